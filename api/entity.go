@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// EntityID identifies a durable entity, which is a stateful object that processes the operations that are sent to it
+// one at a time. Entity names are case-insensitive, but keys are case-sensitive.
+type EntityID struct {
+	Name string
+	Key  string
+}
+
+// NewEntityID returns the ID of the entity with the specified name and key.
+func NewEntityID(name string, key string) EntityID {
+	return EntityID{Name: strings.ToLower(name), Key: key}
+}
+
+// String returns the ID of the entity in the "@name@key" format, which is also the instance ID of the orchestration
+// that runs the entity.
+func (id EntityID) String() string {
+	return "@" + strings.ToLower(id.Name) + "@" + id.Key
+}
+
+// InstanceID returns the instance ID of the orchestration that runs the entity.
+func (id EntityID) InstanceID() InstanceID {
+	return InstanceID(id.String())
+}
+
+// EntityIDFromInstanceID returns the ID of the entity that's run by the orchestration with the specified instance ID,
+// or false if the instance ID isn't the ID of an entity.
+func EntityIDFromInstanceID(id InstanceID) (EntityID, bool) {
+	s := string(id)
+	if !strings.HasPrefix(s, "@") {
+		return EntityID{}, false
+	}
+	name, key, ok := strings.Cut(s[1:], "@")
+	if !ok || name == "" {
+		return EntityID{}, false
+	}
+	return EntityID{Name: name, Key: key}, true
+}
+
+// EntityMetadata is the state of an entity.
+type EntityMetadata struct {
+	ID EntityID
+
+	// SerializedState is the serialized state of the entity, or empty if the entity doesn't have a state.
+	SerializedState string
+
+	// LastModifiedAt is the time at which the entity last processed an operation.
+	LastModifiedAt time.Time
+}
+
+// SignalEntityOptions configures options for signaling an entity.
+type SignalEntityOptions func(*protos.RaiseEventRequest) error
+
+// WithSignalInput configures an input for the entity operation. The specified input must be serializable.
+func WithSignalInput(input any) SignalEntityOptions {
+	return func(req *protos.RaiseEventRequest) error {
+		bytes, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		req.Input = wrapperspb.String(string(bytes))
+		return nil
+	}
+}
+
+// WithRawSignalInput configures a raw input for the entity operation.
+func WithRawSignalInput(input string) SignalEntityOptions {
+	return func(req *protos.RaiseEventRequest) error {
+		req.Input = wrapperspb.String(input)
+		return nil
+	}
+}
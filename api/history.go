@@ -0,0 +1,188 @@
+package api
+
+import (
+	"time"
+
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// HistoryEventType is the type of an orchestration history event.
+type HistoryEventType string
+
+const (
+	HistoryEventExecutionStarted                  HistoryEventType = "ExecutionStarted"
+	HistoryEventExecutionCompleted                HistoryEventType = "ExecutionCompleted"
+	HistoryEventExecutionTerminated               HistoryEventType = "ExecutionTerminated"
+	HistoryEventExecutionSuspended                HistoryEventType = "ExecutionSuspended"
+	HistoryEventExecutionResumed                  HistoryEventType = "ExecutionResumed"
+	HistoryEventTaskScheduled                     HistoryEventType = "TaskScheduled"
+	HistoryEventTaskCompleted                     HistoryEventType = "TaskCompleted"
+	HistoryEventTaskFailed                        HistoryEventType = "TaskFailed"
+	HistoryEventSubOrchestrationInstanceCreated   HistoryEventType = "SubOrchestrationInstanceCreated"
+	HistoryEventSubOrchestrationInstanceCompleted HistoryEventType = "SubOrchestrationInstanceCompleted"
+	HistoryEventSubOrchestrationInstanceFailed    HistoryEventType = "SubOrchestrationInstanceFailed"
+	HistoryEventTimerCreated                      HistoryEventType = "TimerCreated"
+	HistoryEventTimerFired                        HistoryEventType = "TimerFired"
+	HistoryEventOrchestratorStarted               HistoryEventType = "OrchestratorStarted"
+	HistoryEventOrchestratorCompleted             HistoryEventType = "OrchestratorCompleted"
+	HistoryEventEventSent                         HistoryEventType = "EventSent"
+	HistoryEventEventRaised                       HistoryEventType = "EventRaised"
+	HistoryEventContinueAsNew                     HistoryEventType = "ContinueAsNew"
+	HistoryEventGeneric                           HistoryEventType = "GenericEvent"
+	HistoryEventUnknown                           HistoryEventType = "Unknown"
+)
+
+// HistoryEvent is an event in the history of an orchestration instance. Unlike the protobuf messages that are saved
+// by the backends, its fields are stable across releases, so that tooling can use it to render orchestration timelines
+// and debug stuck orchestrations. Fields that don't apply to the type of the event are empty.
+type HistoryEvent struct {
+	// Type is the type of the event.
+	Type HistoryEventType
+
+	// EventID is the ID of the task that the event schedules, e.g. of a TaskScheduled event, or -1 for other events.
+	EventID int32
+
+	// TaskID is the ID of the task that the event is about, e.g. the ID of the activity task that a TaskCompleted
+	// event completes, or -1 if the event isn't about a task.
+	TaskID int32
+
+	// Timestamp is the time at which the event was created.
+	Timestamp time.Time
+
+	// Name is the name of the orchestration, activity, sub-orchestration, or external event.
+	Name string
+
+	// InstanceID is the instance ID of the created sub-orchestration, or the target of a sent event.
+	InstanceID InstanceID
+
+	// Input is the serialized input of the orchestration, activity, or sub-orchestration, the payload of an
+	// external event, or the reason of a termination, suspension, or resumption.
+	Input string
+
+	// Output is the serialized result of a completed activity, sub-orchestration, or orchestration.
+	Output string
+
+	// RuntimeStatus is the final runtime status of the orchestration for ExecutionCompleted events.
+	RuntimeStatus protos.OrchestrationStatus
+
+	// FireAt is the time at which a durable timer fires for TimerCreated and TimerFired events, or the scheduled
+	// start time of an orchestration for ExecutionStarted events.
+	FireAt time.Time
+
+	// Failure describes why an activity, sub-orchestration, or orchestration failed, or nil if it didn't fail.
+	Failure *FailureDetails
+}
+
+// FailureDetails describes the failure of an activity, sub-orchestration, or orchestration.
+type FailureDetails struct {
+	// ErrorType is the type of the error, e.g. the name of the Go error type.
+	ErrorType string
+
+	// ErrorMessage is the message of the error.
+	ErrorMessage string
+
+	// StackTrace is the stack trace of the error, if it was captured.
+	StackTrace string
+
+	// InnerFailure is the failure that caused this failure, if any.
+	InnerFailure *FailureDetails
+}
+
+// NewHistoryEvent converts a history event that was saved by a backend to its stable representation.
+func NewHistoryEvent(e *protos.HistoryEvent) *HistoryEvent {
+	event := &HistoryEvent{
+		Type:      HistoryEventUnknown,
+		EventID:   e.EventId,
+		TaskID:    helpers.GetTaskId(e),
+		Timestamp: e.Timestamp.AsTime(),
+	}
+	switch {
+	case e.GetExecutionStarted() != nil:
+		es := e.GetExecutionStarted()
+		event.Type = HistoryEventExecutionStarted
+		event.Name = es.Name
+		event.Input = es.Input.GetValue()
+		if es.ScheduledStartTimestamp != nil {
+			event.FireAt = es.ScheduledStartTimestamp.AsTime()
+		}
+	case e.GetExecutionCompleted() != nil:
+		ec := e.GetExecutionCompleted()
+		event.Type = HistoryEventExecutionCompleted
+		event.Output = ec.Result.GetValue()
+		event.RuntimeStatus = ec.OrchestrationStatus
+		event.Failure = newFailureDetails(ec.FailureDetails)
+	case e.GetExecutionTerminated() != nil:
+		event.Type = HistoryEventExecutionTerminated
+		event.Input = e.GetExecutionTerminated().Input.GetValue()
+	case e.GetExecutionSuspended() != nil:
+		event.Type = HistoryEventExecutionSuspended
+		event.Input = e.GetExecutionSuspended().Input.GetValue()
+	case e.GetExecutionResumed() != nil:
+		event.Type = HistoryEventExecutionResumed
+		event.Input = e.GetExecutionResumed().Input.GetValue()
+	case e.GetTaskScheduled() != nil:
+		ts := e.GetTaskScheduled()
+		event.Type = HistoryEventTaskScheduled
+		event.Name = ts.Name
+		event.Input = ts.Input.GetValue()
+	case e.GetTaskCompleted() != nil:
+		event.Type = HistoryEventTaskCompleted
+		event.Output = e.GetTaskCompleted().Result.GetValue()
+	case e.GetTaskFailed() != nil:
+		event.Type = HistoryEventTaskFailed
+		event.Failure = newFailureDetails(e.GetTaskFailed().FailureDetails)
+	case e.GetSubOrchestrationInstanceCreated() != nil:
+		sc := e.GetSubOrchestrationInstanceCreated()
+		event.Type = HistoryEventSubOrchestrationInstanceCreated
+		event.Name = sc.Name
+		event.InstanceID = InstanceID(sc.InstanceId)
+		event.Input = sc.Input.GetValue()
+	case e.GetSubOrchestrationInstanceCompleted() != nil:
+		event.Type = HistoryEventSubOrchestrationInstanceCompleted
+		event.Output = e.GetSubOrchestrationInstanceCompleted().Result.GetValue()
+	case e.GetSubOrchestrationInstanceFailed() != nil:
+		event.Type = HistoryEventSubOrchestrationInstanceFailed
+		event.Failure = newFailureDetails(e.GetSubOrchestrationInstanceFailed().FailureDetails)
+	case e.GetTimerCreated() != nil:
+		event.Type = HistoryEventTimerCreated
+		event.FireAt = e.GetTimerCreated().FireAt.AsTime()
+	case e.GetTimerFired() != nil:
+		event.Type = HistoryEventTimerFired
+		event.FireAt = e.GetTimerFired().FireAt.AsTime()
+	case e.GetOrchestratorStarted() != nil:
+		event.Type = HistoryEventOrchestratorStarted
+	case e.GetOrchestratorCompleted() != nil:
+		event.Type = HistoryEventOrchestratorCompleted
+	case e.GetEventSent() != nil:
+		es := e.GetEventSent()
+		event.Type = HistoryEventEventSent
+		event.Name = es.Name
+		event.InstanceID = InstanceID(es.InstanceId)
+		event.Input = es.Input.GetValue()
+	case e.GetEventRaised() != nil:
+		er := e.GetEventRaised()
+		event.Type = HistoryEventEventRaised
+		event.Name = er.Name
+		event.Input = er.Input.GetValue()
+	case e.GetContinueAsNew() != nil:
+		event.Type = HistoryEventContinueAsNew
+		event.Input = e.GetContinueAsNew().Input.GetValue()
+	case e.GetGenericEvent() != nil:
+		event.Type = HistoryEventGeneric
+		event.Input = e.GetGenericEvent().Data
+	}
+	return event
+}
+
+func newFailureDetails(fd *protos.TaskFailureDetails) *FailureDetails {
+	if fd == nil {
+		return nil
+	}
+	return &FailureDetails{
+		ErrorType:    fd.ErrorType,
+		ErrorMessage: fd.ErrorMessage,
+		StackTrace:   fd.StackTrace.GetValue(),
+		InnerFailure: newFailureDetails(fd.InnerFailure),
+	}
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,10 +15,13 @@ import (
 )
 
 var (
-	ErrInstanceNotFound = errors.New("no such instance exists")
-	ErrNotStarted       = errors.New("orchestration has not started")
-	ErrNotCompleted     = errors.New("orchestration has not yet completed")
-	ErrNoFailures       = errors.New("orchestration did not report failure details")
+	ErrInstanceNotFound     = errors.New("no such instance exists")
+	ErrNotStarted           = errors.New("orchestration has not started")
+	ErrNotCompleted         = errors.New("orchestration has not yet completed")
+	ErrNoFailures           = errors.New("orchestration did not report failure details")
+	ErrNoCustomStatus       = errors.New("orchestration did not set a custom status")
+	ErrPreconditionFailed   = errors.New("orchestration is not in one of the expected states")
+	ErrUnknownOrchestration = errors.New("no worker can execute the orchestration")
 
 	EmptyInstanceID = InstanceID("")
 )
@@ -24,6 +29,13 @@ var (
 // InstanceID is a unique identifier for an orchestration instance.
 type InstanceID string
 
+// idempotentInstanceIDPrefix is the prefix of the instance IDs that are derived from idempotency keys.
+const idempotentInstanceIDPrefix = "idempotent-"
+
+// IdempotencyKeyTag is the tag that stores the idempotency key of orchestrations that are scheduled using
+// [WithIdempotencyKey].
+const IdempotencyKeyTag = "durabletask.idempotency-key"
+
 type OrchestrationMetadata struct {
 	InstanceID             InstanceID
 	Name                   string
@@ -34,6 +46,15 @@ type OrchestrationMetadata struct {
 	SerializedOutput       string
 	SerializedCustomStatus string
 	FailureDetails         *protos.TaskFailureDetails
+
+	// GenerationCount is the number of times the orchestration has continued-as-new. It's reset only when the
+	// orchestration instance is scheduled anew, not when the orchestration is restarted or its worker is restarted.
+	// An unusually large value can indicate an orchestration that's stuck in a continue-as-new loop.
+	GenerationCount int
+
+	// Tags are the tags that the orchestration was created with, e.g. to correlate it with a tenant or a job. See
+	// [WithTags].
+	Tags map[string]string
 }
 
 // NewOrchestrationOptions configures options for starting a new orchestration.
@@ -48,6 +69,183 @@ type RaiseEventOptions func(*protos.RaiseEventRequest) error
 // TerminateOptions is a set of options for terminating an orchestration.
 type TerminateOptions func(*protos.TerminateRequest) error
 
+// WaitOrchestrationOptions is a set of options for waiting on an orchestration to start or complete.
+type WaitOrchestrationOptions func(*WaitOrchestrationConfig)
+
+// WaitOrchestrationConfig controls how often an orchestration's metadata is polled while waiting on it.
+// The first poll happens after InitialInterval, and each subsequent interval is multiplied by Multiplier
+// until it reaches MaxInterval. Each interval is randomized by up to Jitter times its length, so that many clients
+// waiting on orchestrations don't poll the backend in lockstep.
+type WaitOrchestrationConfig struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+}
+
+// PurgeOptions is a set of options for purging the state of completed orchestrations.
+type PurgeOptions func(*PurgeConfig)
+
+// PurgeConfig controls which orchestration instances are purged.
+type PurgeConfig struct {
+	// Recursive configures whether the sub-orchestrations created by a purged orchestration are purged as well.
+	Recursive bool
+
+	// RuntimeStatuses restricts a time-based purge to completed orchestrations with one of these runtime statuses.
+	// All completed orchestrations are eligible if it's empty.
+	RuntimeStatuses []protos.OrchestrationStatus
+}
+
+// PurgeResult is the result of purging the state of orchestrations.
+type PurgeResult struct {
+	// DeletedInstanceCount is the number of orchestration instances whose state was deleted.
+	DeletedInstanceCount int
+}
+
+// RestartOptions is a set of options for restarting an orchestration.
+type RestartOptions func(*RestartConfig)
+
+// RestartConfig controls how an orchestration is restarted.
+type RestartConfig struct {
+	// NewInstanceID configures whether the restarted orchestration gets a new, random instance ID. Otherwise, the
+	// original orchestration is purged and its instance ID is reused.
+	NewInstanceID bool
+}
+
+// DefaultInstanceQueryPageSize is the maximum number of orchestration instances returned for an [InstanceQuery] that
+// doesn't specify a page size.
+const DefaultInstanceQueryPageSize = 100
+
+// InstanceQuery selects the orchestration instances to list. Only the instances that match all of the specified
+// criteria are returned, in the order of their instance IDs.
+type InstanceQuery struct {
+	// RuntimeStatuses restricts the query to orchestrations with one of these runtime statuses. All statuses
+	// match if it's empty.
+	RuntimeStatuses []protos.OrchestrationStatus
+
+	// Name restricts the query to orchestrations with this name. All names match if it's empty.
+	Name string
+
+	// NamePrefix restricts the query to orchestrations whose names start with this prefix. All names match if it's
+	// empty. Like Tags, it's applied to the instances that match the other filters.
+	NamePrefix string
+
+	// CreatedFrom restricts the query to orchestrations that were created at or after this time. It's ignored if zero.
+	CreatedFrom time.Time
+
+	// CreatedTo restricts the query to orchestrations that were created before this time. It's ignored if zero.
+	CreatedTo time.Time
+
+	// CompletedBefore restricts the query to completed orchestrations that completed before this time. It's ignored
+	// if zero. Like Tags, it's applied to the instances that match the other filters.
+	CompletedBefore time.Time
+
+	// InstanceIDPrefix restricts the query to orchestrations whose instance IDs start with this prefix.
+	InstanceIDPrefix string
+
+	// Tags restricts the query to orchestrations that have all of these tags, with the same values. All tags match if
+	// it's empty. Like CustomStatusContains, it's applied to the instances that match the other filters.
+	Tags map[string]string
+
+	// TagFilter restricts the query to orchestrations whose tags match this expression, e.g.
+	// AllTags(TagEquals("env", "prod"), TagNotEquals("team", "legacy")). All tags match if it's nil. It's combined
+	// with Tags, so that orchestrations must match both.
+	//
+	// The filter is always applied to the instances that the backend returns, like Tags. The sqlite, in-memory, and
+	// bolt backends also evaluate it in their queries, so that they only return matching instances. The other
+	// backends return all the instances that match the other filters, which are then scanned to fill each page, so a
+	// selective filter can take many round trips to the backend. In sqlite, each predicate parses the tags of every
+	// instance that matches the other filters, so complex expressions are best combined with selective filters such
+	// as Name, RuntimeStatuses, or a creation time range.
+	TagFilter *TagFilter
+
+	// CustomStatusContains restricts the query to orchestrations whose serialized custom status contains this string.
+	// All custom statuses match if it's empty. The filter is applied to the instances that match the other filters,
+	// so it can scan many instances to fill a page if only a few of them match.
+	CustomStatusContains string
+
+	// PageSize is the maximum number of orchestration instances to return. [DefaultInstanceQueryPageSize] is used
+	// if it's zero or negative.
+	PageSize int
+
+	// ContinuationToken is the token returned with the previous page of results, or empty to fetch the first page.
+	ContinuationToken string
+}
+
+// PageSizeOrDefault returns the page size of the query, or [DefaultInstanceQueryPageSize] if it isn't set.
+func (q InstanceQuery) PageSizeOrDefault() int {
+	if q.PageSize <= 0 {
+		return DefaultInstanceQueryPageSize
+	}
+	return q.PageSize
+}
+
+// InstanceQueryResult is a page of the orchestration instances that match an [InstanceQuery].
+type InstanceQueryResult struct {
+	// Instances is the metadata of the orchestration instances in this page.
+	Instances []*OrchestrationMetadata
+
+	// ContinuationToken is the token to set on the query to fetch the next page of results. It's empty if this
+	// is the last page. Tokens are opaque and are only valid for the backend that returned them.
+	ContinuationToken string
+}
+
+// OrchestrationStats contains aggregate execution statistics for the orchestrations with a specific name.
+//
+// Duration statistics are computed from the creation and completion timestamps of the orchestrations that completed
+// within the requested time window, so they don't include orchestrations that are still running. For orchestrations that
+// continued-as-new, the duration is that of the most recent execution.
+type OrchestrationStats struct {
+	// Name is the name of the orchestrations that the statistics were computed for.
+	Name string
+
+	// Started is the number of orchestrations that were created within the time window.
+	Started int
+
+	// Completed is the number of orchestrations that completed successfully within the time window.
+	Completed int
+
+	// Failed is the number of orchestrations that failed within the time window.
+	Failed int
+
+	// AverageDuration is the mean duration of the orchestrations that completed successfully or failed within the
+	// time window, or zero if there were none.
+	AverageDuration time.Duration
+
+	// P95Duration is the 95th percentile duration of the orchestrations that completed successfully or failed within
+	// the time window, or zero if there were none.
+	P95Duration time.Duration
+}
+
+// FaultType is the type of fault that can be injected into an orchestration for chaos testing.
+type FaultType int
+
+const (
+	// FaultFailNextActivity fails the next activity that the orchestration schedules, without executing it.
+	FaultFailNextActivity FaultType = iota + 1
+
+	// FaultDelayNextTimer delays the next durable timer that the orchestration creates.
+	FaultDelayNextTimer
+
+	// FaultDropNextEvent drops the next external event that's raised to the orchestration.
+	FaultDropNextEvent
+)
+
+// FaultSpec describes a fault to inject into an orchestration for chaos testing.
+type FaultSpec struct {
+	// Type is the type of fault to inject.
+	Type FaultType `json:"type"`
+
+	// Message is the error message of the activity failure for [FaultFailNextActivity].
+	Message string `json:"message,omitempty"`
+
+	// Delay is how long the timer is delayed for [FaultDelayNextTimer].
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// EventName restricts [FaultDropNextEvent] to events with this name. Events with any name are dropped if empty.
+	EventName string `json:"eventName,omitempty"`
+}
+
 // WithInstanceID configures an explicit orchestration instance ID. If not specified,
 // a random UUID value will be used for the orchestration instance ID.
 func WithInstanceID(id InstanceID) NewOrchestrationOptions {
@@ -57,6 +255,120 @@ func WithInstanceID(id InstanceID) NewOrchestrationOptions {
 	}
 }
 
+// InstanceIDReuseAction is the action that scheduling a new orchestration takes when its instance ID is already in
+// use.
+type InstanceIDReuseAction int
+
+const (
+	// InstanceIDReuseError fails the request with the error returned by the backend.
+	InstanceIDReuseError InstanceIDReuseAction = iota
+
+	// InstanceIDReuseUseExisting returns the ID of the existing instance without scheduling a new one.
+	InstanceIDReuseUseExisting
+
+	// InstanceIDReuseOverwrite purges the existing instance and schedules a new one with the same ID. Only completed
+	// instances can be overwritten; [ErrNotCompleted] is returned for running instances.
+	InstanceIDReuseOverwrite
+
+	// InstanceIDReuseTerminateAndReplace is like InstanceIDReuseOverwrite, but first terminates the existing
+	// instance, and its sub-orchestrations, if it isn't completed yet. The client waits for a worker to process the
+	// termination, so scheduling blocks until then, until the replace timeout of the client elapses, or until the
+	// context of the request is cancelled.
+	InstanceIDReuseTerminateAndReplace
+)
+
+// WithInstanceIDReusePolicy configures what scheduling the orchestration does if its instance ID is already in use,
+// regardless of the state of the existing instance. It takes precedence over the collision handler and the instance
+// ID reuse policy of the client, for this request only.
+//
+// Replacing an instance isn't atomic: the existing instance is terminated, purged, and then created again, so a
+// concurrent request with the same instance ID can create it in between, in which case the request fails as if the
+// policy was [InstanceIDReuseError].
+func WithInstanceIDReusePolicy(action InstanceIDReuseAction) NewOrchestrationOptions {
+	return func(req *protos.CreateInstanceRequest) error {
+		if action < InstanceIDReuseError || action > InstanceIDReuseTerminateAndReplace {
+			return fmt.Errorf("unknown instance ID reuse action: %d", action)
+		}
+		helpers.SetInstanceIDReuseAction(req, int(action))
+		return nil
+	}
+}
+
+// WithIdempotencyKey configures an idempotency key for the orchestration, so that retrying a request to schedule it,
+// e.g. after a network timeout, doesn't create a duplicate orchestration. The instance ID of the orchestration is
+// derived from the key using [IdempotentInstanceID], and backends reject duplicate instance IDs. The key is stored
+// with the orchestration as the [IdempotencyKeyTag] tag, and retried requests return the ID of the existing
+// orchestration instead of failing, as long as they schedule an orchestration with the same name and key. Requests
+// that collide with an orchestration that wasn't scheduled with the same key fail as usual. The key can be reused
+// once the orchestration is purged.
+//
+// An instance ID that's specified using [WithInstanceID] takes precedence over the idempotency key.
+func WithIdempotencyKey(key string) NewOrchestrationOptions {
+	return func(req *protos.CreateInstanceRequest) error {
+		if key == "" {
+			return errors.New("the idempotency key must not be empty")
+		}
+		if req.InstanceId == "" {
+			req.InstanceId = string(IdempotentInstanceID(key))
+		}
+		return WithTags(map[string]string{IdempotencyKeyTag: key})(req)
+	}
+}
+
+// IdempotentInstanceID returns the instance ID of the orchestrations that are scheduled with the specified idempotency
+// key using [WithIdempotencyKey].
+func IdempotentInstanceID(key string) InstanceID {
+	sum := sha256.Sum256([]byte(key))
+	return InstanceID(idempotentInstanceIDPrefix + hex.EncodeToString(sum[:16]))
+}
+
+// IdempotencyKey returns the idempotency key that the orchestration was scheduled with using [WithIdempotencyKey], or
+// an empty string if it wasn't scheduled with one.
+func (m *OrchestrationMetadata) IdempotencyKey() string {
+	return m.Tags[IdempotencyKeyTag]
+}
+
+// WithVersion configures the version of the orchestration, which workers use to dispatch the orchestration to the
+// matching version of the orchestrator function, so that in-flight orchestrations keep running the code they were
+// started with during rolling upgrades. The version is kept when the orchestration continues as new. Orchestrations
+// fail if the worker that runs them has no orchestrator function registered with the version.
+func WithVersion(version string) NewOrchestrationOptions {
+	return func(req *protos.CreateInstanceRequest) error {
+		req.Version = wrapperspb.String(version)
+		return nil
+	}
+}
+
+// WithTags configures tags for the orchestration, e.g. to correlate it with a tenant, a job, or the origin of the
+// request. Tags are returned with the metadata of the orchestration, can be used to filter instance queries, and are
+// kept when the orchestration continues as new. Tags from multiple WithTags options are merged.
+func WithTags(tags map[string]string) NewOrchestrationOptions {
+	return func(req *protos.CreateInstanceRequest) error {
+		merged := helpers.GetTags(req)
+		if merged == nil {
+			merged = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			merged[k] = v
+		}
+		helpers.SetTags(req, merged)
+		return nil
+	}
+}
+
+// WithOrchestrationTimeout configures how long the orchestration can run before it's automatically terminated or
+// failed, depending on the timeout policy of the orchestration worker. The timeout starts when the orchestration is
+// scheduled to start, and isn't reset when the orchestration continues as new.
+func WithOrchestrationTimeout(timeout time.Duration) NewOrchestrationOptions {
+	return func(req *protos.CreateInstanceRequest) error {
+		if timeout <= 0 {
+			return fmt.Errorf("the orchestration timeout must be positive: %v", timeout)
+		}
+		helpers.SetOrchestrationTimeout(req, timeout)
+		return nil
+	}
+}
+
 // WithInput configures an input for the orchestration. The specified input must be serializable.
 func WithInput(input any) NewOrchestrationOptions {
 	return func(req *protos.CreateInstanceRequest) error {
@@ -80,7 +392,17 @@ func WithRawInput(rawInput string) NewOrchestrationOptions {
 // WithStartTime configures a start time at which the orchestration should start running.
 // Note that the actual start time could be later than the specified start time if the
 // task hub is under load or if the app is not running at the specified start time.
+//
+// Deprecated: Use WithScheduledStartTime instead.
 func WithStartTime(startTime time.Time) NewOrchestrationOptions {
+	return WithScheduledStartTime(startTime)
+}
+
+// WithScheduledStartTime configures a time before which the orchestration won't start running. The orchestration
+// remains in the pending state until then. A scheduled start time in the past has no effect.
+// Note that the actual start time could be later than the specified start time if the
+// task hub is under load or if the app is not running at the specified start time.
+func WithScheduledStartTime(startTime time.Time) NewOrchestrationOptions {
 	return func(req *protos.CreateInstanceRequest) error {
 		req.ScheduledStartTimestamp = timestamppb.New(startTime)
 		return nil
@@ -94,6 +416,27 @@ func WithFetchPayloads(fetchPayloads bool) FetchOrchestrationMetadataOptions {
 	}
 }
 
+// WithPollingBackoff configures how often the orchestration metadata is polled while waiting on an orchestration.
+// Polling starts at initialInterval and backs off by multiplier on each poll, up to maxInterval. Use a small initial
+// interval for short-lived orchestrations, and a large maximum interval for long-running ones. A multiplier of 1
+// polls at a fixed interval.
+func WithPollingBackoff(initialInterval time.Duration, maxInterval time.Duration, multiplier float64) WaitOrchestrationOptions {
+	return func(c *WaitOrchestrationConfig) {
+		c.InitialInterval = initialInterval
+		c.MaxInterval = maxInterval
+		c.Multiplier = multiplier
+	}
+}
+
+// WithPollingJitter configures the fraction, between 0 and 1, by which each polling interval is randomized while
+// waiting on an orchestration. For example, a jitter of 0.2 polls between 80% and 120% of the configured interval.
+// The default is 0.05. A jitter of 0 polls at exactly the configured intervals.
+func WithPollingJitter(jitter float64) WaitOrchestrationOptions {
+	return func(c *WaitOrchestrationConfig) {
+		c.Jitter = jitter
+	}
+}
+
 // WithEventPayload configures an event payload. The specified payload must be serializable.
 func WithEventPayload(data any) RaiseEventOptions {
 	return func(req *protos.RaiseEventRequest) error {
@@ -142,6 +485,30 @@ func WithRecursive(recursive bool) TerminateOptions {
 	}
 }
 
+// WithRecursivePurge configures whether to also purge the sub-orchestrations created by the purged orchestrations.
+// Sub-orchestrations that are still running are left untouched.
+func WithRecursivePurge(recursive bool) PurgeOptions {
+	return func(c *PurgeConfig) {
+		c.Recursive = recursive
+	}
+}
+
+// WithPurgeRuntimeStatus configures the runtime statuses of the completed orchestrations that a time-based purge
+// deletes. Statuses of orchestrations that aren't completed are ignored.
+func WithPurgeRuntimeStatus(statuses ...protos.OrchestrationStatus) PurgeOptions {
+	return func(c *PurgeConfig) {
+		c.RuntimeStatuses = append(c.RuntimeStatuses, statuses...)
+	}
+}
+
+// WithRestartNewInstanceID configures whether a restarted orchestration gets a new, random instance ID, which keeps
+// the state of the original orchestration around, instead of replacing the original orchestration.
+func WithRestartNewInstanceID(newInstanceID bool) RestartOptions {
+	return func(c *RestartConfig) {
+		c.NewInstanceID = newInstanceID
+	}
+}
+
 func NewOrchestrationMetadata(
 	iid InstanceID,
 	name string,
@@ -166,6 +533,69 @@ func NewOrchestrationMetadata(
 	}
 }
 
+// ReadCustomStatus deserializes the custom status of an orchestration into a value of type T.
+// It returns [ErrNoCustomStatus] if the orchestration didn't set a custom status. Note that
+// custom status values are only available when the metadata is fetched with payloads.
+func ReadCustomStatus[T any](m *OrchestrationMetadata) (T, error) {
+	var status T
+	if m.SerializedCustomStatus == "" {
+		return status, ErrNoCustomStatus
+	}
+	if err := json.Unmarshal([]byte(m.SerializedCustomStatus), &status); err != nil {
+		return status, fmt.Errorf("failed to unmarshal the custom status: %w", err)
+	}
+	return status, nil
+}
+
+// LazyValue is a serialized orchestration payload that's only deserialized when it's read, which avoids the cost
+// of deserializing large payloads for callers that only inspect the status of an orchestration.
+//
+// A LazyValue is immutable and safe for concurrent use. It doesn't cache deserialized values, since each call to
+// [LazyValue.Into] can deserialize into a different type, so callers that read a value repeatedly should keep the
+// deserialized value instead.
+type LazyValue struct {
+	data string
+}
+
+// NewLazyValue returns a [LazyValue] for the specified serialized payload.
+func NewLazyValue(data string) LazyValue {
+	return LazyValue{data: data}
+}
+
+// Into deserializes the value into the specified target, which must be a pointer. The target is left unchanged if
+// the value is empty, e.g. because the orchestration doesn't have an input or hasn't completed.
+func (v LazyValue) Into(target any) error {
+	if target == nil || v.data == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(v.data), target); err != nil {
+		return fmt.Errorf("failed to unmarshal the value: %w", err)
+	}
+	return nil
+}
+
+// IsEmpty returns true if there's no value, e.g. because the orchestration doesn't have an input or hasn't completed.
+func (v LazyValue) IsEmpty() bool {
+	return v.data == ""
+}
+
+// String returns the serialized value.
+func (v LazyValue) String() string {
+	return v.data
+}
+
+// Input returns the input of the orchestration, which is deserialized when it's read. Note that inputs are only
+// available when the metadata is fetched with payloads.
+func (m *OrchestrationMetadata) Input() LazyValue {
+	return NewLazyValue(m.SerializedInput)
+}
+
+// Output returns the output of the orchestration, which is deserialized when it's read. Note that outputs are only
+// available when the metadata is fetched with payloads.
+func (m *OrchestrationMetadata) Output() LazyValue {
+	return NewLazyValue(m.SerializedOutput)
+}
+
 func (m *OrchestrationMetadata) MarshalJSON() ([]byte, error) {
 	obj := make(map[string]any, 16)
 
@@ -186,6 +616,12 @@ func (m *OrchestrationMetadata) MarshalJSON() ([]byte, error) {
 	if m.SerializedCustomStatus != "" {
 		obj["serializedCustomStatus"] = m.SerializedCustomStatus
 	}
+	if m.GenerationCount > 0 {
+		obj["generationCount"] = m.GenerationCount
+	}
+	if len(m.Tags) > 0 {
+		obj["tags"] = m.Tags
+	}
 
 	// Optional failure details (recursive)
 	if m.FailureDetails != nil {
@@ -272,6 +708,15 @@ func (m *OrchestrationMetadata) UnmarshalJSON(data []byte) (err error) {
 	if output, ok := obj["serializedCustomStatus"]; ok {
 		m.SerializedCustomStatus = output.(string)
 	}
+	if generationCount, ok := obj["generationCount"]; ok {
+		m.GenerationCount = int(generationCount.(float64))
+	}
+	if tags, ok := obj["tags"]; ok {
+		m.Tags = make(map[string]string)
+		for k, v := range tags.(map[string]any) {
+			m.Tags[k] = v.(string)
+		}
+	}
 
 	failureDetails, ok := obj["failureDetails"]
 	if ok {
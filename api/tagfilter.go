@@ -0,0 +1,139 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagFilterOp is the operator of a [TagFilter].
+type TagFilterOp int
+
+const (
+	// TagFilterEquals matches orchestrations that have the tag with the value.
+	TagFilterEquals TagFilterOp = iota
+
+	// TagFilterNotEquals matches orchestrations that don't have the tag with the value, including orchestrations that
+	// don't have the tag at all.
+	TagFilterNotEquals
+
+	// TagFilterAnd matches orchestrations that match all of the operands. It matches all orchestrations if there are
+	// no operands.
+	TagFilterAnd
+
+	// TagFilterOr matches orchestrations that match any of the operands. It matches no orchestrations if there are
+	// no operands.
+	TagFilterOr
+)
+
+// TagFilter is an expression over the tags of orchestrations, which is used by [InstanceQuery] to select
+// orchestrations by combinations of tag predicates, e.g. env=prod AND team!=legacy. Use [TagEquals], [TagNotEquals],
+// [AllTags], and [AnyTag] to build expressions.
+type TagFilter struct {
+	// Op is the operator of the expression.
+	Op TagFilterOp
+
+	// Key and Value are the tag compared by TagFilterEquals and TagFilterNotEquals.
+	Key   string
+	Value string
+
+	// Operands are the expressions combined by TagFilterAnd and TagFilterOr.
+	Operands []*TagFilter
+}
+
+// TagEquals returns a filter that matches orchestrations that have the specified tag with the specified value.
+func TagEquals(key, value string) *TagFilter {
+	return &TagFilter{Op: TagFilterEquals, Key: key, Value: value}
+}
+
+// TagNotEquals returns a filter that matches orchestrations that don't have the specified tag with the specified
+// value, including orchestrations that don't have the tag at all.
+func TagNotEquals(key, value string) *TagFilter {
+	return &TagFilter{Op: TagFilterNotEquals, Key: key, Value: value}
+}
+
+// AllTags returns a filter that matches orchestrations that match all of the specified filters.
+func AllTags(filters ...*TagFilter) *TagFilter {
+	return &TagFilter{Op: TagFilterAnd, Operands: filters}
+}
+
+// AnyTag returns a filter that matches orchestrations that match any of the specified filters.
+func AnyTag(filters ...*TagFilter) *TagFilter {
+	return &TagFilter{Op: TagFilterOr, Operands: filters}
+}
+
+// Matches returns true if an orchestration with the specified tags matches the filter. A nil filter matches all
+// orchestrations.
+func (f *TagFilter) Matches(tags map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Op {
+	case TagFilterEquals:
+		actual, ok := tags[f.Key]
+		return ok && actual == f.Value
+	case TagFilterNotEquals:
+		actual, ok := tags[f.Key]
+		return !ok || actual != f.Value
+	case TagFilterAnd:
+		for _, operand := range f.Operands {
+			if !operand.Matches(tags) {
+				return false
+			}
+		}
+		return true
+	case TagFilterOr:
+		for _, operand := range f.Operands {
+			if operand.Matches(tags) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// Validate returns an error if the filter, or any of its operands, has an unknown operator or a nil operand.
+func (f *TagFilter) Validate() error {
+	switch f.Op {
+	case TagFilterEquals, TagFilterNotEquals:
+		return nil
+	case TagFilterAnd, TagFilterOr:
+		for _, operand := range f.Operands {
+			if operand == nil {
+				return fmt.Errorf("invalid tag filter: nil operand")
+			}
+			if err := operand.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid tag filter: unknown operator %d", f.Op)
+	}
+}
+
+// String returns the filter as an expression, e.g. (env=prod AND team!=legacy).
+func (f *TagFilter) String() string {
+	if f == nil {
+		return "<nil>"
+	}
+	switch f.Op {
+	case TagFilterEquals:
+		return f.Key + "=" + f.Value
+	case TagFilterNotEquals:
+		return f.Key + "!=" + f.Value
+	case TagFilterAnd, TagFilterOr:
+		separator := " AND "
+		if f.Op == TagFilterOr {
+			separator = " OR "
+		}
+		operands := make([]string, 0, len(f.Operands))
+		for _, operand := range f.Operands {
+			operands = append(operands, operand.String())
+		}
+		return "(" + strings.Join(operands, separator) + ")"
+	default:
+		return fmt.Sprintf("<unknown operator %d>", f.Op)
+	}
+}
@@ -2,7 +2,10 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
@@ -12,9 +15,34 @@ import (
 	"github.com/microsoft/durabletask-go/internal/protos"
 )
 
+// ErrActivityHeartbeatTimeout is returned when an activity that records heartbeats stops recording them for longer
+// than the timeout configured with [WithActivityHeartbeatTimeout].
+var ErrActivityHeartbeatTimeout = errors.New("the activity stopped recording heartbeats")
+
+// ErrActivityConcurrencyLimit is returned when processing an activity work item while the activity worker is already
+// running as many activities of the same name as allowed by [WithActivityConcurrencyLimits], which only happens with
+// backends that don't implement [BackendWithActivityFilters], or when a single fetch returns more work items of the
+// same name than the limit allows. The worker defers the work item, so that it's processed once an activity of the
+// same name completes.
+var ErrActivityConcurrencyLimit = errors.New("the concurrency limit of the activity was reached")
+
+// ErrActivityQueueNotServed is returned when processing the work item of an activity that's routed to a queue that
+// the activity worker doesn't fetch work items from, which only happens with backends that don't implement
+// [BackendWithActivityQueues]. The worker defers the work item, so that it can be fetched by another worker.
+var ErrActivityQueueNotServed = errors.New("the activity worker doesn't serve the queue of the activity")
+
+// DefaultActivityQueue is the name of the queue of the activities that aren't routed to a dedicated queue.
+const DefaultActivityQueue = ""
+
 type activityProcessor struct {
 	be       Backend
 	executor ActivityExecutor
+	logger   Logger
+	options  *WorkerOptions
+
+	// running is the number of running activities of each name that has a concurrency limit.
+	running   map[string]int
+	runningMu sync.Mutex
 }
 
 type ActivityExecutor interface {
@@ -22,14 +50,21 @@ type ActivityExecutor interface {
 }
 
 func NewActivityTaskWorker(be Backend, executor ActivityExecutor, logger Logger, opts ...NewTaskWorkerOptions) TaskWorker {
-	processor := newActivityProcessor(be, executor)
+	options := NewWorkerOptions()
+	for _, configure := range opts {
+		configure(options)
+	}
+	processor := newActivityProcessor(be, executor, logger, options)
 	return NewTaskWorker(be, processor, logger, opts...)
 }
 
-func newActivityProcessor(be Backend, executor ActivityExecutor) TaskProcessor {
+func newActivityProcessor(be Backend, executor ActivityExecutor, logger Logger, options *WorkerOptions) TaskProcessor {
 	return &activityProcessor{
 		be:       be,
 		executor: executor,
+		logger:   logger,
+		options:  options,
+		running:  make(map[string]int),
 	}
 }
 
@@ -40,9 +75,83 @@ func (*activityProcessor) Name() string {
 
 // FetchWorkItem implements TaskDispatcher
 func (ap *activityProcessor) FetchWorkItem(ctx context.Context) (WorkItem, error) {
+	if be, ok := As[BackendWithActivityFilters](ap.be); ok {
+		wis, err := be.GetActivityWorkItemsWithFilter(ctx, ap.filter(), 1)
+		if err != nil {
+			return nil, err
+		}
+		return wis[0], nil
+	}
+	if be, ok := As[BackendWithActivityQueues](ap.be); ok {
+		wis, err := be.GetActivityWorkItemsFromQueues(ctx, ap.queues(), 1)
+		if err != nil {
+			return nil, err
+		}
+		return wis[0], nil
+	}
 	return ap.be.GetActivityWorkItem(ctx)
 }
 
+// fetchWorkItems implements batchingTaskProcessor
+func (ap *activityProcessor) fetchWorkItems(ctx context.Context, max int) ([]WorkItem, error) {
+	var awis []*ActivityWorkItem
+	var err error
+	if be, ok := As[BackendWithActivityFilters](ap.be); ok {
+		awis, err = be.GetActivityWorkItemsWithFilter(ctx, ap.filter(), max)
+	} else if be, ok := As[BackendWithActivityQueues](ap.be); ok {
+		awis, err = be.GetActivityWorkItemsFromQueues(ctx, ap.queues(), max)
+	} else if be, ok := As[BackendWithActivityBatches](ap.be); ok {
+		awis, err = be.GetActivityWorkItems(ctx, max)
+	} else {
+		awis, err = FetchActivityWorkItems(ctx, max, ap.be.GetActivityWorkItem)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wis := make([]WorkItem, len(awis))
+	for i, awi := range awis {
+		wis[i] = awi
+	}
+	return wis, nil
+}
+
+// filter returns the filter of the activity work items that the activity worker can process right now: the
+// activities that its executor supports, without the ones that already run as many times as their concurrency limits
+// allow.
+func (ap *activityProcessor) filter() ActivityWorkItemFilter {
+	filter := ActivityWorkItemFilter{
+		Queues: ap.queues(),
+		Names:  executorCapabilities(ap.executor).activityNames(),
+	}
+
+	ap.runningMu.Lock()
+	defer ap.runningMu.Unlock()
+	for name, limit := range ap.options.ActivityConcurrencyLimits {
+		if ap.running[name] >= limit {
+			filter.ExcludedNames = append(filter.ExcludedNames, name)
+		}
+	}
+	return filter
+}
+
+// queues returns the queues that the activity worker fetches work items from.
+func (ap *activityProcessor) queues() []string {
+	if len(ap.options.ActivityQueues) == 0 {
+		return []string{DefaultActivityQueue}
+	}
+	return ap.options.ActivityQueues
+}
+
+// servesQueue returns true if the activity worker fetches work items from the specified queue.
+func (ap *activityProcessor) servesQueue(queue string) bool {
+	for _, q := range ap.queues() {
+		if q == queue {
+			return true
+		}
+	}
+	return false
+}
+
 // ProcessWorkItem implements TaskDispatcher
 func (p *activityProcessor) ProcessWorkItem(ctx context.Context, wi WorkItem) error {
 	awi := wi.(*ActivityWorkItem)
@@ -51,6 +160,16 @@ func (p *activityProcessor) ProcessWorkItem(ctx context.Context, wi WorkItem) er
 	if ts == nil {
 		return fmt.Errorf("invalid TaskScheduled event")
 	}
+	if !executorCapabilities(p.executor).SupportsActivity(ts.Name) {
+		return fmt.Errorf("%v: activity '%s' is %w", awi.InstanceID, ts.Name, ErrUnsupportedByExecutor)
+	}
+	if queue := helpers.GetActivityQueue(ts); !p.servesQueue(queue) {
+		return fmt.Errorf("%v: activity '%s' is routed to queue '%s': %w", awi.InstanceID, ts.Name, queue, ErrActivityQueueNotServed)
+	}
+	if !p.startRunning(ts.Name) {
+		return fmt.Errorf("%v: %w: '%s'", awi.InstanceID, ErrActivityConcurrencyLimit, ts.Name)
+	}
+	defer p.stopRunning(ts.Name)
 
 	// Create span as child of spanContext found in TaskScheduledEvent
 	ctx, err := helpers.ContextFromTraceContext(ctx, ts.ParentTraceContext)
@@ -69,7 +188,14 @@ func (p *activityProcessor) ProcessWorkItem(ctx context.Context, wi WorkItem) er
 	}
 
 	// Execute the activity and get its result
-	result, err := p.executor.ExecuteActivity(ctx, awi.InstanceID, awi.NewEvent)
+	heartbeats := &activityHeartbeats{be: p.be, wi: awi}
+	ctx = context.WithValue(ctx, activityHeartbeatsKey{}, heartbeats)
+	var result *protos.HistoryEvent
+	if p.options.ActivityHeartbeatTimeout > 0 || p.options.ActivityCancellationPollingInterval > 0 || helpers.GetActivityTimeout(ts) > 0 {
+		result, err = p.executeWithWatchdog(ctx, awi, heartbeats)
+	} else {
+		result, err = p.executor.ExecuteActivity(ctx, awi.InstanceID, awi.NewEvent)
+	}
 	if err != nil {
 		if span != nil {
 			span.RecordError(err)
@@ -82,6 +208,198 @@ func (p *activityProcessor) ProcessWorkItem(ctx context.Context, wi WorkItem) er
 	return nil
 }
 
+// executeWithWatchdog executes an activity while watching for the conditions in which the worker gives up on it:
+//
+//   - The activity recorded heartbeats and then stopped recording them for longer than the configured heartbeat
+//     timeout. Depending on the configured [ActivityHeartbeatTimeoutPolicy], the activity fails, or its work item is
+//     abandoned so that it's executed again.
+//   - Polling shows that the orchestration that scheduled the activity completed, e.g. because it was terminated,
+//     or was purged. The work item is completed with an "ActivityCanceled" failure, which the orchestration ignores.
+//   - The activity attempt took longer than the timeout that the orchestration configured for it. The activity fails
+//     with an "ActivityTimeout" error.
+//
+// When the worker gives up on an activity, the context of the activity is cancelled, and its result is ignored.
+func (p *activityProcessor) executeWithWatchdog(ctx context.Context, awi *ActivityWorkItem, heartbeats *activityHeartbeats) (*protos.HistoryEvent, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type executionResult struct {
+		result *protos.HistoryEvent
+		err    error
+	}
+	done := make(chan executionResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- executionResult{err: fmt.Errorf("%v: activity panicked: %v", awi.InstanceID, r)}
+			}
+		}()
+		result, err := p.executor.ExecuteActivity(ctx, awi.InstanceID, awi.NewEvent)
+		done <- executionResult{result, err}
+	}()
+
+	// Nil channels are never ready, which disables the checks that aren't configured
+	var heartbeatChecks, cancellationChecks, activityTimeout <-chan time.Time
+	if timeout := helpers.GetActivityTimeout(awi.NewEvent.GetTaskScheduled()); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		activityTimeout = timer.C
+	}
+	timeout := p.options.ActivityHeartbeatTimeout
+	if timeout > 0 {
+		interval := timeout / 4
+		if interval < time.Millisecond {
+			interval = time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeatChecks = ticker.C
+	}
+	if interval := p.options.ActivityCancellationPollingInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		cancellationChecks = ticker.C
+	}
+
+	for {
+		select {
+		case r := <-done:
+			return r.result, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-activityTimeout:
+			timeout := helpers.GetActivityTimeout(awi.NewEvent.GetTaskScheduled())
+			p.logger.Warnf("%s: failing the activity because it didn't complete within %v", awi.Description(), timeout)
+			return helpers.NewTaskFailedEvent(awi.NewEvent.EventId, &protos.TaskFailureDetails{
+				ErrorType:    "ActivityTimeout",
+				ErrorMessage: fmt.Sprintf("the activity didn't complete within %v", timeout),
+			}), nil
+		case <-cancellationChecks:
+			if reason, ok := p.isActivityCanceled(ctx, awi); ok {
+				p.logger.Infof("%s: canceling the activity because %s", awi.Description(), reason)
+				return helpers.NewTaskFailedEvent(awi.NewEvent.EventId, &protos.TaskFailureDetails{
+					ErrorType:    "ActivityCanceled",
+					ErrorMessage: fmt.Sprintf("the activity was canceled because %s; its result is ignored", reason),
+				}), nil
+			}
+		case <-heartbeatChecks:
+			if !heartbeats.expireAfter(timeout) {
+				continue
+			}
+			if p.options.ActivityHeartbeatTimeoutPolicy == ActivityHeartbeatTimeoutAbandon {
+				return nil, fmt.Errorf("%s: %w", awi.Description(), ErrActivityHeartbeatTimeout)
+			}
+			p.logger.Warnf("%s: failing the activity because it stopped recording heartbeats for %v", awi.Description(), timeout)
+			return helpers.NewTaskFailedEvent(awi.NewEvent.EventId, &protos.TaskFailureDetails{
+				ErrorType:    "ActivityHeartbeatTimeout",
+				ErrorMessage: fmt.Sprintf("%v: no heartbeat was recorded for %v", ErrActivityHeartbeatTimeout, timeout),
+			}), nil
+		}
+	}
+}
+
+// startRunning returns true, and counts the activity as running, if the concurrency limit of the activity name
+// allows running one more activity of the name.
+func (p *activityProcessor) startRunning(name string) bool {
+	limit, ok := p.options.ActivityConcurrencyLimits[name]
+	if !ok {
+		return true
+	}
+
+	p.runningMu.Lock()
+	defer p.runningMu.Unlock()
+	if p.running[name] >= limit {
+		return false
+	}
+	p.running[name]++
+	return true
+}
+
+// stopRunning stops counting an activity that was counted as running by startRunning.
+func (p *activityProcessor) stopRunning(name string) {
+	if _, ok := p.options.ActivityConcurrencyLimits[name]; !ok {
+		return
+	}
+
+	p.runningMu.Lock()
+	defer p.runningMu.Unlock()
+	p.running[name]--
+}
+
+// isActivityCanceled returns true, with the reason, if the orchestration that scheduled an activity is completed or
+// no longer exists, in which case the result of the activity would be ignored anyway.
+func (p *activityProcessor) isActivityCanceled(ctx context.Context, awi *ActivityWorkItem) (string, bool) {
+	metadata, err := p.be.GetOrchestrationMetadata(ctx, awi.InstanceID)
+	if errors.Is(err, api.ErrInstanceNotFound) {
+		return "the orchestration no longer exists", true
+	} else if err != nil {
+		// The next check may succeed
+		p.logger.Warnf("%s: failed to check whether the orchestration is still running: %v", awi.Description(), err)
+		return "", false
+	} else if metadata.IsComplete() {
+		return fmt.Sprintf("the orchestration is %s", helpers.ToRuntimeStatusString(metadata.RuntimeStatus)), true
+	}
+	return "", false
+}
+
+// activityHeartbeatsKey is the key of the [activityHeartbeats] of an activity in the context that it's executed with.
+type activityHeartbeatsKey struct{}
+
+// activityHeartbeats keeps track of the heartbeats recorded by an activity.
+type activityHeartbeats struct {
+	be Backend
+	wi *ActivityWorkItem
+
+	mu      sync.Mutex
+	expired bool
+}
+
+// RecordActivityHeartbeat records a heartbeat of the activity that's executed with the specified context, with
+// optional details about its progress. Activity executors call it when activities report that they're still making
+// progress, e.g. using [task.ActivityContext.RecordHeartbeat]. Backends that implement
+// [BackendWithActivityHeartbeats] extend the lock on the work item of the activity.
+//
+// Activities that record heartbeats are given up on by the worker if they stop recording them for longer than the
+// timeout configured with [WithActivityHeartbeatTimeout], in which case [ErrActivityHeartbeatTimeout] is returned.
+// It does nothing if the context isn't the context of an activity.
+func RecordActivityHeartbeat(ctx context.Context, details []byte) error {
+	heartbeats, ok := ctx.Value(activityHeartbeatsKey{}).(*activityHeartbeats)
+	if !ok {
+		return nil
+	}
+	return heartbeats.record(ctx, details)
+}
+
+func (h *activityHeartbeats) record(ctx context.Context, details []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.expired {
+		return ErrActivityHeartbeatTimeout
+	}
+	h.wi.LastHeartbeat = time.Now()
+	h.wi.HeartbeatDetails = details
+	if be, ok := As[BackendWithActivityHeartbeats](h.be); ok {
+		if err := be.RecordActivityHeartbeat(ctx, h.wi); err != nil {
+			return fmt.Errorf("failed to record the activity heartbeat: %w", err)
+		}
+	}
+	return nil
+}
+
+// expireAfter returns true, and rejects any further heartbeats, if the activity recorded heartbeats but didn't record
+// one for longer than the specified timeout.
+func (h *activityHeartbeats) expireAfter(timeout time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.wi.LastHeartbeat.IsZero() || time.Since(h.wi.LastHeartbeat) <= timeout {
+		return false
+	}
+	h.expired = true
+	return true
+}
+
 // CompleteWorkItem implements TaskDispatcher
 func (ap *activityProcessor) CompleteWorkItem(ctx context.Context, wi WorkItem) error {
 	awi := wi.(*ActivityWorkItem)
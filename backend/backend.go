@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/microsoft/durabletask-go/api"
 	"github.com/microsoft/durabletask-go/internal/protos"
@@ -16,8 +17,40 @@ var (
 	ErrNotInitialized        = errors.New("backend not initialized")
 	ErrWorkItemLockLost      = errors.New("lock on work-item was lost")
 	ErrBackendAlreadyStarted = errors.New("backend is already started")
+
+	// ErrNotSupported is returned by the wrappers of backends that don't support an optional operation. Callers
+	// should check whether the operation is supported using [As] instead of calling it.
+	ErrNotSupported = errors.New("the operation isn't supported by the backend")
+
+	// ErrTransient is matched by the errors of backend operations that failed without making any changes, so that
+	// the operation can safely be retried. Backends mark these errors using [TransientError].
+	ErrTransient = errors.New("transient backend error")
 )
 
+// TransientError marks err as transient, so that the returned error matches both err and [ErrTransient].
+func TransientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e transientError) Unwrap() error {
+	return e.err
+}
+
+func (transientError) Is(target error) bool {
+	return target == ErrTransient
+}
+
 type (
 	HistoryEvent       = protos.HistoryEvent
 	TaskFailureDetails = protos.TaskFailureDetails
@@ -43,6 +76,9 @@ type Backend interface {
 
 	// CreateOrchestrationInstance creates a new orchestration instance with a history event that
 	// wraps a ExecutionStarted event.
+	//
+	// Returns [ErrDuplicateEvent] if an orchestration instance with the same ID already exists, whatever its runtime
+	// status. Clients decide whether to reuse the ID, e.g. using [WithInstanceIDReusePolicy].
 	CreateOrchestrationInstance(context.Context, *HistoryEvent) error
 
 	// AddNewEvent adds a new orchestration event to the specified orchestration instance.
@@ -93,6 +129,390 @@ type Backend interface {
 	PurgeOrchestrationState(context.Context, api.InstanceID) error
 }
 
+// BackendWithWatch is implemented by backends that can notify clients when the metadata of an orchestration changes.
+// [TaskHubClient] uses it to wait on orchestrations without polling the backend, so that waiters observe changes
+// as soon as they're saved. Clients fall back to polling for backends that don't implement it.
+type BackendWithWatch interface {
+	Backend
+
+	// WatchOrchestrationRuntimeStatus returns a channel that receives the metadata of the specified orchestration,
+	// starting with its current metadata, and then whenever its runtime status or custom status changes. Changes
+	// may be coalesced if the consumer is slower than the orchestration, so consumers always receive the latest
+	// metadata but not necessarily every intermediate one. The channel is closed when ctx is cancelled, after the
+	// metadata of the completed orchestration was sent, or when the orchestration is purged.
+	//
+	// Returns [api.ErrInstanceNotFound] if the orchestration instance doesn't exist.
+	WatchOrchestrationRuntimeStatus(ctx context.Context, id api.InstanceID) (<-chan *api.OrchestrationMetadata, error)
+}
+
+// BackendWithActivityHeartbeats is implemented by backends that keep track of the heartbeats recorded by activities
+// using [RecordActivityHeartbeat].
+type BackendWithActivityHeartbeats interface {
+	Backend
+
+	// RecordActivityHeartbeat records a heartbeat of the activity of the specified work item. The time and the
+	// details of the heartbeat are in the LastHeartbeat and HeartbeatDetails fields of the work item. Backends extend
+	// the lock on the work item, so that activities that keep recording heartbeats aren't executed again by other
+	// workers, while the activities of crashed workers are executed again once their heartbeats stop and their locks
+	// expire.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	RecordActivityHeartbeat(context.Context, *ActivityWorkItem) error
+}
+
+// BackendWithLockRenewal is implemented by backends that can extend the locks on the work items that are being
+// processed. Workers renew the locks of their work items periodically, as configured with [WithLockRenewalInterval].
+// Work items of other backends that take longer to process than the lock timeout of the backend can be delivered to
+// another worker while they're still being processed.
+type BackendWithLockRenewal interface {
+	Backend
+
+	// RenewOrchestrationWorkItemLock extends the lock on the specified orchestration work item by the lock timeout
+	// of the backend, so that the work item isn't delivered to another worker while it's still being processed.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	RenewOrchestrationWorkItemLock(context.Context, *OrchestrationWorkItem) error
+
+	// RenewActivityWorkItemLock extends the lock on the specified activity work item by the lock timeout of the
+	// backend, so that a long-running activity isn't executed again by another worker while it's still running.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	RenewActivityWorkItemLock(context.Context, *ActivityWorkItem) error
+}
+
+// BackendWithActivityBatches is implemented by backends that can fetch several activity work items in a single round
+// trip. Activity workers configured with [WithFetchBatchSize] fetch the work items of other backends one at a time,
+// using [FetchActivityWorkItems].
+type BackendWithActivityBatches interface {
+	Backend
+
+	// GetActivityWorkItems gets up to max pending activity work items from the task hub in a single round trip, or
+	// returns [ErrNoWorkItems] if there are no pending activity work items.
+	GetActivityWorkItems(ctx context.Context, max int) ([]*ActivityWorkItem, error)
+}
+
+// BackendWithActivityQueues is implemented by backends that can fetch the activity work items of specific queues, so
+// that the activities that are routed to dedicated queues are only fetched by the activity workers that declare
+// these queues using [WithActivityQueues]. The queue of an activity is set by the orchestration that schedules it,
+// e.g. using TaskRegistry.RouteActivityN of the task package.
+type BackendWithActivityQueues interface {
+	Backend
+
+	// GetActivityWorkItemsFromQueues gets up to max pending activity work items from the specified queues, or
+	// returns [ErrNoWorkItems] if there are no pending activity work items in these queues. The default queue, which
+	// contains the activities that aren't routed to a dedicated queue, is named [DefaultActivityQueue].
+	GetActivityWorkItemsFromQueues(ctx context.Context, queues []string, max int) ([]*ActivityWorkItem, error)
+}
+
+// ActivityWorkItemFilter selects the activity work items that are fetched using [BackendWithActivityFilters].
+type ActivityWorkItemFilter struct {
+	// Queues are the queues to fetch activity work items from. A nil slice selects the work items of all queues.
+	Queues []string
+
+	// Names are the names of the activities whose work items are fetched. A nil slice selects the work items of all
+	// activities.
+	Names []string
+
+	// ExcludedNames are the names of the activities whose work items aren't fetched.
+	ExcludedNames []string
+}
+
+// BackendWithActivityFilters is implemented by backends that can leave specific activity work items out when
+// fetching them, so that the work items that an activity worker can't process right now, e.g. because its executor
+// doesn't support their activities, or because it already runs as many activities of their names as
+// [WithActivityConcurrencyLimits] allows, stay available to other workers and don't keep the worker from fetching the
+// work items that it can process.
+type BackendWithActivityFilters interface {
+	Backend
+
+	// GetActivityWorkItemsWithFilter gets up to max pending activity work items that match the filter, or returns
+	// [ErrNoWorkItems] if there are no such work items.
+	GetActivityWorkItemsWithFilter(ctx context.Context, filter ActivityWorkItemFilter, max int) ([]*ActivityWorkItem, error)
+}
+
+// OrchestrationWorkItemFilter selects the orchestration work items that are fetched using
+// [BackendWithOrchestrationFilters].
+type OrchestrationWorkItemFilter struct {
+	// Names are the names of the orchestrations whose work items are fetched. A nil slice selects the work items of
+	// all orchestrations.
+	Names []string
+
+	// IncludeHistoryLength requests that [OrchestrationWorkItem.NextSequenceNumber] is populated, which the
+	// orchestration worker only needs when its runtime state cache is enabled. Backends for which counting the
+	// history events is costly can skip it when it isn't requested.
+	IncludeHistoryLength bool
+}
+
+// BackendWithOrchestrationFilters is implemented by backends that can fetch the work items of specific orchestrations,
+// so that an orchestration worker whose executor only supports some orchestrators, as advertised during the handshake
+// of the gRPC executor, isn't handed the work items of the other orchestrations.
+type BackendWithOrchestrationFilters interface {
+	Backend
+
+	// GetOrchestrationWorkItemWithFilter gets a pending orchestration work item that matches the filter, or returns
+	// [ErrNoWorkItems] if there are no such work items.
+	GetOrchestrationWorkItemWithFilter(ctx context.Context, filter OrchestrationWorkItemFilter) (*OrchestrationWorkItem, error)
+}
+
+// BackendWithDeadLetters is implemented by backends that can move poison work items to a dead-letter store. Workers
+// configured with [WithMaxDeliveryCount] move the work items that were delivered too many times to the dead-letter
+// store instead of processing them again, so that an orchestration or an activity that keeps crashing doesn't wedge
+// the workers. Dead letters can be inspected, resubmitted, and deleted using [TaskHubClient].
+type BackendWithDeadLetters interface {
+	Backend
+
+	// DeadLetterOrchestrationWorkItem moves the new events of the specified orchestration work item to the
+	// dead-letter store, and releases the lock on the orchestration.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	DeadLetterOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, reason string) error
+
+	// DeadLetterActivityWorkItem moves the TaskScheduled event of the specified activity work item to the
+	// dead-letter store.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	DeadLetterActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, reason string) error
+
+	// ListDeadLetters returns the work items in the dead-letter store, in the order in which they were added.
+	ListDeadLetters(ctx context.Context) ([]*DeadLetter, error)
+
+	// ResubmitDeadLetter removes the specified dead letter from the dead-letter store and puts its events back in
+	// the queue that they came from, with a delivery count of zero.
+	//
+	// Returns [ErrDeadLetterNotFound] if the dead letter doesn't exist.
+	ResubmitDeadLetter(ctx context.Context, id int64) error
+
+	// DeleteDeadLetter removes the specified dead letter from the dead-letter store without resubmitting it.
+	//
+	// Returns [ErrDeadLetterNotFound] if the dead letter doesn't exist.
+	DeleteDeadLetter(ctx context.Context, id int64) error
+}
+
+// BackendWithDeferrals is implemented by backends that can release the work items that a worker fetched but can't
+// process right now without counting their delivery, e.g. because an activity reached its concurrency limit, or the
+// circuit of an orchestration is open. Deferred work items are never moved to the dead-letter store by workers
+// configured with [WithMaxDeliveryCount], however often they're deferred. Workers abandon the work items of other
+// backends instead, which counts their delivery.
+type BackendWithDeferrals interface {
+	Backend
+
+	// DeferOrchestrationWorkItem releases the lock on the specified orchestration work item without counting the
+	// delivery of its new events, which become visible again after the delay.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	DeferOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, delay time.Duration) error
+
+	// DeferActivityWorkItem releases the lock on the specified activity work item without counting its delivery.
+	// The work item becomes visible again after the delay.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	DeferActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, delay time.Duration) error
+}
+
+// BackendWithExternalActivityResults is implemented by backends that can complete activity work items without adding
+// their results to the orchestrations, so that the backends that wrap them can deliver the results themselves, e.g.
+// through a message broker.
+type BackendWithExternalActivityResults interface {
+	Backend
+
+	// DeleteActivityWorkItem deletes the specified activity work item without adding its result to the orchestration.
+	//
+	// Returns [ErrWorkItemLockLost] if the work item is no longer locked by this worker.
+	DeleteActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error
+}
+
+// BackendWithQueries is implemented by backends that can query the metadata of orchestration instances with filters.
+// [TaskHubClient.QueryInstances] requires it, and so do the operations that find orchestration instances with queries
+// on backends that don't implement a specialized interface, like [TaskHubClient.PurgeCompletedOrchestrationStates]
+// on backends that don't implement [BackendWithBulkPurge]. These operations return [ErrQueriesNotSupported] for
+// other backends.
+type BackendWithQueries interface {
+	Backend
+
+	// QueryOrchestrationMetadata gets one page of the metadata of the orchestration instances that match the
+	// specified query, in the order of their instance IDs. The continuation token of the result must be set on the
+	// query to get the next page, and is empty if there are no more pages.
+	//
+	// Backends typically fetch one more instance than the page size and use [NewInstanceQueryResult] to build the
+	// result, so that the last page doesn't require an extra round trip.
+	QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error)
+}
+
+// BackendWithLastActions is implemented by backends that save the actions produced by the most recent execution of
+// each orchestration, which orchestration workers configured with [WithPersistLastActions] set in the LastActions
+// field of the runtime state before completing their work items. The actions can then be inspected using
+// [TaskHubClient.GetLastActions].
+type BackendWithLastActions interface {
+	Backend
+
+	// GetOrchestrationLastActions gets the actions produced by the most recent execution of the specified
+	// orchestration instance. An empty list is returned if no actions were saved for the instance, which is
+	// the case when the orchestration worker isn't configured to persist them.
+	//
+	// Returns [api.ErrInstanceNotFound] if the orchestration instance doesn't exist.
+	GetOrchestrationLastActions(context.Context, api.InstanceID) ([]*protos.OrchestratorAction, error)
+}
+
+// BackendWithBulkPurge is implemented by backends that can delete the state of many completed orchestrations at
+// once, e.g. with a single statement per table. [TaskHubClient.PurgeCompletedOrchestrationStates] and
+// [TaskHubClient.PurgeInstancesByFilter] delete one batch at a time, so that purging millions of orchestrations
+// doesn't hold all of their IDs in memory or in a single transaction. They purge the completed orchestrations of
+// other backends one at a time, using [BackendWithQueries.QueryOrchestrationMetadata] to find them one page at a time.
+type BackendWithBulkPurge interface {
+	Backend
+
+	// PurgeOrchestrationStateBatch deletes all saved state for up to query.PageSize orchestration instances that
+	// match the runtime status, name, name prefix, instance ID prefix, creation time, and completion time filters of
+	// the query, in the order of their instance IDs and starting after the query's continuation token. The custom
+	// status and tag filters aren't supported. Orchestration instances that aren't completed are never deleted.
+	//
+	// Returns the number of orchestration instances that were deleted, and the continuation token of the next batch,
+	// which is the ID of the last deleted instance, or empty if there are no more matching instances.
+	PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error)
+}
+
+// BackendWithStats is implemented by backends that can compute the execution statistics of orchestrations with
+// aggregate queries. [TaskHubClient.GetOrchestrationStats] computes the statistics of other backends from the
+// metadata of the orchestrations, using [BackendWithQueries.QueryOrchestrationMetadata].
+type BackendWithStats interface {
+	Backend
+
+	// GetOrchestrationStats computes aggregate execution statistics for the orchestrations with the specified name
+	// that were created or completed at or after the specified time. Backends may compute the statistics using
+	// expensive aggregate queries, and are free to cache the results for a short period of time.
+	GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error)
+}
+
+// BackendWithConditionalEvents is implemented by backends that can check the runtime status of an orchestration and
+// add an event to it atomically. [TaskHubClient.RaiseEventIf] checks the runtime status of the orchestrations of
+// other backends before adding the event, so the event can still be added to an orchestration that completes in
+// between.
+type BackendWithConditionalEvents interface {
+	Backend
+
+	// AddNewOrchestrationEventIf adds a new orchestration event to the specified orchestration instance, but only if
+	// the current runtime status of the instance is one of the specified statuses. Backends should check the status
+	// and add the event atomically.
+	//
+	// Returns [api.ErrInstanceNotFound] if the orchestration instance doesn't exist, or [api.ErrPreconditionFailed]
+	// if its runtime status isn't one of the specified statuses.
+	AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *HistoryEvent, statuses []protos.OrchestrationStatus) error
+}
+
+// BackendWithHistoriesBatch is implemented by backends that can fetch the histories of several orchestrations in a
+// single round trip. [TaskHubClient] loads the runtime state of each orchestration of other backends instead.
+type BackendWithHistoriesBatch interface {
+	Backend
+
+	// GetOrchestrationHistoriesBatch gets the history events of multiple orchestration instances in a single round
+	// trip. The keys of fromSequenceNumbers are the IDs of the orchestration instances and the values are the
+	// sequence numbers of the first history events to return, which allows callers to incrementally fetch only the
+	// events that were added since a previous call. A sequence number of zero returns the full history.
+	//
+	// The histories of all requested orchestration instances are held in memory at the same time, so callers that
+	// fetch large histories should keep batches small, e.g. a few dozen instances per call.
+	//
+	// If some of the histories can't be fetched, the histories that could be fetched are returned together with a
+	// [*HistoryBatchError] that contains the error of each failed instance, such as [api.ErrInstanceNotFound].
+	GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*HistoryEvent, error)
+}
+
+// BackendWithOrphanQueries is implemented by backends that can find orphaned sub-orchestrations by joining the parent
+// links of the orchestrations. [TaskHubClient.FindOrphanedSubOrchestrations] loads the history of each orchestration
+// of other backends to find its parent instead.
+type BackendWithOrphanQueries interface {
+	Backend
+
+	// GetOrphanedSubOrchestrations gets the metadata of the sub-orchestrations that are still pending, running, or
+	// suspended, but whose parent orchestration has completed, failed, or was terminated or purged.
+	GetOrphanedSubOrchestrations(context.Context) ([]*api.OrchestrationMetadata, error)
+}
+
+// BackendWithMigration is implemented by backends that can export and import the complete saved state of
+// orchestration instances, including their pending work. It's required by [ExportTaskHub], [ImportTaskHub], and
+// [TaskHubClient.RewindOrchestration], which return [ErrMigrationNotSupported] for other backends.
+type BackendWithMigration interface {
+	Backend
+
+	// ExportOrchestrationInstance gets the complete saved state of the specified orchestration instance, including
+	// the events and activity tasks that are pending for it.
+	//
+	// Returns [api.ErrInstanceNotFound] if the orchestration instance doesn't exist.
+	ExportOrchestrationInstance(context.Context, api.InstanceID) (*OrchestrationInstanceState, error)
+
+	// ImportOrchestrationInstance saves the complete state of an orchestration instance that was exported from
+	// another backend using [BackendWithMigration.ExportOrchestrationInstance].
+	//
+	// Returns [ErrDuplicateEvent] if the orchestration instance already exists.
+	ImportOrchestrationInstance(context.Context, *OrchestrationInstanceState) error
+}
+
+// BackendWithIngest is implemented by backends that can apply a batch of operations in a single round trip, typically
+// in a single transaction. [TaskHubClient.ScheduleNewOrchestrations] and [IngestStream] use [IngestOperations], which
+// applies the operations one at a time for other backends.
+type BackendWithIngest interface {
+	Backend
+
+	// IngestOperations creates orchestration instances and adds events to existing orchestration instances in a
+	// single round trip. Operations with an ExecutionStarted event are applied like [Backend.CreateOrchestrationInstance]
+	// and other operations like [Backend.AddNewOrchestrationEvent], in order.
+	//
+	// Returns one error for each operation, in the same order, where a nil error means that the operation was
+	// committed. The failure of one operation, such as [ErrDuplicateEvent] for an instance that already exists, must
+	// not prevent the other operations from being committed. A non-nil second return value means that none of the
+	// operations were committed.
+	IngestOperations(ctx context.Context, ops []*IngestOperation) ([]error, error)
+}
+
+// BackendWrapper is implemented by backends that wrap another backend to add behavior to some of its operations,
+// like the backends returned by [NewInstrumentedBackend] and [NewMetadataProjectionBackend].
+//
+// Wrappers that embed the wrapped backend only promote the methods of [Backend], so the optional interfaces of the
+// wrapped backend, like [BackendWithWatch], are only visible through a wrapper that explicitly forwards them. Use
+// [As] instead of a type assertion to check whether a backend supports an optional interface.
+type BackendWrapper interface {
+	Backend
+
+	// Unwrap returns the wrapped backend.
+	Unwrap() Backend
+}
+
+// As returns be as a T, which is one of the optional backend interfaces like [BackendWithWatch], and reports whether
+// be supports T.
+//
+// If be is a [BackendWrapper], it only supports T if it forwards T and every backend that it wraps, directly or
+// indirectly, supports T as well. Wrappers forward the optional interfaces whose operations they don't need to
+// intercept, or that they intercept consistently with the rest of their behavior, so a wrapper that doesn't forward
+// an optional interface hides it, and callers fall back to the operations of [Backend].
+func As[T any](be Backend) (T, bool) {
+	t, ok := be.(T)
+	if !ok {
+		return t, false
+	}
+	for {
+		wrapper, ok := be.(BackendWrapper)
+		if !ok {
+			return t, true
+		}
+		be = wrapper.Unwrap()
+		if _, ok := be.(T); !ok {
+			var zero T
+			return zero, false
+		}
+	}
+}
+
+// HistoryBatchError is returned by [BackendWithHistoriesBatch.GetOrchestrationHistoriesBatch] when the histories of some of the
+// requested orchestration instances couldn't be fetched.
+type HistoryBatchError struct {
+	// Errors contains the error of each orchestration instance whose history couldn't be fetched.
+	Errors map[api.InstanceID]error
+}
+
+func (e *HistoryBatchError) Error() string {
+	return fmt.Sprintf("failed to fetch the history of %d orchestration instance(s)", len(e.Errors))
+}
+
 // MarshalHistoryEvent serializes the [HistoryEvent] into a protobuf byte array.
 func MarshalHistoryEvent(e *HistoryEvent) ([]byte, error) {
 	if bytes, err := proto.Marshal(e); err != nil {
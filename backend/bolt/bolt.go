@@ -0,0 +1,1435 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	bbolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// The buckets of the database file. The history bucket contains a nested bucket for each instance.
+var (
+	instancesBucket = []byte("Instances")
+	historyBucket   = []byte("History")
+	eventsBucket    = []byte("NewEvents")
+	tasksBucket     = []byte("NewTasks")
+)
+
+type BoltOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+	FilePath                 string
+
+	// OpenTimeout is how long to wait for the lock on the database file, which is held by the process that has it
+	// open. Zero means to wait indefinitely.
+	OpenTimeout time.Duration
+}
+
+type boltBackend struct {
+	db         *bbolt.DB
+	workerName string
+	logger     backend.Logger
+	options    *BoltOptions
+}
+
+// store provides access to the state of a task hub within a transaction.
+type store struct {
+	tx *bbolt.Tx
+}
+
+type instanceRecord struct {
+	ID               string                     `json:"id"`
+	Name             string                     `json:"name"`
+	Version          string                     `json:"version,omitempty"`
+	ExecutionID      string                     `json:"executionId,omitempty"`
+	RuntimeStatus    protos.OrchestrationStatus `json:"runtimeStatus"`
+	CreatedTime      time.Time                  `json:"createdTime"`
+	LastUpdatedTime  time.Time                  `json:"lastUpdatedTime"`
+	CompletedTime    time.Time                  `json:"completedTime"`
+	Input            string                     `json:"input,omitempty"`
+	Output           string                     `json:"output,omitempty"`
+	CustomStatus     string                     `json:"customStatus,omitempty"`
+	FailureDetails   []byte                     `json:"failureDetails,omitempty"`
+	ParentInstanceID string                     `json:"parentInstanceId,omitempty"`
+	GenerationCount  int                        `json:"generationCount"`
+	Tags             map[string]string          `json:"tags,omitempty"`
+	HistoryLength    int                        `json:"historyLength"`
+	LastActions      []byte                     `json:"lastActions,omitempty"`
+	LockedBy         string                     `json:"lockedBy,omitempty"`
+	LockExpiration   time.Time                  `json:"lockExpiration"`
+}
+
+type eventRecord struct {
+	InstanceID   string    `json:"instanceId"`
+	VisibleTime  time.Time `json:"visibleTime"` // zero if the event is visible immediately
+	DequeueCount int32     `json:"dequeueCount"`
+	LockedBy     string    `json:"lockedBy,omitempty"`
+	EventPayload []byte    `json:"eventPayload"`
+}
+
+type taskRecord struct {
+	InstanceID     string    `json:"instanceId"`
+	DequeueCount   int32     `json:"dequeueCount"`
+	LockedBy       string    `json:"lockedBy,omitempty"`
+	LockExpiration time.Time `json:"lockExpiration"`
+	EventPayload   []byte    `json:"eventPayload"`
+}
+
+// NewBoltOptions creates a new options object for the bbolt backend provider.
+func NewBoltOptions(filePath string) *BoltOptions {
+	// Default values are provided for required options
+	return &BoltOptions{
+		FilePath:                 filePath,
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+		OpenTimeout:              10 * time.Second,
+	}
+}
+
+// NewBoltBackend creates a new Backend object that stores its state in an embedded bbolt database file.
+//
+// The backend is written in pure Go, so it doesn't need CGO or an external database, which makes it a good fit for
+// single-node deployments such as edge devices and agents. The database file is locked by the process that opens
+// it, so a task hub can't be shared by multiple processes. Each operation runs in a transaction of its own, so the
+// state of the task hub stays consistent if the process crashes. Work items are processed in the order in which
+// they were created.
+func NewBoltBackend(opts *BoltOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewBoltOptions("durabletask.db")
+	}
+
+	return &boltBackend{
+		workerName: fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:    opts,
+		logger:     logger,
+	}
+}
+
+// CreateTaskHub opens the database file and creates its buckets, if they don't exist
+func (be *boltBackend) CreateTaskHub(context.Context) error {
+	if be.db == nil {
+		db, err := bbolt.Open(be.options.FilePath, 0o600, &bbolt.Options{Timeout: be.options.OpenTimeout})
+		if err != nil {
+			return fmt.Errorf("failed to open the database: %w", err)
+		}
+		be.db = db
+	}
+
+	return be.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{instancesBucket, historyBucket, eventsBucket, tasksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteTaskHub closes and deletes the database file
+func (be *boltBackend) DeleteTaskHub(context.Context) error {
+	if be.db != nil {
+		if err := be.db.Close(); err != nil {
+			return fmt.Errorf("failed to close the database: %w", err)
+		}
+		be.db = nil
+	}
+
+	err := os.Remove(be.options.FilePath)
+	if os.IsNotExist(err) {
+		return backend.ErrTaskHubNotFound
+	}
+	return err
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *boltBackend) CreateOrchestrationInstance(_ context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		return s.createInstance(e)
+	})
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *boltBackend) AddNewOrchestrationEvent(_ context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		return s.addEvent(string(iid), e, time.Time{})
+	})
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *boltBackend) AddNewOrchestrationEventIf(_ context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if err := validateEvent(e); err != nil {
+		return err
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	return be.update(func(s *store) error {
+		inst, err := s.instance(string(iid))
+		if err != nil {
+			return err
+		} else if inst == nil {
+			return api.ErrInstanceNotFound
+		} else if !containsStatus(statuses, inst.RuntimeStatus) {
+			return api.ErrPreconditionFailed
+		}
+		return s.addEvent(string(iid), e, time.Time{})
+	})
+}
+
+// IngestOperations implements backend.BackendWithIngest
+//
+// Each operation is applied in a transaction of its own.
+func (be *boltBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *boltBackend) GetOrchestrationWorkItem(context.Context) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var wi *backend.OrchestrationWorkItem
+	err := be.update(func(s *store) error {
+		now := time.Now().UTC()
+
+		// Lock the instance of the oldest visible event that can be processed. Instances that haven't started yet
+		// and still have invisible events are waiting for their scheduled start time, so events raised to them in
+		// the meantime must wait as well.
+		candidates := make([]string, 0)
+		hasInvisibleEvents := make(map[string]bool)
+		err := s.forEachEvent(func(_ []byte, e *eventRecord) error {
+			if e.isVisible(now) {
+				candidates = append(candidates, e.InstanceID)
+			} else {
+				hasInvisibleEvents[e.InstanceID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var inst *instanceRecord
+		for _, id := range candidates {
+			candidate, err := s.instance(id)
+			if err != nil {
+				return err
+			} else if candidate == nil || candidate.isLocked(now) {
+				continue
+			} else if candidate.HistoryLength == 0 && hasInvisibleEvents[id] {
+				continue
+			}
+			inst = candidate
+			break
+		}
+		if inst == nil {
+			// No new events to process
+			return backend.ErrNoWorkItems
+		}
+
+		inst.LockedBy = be.workerName
+		inst.LockExpiration = now.Add(be.options.OrchestrationLockTimeout)
+		if err := s.putInstance(inst); err != nil {
+			return err
+		}
+
+		// TODO: Get all the unprocessed events associated with the locked instance
+		maxDequeueCount := int32(0)
+		newEvents := make([]*protos.HistoryEvent, 0, 10)
+		err = s.forEachEvent(func(key []byte, e *eventRecord) error {
+			if e.InstanceID != inst.ID || !e.isVisible(now) || len(newEvents) == 1000 {
+				return nil
+			}
+			e.DequeueCount++
+			e.LockedBy = be.workerName
+			if e.DequeueCount > maxDequeueCount {
+				maxDequeueCount = e.DequeueCount
+			}
+
+			event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+			if err != nil {
+				return err
+			}
+			newEvents = append(newEvents, event)
+			return putRecord(s.tx.Bucket(eventsBucket), key, e)
+		})
+		if err != nil {
+			return err
+		}
+
+		wi = &backend.OrchestrationWorkItem{
+			InstanceID: api.InstanceID(inst.ID),
+			NewEvents:  newEvents,
+			LockedBy:   be.workerName,
+			RetryCount: maxDequeueCount - 1,
+
+			NextSequenceNumber: inst.HistoryLength,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wi, nil
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *boltBackend) GetOrchestrationRuntimeState(_ context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var existingEvents []*protos.HistoryEvent
+	err := be.view(func(s *store) (err error) {
+		existingEvents, err = s.history(string(wi.InstanceID), 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *boltBackend) GetOrchestrationMetadata(_ context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var metadata *api.OrchestrationMetadata
+	err := be.view(func(s *store) error {
+		inst, err := s.instance(string(iid))
+		if err != nil {
+			return err
+		} else if inst == nil {
+			return api.ErrInstanceNotFound
+		}
+		metadata, err = inst.metadata()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *boltBackend) CompleteOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		inst, err := s.instance(string(wi.InstanceID))
+		if err != nil {
+			return err
+		} else if inst == nil || inst.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		} else if ok, err := s.hasLockedEvents(inst.ID, wi.LockedBy); err != nil {
+			return err
+		} else if !ok {
+			return backend.ErrWorkItemLockLost
+		}
+
+		now := time.Now().UTC()
+		isCreated := false
+		isCompleted := false
+		for _, e := range wi.State.NewEvents() {
+			if es := e.GetExecutionStarted(); es != nil {
+				if isCreated {
+					// TODO: Log warning about duplicate start event
+					continue
+				}
+				isCreated = true
+				inst.CreatedTime = e.Timestamp.AsTime()
+				inst.Input = es.Input.GetValue()
+			} else if ec := e.GetExecutionCompleted(); ec != nil {
+				if isCompleted {
+					// TODO: Log warning about duplicate completion event
+					continue
+				}
+				isCompleted = true
+				inst.CompletedTime = now
+				inst.Output = ec.Result.GetValue()
+				inst.FailureDetails = nil
+				if ec.FailureDetails != nil {
+					if inst.FailureDetails, err = proto.Marshal(ec.FailureDetails); err != nil {
+						return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+					}
+				}
+			}
+			// TODO: Execution suspended & resumed
+		}
+
+		if wi.State.CustomStatus != nil {
+			inst.CustomStatus = wi.State.CustomStatus.Value
+		}
+		inst.GenerationCount += wi.State.ContinuedAsNewCount()
+
+		// TODO: Support for stickiness, which would extend the LockExpiration
+		inst.RuntimeStatus = wi.State.RuntimeStatus()
+		inst.LastUpdatedTime = now
+		inst.LockedBy = ""
+		inst.LockExpiration = time.Time{}
+
+		// If continue-as-new, delete all existing history
+		if wi.State.ContinuedAsNew() {
+			if err := s.deleteHistory(inst.ID); err != nil {
+				return err
+			}
+			inst.HistoryLength = 0
+		}
+
+		// Save the actions from the most recent execution, if requested
+		if wi.State.LastActions != nil {
+			payload, err := proto.Marshal(&protos.OrchestratorResponse{
+				InstanceId: inst.ID,
+				Actions:    wi.State.LastActions,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to marshal last actions: %w", err)
+			}
+			inst.LastActions = payload
+		}
+
+		// Save new history events
+		if err := s.appendHistory(inst, wi.State.NewEvents()); err != nil {
+			return err
+		}
+		if err := s.putInstance(inst); err != nil {
+			return err
+		}
+
+		// Save outbound activity tasks
+		for _, e := range wi.State.PendingTasks() {
+			if err := s.addTask(inst.ID, e); err != nil {
+				return err
+			}
+		}
+
+		// Save outbound orchestrator events
+		for _, e := range wi.State.PendingTimers() {
+			if err := s.addEvent(inst.ID, e, e.GetTimerFired().GetFireAt().AsTime()); err != nil {
+				return err
+			}
+		}
+
+		for _, msg := range wi.State.PendingMessages() {
+			if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+				// Need to create a new instance
+				if err := s.createInstance(msg.HistoryEvent); err == backend.ErrDuplicateEvent {
+					be.logger.Warnf(
+						"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+						wi.InstanceID,
+						es.OrchestrationInstance.InstanceId)
+				} else if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := validateEvent(msg.HistoryEvent); err != nil {
+				return err
+			}
+			if err := s.addEvent(msg.TargetInstanceID, msg.HistoryEvent, time.Time{}); err != nil {
+				return err
+			}
+		}
+
+		// Delete inbound events
+		return s.forEachEvent(func(key []byte, e *eventRecord) error {
+			if e.InstanceID == inst.ID && e.LockedBy == wi.LockedBy {
+				return s.tx.Bucket(eventsBucket).Delete(key)
+			}
+			return nil
+		})
+	})
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *boltBackend) AbandonOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	var visibleTime time.Time
+	if delay := wi.GetAbandonDelay(); delay > 0 {
+		visibleTime = time.Now().UTC().Add(delay)
+	}
+
+	return be.update(func(s *store) error {
+		inst, err := s.instance(string(wi.InstanceID))
+		if err != nil {
+			return err
+		} else if inst == nil || inst.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		abandoned := 0
+		err = s.forEachEvent(func(key []byte, e *eventRecord) error {
+			if e.InstanceID != inst.ID || e.LockedBy != wi.LockedBy {
+				return nil
+			}
+			e.LockedBy = ""
+			e.VisibleTime = visibleTime
+			abandoned++
+			return putRecord(s.tx.Bucket(eventsBucket), key, e)
+		})
+		if err != nil {
+			return err
+		} else if abandoned == 0 {
+			return backend.ErrWorkItemLockLost
+		}
+
+		inst.LockedBy = ""
+		inst.LockExpiration = time.Time{}
+		return s.putInstance(inst)
+	})
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *boltBackend) RenewOrchestrationWorkItemLock(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		inst, err := s.instance(string(wi.InstanceID))
+		if err != nil {
+			return err
+		} else if inst == nil || inst.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		inst.LockExpiration = time.Now().UTC().Add(be.options.OrchestrationLockTimeout)
+		return s.putInstance(inst)
+	})
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *boltBackend) GetActivityWorkItem(context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var wi *backend.ActivityWorkItem
+	err := be.update(func(s *store) error {
+		now := time.Now().UTC()
+		tasks := s.tx.Bucket(tasksBucket)
+		c := tasks.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			t := new(taskRecord)
+			if err := json.Unmarshal(v, t); err != nil {
+				return fmt.Errorf("failed to read the activity tasks: %w", err)
+			}
+			if !t.LockExpiration.IsZero() && !t.LockExpiration.Before(now) {
+				continue
+			}
+
+			t.LockedBy = be.workerName
+			t.LockExpiration = now.Add(be.options.ActivityLockTimeout)
+			t.DequeueCount++
+
+			e, err := backend.UnmarshalHistoryEvent(t.EventPayload)
+			if err != nil {
+				return err
+			}
+			wi = &backend.ActivityWorkItem{
+				SequenceNumber: int64(binary.BigEndian.Uint64(k)),
+				InstanceID:     api.InstanceID(t.InstanceID),
+				NewEvent:       e,
+				LockedBy:       be.workerName,
+			}
+			return putRecord(tasks, k, t)
+		}
+
+		// No new activity tasks to process
+		return backend.ErrNoWorkItems
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wi, nil
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *boltBackend) CompleteActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		if t, err := s.lockedTask(wi.SequenceNumber, wi.LockedBy); err != nil {
+			return err
+		} else if t == nil {
+			return backend.ErrWorkItemLockLost
+		}
+
+		if err := s.addEvent(string(wi.InstanceID), wi.Result, time.Time{}); err != nil {
+			return err
+		}
+		return s.tx.Bucket(tasksBucket).Delete(sequenceKey(uint64(wi.SequenceNumber)))
+	})
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *boltBackend) AbandonActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		t, err := s.lockedTask(wi.SequenceNumber, wi.LockedBy)
+		if err != nil {
+			return err
+		} else if t == nil {
+			return backend.ErrWorkItemLockLost
+		}
+
+		t.LockedBy = ""
+		t.LockExpiration = time.Time{}
+		return putRecord(s.tx.Bucket(tasksBucket), sequenceKey(uint64(wi.SequenceNumber)), t)
+	})
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *boltBackend) RenewActivityWorkItemLock(_ context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		t, err := s.lockedTask(wi.SequenceNumber, wi.LockedBy)
+		if err != nil {
+			return err
+		} else if t == nil {
+			return backend.ErrWorkItemLockLost
+		}
+
+		t.LockExpiration = time.Now().UTC().Add(be.options.ActivityLockTimeout)
+		return putRecord(s.tx.Bucket(tasksBucket), sequenceKey(uint64(wi.SequenceNumber)), t)
+	})
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *boltBackend) GetOrchestrationLastActions(_ context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	res := &protos.OrchestratorResponse{}
+	err := be.view(func(s *store) error {
+		inst, err := s.instance(string(iid))
+		if err != nil {
+			return err
+		} else if inst == nil {
+			return api.ErrInstanceNotFound
+		}
+		if err := proto.Unmarshal(inst.LastActions, res); err != nil {
+			return fmt.Errorf("failed to unmarshal last actions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *boltBackend) PurgeOrchestrationState(_ context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(func(s *store) error {
+		inst, err := s.instance(string(id))
+		if err != nil {
+			return err
+		} else if inst == nil {
+			return api.ErrInstanceNotFound
+		} else if !isCompletedStatus(inst.RuntimeStatus) {
+			return api.ErrNotCompleted
+		}
+		return s.deleteInstance(inst.ID)
+	})
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *boltBackend) PurgeOrchestrationStateBatch(_ context.Context, query api.InstanceQuery) (int, string, error) {
+	if err := be.ensureDB(); err != nil {
+		return 0, "", err
+	}
+
+	// Only the state of completed orchestrations can be purged
+	pageSize := query.PageSizeOrDefault()
+	purged := 0
+	continuationToken := ""
+	err := be.update(func(s *store) error {
+		instances, err := s.queryInstances(query, pageSize+1, func(inst *instanceRecord) bool {
+			return isCompletedStatus(inst.RuntimeStatus)
+		})
+		if err != nil {
+			return err
+		}
+		if len(instances) > pageSize {
+			instances = instances[:pageSize]
+			continuationToken = instances[len(instances)-1].ID
+		}
+		for _, inst := range instances {
+			if err := s.deleteInstance(inst.ID); err != nil {
+				return err
+			}
+		}
+		purged = len(instances)
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return purged, continuationToken, nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *boltBackend) GetOrchestrationHistoriesBatch(_ context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	errs := make(map[api.InstanceID]error)
+	err := be.view(func(s *store) error {
+		for iid, from := range fromSequenceNumbers {
+			inst, err := s.instance(string(iid))
+			if err != nil {
+				return err
+			} else if inst == nil {
+				errs[iid] = api.ErrInstanceNotFound
+				continue
+			}
+			if from < 0 {
+				from = 0
+			}
+			if histories[iid], err = s.history(inst.ID, from); err != nil {
+				errs[iid] = err
+				delete(histories, iid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *boltBackend) GetOrphanedSubOrchestrations(context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	err := be.view(func(s *store) error {
+		instances, err := s.sortedInstances()
+		if err != nil {
+			return err
+		}
+		for _, inst := range instances {
+			if inst.ParentInstanceID == "" {
+				continue
+			}
+			switch inst.RuntimeStatus {
+			case protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+				protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING,
+				protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED:
+			default:
+				continue
+			}
+			if parent, err := s.instance(inst.ParentInstanceID); err != nil {
+				return err
+			} else if parent != nil && !isCompletedStatus(parent.RuntimeStatus) {
+				continue
+			}
+
+			metadata, err := inst.metadata()
+			if err != nil {
+				return err
+			}
+			orphans = append(orphans, metadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *boltBackend) QueryOrchestrationMetadata(_ context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	pageSize := query.PageSizeOrDefault()
+	instances := make([]*api.OrchestrationMetadata, 0)
+	err := be.view(func(s *store) error {
+		records, err := s.queryInstances(query, pageSize+1, func(*instanceRecord) bool { return true })
+		if err != nil {
+			return err
+		}
+		for _, inst := range records {
+			metadata, err := inst.metadata()
+			if err != nil {
+				return err
+			}
+			instances = append(instances, metadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *boltBackend) ExportOrchestrationInstance(_ context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{
+		PendingEvents: make([]*backend.HistoryEvent, 0),
+		PendingTasks:  make([]*backend.HistoryEvent, 0),
+	}
+	err := be.view(func(s *store) error {
+		inst, err := s.instance(string(iid))
+		if err != nil {
+			return err
+		} else if inst == nil {
+			return api.ErrInstanceNotFound
+		}
+		if state.Metadata, err = inst.metadata(); err != nil {
+			return err
+		}
+		if state.History, err = s.history(inst.ID, 0); err != nil {
+			return err
+		}
+
+		err = s.forEachEvent(func(_ []byte, e *eventRecord) error {
+			if e.InstanceID != inst.ID {
+				return nil
+			}
+			event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+			if err != nil {
+				return err
+			}
+			state.PendingEvents = append(state.PendingEvents, event)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		c := s.tx.Bucket(tasksBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			t := new(taskRecord)
+			if err := json.Unmarshal(v, t); err != nil {
+				return fmt.Errorf("failed to read the activity tasks: %w", err)
+			} else if t.InstanceID != inst.ID {
+				continue
+			}
+			event, err := backend.UnmarshalHistoryEvent(t.EventPayload)
+			if err != nil {
+				return err
+			}
+			state.PendingTasks = append(state.PendingTasks, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *boltBackend) ImportOrchestrationInstance(_ context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	inst := &instanceRecord{
+		ID:               id,
+		Name:             metadata.Name,
+		Version:          startEvent.GetVersion().GetValue(),
+		ExecutionID:      startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		RuntimeStatus:    metadata.RuntimeStatus,
+		CreatedTime:      metadata.CreatedAt.UTC(),
+		LastUpdatedTime:  metadata.LastUpdatedAt.UTC(),
+		Input:            metadata.SerializedInput,
+		Output:           metadata.SerializedOutput,
+		CustomStatus:     metadata.SerializedCustomStatus,
+		ParentInstanceID: startEvent.GetParentInstance().GetOrchestrationInstance().GetInstanceId(),
+		GenerationCount:  metadata.GenerationCount,
+		Tags:             metadata.Tags,
+	}
+	if metadata.IsComplete() {
+		inst.CompletedTime = inst.LastUpdatedTime
+	}
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		inst.FailureDetails = bytes
+	}
+
+	return be.update(func(s *store) error {
+		if existing, err := s.instance(id); err != nil {
+			return err
+		} else if existing != nil {
+			return backend.ErrDuplicateEvent
+		}
+
+		if err := s.appendHistory(inst, state.History); err != nil {
+			return err
+		}
+		if err := s.putInstance(inst); err != nil {
+			return err
+		}
+
+		for _, e := range state.PendingEvents {
+			// Timers and scheduled starts must stay invisible to workers until they're due
+			var visibleTime time.Time
+			if tf := e.GetTimerFired(); tf != nil {
+				visibleTime = tf.GetFireAt().AsTime()
+			} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+				visibleTime = ts.AsTime()
+			}
+			if err := s.addEvent(id, e, visibleTime); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range state.PendingTasks {
+			if err := s.addTask(id, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *boltBackend) GetOrchestrationStats(_ context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var instances []*instanceRecord
+	err := be.view(func(s *store) (err error) {
+		instances, err = s.sortedInstances()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, inst := range instances {
+		if inst.Name != name {
+			continue
+		}
+		if !inst.CreatedTime.Before(since) {
+			stats.Started++
+		}
+		if inst.CompletedTime.IsZero() || inst.CompletedTime.Before(since) {
+			continue
+		}
+		switch inst.RuntimeStatus {
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED:
+			stats.Completed++
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED:
+			stats.Failed++
+		default:
+			continue
+		}
+		d := inst.CompletedTime.Sub(inst.CreatedTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*boltBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*boltBackend) Stop(context.Context) error {
+	return nil
+}
+
+func (be *boltBackend) ensureDB() error {
+	if be.db == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *boltBackend) String() string {
+	return fmt.Sprintf("bolt::%s", be.options.FilePath)
+}
+
+// update runs fn in a read-write transaction, which is rolled back if fn returns an error.
+func (be *boltBackend) update(fn func(s *store) error) error {
+	return be.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&store{tx: tx})
+	})
+}
+
+// view runs fn in a read-only transaction.
+func (be *boltBackend) view(fn func(s *store) error) error {
+	return be.db.View(func(tx *bbolt.Tx) error {
+		return fn(&store{tx: tx})
+	})
+}
+
+// createInstance creates an orchestration instance and adds its ExecutionStarted event.
+func (s *store) createInstance(e *backend.HistoryEvent) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	id := startEvent.OrchestrationInstance.InstanceId
+	if existing, err := s.instance(id); err != nil {
+		return err
+	} else if existing != nil {
+		return backend.ErrDuplicateEvent
+	}
+
+	err := s.putInstance(&instanceRecord{
+		ID:               id,
+		Name:             startEvent.Name,
+		Version:          startEvent.Version.GetValue(),
+		ExecutionID:      startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		RuntimeStatus:    protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+		CreatedTime:      e.Timestamp.AsTime(),
+		LastUpdatedTime:  time.Now().UTC(),
+		Input:            startEvent.Input.GetValue(),
+		ParentInstanceID: startEvent.GetParentInstance().GetOrchestrationInstance().GetInstanceId(),
+		Tags:             helpers.GetTags(startEvent),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime time.Time
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime()
+	}
+	return s.addEvent(id, e, visibleTime)
+}
+
+// addEvent adds a new event to the queue of an orchestration instance. The event stays invisible to workers until
+// visibleTime, unless it's zero.
+func (s *store) addEvent(id string, e *backend.HistoryEvent, visibleTime time.Time) error {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	events := s.tx.Bucket(eventsBucket)
+	seq, err := events.NextSequence()
+	if err != nil {
+		return err
+	}
+	return putRecord(events, sequenceKey(seq), &eventRecord{
+		InstanceID:   id,
+		VisibleTime:  visibleTime,
+		EventPayload: eventPayload,
+	})
+}
+
+// addTask adds a new activity task that's scheduled by an orchestration instance.
+func (s *store) addTask(id string, e *backend.HistoryEvent) error {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	tasks := s.tx.Bucket(tasksBucket)
+	seq, err := tasks.NextSequence()
+	if err != nil {
+		return err
+	}
+	return putRecord(tasks, sequenceKey(seq), &taskRecord{
+		InstanceID:   id,
+		EventPayload: eventPayload,
+	})
+}
+
+// instance returns the instance with the specified ID, or nil if it doesn't exist.
+func (s *store) instance(id string) (*instanceRecord, error) {
+	v := s.tx.Bucket(instancesBucket).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	inst := new(instanceRecord)
+	if err := json.Unmarshal(v, inst); err != nil {
+		return nil, fmt.Errorf("failed to read orchestration instance %s: %w", id, err)
+	}
+	return inst, nil
+}
+
+func (s *store) putInstance(inst *instanceRecord) error {
+	return putRecord(s.tx.Bucket(instancesBucket), []byte(inst.ID), inst)
+}
+
+// deleteInstance deletes the state of an instance, but not its pending events and tasks.
+func (s *store) deleteInstance(id string) error {
+	if err := s.tx.Bucket(instancesBucket).Delete([]byte(id)); err != nil {
+		return err
+	}
+	return s.deleteHistory(id)
+}
+
+// history returns the history events of an instance, starting at the specified sequence number.
+func (s *store) history(id string, from int) ([]*backend.HistoryEvent, error) {
+	events := make([]*backend.HistoryEvent, 0)
+	b := s.tx.Bucket(historyBucket).Bucket([]byte(id))
+	if b == nil {
+		return events, nil
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(sequenceKey(uint64(from))); k != nil; k, v = c.Next() {
+		e, err := backend.UnmarshalHistoryEvent(v)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// appendHistory adds history events to the end of the history of an instance.
+func (s *store) appendHistory(inst *instanceRecord, events []*backend.HistoryEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	b, err := s.tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(inst.ID))
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(sequenceKey(uint64(inst.HistoryLength)), eventPayload); err != nil {
+			return err
+		}
+		inst.HistoryLength++
+	}
+	return nil
+}
+
+func (s *store) deleteHistory(id string) error {
+	if err := s.tx.Bucket(historyBucket).DeleteBucket([]byte(id)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+// forEachEvent calls fn for each pending event in sequence number order. fn may update or delete the event.
+func (s *store) forEachEvent(fn func(key []byte, e *eventRecord) error) error {
+	events := s.tx.Bucket(eventsBucket)
+
+	// Keys are collected first, since the bucket can't be modified while iterating over it
+	var keys [][]byte
+	if err := events.ForEach(func(k, _ []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		e := new(eventRecord)
+		if err := json.Unmarshal(events.Get(k), e); err != nil {
+			return fmt.Errorf("failed to read the pending events: %w", err)
+		}
+		if err := fn(k, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) hasLockedEvents(id string, lockedBy string) (bool, error) {
+	found := false
+	err := s.forEachEvent(func(_ []byte, e *eventRecord) error {
+		if e.InstanceID == id && e.LockedBy == lockedBy {
+			found = true
+		}
+		return nil
+	})
+	return found, err
+}
+
+// lockedTask returns the activity task with the specified sequence number, or nil if it doesn't exist or isn't
+// locked by the specified worker.
+func (s *store) lockedTask(sequenceNumber int64, lockedBy string) (*taskRecord, error) {
+	v := s.tx.Bucket(tasksBucket).Get(sequenceKey(uint64(sequenceNumber)))
+	if v == nil {
+		return nil, nil
+	}
+	t := new(taskRecord)
+	if err := json.Unmarshal(v, t); err != nil {
+		return nil, fmt.Errorf("failed to read the activity tasks: %w", err)
+	}
+	if t.LockedBy != lockedBy {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// sortedInstances returns all the instances ordered by creation time and instance ID.
+func (s *store) sortedInstances() ([]*instanceRecord, error) {
+	instances := make([]*instanceRecord, 0)
+	err := s.tx.Bucket(instancesBucket).ForEach(func(k, v []byte) error {
+		inst := new(instanceRecord)
+		if err := json.Unmarshal(v, inst); err != nil {
+			return fmt.Errorf("failed to read orchestration instance %s: %w", k, err)
+		}
+		instances = append(instances, inst)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if !instances[i].CreatedTime.Equal(instances[j].CreatedTime) {
+			return instances[i].CreatedTime.Before(instances[j].CreatedTime)
+		}
+		return instances[i].ID < instances[j].ID
+	})
+	return instances, nil
+}
+
+// queryInstances returns up to limit instances that match the query and the match function, in the order of their
+// IDs and starting after the continuation token of the query. The runtime status, name, name prefix, instance ID
+// prefix, creation time, and completion time filters of the query are applied.
+func (s *store) queryInstances(query api.InstanceQuery, limit int, match func(*instanceRecord) bool) ([]*instanceRecord, error) {
+	// The instances are keyed by ID, so the cursor can seek directly to the first instance of the page
+	start := query.InstanceIDPrefix
+	if query.ContinuationToken >= start {
+		start = query.ContinuationToken + "\x00"
+	}
+
+	instances := make([]*instanceRecord, 0)
+	c := s.tx.Bucket(instancesBucket).Cursor()
+	for k, v := c.Seek([]byte(start)); k != nil && strings.HasPrefix(string(k), query.InstanceIDPrefix); k, v = c.Next() {
+		inst := new(instanceRecord)
+		if err := json.Unmarshal(v, inst); err != nil {
+			return nil, fmt.Errorf("failed to read orchestration instance %s: %w", k, err)
+		}
+		if query.Name != "" && inst.Name != query.Name {
+			continue
+		}
+		if !strings.HasPrefix(inst.Name, query.NamePrefix) {
+			continue
+		}
+		if len(query.RuntimeStatuses) > 0 && !containsStatus(query.RuntimeStatuses, inst.RuntimeStatus) {
+			continue
+		}
+		if !query.CreatedFrom.IsZero() && inst.CreatedTime.Before(query.CreatedFrom) {
+			continue
+		}
+		if !query.CreatedTo.IsZero() && !inst.CreatedTime.Before(query.CreatedTo) {
+			continue
+		}
+		if !query.CompletedBefore.IsZero() && (inst.CompletedTime.IsZero() || !inst.CompletedTime.Before(query.CompletedBefore)) {
+			continue
+		}
+		if !query.TagFilter.Matches(inst.Tags) {
+			continue
+		}
+		if !match(inst) {
+			continue
+		}
+		if instances = append(instances, inst); len(instances) >= limit {
+			break
+		}
+	}
+	return instances, nil
+}
+
+func (e *eventRecord) isVisible(now time.Time) bool {
+	return e.VisibleTime.IsZero() || !e.VisibleTime.After(now)
+}
+
+func (inst *instanceRecord) isLocked(now time.Time) bool {
+	return !inst.LockExpiration.IsZero() && !inst.LockExpiration.Before(now)
+}
+
+func (inst *instanceRecord) metadata() (*api.OrchestrationMetadata, error) {
+	var failureDetails *protos.TaskFailureDetails
+	if len(inst.FailureDetails) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(inst.FailureDetails, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(inst.ID),
+		inst.Name,
+		inst.RuntimeStatus,
+		inst.CreatedTime,
+		inst.LastUpdatedTime,
+		inst.Input,
+		inst.Output,
+		inst.CustomStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = inst.GenerationCount
+	metadata.Tags = inst.Tags
+	return metadata, nil
+}
+
+func putRecord(b *bbolt.Bucket, key []byte, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, bytes)
+}
+
+// sequenceKey encodes a sequence number as a big-endian key, so that keys are ordered by sequence number.
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func validateEvent(e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+	return nil
+}
+
+func isCompletedStatus(status protos.OrchestrationStatus) bool {
+	return status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED ||
+		status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED ||
+		status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED
+}
+
+func containsStatus(statuses []protos.OrchestrationStatus, status protos.OrchestrationStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+module github.com/microsoft/durabletask-go/backend/bolt
+
+go 1.18
+
+require (
+	github.com/google/uuid v1.3.0
+	github.com/microsoft/durabletask-go v0.0.0-00010101000000-000000000000
+	go.etcd.io/bbolt v1.3.6
+	google.golang.org/protobuf v1.28.1
+)
+
+require (
+	github.com/cenkalti/backoff/v4 v4.1.3 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/marusama/semaphore/v2 v2.5.0 // indirect
+	go.opentelemetry.io/otel v1.11.1 // indirect
+	go.opentelemetry.io/otel/metric v0.33.0 // indirect
+	go.opentelemetry.io/otel/trace v1.11.1 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
+	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
+	google.golang.org/grpc v1.53.0 // indirect
+)
+
+replace github.com/microsoft/durabletask-go => ../..
@@ -0,0 +1,23 @@
+package bolt
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+// The "bolt" scheme opens a database file, e.g. "bolt:///var/lib/durabletask.db" for an absolute path or
+// "bolt:durabletask.db" for a path that's relative to the working directory.
+func init() {
+	backend.Register("bolt", func(u *url.URL, logger backend.Logger) (backend.Backend, error) {
+		filePath := u.Opaque
+		if filePath == "" {
+			filePath = u.Host + u.Path
+		}
+		if filePath == "" {
+			return nil, errors.New("the bolt connection URL doesn't specify a file path")
+		}
+		return NewBoltBackend(NewBoltOptions(filePath), logger), nil
+	})
+}
@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/microsoft/durabletask-go/api"
+)
+
+// orchestrationStateCache is a size-bounded LRU cache of orchestration runtime states, which allows the orchestration
+// worker to skip reloading the full history of an orchestration from the backend for every work item.
+type orchestrationStateCache struct {
+	lock     sync.Mutex
+	capacity int
+	lru      *list.List // front is most recently used
+	entries  map[api.InstanceID]*list.Element
+
+	// invalidated are the orchestrations that were invalidated since their state was last taken from the cache.
+	// States that are put back for them were taken before the invalidation, so they aren't cached.
+	invalidated map[api.InstanceID]bool
+
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+// CacheStats are the statistics of the orchestration state cache of a [TaskWorker].
+type CacheStats struct {
+	// Capacity is the maximum number of orchestration states that the cache holds. It's zero if caching is disabled.
+	Capacity int `json:"capacity"`
+
+	// Size is the number of orchestration states that are currently cached.
+	Size int `json:"size"`
+
+	// Hits is the number of work items whose orchestration state was found in the cache.
+	Hits uint64 `json:"hits"`
+
+	// Misses is the number of work items whose orchestration state had to be loaded from the backend, either because
+	// it wasn't cached or because the cached state was stale.
+	Misses uint64 `json:"misses"`
+
+	// Evictions is the number of cached states that were evicted to make room for other states.
+	Evictions uint64 `json:"evictions"`
+
+	// Invalidations is the number of cached states that were invalidated using [TaskWorker.InvalidateCache].
+	Invalidations uint64 `json:"invalidations"`
+}
+
+// HitRate returns the fraction of lookups that were served from the cache, or 0 if there were no lookups.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type stateCacheEntry struct {
+	id    api.InstanceID
+	state *OrchestrationRuntimeState
+}
+
+func newOrchestrationStateCache(capacity int) *orchestrationStateCache {
+	return &orchestrationStateCache{
+		capacity:    capacity,
+		lru:         list.New(),
+		entries:     make(map[api.InstanceID]*list.Element, capacity),
+		invalidated: make(map[api.InstanceID]bool),
+	}
+}
+
+// take removes the cached state of the specified orchestration from the cache and returns it. The state is removed
+// so that a work item that fails after mutating it can't leave a corrupted state behind in the cache.
+func (c *orchestrationStateCache) take(id api.InstanceID) (*OrchestrationRuntimeState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.invalidated, id)
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, id)
+	return elem.Value.(*stateCacheEntry).state, true
+}
+
+// put adds the state of the specified orchestration to the cache, evicting the least recently used state if the
+// cache is full.
+func (c *orchestrationStateCache) put(id api.InstanceID, state *OrchestrationRuntimeState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.invalidated[id] {
+		delete(c.invalidated, id)
+		return
+	}
+	if elem, ok := c.entries[id]; ok {
+		elem.Value.(*stateCacheEntry).state = state
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.capacity {
+		if oldest := c.lru.Back(); oldest != nil {
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*stateCacheEntry).id)
+			c.evictions++
+		}
+	}
+	c.entries[id] = c.lru.PushFront(&stateCacheEntry{id: id, state: state})
+}
+
+// remove evicts the state of the specified orchestration from the cache, if present.
+func (c *orchestrationStateCache) remove(id api.InstanceID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.invalidated, id)
+	if elem, ok := c.entries[id]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+// invalidate evicts the state of the specified orchestration from the cache, including the state of a work item of
+// the orchestration that's currently being processed.
+func (c *orchestrationStateCache) invalidate(id api.InstanceID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.invalidated[id] = true
+	c.invalidations++
+	if elem, ok := c.entries[id]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+// recordLookup records whether the state of a work item was served from the cache.
+func (c *orchestrationStateCache) recordLookup(hit bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+func (c *orchestrationStateCache) stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		Capacity:      c.capacity,
+		Size:          c.lru.Len(),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+	}
+}
@@ -0,0 +1,205 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// ErrCircuitOpen is returned when scheduling or processing an orchestration whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("the circuit breaker of the orchestration is open")
+
+// CircuitState is the state of the circuit of an orchestration name.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state, in which orchestrations are scheduled and processed.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen rejects new orchestrations and pauses the processing of existing ones until the cooldown expires.
+	CircuitOpen
+
+	// CircuitHalfOpen follows the cooldown. Orchestrations are scheduled and processed again, and the outcome of the
+	// next orchestration that completes or fails closes the circuit or opens it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "Closed"
+	case CircuitOpen:
+		return "Open"
+	case CircuitHalfOpen:
+		return "HalfOpen"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreakerOptions configures a [CircuitBreaker]. Zero values are replaced with the defaults.
+type CircuitBreakerOptions struct {
+	// FailureRateThreshold is the fraction of failed orchestrations, between 0 and 1, at or above which the circuit
+	// opens. The default is 0.5.
+	FailureRateThreshold float64
+
+	// MinimumOutcomes is the number of orchestrations that must have completed or failed within the window before
+	// the failure rate is evaluated, so that a few failures don't open the circuit. The default is 10.
+	MinimumOutcomes int
+
+	// Window is how far back outcomes are taken into account. The default is one minute.
+	Window time.Duration
+
+	// Cooldown is how long the circuit stays open before it half-opens. The default is 30 seconds.
+	Cooldown time.Duration
+}
+
+// CircuitBreaker stops scheduling and processing the orchestrations of a name when too many of them fail, e.g.
+// because a downstream dependency is down, instead of wasting resources on orchestrations that are likely to fail.
+// Each orchestration name has its own circuit.
+//
+// The failure rate of a name is measured over the outcomes of its orchestrations that completed or failed within the
+// window, as recorded by the orchestration workers that the circuit breaker is configured on using
+// [WithCircuitBreaker]. Orchestrations that are terminated or that continue-as-new don't count, nor do work items
+// that fail to be processed. When at least MinimumOutcomes outcomes were recorded and the fraction of failures
+// reaches FailureRateThreshold, the circuit opens: clients configured with [WithScheduleCircuitBreaker] reject new
+// orchestrations of the name with [ErrCircuitOpen], and the workers defer its work items, so that they're retried
+// later. After the cooldown, the circuit half-opens and the next outcome decides whether it closes or opens again.
+//
+// The circuit state is kept in memory, so the same CircuitBreaker must be shared by the clients and workers of a
+// process, and each process has its own circuits. A CircuitBreaker is safe for concurrent use.
+type CircuitBreaker struct {
+	options  CircuitBreakerOptions
+	lock     sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    CircuitState
+	openedAt time.Time
+	outcomes []circuitOutcome
+}
+
+type circuitOutcome struct {
+	time   time.Time
+	failed bool
+}
+
+// NewCircuitBreaker returns a [CircuitBreaker] with the specified options.
+func NewCircuitBreaker(options CircuitBreakerOptions) *CircuitBreaker {
+	if options.FailureRateThreshold <= 0 {
+		options.FailureRateThreshold = 0.5
+	}
+	if options.MinimumOutcomes <= 0 {
+		options.MinimumOutcomes = 10
+	}
+	if options.Window <= 0 {
+		options.Window = time.Minute
+	}
+	if options.Cooldown <= 0 {
+		options.Cooldown = 30 * time.Second
+	}
+	return &CircuitBreaker{options: options, circuits: make(map[string]*circuit)}
+}
+
+// State returns the state of the circuit of the specified orchestration name.
+func (cb *CircuitBreaker) State(name string) CircuitState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if c, ok := cb.circuits[name]; ok {
+		cb.cooldown(c, time.Now())
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// allow returns [ErrCircuitOpen] if the circuit of the specified orchestration name is open. A nil circuit breaker
+// allows all orchestrations.
+func (cb *CircuitBreaker) allow(name string) error {
+	if cb == nil {
+		return nil
+	}
+	if cb.State(name) == CircuitOpen {
+		return fmt.Errorf("%w: '%s'", ErrCircuitOpen, name)
+	}
+	return nil
+}
+
+// recordOutcome records the outcome of the orchestration of a work item if the orchestration completed or failed
+// while processing the work item.
+func (cb *CircuitBreaker) recordOutcome(wi *OrchestrationWorkItem) {
+	if cb == nil || wi.State == nil {
+		return
+	}
+	for _, e := range wi.State.NewEvents() {
+		if ec := e.GetExecutionCompleted(); ec != nil {
+			switch ec.OrchestrationStatus {
+			case protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED:
+				cb.record(getWorkItemOrchestrationName(wi), false)
+			case protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED:
+				cb.record(getWorkItemOrchestrationName(wi), true)
+			}
+			return
+		}
+	}
+}
+
+func (cb *CircuitBreaker) record(name string, failed bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	now := time.Now()
+	c, ok := cb.circuits[name]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[name] = c
+	}
+	cb.cooldown(c, now)
+
+	switch c.state {
+	case CircuitOpen:
+		// Outcomes of the orchestrations that were in flight when the circuit opened
+		return
+	case CircuitHalfOpen:
+		if failed {
+			c.state = CircuitOpen
+			c.openedAt = now
+		} else {
+			c.state = CircuitClosed
+		}
+		return
+	}
+
+	// Discard the outcomes that fell out of the window
+	start := 0
+	for start < len(c.outcomes) && now.Sub(c.outcomes[start].time) > cb.options.Window {
+		start++
+	}
+	c.outcomes = append(c.outcomes[start:], circuitOutcome{time: now, failed: failed})
+
+	if len(c.outcomes) < cb.options.MinimumOutcomes {
+		return
+	}
+	failures := 0
+	for _, o := range c.outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+	if float64(failures)/float64(len(c.outcomes)) >= cb.options.FailureRateThreshold {
+		c.state = CircuitOpen
+		c.openedAt = now
+		c.outcomes = nil
+	}
+}
+
+// cooldown half-opens the circuit if it's open and its cooldown expired.
+func (cb *CircuitBreaker) cooldown(c *circuit, now time.Time) {
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= cb.options.Cooldown {
+		c.state = CircuitHalfOpen
+	}
+}
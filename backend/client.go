@@ -2,6 +2,8 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,6 +11,9 @@ import (
 	"github.com/google/uuid"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/microsoft/durabletask-go/api"
 	"github.com/microsoft/durabletask-go/internal/helpers"
@@ -18,23 +23,267 @@ import (
 type TaskHubClient interface {
 	ScheduleNewOrchestration(ctx context.Context, orchestrator interface{}, opts ...api.NewOrchestrationOptions) (api.InstanceID, error)
 	FetchOrchestrationMetadata(ctx context.Context, id api.InstanceID) (*api.OrchestrationMetadata, error)
-	WaitForOrchestrationStart(ctx context.Context, id api.InstanceID) (*api.OrchestrationMetadata, error)
-	WaitForOrchestrationCompletion(ctx context.Context, id api.InstanceID) (*api.OrchestrationMetadata, error)
+	QueryInstances(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error)
+	WaitForOrchestrationStart(ctx context.Context, id api.InstanceID, opts ...api.WaitOrchestrationOptions) (*api.OrchestrationMetadata, error)
+	WaitForOrchestrationCompletion(ctx context.Context, id api.InstanceID, opts ...api.WaitOrchestrationOptions) (*api.OrchestrationMetadata, error)
+	StreamOrchestrationMetadata(ctx context.Context, id api.InstanceID, opts ...api.WaitOrchestrationOptions) (<-chan *api.OrchestrationMetadata, error)
 	TerminateOrchestration(ctx context.Context, id api.InstanceID, opts ...api.TerminateOptions) error
 	RaiseEvent(ctx context.Context, id api.InstanceID, eventName string, opts ...api.RaiseEventOptions) error
+	RaiseEventIf(ctx context.Context, id api.InstanceID, eventName string, expectedStatuses []protos.OrchestrationStatus, opts ...api.RaiseEventOptions) error
 	SuspendOrchestration(ctx context.Context, id api.InstanceID, reason string) error
 	ResumeOrchestration(ctx context.Context, id api.InstanceID, reason string) error
-	PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error
+	PurgeOrchestrationState(ctx context.Context, id api.InstanceID, opts ...api.PurgeOptions) (*api.PurgeResult, error)
+	PurgeCompletedOrchestrationStates(ctx context.Context, completedBefore time.Time, opts ...api.PurgeOptions) (*api.PurgeResult, error)
+	PurgeInstancesByFilter(ctx context.Context, filter api.InstanceQuery) (*api.PurgeResult, error)
+	GetOrchestrationStats(ctx context.Context, name string, timeWindow time.Duration) (*api.OrchestrationStats, error)
+	FindOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error)
+	FetchOrchestrationHistories(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*protos.HistoryEvent, error)
+	GetOrchestrationHistory(ctx context.Context, id api.InstanceID) ([]*api.HistoryEvent, error)
+	GetLastActions(ctx context.Context, id api.InstanceID) ([]*protos.OrchestratorAction, error)
+	Reevaluate(ctx context.Context, id api.InstanceID) error
+	InjectFault(ctx context.Context, id api.InstanceID, fault api.FaultSpec) error
+	RetrySubOrchestration(ctx context.Context, parentID api.InstanceID, subTaskID int32) error
+	RewindOrchestration(ctx context.Context, id api.InstanceID, reason string) error
+	RestartOrchestration(ctx context.Context, id api.InstanceID, opts ...api.RestartOptions) (api.InstanceID, error)
+	RetryFailedOrchestrations(ctx context.Context, query api.InstanceQuery, inputPatch InputPatch, opts ...RetryFailedOptions) (int, error)
+	ScheduleNewOrchestrations(ctx context.Context, reqs []NewOrchestrationRequest) ([]api.InstanceID, error)
+	NewIngestStream(ctx context.Context, opts ...NewIngestStreamOptions) (*IngestStream, error)
+	SignalEntity(ctx context.Context, id api.EntityID, operation string, opts ...api.SignalEntityOptions) error
+	FetchEntityMetadata(ctx context.Context, id api.EntityID) (*api.EntityMetadata, error)
+	SetCustomStatus(ctx context.Context, id api.InstanceID, customStatus any) error
+	ListDeadLetters(ctx context.Context) ([]*DeadLetter, error)
+	ResubmitDeadLetter(ctx context.Context, id int64) error
+	DeleteDeadLetter(ctx context.Context, id int64) error
 }
 
+var (
+	// ErrReevaluationDisabled is returned by [TaskHubClient.Reevaluate] when the client wasn't created with [WithReevaluation].
+	ErrReevaluationDisabled = errors.New("orchestration reevaluation is disabled for this client")
+
+	// ErrFaultInjectionDisabled is returned by [TaskHubClient.InjectFault] when the client wasn't created with [WithFaultInjection].
+	ErrFaultInjectionDisabled = errors.New("fault injection is disabled for this client")
+
+	// ErrQuotaExceeded is returned by [TaskHubClient.ScheduleNewOrchestration] when the namespace of the new
+	// orchestration already has as many running orchestrations as its quota allows. See [WithNamespaceQuota].
+	ErrQuotaExceeded = errors.New("the namespace of the orchestration has reached its quota of running orchestrations")
+
+	// ErrSubOrchestrationNotFound, ErrSubOrchestrationNotFailed, and ErrSubOrchestrationFailureObserved are returned by
+	// [TaskHubClient.RetrySubOrchestration] when the sub-orchestration can't be retried.
+	ErrSubOrchestrationNotFound        = errors.New("no sub-orchestration was scheduled with the specified task ID")
+	ErrSubOrchestrationNotFailed       = errors.New("the sub-orchestration did not fail")
+	ErrSubOrchestrationFailureObserved = errors.New("the parent orchestration already processed the failure of the sub-orchestration")
+
+	// ErrOrchestrationNotFailed is returned by [TaskHubClient.RewindOrchestration] when the orchestration isn't failed.
+	ErrOrchestrationNotFailed = errors.New("the orchestration did not fail")
+
+	// ErrNothingToRewind is returned by [TaskHubClient.RewindOrchestration] when the orchestration failed without a
+	// failed activity or sub-orchestration, e.g. because the orchestrator function itself returned an error.
+	ErrNothingToRewind = errors.New("the orchestration has no failed activity or sub-orchestration to rewind")
+
+	// ErrLastActionsNotSupported is returned by [TaskHubClient.GetLastActions] if the backend doesn't implement
+	// [BackendWithLastActions].
+	ErrLastActionsNotSupported = errors.New("the backend doesn't support saving the last orchestrator actions")
+
+	// ErrReservedOrchestrationName is returned by [TaskHubClient.ScheduleNewOrchestration] when the name of the
+	// orchestration starts with "@", which is reserved for the orchestrations that run entities.
+	ErrReservedOrchestrationName = errors.New("orchestration names that start with '@' are reserved for entities")
+
+	// ErrEntityInstance is returned by [TaskHubClient.PurgeOrchestrationState] when the instance is an entity.
+	ErrEntityInstance = errors.New("the instance is an entity, not an orchestration")
+)
+
 type backendClient struct {
-	be Backend
+	be        Backend
+	options   *TaskHubClientOptions
+	sequencer *eventSequencer // nil unless ordered events are enabled
+}
+
+// CollisionAction is the action that [TaskHubClient.ScheduleNewOrchestration] takes when the requested
+// orchestration instance ID is already in use.
+type CollisionAction = api.InstanceIDReuseAction
+
+const (
+	// CollisionActionError fails the request with the error returned by the backend.
+	CollisionActionError = api.InstanceIDReuseError
+
+	// CollisionActionUseExisting returns the ID of the existing instance without scheduling a new one.
+	CollisionActionUseExisting = api.InstanceIDReuseUseExisting
+
+	// CollisionActionOverwrite purges the existing instance and schedules a new one with the same ID. See
+	// [api.InstanceIDReuseOverwrite].
+	CollisionActionOverwrite = api.InstanceIDReuseOverwrite
+
+	// CollisionActionTerminateAndReplace terminates the existing instance, if it isn't completed yet, and replaces it.
+	// See [api.InstanceIDReuseTerminateAndReplace].
+	CollisionActionTerminateAndReplace = api.InstanceIDReuseTerminateAndReplace
+)
+
+// DefaultReplaceTimeout is how long [TaskHubClient.ScheduleNewOrchestration] waits for an existing instance to be
+// terminated before replacing it with [CollisionActionTerminateAndReplace], unless [WithReplaceTimeout] is used.
+const DefaultReplaceTimeout = 30 * time.Second
+
+// CollisionHandler decides what to do when a new orchestration is scheduled with an instance ID that already exists.
+type CollisionHandler func(existing *api.OrchestrationMetadata) (CollisionAction, error)
+
+// TaskHubClientOptions configures the behavior of a [TaskHubClient].
+type TaskHubClientOptions struct {
+	// AllowReevaluation enables the use of [TaskHubClient.Reevaluate].
+	AllowReevaluation bool
+
+	// AllowFaultInjection enables the use of [TaskHubClient.InjectFault].
+	AllowFaultInjection bool
+
+	// CollisionHandler is consulted when a new orchestration is scheduled with an instance ID that already exists.
+	CollisionHandler CollisionHandler
+
+	// ReplaceTimeout limits how long a terminated instance is waited for, or [DefaultReplaceTimeout] if zero.
+	ReplaceTimeout time.Duration
+
+	// OnScheduleError, if set, is called whenever an orchestration instance can't be created.
+	OnScheduleError ScheduleErrorHandler
+
+	// OrderedEvents enables sequencing of the events raised by the client. See [WithOrderedEvents].
+	OrderedEvents bool
+
+	// KnownOrchestrations, if set, is consulted to reject new orchestrations that no worker can execute.
+	KnownOrchestrations KnownOrchestrationsProvider
+
+	// CircuitBreaker, if set, is consulted to reject new orchestrations whose circuit is open.
+	CircuitBreaker *CircuitBreaker
+
+	// MaxSuspendedEventCount and MaxSuspendedEventBytes are the suspension buffer limits enforced when raising events.
+	MaxSuspendedEventCount int
+	MaxSuspendedEventBytes int
+
+	// NamespaceTagKey is the tag that holds the namespace of an orchestration, and NamespaceQuotas are their quotas.
+	NamespaceTagKey string
+	NamespaceQuotas map[string]int
+}
+
+// KnownOrchestrationsProvider returns the names of the orchestrations that the workers of a task hub can execute, where
+// a name of "*" matches all orchestrations. It returns false if the names aren't known, e.g. because no worker has
+// registered yet, in which case new orchestrations aren't validated.
+type KnownOrchestrationsProvider func(ctx context.Context) (names []string, known bool, err error)
+
+// ScheduleErrorHandler is called with the create instance request of an orchestration that couldn't be scheduled, and
+// with the error that prevented it from being scheduled.
+type ScheduleErrorHandler func(req *protos.CreateInstanceRequest, err error)
+
+type NewTaskHubClientOptions func(*TaskHubClientOptions)
+
+// WithReevaluation enables [TaskHubClient.Reevaluate], which is an advanced operation that's disabled by default.
+func WithReevaluation(enabled bool) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.AllowReevaluation = enabled
+	}
+}
+
+// WithFaultInjection enables [TaskHubClient.InjectFault], which is intended for chaos testing and is disabled by default.
+func WithFaultInjection(enabled bool) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.AllowFaultInjection = enabled
+	}
+}
+
+// WithCollisionHandler configures the handler that decides what happens when a new instance ID already exists.
+func WithCollisionHandler(handler CollisionHandler) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.CollisionHandler = handler
+	}
+}
+
+// WithInstanceIDReusePolicy configures a collision handler that always returns the specified action.
+func WithInstanceIDReusePolicy(action CollisionAction) NewTaskHubClientOptions {
+	return WithCollisionHandler(func(*api.OrchestrationMetadata) (CollisionAction, error) {
+		return action, nil
+	})
+}
+
+// WithReplaceTimeout configures how long an instance that's terminated to be replaced is waited for.
+func WithReplaceTimeout(timeout time.Duration) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.ReplaceTimeout = timeout
+	}
+}
+
+// WithOnScheduleError configures a callback that's called whenever an orchestration instance can't be created.
+func WithOnScheduleError(handler ScheduleErrorHandler) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.OnScheduleError = handler
+	}
+}
+
+// WithOrderedEvents makes workers deliver the events raised by the client in the order in which they were raised.
+func WithOrderedEvents() NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.OrderedEvents = true
+	}
+}
+
+// WithKnownOrchestrations rejects new orchestrations whose name isn't returned by the specified provider.
+func WithKnownOrchestrations(provider KnownOrchestrationsProvider) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.KnownOrchestrations = provider
+	}
+}
+
+// WithKnownOrchestrationNames is like [WithKnownOrchestrations], but uses a static list of names.
+func WithKnownOrchestrationNames(names ...string) NewTaskHubClientOptions {
+	return WithKnownOrchestrations(func(context.Context) ([]string, bool, error) {
+		return names, true, nil
+	})
+}
+
+// WithScheduleCircuitBreaker rejects new orchestrations while their circuit is open in the specified circuit breaker.
+func WithScheduleCircuitBreaker(cb *CircuitBreaker) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.CircuitBreaker = cb
+	}
+}
+
+// WithNamespaceQuota rejects new orchestrations whose namespace has reached its quota of running orchestrations.
+func WithNamespaceQuota(tagKey string, quotas map[string]int) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.NamespaceTagKey = tagKey
+		o.NamespaceQuotas = quotas
+	}
+}
+
+// WithRaiseEventSuspensionBufferLimits rejects the events raised to suspended orchestrations whose buffer is full.
+func WithRaiseEventSuspensionBufferLimits(maxEvents int, maxBytes int) NewTaskHubClientOptions {
+	return func(o *TaskHubClientOptions) {
+		o.MaxSuspendedEventCount = maxEvents
+		o.MaxSuspendedEventBytes = maxBytes
+	}
+}
+
+// ExecutorRegisteredOrchestrations returns a [KnownOrchestrationsProvider] that returns the names of the
+// orchestrations advertised by the executors that are connected to the specified executor, like the gRPC executor
+// returned by [NewGrpcExecutor]. The names aren't known while no executor is connected, or if the connected executor
+// doesn't advertise its orchestrations.
+func ExecutorRegisteredOrchestrations(executor Executor) KnownOrchestrationsProvider {
+	return func(context.Context) ([]string, bool, error) {
+		capabilities := executorCapabilities(executor)
+		if capabilities == nil || capabilities.Orchestrators == nil {
+			return nil, false, nil
+		}
+		return capabilities.Orchestrators, true, nil
+	}
 }
 
-func NewTaskHubClient(be Backend) TaskHubClient {
-	return &backendClient{
-		be: be,
+func NewTaskHubClient(be Backend, opts ...NewTaskHubClientOptions) TaskHubClient {
+	options := &TaskHubClientOptions{}
+	for _, configure := range opts {
+		configure(options)
+	}
+	c := &backendClient{
+		be:      be,
+		options: options,
 	}
+	if options.OrderedEvents {
+		c.sequencer = newEventSequencer()
+	}
+	return c
 }
 
 func (c *backendClient) ScheduleNewOrchestration(ctx context.Context, orchestrator interface{}, opts ...api.NewOrchestrationOptions) (api.InstanceID, error) {
@@ -42,27 +291,193 @@ func (c *backendClient) ScheduleNewOrchestration(ctx context.Context, orchestrat
 	req := &protos.CreateInstanceRequest{Name: name}
 	for _, configure := range opts {
 		if err := configure(req); err != nil {
-			return api.EmptyInstanceID, fmt.Errorf("failed to configure create instance request: %w", err)
+			err = fmt.Errorf("failed to configure create instance request: %w", err)
+			c.reportScheduleError(req, err)
+			return api.EmptyInstanceID, err
 		}
 	}
 	if req.InstanceId == "" {
 		req.InstanceId = uuid.NewString()
 	}
+	if err := c.validateOrchestrationName(ctx, req.Name); err != nil {
+		c.reportScheduleError(req, err)
+		return api.EmptyInstanceID, err
+	}
+	if err := c.options.CircuitBreaker.allow(req.Name); err != nil {
+		c.reportScheduleError(req, err)
+		return api.EmptyInstanceID, err
+	}
+	if err := c.checkNamespaceQuota(ctx, req); err != nil {
+		c.reportScheduleError(req, err)
+		return api.EmptyInstanceID, err
+	}
 
 	var span trace.Span
 	ctx, span = helpers.StartNewCreateOrchestrationSpan(ctx, req.Name, req.Version.GetValue(), req.InstanceId)
 	defer span.End()
 
 	tc := helpers.TraceContextFromSpan(span)
-	e := helpers.NewExecutionStartedEvent(req.Name, req.InstanceId, req.Input, nil, tc)
-	if err := c.be.CreateOrchestrationInstance(ctx, e); err != nil {
+	e := helpers.NewExecutionStartedEvent(req.Name, req.InstanceId, req.Input, nil, tc, req.ScheduledStartTimestamp)
+	e.GetExecutionStarted().Version = req.Version
+	helpers.SetTags(e.GetExecutionStarted(), helpers.GetTags(req))
+	helpers.SetOrchestrationTimeout(e.GetExecutionStarted(), helpers.GetOrchestrationTimeout(req))
+	err := c.be.CreateOrchestrationInstance(ctx, e)
+	if errors.Is(err, ErrDuplicateEvent) {
+		err = c.handleDuplicate(ctx, req, e, err)
+	}
+	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return api.EmptyInstanceID, fmt.Errorf("failed to start orchestration: %w", err)
+		err = fmt.Errorf("failed to start orchestration: %w", err)
+		c.reportScheduleError(req, err)
+		return api.EmptyInstanceID, err
 	}
 	return api.InstanceID(req.InstanceId), nil
 }
 
+// validateOrchestrationName returns [ErrReservedOrchestrationName] if the name is reserved for entities, or
+// [api.ErrUnknownOrchestration] if known orchestrations are configured and the specified orchestration isn't one of
+// them.
+func (c *backendClient) validateOrchestrationName(ctx context.Context, name string) error {
+	if helpers.IsEntityOrchestratorName(name) {
+		return fmt.Errorf("%w: '%s'", ErrReservedOrchestrationName, name)
+	}
+	if c.options.KnownOrchestrations == nil {
+		return nil
+	}
+	names, known, err := c.options.KnownOrchestrations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the known orchestrations: %w", err)
+	} else if !known {
+		return nil
+	}
+	for _, n := range names {
+		if n == name || n == "*" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s'", api.ErrUnknownOrchestration, name)
+}
+
+// checkNamespaceQuota returns [ErrQuotaExceeded] if the namespace of the requested orchestration already has as many
+// running orchestrations as its quota allows.
+func (c *backendClient) checkNamespaceQuota(ctx context.Context, req *protos.CreateInstanceRequest) error {
+	if len(c.options.NamespaceQuotas) == 0 {
+		return nil
+	}
+	namespace, ok := helpers.GetTags(req)[c.options.NamespaceTagKey]
+	if !ok {
+		return nil
+	}
+	quota, ok := c.options.NamespaceQuotas[namespace]
+	if !ok {
+		return nil
+	}
+
+	query := api.InstanceQuery{
+		RuntimeStatuses: []protos.OrchestrationStatus{
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING,
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED,
+		},
+		Tags: map[string]string{c.options.NamespaceTagKey: namespace},
+	}
+	running, err := countOrchestrationMetadata(ctx, c.be, query, quota)
+	if err != nil {
+		return fmt.Errorf("failed to count the running orchestrations of namespace '%s': %w", namespace, err)
+	}
+	if running >= quota {
+		return fmt.Errorf("%w: namespace '%s' has %d running orchestration(s)", ErrQuotaExceeded, namespace, running)
+	}
+	return nil
+}
+
+// reportScheduleError calls the configured schedule error callback, if any.
+func (c *backendClient) reportScheduleError(req *protos.CreateInstanceRequest, err error) {
+	if c.options.OnScheduleError != nil {
+		c.options.OnScheduleError(req, err)
+	}
+}
+
+// handleDuplicate handles the error of the backend when the instance ID of the specified ExecutionStarted event is
+// already in use. Retried requests with the same idempotency key succeed, and other collisions are handled according
+// to the instance ID reuse policy of the request, if any, or else passed to the collision handler, if any.
+func (c *backendClient) handleDuplicate(ctx context.Context, req *protos.CreateInstanceRequest, e *HistoryEvent, err error) error {
+	if isIdempotentRetry(ctx, c.be, e) {
+		return nil
+	}
+	handler := c.options.CollisionHandler
+	if action, ok := helpers.GetInstanceIDReuseAction(req); ok {
+		handler = func(*api.OrchestrationMetadata) (CollisionAction, error) {
+			return CollisionAction(action), nil
+		}
+	}
+	if handler != nil {
+		return c.handleCollision(ctx, e, handler)
+	}
+	return err
+}
+
+// isIdempotentRetry returns true if the specified ExecutionStarted event has an idempotency key, and the existing
+// instance with the same ID is an orchestration with the same name and idempotency key, which means that the request
+// to create it is a retry of the request that created the existing instance.
+func isIdempotentRetry(ctx context.Context, be Backend, e *HistoryEvent) bool {
+	es := e.GetExecutionStarted()
+	key := helpers.GetTags(es)[api.IdempotencyKeyTag]
+	if key == "" {
+		return false
+	}
+	existing, err := be.GetOrchestrationMetadata(ctx, api.InstanceID(es.GetOrchestrationInstance().GetInstanceId()))
+	return err == nil && existing.Name == es.Name && existing.IdempotencyKey() == key
+}
+
+// handleCollision consults the specified collision handler after the backend reported that the instance ID of the
+// specified ExecutionStarted event is already in use.
+//
+// Replacing the existing instance isn't atomic. If it's recreated concurrently after it was purged, creating the new
+// instance fails with [ErrDuplicateEvent].
+func (c *backendClient) handleCollision(ctx context.Context, e *HistoryEvent, handler CollisionHandler) error {
+	id := api.InstanceID(e.GetExecutionStarted().OrchestrationInstance.InstanceId)
+	existing, err := c.be.GetOrchestrationMetadata(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the metadata of the existing instance: %w", err)
+	}
+
+	action, err := handler(existing)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case CollisionActionUseExisting:
+		return nil
+	case CollisionActionTerminateAndReplace:
+		if !existing.IsComplete() {
+			if err := c.TerminateOrchestration(ctx, id, api.WithOutput("replaced by a new orchestration with the same instance ID")); err != nil {
+				return fmt.Errorf("failed to terminate the existing instance: %w", err)
+			}
+			timeout := c.options.ReplaceTimeout
+			if timeout <= 0 {
+				timeout = DefaultReplaceTimeout
+			}
+			waitCtx, cancel := context.WithTimeout(ctx, timeout)
+			_, err := c.WaitForOrchestrationCompletion(waitCtx, id)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to wait for the termination of the existing instance: %w", err)
+			}
+		}
+		fallthrough
+	case CollisionActionOverwrite:
+		if err := c.be.PurgeOrchestrationState(ctx, id); err != nil && !errors.Is(err, api.ErrInstanceNotFound) {
+			return fmt.Errorf("failed to purge the existing instance: %w", err)
+		}
+		return c.be.CreateOrchestrationInstance(ctx, e)
+	default:
+		return ErrDuplicateEvent
+	}
+}
+
 // FetchOrchestrationMetadata fetches metadata for the specified orchestration from the configured task hub.
 //
 // ErrInstanceNotFound is returned when the specified orchestration doesn't exist.
@@ -74,37 +489,51 @@ func (c *backendClient) FetchOrchestrationMetadata(ctx context.Context, id api.I
 	return metadata, nil
 }
 
+// QueryInstances fetches one page of the metadata of the orchestration instances that match the specified query,
+// in the order of their instance IDs. To fetch the next page, set the continuation token of the result on the query
+// and call QueryInstances again; the continuation token is empty when there are no more pages.
+//
+// Instances that are created or deleted while the pages are fetched may or may not be returned.
+//
+// [ErrQueriesNotSupported] is returned if the backend doesn't implement [BackendWithQueries].
+func (c *backendClient) QueryInstances(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	result, err := queryOrchestrationMetadata(ctx, c.be, query)
+	if err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to query orchestration instances: %w", err)
+	}
+	return result, nil
+}
+
 // WaitForOrchestrationStart waits for an orchestration to start running and returns an [OrchestrationMetadata] object that contains
-// metadata about the started instance.
+// metadata about the started instance. Use [api.WithPollingBackoff] and [api.WithPollingJitter] to control how often the
+// orchestration metadata is polled. Backends that implement [BackendWithWatch] notify the client of changes instead, in which
+// case the polling options are ignored.
 //
 // ErrInstanceNotFound is returned when the specified orchestration doesn't exist.
-func (c *backendClient) WaitForOrchestrationStart(ctx context.Context, id api.InstanceID) (*api.OrchestrationMetadata, error) {
+func (c *backendClient) WaitForOrchestrationStart(ctx context.Context, id api.InstanceID, opts ...api.WaitOrchestrationOptions) (*api.OrchestrationMetadata, error) {
 	return c.waitForOrchestrationCondition(ctx, id, func(metadata *api.OrchestrationMetadata) bool {
 		return metadata.RuntimeStatus != protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING
-	})
+	}, opts...)
 }
 
 // WaitForOrchestrationCompletion waits for an orchestration to complete and returns an [OrchestrationMetadata] object that contains
-// metadata about the completed instance.
+// metadata about the completed instance. Use [api.WithPollingBackoff] and [api.WithPollingJitter] to control how often
+// the orchestration metadata is polled. Backends that implement [BackendWithWatch] notify the client of changes instead, in which
+// case the polling options are ignored.
 //
 // ErrInstanceNotFound is returned when the specified orchestration doesn't exist.
-func (c *backendClient) WaitForOrchestrationCompletion(ctx context.Context, id api.InstanceID) (*api.OrchestrationMetadata, error) {
+func (c *backendClient) WaitForOrchestrationCompletion(ctx context.Context, id api.InstanceID, opts ...api.WaitOrchestrationOptions) (*api.OrchestrationMetadata, error) {
 	return c.waitForOrchestrationCondition(ctx, id, func(metadata *api.OrchestrationMetadata) bool {
 		return metadata.IsComplete()
-	})
+	}, opts...)
 }
 
-func (c *backendClient) waitForOrchestrationCondition(ctx context.Context, id api.InstanceID, condition func(metadata *api.OrchestrationMetadata) bool) (*api.OrchestrationMetadata, error) {
-	b := backoff.ExponentialBackOff{
-		InitialInterval:     100 * time.Millisecond,
-		MaxInterval:         10 * time.Second,
-		Multiplier:          1.5,
-		RandomizationFactor: 0.05,
-		Stop:                backoff.Stop,
-		Clock:               backoff.SystemClock,
+func (c *backendClient) waitForOrchestrationCondition(ctx context.Context, id api.InstanceID, condition func(metadata *api.OrchestrationMetadata) bool, opts ...api.WaitOrchestrationOptions) (*api.OrchestrationMetadata, error) {
+	if watcher, ok := As[BackendWithWatch](c.be); ok {
+		return watchOrchestrationCondition(ctx, watcher, id, condition)
 	}
-	b.Reset()
 
+	b := newPollingBackoff(opts)
 	for {
 		t := time.NewTimer(b.NextBackOff())
 		select {
@@ -125,6 +554,152 @@ func (c *backendClient) waitForOrchestrationCondition(ctx context.Context, id ap
 	}
 }
 
+// watchOrchestrationCondition is like waitForOrchestrationCondition, but is notified of changes by the backend
+// instead of polling it.
+func watchOrchestrationCondition(ctx context.Context, watcher BackendWithWatch, id api.InstanceID, condition func(metadata *api.OrchestrationMetadata) bool) (*api.OrchestrationMetadata, error) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updates, err := watcher.WatchOrchestrationRuntimeStatus(watchCtx, id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to watch orchestration metadata: %w", err)
+	}
+	for metadata := range updates {
+		if condition(metadata) {
+			return metadata, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The channel is only closed before cancellation if the orchestration was purged while waiting on it
+	return nil, api.ErrInstanceNotFound
+}
+
+// newPollingBackoff returns the backoff for polling orchestration metadata, as configured by the specified options.
+func newPollingBackoff(opts []api.WaitOrchestrationOptions) *backoff.ExponentialBackOff {
+	config := &api.WaitOrchestrationConfig{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     10 * time.Second,
+		Multiplier:      1.5,
+		Jitter:          0.05,
+	}
+	for _, configure := range opts {
+		configure(config)
+	}
+	if config.InitialInterval <= 0 {
+		config.InitialInterval = 100 * time.Millisecond
+	}
+	if config.MaxInterval < config.InitialInterval {
+		config.MaxInterval = config.InitialInterval
+	}
+	if config.Multiplier < 1 {
+		config.Multiplier = 1
+	}
+	if config.Jitter < 0 {
+		config.Jitter = 0
+	} else if config.Jitter > 1 {
+		config.Jitter = 1
+	}
+
+	b := &backoff.ExponentialBackOff{
+		InitialInterval:     config.InitialInterval,
+		MaxInterval:         config.MaxInterval,
+		Multiplier:          config.Multiplier,
+		RandomizationFactor: config.Jitter,
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+	b.Reset()
+	return b
+}
+
+// StreamOrchestrationMetadata returns a channel that receives a snapshot of the metadata of the specified orchestration
+// whenever its runtime status or custom status changes, starting with its current metadata. The channel is closed after
+// the orchestration completes, the orchestration is purged, or ctx is cancelled. The final snapshot of a completed
+// orchestration is always delivered before the channel is closed.
+//
+// Changes are detected by polling, which can be controlled using [api.WithPollingBackoff]. Polling backs off while the
+// orchestration doesn't change and restarts at the initial interval after each change. Consumers that can't keep up
+// don't block polling: intermediate snapshots are dropped, but the most recent one is always kept. Backends that
+// implement [BackendWithWatch] push changes to the client instead, in which case the polling options are ignored.
+//
+// ErrInstanceNotFound is returned when the specified orchestration doesn't exist.
+func (c *backendClient) StreamOrchestrationMetadata(ctx context.Context, id api.InstanceID, opts ...api.WaitOrchestrationOptions) (<-chan *api.OrchestrationMetadata, error) {
+	if watcher, ok := As[BackendWithWatch](c.be); ok {
+		updates, err := watcher.WatchOrchestrationRuntimeStatus(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to watch orchestration metadata: %w", err)
+		}
+		return updates, nil
+	}
+
+	metadata, err := c.FetchOrchestrationMetadata(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *api.OrchestrationMetadata, 1)
+	publishLatest(ch, metadata)
+	if metadata.IsComplete() {
+		close(ch)
+		return ch, nil
+	}
+
+	go func() {
+		defer close(ch)
+
+		last := metadata
+		b := newPollingBackoff(opts)
+		for {
+			t := time.NewTimer(b.NextBackOff())
+			select {
+			case <-ctx.Done():
+				if !t.Stop() {
+					<-t.C
+				}
+				return
+			case <-t.C:
+			}
+
+			metadata, err := c.FetchOrchestrationMetadata(ctx, id)
+			if errors.Is(err, api.ErrInstanceNotFound) {
+				return
+			} else if err != nil {
+				// Transient errors are retried on the next poll, and cancellation is handled at the top of the loop
+				continue
+			}
+			if metadata.RuntimeStatus == last.RuntimeStatus && metadata.SerializedCustomStatus == last.SerializedCustomStatus {
+				continue
+			}
+
+			last = metadata
+			b.Reset()
+			publishLatest(ch, metadata)
+			if metadata.IsComplete() {
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// publishLatest sends a metadata snapshot to a channel with a buffer size of one without blocking, replacing the
+// buffered snapshot if the consumer hasn't received it yet. It must only be called by the channel's single producer.
+func publishLatest(ch chan *api.OrchestrationMetadata, metadata *api.OrchestrationMetadata) {
+	select {
+	case ch <- metadata:
+	default:
+		// Discard the stale snapshot. The consumer may have received it in the meantime, which is fine.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- metadata
+	}
+}
+
 // TerminateOrchestration enqueues a message to terminate a running orchestration, causing it to stop receiving new events and
 // go directly into the TERMINATED state. This operation is asynchronous. An orchestration worker must
 // dequeue the termination event before the orchestration will be terminated.
@@ -159,40 +734,1112 @@ func (c *backendClient) RaiseEvent(ctx context.Context, id api.InstanceID, event
 		}
 	}
 
-	e := helpers.NewEventRaisedEvent(req.Name, req.Input)
+	e, err := c.newEventRaisedEvent(id, req)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSuspensionBuffer(ctx, id, e); err != nil {
+		return err
+	}
 	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
 		return fmt.Errorf("failed to raise event: %w", err)
 	}
 	return nil
 }
 
-// SuspendOrchestration suspends an orchestration instance, halting processing of its events until a "resume" operation resumes it.
+// RaiseEventIf is like [TaskHubClient.RaiseEvent], but only sends the event if the current runtime status of the
+// orchestration instance is one of the expected statuses. The status check and the enqueueing of the event are done
+// atomically by the backend, which avoids races with the orchestration completing or being terminated, in which case
+// the event would otherwise be silently dropped. Backends that don't implement [BackendWithConditionalEvents] can't
+// check the status atomically, so the client checks it before enqueueing the event instead, which narrows the race
+// without closing it.
 //
-// Note that suspended orchestrations are still considered to be "running" even though they will not process events.
-func (c *backendClient) SuspendOrchestration(ctx context.Context, id api.InstanceID, reason string) error {
-	e := helpers.NewSuspendOrchestrationEvent(reason)
-	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
-		return fmt.Errorf("failed to suspend orchestration: %w", err)
+// [api.ErrPreconditionFailed] is returned if the orchestration isn't in one of the expected statuses, and
+// [api.ErrInstanceNotFound] is returned if the orchestration doesn't exist.
+func (c *backendClient) RaiseEventIf(ctx context.Context, id api.InstanceID, eventName string, expectedStatuses []protos.OrchestrationStatus, opts ...api.RaiseEventOptions) error {
+	if len(expectedStatuses) == 0 {
+		return errors.New("at least one expected runtime status must be specified")
+	}
+
+	req := &protos.RaiseEventRequest{InstanceId: string(id), Name: eventName}
+	for _, configure := range opts {
+		if err := configure(req); err != nil {
+			return fmt.Errorf("failed to configure raise event request: %w", err)
+		}
+	}
+
+	e, err := c.newEventRaisedEvent(id, req)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSuspensionBuffer(ctx, id, e); err != nil {
+		return err
+	}
+	if be, ok := As[BackendWithConditionalEvents](c.be); ok {
+		err = be.AddNewOrchestrationEventIf(ctx, id, e, expectedStatuses)
+	} else {
+		err = c.addNewOrchestrationEventIf(ctx, id, e, expectedStatuses)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to raise event: %w", err)
 	}
 	return nil
 }
 
-// ResumeOrchestration resumes an orchestration instance that was previously suspended.
-func (c *backendClient) ResumeOrchestration(ctx context.Context, id api.InstanceID, reason string) error {
-	e := helpers.NewResumeOrchestrationEvent(reason)
-	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
-		return fmt.Errorf("failed to resume orchestration: %w", err)
+// checkSuspensionBuffer returns [ErrSuspensionBufferFull] if the orchestration is suspended and the specified event
+// would exceed the suspension buffer limits configured with [WithRaiseEventSuspensionBufferLimits]. Orchestrations
+// that don't exist are left to the backend to report.
+func (c *backendClient) checkSuspensionBuffer(ctx context.Context, id api.InstanceID, e *HistoryEvent) error {
+	if c.options.MaxSuspendedEventCount <= 0 && c.options.MaxSuspendedEventBytes <= 0 {
+		return nil
+	}
+
+	metadata, err := c.be.GetOrchestrationMetadata(ctx, id)
+	if errors.Is(err, api.ErrInstanceNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to fetch orchestration metadata: %w", err)
+	}
+	if metadata.RuntimeStatus != protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED {
+		return nil
+	}
+
+	state, err := c.be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: id})
+	if err != nil {
+		return fmt.Errorf("failed to fetch orchestration state: %w", err)
+	}
+	if state.exceedsSuspensionBuffer(e, c.options.MaxSuspendedEventCount, c.options.MaxSuspendedEventBytes) {
+		return fmt.Errorf("%v: %w", id, ErrSuspensionBufferFull)
 	}
 	return nil
 }
 
-// PurgeOrchestrationState deletes the state of the specified orchestration instance.
-//
-// [api.ErrInstanceNotFound] is returned if the specified orchestration instance doesn't exist.
-// [api.ErrNotCompleted] is returned if the specified orchestration instance is still running.
-func (c *backendClient) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
-	if err := c.be.PurgeOrchestrationState(ctx, id); err != nil {
-		return fmt.Errorf("failed to purge orchestration state: %w", err)
+// addNewOrchestrationEventIf checks the runtime status of an orchestration and then adds an event to it, for backends
+// that can't do both atomically.
+func (c *backendClient) addNewOrchestrationEventIf(ctx context.Context, id api.InstanceID, e *HistoryEvent, expectedStatuses []protos.OrchestrationStatus) error {
+	metadata, err := c.be.GetOrchestrationMetadata(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !containsStatus(expectedStatuses, metadata.RuntimeStatus) {
+		return api.ErrPreconditionFailed
+	}
+	return c.be.AddNewOrchestrationEvent(ctx, id, e)
+}
+
+// SignalEntity sends a one-way operation to an entity. The entity is created if it doesn't exist yet, and processes
+// the operation asynchronously.
+func (c *backendClient) SignalEntity(ctx context.Context, id api.EntityID, operation string, opts ...api.SignalEntityOptions) error {
+	req := &protos.RaiseEventRequest{InstanceId: id.String(), Name: helpers.EntityOperationEventName}
+	for _, configure := range opts {
+		if err := configure(req); err != nil {
+			return fmt.Errorf("failed to configure signal entity request: %w", err)
+		}
+	}
+	entityReq := helpers.EntityRequest{Operation: operation}
+	if req.Input != nil {
+		entityReq.Input = &req.Input.Value
+	}
+	data, err := json.Marshal(&entityReq)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entity request to JSON: %w", err)
+	}
+	req.Input = wrapperspb.String(string(data))
+
+	// Entities are started on demand, and keep running until they're purged
+	start := helpers.NewExecutionStartedEvent(helpers.EntityOrchestratorName(id.Name), id.String(), nil, nil, nil, nil)
+	if err := c.be.CreateOrchestrationInstance(ctx, start); err != nil && !errors.Is(err, ErrDuplicateEvent) {
+		return fmt.Errorf("failed to create entity: %w", err)
+	}
+
+	e, err := c.newEventRaisedEvent(id.InstanceID(), req)
+	if err != nil {
+		return err
+	}
+	if err := c.be.AddNewOrchestrationEvent(ctx, id.InstanceID(), e); err != nil {
+		return fmt.Errorf("failed to signal entity: %w", err)
 	}
 	return nil
 }
+
+// FetchEntityMetadata fetches the state of an entity, or returns [api.ErrInstanceNotFound] if the entity doesn't
+// exist.
+func (c *backendClient) FetchEntityMetadata(ctx context.Context, id api.EntityID) (*api.EntityMetadata, error) {
+	metadata, err := c.be.GetOrchestrationMetadata(ctx, id.InstanceID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch entity metadata: %w", err)
+	}
+	if metadata.Name != helpers.EntityOrchestratorName(id.Name) {
+		return nil, fmt.Errorf("failed to fetch entity metadata: %w", api.ErrInstanceNotFound)
+	}
+	return &api.EntityMetadata{
+		ID:              id,
+		SerializedState: metadata.SerializedInput,
+		LastModifiedAt:  metadata.LastUpdatedAt,
+	}, nil
+}
+
+// newEventRaisedEvent returns the event that raises the specified event, which carries a sequence number if ordered
+// events are enabled.
+func (c *backendClient) newEventRaisedEvent(id api.InstanceID, req *protos.RaiseEventRequest) (*HistoryEvent, error) {
+	e := helpers.NewEventRaisedEvent(req.Name, req.Input)
+	if c.sequencer == nil {
+		return e, nil
+	}
+	e, err := c.sequencer.sequence(id, e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sequence event: %w", err)
+	}
+	return e, nil
+}
+
+// SuspendOrchestration suspends an orchestration instance, halting processing of its events until a "resume" operation resumes it.
+//
+// Note that suspended orchestrations are still considered to be "running" even though they will not process events.
+func (c *backendClient) SuspendOrchestration(ctx context.Context, id api.InstanceID, reason string) error {
+	e := helpers.NewSuspendOrchestrationEvent(reason)
+	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
+		return fmt.Errorf("failed to suspend orchestration: %w", err)
+	}
+	return nil
+}
+
+// ResumeOrchestration resumes an orchestration instance that was previously suspended.
+func (c *backendClient) ResumeOrchestration(ctx context.Context, id api.InstanceID, reason string) error {
+	e := helpers.NewResumeOrchestrationEvent(reason)
+	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
+		return fmt.Errorf("failed to resume orchestration: %w", err)
+	}
+	return nil
+}
+
+// PurgeOrchestrationState deletes the state of the specified orchestration instance.
+//
+// If [api.WithRecursivePurge] is specified, the sub-orchestrations created by the orchestration, and their
+// sub-orchestrations in turn, are purged as well. Sub-orchestrations that are still running or that were already
+// purged are skipped.
+//
+// [api.ErrInstanceNotFound] is returned if the specified orchestration instance doesn't exist.
+// [api.ErrNotCompleted] is returned if the specified orchestration instance is still running.
+// [ErrEntityInstance] is returned if the specified instance is an entity.
+func (c *backendClient) PurgeOrchestrationState(ctx context.Context, id api.InstanceID, opts ...api.PurgeOptions) (*api.PurgeResult, error) {
+	config := &api.PurgeConfig{}
+	for _, configure := range opts {
+		configure(config)
+	}
+
+	result := &api.PurgeResult{}
+	if err := c.purge(ctx, id, config.Recursive, map[api.InstanceID]bool{}, result); err != nil {
+		return result, fmt.Errorf("failed to purge orchestration state: %w", err)
+	}
+	return result, nil
+}
+
+// purge deletes the state of the specified orchestration instance and, if recursive is true, of its descendants.
+// The visited set protects against cycles in the parent-child relationships.
+func (c *backendClient) purge(ctx context.Context, id api.InstanceID, recursive bool, visited map[api.InstanceID]bool, result *api.PurgeResult) error {
+	visited[id] = true
+
+	// Entities aren't orchestrations, even though they're run by orchestrations
+	if _, ok := api.EntityIDFromInstanceID(id); ok {
+		metadata, err := c.be.GetOrchestrationMetadata(ctx, id)
+		if err != nil {
+			return err
+		}
+		if helpers.IsEntityOrchestratorName(metadata.Name) {
+			return ErrEntityInstance
+		}
+	}
+
+	// The children need to be looked up before the history of the parent is deleted
+	var children []api.InstanceID
+	if recursive {
+		state, err := c.be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: id})
+		if err != nil {
+			return err
+		}
+		children = state.SubOrchestrationInstanceIDs()
+	}
+
+	if err := c.be.PurgeOrchestrationState(ctx, id); err != nil {
+		return err
+	}
+	result.DeletedInstanceCount++
+
+	for _, childID := range children {
+		if visited[childID] {
+			continue
+		}
+		if err := c.purge(ctx, childID, recursive, visited, result); err != nil {
+			if errors.Is(err, api.ErrInstanceNotFound) || errors.Is(err, api.ErrNotCompleted) || errors.Is(err, ErrEntityInstance) {
+				continue
+			}
+			return fmt.Errorf("failed to purge sub-orchestration '%s': %w", childID, err)
+		}
+	}
+	return nil
+}
+
+// PurgeCompletedOrchestrationStates deletes the state of all orchestration instances that completed before the
+// specified time. Use [api.WithPurgeRuntimeStatus] to only purge orchestrations with specific runtime statuses,
+// e.g. to keep failed orchestrations around for longer. This is intended to be run periodically to reclaim the
+// storage used by old orchestrations.
+//
+// Sub-orchestrations are purged only if they match the same criteria, so [api.WithRecursivePurge] is ignored.
+func (c *backendClient) PurgeCompletedOrchestrationStates(ctx context.Context, completedBefore time.Time, opts ...api.PurgeOptions) (*api.PurgeResult, error) {
+	config := &api.PurgeConfig{}
+	for _, configure := range opts {
+		configure(config)
+	}
+
+	query := api.InstanceQuery{RuntimeStatuses: config.RuntimeStatuses, CompletedBefore: completedBefore}
+	result, err := c.purgeInstances(ctx, query)
+	if err != nil {
+		return result, fmt.Errorf("failed to purge completed orchestration states: %w", err)
+	}
+	return result, nil
+}
+
+// PurgeInstancesByFilter deletes the state of all completed orchestration instances that match the specified filter,
+// e.g. all the failed orchestrations whose names start with "import-" that were created more than a week ago. The
+// runtime statuses of the filter default to all of the completed statuses, and orchestrations that aren't completed
+// are never purged. The page size of the filter is the number of instances that are purged in each batch, and its
+// continuation token can resume a purge that was interrupted.
+//
+// The matching instances are purged one batch at a time, so a canceled context stops the purge between two batches,
+// and the returned result counts the instances that were deleted until then. Instances that stop matching the filter
+// while the purge is in progress, e.g. because they were purged concurrently, are skipped.
+func (c *backendClient) PurgeInstancesByFilter(ctx context.Context, filter api.InstanceQuery) (*api.PurgeResult, error) {
+	result, err := c.purgeInstances(ctx, filter)
+	if err != nil {
+		return result, fmt.Errorf("failed to purge orchestration states: %w", err)
+	}
+	return result, nil
+}
+
+// completedStatuses are the runtime statuses of the orchestrations that can be purged.
+var completedStatuses = []protos.OrchestrationStatus{
+	protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED,
+	protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED,
+	protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED,
+	protos.OrchestrationStatus_ORCHESTRATION_STATUS_CANCELED,
+}
+
+// purgeBatchSize is the number of orchestration instances that the client purges in each batch, unless the query
+// specifies a page size, which is the number of instances that are purged between cancellation checks.
+const purgeBatchSize = 100
+
+// purgeInstances purges the completed orchestration instances that match the query, one batch at a time. Backends
+// that implement [BackendWithBulkPurge] delete each batch themselves, unless the query has custom status or tag
+// filters, or doesn't filter on an orchestration name, since the backends can't tell entities apart. The instances
+// of other backends are queried one page at a time and purged one at a time.
+func (c *backendClient) purgeInstances(ctx context.Context, query api.InstanceQuery) (*api.PurgeResult, error) {
+	// Only the state of completed orchestrations can be purged
+	statuses := completedStatuses
+	if len(query.RuntimeStatuses) > 0 {
+		statuses = make([]protos.OrchestrationStatus, 0, len(query.RuntimeStatuses))
+		for _, status := range query.RuntimeStatuses {
+			if containsStatus(completedStatuses, status) {
+				statuses = append(statuses, status)
+			}
+		}
+		if len(statuses) == 0 {
+			return &api.PurgeResult{}, nil
+		}
+	}
+	query.RuntimeStatuses = statuses
+	if query.PageSize <= 0 {
+		query.PageSize = purgeBatchSize
+	}
+
+	purger, ok := As[BackendWithBulkPurge](c.be)
+	if !ok || query.CustomStatusContains != "" || len(query.Tags) > 0 || query.TagFilter != nil ||
+		query.Name == "" || helpers.IsEntityOrchestratorName(query.Name) {
+		return c.purgeQueriedInstances(ctx, query)
+	}
+
+	result := &api.PurgeResult{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		count, continuationToken, err := purger.PurgeOrchestrationStateBatch(ctx, query)
+		result.DeletedInstanceCount += count
+		if err != nil {
+			return result, err
+		}
+		if continuationToken == "" {
+			return result, nil
+		}
+		query.ContinuationToken = continuationToken
+	}
+}
+
+// purgeQueriedInstances purges the orchestration instances that match the query, one page of the query at a time, so
+// a canceled context stops the purge between two pages. Instances that were purged concurrently or that are no longer
+// completed are skipped. The continuation tokens of queries are the IDs of the last instances of their pages, so
+// purging the instances of a page doesn't affect the next page.
+func (c *backendClient) purgeQueriedInstances(ctx context.Context, query api.InstanceQuery) (*api.PurgeResult, error) {
+	result := &api.PurgeResult{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		page, err := queryOrchestrationMetadata(ctx, c.be, query)
+		if err != nil {
+			return result, fmt.Errorf("failed to query orchestrations to purge: %w", err)
+		}
+		for _, metadata := range page.Instances {
+			if err := c.be.PurgeOrchestrationState(ctx, metadata.InstanceID); err != nil {
+				if errors.Is(err, api.ErrInstanceNotFound) || errors.Is(err, api.ErrNotCompleted) {
+					continue
+				}
+				return result, fmt.Errorf("failed to purge orchestration '%s': %w", metadata.InstanceID, err)
+			}
+			result.DeletedInstanceCount++
+		}
+		if page.ContinuationToken == "" {
+			return result, nil
+		}
+		query.ContinuationToken = page.ContinuationToken
+	}
+}
+
+// FetchOrchestrationHistories fetches the history events of multiple orchestration instances in a single round trip
+// to the backend. The keys of fromSequenceNumbers are the IDs of the orchestration instances to fetch, and the values
+// are the sequence numbers of the first events to return, so that tooling can incrementally fetch only the events that
+// were added since a previous call. Use zero to fetch the full history of an instance.
+//
+// All of the fetched histories are held in memory at the same time, so large histories should be fetched in small
+// batches, e.g. a few dozen instances per call.
+//
+// If only some of the histories can be fetched, the ones that could be fetched are returned together with an error
+// that wraps a [*HistoryBatchError], which contains the error of each instance that failed, such as
+// [api.ErrInstanceNotFound].
+func (c *backendClient) FetchOrchestrationHistories(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*protos.HistoryEvent, error) {
+	histories, err := getOrchestrationHistoriesBatch(ctx, c.be, fromSequenceNumbers)
+	if err != nil {
+		return histories, fmt.Errorf("failed to fetch orchestration histories: %w", err)
+	}
+	return histories, nil
+}
+
+// GetOrchestrationHistory returns the history events of an orchestration instance in the order in which they were
+// added. The events are converted to [api.HistoryEvent], whose fields are stable, so that tooling can render the
+// timeline of an orchestration or debug a stuck orchestration without depending on how backends store the events.
+//
+// [api.ErrInstanceNotFound] is returned if the orchestration instance doesn't exist.
+func (c *backendClient) GetOrchestrationHistory(ctx context.Context, id api.InstanceID) ([]*api.HistoryEvent, error) {
+	histories, err := getOrchestrationHistoriesBatch(ctx, c.be, map[api.InstanceID]int{id: 0})
+	if err != nil {
+		var batchErr *HistoryBatchError
+		if errors.As(err, &batchErr) {
+			if instanceErr, ok := batchErr.Errors[id]; ok {
+				err = instanceErr
+			}
+		}
+		return nil, fmt.Errorf("failed to fetch orchestration history: %w", err)
+	}
+
+	history := histories[id]
+	events := make([]*api.HistoryEvent, 0, len(history))
+	for _, e := range history {
+		events = append(events, api.NewHistoryEvent(e))
+	}
+	return events, nil
+}
+
+// getOrchestrationHistoriesBatch fetches the histories of several orchestrations like
+// [BackendWithHistoriesBatch.GetOrchestrationHistoriesBatch], by loading the runtime state of each orchestration if
+// the backend doesn't implement it.
+func getOrchestrationHistoriesBatch(ctx context.Context, be Backend, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*HistoryEvent, error) {
+	if be, ok := As[BackendWithHistoriesBatch](be); ok {
+		return be.GetOrchestrationHistoriesBatch(ctx, fromSequenceNumbers)
+	}
+
+	histories := make(map[api.InstanceID][]*HistoryEvent, len(fromSequenceNumbers))
+	batchErr := &HistoryBatchError{Errors: make(map[api.InstanceID]error)}
+	for id, from := range fromSequenceNumbers {
+		// The runtime state of an orchestration that doesn't exist is empty, so its existence is checked first
+		if _, err := be.GetOrchestrationMetadata(ctx, id); err != nil {
+			batchErr.Errors[id] = err
+			continue
+		}
+		state, err := be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: id})
+		if err != nil {
+			batchErr.Errors[id] = err
+			continue
+		}
+		history := state.OldEvents()
+		if from > len(history) {
+			from = len(history)
+		}
+		histories[id] = history[from:]
+	}
+	if len(batchErr.Errors) > 0 {
+		return histories, batchErr
+	}
+	return histories, nil
+}
+
+// FindOrphanedSubOrchestrations returns the metadata of the sub-orchestrations that are still pending, running, or
+// suspended even though their parent orchestration has completed, failed, or was terminated or purged. The results of
+// these sub-orchestrations will never be consumed, so operators typically terminate them.
+//
+// This is a diagnostic and cleanup tool: orphaned sub-orchestrations are only reported, never terminated or reclaimed
+// automatically. Finding them requires scanning the parent links of all non-completed orchestrations, so it shouldn't
+// be called on a hot path. Backends that don't implement [BackendWithOrphanQueries] don't store the parent links in
+// the metadata, so the history of each non-completed orchestration is loaded to find its parent, and pending
+// sub-orchestrations that haven't started yet aren't reported.
+func (c *backendClient) FindOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	var orphans []*api.OrchestrationMetadata
+	var err error
+	if be, ok := As[BackendWithOrphanQueries](c.be); ok {
+		orphans, err = be.GetOrphanedSubOrchestrations(ctx)
+	} else {
+		orphans, err = c.findOrphanedSubOrchestrations(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find orphaned sub-orchestrations: %w", err)
+	}
+	return orphans, nil
+}
+
+// findOrphanedSubOrchestrations finds the orphaned sub-orchestrations by loading the history of each non-completed
+// orchestration to find its parent, for backends that don't implement [BackendWithOrphanQueries].
+func (c *backendClient) findOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	parents := make(map[api.InstanceID]bool) // whether each parent orchestration is completed or purged
+	query := api.InstanceQuery{RuntimeStatuses: []protos.OrchestrationStatus{
+		protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+		protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING,
+		protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED,
+	}}
+	for {
+		page, err := queryOrchestrationMetadata(ctx, c.be, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range page.Instances {
+			state, err := c.be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: metadata.InstanceID})
+			if err != nil {
+				return nil, err
+			}
+			parentID, ok := parentInstanceID(state.OldEvents())
+			if !ok {
+				continue
+			}
+			orphaned, ok := parents[parentID]
+			if !ok {
+				parent, err := c.be.GetOrchestrationMetadata(ctx, parentID)
+				if err != nil && !errors.Is(err, api.ErrInstanceNotFound) {
+					return nil, err
+				}
+				orphaned = err != nil || parent.IsComplete()
+				parents[parentID] = orphaned
+			}
+			if orphaned {
+				orphans = append(orphans, metadata)
+			}
+		}
+		if page.ContinuationToken == "" {
+			return orphans, nil
+		}
+		query.ContinuationToken = page.ContinuationToken
+	}
+}
+
+// parentInstanceID returns the ID of the parent orchestration of the orchestration with the specified history, if
+// it's a sub-orchestration.
+func parentInstanceID(history []*HistoryEvent) (api.InstanceID, bool) {
+	for _, e := range history {
+		if es := e.GetExecutionStarted(); es != nil {
+			if parent := es.GetParentInstance(); parent != nil {
+				return api.InstanceID(parent.GetOrchestrationInstance().GetInstanceId()), true
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// GetOrchestrationStats returns aggregate execution statistics for the orchestrations with the specified name that
+// were created or completed within the specified time window, ending now.
+//
+// Duration statistics require completion timestamps, so they only cover orchestrations that completed successfully or
+// failed within the time window. The statistics are computed by the backend using aggregate queries over the stored
+// orchestration instances, which can be expensive for large task hubs, and backends may return cached results.
+// Backends that don't implement [BackendWithStats] return the metadata of all the orchestrations with the name, from
+// which the client computes the statistics.
+func (c *backendClient) GetOrchestrationStats(ctx context.Context, name string, timeWindow time.Duration) (*api.OrchestrationStats, error) {
+	if timeWindow <= 0 {
+		return nil, fmt.Errorf("time window must be positive: %v", timeWindow)
+	}
+
+	since := time.Now().Add(-timeWindow)
+	var stats *api.OrchestrationStats
+	var err error
+	if be, ok := As[BackendWithStats](c.be); ok {
+		stats, err = be.GetOrchestrationStats(ctx, name, since)
+	} else {
+		stats, err = computeOrchestrationStats(ctx, c.be, name, since)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch orchestration stats: %w", err)
+	}
+	return stats, nil
+}
+
+// GetLastActions returns the actions produced by the most recent execution of the specified orchestration instance.
+//
+// Actions are only saved when the orchestration worker is configured with [WithPersistLastActions], which is
+// opt-in due to the extra storage cost. Only the actions of the most recent execution are retained, so this
+// isn't a complete log of everything an orchestration has done. An empty list is returned if no actions were saved.
+//
+// [api.ErrInstanceNotFound] is returned if the specified orchestration instance doesn't exist, and
+// [ErrLastActionsNotSupported] is returned if the backend doesn't implement [BackendWithLastActions].
+func (c *backendClient) GetLastActions(ctx context.Context, id api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	be, ok := As[BackendWithLastActions](c.be)
+	if !ok {
+		return nil, ErrLastActionsNotSupported
+	}
+	actions, err := be.GetOrchestrationLastActions(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch last orchestrator actions: %w", err)
+	}
+	return actions, nil
+}
+
+// Reevaluate enqueues a no-op wakeup event for the specified orchestration, forcing an orchestration worker
+// to re-run the orchestrator over its existing history. This is useful after deploying a fixed orchestrator,
+// since running instances get to re-evaluate their current state with the new code, and potentially schedule
+// corrective actions, without having to be rewound or restarted.
+//
+// WARNING: The new orchestrator code must still be deterministic with respect to the recorded history. If it
+// schedules different tasks than the ones already recorded, the replay fails and the orchestration could get stuck
+// or fail. Because of this risk, the client must be created with [WithReevaluation] to use this method, otherwise
+// [ErrReevaluationDisabled] is returned.
+//
+// Like other events, the wakeup event is discarded for completed orchestrations and is buffered for suspended ones.
+func (c *backendClient) Reevaluate(ctx context.Context, id api.InstanceID) error {
+	if !c.options.AllowReevaluation {
+		return ErrReevaluationDisabled
+	}
+
+	e := helpers.NewGenericEvent(helpers.ReevaluateEventData)
+	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
+		return fmt.Errorf("failed to add reevaluation event: %w", err)
+	}
+	return nil
+}
+
+// SetCustomStatus sets the custom status of a running orchestration from outside of the orchestrator, e.g. so that an
+// external process can report progress on behalf of the orchestration. The specified value must be serializable to
+// JSON, and passing nil clears the custom status.
+//
+// The update is delivered to the orchestration as an event, so it's applied, and visible to clients, as soon as a
+// worker processes it, even if the orchestration is waiting for a long-running task. The orchestrator sees the
+// updated custom status, and any later call to [task.OrchestrationContext.SetCustomStatus] replaces it. Like other
+// events, the update is discarded for completed orchestrations and is buffered for suspended ones.
+func (c *backendClient) SetCustomStatus(ctx context.Context, id api.InstanceID, customStatus any) error {
+	var serialized string
+	if customStatus != nil {
+		bytes, err := json.Marshal(customStatus)
+		if err != nil {
+			return fmt.Errorf("failed to marshal custom status to JSON: %w", err)
+		}
+		serialized = string(bytes)
+	}
+
+	e := helpers.NewCustomStatusUpdatedEvent(serialized)
+	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
+		return fmt.Errorf("failed to add custom status event: %w", err)
+	}
+	return nil
+}
+
+// ListDeadLetters returns the poison work items that workers moved to the dead-letter store of the backend, as
+// configured with [WithMaxDeliveryCount], in the order in which they were moved.
+//
+// [ErrDeadLettersNotSupported] is returned if the backend doesn't implement [BackendWithDeadLetters].
+func (c *backendClient) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	be, ok := As[BackendWithDeadLetters](c.be)
+	if !ok {
+		return nil, ErrDeadLettersNotSupported
+	}
+	deadLetters, err := be.ListDeadLetters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	return deadLetters, nil
+}
+
+// ResubmitDeadLetter puts the events of the specified dead letter back in the queue that they came from, e.g. after
+// deploying a fix for the orchestrator or the activity that failed to process them, so that the orchestration makes
+// progress again. The resubmitted work item can be delivered the maximum number of times again.
+//
+// [ErrDeadLetterNotFound] is returned if the dead letter doesn't exist, and [ErrDeadLettersNotSupported] is returned
+// if the backend doesn't implement [BackendWithDeadLetters].
+func (c *backendClient) ResubmitDeadLetter(ctx context.Context, id int64) error {
+	be, ok := As[BackendWithDeadLetters](c.be)
+	if !ok {
+		return ErrDeadLettersNotSupported
+	}
+	if err := be.ResubmitDeadLetter(ctx, id); err != nil {
+		return fmt.Errorf("failed to resubmit dead letter: %w", err)
+	}
+	return nil
+}
+
+// DeleteDeadLetter discards the specified dead letter. The orchestration of a discarded orchestration work item never
+// sees its events, and the orchestration of a discarded activity work item never sees the result of the activity, so
+// the orchestration is usually terminated or purged as well.
+//
+// [ErrDeadLetterNotFound] is returned if the dead letter doesn't exist, and [ErrDeadLettersNotSupported] is returned
+// if the backend doesn't implement [BackendWithDeadLetters].
+func (c *backendClient) DeleteDeadLetter(ctx context.Context, id int64) error {
+	be, ok := As[BackendWithDeadLetters](c.be)
+	if !ok {
+		return ErrDeadLettersNotSupported
+	}
+	if err := be.DeleteDeadLetter(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	return nil
+}
+
+// InjectFault injects a fault into the specified orchestration instance for chaos testing, e.g. to verify that its
+// compensation logic works when an activity fails. The fault is applied by the orchestration worker to the next
+// activity, timer, or external event of the orchestration, depending on its type. Multiple faults are applied in
+// the order in which they were injected.
+//
+// Both the injected fault and its application are recorded in the orchestration history, so replaying the history
+// is deterministic. The client must be created with [WithFaultInjection] to use this method, otherwise
+// [ErrFaultInjectionDisabled] is returned.
+func (c *backendClient) InjectFault(ctx context.Context, id api.InstanceID, fault api.FaultSpec) error {
+	if !c.options.AllowFaultInjection {
+		return ErrFaultInjectionDisabled
+	}
+
+	switch fault.Type {
+	case api.FaultFailNextActivity, api.FaultDropNextEvent:
+	case api.FaultDelayNextTimer:
+		if fault.Delay <= 0 {
+			return fmt.Errorf("invalid fault: the timer delay must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid fault: unknown fault type %d", fault.Type)
+	}
+
+	e, err := newFaultInjectedEvent(injectedFault{ID: uuid.NewString(), FaultSpec: fault})
+	if err != nil {
+		return fmt.Errorf("failed to create fault event: %w", err)
+	}
+	if err := c.be.AddNewOrchestrationEvent(ctx, id, e); err != nil {
+		return fmt.Errorf("failed to inject fault: %w", err)
+	}
+	return nil
+}
+
+// RetrySubOrchestration resets the failed sub-orchestration that was scheduled by the parent orchestration with the
+// specified task ID, and schedules it again with its original name, instance ID, and input. The parent is then
+// re-signaled so that, on replay, the recorded failure is hidden and the parent waits for the outcome of the retried
+// sub-orchestration instead. This avoids having to restart the whole parent orchestration because of a partial failure.
+//
+// The parent orchestration must still be running and waiting on the sub-orchestration, which means it must not have
+// processed the failure yet, for example because it was suspended when the sub-orchestration failed and hasn't been
+// resumed since. If the parent already acted on the failure, hiding it on replay would make the parent diverge from
+// its recorded history, so [ErrSubOrchestrationFailureObserved] is returned instead.
+//
+// The sub-orchestration is purged, scheduled again, and then the parent is signaled, which isn't atomic. If scheduling
+// the sub-orchestration fails after the purge, its previous state is restored when the backend implements
+// [BackendWithMigration], and the parent is left unchanged. If signaling the parent fails, the retried
+// sub-orchestration still runs, but the parent observes the original failure when it's resumed.
+//
+// [api.ErrInstanceNotFound] is returned if the parent orchestration doesn't exist. [ErrSubOrchestrationNotFound] is returned
+// if the parent didn't schedule a sub-orchestration with the specified task ID, and [ErrSubOrchestrationNotFailed] is
+// returned if that sub-orchestration didn't fail.
+func (c *backendClient) RetrySubOrchestration(ctx context.Context, parentID api.InstanceID, subTaskID int32) error {
+	parent, err := c.be.GetOrchestrationMetadata(ctx, parentID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch parent orchestration metadata: %w", err)
+	}
+	if !parent.IsRunning() {
+		return fmt.Errorf("parent orchestration '%s' is not running", parentID)
+	}
+
+	parentState, err := c.be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: parentID})
+	if err != nil {
+		return fmt.Errorf("failed to fetch parent orchestration state: %w", err)
+	}
+	childID, ok := parentState.SubOrchestrationInstanceID(subTaskID)
+	if !ok {
+		return ErrSubOrchestrationNotFound
+	}
+	if subOrchestrationFailureObserved(parentState.OldEvents(), subTaskID) {
+		return ErrSubOrchestrationFailureObserved
+	}
+
+	child, err := c.be.GetOrchestrationMetadata(ctx, childID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sub-orchestration metadata: %w", err)
+	}
+	if child.RuntimeStatus != protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED {
+		return ErrSubOrchestrationNotFailed
+	}
+
+	if err := c.recreateSubOrchestration(ctx, childID); err != nil {
+		return err
+	}
+
+	e := helpers.NewSubOrchestrationRetriedEvent(subTaskID)
+	if err := c.be.AddNewOrchestrationEvent(ctx, parentID, e); err != nil {
+		return fmt.Errorf("failed to signal parent orchestration, which will observe the original failure of the sub-orchestration: %w", err)
+	}
+	return nil
+}
+
+// subOrchestrationFailureObserved returns true if the failure of the sub-orchestration with the specified task ID was
+// already processed by its parent, given the history of the parent. A failure that's recorded while the parent is
+// suspended is only processed once the parent is resumed, and a failure that was superseded by a retry no longer counts.
+func subOrchestrationFailureObserved(history []*HistoryEvent, taskID int32) bool {
+	suspended, pending, observed := false, false, false
+	for _, e := range history {
+		switch {
+		case e.GetExecutionSuspended() != nil:
+			suspended = true
+		case e.GetExecutionResumed() != nil:
+			suspended = false
+			observed = observed || pending
+		case e.GetSubOrchestrationInstanceFailed() != nil && e.GetSubOrchestrationInstanceFailed().TaskScheduledId == taskID:
+			pending = suspended
+			observed = !suspended
+		default:
+			if retriedID, ok := helpers.GetSubOrchestrationRetriedTaskID(e); ok && retriedID == taskID {
+				pending, observed = false, false
+			}
+		}
+	}
+	return observed
+}
+
+// recreateSubOrchestration purges a completed sub-orchestration and schedules it again from its original start event,
+// which also carries the parent info, so that its outcome is reported to its parent again.
+func (c *backendClient) recreateSubOrchestration(ctx context.Context, childID api.InstanceID) error {
+	childState, err := c.be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: childID})
+	if err != nil {
+		return fmt.Errorf("failed to fetch sub-orchestration state: %w", err)
+	}
+	var startEvent *HistoryEvent
+	for _, e := range childState.OldEvents() {
+		if e.GetExecutionStarted() != nil {
+			startEvent = proto.Clone(e).(*HistoryEvent)
+			break
+		}
+	}
+	if startEvent == nil {
+		return fmt.Errorf("sub-orchestration '%s' has no start event", childID)
+	}
+	startEvent.Timestamp = timestamppb.Now()
+
+	// The previous state is kept, when possible, to restore it if the sub-orchestration can't be scheduled again
+	var previous *OrchestrationInstanceState
+	be, canRestore := As[BackendWithMigration](c.be)
+	if canRestore {
+		if previous, err = be.ExportOrchestrationInstance(ctx, childID); err != nil {
+			return fmt.Errorf("failed to fetch sub-orchestration state: %w", err)
+		}
+	}
+
+	if err := c.be.PurgeOrchestrationState(ctx, childID); err != nil {
+		return fmt.Errorf("failed to reset sub-orchestration: %w", err)
+	}
+	if err := c.be.CreateOrchestrationInstance(ctx, startEvent); err != nil {
+		if !canRestore {
+			return fmt.Errorf("failed to restart sub-orchestration, whose previous state was purged: %w", err)
+		}
+		if restoreErr := be.ImportOrchestrationInstance(ctx, previous); restoreErr != nil {
+			return fmt.Errorf("failed to restart sub-orchestration: %w; failed to restore its previous state: %v", err, restoreErr)
+		}
+		return fmt.Errorf("failed to restart sub-orchestration, whose previous state was restored: %w", err)
+	}
+	return nil
+}
+
+// RewindOrchestration resumes a failed orchestration from its most recent failed activity or sub-orchestration,
+// instead of leaving it permanently failed, e.g. after fixing the outage that made an activity fail. The history of
+// the orchestration is rewritten so that the failed task is scheduled again: a failed activity is re-queued with its
+// original input, and a failed sub-orchestration is purged and scheduled again with its original instance ID and
+// input. The orchestration is running again when this method returns, and the rewind is recorded in its history with
+// the specified reason.
+//
+// The orchestration is rewritten by exporting, purging, and re-importing it, so it must not be modified concurrently,
+// and it must not have scheduled new work after the failed task, e.g. a compensating activity.
+//
+// [api.ErrInstanceNotFound] is returned if the orchestration doesn't exist, [ErrOrchestrationNotFailed] is returned if
+// it isn't failed, and [ErrNothingToRewind] is returned if it failed without a failed activity or sub-orchestration.
+// [ErrMigrationNotSupported] is returned if the backend doesn't implement [BackendWithMigration].
+func (c *backendClient) RewindOrchestration(ctx context.Context, id api.InstanceID, reason string) error {
+	be, ok := As[BackendWithMigration](c.be)
+	if !ok {
+		return ErrMigrationNotSupported
+	}
+
+	state, err := be.ExportOrchestrationInstance(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to fetch orchestration state: %w", err)
+	}
+	if state.Metadata.RuntimeStatus != protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED {
+		return ErrOrchestrationNotFailed
+	}
+
+	failedIndex := -1
+	for i := len(state.History) - 1; i >= 0 && failedIndex < 0; i-- {
+		if state.History[i].GetTaskFailed() != nil || state.History[i].GetSubOrchestrationInstanceFailed() != nil {
+			failedIndex = i
+		}
+	}
+	if failedIndex < 0 {
+		return ErrNothingToRewind
+	}
+	failed := state.History[failedIndex]
+
+	// The history is cut at the failure. The results that the orchestration received after it are delivered again,
+	// but the orchestrator's own events after it, such as its completion, are dropped.
+	history := make([]*HistoryEvent, 0, failedIndex+1)
+	history = append(history, state.History[:failedIndex]...)
+	for _, e := range state.History[failedIndex+1:] {
+		switch {
+		case e.GetTaskCompleted() != nil,
+			e.GetTimerFired() != nil,
+			e.GetEventRaised() != nil,
+			e.GetSubOrchestrationInstanceCompleted() != nil,
+			e.GetSubOrchestrationInstanceFailed() != nil:
+			state.PendingEvents = append(state.PendingEvents, e)
+		case e.GetTaskScheduled() != nil,
+			e.GetTimerCreated() != nil,
+			e.GetSubOrchestrationInstanceCreated() != nil,
+			e.GetEventSent() != nil:
+			return fmt.Errorf("failed to rewind orchestration: the orchestration scheduled new work after the failed task")
+		}
+	}
+	history = append(history, helpers.NewOrchestrationRewoundEvent(reason))
+
+	// Find the task that failed, which is scheduled again below
+	var taskScheduled *HistoryEvent
+	var subOrchestrationID api.InstanceID
+	for _, e := range history {
+		if tf := failed.GetTaskFailed(); tf != nil && e.GetTaskScheduled() != nil && e.EventId == tf.TaskScheduledId {
+			taskScheduled = e
+		} else if sf := failed.GetSubOrchestrationInstanceFailed(); sf != nil && e.GetSubOrchestrationInstanceCreated() != nil && e.EventId == sf.TaskScheduledId {
+			subOrchestrationID = api.InstanceID(e.GetSubOrchestrationInstanceCreated().InstanceId)
+		}
+	}
+	if taskScheduled == nil && subOrchestrationID == "" {
+		return fmt.Errorf("failed to rewind orchestration: the failed task has no scheduled event")
+	}
+	if taskScheduled != nil {
+		state.PendingTasks = append(state.PendingTasks, taskScheduled)
+	}
+
+	state.History = history
+	state.Metadata.RuntimeStatus = protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING
+	state.Metadata.LastUpdatedAt = time.Now().UTC()
+	state.Metadata.SerializedOutput = ""
+	state.Metadata.FailureDetails = nil
+
+	if err := c.be.PurgeOrchestrationState(ctx, id); err != nil {
+		return fmt.Errorf("failed to reset orchestration: %w", err)
+	}
+	if err := be.ImportOrchestrationInstance(ctx, state); err != nil {
+		return fmt.Errorf("failed to save the rewound orchestration: %w", err)
+	}
+
+	// The sub-orchestration is scheduled after the parent is running again, so that its outcome isn't lost
+	if subOrchestrationID != "" {
+		if err := c.recreateSubOrchestration(ctx, subOrchestrationID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestartOrchestration schedules a fresh execution of the specified orchestration with the name, input, and tags of its
+// ExecutionStarted event, so that failed or terminated orchestrations can be re-run without the caller having kept
+// their input. For orchestrations that continued-as-new, the input of the most recent generation is used.
+//
+// By default, the original orchestration is purged and the restarted orchestration reuses its instance ID, which
+// requires the original orchestration to be completed. Use [api.WithRestartNewInstanceID] to keep the original
+// orchestration and give the restarted one a new instance ID instead, which also works for running orchestrations.
+// Sub-orchestrations are restarted as top-level orchestrations.
+//
+// Returns the instance ID of the restarted orchestration. [api.ErrInstanceNotFound] is returned if the orchestration
+// doesn't exist, and [api.ErrNotCompleted] is returned if it's still running and its instance ID would be reused.
+func (c *backendClient) RestartOrchestration(ctx context.Context, id api.InstanceID, opts ...api.RestartOptions) (api.InstanceID, error) {
+	config := &api.RestartConfig{}
+	for _, configure := range opts {
+		configure(config)
+	}
+
+	metadata, err := c.be.GetOrchestrationMetadata(ctx, id)
+	if err != nil {
+		return api.EmptyInstanceID, fmt.Errorf("failed to fetch orchestration metadata: %w", err)
+	}
+	if !config.NewInstanceID && !metadata.IsComplete() {
+		return api.EmptyInstanceID, fmt.Errorf("failed to restart orchestration: %w", api.ErrNotCompleted)
+	}
+
+	state, err := c.be.GetOrchestrationRuntimeState(ctx, &OrchestrationWorkItem{InstanceID: id})
+	if err != nil {
+		return api.EmptyInstanceID, fmt.Errorf("failed to fetch orchestration state: %w", err)
+	}
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range state.OldEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+	if startEvent == nil {
+		return api.EmptyInstanceID, fmt.Errorf("orchestration '%s' has no start event", id)
+	}
+
+	restartID := id
+	if config.NewInstanceID {
+		restartID = api.InstanceID(uuid.NewString())
+	} else if err := c.be.PurgeOrchestrationState(ctx, id); err != nil {
+		return api.EmptyInstanceID, fmt.Errorf("failed to purge the original orchestration: %w", err)
+	}
+
+	newOpts := []api.NewOrchestrationOptions{api.WithInstanceID(restartID)}
+	if startEvent.Input != nil {
+		newOpts = append(newOpts, api.WithRawInput(startEvent.Input.GetValue()))
+	}
+	if tags := helpers.GetTags(startEvent); len(tags) > 0 {
+		newOpts = append(newOpts, api.WithTags(tags))
+	}
+	if timeout := helpers.GetOrchestrationTimeout(startEvent); timeout > 0 {
+		newOpts = append(newOpts, api.WithOrchestrationTimeout(timeout))
+	}
+	return c.ScheduleNewOrchestration(ctx, startEvent.Name, newOpts...)
+}
+
+// InputPatch transforms the serialized input of a failed orchestration before it's retried by
+// [TaskHubClient.RetryFailedOrchestrations], e.g. to fix the data that made it fail. The input is nil if the
+// orchestration didn't have an input, and returning nil retries the orchestration without an input.
+type InputPatch func(input []byte) ([]byte, error)
+
+// RetryFailedConfig configures [TaskHubClient.RetryFailedOrchestrations].
+type RetryFailedConfig struct {
+	// Purge replaces each failed orchestration instance with its retry, which reuses its instance ID.
+	Purge bool
+}
+
+// RetryFailedOptions is a set of options for retrying failed orchestrations.
+type RetryFailedOptions func(*RetryFailedConfig)
+
+// WithRetryPurge configures whether the failed orchestration instances are purged and retried with their original
+// instance IDs, instead of being kept and retried with new instance IDs.
+func WithRetryPurge(purge bool) RetryFailedOptions {
+	return func(c *RetryFailedConfig) {
+		c.Purge = purge
+	}
+}
+
+// RetryFailedError is returned by [TaskHubClient.RetryFailedOrchestrations] when some of the failed orchestration
+// instances couldn't be retried.
+type RetryFailedError struct {
+	// Errors contains the error of each orchestration instance that couldn't be retried.
+	Errors map[api.InstanceID]error
+}
+
+func (e *RetryFailedError) Error() string {
+	return fmt.Sprintf("failed to retry %d orchestration instance(s)", len(e.Errors))
+}
+
+// RetryFailedOrchestrations re-drives the failed orchestration instances that match the specified query, e.g. after
+// deploying a fix for the cause of the failures. The runtime statuses of the query are ignored, since only failed
+// orchestrations are retried. If inputPatch isn't nil, it's applied to the input of each orchestration before it's
+// retried.
+//
+// Each retry is a fresh execution of the orchestration with a new history, scheduled like
+// [TaskHubClient.ScheduleNewOrchestration] does. By default, the failed instances are left untouched, and the retries
+// get new instance IDs that consist of the original instance ID followed by "-retry-" and a random suffix. With
+// [WithRetryPurge], each failed instance is purged and its retry reuses its instance ID; if scheduling the retry fails
+// after the purge, the failed instance is lost. Failed sub-orchestrations are retried as top-level orchestrations; use
+// [TaskHubClient.RetrySubOrchestration] to retry a sub-orchestration on behalf of its parent.
+//
+// Returns the number of orchestrations that were retried. If some of them couldn't be retried, the others are still
+// retried, and a [*RetryFailedError] with the error of each of them is returned.
+func (c *backendClient) RetryFailedOrchestrations(ctx context.Context, query api.InstanceQuery, inputPatch InputPatch, opts ...RetryFailedOptions) (int, error) {
+	config := &RetryFailedConfig{}
+	for _, configure := range opts {
+		configure(config)
+	}
+
+	// All the failed instances are listed before any of them is retried, since retries that reuse the instance IDs of
+	// the failed instances would otherwise be listed again
+	query.RuntimeStatuses = []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED}
+	var ids []api.InstanceID
+	for {
+		page, err := queryOrchestrationMetadata(ctx, c.be, query)
+		if err != nil {
+			return 0, fmt.Errorf("failed to query failed orchestrations: %w", err)
+		}
+		for _, metadata := range page.Instances {
+			ids = append(ids, metadata.InstanceID)
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		query.ContinuationToken = page.ContinuationToken
+	}
+
+	retried := 0
+	errs := make(map[api.InstanceID]error)
+	for _, id := range ids {
+		if err := c.retryFailedOrchestration(ctx, id, inputPatch, config); err != nil {
+			errs[id] = err
+		} else {
+			retried++
+		}
+	}
+	if len(errs) > 0 {
+		return retried, &RetryFailedError{Errors: errs}
+	}
+	return retried, nil
+}
+
+func (c *backendClient) retryFailedOrchestration(ctx context.Context, id api.InstanceID, inputPatch InputPatch, config *RetryFailedConfig) error {
+	metadata, err := c.be.GetOrchestrationMetadata(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to fetch orchestration metadata: %w", err)
+	} else if metadata.RuntimeStatus != protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED {
+		return fmt.Errorf("orchestration is no longer failed: %s", helpers.ToRuntimeStatusString(metadata.RuntimeStatus))
+	}
+
+	var input []byte
+	if metadata.SerializedInput != "" {
+		input = []byte(metadata.SerializedInput)
+	}
+	if inputPatch != nil {
+		if input, err = inputPatch(input); err != nil {
+			return fmt.Errorf("failed to patch the input: %w", err)
+		}
+	}
+
+	retryID := api.InstanceID(fmt.Sprintf("%s-retry-%s", id, uuid.NewString()))
+	if config.Purge {
+		if err := c.be.PurgeOrchestrationState(ctx, id); err != nil {
+			return fmt.Errorf("failed to purge the failed orchestration: %w", err)
+		}
+		retryID = id
+	}
+
+	opts := []api.NewOrchestrationOptions{api.WithInstanceID(retryID)}
+	if input != nil {
+		opts = append(opts, api.WithRawInput(string(input)))
+	}
+	_, err = c.ScheduleNewOrchestration(ctx, metadata.Name, opts...)
+	return err
+}
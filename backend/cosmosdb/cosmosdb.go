@@ -0,0 +1,1891 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// The partitions of the work items container
+const (
+	orchestrationPartition = "orchestrations"
+	activityPartition      = "activities"
+	indexPartition         = "instances"
+	counterPartition       = "counters"
+)
+
+// The types of the documents in the partition of an instance
+const (
+	instanceType = "instance"
+	historyType  = "history"
+	eventType    = "event"
+)
+
+// lockedVisibleTime is the visible time of the orchestration work item of a locked instance. Adding an event to the
+// instance resets the visible time, so that the worker that holds the lock can tell whether new events arrived
+// while it was processing the work item. Times are stored in milliseconds, because Cosmos DB stores numbers as
+// doubles.
+const lockedVisibleTime = 1 << 53
+
+// maxBatchOperations is the maximum number of operations in a Cosmos DB transactional batch.
+const maxBatchOperations = 100
+
+// maxWorkItemCandidates is the number of work items that a worker attempts to lock before giving up, when other
+// workers lock them first.
+const maxWorkItemCandidates = 10
+
+var errNotAvailable = errors.New("the work item is no longer available")
+
+type CosmosDBOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// ConnectionString is the connection string of the Cosmos DB account, which contains its endpoint and key.
+	ConnectionString string
+
+	// DatabaseName is the name of the database of the task hub, which is created on demand. Multiple task hubs can
+	// share an account by using different databases.
+	DatabaseName string
+}
+
+type cosmosDBBackend struct {
+	client     *azcosmos.Client
+	instances  *azcosmos.ContainerClient
+	workItems  *azcosmos.ContainerClient
+	workerName string
+	logger     backend.Logger
+	options    *CosmosDBOptions
+}
+
+// instanceDocument contains the metadata of an orchestration instance. It's stored in the partition of the
+// instance, and copied to the index partition of the work items container, so that instances can be queried without
+// cross-partition queries.
+type instanceDocument struct {
+	ID               string            `json:"id"`
+	InstanceID       string            `json:"instanceId"`
+	Partition        string            `json:"partition,omitempty"`
+	Type             string            `json:"type"`
+	Name             string            `json:"name"`
+	Version          string            `json:"version,omitempty"`
+	ExecutionID      string            `json:"executionId,omitempty"`
+	RuntimeStatus    string            `json:"runtimeStatus"`
+	CreatedTime      time.Time         `json:"createdTime"`
+	LastUpdatedTime  time.Time         `json:"lastUpdatedTime"`
+	CompletedTime    *time.Time        `json:"completedTime,omitempty"`
+	Input            string            `json:"input,omitempty"`
+	Output           string            `json:"output,omitempty"`
+	CustomStatus     string            `json:"customStatus,omitempty"`
+	FailureDetails   []byte            `json:"failureDetails,omitempty"`
+	ParentInstanceID string            `json:"parentInstanceId,omitempty"`
+	GenerationCount  int               `json:"generationCount"`
+	HistoryLength    int               `json:"historyLength"`
+	LastActions      []byte            `json:"lastActions,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+type historyDocument struct {
+	ID             string `json:"id"`
+	InstanceID     string `json:"instanceId"`
+	Type           string `json:"type"`
+	SequenceNumber int64  `json:"sequenceNumber"`
+	EventPayload   []byte `json:"eventPayload"`
+}
+
+type eventDocument struct {
+	ID             string `json:"id"`
+	InstanceID     string `json:"instanceId"`
+	Type           string `json:"type"`
+	SequenceNumber int64  `json:"sequenceNumber"`
+	VisibleTime    int64  `json:"visibleTime"`
+	DequeueCount   int32  `json:"dequeueCount"`
+	LockedBy       string `json:"lockedBy,omitempty"`
+	EventPayload   []byte `json:"eventPayload"`
+}
+
+// leaseDocument is the orchestration work item of an instance with pending events.
+type leaseDocument struct {
+	ID             string      `json:"id"`
+	Partition      string      `json:"partition"`
+	VisibleTime    int64       `json:"visibleTime"`
+	LockedBy       string      `json:"lockedBy,omitempty"`
+	LockExpiration int64       `json:"lockExpiration,omitempty"`
+	ETag           azcore.ETag `json:"_etag,omitempty"`
+}
+
+type taskDocument struct {
+	ID             string      `json:"id"`
+	Partition      string      `json:"partition"`
+	SequenceNumber int64       `json:"sequenceNumber"`
+	InstanceID     string      `json:"instanceId"`
+	DequeueCount   int32       `json:"dequeueCount"`
+	LockedBy       string      `json:"lockedBy,omitempty"`
+	LockExpiration int64       `json:"lockExpiration,omitempty"`
+	EventPayload   []byte      `json:"eventPayload"`
+	ETag           azcore.ETag `json:"_etag,omitempty"`
+}
+
+type counterDocument struct {
+	ID        string      `json:"id"`
+	Partition string      `json:"partition"`
+	Value     int64       `json:"value"`
+	ETag      azcore.ETag `json:"_etag,omitempty"`
+}
+
+// NewCosmosDBOptions creates a new options object for the Cosmos DB backend provider.
+func NewCosmosDBOptions(connectionString string) *CosmosDBOptions {
+	// Default values are provided for required options
+	return &CosmosDBOptions{
+		ConnectionString:         connectionString,
+		DatabaseName:             "durabletask",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+	}
+}
+
+// NewCosmosDBBackend creates a new Azure Cosmos DB-based Backend object.
+//
+// The database of the task hub has two containers. The instances container is partitioned by instance ID, and
+// contains the metadata, history, and pending events of each instance, so that the state of an instance is updated
+// with transactional batches. The work items container is partitioned by queue, and contains a lease for each
+// instance with pending events, the pending activity tasks, and an index of the instances. Workers lock work items
+// with optimistic concurrency, so that multiple workers can share the same task hub.
+//
+// Workers poll the work items container for new work items, because the change feed isn't available in the version
+// of the Cosmos DB SDK that supports the Go version of this module. Updates of an instance and of the work items
+// container aren't atomic, so an orchestration work item that fails to complete is processed again after its lock
+// expires, and may send its outbound messages more than once.
+func NewCosmosDBBackend(opts *CosmosDBOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewCosmosDBOptions("")
+	}
+
+	return &cosmosDBBackend{
+		workerName: fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:    opts,
+		logger:     logger,
+	}
+}
+
+// CreateTaskHub creates the database and containers of the task hub, if they don't exist
+func (be *cosmosDBBackend) CreateTaskHub(ctx context.Context) error {
+	if be.client == nil {
+		client, err := azcosmos.NewClientFromConnectionString(be.options.ConnectionString, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create the Cosmos DB client: %w", err)
+		}
+		be.client = client
+	}
+
+	if _, err := be.client.CreateDatabase(ctx, azcosmos.DatabaseProperties{ID: be.options.DatabaseName}, nil); err != nil && !isStatus(err, http.StatusConflict) {
+		return fmt.Errorf("failed to create database %s: %w", be.options.DatabaseName, err)
+	}
+	database, err := be.client.NewDatabase(be.options.DatabaseName)
+	if err != nil {
+		return err
+	}
+
+	containers := []azcosmos.ContainerProperties{
+		{ID: "Instances", PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{Paths: []string{"/instanceId"}}},
+		{ID: "WorkItems", PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{Paths: []string{"/partition"}}},
+	}
+	for _, properties := range containers {
+		if _, err := database.CreateContainer(ctx, properties, nil); err != nil && !isStatus(err, http.StatusConflict) {
+			return fmt.Errorf("failed to create container %s: %w", properties.ID, err)
+		}
+	}
+
+	if be.instances, err = database.NewContainer("Instances"); err != nil {
+		return err
+	}
+	if be.workItems, err = database.NewContainer("WorkItems"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteTaskHub deletes the database of the task hub
+func (be *cosmosDBBackend) DeleteTaskHub(ctx context.Context) error {
+	client := be.client
+	if client == nil {
+		var err error
+		if client, err = azcosmos.NewClientFromConnectionString(be.options.ConnectionString, nil); err != nil {
+			return fmt.Errorf("failed to create the Cosmos DB client: %w", err)
+		}
+	}
+	be.client = nil
+	be.instances = nil
+	be.workItems = nil
+
+	database, err := client.NewDatabase(be.options.DatabaseName)
+	if err != nil {
+		return err
+	}
+	if _, err := database.Delete(ctx, nil); err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return backend.ErrTaskHubNotFound
+		}
+		return fmt.Errorf("failed to delete database %s: %w", be.options.DatabaseName, err)
+	}
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *cosmosDBBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	if e.GetExecutionStarted() == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+	return be.createInstance(ctx, e)
+}
+
+// createInstance creates an orchestration instance and adds its ExecutionStarted event.
+func (be *cosmosDBBackend) createInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	startEvent := e.GetExecutionStarted()
+	id := startEvent.OrchestrationInstance.InstanceId
+
+	// TODO: Support for re-using orchestration instance IDs
+	instance := &instanceDocument{
+		ID:              instanceType,
+		InstanceID:      id,
+		Type:            instanceType,
+		Name:            startEvent.Name,
+		Version:         startEvent.Version.GetValue(),
+		ExecutionID:     startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		RuntimeStatus:   "PENDING",
+		CreatedTime:     e.Timestamp.AsTime(),
+		LastUpdatedTime: time.Now().UTC(),
+		Input:           startEvent.Input.GetValue(),
+		Tags:            helpers.GetTags(startEvent),
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		instance.ParentInstanceID = parent.GetOrchestrationInstance().InstanceId
+	}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime int64
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime().UnixMilli()
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	event, err := newEventDocument(id, e, seq, visibleTime)
+	if err != nil {
+		return err
+	}
+
+	// The instance and its first event are created atomically
+	batch := be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(id))
+	if err := createItem(&batch, instance); err != nil {
+		return err
+	}
+	if err := createItem(&batch, event); err != nil {
+		return err
+	}
+	if err := be.executeBatch(ctx, batch); isStatus(err, http.StatusConflict) {
+		return backend.ErrDuplicateEvent
+	} else if err != nil {
+		return fmt.Errorf("failed to create the orchestration instance: %w", err)
+	}
+
+	if err := be.updateIndex(ctx, instance); err != nil {
+		return err
+	}
+	return be.signalWorkItem(ctx, id, visibleTime)
+}
+
+// addEvent adds an event to the queue of an orchestration instance, and makes the instance's work item visible.
+func (be *cosmosDBBackend) addEvent(ctx context.Context, id string, e *backend.HistoryEvent) error {
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	event, err := newEventDocument(id, e, seq, 0)
+	if err != nil {
+		return err
+	}
+	if err := be.createDocument(ctx, be.instances, id, event); err != nil {
+		return fmt.Errorf("failed to insert into the events: %w", err)
+	}
+	return be.signalWorkItem(ctx, id, 0)
+}
+
+// signalWorkItem makes the orchestration work item of an instance visible at the specified time, unless it's
+// already visible earlier. The work item is created if it doesn't exist.
+func (be *cosmosDBBackend) signalWorkItem(ctx context.Context, id string, visibleTime int64) error {
+	for {
+		lease, err := be.readLease(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if lease == nil {
+			err = be.createDocument(ctx, be.workItems, orchestrationPartition, &leaseDocument{
+				ID:          id,
+				Partition:   orchestrationPartition,
+				VisibleTime: visibleTime,
+			})
+		} else if lease.VisibleTime > visibleTime {
+			// Resetting the visible time of a locked work item tells its owner that new events arrived
+			lease.VisibleTime = visibleTime
+			err = be.replaceDocument(ctx, be.workItems, orchestrationPartition, id, lease, lease.ETag)
+		}
+		if isStatus(err, http.StatusConflict) || isStatus(err, http.StatusPreconditionFailed) {
+			// The work item was updated concurrently
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to update the orchestration work-item: %w", err)
+		}
+		return nil
+	}
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *cosmosDBBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	return be.addEvent(ctx, string(iid), e)
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+//
+// The runtime status is checked before the event is added, so an event can be added to an instance whose status
+// changes in between, like in the other backends when an event is raised right before an instance completes.
+func (be *cosmosDBBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	instance, _, err := be.readInstance(ctx, string(iid))
+	if err != nil {
+		return err
+	} else if instance == nil {
+		return api.ErrInstanceNotFound
+	}
+
+	matches := false
+	for _, status := range statuses {
+		if helpers.ToRuntimeStatusString(status) == instance.RuntimeStatus {
+			matches = true
+			break
+		}
+	}
+	if !matches {
+		return api.ErrPreconditionFailed
+	}
+	return be.addEvent(ctx, string(iid), e)
+}
+
+// IngestOperations implements backend.BackendWithIngest
+//
+// Each operation is applied separately.
+func (be *cosmosDBBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *cosmosDBBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	// A work item can be locked if it's visible and not locked, or if its lock expired
+	var leases []*leaseDocument
+	err := be.query(
+		ctx,
+		be.workItems,
+		orchestrationPartition,
+		"SELECT * FROM c WHERE (c.visibleTime <= @now AND NOT IS_DEFINED(c.lockedBy)) OR (IS_DEFINED(c.lockExpiration) AND c.lockExpiration < @now)",
+		[]azcosmos.QueryParameter{{Name: "@now", Value: now.UnixMilli()}},
+		maxWorkItemCandidates,
+		func(item []byte) error {
+			lease := new(leaseDocument)
+			leases = append(leases, lease)
+			return json.Unmarshal(item, lease)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+	}
+
+	for _, lease := range leases {
+		lease.LockedBy = be.workerName
+		lease.LockExpiration = now.Add(be.options.OrchestrationLockTimeout).UnixMilli()
+		lease.VisibleTime = lockedVisibleTime
+		err := be.replaceDocument(ctx, be.workItems, orchestrationPartition, lease.ID, lease, lease.ETag)
+		if isStatus(err, http.StatusPreconditionFailed) || isStatus(err, http.StatusNotFound) {
+			// Another worker locked the work item first
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to lock the orchestration work-item: %w", err)
+		}
+
+		wi, err := be.readOrchestrationWorkItem(ctx, lease.ID, now)
+		if err == errNotAvailable {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return wi, nil
+	}
+
+	// No new events to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// readOrchestrationWorkItem reads the visible events of a locked instance. If the instance doesn't exist or has no
+// visible events, the lock is released and errNotAvailable is returned.
+func (be *cosmosDBBackend) readOrchestrationWorkItem(ctx context.Context, id string, now time.Time) (*backend.OrchestrationWorkItem, error) {
+	instance, _, err := be.readInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	events, err := be.queryEvents(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if instance == nil {
+		// Events that are sent to an instance before it's created are processed once it's created
+		return nil, be.releaseWorkItem(ctx, id, nil, errNotAvailable)
+	}
+
+	visible := make([]*eventDocument, 0, len(events))
+	for _, e := range events {
+		if e.VisibleTime <= now.UnixMilli() {
+			visible = append(visible, e)
+		}
+	}
+
+	// Instances that haven't started yet and still have invisible events are waiting for their scheduled start
+	// time, so events raised to them in the meantime must wait as well.
+	if len(visible) == 0 || (instance.HistoryLength == 0 && len(visible) < len(events)) {
+		return nil, be.releaseWorkItem(ctx, id, nextVisibleTime(events, instance.HistoryLength), errNotAvailable)
+	}
+
+	// TODO: Get all the unprocessed events associated with the locked instance
+	if len(visible) > 1000 {
+		visible = visible[:1000]
+	}
+
+	batches := make([]azcosmos.TransactionalBatch, 0, 1)
+	maxDequeueCount := int32(0)
+	newEvents := make([]*protos.HistoryEvent, 0, len(visible))
+	for i, e := range visible {
+		if i%maxBatchOperations == 0 {
+			batches = append(batches, be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(id)))
+		}
+		ops := azcosmos.PatchOperations{}
+		ops.AppendSet("/lockedBy", be.workerName)
+		ops.AppendIncrement("/dequeueCount", 1)
+		batches[len(batches)-1].PatchItem(e.ID, ops, nil)
+
+		if e.DequeueCount+1 > maxDequeueCount {
+			maxDequeueCount = e.DequeueCount + 1
+		}
+
+		event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+		if err != nil {
+			return nil, err
+		}
+		newEvents = append(newEvents, event)
+	}
+	for _, batch := range batches {
+		if err := be.executeBatch(ctx, batch); err != nil {
+			return nil, fmt.Errorf("failed to lock the orchestration work-item events: %w", err)
+		}
+	}
+
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: api.InstanceID(id),
+		NewEvents:  newEvents,
+		LockedBy:   be.workerName,
+		RetryCount: maxDequeueCount - 1,
+
+		NextSequenceNumber: instance.HistoryLength,
+	}
+	return wi, nil
+}
+
+// releaseWorkItem unlocks the orchestration work item of an instance, and makes it visible at the specified time,
+// or deletes it if visibleTime is nil. If events were added to the instance while it was locked, the work item stays
+// visible from the time at which they were added. It returns result if the lock was released.
+func (be *cosmosDBBackend) releaseWorkItem(ctx context.Context, id string, visibleTime *int64, result error) error {
+	for {
+		lease, err := be.readLease(ctx, id)
+		if err != nil {
+			return err
+		} else if lease == nil || lease.LockedBy != be.workerName {
+			return backend.ErrWorkItemLockLost
+		}
+
+		if lease.VisibleTime == lockedVisibleTime && visibleTime == nil {
+			_, err = be.workItems.DeleteItem(ctx, azcosmos.NewPartitionKeyString(orchestrationPartition), id, &azcosmos.ItemOptions{IfMatchEtag: &lease.ETag})
+		} else {
+			if visibleTime != nil && *visibleTime < lease.VisibleTime {
+				lease.VisibleTime = *visibleTime
+			}
+			lease.LockedBy = ""
+			lease.LockExpiration = 0
+			err = be.replaceDocument(ctx, be.workItems, orchestrationPartition, id, lease, lease.ETag)
+		}
+		if isStatus(err, http.StatusPreconditionFailed) {
+			// Events were added concurrently
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to release the orchestration work-item: %w", err)
+		}
+		return result
+	}
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *cosmosDBBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	for {
+		lease, err := be.readLease(ctx, string(wi.InstanceID))
+		if err != nil {
+			return err
+		} else if lease == nil || lease.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		lease.LockExpiration = time.Now().UTC().Add(be.options.OrchestrationLockTimeout).UnixMilli()
+		err = be.replaceDocument(ctx, be.workItems, orchestrationPartition, lease.ID, lease, lease.ETag)
+		if isStatus(err, http.StatusPreconditionFailed) {
+			// Events were added concurrently
+			continue
+		} else if isStatus(err, http.StatusNotFound) {
+			return backend.ErrWorkItemLockLost
+		} else if err != nil {
+			return fmt.Errorf("failed to renew the lock on the orchestration work-item: %w", err)
+		}
+		return nil
+	}
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *cosmosDBBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	existingEvents, err := be.queryHistory(ctx, string(wi.InstanceID), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *cosmosDBBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, _, err := be.readInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+	return instance.metadata()
+}
+
+func (instance *instanceDocument) metadata() (*api.OrchestrationMetadata, error) {
+	var failureDetails *protos.TaskFailureDetails
+	if len(instance.FailureDetails) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(instance.FailureDetails, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(instance.InstanceID),
+		instance.Name,
+		helpers.FromRuntimeStatusString(instance.RuntimeStatus),
+		instance.CreatedTime,
+		instance.LastUpdatedTime,
+		instance.Input,
+		instance.Output,
+		instance.CustomStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = instance.GenerationCount
+	metadata.Tags = instance.Tags
+	return metadata, nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *cosmosDBBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	now := time.Now().UTC()
+
+	if lease, err := be.readLease(ctx, id); err != nil {
+		return err
+	} else if lease == nil || lease.LockedBy != wi.LockedBy {
+		return backend.ErrWorkItemLockLost
+	}
+
+	instance, etag, err := be.readInstance(ctx, id)
+	if err != nil {
+		return err
+	} else if instance == nil {
+		return api.ErrInstanceNotFound
+	}
+	events, err := be.queryEvents(ctx, id)
+	if err != nil {
+		return err
+	}
+	lockedEvents := make([]*eventDocument, 0, len(events))
+	remainingEvents := make([]*eventDocument, 0, len(events))
+	for _, e := range events {
+		if e.LockedBy == wi.LockedBy {
+			lockedEvents = append(lockedEvents, e)
+		} else {
+			remainingEvents = append(remainingEvents, e)
+		}
+	}
+	if len(lockedEvents) == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	// Update the instance
+	isCreated := false
+	isCompleted := false
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if isCreated {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			isCreated = true
+			instance.CreatedTime = e.Timestamp.AsTime()
+			instance.Input = es.Input.GetValue()
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			instance.CompletedTime = &now
+			instance.Output = ec.Result.GetValue()
+			instance.FailureDetails = nil
+			if ec.FailureDetails != nil {
+				if instance.FailureDetails, err = proto.Marshal(ec.FailureDetails); err != nil {
+					return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+				}
+			}
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		instance.CustomStatus = wi.State.CustomStatus.Value
+	}
+	instance.GenerationCount += wi.State.ContinuedAsNewCount()
+
+	// Save the actions from the most recent execution, if requested
+	if wi.State.LastActions != nil {
+		instance.LastActions, err = proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: id,
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+	}
+
+	// TODO: Support for stickiness, which would extend the LockExpiration
+	previousHistoryLength := instance.HistoryLength
+	firstSequenceNumber := len(wi.State.OldEvents())
+	instance.HistoryLength = firstSequenceNumber + len(wi.State.NewEvents())
+	instance.RuntimeStatus = helpers.ToRuntimeStatusString(wi.State.RuntimeStatus())
+	instance.LastUpdatedTime = now
+
+	// Sub-orchestrations with IDs that already exist aren't created
+	messages := make([]backend.OrchestratorMessage, 0, len(wi.State.PendingMessages()))
+	created := make(map[string]bool)
+	for _, msg := range wi.State.PendingMessages() {
+		if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+			subID := es.OrchestrationInstance.InstanceId
+			exists := created[subID]
+			if !exists {
+				existing, _, err := be.readInstance(ctx, subID)
+				if err != nil {
+					return err
+				}
+				exists = existing != nil
+			}
+			if exists {
+				be.logger.Warnf(
+					"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+					wi.InstanceID,
+					subID)
+				continue
+			}
+			created[subID] = true
+		}
+		messages = append(messages, msg)
+	}
+
+	// Save outbound activity tasks and messages to other instances first, so that they aren't lost if the
+	// completion fails after the instance is updated
+	for _, e := range wi.State.PendingTasks() {
+		seq, err := be.nextSequenceNumbers(ctx, 1)
+		if err != nil {
+			return err
+		}
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if err := be.createDocument(ctx, be.workItems, activityPartition, &taskDocument{
+			ID:             sequenceID("task", seq),
+			Partition:      activityPartition,
+			SequenceNumber: seq,
+			InstanceID:     id,
+			EventPayload:   eventPayload,
+		}); err != nil {
+			return fmt.Errorf("failed to insert into the activity tasks: %w", err)
+		}
+	}
+
+	selfEvents := make([]*eventDocument, 0, len(wi.State.PendingTimers()))
+	for _, e := range wi.State.PendingTimers() {
+		seq, err := be.nextSequenceNumbers(ctx, 1)
+		if err != nil {
+			return err
+		}
+		event, err := newEventDocument(id, e, seq, e.GetTimerFired().GetFireAt().AsTime().UnixMilli())
+		if err != nil {
+			return err
+		}
+		selfEvents = append(selfEvents, event)
+	}
+
+	for _, msg := range messages {
+		if msg.TargetInstanceID == id {
+			seq, err := be.nextSequenceNumbers(ctx, 1)
+			if err != nil {
+				return err
+			}
+			event, err := newEventDocument(id, msg.HistoryEvent, seq, 0)
+			if err != nil {
+				return err
+			}
+			selfEvents = append(selfEvents, event)
+		} else if msg.HistoryEvent.GetExecutionStarted() != nil {
+			if err := be.createInstance(ctx, msg.HistoryEvent); err != nil && err != backend.ErrDuplicateEvent {
+				return err
+			}
+		} else if err := be.addEvent(ctx, msg.TargetInstanceID, msg.HistoryEvent); err != nil {
+			return err
+		}
+	}
+
+	// The state of the instance is updated with transactional batches. The instance document is updated in the last
+	// batch, so that it isn't updated unless everything else was saved.
+	operations := make([]func(batch *azcosmos.TransactionalBatch) error, 0)
+
+	// If continue-as-new, delete the existing history that isn't overwritten by the new history
+	if wi.State.ContinuedAsNew() {
+		for seq := instance.HistoryLength; seq < previousHistoryLength; seq++ {
+			docID := sequenceID(historyType, int64(seq))
+			operations = append(operations, func(batch *azcosmos.TransactionalBatch) error {
+				batch.DeleteItem(docID, nil)
+				return nil
+			})
+		}
+	}
+
+	// Save new history events
+	for i, e := range wi.State.NewEvents() {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		seq := int64(firstSequenceNumber + i)
+		doc := &historyDocument{
+			ID:             sequenceID(historyType, seq),
+			InstanceID:     id,
+			Type:           historyType,
+			SequenceNumber: seq,
+			EventPayload:   eventPayload,
+		}
+		operations = append(operations, func(batch *azcosmos.TransactionalBatch) error {
+			return upsertItem(batch, doc)
+		})
+	}
+
+	// Save timers and messages to this instance
+	for _, e := range selfEvents {
+		doc := e
+		operations = append(operations, func(batch *azcosmos.TransactionalBatch) error {
+			return createItem(batch, doc)
+		})
+	}
+
+	// Delete inbound events
+	for _, e := range lockedEvents {
+		docID := e.ID
+		operations = append(operations, func(batch *azcosmos.TransactionalBatch) error {
+			batch.DeleteItem(docID, nil)
+			return nil
+		})
+	}
+
+	operations = append(operations, func(batch *azcosmos.TransactionalBatch) error {
+		item, err := json.Marshal(instance)
+		if err != nil {
+			return err
+		}
+		batch.ReplaceItem(instance.ID, item, &azcosmos.TransactionalBatchItemOptions{IfMatchETag: &etag})
+		return nil
+	})
+
+	for len(operations) > 0 {
+		n := len(operations)
+		if n > maxBatchOperations {
+			n = maxBatchOperations
+		}
+
+		batch := be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(id))
+		for _, op := range operations[:n] {
+			if err := op(&batch); err != nil {
+				return err
+			}
+		}
+		if err := be.executeBatch(ctx, batch); isStatus(err, http.StatusPreconditionFailed) || isStatus(err, http.StatusNotFound) {
+			return backend.ErrWorkItemLockLost
+		} else if err != nil {
+			return fmt.Errorf("failed to update the orchestration instance: %w", err)
+		}
+		operations = operations[n:]
+	}
+
+	if err := be.updateIndex(ctx, instance); err != nil {
+		return err
+	}
+
+	// The instance has started, so its work item becomes visible with its first event
+	var visibleTime *int64
+	for _, e := range append(remainingEvents, selfEvents...) {
+		if visibleTime == nil || e.VisibleTime < *visibleTime {
+			t := e.VisibleTime
+			visibleTime = &t
+		}
+	}
+	return be.releaseWorkItem(ctx, id, visibleTime, nil)
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *cosmosDBBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	events, err := be.queryEvents(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var visibleTime int64
+	if delay := wi.GetAbandonDelay(); delay > 0 {
+		visibleTime = time.Now().UTC().Add(delay).UnixMilli()
+	}
+
+	batches := make([]azcosmos.TransactionalBatch, 0, 1)
+	abandoned := 0
+	for _, e := range events {
+		if e.LockedBy != wi.LockedBy {
+			continue
+		}
+
+		if abandoned%maxBatchOperations == 0 {
+			batches = append(batches, be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(id)))
+		}
+		ops := azcosmos.PatchOperations{}
+		ops.AppendSet("/visibleTime", visibleTime)
+		ops.AppendRemove("/lockedBy")
+		batches[len(batches)-1].PatchItem(e.ID, ops, nil)
+		e.VisibleTime = visibleTime
+		abandoned++
+	}
+	if abandoned == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+	for _, batch := range batches {
+		if err := be.executeBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to unlock the orchestration work-item events: %w", err)
+		}
+	}
+
+	return be.releaseWorkItem(ctx, id, nextVisibleTime(events, 1), nil)
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *cosmosDBBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	var tasks []*taskDocument
+	err := be.query(
+		ctx,
+		be.workItems,
+		activityPartition,
+		"SELECT * FROM c WHERE NOT IS_DEFINED(c.lockedBy) OR c.lockExpiration < @now",
+		[]azcosmos.QueryParameter{{Name: "@now", Value: now.UnixMilli()}},
+		maxWorkItemCandidates,
+		func(item []byte) error {
+			task := new(taskDocument)
+			tasks = append(tasks, task)
+			return json.Unmarshal(item, task)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].SequenceNumber < tasks[j].SequenceNumber })
+
+	for _, task := range tasks {
+		task.LockedBy = be.workerName
+		task.LockExpiration = now.Add(be.options.ActivityLockTimeout).UnixMilli()
+		task.DequeueCount++
+		err := be.replaceDocument(ctx, be.workItems, activityPartition, task.ID, task, task.ETag)
+		if isStatus(err, http.StatusPreconditionFailed) || isStatus(err, http.StatusNotFound) {
+			// Another worker locked the task first
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to lock the activity work-item: %w", err)
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(task.EventPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		wi := &backend.ActivityWorkItem{
+			SequenceNumber: task.SequenceNumber,
+			InstanceID:     api.InstanceID(task.InstanceID),
+			NewEvent:       e,
+			LockedBy:       be.workerName,
+		}
+		return wi, nil
+	}
+
+	// No new activity tasks to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *cosmosDBBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	task, err := be.readTask(ctx, wi)
+	if err != nil {
+		return err
+	}
+
+	if err := be.addEvent(ctx, string(wi.InstanceID), wi.Result); err != nil {
+		return err
+	}
+
+	_, err = be.workItems.DeleteItem(ctx, azcosmos.NewPartitionKeyString(activityPartition), task.ID, &azcosmos.ItemOptions{IfMatchEtag: &task.ETag})
+	if isStatus(err, http.StatusPreconditionFailed) || isStatus(err, http.StatusNotFound) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to delete from the activity tasks: %w", err)
+	}
+	return nil
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *cosmosDBBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	task, err := be.readTask(ctx, wi)
+	if err != nil {
+		return err
+	}
+
+	task.LockedBy = ""
+	task.LockExpiration = 0
+	err = be.replaceDocument(ctx, be.workItems, activityPartition, task.ID, task, task.ETag)
+	if isStatus(err, http.StatusPreconditionFailed) || isStatus(err, http.StatusNotFound) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to update the activity tasks for abandon: %w", err)
+	}
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *cosmosDBBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	task, err := be.readTask(ctx, wi)
+	if err != nil {
+		return err
+	}
+
+	task.LockExpiration = time.Now().UTC().Add(be.options.ActivityLockTimeout).UnixMilli()
+	err = be.replaceDocument(ctx, be.workItems, activityPartition, task.ID, task, task.ETag)
+	if isStatus(err, http.StatusPreconditionFailed) || isStatus(err, http.StatusNotFound) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to update the activity tasks for lock renewal: %w", err)
+	}
+	return nil
+}
+
+// readTask reads the task of an activity work item, and checks that it's still locked by the work item's owner.
+func (be *cosmosDBBackend) readTask(ctx context.Context, wi *backend.ActivityWorkItem) (*taskDocument, error) {
+	task := new(taskDocument)
+	res, err := be.workItems.ReadItem(ctx, azcosmos.NewPartitionKeyString(activityPartition), sequenceID("task", wi.SequenceNumber), nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the activity tasks: %w", err)
+	} else if err := json.Unmarshal(res.Value, task); err != nil {
+		return nil, err
+	} else if task.LockedBy != wi.LockedBy {
+		return nil, backend.ErrWorkItemLockLost
+	}
+	task.ETag = res.ETag
+	return task, nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *cosmosDBBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, _, err := be.readInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(instance.LastActions, res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *cosmosDBBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	instance, etag, err := be.readInstance(ctx, string(id))
+	if err != nil {
+		return err
+	} else if instance == nil {
+		return api.ErrInstanceNotFound
+	} else if !isCompletedStatus(instance.RuntimeStatus) {
+		return api.ErrNotCompleted
+	}
+
+	// The instance document is deleted in the last batch, so that a failed purge can be retried
+	batch := be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(string(id)))
+	count := 0
+	for seq := 0; seq < instance.HistoryLength; seq++ {
+		if count == maxBatchOperations {
+			if err := be.executeBatch(ctx, batch); err != nil {
+				return fmt.Errorf("failed to delete the history: %w", err)
+			}
+			batch = be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(string(id)))
+			count = 0
+		}
+		batch.DeleteItem(sequenceID(historyType, int64(seq)), nil)
+		count++
+	}
+	if count == maxBatchOperations {
+		if err := be.executeBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to delete the history: %w", err)
+		}
+		batch = be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(string(id)))
+	}
+	batch.DeleteItem(instanceType, &azcosmos.TransactionalBatchItemOptions{IfMatchETag: &etag})
+	if err := be.executeBatch(ctx, batch); isStatus(err, http.StatusPreconditionFailed) {
+		return api.ErrNotCompleted
+	} else if err != nil && !isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete the orchestration instance: %w", err)
+	}
+
+	_, err = be.workItems.DeleteItem(ctx, azcosmos.NewPartitionKeyString(indexPartition), string(id), nil)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete from the instance index: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *cosmosDBBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	errs := make(map[api.InstanceID]error)
+	for iid, from := range fromSequenceNumbers {
+		instance, _, err := be.readInstance(ctx, string(iid))
+		if err != nil {
+			return nil, err
+		} else if instance == nil {
+			errs[iid] = api.ErrInstanceNotFound
+			continue
+		}
+
+		events, err := be.queryHistory(ctx, string(iid), int64(from))
+		if err != nil {
+			errs[iid] = err
+			continue
+		}
+		histories[iid] = events
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *cosmosDBBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.queryIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string, len(instances))
+	for _, instance := range instances {
+		statuses[instance.InstanceID] = instance.RuntimeStatus
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for _, instance := range instances {
+		if instance.ParentInstanceID == "" {
+			continue
+		}
+		switch instance.RuntimeStatus {
+		case "PENDING", "RUNNING", "SUSPENDED":
+		default:
+			continue
+		}
+		if parentStatus, ok := statuses[instance.ParentInstanceID]; ok && !isCompletedStatus(parentStatus) {
+			continue
+		}
+
+		metadata, err := instance.metadata()
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *cosmosDBBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	instances, err := be.queryIndex(ctx)
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].InstanceID < instances[j].InstanceID
+	})
+
+	pageSize := query.PageSizeOrDefault()
+	page := make([]*api.OrchestrationMetadata, 0)
+	for _, instance := range instances {
+		if instance.InstanceID <= query.ContinuationToken || !strings.HasPrefix(instance.InstanceID, query.InstanceIDPrefix) {
+			continue
+		}
+		if query.Name != "" && instance.Name != query.Name {
+			continue
+		}
+		if len(query.RuntimeStatuses) > 0 {
+			matches := false
+			for _, status := range query.RuntimeStatuses {
+				if helpers.ToRuntimeStatusString(status) == instance.RuntimeStatus {
+					matches = true
+					break
+				}
+			}
+			if !matches {
+				continue
+			}
+		}
+		if !query.CreatedFrom.IsZero() && instance.CreatedTime.Before(query.CreatedFrom) {
+			continue
+		}
+		if !query.CreatedTo.IsZero() && !instance.CreatedTime.Before(query.CreatedTo) {
+			continue
+		}
+
+		metadata, err := instance.metadata()
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		page = append(page, metadata)
+		if len(page) > pageSize {
+			break
+		}
+	}
+	return backend.NewInstanceQueryResult(page, pageSize), nil
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *cosmosDBBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, _, err := be.readInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+	metadata, err := instance.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{Metadata: metadata}
+	if state.History, err = be.queryHistory(ctx, string(iid), 0); err != nil {
+		return nil, err
+	}
+
+	events, err := be.queryEvents(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pending events: %w", err)
+		}
+		state.PendingEvents = append(state.PendingEvents, event)
+	}
+
+	var tasks []*taskDocument
+	err = be.query(
+		ctx,
+		be.workItems,
+		activityPartition,
+		"SELECT * FROM c WHERE c.instanceId = @id",
+		[]azcosmos.QueryParameter{{Name: "@id", Value: string(iid)}},
+		0,
+		func(item []byte) error {
+			task := new(taskDocument)
+			tasks = append(tasks, task)
+			return json.Unmarshal(item, task)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the activity tasks: %w", err)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].SequenceNumber < tasks[j].SequenceNumber })
+	for _, task := range tasks {
+		event, err := backend.UnmarshalHistoryEvent(task.EventPayload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pending tasks: %w", err)
+		}
+		state.PendingTasks = append(state.PendingTasks, event)
+	}
+	return state, nil
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *cosmosDBBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	instance := &instanceDocument{
+		ID:              instanceType,
+		InstanceID:      id,
+		Type:            instanceType,
+		Name:            metadata.Name,
+		Version:         startEvent.GetVersion().GetValue(),
+		ExecutionID:     startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		RuntimeStatus:   helpers.ToRuntimeStatusString(metadata.RuntimeStatus),
+		CreatedTime:     metadata.CreatedAt,
+		LastUpdatedTime: metadata.LastUpdatedAt,
+		Input:           metadata.SerializedInput,
+		Output:          metadata.SerializedOutput,
+		CustomStatus:    metadata.SerializedCustomStatus,
+		GenerationCount: metadata.GenerationCount,
+		HistoryLength:   len(state.History),
+		Tags:            metadata.Tags,
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		instance.ParentInstanceID = parent.GetOrchestrationInstance().GetInstanceId()
+	}
+	if metadata.IsComplete() {
+		completedTime := metadata.LastUpdatedAt
+		instance.CompletedTime = &completedTime
+	}
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		instance.FailureDetails = bytes
+	}
+
+	// Timers and scheduled starts must stay invisible to workers until they're due
+	events := make([]*eventDocument, 0, len(state.PendingEvents))
+	for _, e := range state.PendingEvents {
+		var visibleTime int64
+		if tf := e.GetTimerFired(); tf != nil {
+			visibleTime = tf.GetFireAt().AsTime().UnixMilli()
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			visibleTime = ts.AsTime().UnixMilli()
+		}
+
+		seq, err := be.nextSequenceNumbers(ctx, 1)
+		if err != nil {
+			return err
+		}
+		event, err := newEventDocument(id, e, seq, visibleTime)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+	}
+
+	// The instance document is created in the first batch, so that the import fails if the instance exists
+	docs := []interface{}{instance}
+	for i, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, &historyDocument{
+			ID:             sequenceID(historyType, int64(i)),
+			InstanceID:     id,
+			Type:           historyType,
+			SequenceNumber: int64(i),
+			EventPayload:   eventPayload,
+		})
+	}
+	for _, e := range events {
+		docs = append(docs, e)
+	}
+	for i := 0; i < len(docs); i += maxBatchOperations {
+		batch := be.instances.NewTransactionalBatch(azcosmos.NewPartitionKeyString(id))
+		for j := i; j < len(docs) && j < i+maxBatchOperations; j++ {
+			if err := createItem(&batch, docs[j]); err != nil {
+				return err
+			}
+		}
+		if err := be.executeBatch(ctx, batch); isStatus(err, http.StatusConflict) && i == 0 {
+			return backend.ErrDuplicateEvent
+		} else if err != nil {
+			return fmt.Errorf("failed to import the orchestration instance: %w", err)
+		}
+	}
+
+	if err := be.updateIndex(ctx, instance); err != nil {
+		return err
+	}
+
+	for _, e := range state.PendingTasks {
+		seq, err := be.nextSequenceNumbers(ctx, 1)
+		if err != nil {
+			return err
+		}
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if err := be.createDocument(ctx, be.workItems, activityPartition, &taskDocument{
+			ID:             sequenceID("task", seq),
+			Partition:      activityPartition,
+			SequenceNumber: seq,
+			InstanceID:     id,
+			EventPayload:   eventPayload,
+		}); err != nil {
+			return fmt.Errorf("failed to insert into the activity tasks: %w", err)
+		}
+	}
+
+	if visibleTime := nextVisibleTime(events, len(state.History)); visibleTime != nil {
+		return be.signalWorkItem(ctx, id, *visibleTime)
+	}
+	return nil
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *cosmosDBBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.queryIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, instance := range instances {
+		if instance.Name != name {
+			continue
+		}
+		if !instance.CreatedTime.Before(since) {
+			stats.Started++
+		}
+
+		if instance.CompletedTime == nil || instance.CompletedTime.Before(since) {
+			continue
+		}
+		switch instance.RuntimeStatus {
+		case "COMPLETED":
+			stats.Completed++
+		case "FAILED":
+			stats.Failed++
+		default:
+			continue
+		}
+		d := instance.CompletedTime.Sub(instance.CreatedTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*cosmosDBBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*cosmosDBBackend) Stop(context.Context) error {
+	return nil
+}
+
+func (be *cosmosDBBackend) ensureDB() error {
+	if be.client == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *cosmosDBBackend) String() string {
+	return fmt.Sprintf("cosmosdb::%s", be.options.DatabaseName)
+}
+
+// nextSequenceNumbers reserves count consecutive sequence numbers for events and tasks, and returns the first one.
+func (be *cosmosDBBackend) nextSequenceNumbers(ctx context.Context, count int) (int64, error) {
+	pk := azcosmos.NewPartitionKeyString(counterPartition)
+	for {
+		counter := &counterDocument{ID: "sequence", Partition: counterPartition}
+		res, err := be.workItems.ReadItem(ctx, pk, counter.ID, nil)
+		if isStatus(err, http.StatusNotFound) {
+			counter.Value = int64(count)
+			err = be.createDocument(ctx, be.workItems, counterPartition, counter)
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to generate a sequence number: %w", err)
+		} else if err = json.Unmarshal(res.Value, counter); err != nil {
+			return 0, err
+		} else {
+			counter.Value += int64(count)
+			err = be.replaceDocument(ctx, be.workItems, counterPartition, counter.ID, counter, res.ETag)
+		}
+
+		if isStatus(err, http.StatusConflict) || isStatus(err, http.StatusPreconditionFailed) {
+			// The counter was updated concurrently
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to generate a sequence number: %w", err)
+		}
+		return counter.Value - int64(count) + 1, nil
+	}
+}
+
+// updateIndex copies the metadata of an instance to the index, unless the index already contains a newer copy.
+func (be *cosmosDBBackend) updateIndex(ctx context.Context, instance *instanceDocument) error {
+	entry := *instance
+	entry.ID = instance.InstanceID
+	entry.Partition = indexPartition
+	entry.LastActions = nil
+
+	pk := azcosmos.NewPartitionKeyString(indexPartition)
+	for {
+		var err error
+		res, err := be.workItems.ReadItem(ctx, pk, entry.ID, nil)
+		if isStatus(err, http.StatusNotFound) {
+			err = be.createDocument(ctx, be.workItems, indexPartition, &entry)
+		} else if err != nil {
+			return fmt.Errorf("failed to read the instance index: %w", err)
+		} else {
+			existing := new(instanceDocument)
+			if err := json.Unmarshal(res.Value, existing); err != nil {
+				return err
+			} else if existing.LastUpdatedTime.After(entry.LastUpdatedTime) {
+				return nil
+			}
+			err = be.replaceDocument(ctx, be.workItems, indexPartition, entry.ID, &entry, res.ETag)
+		}
+
+		if isStatus(err, http.StatusConflict) || isStatus(err, http.StatusPreconditionFailed) {
+			// The index was updated concurrently
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to update the instance index: %w", err)
+		}
+		return nil
+	}
+}
+
+// queryIndex reads the metadata of all the instances from the index, ordered by creation time and instance ID.
+func (be *cosmosDBBackend) queryIndex(ctx context.Context) ([]*instanceDocument, error) {
+	instances := make([]*instanceDocument, 0)
+	err := be.query(ctx, be.workItems, indexPartition, "SELECT * FROM c", nil, 0, func(item []byte) error {
+		instance := new(instanceDocument)
+		instances = append(instances, instance)
+		return json.Unmarshal(item, instance)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the instance index: %w", err)
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		if !instances[i].CreatedTime.Equal(instances[j].CreatedTime) {
+			return instances[i].CreatedTime.Before(instances[j].CreatedTime)
+		}
+		return instances[i].InstanceID < instances[j].InstanceID
+	})
+	return instances, nil
+}
+
+// readInstance reads the instance document of an instance, or returns nil if the instance doesn't exist.
+func (be *cosmosDBBackend) readInstance(ctx context.Context, id string) (*instanceDocument, azcore.ETag, error) {
+	res, err := be.instances.ReadItem(ctx, azcosmos.NewPartitionKeyString(id), instanceType, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to read the orchestration instance: %w", err)
+	}
+
+	instance := new(instanceDocument)
+	if err := json.Unmarshal(res.Value, instance); err != nil {
+		return nil, "", err
+	}
+	return instance, res.ETag, nil
+}
+
+// readLease reads the orchestration work item of an instance, or returns nil if it doesn't exist.
+func (be *cosmosDBBackend) readLease(ctx context.Context, id string) (*leaseDocument, error) {
+	res, err := be.workItems.ReadItem(ctx, azcosmos.NewPartitionKeyString(orchestrationPartition), id, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the orchestration work-item: %w", err)
+	}
+
+	lease := new(leaseDocument)
+	if err := json.Unmarshal(res.Value, lease); err != nil {
+		return nil, err
+	}
+	lease.ETag = res.ETag
+	return lease, nil
+}
+
+// queryEvents reads the pending events of an instance, in sequence number order.
+func (be *cosmosDBBackend) queryEvents(ctx context.Context, id string) ([]*eventDocument, error) {
+	events := make([]*eventDocument, 0)
+	err := be.query(
+		ctx,
+		be.instances,
+		id,
+		"SELECT * FROM c WHERE c.type = @type",
+		[]azcosmos.QueryParameter{{Name: "@type", Value: eventType}},
+		0,
+		func(item []byte) error {
+			e := new(eventDocument)
+			events = append(events, e)
+			return json.Unmarshal(item, e)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the pending events: %w", err)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].SequenceNumber < events[j].SequenceNumber })
+	return events, nil
+}
+
+// queryHistory reads the history of an instance, starting at the specified sequence number.
+func (be *cosmosDBBackend) queryHistory(ctx context.Context, id string, from int64) ([]*backend.HistoryEvent, error) {
+	docs := make([]*historyDocument, 0)
+	err := be.query(
+		ctx,
+		be.instances,
+		id,
+		"SELECT * FROM c WHERE c.type = @type AND c.sequenceNumber >= @from",
+		[]azcosmos.QueryParameter{{Name: "@type", Value: historyType}, {Name: "@from", Value: from}},
+		0,
+		func(item []byte) error {
+			doc := new(historyDocument)
+			docs = append(docs, doc)
+			return json.Unmarshal(item, doc)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the history: %w", err)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].SequenceNumber < docs[j].SequenceNumber })
+
+	events := make([]*backend.HistoryEvent, 0, len(docs))
+	for _, doc := range docs {
+		e, err := backend.UnmarshalHistoryEvent(doc.EventPayload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// query runs a query in a partition of a container and calls fn with each result, until limit results are read,
+// or all of them if limit is 0.
+func (be *cosmosDBBackend) query(ctx context.Context, container *azcosmos.ContainerClient, partition string, query string, params []azcosmos.QueryParameter, limit int, fn func(item []byte) error) error {
+	pager := container.NewQueryItemsPager(query, azcosmos.NewPartitionKeyString(partition), &azcosmos.QueryOptions{QueryParameters: params})
+	count := 0
+	for pager.More() && (limit == 0 || count < limit) {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	return nil
+}
+
+func (be *cosmosDBBackend) createDocument(ctx context.Context, container *azcosmos.ContainerClient, partition string, doc interface{}) error {
+	item, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = container.CreateItem(ctx, azcosmos.NewPartitionKeyString(partition), item, nil)
+	return err
+}
+
+func (be *cosmosDBBackend) replaceDocument(ctx context.Context, container *azcosmos.ContainerClient, partition string, id string, doc interface{}, etag azcore.ETag) error {
+	item, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = container.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(partition), id, item, &azcosmos.ItemOptions{IfMatchEtag: &etag})
+	return err
+}
+
+// executeBatch executes a transactional batch, and returns the error of the operation that failed it, if any.
+func (be *cosmosDBBackend) executeBatch(ctx context.Context, batch azcosmos.TransactionalBatch) error {
+	res, err := be.instances.ExecuteTransactionalBatch(ctx, batch, nil)
+	if err != nil {
+		return err
+	} else if res.Success {
+		return nil
+	}
+
+	// The cause of the failure is the first operation that didn't fail because of another one
+	for _, result := range res.OperationResults {
+		if result.StatusCode != http.StatusFailedDependency && result.StatusCode >= 400 {
+			return &azcore.ResponseError{StatusCode: int(result.StatusCode), RawResponse: res.RawResponse}
+		}
+	}
+	return errors.New("the transactional batch failed")
+}
+
+func createItem(batch *azcosmos.TransactionalBatch, doc interface{}) error {
+	item, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	batch.CreateItem(item, nil)
+	return nil
+}
+
+func upsertItem(batch *azcosmos.TransactionalBatch, doc interface{}) error {
+	item, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	batch.UpsertItem(item, nil)
+	return nil
+}
+
+func newEventDocument(id string, e *backend.HistoryEvent, seq int64, visibleTime int64) (*eventDocument, error) {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	return &eventDocument{
+		ID:             sequenceID(eventType, seq),
+		InstanceID:     id,
+		Type:           eventType,
+		SequenceNumber: seq,
+		VisibleTime:    visibleTime,
+		EventPayload:   eventPayload,
+	}, nil
+}
+
+// sequenceID returns the document ID of a sequence number, which is zero-padded so that IDs sort like numbers.
+func sequenceID(prefix string, seq int64) string {
+	return fmt.Sprintf("%s-%020d", prefix, seq)
+}
+
+// nextVisibleTime returns the time at which the orchestration work item of an instance with the specified pending
+// events becomes visible, or nil if there are no events. Instances that haven't started yet wait for all of their
+// events to become visible, so that they start at their scheduled start time.
+func nextVisibleTime(events []*eventDocument, historyLength int) *int64 {
+	var visibleTime *int64
+	for _, e := range events {
+		t := e.VisibleTime
+		if visibleTime == nil || (historyLength > 0 && t < *visibleTime) || (historyLength == 0 && t > *visibleTime) {
+			visibleTime = &t
+		}
+	}
+	return visibleTime
+}
+
+func validateEvent(e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+	return nil
+}
+
+func isCompletedStatus(runtimeStatus string) bool {
+	return runtimeStatus == "COMPLETED" || runtimeStatus == "FAILED" || runtimeStatus == "TERMINATED"
+}
+
+func isStatus(err error, statusCode int) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == statusCode
+}
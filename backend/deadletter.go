@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+)
+
+var (
+	// ErrDeadLetterNotFound is returned when resubmitting or deleting a dead letter that doesn't exist.
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+	// ErrDeadLettersNotSupported is returned by the dead-letter APIs of [TaskHubClient] if the backend doesn't
+	// implement [BackendWithDeadLetters].
+	ErrDeadLettersNotSupported = errors.New("the backend doesn't support dead letters")
+)
+
+// DeadLetterKind is the kind of the work item that was moved to the dead-letter store.
+type DeadLetterKind int
+
+const (
+	// DeadLetterOrchestration is an orchestration work item, whose events are the new events of an orchestration.
+	DeadLetterOrchestration DeadLetterKind = iota
+
+	// DeadLetterActivity is an activity work item, whose single event is the TaskScheduled event of an activity.
+	DeadLetterActivity
+)
+
+func (k DeadLetterKind) String() string {
+	switch k {
+	case DeadLetterOrchestration:
+		return "Orchestration"
+	case DeadLetterActivity:
+		return "Activity"
+	default:
+		return fmt.Sprintf("DeadLetterKind(%d)", int(k))
+	}
+}
+
+// DeadLetter is a poison work item that was moved to the dead-letter store of the backend because it was delivered
+// to workers more times than allowed by [WithMaxDeliveryCount]. Its events stay in the dead-letter store until it's
+// resubmitted or deleted, so the orchestration doesn't make progress in the meantime.
+type DeadLetter struct {
+	// ID identifies the dead letter in the dead-letter store.
+	ID int64
+
+	Kind       DeadLetterKind
+	InstanceID api.InstanceID
+
+	// Events are the events of the work item, which are put back in the queue when the dead letter is resubmitted.
+	Events []*HistoryEvent
+
+	// DeliveryCount is the number of times that the work item was delivered to workers.
+	DeliveryCount int32
+
+	// Reason describes why the work item was moved to the dead-letter store.
+	Reason string
+
+	DeadLetteredAt time.Time
+}
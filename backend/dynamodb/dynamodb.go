@@ -0,0 +1,2055 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// The partitions of the work items table
+const (
+	orchestrationQueue = "orchestrations"
+	activityQueue      = "activities"
+	counterQueue       = "counters"
+)
+
+// lockedVisibleTime is the visible time of the orchestration work item of a locked instance. Adding an event to the
+// instance resets the visible time, so that the worker that holds the lock can tell whether new events arrived
+// while it was processing the work item.
+const lockedVisibleTime = math.MaxInt64
+
+// maxTransactionAttempts is the number of times that an operation is attempted when its transaction conflicts with
+// concurrent transactions.
+const maxTransactionAttempts = 10
+
+// maxTransactionItems is the maximum number of items in a DynamoDB transaction.
+const maxTransactionItems = 100
+
+// maxWorkItemCandidates is the number of work items that a worker attempts to lock before giving up, when other
+// workers lock them first.
+const maxWorkItemCandidates = 10
+
+var (
+	errTransactionConflict = errors.New("the transaction conflicted with a concurrent transaction")
+	errNotAvailable        = errors.New("the work item is no longer available")
+)
+
+type DynamoDBOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// Config is the AWS configuration used to connect to DynamoDB, e.g. as loaded by config.LoadDefaultConfig.
+	Config aws.Config
+
+	// TablePrefix is prepended to the names of the tables of the task hub, so that multiple task hubs can share
+	// an AWS account and region.
+	TablePrefix string
+}
+
+type dynamoDBBackend struct {
+	client     *dynamodb.Client
+	workerName string
+	logger     backend.Logger
+	options    *DynamoDBOptions
+}
+
+// NewDynamoDBOptions creates a new options object for the DynamoDB backend provider.
+func NewDynamoDBOptions(cfg aws.Config) *DynamoDBOptions {
+	// Default values are provided for required options
+	return &DynamoDBOptions{
+		Config:                   cfg,
+		TablePrefix:              "durabletask",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+	}
+}
+
+// NewDynamoDBBackend creates a new DynamoDB-based Backend object.
+//
+// The task hub consists of five tables, which are created on demand with on-demand billing: the instances table
+// contains the metadata of each orchestration instance, the history table contains the history events of each
+// instance, and the events and tasks tables contain the pending orchestration events and activity tasks. The work
+// items table contains a lease for each orchestration instance with pending events, which workers lock with
+// conditional writes, so that multiple workers can share the same task hub.
+//
+// Updates that span multiple items are made in DynamoDB transactions. Completions of orchestration work items that
+// write more than 100 items are split into multiple transactions, so they aren't atomic. If such a completion
+// fails, the work item is processed again after its lock expires.
+func NewDynamoDBBackend(opts *DynamoDBOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewDynamoDBOptions(aws.Config{})
+	}
+
+	return &dynamoDBBackend{
+		client:     nil,
+		workerName: fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:    opts,
+		logger:     logger,
+	}
+}
+
+// CreateTaskHub creates the tables of the task hub, if they don't exist, and waits for them to become active
+func (be *dynamoDBBackend) CreateTaskHub(ctx context.Context) error {
+	if be.client == nil {
+		be.client = dynamodb.NewFromConfig(be.options.Config)
+	}
+
+	for _, input := range be.tableDefinitions() {
+		if _, err := be.client.CreateTable(ctx, input); err != nil {
+			var inUse *types.ResourceInUseException
+			if !errors.As(err, &inUse) {
+				return fmt.Errorf("failed to create table %s: %w", *input.TableName, err)
+			}
+		}
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(be.client)
+	for _, input := range be.tableDefinitions() {
+		if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, 5*time.Minute); err != nil {
+			return fmt.Errorf("failed to wait for table %s: %w", *input.TableName, err)
+		}
+	}
+	return nil
+}
+
+// DeleteTaskHub deletes the tables of the task hub
+func (be *dynamoDBBackend) DeleteTaskHub(ctx context.Context) error {
+	client := be.client
+	if client == nil {
+		client = dynamodb.NewFromConfig(be.options.Config)
+	}
+	be.client = nil
+
+	if _, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: be.instancesTable()}); err != nil {
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return backend.ErrTaskHubNotFound
+		}
+		return fmt.Errorf("failed to check whether the task hub exists: %w", err)
+	}
+
+	for _, input := range be.tableDefinitions() {
+		if _, err := client.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: input.TableName}); err != nil {
+			var notFound *types.ResourceNotFoundException
+			if !errors.As(err, &notFound) {
+				return fmt.Errorf("failed to delete table %s: %w", *input.TableName, err)
+			}
+		}
+	}
+
+	waiter := dynamodb.NewTableNotExistsWaiter(client)
+	for _, input := range be.tableDefinitions() {
+		if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, 5*time.Minute); err != nil {
+			return fmt.Errorf("failed to wait for the deletion of table %s: %w", *input.TableName, err)
+		}
+	}
+	return nil
+}
+
+func (be *dynamoDBBackend) tableDefinitions() []*dynamodb.CreateTableInput {
+	table := func(name *string, hashKey string, hashType types.ScalarAttributeType, rangeKey string, rangeType types.ScalarAttributeType) *dynamodb.CreateTableInput {
+		input := &dynamodb.CreateTableInput{
+			TableName:            name,
+			BillingMode:          types.BillingModePayPerRequest,
+			AttributeDefinitions: []types.AttributeDefinition{{AttributeName: aws.String(hashKey), AttributeType: hashType}},
+			KeySchema:            []types.KeySchemaElement{{AttributeName: aws.String(hashKey), KeyType: types.KeyTypeHash}},
+		}
+		if rangeKey != "" {
+			input.AttributeDefinitions = append(input.AttributeDefinitions, types.AttributeDefinition{AttributeName: aws.String(rangeKey), AttributeType: rangeType})
+			input.KeySchema = append(input.KeySchema, types.KeySchemaElement{AttributeName: aws.String(rangeKey), KeyType: types.KeyTypeRange})
+		}
+		return input
+	}
+
+	return []*dynamodb.CreateTableInput{
+		table(be.instancesTable(), "InstanceID", types.ScalarAttributeTypeS, "", ""),
+		table(be.historyTable(), "InstanceID", types.ScalarAttributeTypeS, "SequenceNumber", types.ScalarAttributeTypeN),
+		table(be.eventsTable(), "InstanceID", types.ScalarAttributeTypeS, "SequenceNumber", types.ScalarAttributeTypeN),
+		table(be.tasksTable(), "Queue", types.ScalarAttributeTypeS, "SequenceNumber", types.ScalarAttributeTypeN),
+		table(be.workItemsTable(), "Queue", types.ScalarAttributeTypeS, "ID", types.ScalarAttributeTypeS),
+	}
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *dynamoDBBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+
+	items, err := be.createInstanceItems(e, seq)
+	if err != nil {
+		return err
+	}
+	return be.retryTransaction(ctx, func() error {
+		err := be.transact(ctx, items)
+		if isConditionalCheckFailed(err) {
+			// The instance is created with the condition that it doesn't exist yet
+			return backend.ErrDuplicateEvent
+		}
+		return err
+	})
+}
+
+// createInstanceItems returns the transaction items that create an orchestration instance and add its
+// ExecutionStarted event, with the specified sequence number.
+func (be *dynamoDBBackend) createInstanceItems(e *backend.HistoryEvent, seq int64) ([]types.TransactWriteItem, error) {
+	startEvent := e.GetExecutionStarted()
+	id := startEvent.OrchestrationInstance.InstanceId
+
+	// TODO: Support for re-using orchestration instance IDs
+	item := map[string]types.AttributeValue{
+		"InstanceID":      attrS(id),
+		"Name":            attrS(startEvent.Name),
+		"Version":         attrS(startEvent.Version.GetValue()),
+		"ExecutionID":     attrS(startEvent.OrchestrationInstance.ExecutionId.GetValue()),
+		"Input":           attrS(startEvent.Input.GetValue()),
+		"RuntimeStatus":   attrS("PENDING"),
+		"CreatedTime":     attrTime(e.Timestamp.AsTime()),
+		"LastUpdatedTime": attrTime(time.Now().UTC()),
+		"GenerationCount": attrN(0),
+		"HistoryLength":   attrN(0),
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		item["ParentInstanceID"] = attrS(parent.GetOrchestrationInstance().InstanceId)
+	}
+	if tags := helpers.GetTags(startEvent); len(tags) > 0 {
+		serialized, err := helpers.MarshalTags(tags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tags: %w", err)
+		}
+		item["Tags"] = attrS(serialized)
+	}
+
+	x := &expression{}
+	x.condition = fmt.Sprintf("attribute_not_exists(%s)", x.name("InstanceID"))
+	put := types.TransactWriteItem{Put: &types.Put{
+		TableName:                be.instancesTable(),
+		Item:                     item,
+		ConditionExpression:      x.conditionExpression(),
+		ExpressionAttributeNames: x.names,
+	}}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime int64
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime().UnixNano()
+	}
+
+	eventItems, err := be.addEventItems(id, e, seq, visibleTime)
+	if err != nil {
+		return nil, err
+	}
+	return append([]types.TransactWriteItem{put}, eventItems...), nil
+}
+
+// addEventItems returns the transaction items that add an event to the queue of an orchestration instance, with the
+// specified sequence number and visible time, and make the instance's work item visible at that time.
+func (be *dynamoDBBackend) addEventItems(id string, e *backend.HistoryEvent, seq int64, visibleTime int64) ([]types.TransactWriteItem, error) {
+	put, err := be.putEventItem(id, e, seq, visibleTime)
+	if err != nil {
+		return nil, err
+	}
+	return []types.TransactWriteItem{put, be.signalWorkItem(id, visibleTime)}, nil
+}
+
+func (be *dynamoDBBackend) putEventItem(id string, e *backend.HistoryEvent, seq int64, visibleTime int64) (types.TransactWriteItem, error) {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName: be.eventsTable(),
+		Item: map[string]types.AttributeValue{
+			"InstanceID":     attrS(id),
+			"SequenceNumber": attrN(seq),
+			"VisibleTime":    attrN(visibleTime),
+			"DequeueCount":   attrN(0),
+			"EventPayload":   attrB(eventPayload),
+		},
+	}}, nil
+}
+
+// signalWorkItem returns the transaction item that makes the orchestration work item of an instance visible at the
+// specified time. The work item is created if it doesn't exist.
+func (be *dynamoDBBackend) signalWorkItem(id string, visibleTime int64) types.TransactWriteItem {
+	x := &expression{}
+	x.set("VisibleTime", attrN(visibleTime))
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName:                 be.workItemsTable(),
+		Key:                       workItemKey(orchestrationQueue, id),
+		UpdateExpression:          x.updateExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	}}
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *dynamoDBBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	items, err := be.addEventItems(string(iid), e, seq, 0)
+	if err != nil {
+		return err
+	}
+	return be.retryTransaction(ctx, func() error {
+		return be.transact(ctx, items)
+	})
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *dynamoDBBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	items, err := be.addEventItems(string(iid), e, seq, 0)
+	if err != nil {
+		return err
+	}
+
+	// The status is checked in the same transaction in which the event is added, so that it can't change in between
+	x := &expression{}
+	placeholders := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		placeholders = append(placeholders, x.value(attrS(helpers.ToRuntimeStatusString(status))))
+	}
+	x.condition = fmt.Sprintf("%s IN (%s)", x.name("RuntimeStatus"), strings.Join(placeholders, ", "))
+	check := types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		TableName:                 be.instancesTable(),
+		Key:                       instanceKey(string(iid)),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	}}
+
+	return be.retryTransaction(ctx, func() error {
+		err := be.transact(ctx, append([]types.TransactWriteItem{check}, items...))
+		if !isConditionalCheckFailed(err) {
+			return err
+		}
+
+		if exists, err := be.instanceExists(ctx, string(iid)); err != nil {
+			return err
+		} else if !exists {
+			return api.ErrInstanceNotFound
+		}
+		return api.ErrPreconditionFailed
+	})
+}
+
+// IngestOperations implements backend.BackendWithIngest
+//
+// Each operation is committed in its own transaction.
+func (be *dynamoDBBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *dynamoDBBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	// A work item can be locked if it's visible and not locked, or if its lock expired
+	lockable := func(x *expression) string {
+		return fmt.Sprintf(
+			"(%s <= %s AND attribute_not_exists(%s)) OR %s < %s",
+			x.name("VisibleTime"), x.value(attrTime(now)), x.name("LockedBy"), x.name("LockExpiration"), x.value(attrTime(now)))
+	}
+
+	candidates := make([]string, 0, maxWorkItemCandidates)
+	x := &expression{}
+	x.condition = lockable(x)
+	keyCondition := fmt.Sprintf("%s = %s", x.name("Queue"), x.value(attrS(orchestrationQueue)))
+	paginator := dynamodb.NewQueryPaginator(be.client, &dynamodb.QueryInput{
+		TableName:                 be.workItemsTable(),
+		KeyConditionExpression:    aws.String(keyCondition),
+		FilterExpression:          x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	for paginator.HasMorePages() && len(candidates) < maxWorkItemCandidates {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+		}
+		for _, item := range page.Items {
+			candidates = append(candidates, itemS(item, "ID"))
+		}
+	}
+
+	for _, id := range candidates {
+		x := &expression{}
+		x.set("LockedBy", attrS(be.workerName))
+		x.set("LockExpiration", attrTime(now.Add(be.options.OrchestrationLockTimeout)))
+		x.set("VisibleTime", attrN(lockedVisibleTime))
+		x.condition = fmt.Sprintf("attribute_exists(%s) AND (%s)", x.name("Queue"), lockable(x))
+		_, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 be.workItemsTable(),
+			Key:                       workItemKey(orchestrationQueue, id),
+			UpdateExpression:          x.updateExpression(),
+			ConditionExpression:       x.conditionExpression(),
+			ExpressionAttributeNames:  x.names,
+			ExpressionAttributeValues: x.values,
+		})
+		if isConditionalCheckFailed(err) {
+			// Another worker locked the work item first
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to lock the orchestration work-item: %w", err)
+		}
+
+		wi, err := be.readOrchestrationWorkItem(ctx, id, now)
+		if err == errNotAvailable {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return wi, nil
+	}
+
+	// No new events to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// readOrchestrationWorkItem reads the visible events of a locked instance. If the instance doesn't exist or has no
+// visible events, the lock is released and errNotAvailable is returned.
+func (be *dynamoDBBackend) readOrchestrationWorkItem(ctx context.Context, id string, now time.Time) (*backend.OrchestrationWorkItem, error) {
+	instance, err := be.getInstance(ctx, id, "HistoryLength")
+	if err != nil {
+		return nil, err
+	}
+	events, err := be.queryEvents(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if instance == nil {
+		// Events that are sent to an instance before it's created are processed once it's created
+		return nil, be.releaseWorkItem(ctx, id, nil, errNotAvailable)
+	}
+	historyLength := itemN(instance, "HistoryLength")
+
+	visible := make([]map[string]types.AttributeValue, 0, len(events))
+	for _, e := range events {
+		if itemN(e, "VisibleTime") <= now.UnixNano() {
+			visible = append(visible, e)
+		}
+	}
+
+	// Instances that haven't started yet and still have invisible events are waiting for their scheduled start
+	// time, so events raised to them in the meantime must wait as well.
+	if len(visible) == 0 || (historyLength == 0 && len(visible) < len(events)) {
+		return nil, be.releaseWorkItem(ctx, id, nextVisibleTime(events, historyLength), errNotAvailable)
+	}
+
+	// TODO: Get all the unprocessed events associated with the locked instance
+	if len(visible) > 1000 {
+		visible = visible[:1000]
+	}
+
+	maxDequeueCount := int32(0)
+	newEvents := make([]*protos.HistoryEvent, 0, len(visible))
+	for _, e := range visible {
+		x := &expression{}
+		x.set("LockedBy", attrS(be.workerName))
+		x.add("DequeueCount", attrN(1))
+		res, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 be.eventsTable(),
+			Key:                       eventKey(id, itemN(e, "SequenceNumber")),
+			UpdateExpression:          x.updateExpression(),
+			ExpressionAttributeNames:  x.names,
+			ExpressionAttributeValues: x.values,
+			ReturnValues:              types.ReturnValueUpdatedNew,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock the orchestration work-item events: %w", err)
+		}
+
+		if dequeueCount := int32(itemN(res.Attributes, "DequeueCount")); dequeueCount > maxDequeueCount {
+			maxDequeueCount = dequeueCount
+		}
+
+		event, err := backend.UnmarshalHistoryEvent(itemB(e, "EventPayload"))
+		if err != nil {
+			return nil, err
+		}
+		newEvents = append(newEvents, event)
+	}
+
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: api.InstanceID(id),
+		NewEvents:  newEvents,
+		LockedBy:   be.workerName,
+		RetryCount: maxDequeueCount - 1,
+
+		NextSequenceNumber: int(historyLength),
+	}
+	return wi, nil
+}
+
+// releaseWorkItem unlocks the orchestration work item of an instance, and makes it visible at the specified time,
+// or deletes it if visibleTime is nil. If events were added to the instance while it was locked, the work item is
+// unlocked and left visible instead. It returns result if the lock was released.
+func (be *dynamoDBBackend) releaseWorkItem(ctx context.Context, id string, visibleTime *int64, result error) error {
+	x := &expression{}
+	x.condition = fmt.Sprintf(
+		"%s = %s AND %s = %s",
+		x.name("LockedBy"), x.value(attrS(be.workerName)), x.name("VisibleTime"), x.value(attrN(lockedVisibleTime)))
+
+	var err error
+	if visibleTime == nil {
+		_, err = be.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 be.workItemsTable(),
+			Key:                       workItemKey(orchestrationQueue, id),
+			ConditionExpression:       x.conditionExpression(),
+			ExpressionAttributeNames:  x.names,
+			ExpressionAttributeValues: x.values,
+		})
+	} else {
+		x.set("VisibleTime", attrN(*visibleTime))
+		x.remove("LockedBy", "LockExpiration")
+		_, err = be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 be.workItemsTable(),
+			Key:                       workItemKey(orchestrationQueue, id),
+			UpdateExpression:          x.updateExpression(),
+			ConditionExpression:       x.conditionExpression(),
+			ExpressionAttributeNames:  x.names,
+			ExpressionAttributeValues: x.values,
+		})
+	}
+	if err == nil {
+		return result
+	} else if !isConditionalCheckFailed(err) {
+		return fmt.Errorf("failed to release the orchestration work-item: %w", err)
+	}
+
+	// Either new events were added, or the lock was lost
+	x = &expression{}
+	x.remove("LockedBy", "LockExpiration")
+	x.condition = fmt.Sprintf("%s = %s", x.name("LockedBy"), x.value(attrS(be.workerName)))
+	_, err = be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 be.workItemsTable(),
+		Key:                       workItemKey(orchestrationQueue, id),
+		UpdateExpression:          x.updateExpression(),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	if isConditionalCheckFailed(err) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to release the orchestration work-item: %w", err)
+	}
+	return result
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *dynamoDBBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	x := &expression{}
+	x.set("LockExpiration", attrTime(time.Now().UTC().Add(be.options.OrchestrationLockTimeout)))
+	x.condition = fmt.Sprintf("%s = %s", x.name("LockedBy"), x.value(attrS(wi.LockedBy)))
+	_, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 be.workItemsTable(),
+		Key:                       workItemKey(orchestrationQueue, string(wi.InstanceID)),
+		UpdateExpression:          x.updateExpression(),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	if isConditionalCheckFailed(err) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to renew the lock on the orchestration work-item: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *dynamoDBBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	existingEvents, err := be.queryHistory(ctx, string(wi.InstanceID), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *dynamoDBBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.getInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+	return parseOrchestrationMetadata(instance)
+}
+
+// parseOrchestrationMetadata reads the orchestration metadata from an item of the instances table.
+func parseOrchestrationMetadata(item map[string]types.AttributeValue) (*api.OrchestrationMetadata, error) {
+	var failureDetails *protos.TaskFailureDetails
+	if payload := itemB(item, "FailureDetails"); len(payload) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(payload, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(itemS(item, "InstanceID")),
+		itemS(item, "Name"),
+		helpers.FromRuntimeStatusString(itemS(item, "RuntimeStatus")),
+		itemTime(item, "CreatedTime"),
+		itemTime(item, "LastUpdatedTime"),
+		itemS(item, "Input"),
+		itemS(item, "Output"),
+		itemS(item, "CustomStatus"),
+		failureDetails,
+	)
+	metadata.GenerationCount = int(itemN(item, "GenerationCount"))
+	tags, err := helpers.UnmarshalTags(itemS(item, "Tags"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+	}
+	metadata.Tags = tags
+	return metadata, nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *dynamoDBBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.retryTransaction(ctx, func() error {
+		return be.completeOrchestrationWorkItem(ctx, wi)
+	})
+}
+
+func (be *dynamoDBBackend) completeOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	id := string(wi.InstanceID)
+	now := time.Now().UTC()
+
+	events, err := be.queryEvents(ctx, id)
+	if err != nil {
+		return err
+	}
+	lockedEvents := make([]map[string]types.AttributeValue, 0, len(events))
+	remainingEvents := make([]map[string]types.AttributeValue, 0, len(events))
+	for _, e := range events {
+		if itemS(e, "LockedBy") == wi.LockedBy {
+			lockedEvents = append(lockedEvents, e)
+		} else {
+			remainingEvents = append(remainingEvents, e)
+		}
+	}
+	if len(lockedEvents) == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	// Update the instance
+	x := &expression{}
+	isCreated := false
+	isCompleted := false
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if isCreated {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			isCreated = true
+			x.set("CreatedTime", attrTime(e.Timestamp.AsTime()))
+			x.set("Input", attrS(es.Input.GetValue()))
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			x.set("CompletedTime", attrTime(now))
+			x.set("Output", attrS(ec.Result.GetValue()))
+			if ec.FailureDetails != nil {
+				bytes, err := proto.Marshal(ec.FailureDetails)
+				if err != nil {
+					return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+				}
+				x.set("FailureDetails", attrB(bytes))
+			} else {
+				x.remove("FailureDetails")
+			}
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		x.set("CustomStatus", attrS(wi.State.CustomStatus.Value))
+	}
+	if count := wi.State.ContinuedAsNewCount(); count > 0 {
+		x.add("GenerationCount", attrN(int64(count)))
+	}
+
+	// Save the actions from the most recent execution, if requested
+	if wi.State.LastActions != nil {
+		payload, err := proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: id,
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+		x.set("LastActions", attrB(payload))
+	}
+
+	// TODO: Support for stickiness, which would extend the LockExpiration
+	firstSequenceNumber := int64(len(wi.State.OldEvents()))
+	historyLength := firstSequenceNumber + int64(len(wi.State.NewEvents()))
+	x.set("RuntimeStatus", attrS(helpers.ToRuntimeStatusString(wi.State.RuntimeStatus())))
+	x.set("LastUpdatedTime", attrTime(now))
+	x.set("HistoryLength", attrN(historyLength))
+	x.condition = fmt.Sprintf("attribute_exists(%s)", x.name("InstanceID"))
+	items := []types.TransactWriteItem{{Update: &types.Update{
+		TableName:                 be.instancesTable(),
+		Key:                       instanceKey(id),
+		UpdateExpression:          x.updateExpression(),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	}}}
+
+	// If continue-as-new, delete the existing history that isn't overwritten by the new history
+	if wi.State.ContinuedAsNew() {
+		keys, err := be.queryHistoryKeys(ctx, id, historyLength)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			items = append(items, types.TransactWriteItem{Delete: &types.Delete{TableName: be.historyTable(), Key: key}})
+		}
+	}
+
+	// Save new history events
+	for i, e := range wi.State.NewEvents() {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName: be.historyTable(),
+			Item: map[string]types.AttributeValue{
+				"InstanceID":     attrS(id),
+				"SequenceNumber": attrN(firstSequenceNumber + int64(i)),
+				"EventPayload":   attrB(eventPayload),
+			},
+		}})
+	}
+
+	// Sub-orchestrations with IDs that already exist aren't created
+	messages := make([]backend.OrchestratorMessage, 0, len(wi.State.PendingMessages()))
+	created := make(map[string]bool)
+	for _, msg := range wi.State.PendingMessages() {
+		if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+			subID := es.OrchestrationInstance.InstanceId
+			exists := created[subID]
+			if !exists {
+				if exists, err = be.instanceExists(ctx, subID); err != nil {
+					return err
+				}
+			}
+			if exists {
+				be.logger.Warnf(
+					"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+					wi.InstanceID,
+					subID)
+				continue
+			}
+			created[subID] = true
+		}
+		messages = append(messages, msg)
+	}
+
+	count := len(wi.State.PendingTasks()) + len(wi.State.PendingTimers()) + len(messages)
+	var seq int64
+	if count > 0 {
+		if seq, err = be.nextSequenceNumbers(ctx, count); err != nil {
+			return err
+		}
+	}
+
+	// Save outbound activity tasks
+	for _, e := range wi.State.PendingTasks() {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName: be.tasksTable(),
+			Item: map[string]types.AttributeValue{
+				"Queue":          attrS(activityQueue),
+				"SequenceNumber": attrN(seq),
+				"InstanceID":     attrS(id),
+				"DequeueCount":   attrN(0),
+				"EventPayload":   attrB(eventPayload),
+			},
+		}})
+		seq++
+	}
+
+	// Save outbound orchestrator events. The work item of this instance is released after the transaction, and the
+	// work items of other instances are signaled once each.
+	visibleTimes := make([]int64, 0, len(remainingEvents)+len(wi.State.PendingTimers()))
+	for _, e := range remainingEvents {
+		visibleTimes = append(visibleTimes, itemN(e, "VisibleTime"))
+	}
+	for _, e := range wi.State.PendingTimers() {
+		visibleTime := e.GetTimerFired().GetFireAt().AsTime().UnixNano()
+		put, err := be.putEventItem(id, e, seq, visibleTime)
+		if err != nil {
+			return err
+		}
+		items = append(items, put)
+		visibleTimes = append(visibleTimes, visibleTime)
+		seq++
+	}
+
+	signaled := make(map[string]bool)
+	for _, msg := range messages {
+		var put []types.TransactWriteItem
+		if msg.HistoryEvent.GetExecutionStarted() != nil {
+			put, err = be.createInstanceItems(msg.HistoryEvent, seq)
+		} else {
+			var item types.TransactWriteItem
+			item, err = be.putEventItem(msg.TargetInstanceID, msg.HistoryEvent, seq, 0)
+			put = []types.TransactWriteItem{item, be.signalWorkItem(msg.TargetInstanceID, 0)}
+		}
+		if err != nil {
+			return err
+		}
+		seq++
+
+		// The last item signals the work item of the target instance
+		if msg.TargetInstanceID == id {
+			visibleTimes = append(visibleTimes, 0)
+			put = put[:len(put)-1]
+		} else if signaled[msg.TargetInstanceID] {
+			put = put[:len(put)-1]
+		}
+		signaled[msg.TargetInstanceID] = true
+		items = append(items, put...)
+	}
+
+	// Delete inbound events
+	for _, e := range lockedEvents {
+		items = append(items, types.TransactWriteItem{Delete: &types.Delete{
+			TableName: be.eventsTable(),
+			Key:       eventKey(id, itemN(e, "SequenceNumber")),
+		}})
+	}
+
+	// The instance update is moved to the last transaction, so that the instance isn't updated unless everything
+	// else was saved
+	items = append(items[1:], items[0])
+	if err := be.transactLocked(ctx, id, items); err != nil {
+		return err
+	}
+
+	// The instance has started, so its work item becomes visible with its first event
+	var visibleTime *int64
+	for _, t := range visibleTimes {
+		if visibleTime == nil || t < *visibleTime {
+			v := t
+			visibleTime = &v
+		}
+	}
+	return be.releaseWorkItem(ctx, id, visibleTime, nil)
+}
+
+// transactLocked writes the specified items in one or more transactions, with the condition that the orchestration
+// work item of the specified instance is locked by this worker.
+func (be *dynamoDBBackend) transactLocked(ctx context.Context, id string, items []types.TransactWriteItem) error {
+	x := &expression{}
+	x.condition = fmt.Sprintf("%s = %s", x.name("LockedBy"), x.value(attrS(be.workerName)))
+	check := types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		TableName:                 be.workItemsTable(),
+		Key:                       workItemKey(orchestrationQueue, id),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	}}
+
+	for len(items) > 0 {
+		n := len(items)
+		if n > maxTransactionItems-1 {
+			n = maxTransactionItems - 1
+		}
+
+		err := be.transact(ctx, append([]types.TransactWriteItem{check}, items[:n]...))
+		if isConditionalCheckFailed(err) {
+			return backend.ErrWorkItemLockLost
+		} else if err != nil {
+			return err
+		}
+		items = items[n:]
+	}
+	return nil
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *dynamoDBBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	events, err := be.queryEvents(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var visibleTime int64
+	if delay := wi.GetAbandonDelay(); delay > 0 {
+		visibleTime = time.Now().UTC().Add(delay).UnixNano()
+	}
+
+	abandoned := 0
+	for _, e := range events {
+		if itemS(e, "LockedBy") != wi.LockedBy {
+			continue
+		}
+
+		x := &expression{}
+		x.set("VisibleTime", attrN(visibleTime))
+		x.remove("LockedBy")
+		if _, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 be.eventsTable(),
+			Key:                       eventKey(id, itemN(e, "SequenceNumber")),
+			UpdateExpression:          x.updateExpression(),
+			ExpressionAttributeNames:  x.names,
+			ExpressionAttributeValues: x.values,
+		}); err != nil {
+			return fmt.Errorf("failed to unlock the orchestration work-item events: %w", err)
+		}
+		e["VisibleTime"] = attrN(visibleTime)
+		abandoned++
+	}
+	if abandoned == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	first := nextVisibleTime(events, 1)
+	return be.releaseWorkItem(ctx, id, first, nil)
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *dynamoDBBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	lockable := func(x *expression) string {
+		return fmt.Sprintf("attribute_not_exists(%s) OR %s < %s", x.name("LockExpiration"), x.name("LockExpiration"), x.value(attrTime(now)))
+	}
+
+	candidates := make([]int64, 0, maxWorkItemCandidates)
+	x := &expression{}
+	x.condition = lockable(x)
+	keyCondition := fmt.Sprintf("%s = %s", x.name("Queue"), x.value(attrS(activityQueue)))
+	paginator := dynamodb.NewQueryPaginator(be.client, &dynamodb.QueryInput{
+		TableName:                 be.tasksTable(),
+		KeyConditionExpression:    aws.String(keyCondition),
+		FilterExpression:          x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	for paginator.HasMorePages() && len(candidates) < maxWorkItemCandidates {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
+		}
+		for _, item := range page.Items {
+			candidates = append(candidates, itemN(item, "SequenceNumber"))
+		}
+	}
+
+	for _, seq := range candidates {
+		x := &expression{}
+		x.set("LockedBy", attrS(be.workerName))
+		x.set("LockExpiration", attrTime(now.Add(be.options.ActivityLockTimeout)))
+		x.add("DequeueCount", attrN(1))
+		x.condition = fmt.Sprintf("attribute_exists(%s) AND (%s)", x.name("Queue"), lockable(x))
+		res, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 be.tasksTable(),
+			Key:                       taskKey(seq),
+			UpdateExpression:          x.updateExpression(),
+			ConditionExpression:       x.conditionExpression(),
+			ExpressionAttributeNames:  x.names,
+			ExpressionAttributeValues: x.values,
+			ReturnValues:              types.ReturnValueAllNew,
+		})
+		if isConditionalCheckFailed(err) {
+			// Another worker locked the task first
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to lock the activity work-item: %w", err)
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(itemB(res.Attributes, "EventPayload"))
+		if err != nil {
+			return nil, err
+		}
+
+		wi := &backend.ActivityWorkItem{
+			SequenceNumber: seq,
+			InstanceID:     api.InstanceID(itemS(res.Attributes, "InstanceID")),
+			NewEvent:       e,
+			LockedBy:       be.workerName,
+		}
+		return wi, nil
+	}
+
+	// No new activity tasks to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *dynamoDBBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	items, err := be.addEventItems(string(wi.InstanceID), wi.Result, seq, 0)
+	if err != nil {
+		return err
+	}
+
+	x := &expression{}
+	x.condition = fmt.Sprintf("%s = %s", x.name("LockedBy"), x.value(attrS(wi.LockedBy)))
+	items = append(items, types.TransactWriteItem{Delete: &types.Delete{
+		TableName:                 be.tasksTable(),
+		Key:                       taskKey(wi.SequenceNumber),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	}})
+
+	return be.retryTransaction(ctx, func() error {
+		err := be.transact(ctx, items)
+		if isConditionalCheckFailed(err) {
+			return backend.ErrWorkItemLockLost
+		}
+		return err
+	})
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *dynamoDBBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	x := &expression{}
+	x.remove("LockedBy", "LockExpiration")
+	x.condition = fmt.Sprintf("%s = %s", x.name("LockedBy"), x.value(attrS(wi.LockedBy)))
+	_, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 be.tasksTable(),
+		Key:                       taskKey(wi.SequenceNumber),
+		UpdateExpression:          x.updateExpression(),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	if isConditionalCheckFailed(err) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to update the tasks table for abandon: %w", err)
+	}
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *dynamoDBBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	x := &expression{}
+	x.set("LockExpiration", attrTime(time.Now().UTC().Add(be.options.ActivityLockTimeout)))
+	x.condition = fmt.Sprintf("%s = %s", x.name("LockedBy"), x.value(attrS(wi.LockedBy)))
+	_, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 be.tasksTable(),
+		Key:                       taskKey(wi.SequenceNumber),
+		UpdateExpression:          x.updateExpression(),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	if isConditionalCheckFailed(err) {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to update the tasks table for lock renewal: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *dynamoDBBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.getInstance(ctx, string(iid), "InstanceID", "LastActions")
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(itemB(instance, "LastActions"), res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *dynamoDBBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	instance, err := be.getInstance(ctx, string(id), "RuntimeStatus")
+	if err != nil {
+		return err
+	} else if instance == nil {
+		return api.ErrInstanceNotFound
+	} else if !isCompletedStatus(itemS(instance, "RuntimeStatus")) {
+		return api.ErrNotCompleted
+	}
+
+	// The history is deleted first, so that a failed purge can be retried
+	keys, err := be.queryHistoryKeys(ctx, string(id), 0)
+	if err != nil {
+		return err
+	}
+	if err := be.batchDelete(ctx, be.historyTable(), keys); err != nil {
+		return fmt.Errorf("failed to delete from the history table: %w", err)
+	}
+
+	x := &expression{}
+	x.condition = fmt.Sprintf(
+		"%s IN (%s, %s, %s)",
+		x.name("RuntimeStatus"), x.value(attrS("COMPLETED")), x.value(attrS("FAILED")), x.value(attrS("TERMINATED")))
+	_, err = be.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 be.instancesTable(),
+		Key:                       instanceKey(string(id)),
+		ConditionExpression:       x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+	})
+	if isConditionalCheckFailed(err) {
+		return api.ErrNotCompleted
+	} else if err != nil {
+		return fmt.Errorf("failed to delete from the instances table: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *dynamoDBBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	errs := make(map[api.InstanceID]error)
+	for iid, from := range fromSequenceNumbers {
+		exists, err := be.instanceExists(ctx, string(iid))
+		if err != nil {
+			return nil, err
+		} else if !exists {
+			errs[iid] = api.ErrInstanceNotFound
+			continue
+		}
+
+		events, err := be.queryHistory(ctx, string(iid), int64(from))
+		if err != nil {
+			errs[iid] = err
+			continue
+		}
+		histories[iid] = events
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *dynamoDBBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.scanInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string, len(instances))
+	for _, instance := range instances {
+		statuses[itemS(instance, "InstanceID")] = itemS(instance, "RuntimeStatus")
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for _, instance := range instances {
+		parentID, ok := instance["ParentInstanceID"]
+		if !ok {
+			continue
+		}
+		switch itemS(instance, "RuntimeStatus") {
+		case "PENDING", "RUNNING", "SUSPENDED":
+		default:
+			continue
+		}
+		if parentStatus, ok := statuses[parentID.(*types.AttributeValueMemberS).Value]; ok && !isCompletedStatus(parentStatus) {
+			continue
+		}
+
+		metadata, err := parseOrchestrationMetadata(instance)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *dynamoDBBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	instances, err := be.scanInstances(ctx)
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return itemS(instances[i], "InstanceID") < itemS(instances[j], "InstanceID")
+	})
+
+	pageSize := query.PageSizeOrDefault()
+	page := make([]*api.OrchestrationMetadata, 0)
+	for _, instance := range instances {
+		id := itemS(instance, "InstanceID")
+		if id <= query.ContinuationToken || !strings.HasPrefix(id, query.InstanceIDPrefix) {
+			continue
+		}
+		if query.Name != "" && itemS(instance, "Name") != query.Name {
+			continue
+		}
+		if len(query.RuntimeStatuses) > 0 {
+			matches := false
+			for _, status := range query.RuntimeStatuses {
+				if helpers.ToRuntimeStatusString(status) == itemS(instance, "RuntimeStatus") {
+					matches = true
+					break
+				}
+			}
+			if !matches {
+				continue
+			}
+		}
+		createdTime := itemTime(instance, "CreatedTime")
+		if !query.CreatedFrom.IsZero() && createdTime.Before(query.CreatedFrom) {
+			continue
+		}
+		if !query.CreatedTo.IsZero() && !createdTime.Before(query.CreatedTo) {
+			continue
+		}
+
+		metadata, err := parseOrchestrationMetadata(instance)
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		page = append(page, metadata)
+		if len(page) > pageSize {
+			break
+		}
+	}
+	return backend.NewInstanceQueryResult(page, pageSize), nil
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+//
+// The items of the instance are read with separate requests, so the export isn't a consistent snapshot of an
+// instance that's running.
+func (be *dynamoDBBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.getInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+	metadata, err := parseOrchestrationMetadata(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{Metadata: metadata}
+	if state.History, err = be.queryHistory(ctx, string(iid), 0); err != nil {
+		return nil, err
+	}
+
+	events, err := be.queryEvents(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	}
+	if state.PendingEvents, err = unmarshalEvents(events); err != nil {
+		return nil, fmt.Errorf("failed to read the pending events: %w", err)
+	}
+
+	x := &expression{}
+	x.condition = fmt.Sprintf("%s = %s", x.name("InstanceID"), x.value(attrS(string(iid))))
+	keyCondition := fmt.Sprintf("%s = %s", x.name("Queue"), x.value(attrS(activityQueue)))
+	tasks, err := be.query(ctx, &dynamodb.QueryInput{
+		TableName:                 be.tasksTable(),
+		KeyConditionExpression:    aws.String(keyCondition),
+		FilterExpression:          x.conditionExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the tasks table: %w", err)
+	}
+	if state.PendingTasks, err = unmarshalEvents(tasks); err != nil {
+		return nil, fmt.Errorf("failed to read the pending tasks: %w", err)
+	}
+	return state, nil
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *dynamoDBBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	item := map[string]types.AttributeValue{
+		"InstanceID":      attrS(id),
+		"Name":            attrS(metadata.Name),
+		"Version":         attrS(startEvent.GetVersion().GetValue()),
+		"ExecutionID":     attrS(startEvent.GetOrchestrationInstance().GetExecutionId().GetValue()),
+		"RuntimeStatus":   attrS(helpers.ToRuntimeStatusString(metadata.RuntimeStatus)),
+		"CreatedTime":     attrTime(metadata.CreatedAt),
+		"LastUpdatedTime": attrTime(metadata.LastUpdatedAt),
+		"Input":           attrS(metadata.SerializedInput),
+		"Output":          attrS(metadata.SerializedOutput),
+		"CustomStatus":    attrS(metadata.SerializedCustomStatus),
+		"GenerationCount": attrN(int64(metadata.GenerationCount)),
+		"HistoryLength":   attrN(int64(len(state.History))),
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		item["ParentInstanceID"] = attrS(parent.GetOrchestrationInstance().GetInstanceId())
+	}
+	if len(metadata.Tags) > 0 {
+		tags, err := helpers.MarshalTags(metadata.Tags)
+		if err != nil {
+			return fmt.Errorf("failed to marshal tags: %w", err)
+		}
+		item["Tags"] = attrS(tags)
+	}
+	if metadata.IsComplete() {
+		item["CompletedTime"] = attrTime(metadata.LastUpdatedAt)
+	}
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		item["FailureDetails"] = attrB(bytes)
+	}
+
+	history := make([]types.WriteRequest, 0, len(state.History))
+	for i, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		history = append(history, types.WriteRequest{PutRequest: &types.PutRequest{Item: map[string]types.AttributeValue{
+			"InstanceID":     attrS(id),
+			"SequenceNumber": attrN(int64(i)),
+			"EventPayload":   attrB(eventPayload),
+		}}})
+	}
+
+	x := &expression{}
+	x.condition = fmt.Sprintf("attribute_not_exists(%s)", x.name("InstanceID"))
+	_, err := be.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                be.instancesTable(),
+		Item:                     item,
+		ConditionExpression:      x.conditionExpression(),
+		ExpressionAttributeNames: x.names,
+	})
+	if isConditionalCheckFailed(err) {
+		return backend.ErrDuplicateEvent
+	} else if err != nil {
+		return fmt.Errorf("failed to insert into the instances table: %w", err)
+	}
+
+	// The history is saved after the instance is created, so that the history of an existing instance with the same
+	// ID isn't overwritten
+	if err := be.batchWrite(ctx, be.historyTable(), history); err != nil {
+		return fmt.Errorf("failed to insert into the history table: %w", err)
+	}
+
+	count := len(state.PendingEvents) + len(state.PendingTasks)
+	if count == 0 {
+		return nil
+	}
+	seq, err := be.nextSequenceNumbers(ctx, count)
+	if err != nil {
+		return err
+	}
+
+	events := make([]types.WriteRequest, 0, len(state.PendingEvents))
+	visibleTimes := make([]map[string]types.AttributeValue, 0, len(state.PendingEvents))
+	for _, e := range state.PendingEvents {
+		// Timers and scheduled starts must stay invisible to workers until they're due
+		var visibleTime int64
+		if tf := e.GetTimerFired(); tf != nil {
+			visibleTime = tf.GetFireAt().AsTime().UnixNano()
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			visibleTime = ts.AsTime().UnixNano()
+		}
+
+		put, err := be.putEventItem(id, e, seq, visibleTime)
+		if err != nil {
+			return err
+		}
+		events = append(events, types.WriteRequest{PutRequest: &types.PutRequest{Item: put.Put.Item}})
+		visibleTimes = append(visibleTimes, map[string]types.AttributeValue{"VisibleTime": attrN(visibleTime)})
+		seq++
+	}
+	if err := be.batchWrite(ctx, be.eventsTable(), events); err != nil {
+		return fmt.Errorf("failed to insert into the events table: %w", err)
+	}
+
+	tasks := make([]types.WriteRequest, 0, len(state.PendingTasks))
+	for _, e := range state.PendingTasks {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		tasks = append(tasks, types.WriteRequest{PutRequest: &types.PutRequest{Item: map[string]types.AttributeValue{
+			"Queue":          attrS(activityQueue),
+			"SequenceNumber": attrN(seq),
+			"InstanceID":     attrS(id),
+			"DequeueCount":   attrN(0),
+			"EventPayload":   attrB(eventPayload),
+		}}})
+		seq++
+	}
+	if err := be.batchWrite(ctx, be.tasksTable(), tasks); err != nil {
+		return fmt.Errorf("failed to insert into the tasks table: %w", err)
+	}
+
+	if visibleTime := nextVisibleTime(visibleTimes, int64(len(state.History))); visibleTime != nil {
+		signal := be.signalWorkItem(id, *visibleTime).Update
+		if _, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 signal.TableName,
+			Key:                       signal.Key,
+			UpdateExpression:          signal.UpdateExpression,
+			ExpressionAttributeNames:  signal.ExpressionAttributeNames,
+			ExpressionAttributeValues: signal.ExpressionAttributeValues,
+		}); err != nil {
+			return fmt.Errorf("failed to update the work items table: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *dynamoDBBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.scanInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, instance := range instances {
+		if itemS(instance, "Name") != name {
+			continue
+		}
+		createdTime := itemTime(instance, "CreatedTime")
+		if !createdTime.Before(since) {
+			stats.Started++
+		}
+
+		runtimeStatus := itemS(instance, "RuntimeStatus")
+		if _, ok := instance["CompletedTime"]; !ok || (runtimeStatus != "COMPLETED" && runtimeStatus != "FAILED") {
+			continue
+		}
+		completedTime := itemTime(instance, "CompletedTime")
+		if completedTime.Before(since) {
+			continue
+		}
+		if runtimeStatus == "FAILED" {
+			stats.Failed++
+		} else {
+			stats.Completed++
+		}
+		d := completedTime.Sub(createdTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*dynamoDBBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*dynamoDBBackend) Stop(context.Context) error {
+	return nil
+}
+
+func (be *dynamoDBBackend) ensureDB() error {
+	if be.client == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *dynamoDBBackend) String() string {
+	return fmt.Sprintf("dynamodb::%s", be.options.TablePrefix)
+}
+
+// nextSequenceNumbers reserves count consecutive sequence numbers for events and tasks, and returns the first one.
+func (be *dynamoDBBackend) nextSequenceNumbers(ctx context.Context, count int) (int64, error) {
+	x := &expression{}
+	x.add("Value", attrN(int64(count)))
+	res, err := be.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 be.workItemsTable(),
+		Key:                       workItemKey(counterQueue, "sequence"),
+		UpdateExpression:          x.updateExpression(),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate a sequence number: %w", err)
+	}
+	return itemN(res.Attributes, "Value") - int64(count) + 1, nil
+}
+
+// transact writes the specified items in a transaction. It returns errTransactionConflict if the transaction was
+// canceled because of a concurrent transaction, and a *types.TransactionCanceledException if it was canceled
+// because a condition wasn't met.
+func (be *dynamoDBBackend) transact(ctx context.Context, items []types.TransactWriteItem) error {
+	_, err := be.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err == nil {
+		return nil
+	}
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "TransactionConflict" {
+				return errTransactionConflict
+			}
+		}
+		return err
+	}
+	var conflict *types.TransactionConflictException
+	if errors.As(err, &conflict) {
+		return errTransactionConflict
+	}
+	return fmt.Errorf("failed to commit transaction: %w", err)
+}
+
+// retryTransaction calls fn until it doesn't return errTransactionConflict, up to maxTransactionAttempts times.
+func (be *dynamoDBBackend) retryTransaction(ctx context.Context, fn func() error) error {
+	delay := 10 * time.Millisecond
+	for i := 0; ; i++ {
+		err := fn()
+		if err != errTransactionConflict || i == maxTransactionAttempts-1 {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (be *dynamoDBBackend) getInstance(ctx context.Context, id string, attributes ...string) (map[string]types.AttributeValue, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      be.instancesTable(),
+		Key:            instanceKey(id),
+		ConsistentRead: aws.Bool(true),
+	}
+	if len(attributes) > 0 {
+		x := &expression{}
+		projection := make([]string, 0, len(attributes))
+		for _, attr := range attributes {
+			projection = append(projection, x.name(attr))
+		}
+		input.ProjectionExpression = aws.String(strings.Join(projection, ", "))
+		input.ExpressionAttributeNames = x.names
+	}
+
+	res, err := be.client.GetItem(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the instances table: %w", err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+	return res.Item, nil
+}
+
+func (be *dynamoDBBackend) instanceExists(ctx context.Context, id string) (bool, error) {
+	instance, err := be.getInstance(ctx, id, "InstanceID")
+	return instance != nil, err
+}
+
+// scanInstances reads all the instances, ordered by creation time and instance ID.
+func (be *dynamoDBBackend) scanInstances(ctx context.Context) ([]map[string]types.AttributeValue, error) {
+	instances := make([]map[string]types.AttributeValue, 0)
+	paginator := dynamodb.NewScanPaginator(be.client, &dynamodb.ScanInput{
+		TableName:      be.instancesTable(),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the instances table: %w", err)
+		}
+		instances = append(instances, page.Items...)
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		ti, tj := itemN(instances[i], "CreatedTime"), itemN(instances[j], "CreatedTime")
+		if ti != tj {
+			return ti < tj
+		}
+		return itemS(instances[i], "InstanceID") < itemS(instances[j], "InstanceID")
+	})
+	return instances, nil
+}
+
+func (be *dynamoDBBackend) query(ctx context.Context, input *dynamodb.QueryInput) ([]map[string]types.AttributeValue, error) {
+	items := make([]map[string]types.AttributeValue, 0)
+	paginator := dynamodb.NewQueryPaginator(be.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+	}
+	return items, nil
+}
+
+// queryEvents reads the pending events of an instance, in sequence number order.
+func (be *dynamoDBBackend) queryEvents(ctx context.Context, id string) ([]map[string]types.AttributeValue, error) {
+	x := &expression{}
+	keyCondition := fmt.Sprintf("%s = %s", x.name("InstanceID"), x.value(attrS(id)))
+	events, err := be.query(ctx, &dynamodb.QueryInput{
+		TableName:                 be.eventsTable(),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the events table: %w", err)
+	}
+	return events, nil
+}
+
+// queryHistory reads the history of an instance, starting at the specified sequence number.
+func (be *dynamoDBBackend) queryHistory(ctx context.Context, id string, from int64) ([]*backend.HistoryEvent, error) {
+	x := &expression{}
+	keyCondition := fmt.Sprintf(
+		"%s = %s AND %s >= %s",
+		x.name("InstanceID"), x.value(attrS(id)), x.name("SequenceNumber"), x.value(attrN(from)))
+	items, err := be.query(ctx, &dynamodb.QueryInput{
+		TableName:                 be.historyTable(),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the history table: %w", err)
+	}
+	return unmarshalEvents(items)
+}
+
+// queryHistoryKeys reads the keys of the history events of an instance, starting at the specified sequence number.
+func (be *dynamoDBBackend) queryHistoryKeys(ctx context.Context, id string, from int64) ([]map[string]types.AttributeValue, error) {
+	x := &expression{}
+	keyCondition := fmt.Sprintf(
+		"%s = %s AND %s >= %s",
+		x.name("InstanceID"), x.value(attrS(id)), x.name("SequenceNumber"), x.value(attrN(from)))
+	keys, err := be.query(ctx, &dynamodb.QueryInput{
+		TableName:                 be.historyTable(),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ProjectionExpression:      aws.String(x.name("InstanceID") + ", " + x.name("SequenceNumber")),
+		ExpressionAttributeNames:  x.names,
+		ExpressionAttributeValues: x.values,
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the history table: %w", err)
+	}
+	return keys, nil
+}
+
+func (be *dynamoDBBackend) batchDelete(ctx context.Context, table *string, keys []map[string]types.AttributeValue) error {
+	requests := make([]types.WriteRequest, 0, len(keys))
+	for _, key := range keys {
+		requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+	}
+	return be.batchWrite(ctx, table, requests)
+}
+
+// batchWrite executes the specified write requests in batches, and retries the requests that weren't processed.
+func (be *dynamoDBBackend) batchWrite(ctx context.Context, table *string, requests []types.WriteRequest) error {
+	for len(requests) > 0 {
+		n := len(requests)
+		if n > 25 {
+			n = 25
+		}
+
+		res, err := be.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{*table: requests[:n]},
+		})
+		if err != nil {
+			return err
+		}
+		requests = append(res.UnprocessedItems[*table], requests[n:]...)
+	}
+	return nil
+}
+
+func (be *dynamoDBBackend) table(name string) *string {
+	return aws.String(be.options.TablePrefix + "-" + name)
+}
+
+func (be *dynamoDBBackend) instancesTable() *string { return be.table("Instances") }
+func (be *dynamoDBBackend) historyTable() *string   { return be.table("History") }
+func (be *dynamoDBBackend) eventsTable() *string    { return be.table("NewEvents") }
+func (be *dynamoDBBackend) tasksTable() *string     { return be.table("NewTasks") }
+func (be *dynamoDBBackend) workItemsTable() *string { return be.table("WorkItems") }
+
+func instanceKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"InstanceID": attrS(id)}
+}
+
+func eventKey(id string, seq int64) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"InstanceID": attrS(id), "SequenceNumber": attrN(seq)}
+}
+
+func taskKey(seq int64) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"Queue": attrS(activityQueue), "SequenceNumber": attrN(seq)}
+}
+
+func workItemKey(queue string, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"Queue": attrS(queue), "ID": attrS(id)}
+}
+
+// nextVisibleTime returns the time at which the orchestration work item of an instance with the specified pending
+// events becomes visible, or nil if there are no events. Instances that haven't started yet wait for all of their
+// events to become visible, so that they start at their scheduled start time.
+func nextVisibleTime(events []map[string]types.AttributeValue, historyLength int64) *int64 {
+	var visibleTime *int64
+	for _, e := range events {
+		t := itemN(e, "VisibleTime")
+		if visibleTime == nil || (historyLength > 0 && t < *visibleTime) || (historyLength == 0 && t > *visibleTime) {
+			visibleTime = &t
+		}
+	}
+	return visibleTime
+}
+
+func validateEvent(e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+	return nil
+}
+
+func isCompletedStatus(runtimeStatus string) bool {
+	return runtimeStatus == "COMPLETED" || runtimeStatus == "FAILED" || runtimeStatus == "TERMINATED"
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return true
+	}
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unmarshalEvents(items []map[string]types.AttributeValue) ([]*backend.HistoryEvent, error) {
+	events := make([]*backend.HistoryEvent, 0, len(items))
+	for _, item := range items {
+		e, err := backend.UnmarshalHistoryEvent(itemB(item, "EventPayload"))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// expression builds the update and condition expressions of a request, and their attribute names and values.
+type expression struct {
+	sets      []string
+	adds      []string
+	removes   []string
+	condition string
+	names     map[string]string
+	values    map[string]types.AttributeValue
+}
+
+// name returns the placeholder of an attribute name. Placeholders are used for all names, because many common
+// names are reserved words in DynamoDB.
+func (x *expression) name(attr string) string {
+	if x.names == nil {
+		x.names = make(map[string]string)
+	}
+	x.names["#"+attr] = attr
+	return "#" + attr
+}
+
+func (x *expression) value(v types.AttributeValue) string {
+	if x.values == nil {
+		x.values = make(map[string]types.AttributeValue)
+	}
+	placeholder := fmt.Sprintf(":v%d", len(x.values))
+	x.values[placeholder] = v
+	return placeholder
+}
+
+func (x *expression) set(attr string, v types.AttributeValue) {
+	x.sets = append(x.sets, x.name(attr)+" = "+x.value(v))
+}
+
+func (x *expression) add(attr string, v types.AttributeValue) {
+	x.adds = append(x.adds, x.name(attr)+" "+x.value(v))
+}
+
+func (x *expression) remove(attrs ...string) {
+	for _, attr := range attrs {
+		x.removes = append(x.removes, x.name(attr))
+	}
+}
+
+func (x *expression) updateExpression() *string {
+	clauses := make([]string, 0, 3)
+	if len(x.sets) > 0 {
+		clauses = append(clauses, "SET "+strings.Join(x.sets, ", "))
+	}
+	if len(x.adds) > 0 {
+		clauses = append(clauses, "ADD "+strings.Join(x.adds, ", "))
+	}
+	if len(x.removes) > 0 {
+		clauses = append(clauses, "REMOVE "+strings.Join(x.removes, ", "))
+	}
+	return aws.String(strings.Join(clauses, " "))
+}
+
+func (x *expression) conditionExpression() *string {
+	if x.condition == "" {
+		return nil
+	}
+	return aws.String(x.condition)
+}
+
+func attrS(v string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: v}
+}
+
+func attrN(v int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+}
+
+func attrB(v []byte) types.AttributeValue {
+	return &types.AttributeValueMemberB{Value: v}
+}
+
+// attrTime stores a time as the number of nanoseconds since the Unix epoch.
+func attrTime(t time.Time) types.AttributeValue {
+	return attrN(t.UnixNano())
+}
+
+func itemS(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func itemN(item map[string]types.AttributeValue, name string) int64 {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	}
+	return 0
+}
+
+func itemB(item map[string]types.AttributeValue, name string) []byte {
+	if v, ok := item[name].(*types.AttributeValueMemberB); ok {
+		return v.Value
+	}
+	return nil
+}
+
+func itemTime(item map[string]types.AttributeValue, name string) time.Time {
+	return time.Unix(0, itemN(item, name)).UTC()
+}
@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+)
+
+// Events raised by clients created with [WithOrderedEvents] are sent to the orchestration as generic events that
+// carry the ID of the client and a sequence number, which the orchestration worker turns back into regular events in
+// the order of their sequence numbers. The sequencing state of an orchestration, including the events that arrived
+// before the events that precede them, is recorded in the orchestration history as generic events, which
+// orchestrators ignore, so that every worker resumes sequencing from the same state.
+
+// orderedEventsBufferWindow is how long an event is buffered while waiting for the events that precede it.
+const orderedEventsBufferWindow = 5 * time.Second
+
+// orderedEvent is an event raised by a client created with [WithOrderedEvents].
+type orderedEvent struct {
+	Sender    string    `json:"sender"`
+	Sequence  int64     `json:"seq"`
+	Name      string    `json:"name"`
+	Input     *string   `json:"input,omitempty"`
+	ArrivedAt time.Time `json:"arrivedAt,omitempty"`
+}
+
+// orderedEventsState is the sequencing state of an orchestration.
+type orderedEventsState struct {
+	// Next is the next expected sequence number of each client.
+	Next map[string]int64 `json:"next"`
+
+	// Buffered are the events that arrived before the events that precede them.
+	Buffered []orderedEvent `json:"buffered,omitempty"`
+}
+
+// eventSequencer assigns monotonically increasing sequence numbers to the events raised by a client.
+type eventSequencer struct {
+	sender string
+	lock   sync.Mutex
+	next   map[api.InstanceID]int64
+}
+
+func newEventSequencer() *eventSequencer {
+	return &eventSequencer{sender: uuid.NewString(), next: make(map[api.InstanceID]int64)}
+}
+
+// sequence wraps the specified event raised event into an event that carries the next sequence number of the
+// orchestration instance.
+func (s *eventSequencer) sequence(id api.InstanceID, e *HistoryEvent) (*HistoryEvent, error) {
+	s.lock.Lock()
+	s.next[id]++
+	seq := s.next[id]
+	s.lock.Unlock()
+
+	raised := e.GetEventRaised()
+	oe := orderedEvent{Sender: s.sender, Sequence: seq, Name: raised.GetName()}
+	if raised.GetInput() != nil {
+		input := raised.GetInput().GetValue()
+		oe.Input = &input
+	}
+	bytes, err := json.Marshal(oe)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := helpers.NewGenericEvent(helpers.OrderedEventPrefix + string(bytes))
+	wrapped.Timestamp = e.Timestamp
+	return wrapped, nil
+}
+
+// getOrderedEvent returns the event carried by the specified event if it was created by [eventSequencer.sequence].
+func getOrderedEvent(e *HistoryEvent) (orderedEvent, bool) {
+	var oe orderedEvent
+	data := e.GetGenericEvent().GetData()
+	if !strings.HasPrefix(data, helpers.OrderedEventPrefix) {
+		return oe, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(data, helpers.OrderedEventPrefix)), &oe); err != nil {
+		return oe, false
+	}
+	return oe, true
+}
+
+func newOrderedEventsStateEvent(state *orderedEventsState) (*HistoryEvent, error) {
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return helpers.NewGenericEvent(helpers.OrderedEventsStatePrefix + string(bytes)), nil
+}
+
+// getOrderedEventsState returns the sequencing state recorded by the specified event if it was created by
+// [newOrderedEventsStateEvent].
+func getOrderedEventsState(e *HistoryEvent) (*orderedEventsState, bool) {
+	data := e.GetGenericEvent().GetData()
+	if !strings.HasPrefix(data, helpers.OrderedEventsStatePrefix) {
+		return nil, false
+	}
+	var state orderedEventsState
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(data, helpers.OrderedEventsStatePrefix)), &state); err != nil {
+		return nil, false
+	}
+	return &state, true
+}
+
+func isOrderedEventsFlushTimer(e *HistoryEvent) bool {
+	tf := e.GetTimerFired()
+	return tf != nil && tf.TimerId == orderedEventsFlushTimerID
+}
+
+// sequenceOrderedEvents returns the new events of a work item with the ordered events put in order, and records the
+// resulting sequencing state in the orchestration history. Ordered events that arrive early are buffered until the
+// events that precede them arrive, or until the buffering window expires, in which case the buffered events are
+// delivered in order and the missing sequence numbers are skipped.
+func (w *orchestratorProcessor) sequenceOrderedEvents(wi *OrchestrationWorkItem, now time.Time) []*HistoryEvent {
+	var state *orderedEventsState
+	events := make([]*HistoryEvent, 0, len(wi.NewEvents))
+	for _, e := range wi.NewEvents {
+		oe, ok := getOrderedEvent(e)
+		if !ok && !isOrderedEventsFlushTimer(e) {
+			events = append(events, e)
+			continue
+		}
+		if state == nil {
+			state = wi.State.orderedEventsState()
+		}
+		if !ok {
+			// The flush timer only wakes up the orchestration
+			continue
+		}
+
+		next := state.next(oe.Sender)
+		switch {
+		case oe.Sequence < next:
+			w.logger.Warnf("%v: delivering event '%s' #%d out of order because its buffering window expired", wi.InstanceID, oe.Name, oe.Sequence)
+			events = append(events, newRaisedEventFromOrderedEvent(oe, e.Timestamp))
+		case oe.Sequence == next:
+			events = append(events, newRaisedEventFromOrderedEvent(oe, e.Timestamp))
+			state.Next[oe.Sender] = oe.Sequence + 1
+			events = append(events, state.deliverBuffered(oe.Sender, false)...)
+		default:
+			w.logger.Debugf("%v: buffering event '%s' #%d until event #%d arrives", wi.InstanceID, oe.Name, oe.Sequence, next)
+			oe.ArrivedAt = now
+			state.Buffered = append(state.Buffered, oe)
+			wi.State.pendingTimers = append(wi.State.pendingTimers, helpers.NewTimerFiredEvent(
+				orderedEventsFlushTimerID, timestamppb.New(now.Add(orderedEventsBufferWindow)), nil))
+		}
+	}
+	if state == nil {
+		return events
+	}
+
+	// Deliver the events that waited for too long for the events that precede them
+	for _, sender := range state.expiredSenders(now) {
+		w.logger.Warnf("%v: skipping missing event #%d because its buffering window expired", wi.InstanceID, state.next(sender))
+		events = append(events, state.deliverBuffered(sender, true)...)
+	}
+
+	if e, err := newOrderedEventsStateEvent(state); err != nil {
+		w.logger.Warnf("%v: failed to record the event sequencing state: %v", wi.InstanceID, err)
+	} else {
+		_ = wi.State.AddEvent(e)
+	}
+	return events
+}
+
+// orderedEventsState returns a copy of the most recently recorded event sequencing state of the orchestration, or an
+// empty state if none was recorded.
+func (s *OrchestrationRuntimeState) orderedEventsState() *orderedEventsState {
+	state := &orderedEventsState{Next: make(map[string]int64)}
+	if s.orderedEvents != nil {
+		for sender, next := range s.orderedEvents.Next {
+			state.Next[sender] = next
+		}
+		state.Buffered = append(state.Buffered, s.orderedEvents.Buffered...)
+	}
+	return state
+}
+
+// next returns the next expected sequence number of the specified client.
+func (state *orderedEventsState) next(sender string) int64 {
+	if next, ok := state.Next[sender]; ok {
+		return next
+	}
+	return 1
+}
+
+// deliverBuffered removes the buffered events of the specified client that are next in sequence and returns them, in
+// order. If skipGaps is true, all the buffered events of the client are delivered, skipping missing sequence numbers.
+func (state *orderedEventsState) deliverBuffered(sender string, skipGaps bool) []*HistoryEvent {
+	var buffered, remaining []orderedEvent
+	for _, oe := range state.Buffered {
+		if oe.Sender == sender {
+			buffered = append(buffered, oe)
+		} else {
+			remaining = append(remaining, oe)
+		}
+	}
+	sort.Slice(buffered, func(i, j int) bool { return buffered[i].Sequence < buffered[j].Sequence })
+
+	var events []*HistoryEvent
+	for i, oe := range buffered {
+		if oe.Sequence < state.next(sender) {
+			// Duplicate of an event that was already delivered
+			continue
+		} else if oe.Sequence > state.next(sender) && !skipGaps {
+			remaining = append(remaining, buffered[i:]...)
+			break
+		}
+		events = append(events, newRaisedEventFromOrderedEvent(oe, timestamppb.New(oe.ArrivedAt)))
+		state.Next[sender] = oe.Sequence + 1
+	}
+	state.Buffered = remaining
+	return events
+}
+
+// expiredSenders returns the clients with buffered events that arrived more than the buffering window ago, sorted.
+func (state *orderedEventsState) expiredSenders(now time.Time) []string {
+	var senders []string
+	seen := make(map[string]bool)
+	for _, oe := range state.Buffered {
+		if !seen[oe.Sender] && !now.Before(oe.ArrivedAt.Add(orderedEventsBufferWindow)) {
+			seen[oe.Sender] = true
+			senders = append(senders, oe.Sender)
+		}
+	}
+	sort.Strings(senders)
+	return senders
+}
+
+func newRaisedEventFromOrderedEvent(oe orderedEvent, timestamp *timestamppb.Timestamp) *HistoryEvent {
+	var input *wrapperspb.StringValue
+	if oe.Input != nil {
+		input = wrapperspb.String(*oe.Input)
+	}
+	e := helpers.NewEventRaisedEvent(oe.Name, input)
+	if timestamp != nil {
+		e.Timestamp = timestamp
+	}
+	return e
+}
@@ -4,6 +4,7 @@ import (
 	context "context"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -50,6 +51,9 @@ type grpcExecutor struct {
 	logger               Logger
 	onWorkItemConnection func(context.Context) error
 	streamShutdownChan   <-chan any
+
+	capabilitiesLock *sync.Mutex
+	connected        []*ExecutorCapabilities // the capabilities of the open work item streams, oldest first
 }
 
 type grpcExecutorOptions func(g *grpcExecutor)
@@ -83,6 +87,7 @@ func NewGrpcExecutor(be Backend, logger Logger, opts ...grpcExecutorOptions) (ex
 		logger:               logger,
 		pendingOrchestrators: &sync.Map{},
 		pendingActivities:    &sync.Map{},
+		capabilitiesLock:     &sync.Mutex{},
 	}
 
 	for _, opt := range opts {
@@ -181,16 +186,75 @@ func (g *grpcExecutor) Shutdown(ctx context.Context) {
 	close(g.workItemQueue)
 }
 
+// Capabilities implements ExecutorCapabilitiesProvider. If several executors are connected, the capabilities of the
+// most recently connected one are returned.
+func (g *grpcExecutor) Capabilities() *ExecutorCapabilities {
+	g.capabilitiesLock.Lock()
+	defer g.capabilitiesLock.Unlock()
+
+	if len(g.connected) == 0 {
+		return nil
+	}
+	capabilities := *g.connected[len(g.connected)-1]
+	return &capabilities
+}
+
+func (g *grpcExecutor) addConnected(capabilities *ExecutorCapabilities) {
+	g.capabilitiesLock.Lock()
+	defer g.capabilitiesLock.Unlock()
+	g.connected = append(g.connected, capabilities)
+}
+
+func (g *grpcExecutor) removeConnected(capabilities *ExecutorCapabilities) {
+	g.capabilitiesLock.Lock()
+	defer g.capabilitiesLock.Unlock()
+	for i, c := range g.connected {
+		if c == capabilities {
+			g.connected = append(g.connected[:i], g.connected[i+1:]...)
+			return
+		}
+	}
+}
+
+// negotiate performs the server side of the executor handshake using the request metadata of the specified context.
+// It returns the negotiated capabilities and the header metadata to send back to the executor.
+func (g *grpcExecutor) negotiate(ctx context.Context) (*ExecutorCapabilities, metadata.MD, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	capabilities, err := negotiateExecutorCapabilities(md)
+	if err != nil {
+		g.logger.Warnf("rejecting executor with user-agent %v: %v", md.Get("user-agent"), err)
+		return nil, nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return capabilities, metadata.Pairs(protocolVersionMetadataKey, strconv.Itoa(capabilities.ProtocolVersion)), nil
+}
+
 // Hello implements protos.TaskHubSidecarServiceServer
-func (grpcExecutor) Hello(ctx context.Context, empty *emptypb.Empty) (*emptypb.Empty, error) {
+func (g *grpcExecutor) Hello(ctx context.Context, empty *emptypb.Empty) (*emptypb.Empty, error) {
+	_, header, err := g.negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpc.SetHeader(ctx, header); err != nil {
+		return nil, err
+	}
 	return empty, nil
 }
 
 // GetWorkItems implements protos.TaskHubSidecarServiceServer
 func (g *grpcExecutor) GetWorkItems(req *protos.GetWorkItemsRequest, stream protos.TaskHubSidecarService_GetWorkItemsServer) error {
+	capabilities, header, err := g.negotiate(stream.Context())
+	if err != nil {
+		return err
+	}
 	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
 		g.logger.Infof("work item stream established by user-agent: %v", md.Get("user-agent"))
 	}
+	if capabilities.Negotiated {
+		g.logger.Infof("negotiated protocol version %d with an executor that supports %d orchestrator(s) and %d activity(ies)",
+			capabilities.ProtocolVersion, len(capabilities.Orchestrators), len(capabilities.Activities))
+	} else {
+		g.logger.Infof("the executor doesn't support the handshake: using protocol version %d", capabilities.ProtocolVersion)
+	}
 
 	// There are some cases where the app may need to be notified when a client connects to fetch work items, like
 	// for auto-starting the worker. The app also has an opportunity to set itself as unavailable by returning an error.
@@ -203,6 +267,12 @@ func (g *grpcExecutor) GetWorkItems(req *protos.GetWorkItemsRequest, stream prot
 		}
 	}
 
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+	g.addConnected(capabilities)
+	defer g.removeConnected(capabilities)
+
 	// The worker client invokes this method, which streams back work-items as they arrive.
 	for {
 		select {
@@ -285,8 +355,36 @@ func (g *grpcExecutor) PurgeInstances(ctx context.Context, req *protos.PurgeInst
 }
 
 // QueryInstances implements protos.TaskHubSidecarServiceServer
-func (grpcExecutor) QueryInstances(context.Context, *protos.QueryInstancesRequest) (*protos.QueryInstancesResponse, error) {
-	return nil, errors.New("unimplemented")
+func (g *grpcExecutor) QueryInstances(ctx context.Context, req *protos.QueryInstancesRequest) (*protos.QueryInstancesResponse, error) {
+	q := req.GetQuery()
+	query := api.InstanceQuery{
+		RuntimeStatuses:   q.GetRuntimeStatus(),
+		InstanceIDPrefix:  q.GetInstanceIdPrefix().GetValue(),
+		PageSize:          int(q.GetMaxInstanceCount()),
+		ContinuationToken: q.GetContinuationToken().GetValue(),
+	}
+	if q.GetCreatedTimeFrom() != nil {
+		query.CreatedFrom = q.GetCreatedTimeFrom().AsTime()
+	}
+	if q.GetCreatedTimeTo() != nil {
+		query.CreatedTo = q.GetCreatedTimeTo().AsTime()
+	}
+
+	result, err := queryOrchestrationMetadata(ctx, g.backend, query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &protos.QueryInstancesResponse{
+		OrchestrationState: make([]*protos.OrchestrationState, 0, len(result.Instances)),
+	}
+	for _, metadata := range result.Instances {
+		resp.OrchestrationState = append(resp.OrchestrationState, createOrchestrationState(metadata, q.GetFetchInputsAndOutputs()))
+	}
+	if result.ContinuationToken != "" {
+		resp.ContinuationToken = wrapperspb.String(result.ContinuationToken)
+	}
+	return resp, nil
 }
 
 // RaiseEvent implements protos.TaskHubSidecarServiceServer
@@ -305,9 +403,19 @@ func (g *grpcExecutor) StartInstance(ctx context.Context, req *protos.CreateInst
 	ctx, span := helpers.StartNewCreateOrchestrationSpan(ctx, req.Name, req.Version.GetValue(), instanceID)
 	defer span.End()
 
-	e := helpers.NewExecutionStartedEvent(req.Name, instanceID, req.Input, nil, helpers.TraceContextFromSpan(span))
+	e := helpers.NewExecutionStartedEvent(req.Name, instanceID, req.Input, nil, helpers.TraceContextFromSpan(span), req.ScheduledStartTimestamp)
+	e.GetExecutionStarted().Version = req.Version
+	helpers.SetTags(e.GetExecutionStarted(), helpers.GetTags(req))
+	helpers.SetOrchestrationTimeout(e.GetExecutionStarted(), helpers.GetOrchestrationTimeout(req))
 	if err := g.backend.CreateOrchestrationInstance(ctx, e); err != nil {
-		return nil, err
+		if errors.Is(err, ErrDuplicateEvent) {
+			// Retries and the instance ID reuse policy of the request are handled like in the client
+			c := &backendClient{be: g.backend, options: &TaskHubClientOptions{}}
+			err = c.handleDuplicate(ctx, req, e, err)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &protos.CreateInstanceResponse{InstanceId: instanceID}, nil
@@ -403,20 +511,25 @@ func (grpcExecutor) mustEmbedUnimplementedTaskHubSidecarServiceServer() {
 }
 
 func createGetInstanceResponse(req *protos.GetInstanceRequest, metadata *api.OrchestrationMetadata) *protos.GetInstanceResponse {
+	state := createOrchestrationState(metadata, req.GetInputsAndOutputs)
+	state.InstanceId = req.InstanceId
+	return &protos.GetInstanceResponse{Exists: true, OrchestrationState: state}
+}
+
+func createOrchestrationState(metadata *api.OrchestrationMetadata, includeInputsAndOutputs bool) *protos.OrchestrationState {
 	state := &protos.OrchestrationState{
-		InstanceId:           req.InstanceId,
+		InstanceId:           string(metadata.InstanceID),
 		Name:                 metadata.Name,
 		OrchestrationStatus:  metadata.RuntimeStatus,
 		CreatedTimestamp:     timestamppb.New(metadata.CreatedAt),
 		LastUpdatedTimestamp: timestamppb.New(metadata.LastUpdatedAt),
 	}
 
-	if req.GetInputsAndOutputs {
+	if includeInputsAndOutputs {
 		state.Input = wrapperspb.String(metadata.SerializedInput)
 		state.CustomStatus = wrapperspb.String(metadata.SerializedCustomStatus)
 		state.Output = wrapperspb.String(metadata.SerializedOutput)
 		state.FailureDetails = metadata.FailureDetails
 	}
-
-	return &protos.GetInstanceResponse{Exists: true, OrchestrationState: state}
+	return state
 }
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+)
+
+// Injected faults are recorded in the orchestration history as generic events, which orchestrators ignore. A fault
+// is pending from the time its event is added to the history until a matching fault-applied event is added, so that
+// replaying the history always yields the same set of pending faults.
+
+// injectedFault is a fault that was injected into a specific orchestration using [TaskHubClient.InjectFault].
+type injectedFault struct {
+	ID string `json:"id"`
+	api.FaultSpec
+}
+
+func newFaultInjectedEvent(fault injectedFault) (*HistoryEvent, error) {
+	bytes, err := json.Marshal(fault)
+	if err != nil {
+		return nil, err
+	}
+	return helpers.NewGenericEvent(helpers.FaultInjectedEventPrefix + string(bytes)), nil
+}
+
+func newFaultAppliedEvent(id string) *HistoryEvent {
+	return helpers.NewGenericEvent(helpers.FaultAppliedEventPrefix + id)
+}
+
+// getInjectedFault returns the fault recorded by the specified event if it was created by [newFaultInjectedEvent].
+func getInjectedFault(e *HistoryEvent) (injectedFault, bool) {
+	var fault injectedFault
+	data := e.GetGenericEvent().GetData()
+	if !strings.HasPrefix(data, helpers.FaultInjectedEventPrefix) {
+		return fault, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(data, helpers.FaultInjectedEventPrefix)), &fault); err != nil {
+		return fault, false
+	}
+	return fault, true
+}
+
+// getAppliedFaultID returns the ID of the applied fault if the specified event was created by [newFaultAppliedEvent].
+func getAppliedFaultID(e *HistoryEvent) (string, bool) {
+	data := e.GetGenericEvent().GetData()
+	if !strings.HasPrefix(data, helpers.FaultAppliedEventPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(data, helpers.FaultAppliedEventPrefix), true
+}
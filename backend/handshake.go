@@ -0,0 +1,215 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Executors that connect to the gRPC executor, like the language SDKs, negotiate the version of the work item
+// protocol and the orchestrators and activities that they can execute in a handshake. The handshake is carried in the
+// metadata of the existing gRPC calls, so it doesn't require any changes to the service definition:
+//
+//  1. When it connects, the executor sends the protocol versions that it supports and the names of its orchestrators
+//     and activities as request metadata of the Hello call, and again of the GetWorkItems call.
+//  2. The gRPC executor picks the newest protocol version that both sides support and returns it in the response
+//     header metadata. If there's no such version, the call fails with a FailedPrecondition status that describes the
+//     versions supported by both sides, so that the executor can fail fast instead of waiting for work items.
+//  3. While the work item stream is open, the orchestration and activity workers only execute the work items of
+//     orchestrators and activities that the executor advertised. Other work items are left locked, so that they're
+//     retried after their lock expires, which gives a compatible executor time to connect.
+//
+// Executors that don't implement the handshake don't send any of this metadata. They're assumed to support protocol
+// version 1 and all orchestrators and activities, which is how the gRPC executor behaved before the handshake was
+// introduced. Likewise, an executor that doesn't advertise any orchestrator or activity names is assumed to support
+// all of them.
+const (
+	protocolVersionsMetadataKey = "durabletask-protocol-versions"
+	protocolVersionMetadataKey  = "durabletask-protocol-version"
+	orchestratorsMetadataKey    = "durabletask-orchestrators-bin"
+	activitiesMetadataKey       = "durabletask-activities-bin"
+)
+
+const (
+	// MinExecutorProtocolVersion is the oldest version of the work item protocol supported by the gRPC executor.
+	MinExecutorProtocolVersion = 1
+
+	// MaxExecutorProtocolVersion is the newest version of the work item protocol supported by the gRPC executor.
+	MaxExecutorProtocolVersion = 1
+)
+
+// ErrUnsupportedByExecutor is returned when processing a work item for an orchestrator or activity that the
+// connected executor didn't advertise during the handshake. Workers only fetch the work items that the executor
+// advertised from backends that implement [BackendWithOrchestrationFilters] and [BackendWithActivityFilters], so this
+// only happens with other backends, or when another executor connects while a work item is being fetched.
+var ErrUnsupportedByExecutor = errors.New("not supported by the connected executor")
+
+// ExecutorHandshake is what an executor advertises to the gRPC executor when it connects.
+type ExecutorHandshake struct {
+	// ProtocolVersions are the versions of the work item protocol supported by the executor.
+	ProtocolVersions []int
+
+	// Orchestrators are the names of the orchestrators that the executor can execute. A name of "*" matches all
+	// orchestrators.
+	Orchestrators []string
+
+	// Activities are the names of the activities that the executor can execute. A name of "*" matches all activities.
+	Activities []string
+}
+
+// AppendToOutgoingContext returns a context that sends the handshake as metadata of the gRPC calls made with it.
+func (h ExecutorHandshake) AppendToOutgoingContext(ctx context.Context) context.Context {
+	kv := make([]string, 0, 2*(len(h.ProtocolVersions)+len(h.Orchestrators)+len(h.Activities)))
+	for _, v := range h.ProtocolVersions {
+		kv = append(kv, protocolVersionsMetadataKey, strconv.Itoa(v))
+	}
+	for _, name := range h.Orchestrators {
+		kv = append(kv, orchestratorsMetadataKey, name)
+	}
+	for _, name := range h.Activities {
+		kv = append(kv, activitiesMetadataKey, name)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// NegotiatedProtocolVersion returns the protocol version from the response header metadata of a handshake, or
+// false if the gRPC executor doesn't implement the handshake.
+func NegotiatedProtocolVersion(header metadata.MD) (int, bool) {
+	values := header.Get(protocolVersionMetadataKey)
+	if len(values) == 0 {
+		return 0, false
+	}
+	v, err := strconv.Atoi(values[0])
+	return v, err == nil
+}
+
+// ExecutorCapabilities describes what the executor that's connected to the gRPC executor can do, as negotiated
+// during the handshake.
+type ExecutorCapabilities struct {
+	// ProtocolVersion is the negotiated version of the work item protocol.
+	ProtocolVersion int `json:"protocolVersion"`
+
+	// Negotiated is false if the executor doesn't implement the handshake, in which case it's assumed to support
+	// all orchestrators and activities.
+	Negotiated bool `json:"negotiated"`
+
+	// Orchestrators are the names of the orchestrators advertised by the executor, sorted, or nil if the executor
+	// didn't advertise any.
+	Orchestrators []string `json:"orchestrators"`
+
+	// Activities are the names of the activities advertised by the executor, sorted, or nil if the executor didn't
+	// advertise any.
+	Activities []string `json:"activities"`
+}
+
+// ExecutorCapabilitiesProvider is implemented by executors that negotiate their capabilities with the executor that
+// connects to them, like the gRPC executor returned by [NewGrpcExecutor].
+type ExecutorCapabilitiesProvider interface {
+	// Capabilities returns the capabilities of the connected executor, or nil if no executor is connected.
+	Capabilities() *ExecutorCapabilities
+}
+
+// SupportsOrchestrator returns true if the executor can execute the specified orchestrator.
+func (c *ExecutorCapabilities) SupportsOrchestrator(name string) bool {
+	return c == nil || supportsName(c.Orchestrators, name)
+}
+
+// SupportsActivity returns true if the executor can execute the specified activity.
+func (c *ExecutorCapabilities) SupportsActivity(name string) bool {
+	return c == nil || supportsName(c.Activities, name)
+}
+
+// orchestratorNames returns the names of the orchestrators whose work items the executor can process, or nil if it
+// can process the work items of all orchestrators.
+func (c *ExecutorCapabilities) orchestratorNames() []string {
+	if c == nil {
+		return nil
+	}
+	return supportedNames(c.Orchestrators)
+}
+
+// activityNames returns the names of the activities whose work items the executor can process, or nil if it can
+// process the work items of all activities.
+func (c *ExecutorCapabilities) activityNames() []string {
+	if c == nil {
+		return nil
+	}
+	return supportedNames(c.Activities)
+}
+
+func supportedNames(names []string) []string {
+	for _, n := range names {
+		if n == "*" {
+			return nil
+		}
+	}
+	return names
+}
+
+func supportsName(names []string, name string) bool {
+	if names == nil {
+		return true
+	}
+	for _, n := range names {
+		if n == name || n == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateExecutorCapabilities negotiates the capabilities of an executor from the request metadata of its
+// handshake.
+func negotiateExecutorCapabilities(md metadata.MD) (*ExecutorCapabilities, error) {
+	values := md.Get(protocolVersionsMetadataKey)
+	if len(values) == 0 {
+		return &ExecutorCapabilities{ProtocolVersion: MinExecutorProtocolVersion}, nil
+	}
+
+	negotiated := 0
+	versions := make([]int, 0, len(values))
+	for _, value := range values {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol version %q", value)
+		}
+		versions = append(versions, v)
+		if v >= MinExecutorProtocolVersion && v <= MaxExecutorProtocolVersion && v > negotiated {
+			negotiated = v
+		}
+	}
+	if negotiated == 0 {
+		return nil, fmt.Errorf(
+			"incompatible executor: the executor supports protocol versions %v, but this worker supports versions %d through %d",
+			versions, MinExecutorProtocolVersion, MaxExecutorProtocolVersion)
+	}
+
+	return &ExecutorCapabilities{
+		ProtocolVersion: negotiated,
+		Negotiated:      true,
+		Orchestrators:   sortedNames(md.Get(orchestratorsMetadataKey)),
+		Activities:      sortedNames(md.Get(activitiesMetadataKey)),
+	}, nil
+}
+
+func sortedNames(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// executorCapabilities returns the capabilities of the executor that's connected to the specified executor, or nil
+// if the executor doesn't negotiate capabilities.
+func executorCapabilities(executor any) *ExecutorCapabilities {
+	if p, ok := executor.(ExecutorCapabilitiesProvider); ok {
+		return p.Capabilities()
+	}
+	return nil
+}
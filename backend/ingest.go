@@ -0,0 +1,440 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// DefaultIngestWindowSize is the default maximum number of operations that an [IngestStream] has in flight.
+const DefaultIngestWindowSize = 100
+
+// ErrIngestStreamClosed is returned when sending an operation over an [IngestStream] that was already closed.
+var ErrIngestStreamClosed = errors.New("the ingest stream is closed")
+
+// IngestOperation is an operation that's sent to the backend in a batch by [IngestOperations].
+type IngestOperation struct {
+	// InstanceID is the ID of the orchestration instance that the operation applies to.
+	InstanceID api.InstanceID
+
+	// Event is either an ExecutionStarted event, which creates the orchestration instance, or an event that's added
+	// to the existing orchestration instance.
+	Event *HistoryEvent
+}
+
+// IngestOperations applies a batch of operations to the specified backend, in a single round trip if the backend
+// implements [BackendWithIngest], or else one at a time, with [Backend.CreateOrchestrationInstance] for operations
+// with an ExecutionStarted event and [Backend.AddNewOrchestrationEvent] for the others. The results are those of
+// [BackendWithIngest.IngestOperations], except that operations that are applied one at a time are committed
+// independently, so the second return value is always nil for backends that don't implement [BackendWithIngest].
+func IngestOperations(ctx context.Context, be Backend, ops []*IngestOperation) ([]error, error) {
+	if ingester, ok := As[BackendWithIngest](be); ok {
+		return ingester.IngestOperations(ctx, ops)
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// IngestRequest is an operation that's sent over an [IngestStream]. Use [IngestCreateOrchestration] and
+// [IngestRaiseEvent] to create requests.
+type IngestRequest struct {
+	create *protos.CreateInstanceRequest
+	raise  *protos.RaiseEventRequest
+	err    error
+}
+
+// IngestCreateOrchestration returns a request that schedules a new orchestration instance, like
+// [TaskHubClient.ScheduleNewOrchestration] does.
+func IngestCreateOrchestration(orchestrator interface{}, opts ...api.NewOrchestrationOptions) *IngestRequest {
+	req := &protos.CreateInstanceRequest{Name: helpers.GetTaskFunctionName(orchestrator)}
+	for _, configure := range opts {
+		if err := configure(req); err != nil {
+			return &IngestRequest{create: req, err: fmt.Errorf("failed to configure create instance request: %w", err)}
+		}
+	}
+	if req.InstanceId == "" {
+		req.InstanceId = uuid.NewString()
+	}
+	return &IngestRequest{create: req}
+}
+
+// IngestRaiseEvent returns a request that raises an event on an orchestration instance, like
+// [TaskHubClient.RaiseEvent] does.
+func IngestRaiseEvent(id api.InstanceID, eventName string, opts ...api.RaiseEventOptions) *IngestRequest {
+	req := &protos.RaiseEventRequest{InstanceId: string(id), Name: eventName}
+	for _, configure := range opts {
+		if err := configure(req); err != nil {
+			return &IngestRequest{raise: req, err: fmt.Errorf("failed to configure raise event request: %w", err)}
+		}
+	}
+	return &IngestRequest{raise: req}
+}
+
+// IngestResult is the result of an operation that was sent over an [IngestStream].
+type IngestResult struct {
+	// InstanceID is the ID of the orchestration instance that the operation applied to, including the generated ID
+	// of orchestrations that were scheduled without one.
+	InstanceID api.InstanceID
+
+	// Err is nil if the operation was committed by the backend.
+	Err error
+}
+
+// IngestStreamOptions configures the flow control of an [IngestStream].
+type IngestStreamOptions struct {
+	// WindowSize is the maximum number of operations that were sent but not yet committed or failed by the backend.
+	// It's also the maximum number of operations that are sent to the backend in a single batch.
+	WindowSize int
+}
+
+type NewIngestStreamOptions func(*IngestStreamOptions)
+
+// WithIngestWindowSize sets the maximum number of operations that an [IngestStream] has in flight. Larger windows
+// allow larger batches, and therefore higher throughput, at the cost of more operations that must be retried if the
+// process fails. The default is [DefaultIngestWindowSize].
+func WithIngestWindowSize(size int) NewIngestStreamOptions {
+	return func(o *IngestStreamOptions) {
+		o.WindowSize = size
+	}
+}
+
+// IngestStream pipelines the creation of orchestration instances and the raising of events to the backend, for
+// high-throughput ingestion. Operations are sent to the backend in batches using [IngestOperations], in the
+// order in which they were sent over the stream.
+//
+// Flow control: at most WindowSize operations are in flight at any time. An operation is in flight from the moment
+// it's sent until the backend commits or fails it. When the window is full, [IngestStream.Send] blocks until the
+// backend completes a batch, which applies backpressure to the sender.
+//
+// Durability: an operation is committed, and survives process failures, only once its result reports no error.
+// Returning from [IngestStream.Send] only means that the operation was accepted into the window. Operations that
+// were in flight when the process failed may or may not have been committed, so ingestion should be resumed with
+// explicit instance IDs, which makes repeated create operations fail with [ErrDuplicateEvent] instead of creating
+// duplicate orchestrations.
+//
+// An IngestStream is safe for concurrent use, but the relative order of operations sent concurrently is undefined.
+type IngestStream struct {
+	c      *backendClient
+	ctx    context.Context
+	window chan struct{} // one element per operation in flight
+	queue  chan *pendingIngest
+	done   chan struct{}
+
+	lock    sync.Mutex
+	closed  bool
+	results []IngestResult
+	err     error
+}
+
+// pendingIngest is an operation that was sent over an [IngestStream] but wasn't yet committed or failed.
+type pendingIngest struct {
+	index  int
+	op     *IngestOperation
+	create *protos.CreateInstanceRequest // nil for events
+	span   trace.Span                    // nil for events
+}
+
+// NewIngestStream opens a stream for the high-throughput creation of orchestration instances and raising of events.
+// The stream must be closed with [IngestStream.CloseAndRecv]. Cancelling the specified context fails the operations
+// that weren't committed yet.
+func (c *backendClient) NewIngestStream(ctx context.Context, opts ...NewIngestStreamOptions) (*IngestStream, error) {
+	options := &IngestStreamOptions{WindowSize: DefaultIngestWindowSize}
+	for _, configure := range opts {
+		configure(options)
+	}
+	if options.WindowSize <= 0 {
+		return nil, fmt.Errorf("invalid ingest window size %d", options.WindowSize)
+	}
+
+	s := &IngestStream{
+		c:      c,
+		ctx:    ctx,
+		window: make(chan struct{}, options.WindowSize),
+		queue:  make(chan *pendingIngest, options.WindowSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send sends an operation over the stream, blocking while the window is full. The operation isn't committed when
+// Send returns; its result is returned by [IngestStream.CloseAndRecv].
+//
+// Requests that are invalid, or that schedule orchestrations that aren't known to the client, are rejected by
+// returning an error, and don't produce a result.
+func (s *IngestStream) Send(req *IngestRequest) error {
+	if req.err != nil {
+		if req.create != nil {
+			s.c.reportScheduleError(req.create, req.err)
+		}
+		return req.err
+	}
+
+	var p *pendingIngest
+	if req.create != nil {
+		var err error
+		if p, err = s.c.newPendingCreate(s.ctx, req.create); err != nil {
+			return err
+		}
+	} else {
+		id := api.InstanceID(req.raise.InstanceId)
+		e, err := s.c.newEventRaisedEvent(id, req.raise)
+		if err != nil {
+			return err
+		}
+		p = &pendingIngest{op: &IngestOperation{InstanceID: id, Event: e}}
+	}
+
+	// Wait for room in the window
+	select {
+	case s.window <- struct{}{}:
+	case <-s.ctx.Done():
+		p.end(s.ctx.Err())
+		return s.ctx.Err()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		<-s.window
+		p.end(ErrIngestStreamClosed)
+		return ErrIngestStreamClosed
+	}
+	p.index = len(s.results)
+	s.results = append(s.results, IngestResult{InstanceID: p.op.InstanceID})
+	// The queue has room for the whole window, so this never blocks
+	s.queue <- p
+	return nil
+}
+
+// CloseAndRecv closes the stream, waits for all the operations that are in flight, and returns the results of all
+// the operations that were sent over the stream, in the order in which they were sent. The returned error is the
+// first error that failed a whole batch of operations, like the cancellation of the context of the stream, in which
+// case the results tell which operations were committed.
+func (s *IngestStream) CloseAndRecv() ([]IngestResult, error) {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+
+	<-s.done
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]IngestResult{}, s.results...), s.err
+}
+
+// run sends the queued operations to the backend in batches until the stream is closed.
+func (s *IngestStream) run() {
+	defer close(s.done)
+	for p := range s.queue {
+		batch := []*pendingIngest{p}
+	drain:
+		for len(batch) < cap(s.queue) {
+			select {
+			case p, ok := <-s.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, p)
+			default:
+				break drain
+			}
+		}
+		s.flush(batch)
+	}
+}
+
+// flush sends a batch of operations to the backend, records their results, and releases their room in the window.
+func (s *IngestStream) flush(batch []*pendingIngest) {
+	ops := make([]*IngestOperation, len(batch))
+	for i, p := range batch {
+		ops[i] = p.op
+	}
+
+	errs, err := IngestOperations(s.ctx, s.c.be, ops)
+	if err == nil && len(errs) != len(ops) {
+		err = fmt.Errorf("the backend returned %d results for %d operations", len(errs), len(ops))
+	}
+
+	results := make([]error, len(batch))
+	for i, p := range batch {
+		opErr := err
+		if opErr == nil {
+			opErr = errs[i]
+		}
+		results[i] = s.c.completePendingIngest(s.ctx, p, opErr)
+	}
+
+	s.lock.Lock()
+	for i, p := range batch {
+		s.results[p.index].Err = results[i]
+	}
+	if err != nil && s.err == nil {
+		s.err = fmt.Errorf("failed to ingest a batch of %d operations: %w", len(ops), err)
+	}
+	s.lock.Unlock()
+
+	for range batch {
+		<-s.window
+	}
+}
+
+// NewOrchestrationRequest is an orchestration that's scheduled by [TaskHubClient.ScheduleNewOrchestrations].
+type NewOrchestrationRequest struct {
+	// Orchestrator is the orchestrator function or the name of the orchestrator, like the orchestrator that's
+	// passed to [TaskHubClient.ScheduleNewOrchestration].
+	Orchestrator interface{}
+
+	// Options configure the orchestration, e.g. its instance ID and input.
+	Options []api.NewOrchestrationOptions
+}
+
+// ScheduleBatchError is returned by [TaskHubClient.ScheduleNewOrchestrations] when some of the orchestrations
+// couldn't be scheduled.
+type ScheduleBatchError struct {
+	// Errors contains the error of each orchestration that couldn't be scheduled, by its index in the batch.
+	Errors map[int]error
+}
+
+func (e *ScheduleBatchError) Error() string {
+	return fmt.Sprintf("failed to schedule %d orchestration(s)", len(e.Errors))
+}
+
+// ScheduleNewOrchestrations schedules a batch of orchestrations in a single round trip to the backend, using
+// [IngestOperations], which is much faster than scheduling them one by one when fanning out bulk jobs.
+// Backends typically create all the orchestrations of the batch in a single transaction. Very large batches, e.g.
+// more than a few thousand orchestrations, should be split, or scheduled using [TaskHubClient.NewIngestStream].
+//
+// The instance IDs of the scheduled orchestrations are returned in the order of the requests. If only some of the
+// orchestrations can be scheduled, the IDs of the others are empty, and the returned error wraps a
+// [*ScheduleBatchError], which contains the error of each orchestration that failed, such as [ErrDuplicateEvent].
+func (c *backendClient) ScheduleNewOrchestrations(ctx context.Context, reqs []NewOrchestrationRequest) ([]api.InstanceID, error) {
+	ids := make([]api.InstanceID, len(reqs))
+	batchErr := &ScheduleBatchError{Errors: make(map[int]error)}
+
+	batch := make([]*pendingIngest, 0, len(reqs))
+	for i, r := range reqs {
+		req := IngestCreateOrchestration(r.Orchestrator, r.Options...)
+		if req.err != nil {
+			c.reportScheduleError(req.create, req.err)
+			batchErr.Errors[i] = req.err
+			continue
+		}
+		p, err := c.newPendingCreate(ctx, req.create)
+		if err != nil {
+			batchErr.Errors[i] = err
+			continue
+		}
+		p.index = i
+		batch = append(batch, p)
+	}
+
+	if len(batch) > 0 {
+		ops := make([]*IngestOperation, len(batch))
+		for i, p := range batch {
+			ops[i] = p.op
+		}
+
+		errs, err := IngestOperations(ctx, c.be, ops)
+		if err == nil && len(errs) != len(ops) {
+			err = fmt.Errorf("the backend returned %d results for %d operations", len(errs), len(ops))
+		}
+		if err != nil {
+			for _, p := range batch {
+				p.end(err)
+			}
+			return nil, fmt.Errorf("failed to start orchestrations: %w", err)
+		}
+
+		for i, p := range batch {
+			if err := c.completePendingIngest(ctx, p, errs[i]); err != nil {
+				batchErr.Errors[p.index] = err
+			} else {
+				ids[p.index] = p.op.InstanceID
+			}
+		}
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return ids, batchErr
+	}
+	return ids, nil
+}
+
+// newPendingCreate validates a request to create an orchestration instance and returns the operation that creates it.
+func (c *backendClient) newPendingCreate(ctx context.Context, req *protos.CreateInstanceRequest) (*pendingIngest, error) {
+	if err := c.validateOrchestrationName(ctx, req.Name); err != nil {
+		c.reportScheduleError(req, err)
+		return nil, err
+	}
+	if err := c.options.CircuitBreaker.allow(req.Name); err != nil {
+		c.reportScheduleError(req, err)
+		return nil, err
+	}
+	if err := c.checkNamespaceQuota(ctx, req); err != nil {
+		c.reportScheduleError(req, err)
+		return nil, err
+	}
+
+	p := &pendingIngest{create: req}
+	_, p.span = helpers.StartNewCreateOrchestrationSpan(ctx, req.Name, req.Version.GetValue(), req.InstanceId)
+	tc := helpers.TraceContextFromSpan(p.span)
+	p.op = &IngestOperation{
+		InstanceID: api.InstanceID(req.InstanceId),
+		Event:      helpers.NewExecutionStartedEvent(req.Name, req.InstanceId, req.Input, nil, tc, req.ScheduledStartTimestamp),
+	}
+	p.op.Event.GetExecutionStarted().Version = req.Version
+	helpers.SetTags(p.op.Event.GetExecutionStarted(), helpers.GetTags(req))
+	helpers.SetOrchestrationTimeout(p.op.Event.GetExecutionStarted(), helpers.GetOrchestrationTimeout(req))
+	return p, nil
+}
+
+// completePendingIngest handles the result of an operation that was committed or failed by the backend, and returns
+// the error of the operation, if any.
+func (c *backendClient) completePendingIngest(ctx context.Context, p *pendingIngest, err error) error {
+	if p.create != nil && errors.Is(err, ErrDuplicateEvent) {
+		err = c.handleDuplicate(ctx, p.create, p.op.Event, err)
+	}
+	if err != nil {
+		if p.create != nil {
+			err = fmt.Errorf("failed to start orchestration: %w", err)
+			c.reportScheduleError(p.create, err)
+		} else {
+			err = fmt.Errorf("failed to raise event: %w", err)
+		}
+	}
+	p.end(err)
+	return err
+}
+
+// end ends the tracing span of the operation, if any.
+func (p *pendingIngest) end(err error) {
+	if p.span == nil {
+		return
+	}
+	if err != nil {
+		p.span.RecordError(err)
+		p.span.SetStatus(codes.Error, err.Error())
+	}
+	p.span.End()
+}
@@ -0,0 +1,1473 @@
+package inmem
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+type InMemoryOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+}
+
+type inMemoryBackend struct {
+	lock       sync.Mutex
+	store      *store
+	workerName string
+	logger     backend.Logger
+	options    *InMemoryOptions
+
+	// changed is closed and replaced whenever the metadata of an orchestration changes, to wake up watchers
+	changed chan struct{}
+}
+
+// store contains the state of a task hub.
+type store struct {
+	instances map[string]*instance
+
+	// events and tasks are in sequence number order, so that work items are processed in FIFO order
+	events []*pendingEvent
+	tasks  []*pendingTask
+
+	nextSequenceNumber int64
+
+	// deadLetters are in the order in which they were added
+	deadLetters      []*backend.DeadLetter
+	nextDeadLetterID int64
+}
+
+type instance struct {
+	id               string
+	name             string
+	version          string
+	executionID      string
+	runtimeStatus    protos.OrchestrationStatus
+	createdTime      time.Time
+	lastUpdatedTime  time.Time
+	completedTime    time.Time
+	input            string
+	output           string
+	customStatus     string
+	failureDetails   *protos.TaskFailureDetails
+	parentInstanceID string
+	generationCount  int
+	tags             map[string]string
+	history          []*backend.HistoryEvent
+	lastActions      []*protos.OrchestratorAction
+	lockedBy         string
+	lockExpiration   time.Time
+}
+
+type pendingEvent struct {
+	sequenceNumber int64
+	instanceID     string
+	event          *backend.HistoryEvent
+	visibleTime    time.Time // zero if the event is visible immediately
+	dequeueCount   int32
+	lockedBy       string
+}
+
+type pendingTask struct {
+	sequenceNumber int64
+	instanceID     string
+	event          *backend.HistoryEvent
+	dequeueCount   int32
+	lockedBy       string
+	lockExpiration time.Time
+}
+
+// NewInMemoryOptions creates a new options object for the in-memory backend provider.
+func NewInMemoryOptions() *InMemoryOptions {
+	// Default values are provided for required options
+	return &InMemoryOptions{
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+	}
+}
+
+// NewInMemoryBackend creates a new Backend object that keeps all of its state in memory.
+//
+// The backend is intended for tests and demos. Its state is lost when the process exits, and it can't be shared
+// by multiple processes. Work items are processed in the order in which they were created, and query results are
+// ordered by creation time and instance ID, so that tests behave deterministically. The backend is safe for
+// concurrent use by multiple workers and clients.
+func NewInMemoryBackend(opts *InMemoryOptions, logger backend.Logger) backend.Backend {
+	if opts == nil {
+		opts = NewInMemoryOptions()
+	}
+
+	return &inMemoryBackend{
+		workerName: "inmem",
+		options:    opts,
+		logger:     logger,
+		changed:    make(chan struct{}),
+	}
+}
+
+// CreateTaskHub implements backend.Backend
+func (be *inMemoryBackend) CreateTaskHub(context.Context) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if be.store != nil {
+		return backend.ErrTaskHubExists
+	}
+	be.store = &store{instances: make(map[string]*instance)}
+	return nil
+}
+
+// DeleteTaskHub implements backend.Backend
+func (be *inMemoryBackend) DeleteTaskHub(context.Context) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if be.store == nil {
+		return backend.ErrTaskHubNotFound
+	}
+	be.store = nil
+	be.notifyChanged()
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *inMemoryBackend) CreateOrchestrationInstance(_ context.Context, e *backend.HistoryEvent) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	return be.store.createInstance(e)
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *inMemoryBackend) AddNewOrchestrationEvent(_ context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	be.store.addEvent(string(iid), e, time.Time{})
+	return nil
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *inMemoryBackend) AddNewOrchestrationEventIf(_ context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if err := validateEvent(e); err != nil {
+		return err
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	inst, ok := be.store.instances[string(iid)]
+	if !ok {
+		return api.ErrInstanceNotFound
+	}
+	for _, status := range statuses {
+		if inst.runtimeStatus == status {
+			be.store.addEvent(string(iid), e, time.Time{})
+			return nil
+		}
+	}
+	return api.ErrPreconditionFailed
+}
+
+// IngestOperations implements backend.BackendWithIngest
+func (be *inMemoryBackend) IngestOperations(_ context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.store.createInstance(op.Event)
+		} else if errs[i] = validateEvent(op.Event); errs[i] == nil {
+			be.store.addEvent(string(op.InstanceID), op.Event, time.Time{})
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *inMemoryBackend) GetOrchestrationWorkItem(context.Context) (*backend.OrchestrationWorkItem, error) {
+	return be.getOrchestrationWorkItem(backend.OrchestrationWorkItemFilter{})
+}
+
+// GetOrchestrationWorkItemWithFilter implements backend.BackendWithOrchestrationFilters
+func (be *inMemoryBackend) GetOrchestrationWorkItemWithFilter(_ context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	if filter.Names != nil && len(filter.Names) == 0 {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getOrchestrationWorkItem(filter)
+}
+
+// getOrchestrationWorkItem locks an orchestration instance that matches the filter and has visible events.
+func (be *inMemoryBackend) getOrchestrationWorkItem(filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	// Lock the instance of the oldest visible event that can be processed. Instances that haven't started yet and
+	// still have invisible events are waiting for their scheduled start time, so events raised to them in the
+	// meantime must wait as well.
+	var inst *instance
+	for _, e := range be.store.events {
+		if !e.isVisible(now) {
+			continue
+		}
+		candidate, ok := be.store.instances[e.instanceID]
+		if !ok || candidate.isLocked(now) {
+			continue
+		}
+		if filter.Names != nil && !containsString(filter.Names, candidate.name) {
+			continue
+		}
+		if len(candidate.history) == 0 && be.store.hasInvisibleEvents(candidate.id, now) {
+			continue
+		}
+		inst = candidate
+		break
+	}
+	if inst == nil {
+		// No new events to process
+		return nil, backend.ErrNoWorkItems
+	}
+
+	inst.lockedBy = be.workerName
+	inst.lockExpiration = now.Add(be.options.OrchestrationLockTimeout)
+
+	// TODO: Get all the unprocessed events associated with the locked instance
+	maxDequeueCount := int32(0)
+	newEvents := make([]*protos.HistoryEvent, 0, 10)
+	for _, e := range be.store.events {
+		if e.instanceID != inst.id || !e.isVisible(now) {
+			continue
+		}
+		e.dequeueCount++
+		e.lockedBy = be.workerName
+		if e.dequeueCount > maxDequeueCount {
+			maxDequeueCount = e.dequeueCount
+		}
+		newEvents = append(newEvents, cloneEvent(e.event))
+		if len(newEvents) == 1000 {
+			break
+		}
+	}
+
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: api.InstanceID(inst.id),
+		NewEvents:  newEvents,
+		LockedBy:   be.workerName,
+		RetryCount: maxDequeueCount - 1,
+
+		NextSequenceNumber: len(inst.history),
+	}
+	return wi, nil
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *inMemoryBackend) GetOrchestrationRuntimeState(_ context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var existingEvents []*protos.HistoryEvent
+	if inst, ok := be.store.instances[string(wi.InstanceID)]; ok {
+		existingEvents = cloneEvents(inst.history)
+	} else {
+		existingEvents = make([]*protos.HistoryEvent, 0)
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *inMemoryBackend) GetOrchestrationMetadata(_ context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	inst, ok := be.store.instances[string(iid)]
+	if !ok {
+		return nil, api.ErrInstanceNotFound
+	}
+	return inst.metadata(), nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *inMemoryBackend) CompleteOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	// All the checks are done before the first update, so that a failed completion doesn't change anything
+	inst, ok := be.store.instances[string(wi.InstanceID)]
+	if !ok || inst.lockedBy != wi.LockedBy || !be.store.hasLockedEvents(inst.id, wi.LockedBy) {
+		return backend.ErrWorkItemLockLost
+	}
+
+	var failureDetails *protos.TaskFailureDetails
+	var lastActions []*protos.OrchestratorAction
+	for _, e := range wi.State.NewEvents() {
+		if ec := e.GetExecutionCompleted(); ec != nil && ec.FailureDetails != nil {
+			failureDetails = proto.Clone(ec.FailureDetails).(*protos.TaskFailureDetails)
+			break
+		}
+	}
+	if wi.State.LastActions != nil {
+		lastActions = make([]*protos.OrchestratorAction, 0, len(wi.State.LastActions))
+		for _, a := range wi.State.LastActions {
+			lastActions = append(lastActions, proto.Clone(a).(*protos.OrchestratorAction))
+		}
+	}
+	for _, msg := range wi.State.PendingMessages() {
+		if err := validateEvent(msg.HistoryEvent); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	isCreated := false
+	isCompleted := false
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if isCreated {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			isCreated = true
+			inst.createdTime = e.Timestamp.AsTime()
+			inst.input = es.Input.GetValue()
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			inst.completedTime = now
+			inst.output = ec.Result.GetValue()
+			inst.failureDetails = failureDetails
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		inst.customStatus = wi.State.CustomStatus.Value
+	}
+	inst.generationCount += wi.State.ContinuedAsNewCount()
+
+	// TODO: Support for stickiness, which would extend the LockExpiration
+	inst.runtimeStatus = wi.State.RuntimeStatus()
+	inst.lastUpdatedTime = now
+	inst.lockedBy = ""
+	inst.lockExpiration = time.Time{}
+
+	// If continue-as-new, delete all existing history
+	if wi.State.ContinuedAsNew() {
+		inst.history = nil
+	}
+
+	// Save the actions from the most recent execution, if requested
+	if lastActions != nil {
+		inst.lastActions = lastActions
+	}
+
+	// Save new history events
+	inst.history = append(inst.history, cloneEvents(wi.State.NewEvents())...)
+
+	// Save outbound activity tasks
+	for _, e := range wi.State.PendingTasks() {
+		be.store.addTask(inst.id, e)
+	}
+
+	// Save outbound orchestrator events
+	for _, e := range wi.State.PendingTimers() {
+		be.store.addEvent(inst.id, e, e.GetTimerFired().GetFireAt().AsTime())
+	}
+
+	for _, msg := range wi.State.PendingMessages() {
+		if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+			// Need to create a new instance
+			if err := be.store.createInstance(msg.HistoryEvent); err == backend.ErrDuplicateEvent {
+				be.logger.Warnf(
+					"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+					wi.InstanceID,
+					es.OrchestrationInstance.InstanceId)
+			}
+			continue
+		}
+
+		be.store.addEvent(msg.TargetInstanceID, msg.HistoryEvent, time.Time{})
+	}
+
+	// Delete inbound events
+	be.store.removeEvents(func(e *pendingEvent) bool {
+		return e.instanceID == inst.id && e.lockedBy == wi.LockedBy
+	})
+	be.notifyChanged()
+	return nil
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *inMemoryBackend) AbandonOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	return be.releaseOrchestrationWorkItem(wi, false, 0)
+}
+
+// DeferOrchestrationWorkItem implements backend.BackendWithDeferrals
+func (be *inMemoryBackend) DeferOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem, delay time.Duration) error {
+	return be.releaseOrchestrationWorkItem(wi, true, delay)
+}
+
+// releaseOrchestrationWorkItem unlocks an orchestration work item. The new events of abandoned work items become
+// visible again after the abandon delay of the work item, while those of deferred work items become visible again
+// after the specified delay, and their delivery isn't counted.
+func (be *inMemoryBackend) releaseOrchestrationWorkItem(wi *backend.OrchestrationWorkItem, deferred bool, delay time.Duration) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	inst, ok := be.store.instances[string(wi.InstanceID)]
+	if !ok || inst.lockedBy != wi.LockedBy || !be.store.hasLockedEvents(inst.id, wi.LockedBy) {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if !deferred {
+		delay = wi.GetAbandonDelay()
+	}
+	var visibleTime time.Time
+	if delay > 0 {
+		visibleTime = time.Now().UTC().Add(delay)
+	}
+
+	for _, e := range be.store.events {
+		if e.instanceID == inst.id && e.lockedBy == wi.LockedBy {
+			e.lockedBy = ""
+			e.visibleTime = visibleTime
+			if deferred {
+				e.dequeueCount--
+			}
+		}
+	}
+	inst.lockedBy = ""
+	inst.lockExpiration = time.Time{}
+	return nil
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *inMemoryBackend) RenewOrchestrationWorkItemLock(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	inst, ok := be.store.instances[string(wi.InstanceID)]
+	if !ok || inst.lockedBy != wi.LockedBy {
+		return backend.ErrWorkItemLockLost
+	}
+
+	inst.lockExpiration = time.Now().UTC().Add(be.options.OrchestrationLockTimeout)
+	return nil
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *inMemoryBackend) GetActivityWorkItem(context.Context) (*backend.ActivityWorkItem, error) {
+	wis, err := be.getActivityWorkItems(backend.ActivityWorkItemFilter{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	return wis[0], nil
+}
+
+// GetActivityWorkItems implements backend.BackendWithActivityBatches
+func (be *inMemoryBackend) GetActivityWorkItems(_ context.Context, max int) ([]*backend.ActivityWorkItem, error) {
+	return be.getActivityWorkItems(backend.ActivityWorkItemFilter{}, max)
+}
+
+// GetActivityWorkItemsFromQueues implements backend.BackendWithActivityQueues
+func (be *inMemoryBackend) GetActivityWorkItemsFromQueues(_ context.Context, queues []string, max int) ([]*backend.ActivityWorkItem, error) {
+	if len(queues) == 0 {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getActivityWorkItems(backend.ActivityWorkItemFilter{Queues: queues}, max)
+}
+
+// GetActivityWorkItemsWithFilter implements backend.BackendWithActivityFilters
+func (be *inMemoryBackend) GetActivityWorkItemsWithFilter(_ context.Context, filter backend.ActivityWorkItemFilter, max int) ([]*backend.ActivityWorkItem, error) {
+	if (filter.Queues != nil && len(filter.Queues) == 0) || (filter.Names != nil && len(filter.Names) == 0) {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getActivityWorkItems(filter, max)
+}
+
+// getActivityWorkItems locks up to max activity work items that match the filter.
+func (be *inMemoryBackend) getActivityWorkItems(filter backend.ActivityWorkItemFilter, max int) ([]*backend.ActivityWorkItem, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var wis []*backend.ActivityWorkItem
+	now := time.Now().UTC()
+	for _, t := range be.store.tasks {
+		if len(wis) >= max {
+			break
+		}
+		if !t.lockExpiration.IsZero() && !t.lockExpiration.Before(now) {
+			continue
+		}
+		if filter.Queues != nil && !containsString(filter.Queues, helpers.GetActivityQueue(t.event.GetTaskScheduled())) {
+			continue
+		}
+		if filter.Names != nil && !containsString(filter.Names, t.event.GetTaskScheduled().GetName()) {
+			continue
+		}
+		if containsString(filter.ExcludedNames, t.event.GetTaskScheduled().GetName()) {
+			continue
+		}
+
+		t.lockedBy = be.workerName
+		t.lockExpiration = now.Add(be.options.ActivityLockTimeout)
+		t.dequeueCount++
+
+		wis = append(wis, &backend.ActivityWorkItem{
+			SequenceNumber: t.sequenceNumber,
+			InstanceID:     api.InstanceID(t.instanceID),
+			NewEvent:       cloneEvent(t.event),
+			LockedBy:       be.workerName,
+			RetryCount:     t.dequeueCount - 1,
+		})
+	}
+
+	if len(wis) == 0 {
+		// No new activity tasks to process
+		return nil, backend.ErrNoWorkItems
+	}
+	return wis, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *inMemoryBackend) CompleteActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	t := be.store.lockedTask(wi.SequenceNumber, wi.LockedBy)
+	if t == nil {
+		return backend.ErrWorkItemLockLost
+	}
+
+	be.store.addEvent(string(wi.InstanceID), wi.Result, time.Time{})
+	be.store.removeTasks(func(other *pendingTask) bool { return other == t })
+	return nil
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *inMemoryBackend) AbandonActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	t := be.store.lockedTask(wi.SequenceNumber, wi.LockedBy)
+	if t == nil {
+		return backend.ErrWorkItemLockLost
+	}
+
+	t.lockedBy = ""
+	t.lockExpiration = time.Time{}
+	return nil
+}
+
+// DeferActivityWorkItem implements backend.BackendWithDeferrals
+func (be *inMemoryBackend) DeferActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem, delay time.Duration) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	t := be.store.lockedTask(wi.SequenceNumber, wi.LockedBy)
+	if t == nil {
+		return backend.ErrWorkItemLockLost
+	}
+
+	// The task isn't fetched again until its lock expiration, which is set to the end of the delay
+	t.lockedBy = ""
+	t.lockExpiration = time.Now().UTC().Add(delay)
+	t.dequeueCount--
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *inMemoryBackend) RenewActivityWorkItemLock(_ context.Context, wi *backend.ActivityWorkItem) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	t := be.store.lockedTask(wi.SequenceNumber, wi.LockedBy)
+	if t == nil {
+		return backend.ErrWorkItemLockLost
+	}
+
+	t.lockExpiration = time.Now().UTC().Add(be.options.ActivityLockTimeout)
+	return nil
+}
+
+// RecordActivityHeartbeat implements backend.BackendWithActivityHeartbeats. The heartbeat details aren't kept, so
+// recording a heartbeat only extends the lock on the work item.
+func (be *inMemoryBackend) RecordActivityHeartbeat(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	return be.RenewActivityWorkItemLock(ctx, wi)
+}
+
+// DeadLetterOrchestrationWorkItem implements backend.BackendWithDeadLetters
+func (be *inMemoryBackend) DeadLetterOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem, reason string) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	inst, ok := be.store.instances[string(wi.InstanceID)]
+	if !ok || inst.lockedBy != wi.LockedBy || !be.store.hasLockedEvents(inst.id, wi.LockedBy) {
+		return backend.ErrWorkItemLockLost
+	}
+
+	var events []*backend.HistoryEvent
+	deliveryCount := int32(0)
+	be.store.removeEvents(func(e *pendingEvent) bool {
+		if e.instanceID != inst.id || e.lockedBy != wi.LockedBy {
+			return false
+		}
+		events = append(events, e.event)
+		if e.dequeueCount > deliveryCount {
+			deliveryCount = e.dequeueCount
+		}
+		return true
+	})
+	be.store.addDeadLetter(backend.DeadLetterOrchestration, inst.id, deliveryCount, reason, events)
+
+	inst.lockedBy = ""
+	inst.lockExpiration = time.Time{}
+	return nil
+}
+
+// DeadLetterActivityWorkItem implements backend.BackendWithDeadLetters
+func (be *inMemoryBackend) DeadLetterActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem, reason string) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	t := be.store.lockedTask(wi.SequenceNumber, wi.LockedBy)
+	if t == nil {
+		return backend.ErrWorkItemLockLost
+	}
+
+	be.store.removeTasks(func(other *pendingTask) bool { return other == t })
+	be.store.addDeadLetter(backend.DeadLetterActivity, t.instanceID, t.dequeueCount, reason, []*backend.HistoryEvent{t.event})
+	return nil
+}
+
+// ListDeadLetters implements backend.BackendWithDeadLetters
+func (be *inMemoryBackend) ListDeadLetters(context.Context) ([]*backend.DeadLetter, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]*backend.DeadLetter, 0, len(be.store.deadLetters))
+	for _, dl := range be.store.deadLetters {
+		clone := *dl
+		clone.Events = cloneEvents(dl.Events)
+		deadLetters = append(deadLetters, &clone)
+	}
+	return deadLetters, nil
+}
+
+// ResubmitDeadLetter implements backend.BackendWithDeadLetters
+func (be *inMemoryBackend) ResubmitDeadLetter(_ context.Context, id int64) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dl := be.store.removeDeadLetter(id)
+	if dl == nil {
+		return backend.ErrDeadLetterNotFound
+	}
+	for _, e := range dl.Events {
+		if dl.Kind == backend.DeadLetterActivity {
+			be.store.addTask(string(dl.InstanceID), e)
+		} else {
+			be.store.addEvent(string(dl.InstanceID), e, time.Time{})
+		}
+	}
+	return nil
+}
+
+// DeleteDeadLetter implements backend.BackendWithDeadLetters
+func (be *inMemoryBackend) DeleteDeadLetter(_ context.Context, id int64) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if be.store.removeDeadLetter(id) == nil {
+		return backend.ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *inMemoryBackend) GetOrchestrationLastActions(_ context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	inst, ok := be.store.instances[string(iid)]
+	if !ok {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	actions := make([]*protos.OrchestratorAction, 0, len(inst.lastActions))
+	for _, a := range inst.lastActions {
+		actions = append(actions, proto.Clone(a).(*protos.OrchestratorAction))
+	}
+	return actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *inMemoryBackend) PurgeOrchestrationState(_ context.Context, id api.InstanceID) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	inst, ok := be.store.instances[string(id)]
+	if !ok {
+		return api.ErrInstanceNotFound
+	}
+	if !isCompletedStatus(inst.runtimeStatus) {
+		return api.ErrNotCompleted
+	}
+
+	delete(be.store.instances, string(id))
+	be.notifyChanged()
+	return nil
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *inMemoryBackend) PurgeOrchestrationStateBatch(_ context.Context, query api.InstanceQuery) (int, string, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return 0, "", err
+	}
+
+	// Only the state of completed orchestrations can be purged
+	pageSize := query.PageSizeOrDefault()
+	ids := make([]string, 0, pageSize+1)
+	for _, id := range be.store.queryInstanceIDs(query) {
+		if inst := be.store.instances[id]; isCompletedStatus(inst.runtimeStatus) && matchesQuery(inst, query) {
+			if ids = append(ids, id); len(ids) > pageSize {
+				break
+			}
+		}
+	}
+
+	continuationToken := ""
+	if len(ids) > pageSize {
+		ids = ids[:pageSize]
+		continuationToken = ids[len(ids)-1]
+	}
+	for _, id := range ids {
+		delete(be.store.instances, id)
+	}
+	if len(ids) > 0 {
+		be.notifyChanged()
+	}
+	return len(ids), continuationToken, nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *inMemoryBackend) GetOrchestrationHistoriesBatch(_ context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	errs := make(map[api.InstanceID]error)
+	for iid, from := range fromSequenceNumbers {
+		inst, ok := be.store.instances[string(iid)]
+		if !ok {
+			errs[iid] = api.ErrInstanceNotFound
+			continue
+		}
+		if from < 0 {
+			from = 0
+		}
+		if from > len(inst.history) {
+			from = len(inst.history)
+		}
+		histories[iid] = cloneEvents(inst.history[from:])
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *inMemoryBackend) GetOrphanedSubOrchestrations(context.Context) ([]*api.OrchestrationMetadata, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for _, inst := range be.store.sortedInstances() {
+		if inst.parentInstanceID == "" {
+			continue
+		}
+		switch inst.runtimeStatus {
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING,
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED:
+		default:
+			continue
+		}
+		if parent, ok := be.store.instances[inst.parentInstanceID]; ok && !isCompletedStatus(parent.runtimeStatus) {
+			continue
+		}
+		orphans = append(orphans, inst.metadata())
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *inMemoryBackend) QueryOrchestrationMetadata(_ context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	pageSize := query.PageSizeOrDefault()
+	instances := make([]*api.OrchestrationMetadata, 0)
+	for _, id := range be.store.queryInstanceIDs(query) {
+		inst := be.store.instances[id]
+		if !matchesQuery(inst, query) {
+			continue
+		}
+		instances = append(instances, inst.metadata())
+		if len(instances) > pageSize {
+			break
+		}
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *inMemoryBackend) ExportOrchestrationInstance(_ context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	inst, ok := be.store.instances[string(iid)]
+	if !ok {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	state := &backend.OrchestrationInstanceState{
+		Metadata:      inst.metadata(),
+		History:       cloneEvents(inst.history),
+		PendingEvents: make([]*backend.HistoryEvent, 0),
+		PendingTasks:  make([]*backend.HistoryEvent, 0),
+	}
+	for _, e := range be.store.events {
+		if e.instanceID == inst.id {
+			state.PendingEvents = append(state.PendingEvents, cloneEvent(e.event))
+		}
+	}
+	for _, t := range be.store.tasks {
+		if t.instanceID == inst.id {
+			state.PendingTasks = append(state.PendingTasks, cloneEvent(t.event))
+		}
+	}
+	return state, nil
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *inMemoryBackend) ImportOrchestrationInstance(_ context.Context, state *backend.OrchestrationInstanceState) error {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+	if _, ok := be.store.instances[id]; ok {
+		return backend.ErrDuplicateEvent
+	}
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	inst := &instance{
+		id:               id,
+		name:             metadata.Name,
+		version:          startEvent.GetVersion().GetValue(),
+		executionID:      startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		runtimeStatus:    metadata.RuntimeStatus,
+		createdTime:      metadata.CreatedAt.UTC(),
+		lastUpdatedTime:  metadata.LastUpdatedAt.UTC(),
+		input:            metadata.SerializedInput,
+		output:           metadata.SerializedOutput,
+		customStatus:     metadata.SerializedCustomStatus,
+		parentInstanceID: startEvent.GetParentInstance().GetOrchestrationInstance().GetInstanceId(),
+		generationCount:  metadata.GenerationCount,
+		tags:             cloneTags(metadata.Tags),
+		history:          cloneEvents(state.History),
+	}
+	if metadata.IsComplete() {
+		inst.completedTime = inst.lastUpdatedTime
+	}
+	if metadata.FailureDetails != nil {
+		inst.failureDetails = proto.Clone(metadata.FailureDetails).(*protos.TaskFailureDetails)
+	}
+	be.store.instances[id] = inst
+
+	for _, e := range state.PendingEvents {
+		// Timers and scheduled starts must stay invisible to workers until they're due
+		var visibleTime time.Time
+		if tf := e.GetTimerFired(); tf != nil {
+			visibleTime = tf.GetFireAt().AsTime()
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			visibleTime = ts.AsTime()
+		}
+		be.store.addEvent(id, e, visibleTime)
+	}
+
+	for _, e := range state.PendingTasks {
+		be.store.addTask(id, e)
+	}
+	be.notifyChanged()
+	return nil
+}
+
+// WatchOrchestrationRuntimeStatus implements backend.BackendWithWatch
+func (be *inMemoryBackend) WatchOrchestrationRuntimeStatus(ctx context.Context, iid api.InstanceID) (<-chan *api.OrchestrationMetadata, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	inst, ok := be.store.instances[string(iid)]
+	if !ok {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	ch := make(chan *api.OrchestrationMetadata, 1)
+	go be.watch(ctx, iid, inst.metadata(), be.changed, ch)
+	return ch, nil
+}
+
+// watch sends the metadata of an orchestration to ch, and then its changes until ctx is cancelled or the
+// orchestration completes or is purged.
+func (be *inMemoryBackend) watch(ctx context.Context, iid api.InstanceID, metadata *api.OrchestrationMetadata, changed <-chan struct{}, ch chan *api.OrchestrationMetadata) {
+	defer close(ch)
+
+	last := metadata
+	for {
+		// Only the latest metadata is kept if the consumer doesn't keep up
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- last
+		if last.IsComplete() {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+
+			be.lock.Lock()
+			var inst *instance
+			if be.store != nil {
+				inst = be.store.instances[string(iid)]
+			}
+			if inst != nil {
+				metadata = inst.metadata()
+			}
+			changed = be.changed
+			be.lock.Unlock()
+
+			if inst == nil {
+				return
+			}
+			if metadata.RuntimeStatus != last.RuntimeStatus || metadata.SerializedCustomStatus != last.SerializedCustomStatus {
+				last = metadata
+				break
+			}
+		}
+	}
+}
+
+// notifyChanged wakes up the watchers of orchestration metadata. The caller must hold the lock.
+func (be *inMemoryBackend) notifyChanged() {
+	close(be.changed)
+	be.changed = make(chan struct{})
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *inMemoryBackend) GetOrchestrationStats(_ context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, inst := range be.store.sortedInstances() {
+		if inst.name != name {
+			continue
+		}
+		if !inst.createdTime.Before(since) {
+			stats.Started++
+		}
+		if inst.completedTime.IsZero() || inst.completedTime.Before(since) {
+			continue
+		}
+		switch inst.runtimeStatus {
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED:
+			stats.Completed++
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED:
+			stats.Failed++
+		default:
+			continue
+		}
+		d := inst.completedTime.Sub(inst.createdTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*inMemoryBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*inMemoryBackend) Stop(context.Context) error {
+	return nil
+}
+
+// ensureDB must be called while holding the lock.
+func (be *inMemoryBackend) ensureDB() error {
+	if be.store == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *inMemoryBackend) String() string {
+	return "inmem"
+}
+
+// createInstance creates an orchestration instance and adds its ExecutionStarted event.
+func (s *store) createInstance(e *backend.HistoryEvent) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	id := startEvent.OrchestrationInstance.InstanceId
+	if _, ok := s.instances[id]; ok {
+		return backend.ErrDuplicateEvent
+	}
+
+	s.instances[id] = &instance{
+		id:               id,
+		name:             startEvent.Name,
+		version:          startEvent.Version.GetValue(),
+		executionID:      startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		runtimeStatus:    protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+		createdTime:      e.Timestamp.AsTime(),
+		lastUpdatedTime:  time.Now().UTC(),
+		input:            startEvent.Input.GetValue(),
+		parentInstanceID: startEvent.GetParentInstance().GetOrchestrationInstance().GetInstanceId(),
+		tags:             helpers.GetTags(startEvent),
+	}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime time.Time
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime()
+	}
+	s.addEvent(id, e, visibleTime)
+	return nil
+}
+
+// addEvent adds a new event to the queue of an orchestration instance. The event stays invisible to workers until
+// visibleTime, unless it's zero.
+func (s *store) addEvent(id string, e *backend.HistoryEvent, visibleTime time.Time) {
+	s.nextSequenceNumber++
+	s.events = append(s.events, &pendingEvent{
+		sequenceNumber: s.nextSequenceNumber,
+		instanceID:     id,
+		event:          cloneEvent(e),
+		visibleTime:    visibleTime,
+	})
+}
+
+// addTask adds a new activity task that's scheduled by an orchestration instance.
+func (s *store) addTask(id string, e *backend.HistoryEvent) {
+	s.nextSequenceNumber++
+	s.tasks = append(s.tasks, &pendingTask{
+		sequenceNumber: s.nextSequenceNumber,
+		instanceID:     id,
+		event:          cloneEvent(e),
+	})
+}
+
+// addDeadLetter adds the events of a poison work item to the dead-letter store.
+func (s *store) addDeadLetter(kind backend.DeadLetterKind, id string, deliveryCount int32, reason string, events []*backend.HistoryEvent) {
+	s.nextDeadLetterID++
+	s.deadLetters = append(s.deadLetters, &backend.DeadLetter{
+		ID:             s.nextDeadLetterID,
+		Kind:           kind,
+		InstanceID:     api.InstanceID(id),
+		Events:         events,
+		DeliveryCount:  deliveryCount,
+		Reason:         reason,
+		DeadLetteredAt: time.Now().UTC(),
+	})
+}
+
+// removeDeadLetter removes the specified dead letter from the dead-letter store, and returns it, or nil if it doesn't
+// exist.
+func (s *store) removeDeadLetter(id int64) *backend.DeadLetter {
+	for i, dl := range s.deadLetters {
+		if dl.ID == id {
+			s.deadLetters = append(s.deadLetters[:i], s.deadLetters[i+1:]...)
+			return dl
+		}
+	}
+	return nil
+}
+
+func (s *store) removeEvents(match func(e *pendingEvent) bool) {
+	remaining := s.events[:0]
+	for _, e := range s.events {
+		if !match(e) {
+			remaining = append(remaining, e)
+		}
+	}
+	for i := len(remaining); i < len(s.events); i++ {
+		s.events[i] = nil
+	}
+	s.events = remaining
+}
+
+func (s *store) removeTasks(match func(t *pendingTask) bool) {
+	remaining := s.tasks[:0]
+	for _, t := range s.tasks {
+		if !match(t) {
+			remaining = append(remaining, t)
+		}
+	}
+	for i := len(remaining); i < len(s.tasks); i++ {
+		s.tasks[i] = nil
+	}
+	s.tasks = remaining
+}
+
+func (s *store) hasInvisibleEvents(id string, now time.Time) bool {
+	for _, e := range s.events {
+		if e.instanceID == id && !e.isVisible(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *store) hasLockedEvents(id string, lockedBy string) bool {
+	for _, e := range s.events {
+		if e.instanceID == id && e.lockedBy == lockedBy {
+			return true
+		}
+	}
+	return false
+}
+
+// lockedTask returns the activity task with the specified sequence number, or nil if it doesn't exist or isn't
+// locked by the specified worker.
+func (s *store) lockedTask(sequenceNumber int64, lockedBy string) *pendingTask {
+	for _, t := range s.tasks {
+		if t.sequenceNumber == sequenceNumber {
+			if t.lockedBy != lockedBy {
+				return nil
+			}
+			return t
+		}
+	}
+	return nil
+}
+
+// sortedInstances returns all the instances ordered by creation time and instance ID.
+func (s *store) sortedInstances() []*instance {
+	instances := make([]*instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		if !instances[i].createdTime.Equal(instances[j].createdTime) {
+			return instances[i].createdTime.Before(instances[j].createdTime)
+		}
+		return instances[i].id < instances[j].id
+	})
+	return instances
+}
+
+// queryInstanceIDs returns the sorted IDs of the instances that match the instance ID prefix of the query and come
+// after its continuation token.
+func (s *store) queryInstanceIDs(query api.InstanceQuery) []string {
+	ids := make([]string, 0, len(s.instances))
+	for id := range s.instances {
+		if id > query.ContinuationToken && strings.HasPrefix(id, query.InstanceIDPrefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// matchesQuery returns true if the instance matches the runtime status, name, creation time, completion time, and tag
+// filter expression filters of the query.
+func matchesQuery(inst *instance, query api.InstanceQuery) bool {
+	if query.Name != "" && inst.name != query.Name {
+		return false
+	}
+	if !strings.HasPrefix(inst.name, query.NamePrefix) {
+		return false
+	}
+	if len(query.RuntimeStatuses) > 0 && !containsStatus(query.RuntimeStatuses, inst.runtimeStatus) {
+		return false
+	}
+	if !query.CreatedFrom.IsZero() && inst.createdTime.Before(query.CreatedFrom) {
+		return false
+	}
+	if !query.CreatedTo.IsZero() && !inst.createdTime.Before(query.CreatedTo) {
+		return false
+	}
+	if !query.CompletedBefore.IsZero() && (inst.completedTime.IsZero() || !inst.completedTime.Before(query.CompletedBefore)) {
+		return false
+	}
+	return query.TagFilter.Matches(inst.tags)
+}
+
+func (e *pendingEvent) isVisible(now time.Time) bool {
+	return e.visibleTime.IsZero() || !e.visibleTime.After(now)
+}
+
+func (inst *instance) isLocked(now time.Time) bool {
+	return !inst.lockExpiration.IsZero() && !inst.lockExpiration.Before(now)
+}
+
+func (inst *instance) metadata() *api.OrchestrationMetadata {
+	var failureDetails *protos.TaskFailureDetails
+	if inst.failureDetails != nil {
+		failureDetails = proto.Clone(inst.failureDetails).(*protos.TaskFailureDetails)
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(inst.id),
+		inst.name,
+		inst.runtimeStatus,
+		inst.createdTime,
+		inst.lastUpdatedTime,
+		inst.input,
+		inst.output,
+		inst.customStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = inst.generationCount
+	metadata.Tags = cloneTags(inst.tags)
+	return metadata
+}
+
+// cloneTags returns a copy of the specified tags, so that callers can't modify the stored tags.
+func cloneTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(tags))
+	for k, v := range tags {
+		clone[k] = v
+	}
+	return clone
+}
+
+func validateEvent(e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+	return nil
+}
+
+func isCompletedStatus(status protos.OrchestrationStatus) bool {
+	return status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED ||
+		status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED ||
+		status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED
+}
+
+func containsStatus(statuses []protos.OrchestrationStatus, status protos.OrchestrationStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneEvent copies an event so that the stored state can't be changed by callers, the same way that serializing
+// the event would.
+func cloneEvent(e *backend.HistoryEvent) *backend.HistoryEvent {
+	return proto.Clone(e).(*backend.HistoryEvent)
+}
+
+func cloneEvents(events []*backend.HistoryEvent) []*backend.HistoryEvent {
+	cloned := make([]*backend.HistoryEvent, 0, len(events))
+	for _, e := range events {
+		cloned = append(cloned, cloneEvent(e))
+	}
+	return cloned
+}
@@ -0,0 +1,14 @@
+package inmem
+
+import (
+	"net/url"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+// The "inmem" scheme creates an in-memory backend, e.g. "inmem://".
+func init() {
+	backend.Register("inmem", func(_ *url.URL, logger backend.Logger) (backend.Backend, error) {
+		return NewInMemoryBackend(NewInMemoryOptions(), logger), nil
+	})
+}
@@ -0,0 +1,448 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// instrumentedBackend is a Backend that records the latencies of the operations that workers and clients perform on
+// the wrapped backend.
+type instrumentedBackend struct {
+	Backend
+}
+
+// NewInstrumentedBackend wraps the specified backend so that the latency of each backend operation performed by the
+// workers and clients that use it is recorded in the "durabletask.backend.operation.duration" histogram, in
+// milliseconds. The histogram is labeled with the operation, e.g. "get_orchestration_work_item" or
+// "complete_orchestration_work_item", and with its outcome, "success" or "error". Polls that find no work items are
+// successful. Comparing these latencies with the end-to-end latencies of work items tells whether the backend or the
+// executor is the bottleneck.
+//
+// Like the other metrics of this package, the histogram is recorded with the global OpenTelemetry meter provider, so
+// it's exported by whichever meter provider the app registers with the global package of the OpenTelemetry metric
+// API. The instrumentation only reads the clock twice per operation, and recording is a no-op until a meter provider
+// is registered.
+//
+// Pass the same wrapped backend to the workers and clients. Apply this wrapper last, around any other wrappers like
+// the one returned by [NewMetadataProjectionBackend], so that their overhead is included in the recorded latencies.
+func NewInstrumentedBackend(be Backend) Backend {
+	return &instrumentedBackend{Backend: be}
+}
+
+// CreateOrchestrationInstance implements Backend
+func (be *instrumentedBackend) CreateOrchestrationInstance(ctx context.Context, e *HistoryEvent) error {
+	start := time.Now()
+	err := be.Backend.CreateOrchestrationInstance(ctx, e)
+	helpers.RecordBackendOperation(ctx, "create_orchestration_instance", start, err)
+	return err
+}
+
+// AddNewOrchestrationEvent implements Backend
+func (be *instrumentedBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *HistoryEvent) error {
+	start := time.Now()
+	err := be.Backend.AddNewOrchestrationEvent(ctx, iid, e)
+	helpers.RecordBackendOperation(ctx, "add_orchestration_event", start, err)
+	return err
+}
+
+// AddNewOrchestrationEventIf implements BackendWithConditionalEvents
+func (be *instrumentedBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	conditional, err := wrapped[BackendWithConditionalEvents](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = conditional.AddNewOrchestrationEventIf(ctx, iid, e, statuses)
+	helpers.RecordBackendOperation(ctx, "add_orchestration_event_if", start, err)
+	return err
+}
+
+// IngestOperations implements BackendWithIngest
+func (be *instrumentedBackend) IngestOperations(ctx context.Context, ops []*IngestOperation) ([]error, error) {
+	start := time.Now()
+	errs, err := IngestOperations(ctx, be.Backend, ops)
+	helpers.RecordBackendOperation(ctx, "ingest_operations", start, err)
+	return errs, err
+}
+
+// GetOrchestrationWorkItem implements Backend
+func (be *instrumentedBackend) GetOrchestrationWorkItem(ctx context.Context) (*OrchestrationWorkItem, error) {
+	start := time.Now()
+	wi, err := be.Backend.GetOrchestrationWorkItem(ctx)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_work_item", start, ignoreNoWorkItems(err))
+	return wi, err
+}
+
+// GetOrchestrationRuntimeState implements Backend
+func (be *instrumentedBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *OrchestrationWorkItem) (*OrchestrationRuntimeState, error) {
+	start := time.Now()
+	state, err := be.Backend.GetOrchestrationRuntimeState(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_runtime_state", start, err)
+	return state, err
+}
+
+// GetOrchestrationMetadata implements Backend
+func (be *instrumentedBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	start := time.Now()
+	metadata, err := be.Backend.GetOrchestrationMetadata(ctx, iid)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_metadata", start, err)
+	return metadata, err
+}
+
+// CompleteOrchestrationWorkItem implements Backend
+func (be *instrumentedBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem) error {
+	start := time.Now()
+	err := be.Backend.CompleteOrchestrationWorkItem(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "complete_orchestration_work_item", start, err)
+	return err
+}
+
+// AbandonOrchestrationWorkItem implements Backend
+func (be *instrumentedBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem) error {
+	start := time.Now()
+	err := be.Backend.AbandonOrchestrationWorkItem(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "abandon_orchestration_work_item", start, err)
+	return err
+}
+
+// RenewOrchestrationWorkItemLock implements BackendWithLockRenewal
+func (be *instrumentedBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *OrchestrationWorkItem) error {
+	renewer, err := wrapped[BackendWithLockRenewal](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = renewer.RenewOrchestrationWorkItemLock(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "renew_orchestration_work_item_lock", start, err)
+	return err
+}
+
+// GetActivityWorkItem implements Backend
+func (be *instrumentedBackend) GetActivityWorkItem(ctx context.Context) (*ActivityWorkItem, error) {
+	start := time.Now()
+	wi, err := be.Backend.GetActivityWorkItem(ctx)
+	helpers.RecordBackendOperation(ctx, "get_activity_work_item", start, ignoreNoWorkItems(err))
+	return wi, err
+}
+
+// GetActivityWorkItems implements BackendWithActivityBatches
+func (be *instrumentedBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*ActivityWorkItem, error) {
+	batched, err := wrapped[BackendWithActivityBatches](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	wis, err := batched.GetActivityWorkItems(ctx, max)
+	helpers.RecordBackendOperation(ctx, "get_activity_work_items", start, ignoreNoWorkItems(err))
+	return wis, err
+}
+
+// CompleteActivityWorkItem implements Backend
+func (be *instrumentedBackend) CompleteActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error {
+	start := time.Now()
+	err := be.Backend.CompleteActivityWorkItem(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "complete_activity_work_item", start, err)
+	return err
+}
+
+// AbandonActivityWorkItem implements Backend
+func (be *instrumentedBackend) AbandonActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error {
+	start := time.Now()
+	err := be.Backend.AbandonActivityWorkItem(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "abandon_activity_work_item", start, err)
+	return err
+}
+
+// RenewActivityWorkItemLock implements BackendWithLockRenewal
+func (be *instrumentedBackend) RenewActivityWorkItemLock(ctx context.Context, wi *ActivityWorkItem) error {
+	renewer, err := wrapped[BackendWithLockRenewal](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = renewer.RenewActivityWorkItemLock(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "renew_activity_work_item_lock", start, err)
+	return err
+}
+
+// WatchOrchestrationRuntimeStatus implements BackendWithWatch
+func (be *instrumentedBackend) WatchOrchestrationRuntimeStatus(ctx context.Context, id api.InstanceID) (<-chan *api.OrchestrationMetadata, error) {
+	watcher, err := wrapped[BackendWithWatch](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	ch, err := watcher.WatchOrchestrationRuntimeStatus(ctx, id)
+	helpers.RecordBackendOperation(ctx, "watch_orchestration_runtime_status", start, err)
+	return ch, err
+}
+
+// RecordActivityHeartbeat implements BackendWithActivityHeartbeats
+func (be *instrumentedBackend) RecordActivityHeartbeat(ctx context.Context, wi *ActivityWorkItem) error {
+	heartbeats, err := wrapped[BackendWithActivityHeartbeats](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = heartbeats.RecordActivityHeartbeat(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "record_activity_heartbeat", start, err)
+	return err
+}
+
+// GetActivityWorkItemsFromQueues implements BackendWithActivityQueues
+func (be *instrumentedBackend) GetActivityWorkItemsFromQueues(ctx context.Context, queues []string, max int) ([]*ActivityWorkItem, error) {
+	queued, err := wrapped[BackendWithActivityQueues](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	wis, err := queued.GetActivityWorkItemsFromQueues(ctx, queues, max)
+	helpers.RecordBackendOperation(ctx, "get_activity_work_items_from_queues", start, ignoreNoWorkItems(err))
+	return wis, err
+}
+
+// DeadLetterOrchestrationWorkItem implements BackendWithDeadLetters
+func (be *instrumentedBackend) DeadLetterOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, reason string) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, reason)
+	helpers.RecordBackendOperation(ctx, "dead_letter_orchestration_work_item", start, err)
+	return err
+}
+
+// DeadLetterActivityWorkItem implements BackendWithDeadLetters
+func (be *instrumentedBackend) DeadLetterActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, reason string) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = deadLetters.DeadLetterActivityWorkItem(ctx, wi, reason)
+	helpers.RecordBackendOperation(ctx, "dead_letter_activity_work_item", start, err)
+	return err
+}
+
+// ListDeadLetters implements BackendWithDeadLetters
+func (be *instrumentedBackend) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	letters, err := deadLetters.ListDeadLetters(ctx)
+	helpers.RecordBackendOperation(ctx, "list_dead_letters", start, err)
+	return letters, err
+}
+
+// ResubmitDeadLetter implements BackendWithDeadLetters
+func (be *instrumentedBackend) ResubmitDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = deadLetters.ResubmitDeadLetter(ctx, id)
+	helpers.RecordBackendOperation(ctx, "resubmit_dead_letter", start, err)
+	return err
+}
+
+// DeleteDeadLetter implements BackendWithDeadLetters
+func (be *instrumentedBackend) DeleteDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = deadLetters.DeleteDeadLetter(ctx, id)
+	helpers.RecordBackendOperation(ctx, "delete_dead_letter", start, err)
+	return err
+}
+
+// GetOrchestrationLastActions implements BackendWithLastActions
+func (be *instrumentedBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	lastActions, err := wrapped[BackendWithLastActions](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	actions, err := lastActions.GetOrchestrationLastActions(ctx, iid)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_last_actions", start, err)
+	return actions, err
+}
+
+// PurgeOrchestrationStateBatch implements BackendWithBulkPurge
+func (be *instrumentedBackend) PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error) {
+	purger, err := wrapped[BackendWithBulkPurge](be.Backend)
+	if err != nil {
+		return 0, "", err
+	}
+	start := time.Now()
+	count, continuationToken, err := purger.PurgeOrchestrationStateBatch(ctx, query)
+	helpers.RecordBackendOperation(ctx, "purge_orchestration_state_batch", start, err)
+	return count, continuationToken, err
+}
+
+// GetOrchestrationStats implements BackendWithStats
+func (be *instrumentedBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	statistics, err := wrapped[BackendWithStats](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	stats, err := statistics.GetOrchestrationStats(ctx, name, since)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_stats", start, err)
+	return stats, err
+}
+
+// GetOrchestrationHistoriesBatch implements BackendWithHistoriesBatch
+func (be *instrumentedBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*HistoryEvent, error) {
+	batch, err := wrapped[BackendWithHistoriesBatch](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	histories, err := batch.GetOrchestrationHistoriesBatch(ctx, fromSequenceNumbers)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_histories_batch", start, err)
+	return histories, err
+}
+
+// GetOrphanedSubOrchestrations implements BackendWithOrphanQueries
+func (be *instrumentedBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	orphans, err := wrapped[BackendWithOrphanQueries](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	metadata, err := orphans.GetOrphanedSubOrchestrations(ctx)
+	helpers.RecordBackendOperation(ctx, "get_orphaned_sub_orchestrations", start, err)
+	return metadata, err
+}
+
+// ExportOrchestrationInstance implements BackendWithMigration
+func (be *instrumentedBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*OrchestrationInstanceState, error) {
+	migrator, err := wrapped[BackendWithMigration](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	state, err := migrator.ExportOrchestrationInstance(ctx, iid)
+	helpers.RecordBackendOperation(ctx, "export_orchestration_instance", start, err)
+	return state, err
+}
+
+// ImportOrchestrationInstance implements BackendWithMigration
+func (be *instrumentedBackend) ImportOrchestrationInstance(ctx context.Context, state *OrchestrationInstanceState) error {
+	migrator, err := wrapped[BackendWithMigration](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = migrator.ImportOrchestrationInstance(ctx, state)
+	helpers.RecordBackendOperation(ctx, "import_orchestration_instance", start, err)
+	return err
+}
+
+// QueryOrchestrationMetadata implements BackendWithQueries
+func (be *instrumentedBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	querier, err := wrapped[BackendWithQueries](be.Backend)
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	start := time.Now()
+	result, err := querier.QueryOrchestrationMetadata(ctx, query)
+	helpers.RecordBackendOperation(ctx, "query_orchestration_metadata", start, err)
+	return result, err
+}
+
+// GetActivityWorkItemsWithFilter implements BackendWithActivityFilters
+func (be *instrumentedBackend) GetActivityWorkItemsWithFilter(ctx context.Context, filter ActivityWorkItemFilter, max int) ([]*ActivityWorkItem, error) {
+	filtered, err := wrapped[BackendWithActivityFilters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	wis, err := filtered.GetActivityWorkItemsWithFilter(ctx, filter, max)
+	helpers.RecordBackendOperation(ctx, "get_activity_work_items_with_filter", start, ignoreNoWorkItems(err))
+	return wis, err
+}
+
+// GetOrchestrationWorkItemWithFilter implements BackendWithOrchestrationFilters
+func (be *instrumentedBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter OrchestrationWorkItemFilter) (*OrchestrationWorkItem, error) {
+	filtered, err := wrapped[BackendWithOrchestrationFilters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	wi, err := filtered.GetOrchestrationWorkItemWithFilter(ctx, filter)
+	helpers.RecordBackendOperation(ctx, "get_orchestration_work_item_with_filter", start, ignoreNoWorkItems(err))
+	return wi, err
+}
+
+// DeferOrchestrationWorkItem implements BackendWithDeferrals
+func (be *instrumentedBackend) DeferOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, delay time.Duration) error {
+	deferrals, err := wrapped[BackendWithDeferrals](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = deferrals.DeferOrchestrationWorkItem(ctx, wi, delay)
+	helpers.RecordBackendOperation(ctx, "defer_orchestration_work_item", start, err)
+	return err
+}
+
+// DeferActivityWorkItem implements BackendWithDeferrals
+func (be *instrumentedBackend) DeferActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, delay time.Duration) error {
+	deferrals, err := wrapped[BackendWithDeferrals](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = deferrals.DeferActivityWorkItem(ctx, wi, delay)
+	helpers.RecordBackendOperation(ctx, "defer_activity_work_item", start, err)
+	return err
+}
+
+// DeleteActivityWorkItem implements BackendWithExternalActivityResults
+func (be *instrumentedBackend) DeleteActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error {
+	external, err := wrapped[BackendWithExternalActivityResults](be.Backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = external.DeleteActivityWorkItem(ctx, wi)
+	helpers.RecordBackendOperation(ctx, "delete_activity_work_item", start, err)
+	return err
+}
+
+// Unwrap implements BackendWrapper
+func (be *instrumentedBackend) Unwrap() Backend {
+	return be.Backend
+}
+
+// wrapped returns the specified wrapped backend as a T, or an error wrapping [ErrNotSupported] if it doesn't support
+// T. Wrappers use it to forward the optional interfaces, which are only called through [As] if the wrapped backend
+// supports them.
+func wrapped[T any](be Backend) (T, error) {
+	t, ok := As[T](be)
+	if !ok {
+		return t, fmt.Errorf("%v: %w", be, ErrNotSupported)
+	}
+	return t, nil
+}
+
+// ignoreNoWorkItems returns nil if the specified error only indicates that there were no work items to fetch.
+func ignoreNoWorkItems(err error) error {
+	if errors.Is(err, ErrNoWorkItems) {
+		return nil
+	}
+	return err
+}
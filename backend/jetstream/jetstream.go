@@ -0,0 +1,1501 @@
+package jetstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+// instanceIDHeader is the header of work item messages that contains the ID of the orchestration instance.
+const instanceIDHeader = "Durabletask-Instance-Id"
+
+// errNoChange is returned by the functions that are passed to modify to leave the state of an instance unchanged.
+var errNoChange = errors.New("no change")
+
+// maxEventsPerWorkItem is the maximum number of new events that are delivered in an orchestration work item.
+const maxEventsPerWorkItem = 1000
+
+type JetStreamOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// URL is the URL of the NATS server, e.g. "nats://localhost:4222".
+	URL string
+
+	// ConnectOptions are additional options for connecting to the NATS server, e.g. for authentication.
+	ConnectOptions []nats.Option
+
+	// TaskHubName is used as the prefix of the names of the streams, subjects, consumers, and key/value bucket of the
+	// task hub. Multiple task hubs can share a NATS server by using different names.
+	TaskHubName string
+
+	// MaxFetchWait is how long a request for a work item waits for a message to be delivered, before it reports that
+	// there are no work items.
+	MaxFetchWait time.Duration
+}
+
+type jetStreamBackend struct {
+	nc         *nats.Conn
+	js         nats.JetStreamContext
+	kv         nats.KeyValue
+	workerName string
+	logger     backend.Logger
+	options    *JetStreamOptions
+
+	orchestrationSub *nats.Subscription
+	activitySub      *nats.Subscription
+
+	// The messages of the work items that are being processed, which are acknowledged when the work items are
+	// completed or abandoned.
+	lock                  sync.Mutex
+	orchestrationMessages map[api.InstanceID]*nats.Msg
+	activityMessages      map[int64]*nats.Msg
+}
+
+// instanceState is the value of an orchestration instance in the key/value bucket. Events that are sent to an
+// instance before it's created are added to a value that isn't marked as created yet.
+type instanceState struct {
+	ID               string                     `json:"id"`
+	Created          bool                       `json:"created"`
+	Name             string                     `json:"name,omitempty"`
+	Version          string                     `json:"version,omitempty"`
+	ExecutionID      string                     `json:"executionId,omitempty"`
+	RuntimeStatus    protos.OrchestrationStatus `json:"runtimeStatus"`
+	CreatedTime      time.Time                  `json:"createdTime"`
+	LastUpdatedTime  time.Time                  `json:"lastUpdatedTime"`
+	CompletedTime    time.Time                  `json:"completedTime"`
+	Input            string                     `json:"input,omitempty"`
+	Output           string                     `json:"output,omitempty"`
+	CustomStatus     string                     `json:"customStatus,omitempty"`
+	FailureDetails   []byte                     `json:"failureDetails,omitempty"`
+	ParentInstanceID string                     `json:"parentInstanceId,omitempty"`
+	GenerationCount  int                        `json:"generationCount"`
+	Tags             map[string]string          `json:"tags,omitempty"`
+	History          [][]byte                   `json:"history"`
+	LastActions      []byte                     `json:"lastActions,omitempty"`
+	PendingEvents    []*pendingEvent            `json:"pendingEvents"`
+	LockedBy         string                     `json:"lockedBy,omitempty"`
+	LockExpiration   time.Time                  `json:"lockExpiration"`
+}
+
+type pendingEvent struct {
+	VisibleTime  time.Time `json:"visibleTime"` // zero if the event is visible immediately
+	DequeueCount int32     `json:"dequeueCount"`
+	LockedBy     string    `json:"lockedBy,omitempty"`
+	EventPayload []byte    `json:"eventPayload"`
+}
+
+// NewJetStreamOptions creates a new options object for the NATS JetStream backend provider.
+func NewJetStreamOptions(url string) *JetStreamOptions {
+	// Default values are provided for required options
+	return &JetStreamOptions{
+		URL:                      url,
+		TaskHubName:              "durabletask",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+		MaxFetchWait:             time.Second,
+	}
+}
+
+// NewJetStreamBackend creates a new Backend object that uses NATS JetStream for its work item queues and state.
+//
+// The state of each orchestration instance, including its history and pending events, is stored in an entry of a
+// key/value bucket, which is updated with optimistic concurrency. Orchestration and activity work items are
+// delivered by durable pull consumers of work queue streams, so workers are notified of new work items as soon as
+// they're published instead of polling. Completing a work item acknowledges its message, and abandoning a work item
+// negatively acknowledges it, so that it's delivered again. Durable timers are implemented by delaying the
+// redelivery of the message of an orchestration until its timer fires.
+//
+// The size of the state of an orchestration instance is limited by the maximum payload size of the NATS server.
+func NewJetStreamBackend(opts *JetStreamOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewJetStreamOptions(nats.DefaultURL)
+	}
+
+	return &jetStreamBackend{
+		workerName:            fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:               opts,
+		logger:                logger,
+		orchestrationMessages: make(map[api.InstanceID]*nats.Msg),
+		activityMessages:      make(map[int64]*nats.Msg),
+	}
+}
+
+// CreateTaskHub creates the streams, consumers, and key/value bucket of the task hub, if they don't exist
+func (be *jetStreamBackend) CreateTaskHub(context.Context) error {
+	if err := be.connect(); err != nil {
+		return err
+	}
+
+	for _, name := range []string{be.orchestrationsName(), be.activitiesName()} {
+		_, err := be.js.AddStream(&nats.StreamConfig{
+			Name:      name,
+			Subjects:  []string{be.subject(name)},
+			Retention: nats.WorkQueuePolicy,
+			Storage:   nats.FileStorage,
+		})
+		if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+			return fmt.Errorf("failed to create stream %s: %w", name, err)
+		}
+	}
+
+	kv, err := be.js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:  be.instancesName(),
+		History: 1,
+		Storage: nats.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create key/value bucket %s: %w", be.instancesName(), err)
+	}
+	be.kv = kv
+
+	// Messages of orchestrations are delivered until they're acknowledged, since they're also used for timers
+	if be.orchestrationSub, err = be.js.PullSubscribe(
+		be.subject(be.orchestrationsName()),
+		be.orchestrationsName(),
+		nats.BindStream(be.orchestrationsName()),
+		nats.AckWait(be.options.OrchestrationLockTimeout),
+		nats.MaxDeliver(-1),
+	); err != nil {
+		return fmt.Errorf("failed to subscribe to the orchestration work items: %w", err)
+	}
+	if be.activitySub, err = be.js.PullSubscribe(
+		be.subject(be.activitiesName()),
+		be.activitiesName(),
+		nats.BindStream(be.activitiesName()),
+		nats.AckWait(be.options.ActivityLockTimeout),
+		nats.MaxDeliver(-1),
+	); err != nil {
+		return fmt.Errorf("failed to subscribe to the activity work items: %w", err)
+	}
+	return nil
+}
+
+// DeleteTaskHub deletes the streams and key/value bucket of the task hub
+func (be *jetStreamBackend) DeleteTaskHub(context.Context) error {
+	if err := be.connect(); err != nil {
+		return err
+	}
+
+	err := be.js.DeleteKeyValue(be.instancesName())
+	if errors.Is(err, nats.ErrBucketNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		return backend.ErrTaskHubNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to delete key/value bucket %s: %w", be.instancesName(), err)
+	}
+
+	for _, name := range []string{be.orchestrationsName(), be.activitiesName()} {
+		if err := be.js.DeleteStream(name); err != nil && !errors.Is(err, nats.ErrStreamNotFound) {
+			return fmt.Errorf("failed to delete stream %s: %w", name, err)
+		}
+	}
+	be.kv = nil
+
+	// The consumers were deleted with their streams, and the messages of in-flight work items can't be acknowledged
+	for _, sub := range []*nats.Subscription{be.orchestrationSub, be.activitySub} {
+		if sub != nil {
+			_ = sub.Unsubscribe()
+		}
+	}
+	be.orchestrationSub, be.activitySub = nil, nil
+	be.lock.Lock()
+	be.orchestrationMessages = make(map[api.InstanceID]*nats.Msg)
+	be.activityMessages = make(map[int64]*nats.Msg)
+	be.lock.Unlock()
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *jetStreamBackend) CreateOrchestrationInstance(_ context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.createInstance(e)
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *jetStreamBackend) AddNewOrchestrationEvent(_ context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	return be.addEvent(string(iid), e, nil)
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *jetStreamBackend) AddNewOrchestrationEventIf(_ context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if err := validateEvent(e); err != nil {
+		return err
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	// The status is checked in the same update in which the event is added, so that it can't change in between
+	return be.addEvent(string(iid), e, func(state *instanceState) error {
+		if !state.Created {
+			return api.ErrInstanceNotFound
+		} else if !containsStatus(statuses, state.RuntimeStatus) {
+			return api.ErrPreconditionFailed
+		}
+		return nil
+	})
+}
+
+// IngestOperations implements backend.BackendWithIngest
+//
+// Each operation is applied separately.
+func (be *jetStreamBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+//
+// A message is published to the orchestrations stream whenever events are added to an instance. Messages of
+// instances that have no events to process are acknowledged and skipped, and messages of instances whose events
+// aren't visible yet, e.g. because they're timers, are delivered again when the events become visible.
+func (be *jetStreamBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := be.fetch(ctx, be.orchestrationSub)
+		if err != nil {
+			return nil, err
+		}
+		id := msg.Header.Get(instanceIDHeader)
+
+		var wi *backend.OrchestrationWorkItem
+		var redeliveryDelay time.Duration
+		err = be.modify(id, func(state *instanceState) error {
+			wi = nil
+			redeliveryDelay = -1
+
+			now := time.Now().UTC()
+			if !state.Created {
+				// The message of the ExecutionStarted event is delivered once the instance is created
+				return errNoChange
+			} else if state.LockedBy != "" && state.LockExpiration.After(now) {
+				// The events are processed by the worker that holds the lock, or after its lock expires
+				redeliveryDelay = state.LockExpiration.Sub(now)
+				return errNoChange
+			}
+
+			// Instances that haven't started yet and still have invisible events are waiting for their scheduled
+			// start time, so events raised to them in the meantime must wait as well.
+			visibleTime := nextVisibleTime(state.PendingEvents, len(state.History))
+			if visibleTime == nil {
+				return errNoChange
+			} else if visibleTime.After(now) {
+				redeliveryDelay = visibleTime.Sub(now)
+				return errNoChange
+			}
+
+			// TODO: Get all the unprocessed events associated with the locked instance
+			maxDequeueCount := int32(0)
+			newEvents := make([]*protos.HistoryEvent, 0, 10)
+			for _, e := range state.PendingEvents {
+				if !e.isVisible(now) {
+					continue
+				}
+				e.DequeueCount++
+				e.LockedBy = be.workerName
+				if e.DequeueCount > maxDequeueCount {
+					maxDequeueCount = e.DequeueCount
+				}
+
+				event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+				if err != nil {
+					return err
+				}
+				newEvents = append(newEvents, event)
+				if len(newEvents) == maxEventsPerWorkItem {
+					break
+				}
+			}
+			state.LockedBy = be.workerName
+			state.LockExpiration = now.Add(be.options.OrchestrationLockTimeout)
+
+			wi = &backend.OrchestrationWorkItem{
+				InstanceID: api.InstanceID(id),
+				NewEvents:  newEvents,
+				LockedBy:   be.workerName,
+				RetryCount: maxDequeueCount - 1,
+
+				NextSequenceNumber: len(state.History),
+			}
+			return nil
+		})
+		if err != nil {
+			// The message is delivered again after its ack wait expires
+			return nil, err
+		}
+
+		if wi != nil {
+			be.lock.Lock()
+			be.orchestrationMessages[wi.InstanceID] = msg
+			be.lock.Unlock()
+			return wi, nil
+		} else if redeliveryDelay >= 0 {
+			if err := msg.NakWithDelay(redeliveryDelay); err != nil {
+				return nil, fmt.Errorf("failed to delay the orchestration work-item: %w", err)
+			}
+		} else if err := msg.Ack(); err != nil {
+			return nil, fmt.Errorf("failed to acknowledge the orchestration work-item: %w", err)
+		}
+	}
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *jetStreamBackend) GetOrchestrationRuntimeState(_ context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	state, _, err := be.read(string(wi.InstanceID))
+	if err != nil {
+		return nil, err
+	}
+
+	existingEvents := make([]*protos.HistoryEvent, 0)
+	if state != nil {
+		if existingEvents, err = state.history(0); err != nil {
+			return nil, err
+		}
+	}
+	return backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents), nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *jetStreamBackend) GetOrchestrationMetadata(_ context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	state, _, err := be.read(string(iid))
+	if err != nil {
+		return nil, err
+	} else if state == nil || !state.Created {
+		return nil, api.ErrInstanceNotFound
+	}
+	return state.metadata()
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+//
+// Activity tasks and messages to other instances are published first, and the state of the instance is updated
+// last, so a work item that fails to complete is processed again after its lock expires, and may publish its
+// outbound messages more than once.
+func (be *jetStreamBackend) CompleteOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	if state, _, err := be.read(id); err != nil {
+		return err
+	} else if state == nil || state.LockedBy != wi.LockedBy {
+		return backend.ErrWorkItemLockLost
+	}
+
+	// Save outbound activity tasks
+	for _, e := range wi.State.PendingTasks() {
+		if err := be.publish(be.activitiesName(), id, e); err != nil {
+			return err
+		}
+	}
+
+	// Save outbound orchestrator events. Timers and events that are sent to the instance itself are saved with its
+	// state.
+	selfEvents := make([]*pendingEvent, 0, len(wi.State.PendingTimers()))
+	for _, e := range wi.State.PendingTimers() {
+		event, err := newPendingEvent(e, e.GetTimerFired().GetFireAt().AsTime())
+		if err != nil {
+			return err
+		}
+		selfEvents = append(selfEvents, event)
+	}
+	for _, msg := range wi.State.PendingMessages() {
+		if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+			// Need to create a new instance
+			if err := be.createInstance(msg.HistoryEvent); err == backend.ErrDuplicateEvent {
+				be.logger.Warnf(
+					"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+					wi.InstanceID,
+					es.OrchestrationInstance.InstanceId)
+			} else if err != nil {
+				return err
+			}
+		} else if msg.TargetInstanceID == id {
+			event, err := newPendingEvent(msg.HistoryEvent, time.Time{})
+			if err != nil {
+				return err
+			}
+			selfEvents = append(selfEvents, event)
+		} else if err := be.addEvent(msg.TargetInstanceID, msg.HistoryEvent, nil); err != nil {
+			return err
+		}
+	}
+
+	hasPendingEvents := false
+	err := be.modify(id, func(state *instanceState) error {
+		if state.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		now := time.Now().UTC()
+		isCreated := false
+		isCompleted := false
+		for _, e := range wi.State.NewEvents() {
+			if es := e.GetExecutionStarted(); es != nil {
+				if isCreated {
+					// TODO: Log warning about duplicate start event
+					continue
+				}
+				isCreated = true
+				state.CreatedTime = e.Timestamp.AsTime()
+				state.Input = es.Input.GetValue()
+			} else if ec := e.GetExecutionCompleted(); ec != nil {
+				if isCompleted {
+					// TODO: Log warning about duplicate completion event
+					continue
+				}
+				isCompleted = true
+				state.CompletedTime = now
+				state.Output = ec.Result.GetValue()
+				state.FailureDetails = nil
+				if ec.FailureDetails != nil {
+					bytes, err := proto.Marshal(ec.FailureDetails)
+					if err != nil {
+						return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+					}
+					state.FailureDetails = bytes
+				}
+			}
+			// TODO: Execution suspended & resumed
+		}
+
+		if wi.State.CustomStatus != nil {
+			state.CustomStatus = wi.State.CustomStatus.Value
+		}
+		state.GenerationCount += wi.State.ContinuedAsNewCount()
+
+		// TODO: Support for stickiness, which would extend the LockExpiration
+		state.RuntimeStatus = wi.State.RuntimeStatus()
+		state.LastUpdatedTime = now
+		state.LockedBy = ""
+		state.LockExpiration = time.Time{}
+
+		// Save the actions from the most recent execution, if requested
+		if wi.State.LastActions != nil {
+			payload, err := proto.Marshal(&protos.OrchestratorResponse{
+				InstanceId: id,
+				Actions:    wi.State.LastActions,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to marshal last actions: %w", err)
+			}
+			state.LastActions = payload
+		}
+
+		// If continue-as-new, delete all existing history
+		if wi.State.ContinuedAsNew() {
+			state.History = nil
+		}
+
+		// Save new history events
+		for _, e := range wi.State.NewEvents() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+			state.History = append(state.History, eventPayload)
+		}
+
+		// Delete inbound events
+		remaining := make([]*pendingEvent, 0, len(state.PendingEvents)+len(selfEvents))
+		for _, e := range state.PendingEvents {
+			if e.LockedBy != wi.LockedBy {
+				remaining = append(remaining, e)
+			}
+		}
+		state.PendingEvents = append(remaining, selfEvents...)
+		hasPendingEvents = len(state.PendingEvents) > 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Events that were added while the work item was processed are delivered in a new work item
+	if hasPendingEvents {
+		if err := be.notify(id); err != nil {
+			return err
+		}
+	}
+
+	if msg := be.takeOrchestrationMessage(wi.InstanceID); msg != nil {
+		// The message is skipped if it's delivered again after failing to acknowledge it
+		if err := msg.Ack(); err != nil {
+			be.logger.Warnf("%v: failed to acknowledge the orchestration work-item: %v", wi.InstanceID, err)
+		}
+	}
+	return nil
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *jetStreamBackend) AbandonOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	var visibleTime time.Time
+	delay := wi.GetAbandonDelay()
+	if delay > 0 {
+		visibleTime = time.Now().UTC().Add(delay)
+	} else {
+		delay = 0
+	}
+
+	err := be.modify(string(wi.InstanceID), func(state *instanceState) error {
+		if state.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		abandoned := 0
+		for _, e := range state.PendingEvents {
+			if e.LockedBy == wi.LockedBy {
+				e.LockedBy = ""
+				e.VisibleTime = visibleTime
+				abandoned++
+			}
+		}
+		if abandoned == 0 {
+			return backend.ErrWorkItemLockLost
+		}
+
+		state.LockedBy = ""
+		state.LockExpiration = time.Time{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if msg := be.takeOrchestrationMessage(wi.InstanceID); msg != nil {
+		if err := msg.NakWithDelay(delay); err != nil {
+			return fmt.Errorf("failed to abandon the orchestration work-item: %w", err)
+		}
+		return nil
+	}
+	return be.notify(string(wi.InstanceID))
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *jetStreamBackend) RenewOrchestrationWorkItemLock(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	err := be.modify(string(wi.InstanceID), func(state *instanceState) error {
+		if state.LockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+		state.LockExpiration = time.Now().UTC().Add(be.options.OrchestrationLockTimeout)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The message is delivered again once its ack wait expires, unless it's marked as in progress
+	if msg := be.orchestrationMessage(wi.InstanceID); msg != nil {
+		if err := msg.InProgress(); err != nil {
+			return fmt.Errorf("failed to renew the lock on the orchestration work-item: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *jetStreamBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	msg, err := be.fetch(ctx, be.activitySub)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := msg.Metadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the activity work-item metadata: %w", err)
+	}
+	e, err := backend.UnmarshalHistoryEvent(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	wi := &backend.ActivityWorkItem{
+		SequenceNumber: int64(metadata.Sequence.Stream),
+		InstanceID:     api.InstanceID(msg.Header.Get(instanceIDHeader)),
+		NewEvent:       e,
+		LockedBy:       be.workerName,
+	}
+
+	be.lock.Lock()
+	be.activityMessages[wi.SequenceNumber] = msg
+	be.lock.Unlock()
+	return wi, nil
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+//
+// The result of an activity may be delivered more than once if its message can't be acknowledged.
+func (be *jetStreamBackend) CompleteActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	msg := be.takeActivityMessage(wi.SequenceNumber)
+	if msg == nil || wi.LockedBy != be.workerName {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err := be.addEvent(string(wi.InstanceID), wi.Result, nil); err != nil {
+		return err
+	}
+	if err := msg.AckSync(); err != nil {
+		return fmt.Errorf("failed to acknowledge the activity work-item: %w", err)
+	}
+	return nil
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *jetStreamBackend) AbandonActivityWorkItem(_ context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	msg := be.takeActivityMessage(wi.SequenceNumber)
+	if msg == nil || wi.LockedBy != be.workerName {
+		return backend.ErrWorkItemLockLost
+	}
+	if err := msg.Nak(); err != nil {
+		return fmt.Errorf("failed to abandon the activity work-item: %w", err)
+	}
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *jetStreamBackend) RenewActivityWorkItemLock(_ context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	msg := be.activityMessage(wi.SequenceNumber)
+	if msg == nil || wi.LockedBy != be.workerName {
+		return backend.ErrWorkItemLockLost
+	}
+	if err := msg.InProgress(); err != nil {
+		return fmt.Errorf("failed to renew the lock on the activity work-item: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *jetStreamBackend) GetOrchestrationLastActions(_ context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	state, _, err := be.read(string(iid))
+	if err != nil {
+		return nil, err
+	} else if state == nil || !state.Created {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(state.LastActions, res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *jetStreamBackend) PurgeOrchestrationState(_ context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	for {
+		state, revision, err := be.read(string(id))
+		if err != nil {
+			return err
+		} else if state == nil || !state.Created {
+			return api.ErrInstanceNotFound
+		} else if !isCompletedStatus(state.RuntimeStatus) {
+			return api.ErrNotCompleted
+		}
+
+		err = be.kv.Purge(instanceKey(string(id)), nats.LastRevision(revision))
+		if isConflict(err) {
+			// The instance was updated concurrently
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to purge the orchestration instance: %w", err)
+		}
+		return nil
+	}
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *jetStreamBackend) GetOrchestrationHistoriesBatch(_ context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	errs := make(map[api.InstanceID]error)
+	for iid, from := range fromSequenceNumbers {
+		state, _, err := be.read(string(iid))
+		if err != nil {
+			return nil, err
+		} else if state == nil || !state.Created {
+			errs[iid] = api.ErrInstanceNotFound
+			continue
+		}
+
+		events, err := state.history(from)
+		if err != nil {
+			errs[iid] = err
+			continue
+		}
+		histories[iid] = events
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *jetStreamBackend) GetOrphanedSubOrchestrations(context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	states, err := be.sortedInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for _, state := range states {
+		if state.ParentInstanceID == "" {
+			continue
+		}
+		switch state.RuntimeStatus {
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING,
+			protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED:
+		default:
+			continue
+		}
+		if parent, _, err := be.read(state.ParentInstanceID); err != nil {
+			return nil, err
+		} else if parent != nil && parent.Created && !isCompletedStatus(parent.RuntimeStatus) {
+			continue
+		}
+
+		metadata, err := state.metadata()
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *jetStreamBackend) QueryOrchestrationMetadata(_ context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	states, err := be.sortedInstances()
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ID < states[j].ID
+	})
+
+	pageSize := query.PageSizeOrDefault()
+	instances := make([]*api.OrchestrationMetadata, 0)
+	for _, state := range states {
+		if state.ID <= query.ContinuationToken || !strings.HasPrefix(state.ID, query.InstanceIDPrefix) {
+			continue
+		}
+		if query.Name != "" && state.Name != query.Name {
+			continue
+		}
+		if len(query.RuntimeStatuses) > 0 && !containsStatus(query.RuntimeStatuses, state.RuntimeStatus) {
+			continue
+		}
+		if !query.CreatedFrom.IsZero() && state.CreatedTime.Before(query.CreatedFrom) {
+			continue
+		}
+		if !query.CreatedTo.IsZero() && !state.CreatedTime.Before(query.CreatedTo) {
+			continue
+		}
+		if !query.TagFilter.Matches(state.Tags) {
+			continue
+		}
+
+		metadata, err := state.metadata()
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		instances = append(instances, metadata)
+		if len(instances) > pageSize {
+			break
+		}
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+//
+// The pending activity tasks of the instance are found by reading all the messages of the activities stream.
+func (be *jetStreamBackend) ExportOrchestrationInstance(_ context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	state, _, err := be.read(string(iid))
+	if err != nil {
+		return nil, err
+	} else if state == nil || !state.Created {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	exported := &backend.OrchestrationInstanceState{
+		PendingEvents: make([]*backend.HistoryEvent, 0, len(state.PendingEvents)),
+		PendingTasks:  make([]*backend.HistoryEvent, 0),
+	}
+	if exported.Metadata, err = state.metadata(); err != nil {
+		return nil, err
+	}
+	if exported.History, err = state.history(0); err != nil {
+		return nil, err
+	}
+	for _, e := range state.PendingEvents {
+		event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+		if err != nil {
+			return nil, err
+		}
+		exported.PendingEvents = append(exported.PendingEvents, event)
+	}
+
+	info, err := be.js.StreamInfo(be.activitiesName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the activities stream: %w", err)
+	}
+	for seq := info.State.FirstSeq; seq > 0 && seq <= info.State.LastSeq; seq++ {
+		msg, err := be.js.GetMsg(be.activitiesName(), seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			// The activity task was completed
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read the activity tasks: %w", err)
+		} else if msg.Header.Get(instanceIDHeader) != string(iid) {
+			continue
+		}
+
+		event, err := backend.UnmarshalHistoryEvent(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		exported.PendingTasks = append(exported.PendingTasks, event)
+	}
+	return exported, nil
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *jetStreamBackend) ImportOrchestrationInstance(_ context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	imported := &instanceState{
+		ID:               id,
+		Created:          true,
+		Name:             metadata.Name,
+		Version:          startEvent.GetVersion().GetValue(),
+		ExecutionID:      startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		RuntimeStatus:    metadata.RuntimeStatus,
+		CreatedTime:      metadata.CreatedAt.UTC(),
+		LastUpdatedTime:  metadata.LastUpdatedAt.UTC(),
+		Input:            metadata.SerializedInput,
+		Output:           metadata.SerializedOutput,
+		CustomStatus:     metadata.SerializedCustomStatus,
+		ParentInstanceID: startEvent.GetParentInstance().GetOrchestrationInstance().GetInstanceId(),
+		GenerationCount:  metadata.GenerationCount,
+		Tags:             metadata.Tags,
+		History:          make([][]byte, 0, len(state.History)),
+		PendingEvents:    make([]*pendingEvent, 0, len(state.PendingEvents)),
+	}
+	if metadata.IsComplete() {
+		imported.CompletedTime = imported.LastUpdatedTime
+	}
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		imported.FailureDetails = bytes
+	}
+	for _, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		imported.History = append(imported.History, eventPayload)
+	}
+	for _, e := range state.PendingEvents {
+		// Timers and scheduled starts must stay invisible to workers until they're due
+		var visibleTime time.Time
+		if tf := e.GetTimerFired(); tf != nil {
+			visibleTime = tf.GetFireAt().AsTime()
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			visibleTime = ts.AsTime()
+		}
+		event, err := newPendingEvent(e, visibleTime)
+		if err != nil {
+			return err
+		}
+		imported.PendingEvents = append(imported.PendingEvents, event)
+	}
+
+	value, err := json.Marshal(imported)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the orchestration instance: %w", err)
+	}
+	if _, err := be.kv.Create(instanceKey(id), value); isConflict(err) {
+		return backend.ErrDuplicateEvent
+	} else if err != nil {
+		return fmt.Errorf("failed to create the orchestration instance: %w", err)
+	}
+
+	for _, e := range state.PendingTasks {
+		if err := be.publish(be.activitiesName(), id, e); err != nil {
+			return err
+		}
+	}
+	if len(imported.PendingEvents) > 0 {
+		return be.notify(id)
+	}
+	return nil
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *jetStreamBackend) GetOrchestrationStats(_ context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	states, err := be.sortedInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, state := range states {
+		if state.Name != name {
+			continue
+		}
+		if !state.CreatedTime.Before(since) {
+			stats.Started++
+		}
+		if state.CompletedTime.IsZero() || state.CompletedTime.Before(since) {
+			continue
+		}
+		switch state.RuntimeStatus {
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED:
+			stats.Completed++
+		case protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED:
+			stats.Failed++
+		default:
+			continue
+		}
+		d := state.CompletedTime.Sub(state.CreatedTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*jetStreamBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*jetStreamBackend) Stop(context.Context) error {
+	return nil
+}
+
+// connect connects to the NATS server, unless the backend is already connected.
+func (be *jetStreamBackend) connect() error {
+	if be.nc != nil {
+		return nil
+	}
+	nc, err := nats.Connect(be.options.URL, be.options.ConnectOptions...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to create the JetStream context: %w", err)
+	}
+	be.nc = nc
+	be.js = js
+	return nil
+}
+
+func (be *jetStreamBackend) ensureDB() error {
+	if be.kv == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *jetStreamBackend) String() string {
+	return fmt.Sprintf("jetstream::%s/%s", be.options.URL, be.options.TaskHubName)
+}
+
+func (be *jetStreamBackend) orchestrationsName() string {
+	return be.options.TaskHubName + "-orchestrations"
+}
+
+func (be *jetStreamBackend) activitiesName() string {
+	return be.options.TaskHubName + "-activities"
+}
+
+func (be *jetStreamBackend) instancesName() string {
+	return be.options.TaskHubName + "-instances"
+}
+
+// subject returns the subject of the messages of a stream.
+func (be *jetStreamBackend) subject(stream string) string {
+	return be.options.TaskHubName + "." + stream[len(be.options.TaskHubName)+1:]
+}
+
+// createInstance creates an orchestration instance and adds its ExecutionStarted event.
+func (be *jetStreamBackend) createInstance(e *backend.HistoryEvent) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime time.Time
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime()
+	}
+	event, err := newPendingEvent(e, visibleTime)
+	if err != nil {
+		return err
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	id := startEvent.OrchestrationInstance.InstanceId
+	err = be.modify(id, func(state *instanceState) error {
+		if state.Created {
+			return backend.ErrDuplicateEvent
+		}
+
+		state.Created = true
+		state.Name = startEvent.Name
+		state.Version = startEvent.Version.GetValue()
+		state.ExecutionID = startEvent.OrchestrationInstance.ExecutionId.GetValue()
+		state.RuntimeStatus = protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING
+		state.CreatedTime = e.Timestamp.AsTime()
+		state.LastUpdatedTime = time.Now().UTC()
+		state.Input = startEvent.Input.GetValue()
+		state.ParentInstanceID = startEvent.GetParentInstance().GetOrchestrationInstance().GetInstanceId()
+		state.Tags = helpers.GetTags(startEvent)
+		state.PendingEvents = append(state.PendingEvents, event)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return be.notify(id)
+}
+
+// addEvent adds a new event to the pending events of an orchestration instance, after checking the state of the
+// instance with check, unless it's nil, and notifies the workers.
+func (be *jetStreamBackend) addEvent(id string, e *backend.HistoryEvent, check func(state *instanceState) error) error {
+	event, err := newPendingEvent(e, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	err = be.modify(id, func(state *instanceState) error {
+		if check != nil {
+			if err := check(state); err != nil {
+				return err
+			}
+		}
+		state.PendingEvents = append(state.PendingEvents, event)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return be.notify(id)
+}
+
+// read reads the state of an orchestration instance and its revision, or returns nil if it doesn't exist.
+func (be *jetStreamBackend) read(id string) (*instanceState, uint64, error) {
+	entry, err := be.kv.Get(instanceKey(id))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("failed to read the orchestration instance: %w", err)
+	}
+
+	state := new(instanceState)
+	if err := json.Unmarshal(entry.Value(), state); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal the orchestration instance: %w", err)
+	}
+	return state, entry.Revision(), nil
+}
+
+// modify applies fn to the state of an orchestration instance, which is created if it doesn't exist, and saves it,
+// unless fn returns errNoChange. fn is called again with the latest state if the instance is updated concurrently.
+func (be *jetStreamBackend) modify(id string, fn func(state *instanceState) error) error {
+	for {
+		state, revision, err := be.read(id)
+		if err != nil {
+			return err
+		} else if state == nil {
+			state = &instanceState{ID: id}
+		}
+
+		if err := fn(state); err == errNoChange {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to marshal the orchestration instance: %w", err)
+		}
+		if revision == 0 {
+			_, err = be.kv.Create(instanceKey(id), value)
+		} else {
+			_, err = be.kv.Update(instanceKey(id), value, revision)
+		}
+		if isConflict(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to save the orchestration instance: %w", err)
+		}
+		return nil
+	}
+}
+
+// notify publishes a message to the orchestrations stream, so that the pending events of an instance are processed.
+func (be *jetStreamBackend) notify(id string) error {
+	msg := nats.NewMsg(be.subject(be.orchestrationsName()))
+	msg.Header.Set(instanceIDHeader, id)
+	if _, err := be.js.PublishMsg(msg); err != nil {
+		return fmt.Errorf("failed to publish the orchestration work-item: %w", err)
+	}
+	return nil
+}
+
+// publish publishes an event of an orchestration instance to a stream.
+func (be *jetStreamBackend) publish(stream string, id string, e *backend.HistoryEvent) error {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(be.subject(stream))
+	msg.Header.Set(instanceIDHeader, id)
+	msg.Data = eventPayload
+	if _, err := be.js.PublishMsg(msg); err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %w", stream, err)
+	}
+	return nil
+}
+
+// fetch waits for the next message of a subscription, for up to MaxFetchWait.
+func (be *jetStreamBackend) fetch(ctx context.Context, sub *nats.Subscription) (*nats.Msg, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, be.options.MaxFetchWait)
+	defer cancel()
+
+	msgs, err := sub.Fetch(1, nats.Context(fetchCtx))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) || (err == nil && len(msgs) == 0) {
+		// No new work items to process
+		return nil, backend.ErrNoWorkItems
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch a work-item: %w", err)
+	}
+	return msgs[0], nil
+}
+
+func (be *jetStreamBackend) orchestrationMessage(iid api.InstanceID) *nats.Msg {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	return be.orchestrationMessages[iid]
+}
+
+func (be *jetStreamBackend) activityMessage(sequenceNumber int64) *nats.Msg {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	return be.activityMessages[sequenceNumber]
+}
+
+func (be *jetStreamBackend) takeOrchestrationMessage(iid api.InstanceID) *nats.Msg {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	msg := be.orchestrationMessages[iid]
+	delete(be.orchestrationMessages, iid)
+	return msg
+}
+
+func (be *jetStreamBackend) takeActivityMessage(sequenceNumber int64) *nats.Msg {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
+	msg := be.activityMessages[sequenceNumber]
+	delete(be.activityMessages, sequenceNumber)
+	return msg
+}
+
+// sortedInstances returns all the created instances ordered by creation time and instance ID.
+func (be *jetStreamBackend) sortedInstances() ([]*instanceState, error) {
+	keys, err := be.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return []*instanceState{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list the orchestration instances: %w", err)
+	}
+
+	states := make([]*instanceState, 0, len(keys))
+	for _, key := range keys {
+		id, err := base64.RawURLEncoding.DecodeString(key)
+		if err != nil {
+			continue
+		}
+		state, _, err := be.read(string(id))
+		if err != nil {
+			return nil, err
+		} else if state == nil || !state.Created {
+			continue
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if !states[i].CreatedTime.Equal(states[j].CreatedTime) {
+			return states[i].CreatedTime.Before(states[j].CreatedTime)
+		}
+		return states[i].ID < states[j].ID
+	})
+	return states, nil
+}
+
+func (state *instanceState) history(from int) ([]*backend.HistoryEvent, error) {
+	if from < 0 {
+		from = 0
+	}
+	if from > len(state.History) {
+		from = len(state.History)
+	}
+
+	events := make([]*backend.HistoryEvent, 0, len(state.History)-from)
+	for _, eventPayload := range state.History[from:] {
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (state *instanceState) metadata() (*api.OrchestrationMetadata, error) {
+	var failureDetails *protos.TaskFailureDetails
+	if len(state.FailureDetails) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(state.FailureDetails, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(state.ID),
+		state.Name,
+		state.RuntimeStatus,
+		state.CreatedTime,
+		state.LastUpdatedTime,
+		state.Input,
+		state.Output,
+		state.CustomStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = state.GenerationCount
+	metadata.Tags = state.Tags
+	return metadata, nil
+}
+
+func (e *pendingEvent) isVisible(now time.Time) bool {
+	return e.VisibleTime.IsZero() || !e.VisibleTime.After(now)
+}
+
+func newPendingEvent(e *backend.HistoryEvent, visibleTime time.Time) (*pendingEvent, error) {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingEvent{VisibleTime: visibleTime, EventPayload: eventPayload}, nil
+}
+
+// nextVisibleTime returns the time at which the pending events of an instance can be processed, or nil if there are
+// no events. Instances that haven't started yet wait for all of their events to become visible, so that they start
+// at their scheduled start time.
+func nextVisibleTime(events []*pendingEvent, historyLength int) *time.Time {
+	var visibleTime *time.Time
+	for _, e := range events {
+		t := e.VisibleTime
+		if visibleTime == nil || (historyLength > 0 && t.Before(*visibleTime)) || (historyLength == 0 && t.After(*visibleTime)) {
+			visibleTime = &t
+		}
+	}
+	return visibleTime
+}
+
+// instanceKey encodes an instance ID as a key of the key/value bucket, which only allows a limited set of characters.
+func instanceKey(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// isConflict returns true if err is caused by an optimistic concurrency check.
+func isConflict(err error) bool {
+	var apiErr *nats.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence
+}
+
+func validateEvent(e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+	return nil
+}
+
+func isCompletedStatus(status protos.OrchestrationStatus) bool {
+	return status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED ||
+		status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED ||
+		status == protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED
+}
+
+func containsStatus(statuses []protos.OrchestrationStatus, status protos.OrchestrationStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package jetstream
+
+import (
+	"net/url"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+// The "nats" scheme connects to a NATS server with JetStream enabled, e.g. "nats://localhost:4222".
+func init() {
+	backend.Register("nats", func(u *url.URL, logger backend.Logger) (backend.Backend, error) {
+		return NewJetStreamBackend(NewJetStreamOptions(u.String()), logger), nil
+	})
+}
@@ -0,0 +1,646 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/segmentio/kafka-go"
+)
+
+type KafkaOptions struct {
+	// Brokers are the addresses of the Kafka brokers, e.g. "localhost:9092".
+	Brokers []string
+
+	// Topic is the name of the topic that transports the new orchestration events.
+	Topic string
+
+	// ResultsTopic is the name of the topic that transports the results of activities.
+	ResultsTopic string
+
+	// GroupID is the ID of the consumer group that ingests the events of the topics into the store. All the
+	// instances of an app that share a task hub must use the same group ID.
+	GroupID string
+
+	// Partitions is the number of partitions of the topics when they're created by CreateTaskHub. Events are
+	// partitioned by instance ID, so the events of an orchestration instance are always ingested in the order they
+	// were sent.
+	Partitions int
+
+	// ReplicationFactor is the replication factor of the topics when they're created by CreateTaskHub.
+	ReplicationFactor int
+
+	// BatchSize is the maximum number of events that are ingested into the store in a single round trip.
+	BatchSize int
+
+	// BatchWait is how long the consumer waits for more events before it ingests an incomplete batch.
+	BatchWait time.Duration
+
+	// RetryInterval is how long the consumer waits before it retries ingesting a batch of events that the store
+	// failed to ingest.
+	RetryInterval time.Duration
+}
+
+type kafkaBackend struct {
+	backend.Backend
+
+	options *KafkaOptions
+	logger  backend.Logger
+	writer  *kafka.Writer
+
+	lock   sync.Mutex
+	reader *kafka.Reader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewKafkaOptions creates a new options object for the Kafka event transport.
+func NewKafkaOptions(brokers ...string) *KafkaOptions {
+	// Default values are provided for required options
+	return &KafkaOptions{
+		Brokers:           brokers,
+		Topic:             "durabletask-events",
+		ResultsTopic:      "durabletask-activity-results",
+		GroupID:           "durabletask",
+		Partitions:        16,
+		ReplicationFactor: 1,
+		BatchSize:         100,
+		BatchWait:         100 * time.Millisecond,
+		RetryInterval:     time.Second,
+	}
+}
+
+// NewKafkaBackend creates a new Backend object that sends new orchestration events through a Kafka topic and
+// persists them, along with the history and the work items of the task hub, in the specified store, e.g. a backend
+// created by [sqlite.NewSqliteBackend] or [postgres.NewPostgresBackend].
+//
+// [backend.Backend.AddNewOrchestrationEvent] and [backend.BackendWithIngest.IngestOperations] publish the events,
+// other than ExecutionStarted events, to the topic and return as soon as all the in-sync replicas have acknowledged
+// them. The topic is partitioned by instance ID, so the events of an instance are delivered in order, and they can be
+// replayed by resetting the offsets of the consumer group. Start runs a consumer of the group that ingests the events
+// into the store in batches with [backend.IngestOperations], and commits their offsets once the store has committed
+// them, so events are ingested at least once.
+//
+// Activity results are published to a separate topic, which the consumer ingests in the same way, and then their work
+// items are deleted from the store, so results are delivered at least once; orchestrations ignore the results of
+// activities that they already received. This requires a store that implements
+// [backend.BackendWithExternalActivityResults], and the results bypass the topic otherwise.
+//
+// Creating orchestration instances and adding events with preconditions, i.e.
+// [backend.BackendWithConditionalEvents.AddNewOrchestrationEventIf], bypass the topics, since the store must check
+// for duplicate instances and preconditions synchronously. The messages that orchestrations send to other instances
+// also bypass the topics, since the store commits them atomically with the completion of their work items.
+func NewKafkaBackend(store backend.Backend, opts *KafkaOptions, logger backend.Logger) backend.Backend {
+	if opts == nil {
+		opts = NewKafkaOptions()
+	}
+	return &kafkaBackend{
+		Backend: store,
+		options: opts,
+		logger:  logger,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(opts.Brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}
+}
+
+// CreateTaskHub implements backend.Backend
+func (be *kafkaBackend) CreateTaskHub(ctx context.Context) error {
+	if err := be.Backend.CreateTaskHub(ctx); err != nil && !errors.Is(err, backend.ErrTaskHubExists) {
+		return err
+	}
+
+	conn, err := be.dialController(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, topic := range be.topics() {
+		err = conn.CreateTopics(kafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     be.options.Partitions,
+			ReplicationFactor: be.options.ReplicationFactor,
+		})
+		if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+			return fmt.Errorf("failed to create the %s topic: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// DeleteTaskHub implements backend.Backend
+func (be *kafkaBackend) DeleteTaskHub(ctx context.Context) error {
+	if err := be.Backend.DeleteTaskHub(ctx); err != nil {
+		return err
+	}
+
+	conn, err := be.dialController(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, topic := range be.topics() {
+		if err := conn.DeleteTopics(topic); err != nil && !errors.Is(err, kafka.UnknownTopicOrPartition) {
+			return fmt.Errorf("failed to delete the %s topic: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *kafkaBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	msg, err := newMessage(be.options.Topic, iid, e)
+	if err != nil {
+		return err
+	}
+	if err := be.writer.WriteMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to publish event to the %s topic: %w", be.options.Topic, err)
+	}
+	return nil
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *kafkaBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	external, ok := backend.As[backend.BackendWithExternalActivityResults](be.Backend)
+	if !ok {
+		return be.Backend.CompleteActivityWorkItem(ctx, wi)
+	}
+
+	// The result is published before the work item is deleted, so that it isn't lost if the deletion fails
+	msg, err := newMessage(be.options.ResultsTopic, wi.InstanceID, wi.Result)
+	if err != nil {
+		return err
+	}
+	if err := be.writer.WriteMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to publish activity result to the %s topic: %w", be.options.ResultsTopic, err)
+	}
+	return external.DeleteActivityWorkItem(ctx, wi)
+}
+
+// IngestOperations implements backend.BackendWithIngest
+func (be *kafkaBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	errs := make([]error, len(ops))
+
+	// Instances are created synchronously, so that duplicates are reported to the caller. They're created before
+	// the other events are published, so that events sent to new instances are never ingested before them.
+	var starts []*backend.IngestOperation
+	var startIndexes []int
+	var msgs []kafka.Message
+	var msgIndexes []int
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			starts = append(starts, op)
+			startIndexes = append(startIndexes, i)
+			continue
+		}
+		msg, err := newMessage(be.options.Topic, op.InstanceID, op.Event)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msgs = append(msgs, msg)
+		msgIndexes = append(msgIndexes, i)
+	}
+
+	if len(starts) > 0 {
+		startErrs, err := backend.IngestOperations(ctx, be.Backend, starts)
+		if err != nil {
+			return nil, err
+		}
+		for j, err := range startErrs {
+			errs[startIndexes[j]] = err
+		}
+	}
+
+	if len(msgs) > 0 {
+		if err := be.writer.WriteMessages(ctx, msgs...); err != nil {
+			var writeErrs kafka.WriteErrors
+			if !errors.As(err, &writeErrs) {
+				return nil, fmt.Errorf("failed to publish events to the %s topic: %w", be.options.Topic, err)
+			}
+			for j, err := range writeErrs {
+				if err != nil {
+					errs[msgIndexes[j]] = fmt.Errorf("failed to publish event to the %s topic: %w", be.options.Topic, err)
+				}
+			}
+		}
+	}
+	return errs, nil
+}
+
+// Start implements backend.Backend
+func (be *kafkaBackend) Start(ctx context.Context) error {
+	if err := be.Backend.Start(ctx); err != nil {
+		return err
+	}
+
+	be.lock.Lock()
+	defer be.lock.Unlock()
+	if be.reader != nil {
+		return nil
+	}
+
+	be.reader = kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     be.options.Brokers,
+		GroupID:     be.options.GroupID,
+		GroupTopics: be.topics(),
+	})
+	consumeCtx, cancel := context.WithCancel(context.Background())
+	be.cancel = cancel
+	be.done = make(chan struct{})
+	go be.consume(consumeCtx, be.reader, be.done)
+	return nil
+}
+
+// Stop implements backend.Backend
+func (be *kafkaBackend) Stop(ctx context.Context) error {
+	be.lock.Lock()
+	reader, cancel, done := be.reader, be.cancel, be.done
+	be.reader, be.cancel, be.done = nil, nil, nil
+	be.lock.Unlock()
+
+	if reader != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := reader.Close(); err != nil {
+			be.logger.Warnf("failed to close the consumer of the %s topics: %v", strings.Join(be.topics(), " and "), err)
+		}
+	}
+	if err := be.writer.Close(); err != nil {
+		be.logger.Warnf("failed to close the producer of the %s topics: %v", strings.Join(be.topics(), " and "), err)
+	}
+	return be.Backend.Stop(ctx)
+}
+
+// WatchOrchestrationRuntimeStatus implements backend.BackendWithWatch
+func (be *kafkaBackend) WatchOrchestrationRuntimeStatus(ctx context.Context, id api.InstanceID) (<-chan *api.OrchestrationMetadata, error) {
+	watcher, ok := backend.As[backend.BackendWithWatch](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return watcher.WatchOrchestrationRuntimeStatus(ctx, id)
+}
+
+// RecordActivityHeartbeat implements backend.BackendWithActivityHeartbeats
+func (be *kafkaBackend) RecordActivityHeartbeat(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	heartbeats, ok := backend.As[backend.BackendWithActivityHeartbeats](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return heartbeats.RecordActivityHeartbeat(ctx, wi)
+}
+
+// GetActivityWorkItemsFromQueues implements backend.BackendWithActivityQueues
+func (be *kafkaBackend) GetActivityWorkItemsFromQueues(ctx context.Context, queues []string, max int) ([]*backend.ActivityWorkItem, error) {
+	queued, ok := backend.As[backend.BackendWithActivityQueues](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return queued.GetActivityWorkItemsFromQueues(ctx, queues, max)
+}
+
+// DeadLetterOrchestrationWorkItem implements backend.BackendWithDeadLetters
+func (be *kafkaBackend) DeadLetterOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem, reason string) error {
+	deadLetters, ok := backend.As[backend.BackendWithDeadLetters](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, reason)
+}
+
+// DeadLetterActivityWorkItem implements backend.BackendWithDeadLetters
+func (be *kafkaBackend) DeadLetterActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem, reason string) error {
+	deadLetters, ok := backend.As[backend.BackendWithDeadLetters](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return deadLetters.DeadLetterActivityWorkItem(ctx, wi, reason)
+}
+
+// ListDeadLetters implements backend.BackendWithDeadLetters
+func (be *kafkaBackend) ListDeadLetters(ctx context.Context) ([]*backend.DeadLetter, error) {
+	deadLetters, ok := backend.As[backend.BackendWithDeadLetters](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return deadLetters.ListDeadLetters(ctx)
+}
+
+// ResubmitDeadLetter implements backend.BackendWithDeadLetters
+func (be *kafkaBackend) ResubmitDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, ok := backend.As[backend.BackendWithDeadLetters](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return deadLetters.ResubmitDeadLetter(ctx, id)
+}
+
+// DeleteDeadLetter implements backend.BackendWithDeadLetters
+func (be *kafkaBackend) DeleteDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, ok := backend.As[backend.BackendWithDeadLetters](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return deadLetters.DeleteDeadLetter(ctx, id)
+}
+
+// GetOrchestrationLastActions implements backend.BackendWithLastActions
+func (be *kafkaBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	lastActions, ok := backend.As[backend.BackendWithLastActions](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return lastActions.GetOrchestrationLastActions(ctx, iid)
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *kafkaBackend) PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error) {
+	purger, ok := backend.As[backend.BackendWithBulkPurge](be.Backend)
+	if !ok {
+		return 0, "", backend.ErrNotSupported
+	}
+	return purger.PurgeOrchestrationStateBatch(ctx, query)
+}
+
+// GetOrchestrationStats implements backend.BackendWithStats
+func (be *kafkaBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	statistics, ok := backend.As[backend.BackendWithStats](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return statistics.GetOrchestrationStats(ctx, name, since)
+}
+
+// AddNewOrchestrationEventIf implements backend.BackendWithConditionalEvents
+func (be *kafkaBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	conditional, ok := backend.As[backend.BackendWithConditionalEvents](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return conditional.AddNewOrchestrationEventIf(ctx, iid, e, statuses)
+}
+
+// GetOrchestrationHistoriesBatch implements backend.BackendWithHistoriesBatch
+func (be *kafkaBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	batch, ok := backend.As[backend.BackendWithHistoriesBatch](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return batch.GetOrchestrationHistoriesBatch(ctx, fromSequenceNumbers)
+}
+
+// GetOrphanedSubOrchestrations implements backend.BackendWithOrphanQueries
+func (be *kafkaBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	orphans, ok := backend.As[backend.BackendWithOrphanQueries](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return orphans.GetOrphanedSubOrchestrations(ctx)
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *kafkaBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	migrator, ok := backend.As[backend.BackendWithMigration](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return migrator.ExportOrchestrationInstance(ctx, iid)
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *kafkaBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	migrator, ok := backend.As[backend.BackendWithMigration](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return migrator.ImportOrchestrationInstance(ctx, state)
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *kafkaBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	querier, ok := backend.As[backend.BackendWithQueries](be.Backend)
+	if !ok {
+		return api.InstanceQueryResult{}, backend.ErrNotSupported
+	}
+	return querier.QueryOrchestrationMetadata(ctx, query)
+}
+
+// GetActivityWorkItems implements backend.BackendWithActivityBatches
+func (be *kafkaBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*backend.ActivityWorkItem, error) {
+	batched, ok := backend.As[backend.BackendWithActivityBatches](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return batched.GetActivityWorkItems(ctx, max)
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *kafkaBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	renewer, ok := backend.As[backend.BackendWithLockRenewal](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return renewer.RenewOrchestrationWorkItemLock(ctx, wi)
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *kafkaBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	renewer, ok := backend.As[backend.BackendWithLockRenewal](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return renewer.RenewActivityWorkItemLock(ctx, wi)
+}
+
+// GetActivityWorkItemsWithFilter implements backend.BackendWithActivityFilters
+func (be *kafkaBackend) GetActivityWorkItemsWithFilter(ctx context.Context, filter backend.ActivityWorkItemFilter, max int) ([]*backend.ActivityWorkItem, error) {
+	filtered, ok := backend.As[backend.BackendWithActivityFilters](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return filtered.GetActivityWorkItemsWithFilter(ctx, filter, max)
+}
+
+// GetOrchestrationWorkItemWithFilter implements backend.BackendWithOrchestrationFilters
+func (be *kafkaBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	filtered, ok := backend.As[backend.BackendWithOrchestrationFilters](be.Backend)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return filtered.GetOrchestrationWorkItemWithFilter(ctx, filter)
+}
+
+// DeferOrchestrationWorkItem implements backend.BackendWithDeferrals
+func (be *kafkaBackend) DeferOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem, delay time.Duration) error {
+	deferrals, ok := backend.As[backend.BackendWithDeferrals](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return deferrals.DeferOrchestrationWorkItem(ctx, wi, delay)
+}
+
+// DeferActivityWorkItem implements backend.BackendWithDeferrals
+func (be *kafkaBackend) DeferActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem, delay time.Duration) error {
+	deferrals, ok := backend.As[backend.BackendWithDeferrals](be.Backend)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+	return deferrals.DeferActivityWorkItem(ctx, wi, delay)
+}
+
+// Unwrap implements backend.BackendWrapper
+func (be *kafkaBackend) Unwrap() backend.Backend {
+	return be.Backend
+}
+
+func (be *kafkaBackend) String() string {
+	return fmt.Sprintf("kafka::%s/%s+%v", strings.Join(be.options.Brokers, ","), be.options.Topic, be.Backend)
+}
+
+// topics returns the names of the topics of the task hub.
+func (be *kafkaBackend) topics() []string {
+	return []string{be.options.Topic, be.options.ResultsTopic}
+}
+
+// consume ingests the events of the topics into the store in batches until ctx is canceled.
+func (be *kafkaBackend) consume(ctx context.Context, reader *kafka.Reader, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			be.logger.Warnf("failed to fetch events from the %s topics: %v", strings.Join(be.topics(), " and "), err)
+			if !sleep(ctx, be.options.RetryInterval) {
+				return
+			}
+			continue
+		}
+
+		batch := []kafka.Message{msg}
+		for len(batch) < be.options.BatchSize {
+			fetchCtx, cancel := context.WithTimeout(ctx, be.options.BatchWait)
+			msg, err := reader.FetchMessage(fetchCtx)
+			cancel()
+			if err != nil {
+				break
+			}
+			batch = append(batch, msg)
+		}
+
+		// The offsets are only committed once the store has committed the events, so a batch that fails is retried
+		// until it succeeds.
+		for !be.ingest(ctx, batch) {
+			if !sleep(ctx, be.options.RetryInterval) {
+				return
+			}
+		}
+		for {
+			err := reader.CommitMessages(ctx, batch...)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			be.logger.Warnf("failed to commit the offsets of %d events of the %s topics: %v", len(batch), strings.Join(be.topics(), " and "), err)
+			if !sleep(ctx, be.options.RetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// ingest adds a batch of events to the store and reports whether the store committed the batch. Events that can't
+// be decoded or that the store rejects are dropped, since they would fail again if they were retried.
+func (be *kafkaBackend) ingest(ctx context.Context, batch []kafka.Message) bool {
+	ops := make([]*backend.IngestOperation, 0, len(batch))
+	topics := make([]string, 0, len(batch))
+	for _, msg := range batch {
+		e, err := backend.UnmarshalHistoryEvent(msg.Value)
+		if err != nil {
+			be.logger.Warnf("dropping event at offset %d of partition %d of the %s topic: %v", msg.Offset, msg.Partition, msg.Topic, err)
+			continue
+		}
+		ops = append(ops, &backend.IngestOperation{InstanceID: api.InstanceID(msg.Key), Event: e})
+		topics = append(topics, msg.Topic)
+	}
+	if len(ops) == 0 {
+		return true
+	}
+
+	errs, err := backend.IngestOperations(ctx, be.Backend, ops)
+	if err != nil {
+		if ctx.Err() == nil {
+			be.logger.Warnf("failed to ingest %d events of the %s topics: %v", len(ops), strings.Join(be.topics(), " and "), err)
+		}
+		return false
+	}
+	for i, err := range errs {
+		if err != nil {
+			be.logger.Warnf("%v: dropping event of the %s topic: %v", ops[i].InstanceID, topics[i], err)
+		}
+	}
+	return true
+}
+
+// dialController connects to the controller of the Kafka cluster, which is the only broker that can create and
+// delete topics.
+func (be *kafkaBackend) dialController(ctx context.Context) (*kafka.Conn, error) {
+	if len(be.options.Brokers) == 0 {
+		return nil, errors.New("no Kafka brokers are configured")
+	}
+
+	conn, err := kafka.DialContext(ctx, "tcp", be.options.Brokers[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka: %w", err)
+	}
+	defer conn.Close()
+
+	controller, err := conn.Controller()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the Kafka controller: %w", err)
+	}
+	controllerConn, err := kafka.DialContext(ctx, "tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the Kafka controller: %w", err)
+	}
+	return controllerConn, nil
+}
+
+func newMessage(topic string, iid api.InstanceID, e *backend.HistoryEvent) (kafka.Message, error) {
+	bytes, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{Topic: topic, Key: []byte(iid), Value: bytes}, nil
+}
+
+// sleep waits for d and reports whether ctx is still alive.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,451 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// MetadataStore stores a projection of the metadata of orchestration instances, such as their runtime status and
+// timestamps, separately from their history. Reading the metadata of an orchestration from the projection is a single
+// lookup that never reads or replays its history, which keeps status queries fast for orchestrations with large
+// histories.
+//
+// Backends that keep metadata in the same storage as the history, like the sqlite backend does with its Instances
+// table, can update the projection in the same transaction as the history, which makes it strongly consistent with
+// the history. Other backends can use [NewMetadataProjectionBackend] to maintain the projection in a separate store.
+//
+// Implementations must be safe for concurrent use.
+type MetadataStore interface {
+	// GetOrchestrationMetadata gets the projected metadata of the specified orchestration instance.
+	//
+	// Returns [api.ErrInstanceNotFound] if the store doesn't contain metadata for the orchestration instance.
+	GetOrchestrationMetadata(context.Context, api.InstanceID) (*api.OrchestrationMetadata, error)
+
+	// SaveOrchestrationMetadata creates or replaces the projected metadata of an orchestration instance.
+	SaveOrchestrationMetadata(context.Context, *api.OrchestrationMetadata) error
+
+	// DeleteOrchestrationMetadata deletes the projected metadata of the specified orchestration instance, if any.
+	DeleteOrchestrationMetadata(context.Context, api.InstanceID) error
+}
+
+// ProjectOrchestrationMetadata returns the metadata of an orchestration after the specified runtime state was
+// saved, given its previously projected metadata, which is nil for new orchestrations. The projection only looks at
+// the summary kept by the runtime state and at the changes made by the current work item, so its cost doesn't depend
+// on the size of the orchestration history. The previous metadata isn't modified.
+func ProjectOrchestrationMetadata(previous *api.OrchestrationMetadata, state *OrchestrationRuntimeState, now time.Time) *api.OrchestrationMetadata {
+	var metadata api.OrchestrationMetadata
+	if previous != nil {
+		metadata = *previous
+	}
+	metadata.InstanceID = state.InstanceID()
+	metadata.RuntimeStatus = state.RuntimeStatus()
+	metadata.LastUpdatedAt = now
+
+	if name, err := state.Name(); err == nil {
+		metadata.Name = name
+	}
+	if createdAt, err := state.CreatedTime(); err == nil {
+		metadata.CreatedAt = createdAt
+	}
+	if tags, err := state.Tags(); err == nil {
+		metadata.Tags = tags
+	}
+	if input, err := state.Input(); err == nil {
+		metadata.SerializedInput = input
+	}
+	if output, err := state.Output(); err == nil {
+		metadata.SerializedOutput = output
+		metadata.FailureDetails, _ = state.FailureDetails()
+	}
+	if state.CustomStatus != nil {
+		metadata.SerializedCustomStatus = state.CustomStatus.GetValue()
+	}
+	metadata.GenerationCount += state.ContinuedAsNewCount()
+	return &metadata
+}
+
+// metadataProjectionBackend is a Backend that maintains a projection of the metadata of orchestration instances in a
+// separate MetadataStore, and serves metadata queries from it.
+type metadataProjectionBackend struct {
+	Backend
+	store  MetadataStore
+	logger Logger
+}
+
+// NewMetadataProjectionBackend wraps the specified backend so that the metadata of orchestration instances is
+// projected into the specified store whenever an orchestration is created or a work item is completed, and so that
+// [Backend.GetOrchestrationMetadata] is served from the store instead of the wrapped backend.
+//
+// The projection is eventually consistent with the history: it's updated after the wrapped backend commits a work
+// item, so readers can briefly observe the metadata from before the work item. Failures to update the projection are
+// logged instead of failing the work item, since the history was already committed, and are corrected by the next
+// work item of the orchestration. Metadata that's missing from the store is read from the wrapped backend.
+//
+// The projected metadata of an orchestration instance is deleted with [Backend.PurgeOrchestrationState]. The wrapper
+// doesn't forward [BackendWithBulkPurge], since batch purges don't report which orchestration instances they purged,
+// so purges of many orchestrations purge them one at a time instead.
+func NewMetadataProjectionBackend(be Backend, store MetadataStore, logger Logger) Backend {
+	return &metadataProjectionBackend{Backend: be, store: store, logger: logger}
+}
+
+// CreateOrchestrationInstance implements Backend
+func (be *metadataProjectionBackend) CreateOrchestrationInstance(ctx context.Context, e *HistoryEvent) error {
+	if err := be.Backend.CreateOrchestrationInstance(ctx, e); err != nil {
+		return err
+	}
+
+	be.savePendingMetadata(ctx, e)
+	return nil
+}
+
+// IngestOperations implements BackendWithIngest
+func (be *metadataProjectionBackend) IngestOperations(ctx context.Context, ops []*IngestOperation) ([]error, error) {
+	errs, err := IngestOperations(ctx, be.Backend, ops)
+	if err != nil {
+		return errs, err
+	}
+	for i, op := range ops {
+		if i < len(errs) && errs[i] == nil && op.Event.GetExecutionStarted() != nil {
+			be.savePendingMetadata(ctx, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// savePendingMetadata projects the metadata of an orchestration instance that was created with the specified
+// ExecutionStarted event.
+func (be *metadataProjectionBackend) savePendingMetadata(ctx context.Context, e *HistoryEvent) {
+	es := e.GetExecutionStarted()
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(es.GetOrchestrationInstance().GetInstanceId()),
+		es.GetName(),
+		protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING,
+		e.Timestamp.AsTime(),
+		e.Timestamp.AsTime(),
+		es.GetInput().GetValue(),
+		"",
+		"",
+		nil,
+	)
+	if err := be.store.SaveOrchestrationMetadata(ctx, metadata); err != nil {
+		be.logger.Warnf("%v: failed to save the metadata projection: %v", metadata.InstanceID, err)
+	}
+}
+
+// GetOrchestrationMetadata implements Backend
+func (be *metadataProjectionBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	metadata, err := be.store.GetOrchestrationMetadata(ctx, iid)
+	if errors.Is(err, api.ErrInstanceNotFound) {
+		return be.Backend.GetOrchestrationMetadata(ctx, iid)
+	}
+	return metadata, err
+}
+
+// CompleteOrchestrationWorkItem implements Backend
+func (be *metadataProjectionBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem) error {
+	previous, err := be.GetOrchestrationMetadata(ctx, wi.InstanceID)
+	if err != nil {
+		previous = nil
+	}
+
+	if err := be.Backend.CompleteOrchestrationWorkItem(ctx, wi); err != nil {
+		return err
+	}
+
+	metadata := ProjectOrchestrationMetadata(previous, wi.State, time.Now().UTC())
+	if err := be.store.SaveOrchestrationMetadata(ctx, metadata); err != nil {
+		be.logger.Warnf("%v: failed to save the metadata projection: %v", wi.InstanceID, err)
+	}
+	return nil
+}
+
+// PurgeOrchestrationState implements Backend
+func (be *metadataProjectionBackend) PurgeOrchestrationState(ctx context.Context, iid api.InstanceID) error {
+	if err := be.Backend.PurgeOrchestrationState(ctx, iid); err != nil {
+		return err
+	}
+	return be.store.DeleteOrchestrationMetadata(ctx, iid)
+}
+
+// ExportOrchestrationInstance implements BackendWithMigration
+func (be *metadataProjectionBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*OrchestrationInstanceState, error) {
+	migrator, err := wrapped[BackendWithMigration](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return migrator.ExportOrchestrationInstance(ctx, iid)
+}
+
+// ImportOrchestrationInstance implements BackendWithMigration
+func (be *metadataProjectionBackend) ImportOrchestrationInstance(ctx context.Context, state *OrchestrationInstanceState) error {
+	migrator, err := wrapped[BackendWithMigration](be.Backend)
+	if err != nil {
+		return err
+	}
+	if err := migrator.ImportOrchestrationInstance(ctx, state); err != nil {
+		return err
+	}
+	if err := be.store.SaveOrchestrationMetadata(ctx, state.Metadata); err != nil {
+		be.logger.Warnf("%v: failed to save the metadata projection: %v", state.Metadata.InstanceID, err)
+	}
+	return nil
+}
+
+// WatchOrchestrationRuntimeStatus implements BackendWithWatch
+func (be *metadataProjectionBackend) WatchOrchestrationRuntimeStatus(ctx context.Context, id api.InstanceID) (<-chan *api.OrchestrationMetadata, error) {
+	watcher, err := wrapped[BackendWithWatch](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return watcher.WatchOrchestrationRuntimeStatus(ctx, id)
+}
+
+// RecordActivityHeartbeat implements BackendWithActivityHeartbeats
+func (be *metadataProjectionBackend) RecordActivityHeartbeat(ctx context.Context, wi *ActivityWorkItem) error {
+	heartbeats, err := wrapped[BackendWithActivityHeartbeats](be.Backend)
+	if err != nil {
+		return err
+	}
+	return heartbeats.RecordActivityHeartbeat(ctx, wi)
+}
+
+// GetActivityWorkItemsFromQueues implements BackendWithActivityQueues
+func (be *metadataProjectionBackend) GetActivityWorkItemsFromQueues(ctx context.Context, queues []string, max int) ([]*ActivityWorkItem, error) {
+	queued, err := wrapped[BackendWithActivityQueues](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return queued.GetActivityWorkItemsFromQueues(ctx, queues, max)
+}
+
+// DeadLetterOrchestrationWorkItem implements BackendWithDeadLetters
+func (be *metadataProjectionBackend) DeadLetterOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, reason string) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, reason)
+}
+
+// DeadLetterActivityWorkItem implements BackendWithDeadLetters
+func (be *metadataProjectionBackend) DeadLetterActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, reason string) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.DeadLetterActivityWorkItem(ctx, wi, reason)
+}
+
+// ListDeadLetters implements BackendWithDeadLetters
+func (be *metadataProjectionBackend) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters.ListDeadLetters(ctx)
+}
+
+// ResubmitDeadLetter implements BackendWithDeadLetters
+func (be *metadataProjectionBackend) ResubmitDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.ResubmitDeadLetter(ctx, id)
+}
+
+// DeleteDeadLetter implements BackendWithDeadLetters
+func (be *metadataProjectionBackend) DeleteDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.DeleteDeadLetter(ctx, id)
+}
+
+// GetOrchestrationLastActions implements BackendWithLastActions
+func (be *metadataProjectionBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	lastActions, err := wrapped[BackendWithLastActions](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return lastActions.GetOrchestrationLastActions(ctx, iid)
+}
+
+// GetOrchestrationStats implements BackendWithStats
+func (be *metadataProjectionBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	statistics, err := wrapped[BackendWithStats](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return statistics.GetOrchestrationStats(ctx, name, since)
+}
+
+// AddNewOrchestrationEventIf implements BackendWithConditionalEvents
+func (be *metadataProjectionBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	conditional, err := wrapped[BackendWithConditionalEvents](be.Backend)
+	if err != nil {
+		return err
+	}
+	return conditional.AddNewOrchestrationEventIf(ctx, iid, e, statuses)
+}
+
+// GetOrchestrationHistoriesBatch implements BackendWithHistoriesBatch
+func (be *metadataProjectionBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*HistoryEvent, error) {
+	batch, err := wrapped[BackendWithHistoriesBatch](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return batch.GetOrchestrationHistoriesBatch(ctx, fromSequenceNumbers)
+}
+
+// GetOrphanedSubOrchestrations implements BackendWithOrphanQueries
+func (be *metadataProjectionBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	orphans, err := wrapped[BackendWithOrphanQueries](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return orphans.GetOrphanedSubOrchestrations(ctx)
+}
+
+// QueryOrchestrationMetadata implements BackendWithQueries
+func (be *metadataProjectionBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	querier, err := wrapped[BackendWithQueries](be.Backend)
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	return querier.QueryOrchestrationMetadata(ctx, query)
+}
+
+// GetActivityWorkItems implements BackendWithActivityBatches
+func (be *metadataProjectionBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*ActivityWorkItem, error) {
+	batched, err := wrapped[BackendWithActivityBatches](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return batched.GetActivityWorkItems(ctx, max)
+}
+
+// RenewOrchestrationWorkItemLock implements BackendWithLockRenewal
+func (be *metadataProjectionBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *OrchestrationWorkItem) error {
+	renewer, err := wrapped[BackendWithLockRenewal](be.Backend)
+	if err != nil {
+		return err
+	}
+	return renewer.RenewOrchestrationWorkItemLock(ctx, wi)
+}
+
+// RenewActivityWorkItemLock implements BackendWithLockRenewal
+func (be *metadataProjectionBackend) RenewActivityWorkItemLock(ctx context.Context, wi *ActivityWorkItem) error {
+	renewer, err := wrapped[BackendWithLockRenewal](be.Backend)
+	if err != nil {
+		return err
+	}
+	return renewer.RenewActivityWorkItemLock(ctx, wi)
+}
+
+// GetActivityWorkItemsWithFilter implements BackendWithActivityFilters
+func (be *metadataProjectionBackend) GetActivityWorkItemsWithFilter(ctx context.Context, filter ActivityWorkItemFilter, max int) ([]*ActivityWorkItem, error) {
+	filtered, err := wrapped[BackendWithActivityFilters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return filtered.GetActivityWorkItemsWithFilter(ctx, filter, max)
+}
+
+// GetOrchestrationWorkItemWithFilter implements BackendWithOrchestrationFilters
+func (be *metadataProjectionBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter OrchestrationWorkItemFilter) (*OrchestrationWorkItem, error) {
+	filtered, err := wrapped[BackendWithOrchestrationFilters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return filtered.GetOrchestrationWorkItemWithFilter(ctx, filter)
+}
+
+// DeferOrchestrationWorkItem implements BackendWithDeferrals
+func (be *metadataProjectionBackend) DeferOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, delay time.Duration) error {
+	deferrals, err := wrapped[BackendWithDeferrals](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deferrals.DeferOrchestrationWorkItem(ctx, wi, delay)
+}
+
+// DeferActivityWorkItem implements BackendWithDeferrals
+func (be *metadataProjectionBackend) DeferActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, delay time.Duration) error {
+	deferrals, err := wrapped[BackendWithDeferrals](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deferrals.DeferActivityWorkItem(ctx, wi, delay)
+}
+
+// DeleteActivityWorkItem implements BackendWithExternalActivityResults
+func (be *metadataProjectionBackend) DeleteActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error {
+	external, err := wrapped[BackendWithExternalActivityResults](be.Backend)
+	if err != nil {
+		return err
+	}
+	return external.DeleteActivityWorkItem(ctx, wi)
+}
+
+// Unwrap implements BackendWrapper
+func (be *metadataProjectionBackend) Unwrap() Backend {
+	return be.Backend
+}
+
+// inMemoryMetadataStore is a MetadataStore that keeps the projected metadata in memory.
+type inMemoryMetadataStore struct {
+	lock     sync.RWMutex
+	metadata map[api.InstanceID]api.OrchestrationMetadata
+}
+
+// NewInMemoryMetadataStore returns a [MetadataStore] that keeps the projected metadata in memory. It's intended for
+// tests and for single-process deployments, since the projection is lost when the process exits.
+func NewInMemoryMetadataStore() MetadataStore {
+	return &inMemoryMetadataStore{metadata: make(map[api.InstanceID]api.OrchestrationMetadata)}
+}
+
+// GetOrchestrationMetadata implements MetadataStore
+func (s *inMemoryMetadataStore) GetOrchestrationMetadata(_ context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	metadata, ok := s.metadata[iid]
+	if !ok {
+		return nil, api.ErrInstanceNotFound
+	}
+	return &metadata, nil
+}
+
+// SaveOrchestrationMetadata implements MetadataStore
+func (s *inMemoryMetadataStore) SaveOrchestrationMetadata(_ context.Context, metadata *api.OrchestrationMetadata) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.metadata[metadata.InstanceID] = *metadata
+	return nil
+}
+
+// DeleteOrchestrationMetadata implements MetadataStore
+func (s *inMemoryMetadataStore) DeleteOrchestrationMetadata(_ context.Context, iid api.InstanceID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.metadata, iid)
+	return nil
+}
+
+func containsStatus(statuses []protos.OrchestrationStatus, status protos.OrchestrationStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+const (
+	// taskHubExportFormat identifies the streams written by [ExportTaskHub].
+	taskHubExportFormat = "durabletask-taskhub-export"
+
+	// TaskHubExportVersion is the version of the format written by [ExportTaskHub]. [ImportTaskHub] rejects streams
+	// that were written with a newer version.
+	TaskHubExportVersion = 1
+)
+
+// ErrMigrationNotSupported is returned by [ExportTaskHub], [ImportTaskHub], and [TaskHubClient.RewindOrchestration] if
+// the backend doesn't implement [BackendWithMigration].
+var ErrMigrationNotSupported = errors.New("the backend doesn't support exporting and importing orchestration instances")
+
+// OrchestrationInstanceState is the complete saved state of an orchestration instance, which is what's needed to move
+// the orchestration instance from one backend to another.
+type OrchestrationInstanceState struct {
+	// Metadata is the metadata of the orchestration instance.
+	Metadata *api.OrchestrationMetadata
+
+	// History is the history of the orchestration instance, in order.
+	History []*HistoryEvent
+
+	// PendingEvents are the events that were sent to the orchestration instance but not yet processed, including
+	// durable timers that haven't fired yet.
+	PendingEvents []*HistoryEvent
+
+	// PendingTasks are the activity tasks that were scheduled by the orchestration instance but not yet completed.
+	PendingTasks []*HistoryEvent
+}
+
+// ExportOptions configures which orchestration instances are exported by [ExportTaskHub].
+type ExportOptions func(*api.InstanceQuery)
+
+// WithExportRuntimeStatus restricts an export to orchestration instances with one of the specified runtime statuses,
+// e.g. only completed, failed, and terminated orchestrations.
+func WithExportRuntimeStatus(statuses ...protos.OrchestrationStatus) ExportOptions {
+	return func(q *api.InstanceQuery) {
+		q.RuntimeStatuses = append(q.RuntimeStatuses, statuses...)
+	}
+}
+
+// WithExportCreatedTimeRange restricts an export to orchestration instances that were created at or after from and
+// before to. Specify a zero time to leave either end of the range open.
+func WithExportCreatedTimeRange(from time.Time, to time.Time) ExportOptions {
+	return func(q *api.InstanceQuery) {
+		q.CreatedFrom = from
+		q.CreatedTo = to
+	}
+}
+
+// exportHeader is the first record of an export stream.
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// exportedInstance is the record of a single orchestration instance in an export stream. Events are serialized
+// using their protobuf encoding.
+type exportedInstance struct {
+	Metadata      *api.OrchestrationMetadata `json:"metadata"`
+	History       [][]byte                   `json:"history,omitempty"`
+	PendingEvents [][]byte                   `json:"pendingEvents,omitempty"`
+	PendingTasks  [][]byte                   `json:"pendingTasks,omitempty"`
+}
+
+// ExportTaskHub writes the metadata, history, and pending work of the orchestration instances in the specified
+// backend to w, in a versioned format that can be loaded into another backend using [ImportTaskHub]. This can be used
+// to migrate between backends and to back up a task hub. All orchestration instances are exported unless the export
+// is restricted using [WithExportRuntimeStatus] or [WithExportCreatedTimeRange].
+//
+// The stream contains one JSON record per line, and instances are read from the backend one at a time, so that the
+// memory used by an export doesn't depend on the size of the task hub. Instances that are still running while the
+// export is in progress are exported in whatever state they were in when they were read, so an export is only a
+// consistent snapshot of the task hub if no workers are running.
+//
+// [ErrMigrationNotSupported] is returned if the backend doesn't implement [BackendWithMigration].
+func ExportTaskHub(ctx context.Context, be Backend, w io.Writer, opts ...ExportOptions) error {
+	migrationBackend, ok := As[BackendWithMigration](be)
+	if !ok {
+		return ErrMigrationNotSupported
+	}
+
+	query := api.InstanceQuery{}
+	for _, configure := range opts {
+		configure(&query)
+	}
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	if err := encoder.Encode(exportHeader{Format: taskHubExportFormat, Version: TaskHubExportVersion}); err != nil {
+		return fmt.Errorf("failed to write export header: %w", err)
+	}
+
+	for {
+		page, err := queryOrchestrationMetadata(ctx, be, query)
+		if err != nil {
+			return fmt.Errorf("failed to query orchestration instances: %w", err)
+		}
+		for _, metadata := range page.Instances {
+			if err := exportOrchestrationInstance(ctx, migrationBackend, encoder, metadata.InstanceID); err != nil {
+				return err
+			}
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		query.ContinuationToken = page.ContinuationToken
+	}
+	return bw.Flush()
+}
+
+func exportOrchestrationInstance(ctx context.Context, be BackendWithMigration, encoder *json.Encoder, id api.InstanceID) error {
+	state, err := be.ExportOrchestrationInstance(ctx, id)
+	if errors.Is(err, api.ErrInstanceNotFound) {
+		// The instance was purged after it was queried
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to export orchestration instance '%s': %w", id, err)
+	}
+
+	record := exportedInstance{Metadata: state.Metadata}
+	if record.History, err = marshalHistoryEvents(state.History); err != nil {
+		return err
+	}
+	if record.PendingEvents, err = marshalHistoryEvents(state.PendingEvents); err != nil {
+		return err
+	}
+	if record.PendingTasks, err = marshalHistoryEvents(state.PendingTasks); err != nil {
+		return err
+	}
+	if err := encoder.Encode(record); err != nil {
+		return fmt.Errorf("failed to write orchestration instance '%s': %w", id, err)
+	}
+	return nil
+}
+
+// ImportTaskHub loads orchestration instances that were written by [ExportTaskHub] into the specified backend.
+// Importing an orchestration instance that already exists in the backend fails with [ErrDuplicateEvent], and
+// instances that were imported before the failure are kept.
+//
+// Importing into a task hub while workers are running is unsafe, since workers can pick up the pending work of an
+// instance before all of its state was imported. Imports should be done offline, into a fresh task hub, and workers
+// should only be started after the import completes.
+//
+// [ErrMigrationNotSupported] is returned if the backend doesn't implement [BackendWithMigration].
+func ImportTaskHub(ctx context.Context, be Backend, r io.Reader) error {
+	migrationBackend, ok := As[BackendWithMigration](be)
+	if !ok {
+		return ErrMigrationNotSupported
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header exportHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read export header: %w", err)
+	} else if header.Format != taskHubExportFormat {
+		return fmt.Errorf("unrecognized export format: %q", header.Format)
+	} else if header.Version > TaskHubExportVersion {
+		return fmt.Errorf("unsupported export version %d: the newest supported version is %d", header.Version, TaskHubExportVersion)
+	}
+
+	for {
+		var record exportedInstance
+		if err := decoder.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read orchestration instance: %w", err)
+		} else if record.Metadata == nil {
+			return errors.New("failed to read orchestration instance: missing metadata")
+		}
+
+		state := &OrchestrationInstanceState{Metadata: record.Metadata}
+		var err error
+		if state.History, err = unmarshalHistoryEvents(record.History); err != nil {
+			return err
+		}
+		if state.PendingEvents, err = unmarshalHistoryEvents(record.PendingEvents); err != nil {
+			return err
+		}
+		if state.PendingTasks, err = unmarshalHistoryEvents(record.PendingTasks); err != nil {
+			return err
+		}
+		if err := migrationBackend.ImportOrchestrationInstance(ctx, state); err != nil {
+			return fmt.Errorf("failed to import orchestration instance '%s': %w", record.Metadata.InstanceID, err)
+		}
+	}
+}
+
+func marshalHistoryEvents(events []*HistoryEvent) ([][]byte, error) {
+	payloads := make([][]byte, 0, len(events))
+	for _, e := range events {
+		payload, err := MarshalHistoryEvent(e)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+func unmarshalHistoryEvents(payloads [][]byte) ([]*HistoryEvent, error) {
+	events := make([]*HistoryEvent, 0, len(payloads))
+	for _, payload := range payloads {
+		e, err := UnmarshalHistoryEvent(payload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
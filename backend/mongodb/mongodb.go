@@ -0,0 +1,1643 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/proto"
+)
+
+// The types of the documents in the collection of a task hub
+const (
+	instanceType = "instance"
+	historyType  = "history"
+	taskType     = "task"
+	counterType  = "counter"
+)
+
+// maxWorkItemCandidates is the number of orchestration work items that a worker locks and releases before giving up,
+// when their instances are waiting for a scheduled start time.
+const maxWorkItemCandidates = 10
+
+type MongoDBOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// URI is the connection string of the MongoDB deployment, e.g. "mongodb://localhost:27017".
+	URI string
+
+	// Database is the name of the database that contains the task hub.
+	Database string
+
+	// TaskHubName is the name of the collection that contains the task hub. Multiple task hubs can share a database
+	// by using different names.
+	TaskHubName string
+
+	// Retention is how long the state of completed orchestrations is kept before it's deleted by a TTL index. The
+	// state is kept until it's purged if Retention is zero.
+	Retention time.Duration
+}
+
+type mongoDBBackend struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	workerName string
+	logger     backend.Logger
+	options    *MongoDBOptions
+}
+
+// instanceDocument contains the metadata and the pending events of an orchestration instance, so that they're
+// updated atomically. Events that are sent to an instance before it's created are added to a document that isn't
+// marked as created yet.
+type instanceDocument struct {
+	ID               string            `bson:"_id"`
+	Type             string            `bson:"type"`
+	InstanceID       string            `bson:"instanceId"`
+	Created          bool              `bson:"created"`
+	Name             string            `bson:"name,omitempty"`
+	Version          string            `bson:"version,omitempty"`
+	ExecutionID      string            `bson:"executionId,omitempty"`
+	RuntimeStatus    string            `bson:"runtimeStatus,omitempty"`
+	CreatedTime      time.Time         `bson:"createdTime,omitempty"`
+	LastUpdatedTime  time.Time         `bson:"lastUpdatedTime,omitempty"`
+	CompletedTime    *time.Time        `bson:"completedTime,omitempty"`
+	Input            string            `bson:"input,omitempty"`
+	Output           string            `bson:"output,omitempty"`
+	CustomStatus     string            `bson:"customStatus,omitempty"`
+	FailureDetails   []byte            `bson:"failureDetails,omitempty"`
+	ParentInstanceID string            `bson:"parentInstanceId,omitempty"`
+	GenerationCount  int               `bson:"generationCount"`
+	HistoryLength    int               `bson:"historyLength"`
+	LastActions      []byte            `bson:"lastActions,omitempty"`
+	Tags             map[string]string `bson:"tags,omitempty"`
+	Events           []eventDocument   `bson:"events"`
+
+	// The orchestration work item of the instance. Revision is incremented whenever events are added, so that the
+	// worker that holds the lock can tell whether new events arrived while it was processing the work item.
+	VisibleTime    *time.Time `bson:"visibleTime,omitempty"`
+	LockedBy       string     `bson:"lockedBy,omitempty"`
+	LockExpiration *time.Time `bson:"lockExpiration,omitempty"`
+	Revision       int64      `bson:"revision"`
+
+	ExpireAt *time.Time `bson:"expireAt,omitempty"`
+}
+
+type eventDocument struct {
+	SequenceNumber int64     `bson:"seq"`
+	VisibleTime    time.Time `bson:"visibleTime"`
+	DequeueCount   int32     `bson:"dequeueCount"`
+	LockedBy       string    `bson:"lockedBy,omitempty"`
+	EventPayload   []byte    `bson:"eventPayload"`
+}
+
+// historyDocument is a history event of an instance. The history of each generation of an instance is stored
+// separately, so that the history of the previous generation isn't overwritten until the instance continues as new.
+type historyDocument struct {
+	ID             string     `bson:"_id"`
+	Type           string     `bson:"type"`
+	InstanceID     string     `bson:"instanceId"`
+	Generation     int        `bson:"generation"`
+	SequenceNumber int64      `bson:"seq"`
+	EventPayload   []byte     `bson:"eventPayload"`
+	ExpireAt       *time.Time `bson:"expireAt,omitempty"`
+}
+
+type taskDocument struct {
+	ID             string     `bson:"_id"`
+	Type           string     `bson:"type"`
+	SequenceNumber int64      `bson:"seq"`
+	InstanceID     string     `bson:"instanceId"`
+	DequeueCount   int32      `bson:"dequeueCount"`
+	LockedBy       string     `bson:"lockedBy,omitempty"`
+	LockExpiration *time.Time `bson:"lockExpiration,omitempty"`
+	EventPayload   []byte     `bson:"eventPayload"`
+}
+
+// NewMongoDBOptions creates a new options object for the MongoDB backend provider.
+func NewMongoDBOptions(uri string) *MongoDBOptions {
+	// Default values are provided for required options
+	return &MongoDBOptions{
+		URI:                      uri,
+		Database:                 "durabletask",
+		TaskHubName:              "taskhub",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+	}
+}
+
+// NewMongoDBBackend creates a new MongoDB-based Backend object.
+//
+// Each task hub is stored in a collection of its own. The metadata and pending events of each orchestration instance
+// are stored in one document, which also serves as the instance's orchestration work item, so that the state of an
+// instance is updated atomically. History events and activity tasks are stored in separate documents. Workers lock
+// work items with atomic find-and-modify operations, so that multiple workers can share the same task hub.
+func NewMongoDBBackend(opts *MongoDBOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewMongoDBOptions("mongodb://localhost:27017")
+	}
+
+	return &mongoDBBackend{
+		workerName: fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:    opts,
+		logger:     logger,
+	}
+}
+
+// CreateTaskHub creates the collection of the task hub and its indexes, if they don't exist
+func (be *mongoDBBackend) CreateTaskHub(ctx context.Context) error {
+	if be.client == nil {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(be.options.URI))
+		if err != nil {
+			return fmt.Errorf("failed to connect to MongoDB: %w", err)
+		}
+		be.client = client
+		be.collection = client.Database(be.options.Database).Collection(be.options.TaskHubName)
+	}
+
+	indexes := []mongo.IndexModel{
+		// Orchestration work items, activity tasks, and histories are read in order
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "visibleTime", Value: 1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "instanceId", Value: 1}, {Key: "generation", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "createdTime", Value: 1}, {Key: "instanceId", Value: 1}}},
+
+		// Documents with an expiration time are deleted by MongoDB once they expire
+		{Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	}
+	if _, err := be.collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("failed to create the indexes of the task hub: %w", err)
+	}
+	return nil
+}
+
+// DeleteTaskHub drops the collection of the task hub
+func (be *mongoDBBackend) DeleteTaskHub(ctx context.Context) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	names, err := be.client.Database(be.options.Database).ListCollectionNames(ctx, bson.M{"name": be.options.TaskHubName})
+	if err != nil {
+		return fmt.Errorf("failed to check whether the task hub exists: %w", err)
+	} else if len(names) == 0 {
+		return backend.ErrTaskHubNotFound
+	}
+
+	if err := be.collection.Drop(ctx); err != nil {
+		return fmt.Errorf("failed to drop the task hub collection: %w", err)
+	}
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *mongoDBBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	if e.GetExecutionStarted() == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+	return be.createInstance(ctx, e)
+}
+
+// createInstance creates an orchestration instance and adds its ExecutionStarted event.
+func (be *mongoDBBackend) createInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	startEvent := e.GetExecutionStarted()
+	id := startEvent.OrchestrationInstance.InstanceId
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	visibleTime := time.Now().UTC()
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime()
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	event, err := newEventDocument(e, seq, visibleTime)
+	if err != nil {
+		return err
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	fields := bson.M{
+		"type":            instanceType,
+		"instanceId":      id,
+		"created":         true,
+		"name":            startEvent.Name,
+		"version":         startEvent.Version.GetValue(),
+		"executionId":     startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		"runtimeStatus":   "PENDING",
+		"createdTime":     e.Timestamp.AsTime(),
+		"lastUpdatedTime": time.Now().UTC(),
+		"input":           startEvent.Input.GetValue(),
+		"generationCount": 0,
+		"historyLength":   0,
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		fields["parentInstanceId"] = parent.GetOrchestrationInstance().InstanceId
+	}
+	if tags := helpers.GetTags(startEvent); len(tags) > 0 {
+		fields["tags"] = tags
+	}
+
+	// A document that isn't marked as created contains events that were sent to the instance before it was created.
+	// If the instance exists, the upsert fails with a duplicate key error.
+	_, err = be.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": instanceKey(id), "created": bson.M{"$ne": true}},
+		bson.M{
+			"$set":  fields,
+			"$push": bson.M{"events": event},
+			"$min":  bson.M{"visibleTime": visibleTime},
+			"$inc":  bson.M{"revision": 1},
+		},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return backend.ErrDuplicateEvent
+	} else if err != nil {
+		return fmt.Errorf("failed to create the orchestration instance: %w", err)
+	}
+	return nil
+}
+
+// addEvent adds an event to the queue of an orchestration instance, and makes the instance's work item visible.
+func (be *mongoDBBackend) addEvent(ctx context.Context, id string, e *backend.HistoryEvent) error {
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	event, err := newEventDocument(e, seq, now)
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, err = be.collection.UpdateOne(
+			ctx,
+			bson.M{"_id": instanceKey(id)},
+			bson.M{
+				"$setOnInsert": bson.M{"type": instanceType, "instanceId": id, "created": false, "generationCount": 0, "historyLength": 0},
+				"$push":        bson.M{"events": event},
+				"$min":         bson.M{"visibleTime": now},
+				"$inc":         bson.M{"revision": 1},
+			},
+			options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			// The document was inserted concurrently, so the event is added to it instead
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to add the orchestration event: %w", err)
+		}
+		return nil
+	}
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *mongoDBBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	return be.addEvent(ctx, string(iid), e)
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *mongoDBBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if err := validateEvent(e); err != nil {
+		return err
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	event, err := newEventDocument(e, seq, now)
+	if err != nil {
+		return err
+	}
+
+	// The status is checked in the same update in which the event is added, so that it can't change in between
+	runtimeStatuses := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		runtimeStatuses = append(runtimeStatuses, helpers.ToRuntimeStatusString(status))
+	}
+	res, err := be.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": instanceKey(string(iid)), "created": true, "runtimeStatus": bson.M{"$in": runtimeStatuses}},
+		bson.M{
+			"$push": bson.M{"events": event},
+			"$min":  bson.M{"visibleTime": now},
+			"$inc":  bson.M{"revision": 1},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to add the orchestration event: %w", err)
+	} else if res.MatchedCount > 0 {
+		return nil
+	}
+
+	if instance, err := be.findInstance(ctx, string(iid)); err != nil {
+		return err
+	} else if instance == nil {
+		return api.ErrInstanceNotFound
+	}
+	return api.ErrPreconditionFailed
+}
+
+// IngestOperations implements backend.BackendWithIngest
+//
+// Each operation is applied separately.
+func (be *mongoDBBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *mongoDBBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < maxWorkItemCandidates; i++ {
+		now := time.Now().UTC()
+		lockExpiration := now.Add(be.options.OrchestrationLockTimeout)
+
+		// A work item can be locked if it's visible and not locked, or if its lock expired
+		instance := new(instanceDocument)
+		err := be.collection.FindOneAndUpdate(
+			ctx,
+			bson.M{
+				"type":    instanceType,
+				"created": true,
+				"$or": bson.A{
+					bson.M{"visibleTime": bson.M{"$lte": now}, "lockedBy": bson.M{"$exists": false}},
+					bson.M{"lockExpiration": bson.M{"$lt": now}},
+				},
+			},
+			bson.M{"$set": bson.M{"lockedBy": be.workerName, "lockExpiration": lockExpiration}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "visibleTime", Value: 1}}).SetReturnDocument(options.After),
+		).Decode(instance)
+		if err == mongo.ErrNoDocuments {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to lock the orchestration work-item: %w", err)
+		}
+
+		visible := make([]eventDocument, 0, len(instance.Events))
+		for _, e := range instance.Events {
+			if !e.VisibleTime.After(now) {
+				visible = append(visible, e)
+			}
+		}
+
+		// Instances that haven't started yet and still have invisible events are waiting for their scheduled start
+		// time, so events raised to them in the meantime must wait as well.
+		if len(visible) == 0 || (instance.HistoryLength == 0 && len(visible) < len(instance.Events)) {
+			if err := be.releaseWorkItem(ctx, instance.InstanceID, be.workerName, nil); err != nil && err != backend.ErrWorkItemLockLost {
+				return nil, err
+			}
+			continue
+		}
+		sort.Slice(visible, func(i, j int) bool { return visible[i].SequenceNumber < visible[j].SequenceNumber })
+
+		// TODO: Get all the unprocessed events associated with the locked instance
+		if len(visible) > 1000 {
+			visible = visible[:1000]
+		}
+
+		seqs := make([]int64, 0, len(visible))
+		maxDequeueCount := int32(0)
+		newEvents := make([]*protos.HistoryEvent, 0, len(visible))
+		for _, e := range visible {
+			seqs = append(seqs, e.SequenceNumber)
+			if e.DequeueCount+1 > maxDequeueCount {
+				maxDequeueCount = e.DequeueCount + 1
+			}
+
+			event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+			if err != nil {
+				return nil, err
+			}
+			newEvents = append(newEvents, event)
+		}
+
+		_, err = be.collection.UpdateOne(
+			ctx,
+			bson.M{"_id": instance.ID, "lockedBy": be.workerName},
+			bson.M{
+				"$set": bson.M{"events.$[e].lockedBy": be.workerName},
+				"$inc": bson.M{"events.$[e].dequeueCount": 1},
+			},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"e.seq": bson.M{"$in": seqs}}}}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock the orchestration work-item events: %w", err)
+		}
+
+		wi := &backend.OrchestrationWorkItem{
+			InstanceID: api.InstanceID(instance.InstanceID),
+			NewEvents:  newEvents,
+			LockedBy:   be.workerName,
+			RetryCount: maxDequeueCount - 1,
+
+			NextSequenceNumber: instance.HistoryLength,
+		}
+		return wi, nil
+	}
+
+	// No new events to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// releaseWorkItem unlocks the orchestration work item of an instance after applying fn to its pending events, and
+// makes it visible when its next event becomes visible. The update is retried if events are added concurrently.
+func (be *mongoDBBackend) releaseWorkItem(ctx context.Context, id string, lockedBy string, fn func(instance *instanceDocument) (bson.M, error)) error {
+	for {
+		instance, err := be.findInstance(ctx, id)
+		if err != nil {
+			return err
+		} else if instance == nil || instance.LockedBy != lockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		set := bson.M{}
+		if fn != nil {
+			if set, err = fn(instance); err != nil {
+				return err
+			}
+		}
+		set["events"] = instance.Events
+
+		update := bson.M{"$unset": bson.M{"lockedBy": "", "lockExpiration": ""}}
+		if visibleTime := nextVisibleTime(instance.Events, instance.HistoryLength); visibleTime != nil {
+			set["visibleTime"] = *visibleTime
+		} else {
+			update["$unset"].(bson.M)["visibleTime"] = ""
+		}
+		update["$set"] = set
+
+		res, err := be.collection.UpdateOne(
+			ctx,
+			bson.M{"_id": instance.ID, "lockedBy": lockedBy, "revision": instance.Revision},
+			update)
+		if err != nil {
+			return fmt.Errorf("failed to release the orchestration work-item: %w", err)
+		} else if res.MatchedCount == 0 {
+			// Events were added concurrently, or the lock was lost
+			continue
+		}
+		return nil
+	}
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *mongoDBBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.findInstance(ctx, string(wi.InstanceID))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	existingEvents, err := be.findHistory(ctx, instance, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *mongoDBBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.findInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil {
+		return nil, api.ErrInstanceNotFound
+	}
+	return instance.metadata()
+}
+
+func (instance *instanceDocument) metadata() (*api.OrchestrationMetadata, error) {
+	var failureDetails *protos.TaskFailureDetails
+	if len(instance.FailureDetails) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(instance.FailureDetails, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(instance.InstanceID),
+		instance.Name,
+		helpers.FromRuntimeStatusString(instance.RuntimeStatus),
+		instance.CreatedTime,
+		instance.LastUpdatedTime,
+		instance.Input,
+		instance.Output,
+		instance.CustomStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = instance.GenerationCount
+	metadata.Tags = instance.Tags
+	return metadata, nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+//
+// History events, activity tasks, and messages to other instances are saved first, and the instance document is
+// updated last, so a work item that fails to complete is processed again after its lock expires, and may send its
+// outbound messages more than once.
+func (be *mongoDBBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	now := time.Now().UTC()
+
+	instance, err := be.findInstance(ctx, id)
+	if err != nil {
+		return err
+	} else if instance == nil || instance.LockedBy != wi.LockedBy {
+		return backend.ErrWorkItemLockLost
+	}
+
+	// Update the instance
+	set := bson.M{}
+	unset := bson.M{}
+	isCreated := false
+	isCompleted := false
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if isCreated {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			isCreated = true
+			set["createdTime"] = e.Timestamp.AsTime()
+			set["input"] = es.Input.GetValue()
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			set["completedTime"] = now
+			set["output"] = ec.Result.GetValue()
+			if ec.FailureDetails != nil {
+				bytes, err := proto.Marshal(ec.FailureDetails)
+				if err != nil {
+					return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+				}
+				set["failureDetails"] = bytes
+			} else {
+				unset["failureDetails"] = ""
+			}
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		set["customStatus"] = wi.State.CustomStatus.Value
+	}
+
+	// Save the actions from the most recent execution, if requested
+	if wi.State.LastActions != nil {
+		payload, err := proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: id,
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+		set["lastActions"] = payload
+	}
+
+	// The state of completed orchestrations expires after the retention period
+	var expireAt *time.Time
+	runtimeStatus := helpers.ToRuntimeStatusString(wi.State.RuntimeStatus())
+	if be.options.Retention > 0 && isCompletedStatus(runtimeStatus) {
+		t := now.Add(be.options.Retention)
+		expireAt = &t
+		set["expireAt"] = t
+	}
+
+	// TODO: Support for stickiness, which would extend the LockExpiration
+	generation := instance.GenerationCount + wi.State.ContinuedAsNewCount()
+	firstSequenceNumber := len(wi.State.OldEvents())
+	set["generationCount"] = generation
+	set["historyLength"] = firstSequenceNumber + len(wi.State.NewEvents())
+	set["runtimeStatus"] = runtimeStatus
+	set["lastUpdatedTime"] = now
+
+	// Save new history events. If continue-as-new, they're saved in a new generation, so that the history of the
+	// previous generation stays intact until the instance is updated.
+	if len(wi.State.NewEvents()) > 0 {
+		models := make([]mongo.WriteModel, 0, len(wi.State.NewEvents()))
+		for i, e := range wi.State.NewEvents() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+			seq := int64(firstSequenceNumber + i)
+			doc := &historyDocument{
+				ID:             historyKey(id, generation, seq),
+				Type:           historyType,
+				InstanceID:     id,
+				Generation:     generation,
+				SequenceNumber: seq,
+				EventPayload:   eventPayload,
+				ExpireAt:       expireAt,
+			}
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": doc.ID}).SetReplacement(doc).SetUpsert(true))
+		}
+		if _, err := be.collection.BulkWrite(ctx, models); err != nil {
+			return fmt.Errorf("failed to insert into the history: %w", err)
+		}
+	}
+
+	// Sub-orchestrations with IDs that already exist aren't created
+	messages := make([]backend.OrchestratorMessage, 0, len(wi.State.PendingMessages()))
+	created := make(map[string]bool)
+	for _, msg := range wi.State.PendingMessages() {
+		if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+			subID := es.OrchestrationInstance.InstanceId
+			exists := created[subID]
+			if !exists {
+				existing, err := be.findInstance(ctx, subID)
+				if err != nil {
+					return err
+				}
+				exists = existing != nil && existing.Created
+			}
+			if exists {
+				be.logger.Warnf(
+					"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+					wi.InstanceID,
+					subID)
+				continue
+			}
+			created[subID] = true
+		}
+		messages = append(messages, msg)
+	}
+
+	// Save outbound activity tasks
+	if err := be.insertTasks(ctx, id, wi.State.PendingTasks()); err != nil {
+		return err
+	}
+
+	// Save outbound orchestrator events
+	selfEvents := make([]eventDocument, 0, len(wi.State.PendingTimers()))
+	for _, e := range wi.State.PendingTimers() {
+		seq, err := be.nextSequenceNumbers(ctx, 1)
+		if err != nil {
+			return err
+		}
+		event, err := newEventDocument(e, seq, e.GetTimerFired().GetFireAt().AsTime())
+		if err != nil {
+			return err
+		}
+		selfEvents = append(selfEvents, *event)
+	}
+	for _, msg := range messages {
+		if msg.TargetInstanceID == id {
+			seq, err := be.nextSequenceNumbers(ctx, 1)
+			if err != nil {
+				return err
+			}
+			event, err := newEventDocument(msg.HistoryEvent, seq, now)
+			if err != nil {
+				return err
+			}
+			selfEvents = append(selfEvents, *event)
+		} else if msg.HistoryEvent.GetExecutionStarted() != nil {
+			if err := be.createInstance(ctx, msg.HistoryEvent); err != nil && err != backend.ErrDuplicateEvent {
+				return err
+			}
+		} else if err := be.addEvent(ctx, msg.TargetInstanceID, msg.HistoryEvent); err != nil {
+			return err
+		}
+	}
+
+	// The instance is updated, its inbound events are deleted, and its work item is released atomically
+	err = be.releaseWorkItem(ctx, id, wi.LockedBy, func(instance *instanceDocument) (bson.M, error) {
+		events := make([]eventDocument, 0, len(instance.Events)+len(selfEvents))
+		for _, e := range instance.Events {
+			if e.LockedBy != wi.LockedBy {
+				events = append(events, e)
+			}
+		}
+		instance.Events = append(events, selfEvents...)
+		instance.HistoryLength = set["historyLength"].(int)
+		return set, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unset) > 0 {
+		if _, err := be.collection.UpdateOne(ctx, bson.M{"_id": instanceKey(id)}, bson.M{"$unset": unset}); err != nil {
+			return fmt.Errorf("failed to update the orchestration instance: %w", err)
+		}
+	}
+
+	// Delete the history of previous generations
+	if generation != instance.GenerationCount {
+		_, err := be.collection.DeleteMany(ctx, bson.M{"type": historyType, "instanceId": id, "generation": bson.M{"$lt": generation}})
+		if err != nil {
+			return fmt.Errorf("failed to delete from the history: %w", err)
+		}
+	}
+
+	// The history of completed orchestrations expires with the instance
+	if expireAt != nil {
+		_, err := be.collection.UpdateMany(ctx, bson.M{"type": historyType, "instanceId": id}, bson.M{"$set": bson.M{"expireAt": *expireAt}})
+		if err != nil {
+			return fmt.Errorf("failed to update the history: %w", err)
+		}
+	}
+	return nil
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *mongoDBBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	visibleTime := time.Now().UTC()
+	if delay := wi.GetAbandonDelay(); delay > 0 {
+		visibleTime = visibleTime.Add(delay)
+	}
+
+	return be.releaseWorkItem(ctx, string(wi.InstanceID), wi.LockedBy, func(instance *instanceDocument) (bson.M, error) {
+		abandoned := 0
+		for i := range instance.Events {
+			if instance.Events[i].LockedBy == wi.LockedBy {
+				instance.Events[i].LockedBy = ""
+				instance.Events[i].VisibleTime = visibleTime
+				abandoned++
+			}
+		}
+		if abandoned == 0 {
+			return nil, backend.ErrWorkItemLockLost
+		}
+		return bson.M{}, nil
+	})
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *mongoDBBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	res, err := be.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": instanceKey(string(wi.InstanceID)), "lockedBy": wi.LockedBy},
+		bson.M{"$set": bson.M{"lockExpiration": time.Now().UTC().Add(be.options.OrchestrationLockTimeout)}})
+	if err != nil {
+		return fmt.Errorf("failed to renew the lock on the orchestration work-item: %w", err)
+	} else if res.MatchedCount == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+	return nil
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *mongoDBBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	task := new(taskDocument)
+	err := be.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"type": taskType,
+			"$or": bson.A{
+				bson.M{"lockedBy": bson.M{"$exists": false}},
+				bson.M{"lockExpiration": bson.M{"$lt": now}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{"lockedBy": be.workerName, "lockExpiration": now.Add(be.options.ActivityLockTimeout)},
+			"$inc": bson.M{"dequeueCount": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "type", Value: 1}, {Key: "seq", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(task)
+	if err == mongo.ErrNoDocuments {
+		// No new activity tasks to process
+		return nil, backend.ErrNoWorkItems
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to lock the activity work-item: %w", err)
+	}
+
+	e, err := backend.UnmarshalHistoryEvent(task.EventPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	wi := &backend.ActivityWorkItem{
+		SequenceNumber: task.SequenceNumber,
+		InstanceID:     api.InstanceID(task.InstanceID),
+		NewEvent:       e,
+		LockedBy:       be.workerName,
+	}
+	return wi, nil
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *mongoDBBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": taskKey(wi.SequenceNumber), "lockedBy": wi.LockedBy}
+	if n, err := be.collection.CountDocuments(ctx, filter); err != nil {
+		return fmt.Errorf("failed to read the activity tasks: %w", err)
+	} else if n == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err := be.addEvent(ctx, string(wi.InstanceID), wi.Result); err != nil {
+		return err
+	}
+
+	res, err := be.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to delete from the activity tasks: %w", err)
+	} else if res.DeletedCount == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+	return nil
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *mongoDBBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	res, err := be.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": taskKey(wi.SequenceNumber), "lockedBy": wi.LockedBy},
+		bson.M{"$unset": bson.M{"lockedBy": "", "lockExpiration": ""}})
+	if err != nil {
+		return fmt.Errorf("failed to update the activity tasks for abandon: %w", err)
+	} else if res.MatchedCount == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *mongoDBBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	res, err := be.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": taskKey(wi.SequenceNumber), "lockedBy": wi.LockedBy},
+		bson.M{"$set": bson.M{"lockExpiration": time.Now().UTC().Add(be.options.ActivityLockTimeout)}})
+	if err != nil {
+		return fmt.Errorf("failed to update the activity tasks for lock renewal: %w", err)
+	} else if res.MatchedCount == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+	return nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *mongoDBBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.findInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil || !instance.Created {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(instance.LastActions, res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *mongoDBBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	instance, err := be.findInstance(ctx, string(id))
+	if err != nil {
+		return err
+	} else if instance == nil {
+		return api.ErrInstanceNotFound
+	} else if !isCompletedStatus(instance.RuntimeStatus) {
+		return api.ErrNotCompleted
+	}
+
+	res, err := be.collection.DeleteOne(ctx, bson.M{
+		"_id":           instance.ID,
+		"runtimeStatus": bson.M{"$in": bson.A{"COMPLETED", "FAILED", "TERMINATED"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete the orchestration instance: %w", err)
+	} else if res.DeletedCount == 0 {
+		return api.ErrNotCompleted
+	}
+
+	if _, err := be.collection.DeleteMany(ctx, bson.M{"type": historyType, "instanceId": string(id)}); err != nil {
+		return fmt.Errorf("failed to delete from the history: %w", err)
+	}
+	return nil
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *mongoDBBackend) PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error) {
+	if err := be.ensureDB(); err != nil {
+		return 0, "", err
+	}
+
+	// Only the state of completed orchestrations can be purged
+	completed := bson.M{"$in": bson.A{"COMPLETED", "FAILED", "TERMINATED"}}
+	filter := instanceQueryFilter(query)
+	filter["$and"] = bson.A{bson.M{"runtimeStatus": completed}}
+
+	pageSize := query.PageSizeOrDefault()
+	cursor, err := be.collection.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "type", Value: 1}, {Key: "instanceId", Value: 1}}).
+			SetLimit(int64(pageSize+1)).
+			SetProjection(bson.M{"_id": 1, "instanceId": 1}))
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to query the orchestration instances: %w", err)
+	}
+	documents := make([]*instanceDocument, 0)
+	if err := cursor.All(ctx, &documents); err != nil {
+		return 0, "", fmt.Errorf("failed to read the orchestration instances: %w", err)
+	}
+	if len(documents) == 0 {
+		return 0, "", nil
+	}
+
+	continuationToken := ""
+	if len(documents) > pageSize {
+		documents = documents[:pageSize]
+		continuationToken = documents[len(documents)-1].InstanceID
+	}
+	ids := make(bson.A, 0, len(documents))
+	for _, document := range documents {
+		ids = append(ids, document.ID)
+	}
+	res, err := be.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "runtimeStatus": completed})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to delete the orchestration instances: %w", err)
+	}
+
+	// The history of instances that were restarted since they were queried must be kept
+	purged := make(map[string]bool, len(documents))
+	for _, document := range documents {
+		purged[document.InstanceID] = true
+	}
+	if int(res.DeletedCount) < len(documents) {
+		remaining, err := be.findInstances(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return int(res.DeletedCount), "", err
+		}
+		for _, instance := range remaining {
+			delete(purged, instance.InstanceID)
+		}
+	}
+	instanceIDs := make(bson.A, 0, len(purged))
+	for instanceID := range purged {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	if _, err := be.collection.DeleteMany(ctx, bson.M{"type": historyType, "instanceId": bson.M{"$in": instanceIDs}}); err != nil {
+		return int(res.DeletedCount), "", fmt.Errorf("failed to delete from the history: %w", err)
+	}
+	return int(res.DeletedCount), continuationToken, nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *mongoDBBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	errs := make(map[api.InstanceID]error)
+	for iid, from := range fromSequenceNumbers {
+		instance, err := be.findInstance(ctx, string(iid))
+		if err != nil {
+			return nil, err
+		} else if instance == nil || !instance.Created {
+			errs[iid] = api.ErrInstanceNotFound
+			continue
+		}
+
+		events, err := be.findHistory(ctx, instance, int64(from))
+		if err != nil {
+			errs[iid] = err
+			continue
+		}
+		histories[iid] = events
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *mongoDBBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	children, err := be.findInstances(ctx, bson.M{
+		"parentInstanceId": bson.M{"$exists": true},
+		"runtimeStatus":    bson.M{"$in": bson.A{"PENDING", "RUNNING", "SUSPENDED"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for _, child := range children {
+		parent, err := be.findInstance(ctx, child.ParentInstanceID)
+		if err != nil {
+			return nil, err
+		} else if parent != nil && parent.Created && !isCompletedStatus(parent.RuntimeStatus) {
+			continue
+		}
+
+		metadata, err := child.metadata()
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *mongoDBBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	filter := instanceQueryFilter(query)
+	pageSize := query.PageSizeOrDefault()
+	cursor, err := be.collection.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "type", Value: 1}, {Key: "instanceId", Value: 1}}).
+			SetLimit(int64(pageSize+1)).
+			SetProjection(bson.M{"events": 0, "lastActions": 0}))
+	if err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to query the orchestration instances: %w", err)
+	}
+	documents := make([]*instanceDocument, 0)
+	if err := cursor.All(ctx, &documents); err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to read the orchestration instances: %w", err)
+	}
+
+	instances := make([]*api.OrchestrationMetadata, 0, len(documents))
+	for _, document := range documents {
+		metadata, err := document.metadata()
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		instances = append(instances, metadata)
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// instanceQueryFilter returns the filter of the instance documents that implements the continuation token, instance
+// ID prefix, name, name prefix, runtime status, creation time, and completion time filters of the query.
+func instanceQueryFilter(query api.InstanceQuery) bson.M {
+	filter := bson.M{"type": instanceType, "created": true}
+	instanceID := bson.M{}
+	if query.ContinuationToken != "" {
+		instanceID["$gt"] = query.ContinuationToken
+	}
+	if query.InstanceIDPrefix != "" {
+		instanceID["$regex"] = "^" + regexp.QuoteMeta(query.InstanceIDPrefix)
+	}
+	if len(instanceID) > 0 {
+		filter["instanceId"] = instanceID
+	}
+	name := bson.M{}
+	if query.Name != "" {
+		name["$eq"] = query.Name
+	}
+	if query.NamePrefix != "" {
+		name["$regex"] = "^" + regexp.QuoteMeta(query.NamePrefix)
+	}
+	if len(name) > 0 {
+		filter["name"] = name
+	}
+	if len(query.RuntimeStatuses) > 0 {
+		runtimeStatuses := make(bson.A, 0, len(query.RuntimeStatuses))
+		for _, status := range query.RuntimeStatuses {
+			runtimeStatuses = append(runtimeStatuses, helpers.ToRuntimeStatusString(status))
+		}
+		filter["runtimeStatus"] = bson.M{"$in": runtimeStatuses}
+	}
+	createdTime := bson.M{}
+	if !query.CreatedFrom.IsZero() {
+		createdTime["$gte"] = query.CreatedFrom
+	}
+	if !query.CreatedTo.IsZero() {
+		createdTime["$lt"] = query.CreatedTo
+	}
+	if len(createdTime) > 0 {
+		filter["createdTime"] = createdTime
+	}
+	if !query.CompletedBefore.IsZero() {
+		filter["completedTime"] = bson.M{"$lt": query.CompletedBefore}
+	}
+	return filter
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *mongoDBBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instance, err := be.findInstance(ctx, string(iid))
+	if err != nil {
+		return nil, err
+	} else if instance == nil || !instance.Created {
+		return nil, api.ErrInstanceNotFound
+	}
+	metadata, err := instance.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{Metadata: metadata}
+	if state.History, err = be.findHistory(ctx, instance, 0); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(instance.Events, func(i, j int) bool { return instance.Events[i].SequenceNumber < instance.Events[j].SequenceNumber })
+	for _, e := range instance.Events {
+		event, err := backend.UnmarshalHistoryEvent(e.EventPayload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pending events: %w", err)
+		}
+		state.PendingEvents = append(state.PendingEvents, event)
+	}
+
+	cursor, err := be.collection.Find(
+		ctx,
+		bson.M{"type": taskType, "instanceId": string(iid)},
+		options.Find().SetSort(bson.D{{Key: "type", Value: 1}, {Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the activity tasks: %w", err)
+	}
+	var tasks []*taskDocument
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, fmt.Errorf("failed to read the activity tasks: %w", err)
+	}
+	for _, task := range tasks {
+		event, err := backend.UnmarshalHistoryEvent(task.EventPayload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pending tasks: %w", err)
+		}
+		state.PendingTasks = append(state.PendingTasks, event)
+	}
+	return state, nil
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *mongoDBBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	instance := &instanceDocument{
+		ID:              instanceKey(id),
+		Type:            instanceType,
+		InstanceID:      id,
+		Created:         true,
+		Name:            metadata.Name,
+		Version:         startEvent.GetVersion().GetValue(),
+		ExecutionID:     startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		RuntimeStatus:   helpers.ToRuntimeStatusString(metadata.RuntimeStatus),
+		CreatedTime:     metadata.CreatedAt,
+		LastUpdatedTime: metadata.LastUpdatedAt,
+		Input:           metadata.SerializedInput,
+		Output:          metadata.SerializedOutput,
+		CustomStatus:    metadata.SerializedCustomStatus,
+		GenerationCount: metadata.GenerationCount,
+		HistoryLength:   len(state.History),
+		Tags:            metadata.Tags,
+		Events:          []eventDocument{},
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		instance.ParentInstanceID = parent.GetOrchestrationInstance().GetInstanceId()
+	}
+	if metadata.IsComplete() {
+		completedTime := metadata.LastUpdatedAt
+		instance.CompletedTime = &completedTime
+		if be.options.Retention > 0 {
+			expireAt := time.Now().UTC().Add(be.options.Retention)
+			instance.ExpireAt = &expireAt
+		}
+	}
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		instance.FailureDetails = bytes
+	}
+
+	// Timers and scheduled starts must stay invisible to workers until they're due
+	now := time.Now().UTC()
+	for _, e := range state.PendingEvents {
+		visibleTime := now
+		if tf := e.GetTimerFired(); tf != nil {
+			visibleTime = tf.GetFireAt().AsTime()
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			visibleTime = ts.AsTime()
+		}
+
+		seq, err := be.nextSequenceNumbers(ctx, 1)
+		if err != nil {
+			return err
+		}
+		event, err := newEventDocument(e, seq, visibleTime)
+		if err != nil {
+			return err
+		}
+		instance.Events = append(instance.Events, *event)
+	}
+	instance.VisibleTime = nextVisibleTime(instance.Events, instance.HistoryLength)
+
+	if _, err := be.collection.InsertOne(ctx, instance); mongo.IsDuplicateKeyError(err) {
+		return backend.ErrDuplicateEvent
+	} else if err != nil {
+		return fmt.Errorf("failed to insert the orchestration instance: %w", err)
+	}
+
+	// The history is saved after the instance is created, so that the history of an existing instance with the same
+	// ID isn't overwritten
+	if len(state.History) > 0 {
+		docs := make([]interface{}, 0, len(state.History))
+		for i, e := range state.History {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, &historyDocument{
+				ID:             historyKey(id, instance.GenerationCount, int64(i)),
+				Type:           historyType,
+				InstanceID:     id,
+				Generation:     instance.GenerationCount,
+				SequenceNumber: int64(i),
+				EventPayload:   eventPayload,
+				ExpireAt:       instance.ExpireAt,
+			})
+		}
+		if _, err := be.collection.InsertMany(ctx, docs); err != nil {
+			return fmt.Errorf("failed to insert into the history: %w", err)
+		}
+	}
+
+	return be.insertTasks(ctx, id, state.PendingTasks)
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *mongoDBBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.findInstances(ctx, bson.M{
+		"name": name,
+		"$or": bson.A{
+			bson.M{"createdTime": bson.M{"$gte": since}},
+			bson.M{"completedTime": bson.M{"$gte": since}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, instance := range instances {
+		if !instance.CreatedTime.Before(since) {
+			stats.Started++
+		}
+
+		if instance.CompletedTime == nil || instance.CompletedTime.Before(since) {
+			continue
+		}
+		switch instance.RuntimeStatus {
+		case "COMPLETED":
+			stats.Completed++
+		case "FAILED":
+			stats.Failed++
+		default:
+			continue
+		}
+		d := instance.CompletedTime.Sub(instance.CreatedTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*mongoDBBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*mongoDBBackend) Stop(context.Context) error {
+	return nil
+}
+
+func (be *mongoDBBackend) ensureDB() error {
+	if be.client == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *mongoDBBackend) String() string {
+	return fmt.Sprintf("mongodb::%s.%s", be.options.Database, be.options.TaskHubName)
+}
+
+// nextSequenceNumbers reserves count consecutive sequence numbers for events and tasks, and returns the first one.
+func (be *mongoDBBackend) nextSequenceNumbers(ctx context.Context, count int) (int64, error) {
+	var counter struct {
+		Value int64 `bson:"value"`
+	}
+	err := be.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": counterType + "|sequence"},
+		bson.M{"$set": bson.M{"type": counterType}, "$inc": bson.M{"value": int64(count)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate a sequence number: %w", err)
+	}
+	return counter.Value - int64(count) + 1, nil
+}
+
+func (be *mongoDBBackend) insertTasks(ctx context.Context, id string, events []*backend.HistoryEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	seq, err := be.nextSequenceNumbers(ctx, len(events))
+	if err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, &taskDocument{
+			ID:             taskKey(seq),
+			Type:           taskType,
+			SequenceNumber: seq,
+			InstanceID:     id,
+			EventPayload:   eventPayload,
+		})
+		seq++
+	}
+	if _, err := be.collection.InsertMany(ctx, docs); err != nil {
+		return fmt.Errorf("failed to insert into the activity tasks: %w", err)
+	}
+	return nil
+}
+
+// findInstance reads the document of an instance, or returns nil if it doesn't exist. The document may contain only
+// events, if the instance hasn't been created yet.
+func (be *mongoDBBackend) findInstance(ctx context.Context, id string) (*instanceDocument, error) {
+	instance := new(instanceDocument)
+	err := be.collection.FindOne(ctx, bson.M{"_id": instanceKey(id)}).Decode(instance)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the orchestration instance: %w", err)
+	}
+	if !instance.Created && instance.RuntimeStatus == "" {
+		// The status of an instance that hasn't been created yet is only used to check whether it's completed
+		instance.RuntimeStatus = "PENDING"
+	}
+	return instance, nil
+}
+
+// findInstances reads the created instances that match the specified conditions, ordered by creation time and
+// instance ID.
+func (be *mongoDBBackend) findInstances(ctx context.Context, conditions bson.M) ([]*instanceDocument, error) {
+	filter := bson.M{"type": instanceType, "created": true}
+	for k, v := range conditions {
+		filter[k] = v
+	}
+
+	cursor, err := be.collection.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "type", Value: 1}, {Key: "createdTime", Value: 1}, {Key: "instanceId", Value: 1}}).
+			SetProjection(bson.M{"events": 0, "lastActions": 0}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the orchestration instances: %w", err)
+	}
+	instances := make([]*instanceDocument, 0)
+	if err := cursor.All(ctx, &instances); err != nil {
+		return nil, fmt.Errorf("failed to read the orchestration instances: %w", err)
+	}
+	return instances, nil
+}
+
+// findHistory reads the history of the current generation of an instance, starting at the specified sequence
+// number.
+func (be *mongoDBBackend) findHistory(ctx context.Context, instance *instanceDocument, from int64) ([]*backend.HistoryEvent, error) {
+	cursor, err := be.collection.Find(
+		ctx,
+		bson.M{
+			"type":       historyType,
+			"instanceId": instance.InstanceID,
+			"generation": instance.GenerationCount,
+			"seq":        bson.M{"$gte": from, "$lt": instance.HistoryLength},
+		},
+		options.Find().SetSort(bson.D{{Key: "instanceId", Value: 1}, {Key: "generation", Value: 1}, {Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the history: %w", err)
+	}
+	var docs []*historyDocument
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to read the history: %w", err)
+	}
+
+	events := make([]*backend.HistoryEvent, 0, len(docs))
+	for _, doc := range docs {
+		e, err := backend.UnmarshalHistoryEvent(doc.EventPayload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func instanceKey(id string) string {
+	return instanceType + "|" + id
+}
+
+func historyKey(id string, generation int, seq int64) string {
+	return fmt.Sprintf("%s|%s|%d|%d", historyType, id, generation, seq)
+}
+
+func taskKey(seq int64) string {
+	return fmt.Sprintf("%s|%d", taskType, seq)
+}
+
+func newEventDocument(e *backend.HistoryEvent, seq int64, visibleTime time.Time) (*eventDocument, error) {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	return &eventDocument{
+		SequenceNumber: seq,
+		VisibleTime:    visibleTime,
+		EventPayload:   eventPayload,
+	}, nil
+}
+
+// nextVisibleTime returns the time at which the orchestration work item of an instance with the specified pending
+// events becomes visible, or nil if there are no events. Instances that haven't started yet wait for all of their
+// events to become visible, so that they start at their scheduled start time.
+func nextVisibleTime(events []eventDocument, historyLength int) *time.Time {
+	var visibleTime *time.Time
+	for _, e := range events {
+		t := e.VisibleTime
+		if visibleTime == nil || (historyLength > 0 && t.Before(*visibleTime)) || (historyLength == 0 && t.After(*visibleTime)) {
+			visibleTime = &t
+		}
+	}
+	return visibleTime
+}
+
+func validateEvent(e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+	return nil
+}
+
+func isCompletedStatus(runtimeStatus string) bool {
+	return runtimeStatus == "COMPLETED" || runtimeStatus == "FAILED" || runtimeStatus == "TERMINATED"
+}
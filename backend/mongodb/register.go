@@ -0,0 +1,23 @@
+package mongodb
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+// The "mongodb" and "mongodb+srv" schemes connect to a MongoDB deployment, e.g.
+// "mongodb://localhost:27017/durabletask". The URL is used as the connection string, and its path, if any, is the
+// name of the database of the task hub.
+func init() {
+	factory := func(u *url.URL, logger backend.Logger) (backend.Backend, error) {
+		options := NewMongoDBOptions(u.String())
+		if database := strings.TrimPrefix(u.Path, "/"); database != "" {
+			options.Database = database
+		}
+		return NewMongoDBBackend(options, logger), nil
+	}
+	backend.Register("mongodb", factory)
+	backend.Register("mongodb+srv", factory)
+}
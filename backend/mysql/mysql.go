@@ -0,0 +1,1868 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:embed schema.sql
+var schema string
+
+var emptyString string = ""
+
+type MySQLOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// DataSourceName is the data source name of the MySQL or MariaDB database, in the format expected by the
+	// database/sql driver. With the github.com/go-sql-driver/mysql driver, the data source name must include
+	// parseTime=true so that timestamps can be read.
+	DataSourceName string
+
+	// DriverName is the name of the database/sql driver used to connect to the database. The app must import the
+	// package that registers this driver, e.g. github.com/go-sql-driver/mysql for "mysql".
+	DriverName string
+
+	// MaxOpenConns is the maximum number of open connections to the database. Zero means unlimited.
+	MaxOpenConns int
+
+	// MaxIdleConns is the maximum number of idle connections kept in the pool. Zero keeps the database/sql default.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is the maximum amount of time a connection may be reused, which should be shorter than the
+	// wait_timeout of the server. Zero means connections are reused forever.
+	ConnMaxLifetime time.Duration
+
+	// ConnMaxIdleTime is the maximum amount of time a connection may be idle before it's closed. Zero means
+	// connections aren't closed due to idleness.
+	ConnMaxIdleTime time.Duration
+}
+
+type mysqlBackend struct {
+	db         *sql.DB
+	workerName string
+	logger     backend.Logger
+	options    *MySQLOptions
+}
+
+// NewMySQLOptions creates a new options object for the MySQL backend provider.
+//
+// The options use the "mysql" database/sql driver by default, and connections are recycled every 3 minutes.
+func NewMySQLOptions(dataSourceName string) *MySQLOptions {
+	// Default values are provided for required options
+	return &MySQLOptions{
+		DataSourceName:           dataSourceName,
+		DriverName:               "mysql",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+		ConnMaxLifetime:          3 * time.Minute,
+	}
+}
+
+// NewMySQLBackend creates a new Backend object that's based on MySQL 8.0 or MariaDB 10.6, or later.
+//
+// Multiple workers, in the same process or in different processes, can share the same database. Work items are
+// leased using SELECT ... FOR UPDATE SKIP LOCKED, so that each work item is processed by a single worker at a time,
+// and workers don't block each other.
+func NewMySQLBackend(opts *MySQLOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewMySQLOptions("")
+	}
+
+	return &mysqlBackend{
+		db:         nil,
+		workerName: fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:    opts,
+		logger:     logger,
+	}
+}
+
+// CreateTaskHub connects to the MySQL database and applies the schema
+func (be *mysqlBackend) CreateTaskHub(ctx context.Context) error {
+	if err := be.open(); err != nil {
+		return err
+	}
+
+	// Initialize database. The statements are executed one by one because drivers don't support multiple
+	// statements per query by default.
+	for _, statement := range strings.Split(schema, ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if _, err := be.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to initialize the database: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteTaskHub drops the tables of the task hub
+func (be *mysqlBackend) DeleteTaskHub(ctx context.Context) error {
+	if err := be.open(); err != nil {
+		return err
+	}
+	defer func() {
+		be.db.Close()
+		be.db = nil
+	}()
+
+	var count int
+	if err := be.db.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'Instances'",
+	).Scan(&count); err != nil {
+		return fmt.Errorf("failed to check whether the task hub exists: %w", err)
+	} else if count == 0 {
+		return backend.ErrTaskHubNotFound
+	}
+
+	if _, err := be.db.ExecContext(ctx, "DROP TABLE IF EXISTS Instances, History, NewEvents, NewTasks, LastActions"); err != nil {
+		return fmt.Errorf("failed to drop the tables: %w", err)
+	}
+	return nil
+}
+
+// open opens the database and configures the connection pool if the database isn't already open.
+func (be *mysqlBackend) open() error {
+	if be.db != nil {
+		return nil
+	}
+
+	db, err := sql.Open(be.options.DriverName, be.options.DataSourceName)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+
+	db.SetMaxOpenConns(be.options.MaxOpenConns)
+	if be.options.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(be.options.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(be.options.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(be.options.ConnMaxIdleTime)
+
+	be.db = db
+	return nil
+}
+
+// beginTx starts a read committed transaction. Work items are leased with locking reads, which lock the gaps
+// between the rows that they scan under the default repeatable read isolation level, and would block the inserts of
+// new events and tasks.
+func (be *mysqlBackend) beginTx(ctx context.Context) (*sql.Tx, error) {
+	return be.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *mysqlBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var visibleTime *time.Time = nil
+	if delay := wi.GetAbandonDelay(); delay > 0 {
+		t := time.Now().UTC().Add(delay)
+		visibleTime = &t
+	}
+
+	dbResult, err := tx.ExecContext(
+		ctx,
+		"UPDATE NewEvents SET LockedBy = NULL, VisibleTime = ? WHERE InstanceID = ? AND LockedBy = ?",
+		visibleTime,
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update NewEvents table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE NewEvents statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	dbResult, err = tx.ExecContext(
+		ctx,
+		"UPDATE Instances SET LockedBy = NULL, LockExpiration = NULL WHERE InstanceID = ? AND LockedBy = ?",
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	rowsAffected, err = dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE Instances statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *mysqlBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE Instances SET LockExpiration = ? WHERE InstanceID = ? AND LockedBy = ?",
+		time.Now().UTC().Add(be.options.OrchestrationLockTimeout),
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE Instances statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *mysqlBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) (err error) {
+	defer func() { err = markTransient(err) }()
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	// Dynamically generate the UPDATE statement for the Instances table
+	var sqlSB strings.Builder
+	sqlSB.WriteString("UPDATE Instances SET ")
+
+	sqlUpdateArgs := make([]interface{}, 0, 10)
+	isCreated := false
+	isCompleted := false
+
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if isCreated {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			isCreated = true
+			sqlSB.WriteString("CreatedTime = ?, Input = ?, ")
+			sqlUpdateArgs = append(sqlUpdateArgs, e.Timestamp.AsTime())
+			sqlUpdateArgs = append(sqlUpdateArgs, es.Input.GetValue())
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			sqlSB.WriteString("CompletedTime = ?, Output = ?, FailureDetails = ?, ")
+			sqlUpdateArgs = append(sqlUpdateArgs, now)
+			sqlUpdateArgs = append(sqlUpdateArgs, ec.Result.GetValue())
+			if ec.FailureDetails != nil {
+				bytes, err := proto.Marshal(ec.FailureDetails)
+				if err != nil {
+					return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+				}
+				sqlUpdateArgs = append(sqlUpdateArgs, &bytes)
+			} else {
+				sqlUpdateArgs = append(sqlUpdateArgs, nil)
+			}
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		sqlSB.WriteString("CustomStatus = ?, ")
+		sqlUpdateArgs = append(sqlUpdateArgs, wi.State.CustomStatus.Value)
+	}
+
+	if count := wi.State.ContinuedAsNewCount(); count > 0 {
+		sqlSB.WriteString("GenerationCount = GenerationCount + ?, ")
+		sqlUpdateArgs = append(sqlUpdateArgs, count)
+	}
+
+	// TODO: Support for stickiness, which would extend the LockExpiration
+	sqlSB.WriteString("RuntimeStatus = ?, LastUpdatedTime = ?, LockExpiration = NULL WHERE InstanceID = ? AND LockedBy = ?")
+	sqlUpdateArgs = append(sqlUpdateArgs, helpers.ToRuntimeStatusString(wi.State.RuntimeStatus()), now, string(wi.InstanceID), wi.LockedBy)
+
+	result, err := tx.ExecContext(ctx, sqlSB.String(), sqlUpdateArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get the number of rows affected by the Instance table update: %w", err)
+	} else if count == 0 {
+		return fmt.Errorf("instance '%s' no longer exists or was locked by a different worker", string(wi.InstanceID))
+	}
+
+	// If continue-as-new, delete all existing history
+	if wi.State.ContinuedAsNew() {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM History WHERE InstanceID = ?", string(wi.InstanceID)); err != nil {
+			return fmt.Errorf("failed to delete from History table: %w", err)
+		}
+	}
+
+	// Save the actions from the most recent execution, if requested
+	if wi.State.LastActions != nil {
+		payload, err := proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: string(wi.InstanceID),
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO LastActions (InstanceID, Payload) VALUES (?, ?) ON DUPLICATE KEY UPDATE Payload = VALUES(Payload)", string(wi.InstanceID), payload); err != nil {
+			return fmt.Errorf("failed to update LastActions table: %w", err)
+		}
+	}
+
+	// Save new history events
+	newHistoryCount := len(wi.State.NewEvents())
+	if newHistoryCount > 0 {
+		query := "INSERT INTO History (InstanceID, SequenceNumber, EventPayload) VALUES (?, ?, ?)" +
+			strings.Repeat(", (?, ?, ?)", newHistoryCount-1)
+
+		args := make([]interface{}, 0, newHistoryCount*3)
+		nextSequenceNumber := len(wi.State.OldEvents())
+		for _, e := range wi.State.NewEvents() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+
+			args = append(args, string(wi.InstanceID), nextSequenceNumber, eventPayload)
+			nextSequenceNumber++
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert into the History table: %w", err)
+		}
+	}
+
+	// Save outbound activity tasks
+	newActivityCount := len(wi.State.PendingTasks())
+	if newActivityCount > 0 {
+		insertSql := "INSERT INTO NewTasks (InstanceID, EventPayload) VALUES (?, ?)" +
+			strings.Repeat(", (?, ?)", newActivityCount-1)
+
+		sqlInsertArgs := make([]interface{}, 0, newActivityCount*2)
+		for _, e := range wi.State.PendingTasks() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+
+			sqlInsertArgs = append(sqlInsertArgs, string(wi.InstanceID), eventPayload)
+		}
+
+		_, err = tx.ExecContext(ctx, insertSql, sqlInsertArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to insert into the NewTasks table: %w", err)
+		}
+	}
+
+	// Save outbound orchestrator events
+	newEventCount := len(wi.State.PendingTimers()) + len(wi.State.PendingMessages())
+	if newEventCount > 0 {
+		insertSql := "INSERT INTO NewEvents (InstanceID, EventPayload, VisibleTime) VALUES (?, ?, ?)" +
+			strings.Repeat(", (?, ?, ?)", newEventCount-1)
+
+		sqlInsertArgs := make([]interface{}, 0, newEventCount*3)
+		for _, e := range wi.State.PendingTimers() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+
+			visibileTime := e.GetTimerFired().GetFireAt().AsTime()
+			sqlInsertArgs = append(sqlInsertArgs, string(wi.InstanceID), eventPayload, visibileTime)
+		}
+
+		for _, msg := range wi.State.PendingMessages() {
+			if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+				// Need to insert a new row into the DB
+				var instanceID string
+				if err := be.createOrchestrationInstanceInternal(ctx, msg.HistoryEvent, tx, &instanceID); err != nil {
+					if err == backend.ErrDuplicateEvent {
+						be.logger.Warnf(
+							"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+							wi.InstanceID,
+							es.OrchestrationInstance.InstanceId)
+					} else {
+						return err
+					}
+				}
+			}
+
+			eventPayload, err := backend.MarshalHistoryEvent(msg.HistoryEvent)
+			if err != nil {
+				return err
+			}
+
+			sqlInsertArgs = append(sqlInsertArgs, msg.TargetInstanceID, eventPayload, nil)
+		}
+
+		_, err = tx.ExecContext(ctx, insertSql, sqlInsertArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to insert into the NewEvents table: %w", err)
+		}
+	}
+
+	// Delete inbound events
+	dbResult, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM NewEvents WHERE InstanceID = ? AND LockedBy = ?",
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewEvents table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete from the NewEvents table: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *mysqlBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := be.createOrchestrationInstance(ctx, e, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create orchestration: %w", err)
+	}
+
+	return nil
+}
+
+// createOrchestrationInstance creates the orchestration instance and its ExecutionStarted event in the specified
+// transaction.
+func (be *mysqlBackend) createOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent, tx *sql.Tx) error {
+	var instanceID string
+	if err := be.createOrchestrationInstanceInternal(ctx, e, tx, &instanceID); err != nil {
+		return err
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime *time.Time = nil
+	if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+		t := ts.AsTime()
+		visibleTime = &t
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload, VisibleTime) VALUES (?, ?, ?)`,
+		instanceID,
+		eventPayload,
+		visibleTime,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	return nil
+}
+
+func (be *mysqlBackend) createOrchestrationInstanceInternal(ctx context.Context, e *backend.HistoryEvent, tx *sql.Tx, instanceID *string) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	var parentInstanceID *string
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		parentInstanceID = &parent.GetOrchestrationInstance().InstanceId
+	}
+
+	tags, err := helpers.MarshalTags(helpers.GetTags(startEvent))
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags: %w", err)
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT IGNORE INTO Instances (
+			Name,
+			Version,
+			InstanceID,
+			ExecutionID,
+			Input,
+			RuntimeStatus,
+			CreatedTime,
+			ParentInstanceID,
+			Tags
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		startEvent.Name,
+		startEvent.Version.GetValue(),
+		startEvent.OrchestrationInstance.InstanceId,
+		startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		startEvent.Input.GetValue(),
+		"PENDING",
+		e.Timestamp.AsTime(),
+		parentInstanceID,
+		tags,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into Instances table: %w", err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	}
+
+	if rows <= 0 {
+		return backend.ErrDuplicateEvent
+	}
+
+	*instanceID = startEvent.OrchestrationInstance.InstanceId
+	return nil
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *mysqlBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = be.db.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload) VALUES (?, ?)`,
+		string(iid),
+		eventPayload,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	return nil
+}
+
+// IngestOperations implements backend.BackendWithIngest
+func (be *mysqlBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		// Each operation is applied in a savepoint so that a failed operation can be rolled back without rolling back
+		// the others
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT ingest"); err != nil {
+			return nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+		if errs[i] = be.ingestOperation(ctx, op, tx); errs[i] != nil {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT ingest"); err != nil {
+				return nil, fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT ingest"); err != nil {
+			return nil, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return errs, nil
+}
+
+func (be *mysqlBackend) ingestOperation(ctx context.Context, op *backend.IngestOperation, tx *sql.Tx) error {
+	if op.Event.GetExecutionStarted() != nil {
+		return be.createOrchestrationInstance(ctx, op.Event, tx)
+	}
+
+	if op.Event == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if op.Event.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(op.Event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload) VALUES (?, ?)`,
+		string(op.InstanceID),
+		eventPayload,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	return nil
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *mysqlBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	sqlArgs := make([]interface{}, 0, len(statuses)+3)
+	sqlArgs = append(sqlArgs, string(iid), eventPayload, string(iid))
+	for _, status := range statuses {
+		sqlArgs = append(sqlArgs, helpers.ToRuntimeStatusString(status))
+	}
+
+	// The status check and the insert are done in a single statement so that the status can't change in between
+	res, err := be.db.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload)
+		SELECT ?, ? FROM DUAL WHERE EXISTS (
+			SELECT 1 FROM Instances WHERE InstanceID = ? AND RuntimeStatus IN (?`+strings.Repeat(", ?", len(statuses)-1)+`)
+		)`,
+		sqlArgs...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var exists int
+	err = be.db.QueryRowContext(ctx, "SELECT 1 FROM Instances WHERE InstanceID = ?", string(iid)).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return api.ErrInstanceNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	return api.ErrPreconditionFailed
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *mysqlBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	row := be.db.QueryRowContext(
+		ctx,
+		"SELECT "+metadataColumns+" FROM Instances WHERE InstanceID = ?",
+		string(iid),
+	)
+
+	err := row.Err()
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", row.Err())
+	}
+
+	metadata, err := scanOrchestrationMetadata(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	}
+	return metadata, err
+}
+
+// metadataColumns are the columns of the Instances table that are read by scanOrchestrationMetadata.
+const metadataColumns = "InstanceID, Name, RuntimeStatus, CreatedTime, LastUpdatedTime, Input, Output, CustomStatus, FailureDetails, GenerationCount, Tags"
+
+// scanOrchestrationMetadata reads the orchestration metadata from a row that contains the metadataColumns.
+func scanOrchestrationMetadata(scan func(dest ...any) error) (*api.OrchestrationMetadata, error) {
+	var instanceID *string
+	var name *string
+	var runtimeStatus *string
+	var createdAt *time.Time
+	var lastUpdatedAt *time.Time
+	var input *string
+	var output *string
+	var customStatus *string
+	var failureDetails *protos.TaskFailureDetails
+	var generationCount int
+	var tags *string
+
+	var failureDetailsPayload []byte
+	err := scan(&instanceID, &name, &runtimeStatus, &createdAt, &lastUpdatedAt, &input, &output, &customStatus, &failureDetailsPayload, &generationCount, &tags)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+	}
+
+	if input == nil {
+		input = &emptyString
+	}
+
+	if output == nil {
+		output = &emptyString
+	}
+
+	if customStatus == nil {
+		customStatus = &emptyString
+	}
+
+	if len(failureDetailsPayload) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(failureDetailsPayload, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(*instanceID),
+		*name,
+		helpers.FromRuntimeStatusString(*runtimeStatus),
+		*createdAt,
+		*lastUpdatedAt,
+		*input,
+		*output,
+		*customStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = generationCount
+	if tags != nil {
+		if metadata.Tags, err = helpers.UnmarshalTags(*tags); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+	}
+	return metadata, nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *mysqlBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	row := be.db.QueryRowContext(
+		ctx,
+		`SELECT A.Payload FROM Instances I
+		LEFT OUTER JOIN LastActions A ON A.InstanceID = I.InstanceID
+		WHERE I.InstanceID = ?`,
+		string(iid),
+	)
+
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to scan the LastActions table result: %w", err)
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(payload, res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *mysqlBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT EventPayload FROM History WHERE InstanceID = ? ORDER BY SequenceNumber ASC",
+		string(wi.InstanceID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existingEvents := make([]*protos.HistoryEvent, 0, 50)
+	for rows.Next() {
+		var eventPayload []byte
+		if err := rows.Scan(&eventPayload); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		existingEvents = append(existingEvents, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the History table results: %w", err)
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *mysqlBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	return be.getOrchestrationWorkItem(ctx, backend.OrchestrationWorkItemFilter{})
+}
+
+// GetOrchestrationWorkItemWithFilter implements backend.BackendWithOrchestrationFilters
+func (be *mysqlBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	if filter.Names != nil && len(filter.Names) == 0 {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getOrchestrationWorkItem(ctx, filter)
+}
+
+// getOrchestrationWorkItem leases an orchestration instance that matches the filter and has new events that are
+// ready to be executed.
+func (be *mysqlBackend) getOrchestrationWorkItem(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	newLockExpiration := now.Add(be.options.OrchestrationLockTimeout)
+
+	args := []interface{}{
+		now, // LockExpiration for Instances table
+		now, // VisibleTime for NewEvents table
+		now, // VisibleTime for scheduled start events
+	}
+	nameFilter := ""
+	if filter.Names != nil {
+		nameFilter = " AND I.Name IN (?" + strings.Repeat(", ?", len(filter.Names)-1) + ")"
+		for _, name := range filter.Names {
+			args = append(args, name)
+		}
+	}
+
+	// Find an orchestration instance that has new events that are ready to be executed.
+	// Instances that haven't started yet and still have invisible events are waiting for their
+	// scheduled start time, so events raised to them in the meantime must wait as well.
+	// Rows that are being leased by other workers are skipped rather than waited on, so that
+	// concurrent workers lease different instances.
+	row := tx.QueryRowContext(
+		ctx,
+		`SELECT I.InstanceID FROM Instances I
+		WHERE (I.LockExpiration IS NULL OR I.LockExpiration < ?) AND EXISTS (
+			SELECT 1 FROM NewEvents E
+			WHERE E.InstanceID = I.InstanceID AND (E.VisibleTime IS NULL OR E.VisibleTime < ?)
+		) AND NOT (
+			EXISTS (SELECT 1 FROM NewEvents E WHERE E.InstanceID = I.InstanceID AND E.VisibleTime >= ?)
+			AND NOT EXISTS (SELECT 1 FROM History H WHERE H.InstanceID = I.InstanceID)
+		)`+nameFilter+`
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`,
+		args...,
+	)
+
+	var instanceID string
+	if err := row.Scan(&instanceID); err != nil {
+		if err == sql.ErrNoRows {
+			// No new events to process
+			return nil, backend.ErrNoWorkItems
+		}
+
+		return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+	}
+
+	// Place a lock on the orchestration instance
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE Instances SET LockedBy = ?, LockExpiration = ? WHERE InstanceID = ?",
+		be.workerName,
+		newLockExpiration,
+		instanceID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to lock the orchestration work-item: %w", err)
+	}
+
+	// The number of saved history events is used by the worker to detect stale cached state, so it's only counted
+	// for workers that cache state
+	var nextSequenceNumber int
+	if filter.IncludeHistoryLength {
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM History WHERE InstanceID = ?", instanceID).Scan(&nextSequenceNumber); err != nil {
+			return nil, fmt.Errorf("failed to count the history events of the orchestration work-item: %w", err)
+		}
+	}
+
+	// TODO: Get all the unprocessed events associated with the locked instance
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE NewEvents SET DequeueCount = DequeueCount + 1, LockedBy = ?
+		WHERE InstanceID = ? AND (VisibleTime IS NULL OR VisibleTime <= ?)
+		ORDER BY SequenceNumber
+		LIMIT 1000`,
+		be.workerName,
+		instanceID,
+		now,
+	); err != nil {
+		return nil, fmt.Errorf("failed to lock the orchestration work-item events: %w", err)
+	}
+
+	events, err := tx.QueryContext(
+		ctx,
+		"SELECT EventPayload, DequeueCount FROM NewEvents WHERE InstanceID = ? AND LockedBy = ? ORDER BY SequenceNumber",
+		instanceID,
+		be.workerName,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+	}
+	defer events.Close()
+
+	maxDequeueCount := int32(0)
+
+	newEvents := make([]*protos.HistoryEvent, 0, 10)
+	for events.Next() {
+		var eventPayload []byte
+		var dequeueCount int32
+		if err := events.Scan(&eventPayload, &dequeueCount); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		if dequeueCount > maxDequeueCount {
+			maxDequeueCount = dequeueCount
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		newEvents = append(newEvents, e)
+	}
+	if err := events.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the orchestration work-item events: %w", err)
+	}
+	events.Close()
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update orchestration work-item: %w", err)
+	}
+
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: api.InstanceID(instanceID),
+		NewEvents:  newEvents,
+		LockedBy:   be.workerName,
+		RetryCount: maxDequeueCount - 1,
+
+		NextSequenceNumber: nextSequenceNumber,
+	}
+
+	return wi, nil
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *mysqlBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	newLockExpiration := now.Add(be.options.ActivityLockTimeout)
+
+	row := tx.QueryRowContext(
+		ctx,
+		`SELECT SequenceNumber, InstanceID, EventPayload, DequeueCount FROM NewTasks
+		WHERE LockExpiration IS NULL OR LockExpiration < ?
+		ORDER BY SequenceNumber
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`,
+		now,
+	)
+
+	var sequenceNumber int64
+	var instanceID string
+	var eventPayload []byte
+	var dequeueCount int32
+
+	if err := row.Scan(&sequenceNumber, &instanceID, &eventPayload, &dequeueCount); err != nil {
+		if err == sql.ErrNoRows {
+			// No new activity tasks to process
+			return nil, backend.ErrNoWorkItems
+		}
+
+		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET LockedBy = ?, LockExpiration = ?, DequeueCount = DequeueCount + 1 WHERE SequenceNumber = ?",
+		be.workerName,
+		newLockExpiration,
+		sequenceNumber,
+	); err != nil {
+		return nil, fmt.Errorf("failed to lock the activity work-item: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update activity work-item: %w", err)
+	}
+
+	e, err := backend.UnmarshalHistoryEvent(eventPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	wi := &backend.ActivityWorkItem{
+		SequenceNumber: sequenceNumber,
+		InstanceID:     api.InstanceID(instanceID),
+		NewEvent:       e,
+		LockedBy:       be.workerName,
+		// The dequeue count was read before this delivery incremented it
+		RetryCount: dequeueCount,
+	}
+	return wi, nil
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *mysqlBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) (err error) {
+	defer func() { err = markTransient(err) }()
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bytes, err := backend.MarshalHistoryEvent(wi.Result)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO NewEvents (InstanceID, EventPayload) VALUES (?, ?)", string(wi.InstanceID), bytes)
+	if err != nil {
+		return fmt.Errorf("failed to insert into NewEvents table: %w", err)
+	}
+
+	dbResult, err := tx.ExecContext(ctx, "DELETE FROM NewTasks WHERE SequenceNumber = ? AND LockedBy = ?", wi.SequenceNumber, wi.LockedBy)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewTasks table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteActivityWorkItem implements backend.BackendWithExternalActivityResults
+func (be *mysqlBackend) DeleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(ctx, "DELETE FROM NewTasks WHERE SequenceNumber = ? AND LockedBy = ?", wi.SequenceNumber, wi.LockedBy)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewTasks table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *mysqlBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET LockedBy = NULL, LockExpiration = NULL WHERE SequenceNumber = ? AND LockedBy = ?",
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the NewTasks table for abandon: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by update statement for abandon: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *mysqlBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET LockExpiration = ? WHERE SequenceNumber = ? AND LockedBy = ?",
+		time.Now().UTC().Add(be.options.ActivityLockTimeout),
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the NewTasks table for lock renewal: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by update statement for lock renewal: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *mysqlBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "SELECT 1 FROM Instances WHERE InstanceID = ?", string(id))
+	if err := row.Err(); err != nil {
+		return fmt.Errorf("failed to query for instance existence: %w", err)
+	}
+
+	var unused int
+	if err := row.Scan(&unused); err == sql.ErrNoRows {
+		return api.ErrInstanceNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to scan instance existence: %w", err)
+	}
+
+	dbResult, err := tx.ExecContext(ctx, "DELETE FROM Instances WHERE InstanceID = ? AND RuntimeStatus IN ('COMPLETED', 'FAILED', 'TERMINATED')", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from the Instances table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected in Instances delete operation: %w", err)
+	}
+	if rowsAffected == 0 {
+		return api.ErrNotCompleted
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM History WHERE InstanceID = ?", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from History table: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM LastActions WHERE InstanceID = ?", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from LastActions table: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *mysqlBackend) PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error) {
+	if err := be.ensureDB(); err != nil {
+		return 0, "", err
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	// Only the state of completed orchestrations can be purged. The selected rows are locked so that they can't be
+	// restarted before they're deleted.
+	filter, sqlArgs := instanceQueryFilter(query)
+	pageSize := query.PageSizeOrDefault()
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT InstanceID FROM Instances WHERE RuntimeStatus IN ('COMPLETED', 'FAILED', 'TERMINATED')"+filter+" ORDER BY InstanceID LIMIT ? FOR UPDATE",
+		append(sqlArgs, pageSize+1)...,
+	)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	instanceIDs := make([]interface{}, 0, pageSize+1)
+	for rows.Next() {
+		var instanceID string
+		if err := rows.Scan(&instanceID); err != nil {
+			rows.Close()
+			return 0, "", fmt.Errorf("failed to scan the instance ID: %w", err)
+		}
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, "", fmt.Errorf("failed to read the instance IDs: %w", err)
+	}
+	rows.Close()
+	if len(instanceIDs) == 0 {
+		return 0, "", nil
+	}
+
+	continuationToken := ""
+	if len(instanceIDs) > pageSize {
+		instanceIDs = instanceIDs[:pageSize]
+		continuationToken = instanceIDs[len(instanceIDs)-1].(string)
+	}
+	inClause := "(?" + strings.Repeat(", ?", len(instanceIDs)-1) + ")"
+	for _, table := range []string{"Instances", "History", "LastActions"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE InstanceID IN "+inClause, instanceIDs...); err != nil {
+			return 0, "", fmt.Errorf("failed to delete from the %s table: %w", table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(instanceIDs), continuationToken, nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *mysqlBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	if len(fromSequenceNumbers) == 0 {
+		return histories, nil
+	}
+
+	tx, err := be.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	idArgs := make([]interface{}, 0, len(fromSequenceNumbers))
+	historyArgs := make([]interface{}, 0, len(fromSequenceNumbers)*2)
+	for iid, from := range fromSequenceNumbers {
+		idArgs = append(idArgs, string(iid))
+		historyArgs = append(historyArgs, string(iid), from)
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT InstanceID FROM Instances WHERE InstanceID IN (?"+strings.Repeat(", ?", len(idArgs)-1)+")",
+		idArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	for rows.Next() {
+		var instanceID string
+		if err := rows.Scan(&instanceID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+		}
+		histories[api.InstanceID(instanceID)] = make([]*backend.HistoryEvent, 0)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(
+		ctx,
+		"SELECT InstanceID, EventPayload FROM History WHERE (InstanceID = ? AND SequenceNumber >= ?)"+
+			strings.Repeat(" OR (InstanceID = ? AND SequenceNumber >= ?)", len(fromSequenceNumbers)-1)+
+			" ORDER BY InstanceID, SequenceNumber ASC",
+		historyArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the History table: %w", err)
+	}
+	defer rows.Close()
+
+	errs := make(map[api.InstanceID]error)
+	for rows.Next() {
+		var instanceID string
+		var eventPayload []byte
+		if err := rows.Scan(&instanceID, &eventPayload); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		iid := api.InstanceID(instanceID)
+		if _, failed := errs[iid]; failed {
+			continue
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			errs[iid] = err
+			delete(histories, iid)
+			continue
+		}
+		histories[iid] = append(histories[iid], e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the History table results: %w", err)
+	}
+
+	for iid := range fromSequenceNumbers {
+		if _, ok := histories[iid]; !ok {
+			if _, failed := errs[iid]; !failed {
+				errs[iid] = api.ErrInstanceNotFound
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *mysqlBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT "+metadataColumns+` FROM Instances WHERE InstanceID IN (
+			SELECT c.InstanceID FROM Instances c
+			LEFT JOIN Instances p ON p.InstanceID = c.ParentInstanceID
+			WHERE c.ParentInstanceID IS NOT NULL
+				AND c.RuntimeStatus IN ('PENDING', 'RUNNING', 'SUSPENDED')
+				AND (p.InstanceID IS NULL OR p.RuntimeStatus IN ('COMPLETED', 'FAILED', 'TERMINATED'))
+		) ORDER BY CreatedTime`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for rows.Next() {
+		metadata, err := scanOrchestrationMetadata(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *mysqlBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	filter, sqlArgs := instanceQueryFilter(query)
+	pageSize := query.PageSizeOrDefault()
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT "+metadataColumns+" FROM Instances WHERE 1 = 1"+filter+" ORDER BY InstanceID LIMIT ?",
+		append(sqlArgs, pageSize+1)...,
+	)
+	if err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	instances := make([]*api.OrchestrationMetadata, 0)
+	for rows.Next() {
+		metadata, err := scanOrchestrationMetadata(rows.Scan)
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		instances = append(instances, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// instanceQueryFilter returns the conditions of the Instances table that implement the continuation token, instance
+// ID prefix, name, name prefix, runtime status, creation time, and completion time filters of the query, each
+// starting with " AND ", and their arguments.
+func instanceQueryFilter(query api.InstanceQuery) (string, []interface{}) {
+	var sqlSB strings.Builder
+	sqlArgs := make([]interface{}, 0, len(query.RuntimeStatuses)+10)
+	if query.ContinuationToken != "" {
+		sqlSB.WriteString(" AND InstanceID > ?")
+		sqlArgs = append(sqlArgs, query.ContinuationToken)
+	}
+	if query.InstanceIDPrefix != "" {
+		sqlSB.WriteString(" AND LEFT(InstanceID, CHAR_LENGTH(?)) = ?")
+		sqlArgs = append(sqlArgs, query.InstanceIDPrefix, query.InstanceIDPrefix)
+	}
+	if query.Name != "" {
+		sqlSB.WriteString(" AND Name = ?")
+		sqlArgs = append(sqlArgs, query.Name)
+	}
+	if query.NamePrefix != "" {
+		sqlSB.WriteString(" AND LEFT(Name, CHAR_LENGTH(?)) = ?")
+		sqlArgs = append(sqlArgs, query.NamePrefix, query.NamePrefix)
+	}
+	if len(query.RuntimeStatuses) > 0 {
+		sqlSB.WriteString(" AND RuntimeStatus IN (?" + strings.Repeat(", ?", len(query.RuntimeStatuses)-1) + ")")
+		for _, status := range query.RuntimeStatuses {
+			sqlArgs = append(sqlArgs, helpers.ToRuntimeStatusString(status))
+		}
+	}
+	if !query.CreatedFrom.IsZero() {
+		sqlSB.WriteString(" AND CreatedTime >= ?")
+		sqlArgs = append(sqlArgs, query.CreatedFrom.UTC())
+	}
+	if !query.CreatedTo.IsZero() {
+		sqlSB.WriteString(" AND CreatedTime < ?")
+		sqlArgs = append(sqlArgs, query.CreatedTo.UTC())
+	}
+	if !query.CompletedBefore.IsZero() {
+		sqlSB.WriteString(" AND CompletedTime < ?")
+		sqlArgs = append(sqlArgs, query.CompletedBefore.UTC())
+	}
+	return sqlSB.String(), sqlArgs
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *mysqlBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	// A repeatable read transaction so that the metadata, history, and pending events are a consistent snapshot
+	tx, err := be.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "SELECT "+metadataColumns+" FROM Instances WHERE InstanceID = ?", string(iid))
+	metadata, err := scanOrchestrationMetadata(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{Metadata: metadata}
+	if state.History, err = readEvents(ctx, tx, "SELECT EventPayload FROM History WHERE InstanceID = ? ORDER BY SequenceNumber ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the History table: %w", err)
+	}
+	if state.PendingEvents, err = readEvents(ctx, tx, "SELECT EventPayload FROM NewEvents WHERE InstanceID = ? ORDER BY SequenceNumber ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the NewEvents table: %w", err)
+	}
+	if state.PendingTasks, err = readEvents(ctx, tx, "SELECT EventPayload FROM NewTasks WHERE InstanceID = ? ORDER BY SequenceNumber ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the NewTasks table: %w", err)
+	}
+	return state, nil
+}
+
+// readEvents reads the history events returned by a query that selects a single column with event payloads.
+func readEvents(ctx context.Context, tx *sql.Tx, query string, iid api.InstanceID) ([]*backend.HistoryEvent, error) {
+	rows, err := tx.QueryContext(ctx, query, string(iid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*backend.HistoryEvent, 0)
+	for rows.Next() {
+		var eventPayload []byte
+		if err := rows.Scan(&eventPayload); err != nil {
+			return nil, err
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *mysqlBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+	var parentInstanceID *string
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		parentInstanceID = &parent.GetOrchestrationInstance().InstanceId
+	}
+	tags, err := helpers.MarshalTags(metadata.Tags)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags: %w", err)
+	}
+	var completedTime *time.Time
+	if metadata.IsComplete() {
+		completedTime = &metadata.LastUpdatedAt
+	}
+	var failureDetailsPayload []byte
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		failureDetailsPayload = bytes
+	}
+
+	tx, err := be.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT IGNORE INTO Instances (
+			Name,
+			Version,
+			InstanceID,
+			ExecutionID,
+			RuntimeStatus,
+			CreatedTime,
+			LastUpdatedTime,
+			CompletedTime,
+			Input,
+			Output,
+			CustomStatus,
+			FailureDetails,
+			ParentInstanceID,
+			GenerationCount,
+			Tags
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		metadata.Name,
+		startEvent.GetVersion().GetValue(),
+		string(metadata.InstanceID),
+		startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		helpers.ToRuntimeStatusString(metadata.RuntimeStatus),
+		metadata.CreatedAt.UTC(),
+		metadata.LastUpdatedAt.UTC(),
+		completedTime,
+		metadata.SerializedInput,
+		metadata.SerializedOutput,
+		metadata.SerializedCustomStatus,
+		failureDetailsPayload,
+		parentInstanceID,
+		metadata.GenerationCount,
+		tags,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into Instances table: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	} else if rows <= 0 {
+		return backend.ErrDuplicateEvent
+	}
+
+	for i, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO History (InstanceID, SequenceNumber, EventPayload) VALUES (?, ?, ?)", string(metadata.InstanceID), i, eventPayload); err != nil {
+			return fmt.Errorf("failed to insert into the History table: %w", err)
+		}
+	}
+
+	for _, e := range state.PendingEvents {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+
+		// Timers and scheduled starts must stay invisible to workers until they're due
+		var visibleTime *time.Time
+		if tf := e.GetTimerFired(); tf != nil {
+			t := tf.GetFireAt().AsTime()
+			visibleTime = &t
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			t := ts.AsTime()
+			visibleTime = &t
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO NewEvents (InstanceID, EventPayload, VisibleTime) VALUES (?, ?, ?)", string(metadata.InstanceID), eventPayload, visibleTime); err != nil {
+			return fmt.Errorf("failed to insert into the NewEvents table: %w", err)
+		}
+	}
+
+	for _, e := range state.PendingTasks {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO NewTasks (InstanceID, EventPayload) VALUES (?, ?)", string(metadata.InstanceID), eventPayload); err != nil {
+			return fmt.Errorf("failed to insert into the NewTasks table: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *mysqlBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	row := be.db.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM Instances WHERE Name = ? AND CreatedTime >= ?",
+		name,
+		since.UTC(),
+	)
+	if err := row.Scan(&stats.Started); err != nil {
+		return nil, fmt.Errorf("failed to count the started instances: %w", err)
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		`SELECT RuntimeStatus, CreatedTime, CompletedTime FROM Instances
+		WHERE Name = ? AND CompletedTime >= ? AND RuntimeStatus IN ('COMPLETED', 'FAILED')`,
+		name,
+		since.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	var durations []time.Duration
+	var total time.Duration
+	for rows.Next() {
+		var runtimeStatus string
+		var createdAt, completedAt time.Time
+		if err := rows.Scan(&runtimeStatus, &createdAt, &completedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+		}
+		if runtimeStatus == "FAILED" {
+			stats.Failed++
+		} else {
+			stats.Completed++
+		}
+		d := completedAt.Sub(createdAt)
+		durations = append(durations, d)
+		total += d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*mysqlBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*mysqlBackend) Stop(context.Context) error {
+	return nil
+}
+
+// markTransient marks the errors of transactions that were rolled back because of a deadlock as transient.
+func markTransient(err error) error {
+	var mysqlErr *mysqldriver.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1213 {
+		return backend.TransientError(err)
+	}
+	return err
+}
+
+func (be *mysqlBackend) ensureDB() error {
+	if be.db == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *mysqlBackend) String() string {
+	return fmt.Sprintf("mysql::%s", be.options.DriverName)
+}
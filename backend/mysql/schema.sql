@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS Instances (
+    InstanceID VARCHAR(255) PRIMARY KEY NOT NULL,
+    ExecutionID VARCHAR(255) NOT NULL,
+    Name VARCHAR(255) NOT NULL, -- the type name of the orchestration or entity
+    Version VARCHAR(255) NULL, -- the version of the orchestration (optional)
+    RuntimeStatus VARCHAR(32) NOT NULL,
+    CreatedTime DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    LastUpdatedTime DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    CompletedTime DATETIME(6) NULL,
+    LockedBy VARCHAR(255) NULL,
+    LockExpiration DATETIME(6) NULL,
+    Input LONGTEXT NULL,
+    Output LONGTEXT NULL,
+    CustomStatus LONGTEXT NULL,
+    FailureDetails LONGBLOB NULL,
+    ParentInstanceID VARCHAR(255) NULL,
+    GenerationCount INT NOT NULL DEFAULT 0, -- the number of times the orchestration continued-as-new
+    Tags TEXT NULL, -- the tags of the orchestration, as a JSON object (optional)
+
+    -- This index is used by LockNext and Purge logic
+    INDEX IX_Instances_RuntimeStatus (RuntimeStatus),
+
+    -- This index is intended to help the performance of multi-instance query
+    INDEX IX_Instances_CreatedTime (CreatedTime)
+);
+
+CREATE TABLE IF NOT EXISTS History (
+    InstanceID VARCHAR(255) NOT NULL,
+    SequenceNumber INT NOT NULL,
+    EventPayload LONGBLOB NOT NULL,
+
+    CONSTRAINT PK_History PRIMARY KEY (InstanceID, SequenceNumber)
+);
+
+CREATE TABLE IF NOT EXISTS NewEvents (
+    SequenceNumber BIGINT AUTO_INCREMENT PRIMARY KEY, -- order is important for FIFO
+    InstanceID VARCHAR(255) NOT NULL,
+    ExecutionID VARCHAR(255) NULL,
+    Timestamp DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    VisibleTime DATETIME(6) NULL, -- for scheduled or abandoned messages
+    DequeueCount INT NOT NULL DEFAULT 0,
+    LockedBy VARCHAR(255) NULL,
+    EventPayload LONGBLOB NOT NULL,
+
+    -- This index is used to fetch the new events of a locked instance
+    INDEX IX_NewEvents_InstanceID (InstanceID, SequenceNumber)
+);
+
+CREATE TABLE IF NOT EXISTS NewTasks (
+    SequenceNumber BIGINT AUTO_INCREMENT PRIMARY KEY, -- order is important for FIFO
+    InstanceID VARCHAR(255) NOT NULL,
+    ExecutionID VARCHAR(255) NULL,
+    Timestamp DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    DequeueCount INT NOT NULL DEFAULT 0,
+    LockedBy VARCHAR(255) NULL,
+    LockExpiration DATETIME(6) NULL,
+    EventPayload LONGBLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS LastActions (
+    InstanceID VARCHAR(255) PRIMARY KEY NOT NULL,
+    Payload LONGBLOB NOT NULL -- serialized OrchestratorResponse containing only the actions
+);
@@ -2,12 +2,16 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/microsoft/durabletask-go/api"
@@ -27,13 +31,26 @@ type orchestratorProcessor struct {
 	be       Backend
 	executor OrchestratorExecutor
 	logger   Logger
+	options  *WorkerOptions
+	cache    *orchestrationStateCache // nil if caching is disabled
 }
 
 func NewOrchestrationWorker(be Backend, executor OrchestratorExecutor, logger Logger, opts ...NewTaskWorkerOptions) TaskWorker {
+	options := NewWorkerOptions()
+	for _, configure := range opts {
+		configure(options)
+	}
 	processor := &orchestratorProcessor{
 		be:       be,
 		executor: executor,
 		logger:   logger,
+		options:  options,
+	}
+	if options.StateCacheSize > 0 {
+		processor.cache = newOrchestrationStateCache(options.StateCacheSize)
+	}
+	if _, ok := As[BackendWithLastActions](be); options.PersistLastActions && !ok {
+		logger.Warnf("%v: the backend doesn't support saving the last orchestrator actions, so they aren't persisted", processor.Name())
 	}
 	return NewTaskWorker(be, processor, logger, opts...)
 }
@@ -45,6 +62,13 @@ func (*orchestratorProcessor) Name() string {
 
 // FetchWorkItem implements TaskProcessor
 func (p *orchestratorProcessor) FetchWorkItem(ctx context.Context) (WorkItem, error) {
+	if be, ok := As[BackendWithOrchestrationFilters](p.be); ok {
+		filter := OrchestrationWorkItemFilter{
+			Names:                executorCapabilities(p.executor).orchestratorNames(),
+			IncludeHistoryLength: p.cache != nil,
+		}
+		return be.GetOrchestrationWorkItemWithFilter(ctx, filter)
+	}
 	return p.be.GetOrchestrationWorkItem(ctx)
 }
 
@@ -53,10 +77,11 @@ func (w *orchestratorProcessor) ProcessWorkItem(ctx context.Context, cwi WorkIte
 	wi := cwi.(*OrchestrationWorkItem)
 	w.logger.Debugf("%v: received work item with %d new event(s): %v", wi.InstanceID, len(wi.NewEvents), helpers.HistoryListSummary(wi.NewEvents))
 
-	// TODO: Caching
-	// In the fullness of time, we should consider caching executors and runtime state
-	// so that we can skip the loading of state and/or the creation of executors. A cached
-	// executor should allow us to 1) skip runtime state loading and 2) execute only new events.
+	// A cached state has the same history events as the previous work item, which allows executors that cache
+	// orchestrators to execute only the new events rather than replaying the full history.
+	if wi.State == nil {
+		wi.State = w.getCachedState(wi)
+	}
 	if wi.State == nil {
 		if state, err := w.be.GetOrchestrationRuntimeState(ctx, wi); err != nil {
 			return fmt.Errorf("failed to load orchestration state: %w", err)
@@ -66,12 +91,31 @@ func (w *orchestratorProcessor) ProcessWorkItem(ctx context.Context, cwi WorkIte
 	}
 	w.logger.Debugf("%v: got orchestration runtime state: %s", wi.InstanceID, getOrchestrationStateDescription(wi))
 
+	if !wi.State.IsValid() {
+		return w.handleInvalidState(ctx, wi)
+	}
+	if name := getWorkItemOrchestrationName(wi); !executorCapabilities(w.executor).SupportsOrchestrator(name) {
+		return fmt.Errorf("%v: orchestrator '%s' is %w", wi.InstanceID, name, ErrUnsupportedByExecutor)
+	} else if err := w.options.CircuitBreaker.allow(name); err != nil {
+		return fmt.Errorf("%v: %w", wi.InstanceID, err)
+	}
+
+	if len(wi.NewEvents) == 0 && !wi.State.IsCompleted() {
+		if proceed, err := w.handleEmptyWorkItem(wi); !proceed {
+			return err
+		}
+	}
+
 	if ctx, span, ok := w.applyWorkItem(ctx, wi); ok {
 		defer func() {
 			// Note that the span and ctx references may be updated inside the continue-as-new loop.
 			w.endOrchestratorSpan(ctx, wi, span, false)
 		}()
 
+		if w.options.OrchestrationTimeoutPolicy == OrchestrationTimeoutFail && hasOrchestrationTimedOut(wi.State.NewEvents()) {
+			return w.failTimedOutOrchestration(wi, span)
+		}
+
 		for continueAsNewCount := 0; ; continueAsNewCount++ {
 			if continueAsNewCount > 0 {
 				w.logger.Debugf("%v: continuing-as-new with %d event(s): %s", wi.InstanceID, len(wi.State.NewEvents()), helpers.HistoryListSummary(wi.State.NewEvents()))
@@ -80,25 +124,53 @@ func (w *orchestratorProcessor) ProcessWorkItem(ctx context.Context, cwi WorkIte
 			}
 
 			// Run the user orchestrator code, providing the old history and new events together.
-			results, err := w.executor.ExecuteOrchestrator(ctx, wi.InstanceID, wi.State.OldEvents(), wi.State.NewEvents())
+			oldEvents, newEvents := wi.State.ExecutionHistory()
+			results, err := w.executor.ExecuteOrchestrator(ctx, wi.InstanceID, oldEvents, newEvents)
 			if err != nil {
 				return fmt.Errorf("error executing orchestrator: %w", err)
 			}
 			w.logger.Debugf("%v: orchestrator returned %d action(s): %s", wi.InstanceID, len(results.Response.Actions), helpers.ActionListSummary(results.Response.Actions))
 
 			// Apply the orchestrator outputs to the orchestration state.
+			oldInput, _ := wi.State.Input()
 			continuedAsNew, err := wi.State.ApplyActions(results.Response.Actions, helpers.TraceContextFromSpan(span))
 			if err != nil {
 				return fmt.Errorf("failed to apply the execution result actions: %w", err)
 			}
-			wi.State.CustomStatus = results.Response.CustomStatus
+			if continuedAsNew && w.options.ContinueAsNewInputTransform != nil {
+				if err := w.transformContinueAsNewInput(wi, oldInput); err != nil {
+					return err
+				}
+			}
+			if !continuedAsNew {
+				w.applyInjectedFaults(wi)
+			}
+			if err := w.validateCustomStatus(wi.State, results.Response.CustomStatus); err != nil {
+				w.logger.Warnf("%v: discarding invalid custom status: %v", wi.InstanceID, err)
+			} else {
+				wi.State.CustomStatus = results.Response.CustomStatus
+			}
+			if w.options.PersistLastActions {
+				// A non-nil list tells the backend to save the actions, even if there aren't any.
+				wi.State.LastActions = append([]*protos.OrchestratorAction{}, results.Response.Actions...)
+			}
 
 			// When continuing-as-new, we re-execute the orchestrator from the beginning with a truncated state in a tight loop
 			// until the orchestrator performs some non-continue-as-new action.
 			if continuedAsNew {
-				const MaxContinueAsNewCount = 20
-				if continueAsNewCount >= MaxContinueAsNewCount {
-					return fmt.Errorf("exceeded tight-loop continue-as-new limit of %d iterations", MaxContinueAsNewCount)
+				wi.State.continuedAsNewCount++
+
+				if limit := w.options.MaxContinueAsNewCount; limit > 0 && continueAsNewCount >= limit {
+					if w.options.ContinueAsNewLimitPolicy != ContinueAsNewLimitYield {
+						return fmt.Errorf("%v: exceeded tight-loop continue-as-new limit of %d iterations", wi.InstanceID, limit)
+					}
+
+					// Save the new generation, and wake it up immediately with a timer so that it's executed by the
+					// next work item
+					w.logger.Debugf("%v: yielding after %d continue-as-new iterations", wi.InstanceID, limit)
+					wi.State.pendingTimers = append(wi.State.pendingTimers, helpers.NewTimerFiredEvent(
+						continueAsNewYieldTimerID, timestamppb.New(w.now(ctx, wi)), nil))
+					break
 				}
 
 				// We create a new trace span for every continue-as-new
@@ -113,37 +185,290 @@ func (w *orchestratorProcessor) ProcessWorkItem(ctx context.Context, cwi WorkIte
 			}
 			break
 		}
+		w.scheduleOrchestrationTimeout(wi)
+	}
+	return nil
+}
+
+// The IDs of the durable timers that the orchestration worker schedules on behalf of orchestrations: to deliver the
+// buffered events of [WithOrderedEvents] once their buffering window expires, to wake up orchestrations that yielded
+// after exceeding the tight-loop continue-as-new limit, and to fire when orchestrations exceed the timeout configured
+// by [api.WithOrchestrationTimeout]. Orchestrators never use negative timer IDs, and ignore the timers that they
+// didn't create, so these IDs never collide with theirs. New IDs must be added at the end, since they're saved in
+// orchestration histories.
+const (
+	orderedEventsFlushTimerID int32 = math.MinInt32 + iota
+	continueAsNewYieldTimerID
+	orchestrationTimeoutTimerID
+)
+
+// scheduleOrchestrationTimeout schedules the timeout timer of an orchestration that was started by the work item, if
+// the orchestration has a timeout. The timer is scheduled only once, so the timeout isn't reset when the orchestration
+// continues as new.
+func (w *orchestratorProcessor) scheduleOrchestrationTimeout(wi *OrchestrationWorkItem) {
+	if wi.State.IsCompleted() {
+		return
+	}
+	for _, e := range wi.NewEvents {
+		es := e.GetExecutionStarted()
+		if es == nil {
+			continue
+		}
+		timeout := helpers.GetOrchestrationTimeout(es)
+		if timeout <= 0 {
+			return
+		}
+		start := e.Timestamp.AsTime()
+		if es.ScheduledStartTimestamp != nil {
+			start = es.ScheduledStartTimestamp.AsTime()
+		}
+		w.logger.Debugf("%v: orchestration times out after %v", wi.InstanceID, timeout)
+		wi.State.pendingTimers = append(wi.State.pendingTimers, helpers.NewTimerFiredEvent(
+			orchestrationTimeoutTimerID, timestamppb.New(start.Add(timeout)), nil))
+		return
+	}
+}
+
+// hasOrchestrationTimedOut returns true if the specified events contain the timeout timer of the orchestration.
+func hasOrchestrationTimedOut(events []*protos.HistoryEvent) bool {
+	for _, e := range events {
+		if e.GetTimerFired() != nil && e.GetTimerFired().TimerId == orchestrationTimeoutTimerID {
+			return true
+		}
+	}
+	return false
+}
+
+// failTimedOutOrchestration fails an orchestration that exceeded its timeout, without executing the orchestrator.
+func (w *orchestratorProcessor) failTimedOutOrchestration(wi *OrchestrationWorkItem, span trace.Span) error {
+	w.logger.Warnf("%v: orchestration timed out; failing the orchestration", wi.InstanceID)
+	timeout := helpers.GetOrchestrationTimeout(wi.State.startEvent)
+	action := helpers.NewCompleteOrchestrationAction(
+		-1,
+		protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED,
+		nil,
+		nil,
+		&protos.TaskFailureDetails{
+			ErrorType:    "OrchestrationTimeout",
+			ErrorMessage: fmt.Sprintf("the orchestration didn't complete within %v", timeout),
+		},
+	)
+	if _, err := wi.State.ApplyActions([]*protos.OrchestratorAction{action}, helpers.TraceContextFromSpan(span)); err != nil {
+		return fmt.Errorf("failed to fail the timed out orchestration: %w", err)
 	}
 	return nil
 }
 
+// getWorkItemOrchestrationName returns the name of the orchestration of a work item, which is found in the new events
+// of the work item if the orchestration hasn't started yet.
+func getWorkItemOrchestrationName(wi *OrchestrationWorkItem) string {
+	if name, err := wi.State.Name(); err == nil {
+		return name
+	}
+	for _, e := range wi.NewEvents {
+		if es := e.GetExecutionStarted(); es != nil {
+			return es.Name
+		}
+	}
+	return ""
+}
+
 // CompleteWorkItem implements TaskProcessor
 func (p *orchestratorProcessor) CompleteWorkItem(ctx context.Context, wi WorkItem) error {
 	owi := wi.(*OrchestrationWorkItem)
-	return p.be.CompleteOrchestrationWorkItem(ctx, owi)
+	if err := p.be.CompleteOrchestrationWorkItem(ctx, owi); err != nil {
+		return err
+	}
+	p.cacheState(owi)
+	p.options.CircuitBreaker.recordOutcome(owi)
+	return nil
 }
 
 // AbandonWorkItem implements TaskProcessor
 func (p *orchestratorProcessor) AbandonWorkItem(ctx context.Context, wi WorkItem) error {
 	owi := wi.(*OrchestrationWorkItem)
+	if p.cache != nil {
+		p.cache.remove(owi.InstanceID)
+	}
 	return p.be.AbandonOrchestrationWorkItem(ctx, owi)
 }
 
-func (w *orchestratorProcessor) applyWorkItem(ctx context.Context, wi *OrchestrationWorkItem) (context.Context, trace.Span, bool) {
-	// Ignore work items for orchestrations that are completed or are in a corrupted state.
-	if !wi.State.IsValid() {
+// applyInjectedFaults applies the pending injected faults that affect the activities and timers scheduled by the
+// most recent orchestrator execution. Each applied fault is recorded in the orchestration history.
+func (w *orchestratorProcessor) applyInjectedFaults(wi *OrchestrationWorkItem) {
+	s := wi.State
+	if len(s.pendingTasks) > 0 {
+		if fault, ok := s.pendingFault(api.FaultFailNextActivity, ""); ok {
+			// The activity is never executed. Instead, the orchestration receives a failure for it.
+			scheduled := s.pendingTasks[0]
+			s.pendingTasks = s.pendingTasks[1:]
+			message := fault.Message
+			if message == "" {
+				message = "injected fault"
+			}
+			w.logger.Warnf("%v: failing activity '%s' due to an injected fault", wi.InstanceID, scheduled.GetTaskScheduled().GetName())
+			failedEvent := helpers.NewTaskFailedEvent(scheduled.EventId, &protos.TaskFailureDetails{
+				ErrorType:    "InjectedFault",
+				ErrorMessage: message,
+			})
+			s.pendingMessages = append(s.pendingMessages, OrchestratorMessage{HistoryEvent: s.stamp(failedEvent), TargetInstanceID: string(wi.InstanceID)})
+			s.AddEvent(s.stamp(newFaultAppliedEvent(fault.ID)))
+		}
+	}
+	if len(s.pendingTimers) > 0 {
+		if fault, ok := s.pendingFault(api.FaultDelayNextTimer, ""); ok {
+			timerFired := s.pendingTimers[0].GetTimerFired()
+			w.logger.Warnf("%v: delaying timer #%d by %v due to an injected fault", wi.InstanceID, timerFired.GetTimerId(), fault.Delay)
+			timerFired.FireAt = timestamppb.New(timerFired.GetFireAt().AsTime().Add(fault.Delay))
+			s.AddEvent(s.stamp(newFaultAppliedEvent(fault.ID)))
+		}
+	}
+}
+
+// handleInvalidState applies the configured [InvalidStatePolicy] to a work item for an orchestration whose state is
+// invalid.
+func (w *orchestratorProcessor) handleInvalidState(ctx context.Context, wi *OrchestrationWorkItem) error {
+	switch w.options.InvalidStatePolicy {
+	case InvalidStateFail:
+		if wi.State.IsCompleted() {
+			w.logger.Warnf("%v: orchestration state is invalid and the orchestration already failed; dropping work item", wi.InstanceID)
+			return nil
+		}
+		w.logger.Errorf("%v: orchestration state is invalid; failing the orchestration", wi.InstanceID)
+		failureDetails := &protos.TaskFailureDetails{
+			ErrorType:    "InvalidOrchestrationState",
+			ErrorMessage: ErrInvalidOrchestrationState.Error(),
+		}
+		wi.State.now = w.now(ctx, wi)
+		e := helpers.NewExecutionCompletedEvent(-1, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, nil, failureDetails)
+		return wi.State.AddEvent(wi.State.stamp(e))
+	case InvalidStateQuarantine:
+		// The worker moves the work item to the dead-letter store
+		return fmt.Errorf("%v: %w", wi.InstanceID, ErrInvalidOrchestrationState)
+	default:
 		w.logger.Warnf("%v: orchestration state is invalid; dropping work item", wi.InstanceID)
-		return nil, nil, false
-	} else if wi.State.IsCompleted() {
+		return nil
+	}
+}
+
+// handleEmptyWorkItem applies the configured policy to a work item without new events, and returns true if the work
+// item should be processed anyway.
+func (w *orchestratorProcessor) handleEmptyWorkItem(wi *OrchestrationWorkItem) (bool, error) {
+	switch w.options.EmptyWorkItemPolicy {
+	case EmptyWorkItemDrop:
+		w.logger.Debugf("%v: the work item had no events; dropping work item", wi.InstanceID)
+		return false, nil
+	case EmptyWorkItemError:
+		return false, fmt.Errorf("%v: %w", wi.InstanceID, ErrEmptyWorkItem)
+	default:
+		w.logger.Warnf("%v: the work item had no events!", wi.InstanceID)
+		return true, nil
+	}
+}
+
+// transformContinueAsNewInput replaces the input of a continued-as-new orchestration with the result of the
+// configured input transform.
+func (w *orchestratorProcessor) transformContinueAsNewInput(wi *OrchestrationWorkItem, oldInput string) error {
+	startEvent := wi.State.startEvent
+	if startEvent == nil {
+		return nil
+	}
+
+	var newInput []byte
+	if startEvent.Input != nil {
+		newInput = []byte(startEvent.Input.GetValue())
+	}
+	transformed, err := w.options.ContinueAsNewInputTransform(wi.InstanceID, []byte(oldInput), newInput)
+	if err != nil {
+		return fmt.Errorf("failed to transform the continue-as-new input: %w", err)
+	}
+
+	if transformed == nil {
+		startEvent.Input = nil
+	} else {
+		startEvent.Input = wrapperspb.String(string(transformed))
+	}
+	return nil
+}
+
+// now returns the current time from the configured timestamp source, falling back to the local clock on errors.
+func (p *orchestratorProcessor) now(ctx context.Context, wi *OrchestrationWorkItem) time.Time {
+	if p.options.TimestampSource == nil {
+		return time.Now()
+	}
+	t, err := p.options.TimestampSource.Now(ctx)
+	if err != nil {
+		p.logger.Warnf("%v: failed to get the current time from the timestamp source, using the local clock instead: %v", wi.InstanceID, err)
+		return time.Now()
+	}
+	return t
+}
+
+// getCachedState returns the cached runtime state of the work item's orchestration, or nil if there's no cached state
+// or if the cached state is stale compared to the history that the backend has saved.
+func (p *orchestratorProcessor) getCachedState(wi *OrchestrationWorkItem) *OrchestrationRuntimeState {
+	if p.cache == nil {
+		return nil
+	}
+	state, ok := p.cache.take(wi.InstanceID)
+	if !ok {
+		p.cache.recordLookup(false)
+		return nil
+	}
+	if len(state.OldEvents()) != wi.NextSequenceNumber {
+		p.logger.Debugf("%v: cached state is stale (%d cached event(s), %d saved event(s)); reloading", wi.InstanceID, len(state.OldEvents()), wi.NextSequenceNumber)
+		p.cache.recordLookup(false)
+		return nil
+	}
+	p.cache.recordLookup(true)
+	return state
+}
+
+// cacheStats implements cachingTaskProcessor
+func (p *orchestratorProcessor) cacheStats() CacheStats {
+	if p.cache == nil {
+		return CacheStats{}
+	}
+	return p.cache.stats()
+}
+
+// invalidateCache implements cachingTaskProcessor
+func (p *orchestratorProcessor) invalidateCache(id api.InstanceID) {
+	if p.cache != nil {
+		p.cache.invalidate(id)
+	}
+}
+
+// cacheState caches the runtime state of a successfully completed work item so that it doesn't need to be reloaded
+// for the next work item. States of orchestrations that completed or continued-as-new are evicted instead.
+func (p *orchestratorProcessor) cacheState(wi *OrchestrationWorkItem) {
+	if p.cache == nil || wi.State == nil {
+		return
+	}
+	if wi.State.IsCompleted() || wi.State.ContinuedAsNew() {
+		p.cache.remove(wi.InstanceID)
+		return
+	}
+
+	// The new events are now saved, so the next work item sees them as old events
+	history := make([]*HistoryEvent, 0, len(wi.State.OldEvents())+len(wi.State.NewEvents()))
+	history = append(history, wi.State.OldEvents()...)
+	history = append(history, wi.State.NewEvents()...)
+	p.cache.put(wi.InstanceID, NewOrchestrationRuntimeState(wi.InstanceID, history))
+}
+
+func (w *orchestratorProcessor) applyWorkItem(ctx context.Context, wi *OrchestrationWorkItem) (context.Context, trace.Span, bool) {
+	// Ignore work items for orchestrations that are completed.
+	if wi.State.IsCompleted() {
 		w.logger.Warnf("%v: orchestration already completed; dropping work item", wi.InstanceID)
 		return nil, nil, false
-	} else if len(wi.NewEvents) == 0 {
-		w.logger.Warnf("%v: the work item had no events!", wi.InstanceID)
 	}
 
 	// The orchestrator started event is used primarily for updating the current time as reported
 	// by the orchestration context APIs.
-	wi.State.AddEvent(helpers.NewOrchestratorStartedEvent())
+	now := w.now(ctx, wi)
+	wi.State.now = now
+	wi.State.AddEvent(wi.State.stamp(helpers.NewOrchestratorStartedEvent()))
 
 	// Each orchestration instance gets its own distributed tracing span. However, the implementation of
 	// endOrchestratorSpan will "cancel" the span mark the span as "unsampled" if the orchestration isn't
@@ -154,8 +479,43 @@ func (w *orchestratorProcessor) applyWorkItem(ctx context.Context, wi *Orchestra
 	// New events from the work item are appended to the orchestration state, with duplicates automatically
 	// filtered out. If all events are filtered out, return false so that the caller knows not to execute
 	// the orchestration logic for an empty set of events.
+	events := w.sequenceOrderedEvents(wi, now)
 	added := 0
-	for _, e := range wi.NewEvents {
+	for _, e := range events {
+		if sent := e.GetEventSent(); sent != nil {
+			// Events that are sent by other orchestrations are raised events for the orchestrations that receive them
+			raised := helpers.NewEventRaisedEvent(sent.Name, sent.Input)
+			raised.Timestamp = e.Timestamp
+			e = raised
+		}
+		if w.options.OrchestrationTimeoutPolicy == OrchestrationTimeoutTerminate && hasOrchestrationTimedOut([]*protos.HistoryEvent{e}) {
+			w.logger.Warnf("%v: orchestration timed out; terminating the orchestration", wi.InstanceID)
+			e = wi.State.stamp(helpers.NewExecutionTerminatedEvent(nil, true))
+		}
+		if raised := e.GetEventRaised(); raised != nil {
+			if fault, ok := wi.State.pendingFault(api.FaultDropNextEvent, raised.Name); ok {
+				w.logger.Warnf("%v: dropping event '%s' due to an injected fault", wi.InstanceID, raised.Name)
+				wi.State.AddEvent(wi.State.stamp(newFaultAppliedEvent(fault.ID)))
+				continue
+			}
+		}
+
+		if w.isSuspensionBufferFull(wi.State, e) {
+			if w.options.SuspensionBufferOverflowPolicy == SuspensionBufferOverflowAutoResume {
+				w.logger.Warnf("%v: automatically resuming the orchestration because its suspension buffer is full", wi.InstanceID)
+				wi.State.AddEvent(wi.State.stamp(helpers.NewResumeOrchestrationEvent("suspension buffer full")))
+			} else {
+				w.logger.Warnf("%v: dropping event: %v, %v", wi.InstanceID, e, ErrSuspensionBufferFull)
+				// The event was already accepted, e.g. from another orchestration, so the history keeps a record of it
+				if dropped, err := newEventDroppedEvent(e); err != nil {
+					w.logger.Warnf("%v: failed to record the dropped event: %v", wi.InstanceID, err)
+				} else {
+					wi.State.AddEvent(wi.State.stamp(dropped))
+				}
+				continue
+			}
+		}
+
 		if err := wi.State.AddEvent(e); err != nil {
 			if err == ErrDuplicateEvent {
 				w.logger.Warnf("%v: dropping duplicate event: %v", wi.InstanceID, e)
@@ -169,8 +529,9 @@ func (w *orchestratorProcessor) applyWorkItem(ctx context.Context, wi *Orchestra
 		// Special case logic for specific event types
 		if es := e.GetExecutionStarted(); es != nil {
 			w.logger.Infof("%v: starting new '%s' instance with ID = '%s'.", wi.InstanceID, es.Name, es.OrchestrationInstance.InstanceId)
-		} else if timerFired := e.GetTimerFired(); timerFired != nil {
-			// Timer spans are created and completed once the TimerFired event is received.
+		} else if timerFired := e.GetTimerFired(); timerFired != nil && timerFired.TimerId >= 0 {
+			// Timer spans are created and completed once the TimerFired event is received. The timers that the worker
+			// creates for itself have negative IDs and don't get spans.
 			// TODO: Ideally we don't emit spans for cancelled timers. Is there a way to support this?
 			if err := helpers.StartAndEndNewTimerSpan(ctx, timerFired, e.Timestamp.AsTime(), string(wi.InstanceID)); err != nil {
 				w.logger.Warnf("%v: failed to generate distributed trace span for durable timer: %v", wi.InstanceID, err)
@@ -179,13 +540,88 @@ func (w *orchestratorProcessor) applyWorkItem(ctx context.Context, wi *Orchestra
 	}
 
 	if added == 0 {
-		w.logger.Warnf("%v: all new events were dropped", wi.InstanceID)
+		// Work items that only buffered ordered events don't have any events to drop
+		if len(events) > 0 {
+			w.logger.Warnf("%v: all new events were dropped", wi.InstanceID)
+		}
 		return ctx, span, false
 	}
 
 	return ctx, span, true
 }
 
+// ContinueAsNewInputTransform validates or transforms the input that an orchestration carries over when it
+// continues-as-new. It receives the input of the current generation and the input passed by the orchestrator
+// and returns the input of the next generation. Returning an error fails the work item.
+//
+// The transform must be deterministic: a work item can be executed more than once, and every execution must
+// produce the same input for the next generation.
+type ContinueAsNewInputTransform func(iid api.InstanceID, oldInput, newInput []byte) ([]byte, error)
+
+// CustomStatusValidator validates the serialized custom status value of an orchestration.
+type CustomStatusValidator func(serializedCustomStatus string) error
+
+// CustomStatusSchema returns a [CustomStatusValidator] that requires custom status values to be JSON
+// documents that can be deserialized into a value of type T without any unknown fields.
+func CustomStatusSchema[T any]() CustomStatusValidator {
+	return func(serializedCustomStatus string) error {
+		decoder := json.NewDecoder(strings.NewReader(serializedCustomStatus))
+		decoder.DisallowUnknownFields()
+		var v T
+		if err := decoder.Decode(&v); err != nil {
+			return fmt.Errorf("custom status doesn't match the schema of %T: %w", v, err)
+		}
+		return nil
+	}
+}
+
+// validateCustomStatus validates the size of a custom status value, and validates it using the validator registered
+// for the orchestration, if any. Empty custom status values, which clear the custom status, are always considered valid.
+func (w *orchestratorProcessor) validateCustomStatus(state *OrchestrationRuntimeState, customStatus *wrapperspb.StringValue) error {
+	if customStatus.GetValue() == "" {
+		return nil
+	}
+	if limit := w.options.MaxCustomStatusSize; limit > 0 && len(customStatus.GetValue()) > limit {
+		return fmt.Errorf("custom status of %d bytes exceeds the limit of %d bytes", len(customStatus.GetValue()), limit)
+	}
+	name, _ := state.Name()
+	validator, ok := w.options.CustomStatusValidators[name]
+	if !ok {
+		return nil
+	}
+	return validator(customStatus.GetValue())
+}
+
+// isSuspensionBufferFull returns true if adding the specified event to a suspended orchestration would
+// exceed the configured suspension buffer limits.
+func (w *orchestratorProcessor) isSuspensionBufferFull(state *OrchestrationRuntimeState, e *HistoryEvent) bool {
+	return state.exceedsSuspensionBuffer(e, w.options.MaxSuspendedEventCount, w.options.MaxSuspendedEventBytes)
+}
+
+// droppedEvent is an external event that a suspended orchestration dropped because its suspension buffer was full.
+type droppedEvent struct {
+	Name     string    `json:"name"`
+	Input    *string   `json:"input,omitempty"`
+	RaisedAt time.Time `json:"raisedAt"`
+	Reason   string    `json:"reason"`
+}
+
+// newEventDroppedEvent returns a generic event that records the specified event raised event, which orchestrators
+// ignore, so that events dropped by [SuspensionBufferOverflowReject] can be found in the orchestration history.
+func newEventDroppedEvent(e *HistoryEvent) (*HistoryEvent, error) {
+	raised := e.GetEventRaised()
+	de := droppedEvent{Name: raised.GetName(), RaisedAt: e.GetTimestamp().AsTime(), Reason: ErrSuspensionBufferFull.Error()}
+	if raised.GetInput() != nil {
+		input := raised.GetInput().GetValue()
+		de.Input = &input
+	}
+	bytes, err := json.Marshal(de)
+	if err != nil {
+		return nil, err
+	}
+	return helpers.NewGenericEvent(helpers.DroppedEventPrefix + string(bytes)), nil
+}
+
 func getOrchestrationStateDescription(wi *OrchestrationWorkItem) string {
 	name, err := wi.State.Name()
 	if err != nil {
@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"sync"
+
+	"github.com/microsoft/durabletask-go/api"
+)
+
+// completionOrder serializes the completion of the work items of each orchestration instance in the order in which
+// completion slots are reserved for them. It acts as a FIFO mutex per instance: each slot waits for the previous slot
+// of the same instance to be released.
+type completionOrder struct {
+	lock sync.Mutex
+
+	// tails are the most recently reserved slots of each instance that still has unreleased slots.
+	tails map[api.InstanceID]*completionSlot
+}
+
+// completionSlot is a reserved position in the completion order of an orchestration instance. The methods of a nil
+// slot are no-ops, so that callers don't need to check whether ordering is enabled.
+type completionSlot struct {
+	order    *completionOrder
+	id       api.InstanceID
+	previous *completionSlot
+	done     chan struct{}
+}
+
+func newCompletionOrder() *completionOrder {
+	return &completionOrder{tails: make(map[api.InstanceID]*completionSlot)}
+}
+
+// reserve reserves the next completion slot of the specified instance.
+func (o *completionOrder) reserve(id api.InstanceID) *completionSlot {
+	if id == api.EmptyInstanceID {
+		return nil
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	slot := &completionSlot{order: o, id: id, previous: o.tails[id], done: make(chan struct{})}
+	o.tails[id] = slot
+	return slot
+}
+
+// wait blocks until all of the slots that were reserved before this one for the same instance are released.
+func (s *completionSlot) wait() {
+	if s != nil && s.previous != nil {
+		<-s.previous.done
+		s.previous = nil
+	}
+}
+
+// release releases the slot, which allows the next slot of the same instance to proceed.
+func (s *completionSlot) release() {
+	if s == nil {
+		return
+	}
+
+	s.order.lock.Lock()
+	if s.order.tails[s.id] == s {
+		delete(s.order.tails, s.id)
+	}
+	s.order.lock.Unlock()
+	close(s.done)
+}
@@ -0,0 +1,723 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// ErrPayloadNotFound is returned by [PayloadStore.GetPayload] when the store doesn't contain the requested payload.
+var ErrPayloadNotFound = errors.New("payload not found")
+
+// payloadReferencePrefix is the prefix of the values that replace offloaded payloads in history events. The rest of
+// the value is the key of the payload in the payload store.
+const payloadReferencePrefix = "durabletask+payload://"
+
+// PayloadStore stores large payloads, such as orchestration inputs and outputs, activity inputs and results, and
+// external event data, outside of the history of orchestrations, e.g. in a blob storage service.
+//
+// The keys of the payloads of an orchestration instance all start with the same prefix, so that they can be deleted
+// together when the orchestration instance is purged.
+//
+// Implementations must be safe for concurrent use.
+type PayloadStore interface {
+	// PutPayload saves a payload with the specified key.
+	PutPayload(ctx context.Context, key string, payload []byte) error
+
+	// GetPayload gets the payload with the specified key.
+	//
+	// Returns [ErrPayloadNotFound] if the store doesn't contain a payload with the key.
+	GetPayload(ctx context.Context, key string) ([]byte, error)
+
+	// DeletePayloads deletes all the payloads whose keys start with the specified prefix.
+	DeletePayloads(ctx context.Context, prefix string) error
+}
+
+// payloadOffloadingBackend is a Backend that saves large payloads in a separate PayloadStore, and only saves
+// references to them in the wrapped backend.
+type payloadOffloadingBackend struct {
+	Backend
+	store     PayloadStore
+	threshold int
+	logger    Logger
+}
+
+// NewPayloadOffloadingBackend wraps the specified backend so that the payloads of history events that are larger than
+// threshold bytes are saved in the specified store, and only a reference to each of them is saved in the history of
+// the wrapped backend. This keeps the history small for orchestrations with large inputs, outputs, activity results,
+// or external events, which speeds up loading and replaying it. References are replaced by the payloads when history
+// events, work items, and metadata are read, so workers and clients never observe them.
+//
+// The payloads of an orchestration instance are deleted with [Backend.PurgeOrchestrationState]. The wrapper doesn't
+// forward [BackendWithBulkPurge], since batch purges don't report which orchestration instances they purged, so
+// [TaskHubClient.PurgeCompletedOrchestrationStates] purges the orchestration instances one at a time instead, which
+// deletes their payloads as well.
+//
+// Wrap the storage backend directly, so that other wrappers, like the one returned by
+// [NewMetadataProjectionBackend], only observe the payloads and never the references.
+func NewPayloadOffloadingBackend(be Backend, store PayloadStore, threshold int, logger Logger) Backend {
+	return &payloadOffloadingBackend{Backend: be, store: store, threshold: threshold, logger: logger}
+}
+
+// CreateOrchestrationInstance implements Backend
+func (be *payloadOffloadingBackend) CreateOrchestrationInstance(ctx context.Context, e *HistoryEvent) error {
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	iid := api.InstanceID(e.GetExecutionStarted().GetOrchestrationInstance().GetInstanceId())
+	if err := be.offload(ctx, iid, e, &offloaded); err != nil {
+		return err
+	}
+	return be.Backend.CreateOrchestrationInstance(ctx, e)
+}
+
+// AddNewOrchestrationEvent implements Backend
+func (be *payloadOffloadingBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *HistoryEvent) error {
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	if err := be.offload(ctx, iid, e, &offloaded); err != nil {
+		return err
+	}
+	return be.Backend.AddNewOrchestrationEvent(ctx, iid, e)
+}
+
+// AddNewOrchestrationEventIf implements BackendWithConditionalEvents
+func (be *payloadOffloadingBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	conditional, err := wrapped[BackendWithConditionalEvents](be.Backend)
+	if err != nil {
+		return err
+	}
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	if err := be.offload(ctx, iid, e, &offloaded); err != nil {
+		return err
+	}
+	return conditional.AddNewOrchestrationEventIf(ctx, iid, e, statuses)
+}
+
+// IngestOperations implements BackendWithIngest
+func (be *payloadOffloadingBackend) IngestOperations(ctx context.Context, ops []*IngestOperation) ([]error, error) {
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	for _, op := range ops {
+		if err := be.offload(ctx, op.InstanceID, op.Event, &offloaded); err != nil {
+			return nil, err
+		}
+	}
+	return IngestOperations(ctx, be.Backend, ops)
+}
+
+// GetOrchestrationWorkItem implements Backend
+func (be *payloadOffloadingBackend) GetOrchestrationWorkItem(ctx context.Context) (*OrchestrationWorkItem, error) {
+	wi, err := be.Backend.GetOrchestrationWorkItem(ctx)
+	if err != nil {
+		return wi, err
+	}
+	return be.resolveOrchestrationWorkItem(ctx, wi)
+}
+
+// resolveOrchestrationWorkItem loads the offloaded payloads of a fetched orchestration work item, and abandons the
+// work item if they can't be loaded.
+func (be *payloadOffloadingBackend) resolveOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem) (*OrchestrationWorkItem, error) {
+	if err := be.resolveAll(ctx, wi.NewEvents); err != nil {
+		be.abandon(wi)
+		return nil, err
+	}
+	if wi.State != nil {
+		if err := be.resolveState(ctx, wi.State); err != nil {
+			be.abandon(wi)
+			return nil, err
+		}
+	}
+	return wi, nil
+}
+
+// GetOrchestrationRuntimeState implements Backend
+func (be *payloadOffloadingBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *OrchestrationWorkItem) (*OrchestrationRuntimeState, error) {
+	state, err := be.Backend.GetOrchestrationRuntimeState(ctx, wi)
+	if err != nil {
+		return state, err
+	}
+	if err := be.resolveState(ctx, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// CompleteOrchestrationWorkItem implements Backend
+func (be *payloadOffloadingBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem) error {
+	// The payloads are restored after the work item is saved, since the worker may cache the runtime state
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	for _, e := range wi.State.NewEvents() {
+		if err := be.offload(ctx, wi.InstanceID, e, &offloaded); err != nil {
+			return err
+		}
+	}
+	for _, e := range wi.State.PendingTasks() {
+		if err := be.offload(ctx, wi.InstanceID, e, &offloaded); err != nil {
+			return err
+		}
+	}
+	for _, msg := range wi.State.PendingMessages() {
+		if err := be.offload(ctx, api.InstanceID(msg.TargetInstanceID), msg.HistoryEvent, &offloaded); err != nil {
+			return err
+		}
+	}
+	return be.Backend.CompleteOrchestrationWorkItem(ctx, wi)
+}
+
+// GetActivityWorkItem implements Backend
+func (be *payloadOffloadingBackend) GetActivityWorkItem(ctx context.Context) (*ActivityWorkItem, error) {
+	wi, err := be.Backend.GetActivityWorkItem(ctx)
+	if err != nil {
+		return wi, err
+	}
+	if err := be.resolve(ctx, wi.NewEvent); err != nil {
+		if abandonErr := be.Backend.AbandonActivityWorkItem(ctx, wi); abandonErr != nil {
+			be.logger.Warnf("%v: failed to abandon activity work item: %v", wi.Description(), abandonErr)
+		}
+		return nil, err
+	}
+	return wi, nil
+}
+
+// GetActivityWorkItems implements BackendWithActivityBatches
+func (be *payloadOffloadingBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*ActivityWorkItem, error) {
+	batched, err := wrapped[BackendWithActivityBatches](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	wis, err := batched.GetActivityWorkItems(ctx, max)
+	if err != nil {
+		return wis, err
+	}
+	return be.resolveActivityWorkItems(ctx, wis)
+}
+
+// resolveActivityWorkItems resolves the payloads of fetched activity work items.
+func (be *payloadOffloadingBackend) resolveActivityWorkItems(ctx context.Context, wis []*ActivityWorkItem) ([]*ActivityWorkItem, error) {
+	// Work items whose payloads can't be resolved are abandoned, and the error is only returned if none of the work
+	// items could be resolved
+	var resolveErr error
+	resolved := wis[:0]
+	for _, wi := range wis {
+		if err := be.resolve(ctx, wi.NewEvent); err != nil {
+			if abandonErr := be.Backend.AbandonActivityWorkItem(ctx, wi); abandonErr != nil {
+				be.logger.Warnf("%v: failed to abandon activity work item: %v", wi.Description(), abandonErr)
+			}
+			if resolveErr == nil {
+				resolveErr = err
+			}
+			be.logger.Warnf("%v: failed to resolve activity work item: %v", wi.Description(), err)
+			continue
+		}
+		resolved = append(resolved, wi)
+	}
+	if len(resolved) == 0 {
+		return nil, resolveErr
+	}
+	return resolved, nil
+}
+
+// CompleteActivityWorkItem implements Backend
+func (be *payloadOffloadingBackend) CompleteActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error {
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	if err := be.offload(ctx, wi.InstanceID, wi.Result, &offloaded); err != nil {
+		return err
+	}
+	return be.Backend.CompleteActivityWorkItem(ctx, wi)
+}
+
+// GetOrchestrationMetadata implements Backend
+func (be *payloadOffloadingBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	metadata, err := be.Backend.GetOrchestrationMetadata(ctx, iid)
+	if err != nil {
+		return metadata, err
+	}
+	if err := be.resolveMetadata(ctx, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// QueryOrchestrationMetadata implements BackendWithQueries
+func (be *payloadOffloadingBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	querier, err := wrapped[BackendWithQueries](be.Backend)
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	result, err := querier.QueryOrchestrationMetadata(ctx, query)
+	if err != nil {
+		return result, err
+	}
+	for _, metadata := range result.Instances {
+		if err := be.resolveMetadata(ctx, metadata); err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+	}
+	return result, nil
+}
+
+// GetOrchestrationHistoriesBatch implements BackendWithHistoriesBatch
+func (be *payloadOffloadingBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*HistoryEvent, error) {
+	batch, err := wrapped[BackendWithHistoriesBatch](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	histories, err := batch.GetOrchestrationHistoriesBatch(ctx, fromSequenceNumbers)
+	for _, history := range histories {
+		if err := be.resolveAll(ctx, history); err != nil {
+			return nil, err
+		}
+	}
+	return histories, err
+}
+
+// ExportOrchestrationInstance implements BackendWithMigration
+func (be *payloadOffloadingBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*OrchestrationInstanceState, error) {
+	migrator, err := wrapped[BackendWithMigration](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	state, err := migrator.ExportOrchestrationInstance(ctx, iid)
+	if err != nil {
+		return state, err
+	}
+
+	// Exported states contain the payloads, so that they can be imported into backends that don't share the store
+	if err := be.resolveMetadata(ctx, state.Metadata); err != nil {
+		return nil, err
+	}
+	for _, events := range [][]*HistoryEvent{state.History, state.PendingEvents, state.PendingTasks} {
+		if err := be.resolveAll(ctx, events); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// ImportOrchestrationInstance implements BackendWithMigration
+func (be *payloadOffloadingBackend) ImportOrchestrationInstance(ctx context.Context, state *OrchestrationInstanceState) error {
+	migrator, err := wrapped[BackendWithMigration](be.Backend)
+	if err != nil {
+		return err
+	}
+
+	var offloaded offloadedPayloads
+	defer offloaded.restore()
+
+	for _, events := range [][]*HistoryEvent{state.History, state.PendingEvents, state.PendingTasks} {
+		for _, e := range events {
+			if err := be.offload(ctx, state.Metadata.InstanceID, e, &offloaded); err != nil {
+				return err
+			}
+		}
+	}
+	return migrator.ImportOrchestrationInstance(ctx, state)
+}
+
+// PurgeOrchestrationState implements Backend
+func (be *payloadOffloadingBackend) PurgeOrchestrationState(ctx context.Context, iid api.InstanceID) error {
+	if err := be.Backend.PurgeOrchestrationState(ctx, iid); err != nil {
+		return err
+	}
+	if err := be.store.DeletePayloads(ctx, payloadKeyPrefix(iid)); err != nil {
+		return fmt.Errorf("%v: failed to delete offloaded payloads: %w", iid, err)
+	}
+	return nil
+}
+
+// WatchOrchestrationRuntimeStatus implements BackendWithWatch
+func (be *payloadOffloadingBackend) WatchOrchestrationRuntimeStatus(ctx context.Context, id api.InstanceID) (<-chan *api.OrchestrationMetadata, error) {
+	watcher, err := wrapped[BackendWithWatch](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := watcher.WatchOrchestrationRuntimeStatus(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata is resolved before it's relayed, and the channel is closed early if it can't be resolved, so
+	// that watchers fall back to reading the metadata
+	resolved := make(chan *api.OrchestrationMetadata)
+	go func() {
+		defer close(resolved)
+		for metadata := range ch {
+			if err := be.resolveMetadata(ctx, metadata); err != nil {
+				be.logger.Warnf("%v: failed to resolve watched metadata: %v", id, err)
+				return
+			}
+			select {
+			case resolved <- metadata:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return resolved, nil
+}
+
+// RecordActivityHeartbeat implements BackendWithActivityHeartbeats
+func (be *payloadOffloadingBackend) RecordActivityHeartbeat(ctx context.Context, wi *ActivityWorkItem) error {
+	heartbeats, err := wrapped[BackendWithActivityHeartbeats](be.Backend)
+	if err != nil {
+		return err
+	}
+	return heartbeats.RecordActivityHeartbeat(ctx, wi)
+}
+
+// GetActivityWorkItemsFromQueues implements BackendWithActivityQueues
+func (be *payloadOffloadingBackend) GetActivityWorkItemsFromQueues(ctx context.Context, queues []string, max int) ([]*ActivityWorkItem, error) {
+	queued, err := wrapped[BackendWithActivityQueues](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	wis, err := queued.GetActivityWorkItemsFromQueues(ctx, queues, max)
+	if err != nil {
+		return wis, err
+	}
+	return be.resolveActivityWorkItems(ctx, wis)
+}
+
+// DeadLetterOrchestrationWorkItem implements BackendWithDeadLetters
+func (be *payloadOffloadingBackend) DeadLetterOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, reason string) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, reason)
+}
+
+// DeadLetterActivityWorkItem implements BackendWithDeadLetters
+func (be *payloadOffloadingBackend) DeadLetterActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, reason string) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.DeadLetterActivityWorkItem(ctx, wi, reason)
+}
+
+// ListDeadLetters implements BackendWithDeadLetters
+func (be *payloadOffloadingBackend) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	letters, err := deadLetters.ListDeadLetters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, letter := range letters {
+		if err := be.resolveAll(ctx, letter.Events); err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// ResubmitDeadLetter implements BackendWithDeadLetters
+func (be *payloadOffloadingBackend) ResubmitDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.ResubmitDeadLetter(ctx, id)
+}
+
+// DeleteDeadLetter implements BackendWithDeadLetters
+func (be *payloadOffloadingBackend) DeleteDeadLetter(ctx context.Context, id int64) error {
+	deadLetters, err := wrapped[BackendWithDeadLetters](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deadLetters.DeleteDeadLetter(ctx, id)
+}
+
+// GetOrchestrationLastActions implements BackendWithLastActions
+func (be *payloadOffloadingBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	lastActions, err := wrapped[BackendWithLastActions](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return lastActions.GetOrchestrationLastActions(ctx, iid)
+}
+
+// GetOrchestrationStats implements BackendWithStats
+func (be *payloadOffloadingBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	statistics, err := wrapped[BackendWithStats](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return statistics.GetOrchestrationStats(ctx, name, since)
+}
+
+// GetOrphanedSubOrchestrations implements BackendWithOrphanQueries
+func (be *payloadOffloadingBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	orphans, err := wrapped[BackendWithOrphanQueries](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return orphans.GetOrphanedSubOrchestrations(ctx)
+}
+
+// RenewOrchestrationWorkItemLock implements BackendWithLockRenewal
+func (be *payloadOffloadingBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *OrchestrationWorkItem) error {
+	renewer, err := wrapped[BackendWithLockRenewal](be.Backend)
+	if err != nil {
+		return err
+	}
+	return renewer.RenewOrchestrationWorkItemLock(ctx, wi)
+}
+
+// RenewActivityWorkItemLock implements BackendWithLockRenewal
+func (be *payloadOffloadingBackend) RenewActivityWorkItemLock(ctx context.Context, wi *ActivityWorkItem) error {
+	renewer, err := wrapped[BackendWithLockRenewal](be.Backend)
+	if err != nil {
+		return err
+	}
+	return renewer.RenewActivityWorkItemLock(ctx, wi)
+}
+
+// GetActivityWorkItemsWithFilter implements BackendWithActivityFilters
+func (be *payloadOffloadingBackend) GetActivityWorkItemsWithFilter(ctx context.Context, filter ActivityWorkItemFilter, max int) ([]*ActivityWorkItem, error) {
+	filtered, err := wrapped[BackendWithActivityFilters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	wis, err := filtered.GetActivityWorkItemsWithFilter(ctx, filter, max)
+	if err != nil {
+		return wis, err
+	}
+	return be.resolveActivityWorkItems(ctx, wis)
+}
+
+// GetOrchestrationWorkItemWithFilter implements BackendWithOrchestrationFilters
+func (be *payloadOffloadingBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter OrchestrationWorkItemFilter) (*OrchestrationWorkItem, error) {
+	filtered, err := wrapped[BackendWithOrchestrationFilters](be.Backend)
+	if err != nil {
+		return nil, err
+	}
+	wi, err := filtered.GetOrchestrationWorkItemWithFilter(ctx, filter)
+	if err != nil {
+		return wi, err
+	}
+	return be.resolveOrchestrationWorkItem(ctx, wi)
+}
+
+// DeferOrchestrationWorkItem implements BackendWithDeferrals
+func (be *payloadOffloadingBackend) DeferOrchestrationWorkItem(ctx context.Context, wi *OrchestrationWorkItem, delay time.Duration) error {
+	deferrals, err := wrapped[BackendWithDeferrals](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deferrals.DeferOrchestrationWorkItem(ctx, wi, delay)
+}
+
+// DeferActivityWorkItem implements BackendWithDeferrals
+func (be *payloadOffloadingBackend) DeferActivityWorkItem(ctx context.Context, wi *ActivityWorkItem, delay time.Duration) error {
+	deferrals, err := wrapped[BackendWithDeferrals](be.Backend)
+	if err != nil {
+		return err
+	}
+	return deferrals.DeferActivityWorkItem(ctx, wi, delay)
+}
+
+// DeleteActivityWorkItem implements BackendWithExternalActivityResults
+func (be *payloadOffloadingBackend) DeleteActivityWorkItem(ctx context.Context, wi *ActivityWorkItem) error {
+	external, err := wrapped[BackendWithExternalActivityResults](be.Backend)
+	if err != nil {
+		return err
+	}
+	return external.DeleteActivityWorkItem(ctx, wi)
+}
+
+// Unwrap implements BackendWrapper
+func (be *payloadOffloadingBackend) Unwrap() Backend {
+	return be.Backend
+}
+
+// offload saves the payload of an event in the store if it's larger than the threshold, and replaces it with a
+// reference. The replaced payload is recorded in offloaded, so that it can be restored.
+func (be *payloadOffloadingBackend) offload(ctx context.Context, iid api.InstanceID, e *HistoryEvent, offloaded *offloadedPayloads) error {
+	payload := getPayload(e)
+	if payload == nil || len(payload.Value) <= be.threshold || strings.HasPrefix(payload.Value, payloadReferencePrefix) {
+		return nil
+	}
+
+	key := payloadKeyPrefix(iid) + uuid.NewString()
+	if err := be.store.PutPayload(ctx, key, []byte(payload.Value)); err != nil {
+		return fmt.Errorf("%v: failed to offload payload: %w", iid, err)
+	}
+	*offloaded = append(*offloaded, offloadedPayload{value: payload, payload: payload.Value})
+	payload.Value = payloadReferencePrefix + key
+	return nil
+}
+
+// resolve replaces the reference in the payload of an event, if any, with the payload from the store.
+func (be *payloadOffloadingBackend) resolve(ctx context.Context, e *HistoryEvent) error {
+	return be.resolveValue(ctx, getPayload(e))
+}
+
+func (be *payloadOffloadingBackend) resolveAll(ctx context.Context, events []*HistoryEvent) error {
+	for _, e := range events {
+		if err := be.resolve(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (be *payloadOffloadingBackend) resolveState(ctx context.Context, state *OrchestrationRuntimeState) error {
+	if err := be.resolveAll(ctx, state.OldEvents()); err != nil {
+		return err
+	}
+	return be.resolveAll(ctx, state.NewEvents())
+}
+
+func (be *payloadOffloadingBackend) resolveMetadata(ctx context.Context, metadata *api.OrchestrationMetadata) error {
+	for _, value := range []*string{&metadata.SerializedInput, &metadata.SerializedOutput} {
+		wrapper := wrapperspb.String(*value)
+		if err := be.resolveValue(ctx, wrapper); err != nil {
+			return err
+		}
+		*value = wrapper.Value
+	}
+	return nil
+}
+
+func (be *payloadOffloadingBackend) resolveValue(ctx context.Context, value *wrapperspb.StringValue) error {
+	if value == nil || !strings.HasPrefix(value.Value, payloadReferencePrefix) {
+		return nil
+	}
+
+	key := strings.TrimPrefix(value.Value, payloadReferencePrefix)
+	payload, err := be.store.GetPayload(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to load offloaded payload %s: %w", key, err)
+	}
+	value.Value = string(payload)
+	return nil
+}
+
+// abandon abandons an orchestration work item whose payloads couldn't be loaded, so that it's retried later.
+func (be *payloadOffloadingBackend) abandon(wi *OrchestrationWorkItem) {
+	if err := be.Backend.AbandonOrchestrationWorkItem(context.Background(), wi); err != nil {
+		be.logger.Warnf("%v: failed to abandon work item: %v", wi.InstanceID, err)
+	}
+}
+
+// offloadedPayload is a payload that was replaced by a reference.
+type offloadedPayload struct {
+	value   *wrapperspb.StringValue
+	payload string
+}
+
+type offloadedPayloads []offloadedPayload
+
+// restore replaces the references with the original payloads, since the events may still be used after they're
+// saved, e.g. by the caller of the backend or by the state cache of the orchestration worker.
+func (offloaded offloadedPayloads) restore() {
+	for _, p := range offloaded {
+		p.value.Value = p.payload
+	}
+}
+
+// payloadKeyPrefix returns the prefix of the keys of the payloads of an orchestration instance.
+func payloadKeyPrefix(iid api.InstanceID) string {
+	return url.PathEscape(string(iid)) + "/"
+}
+
+// getPayload returns the input, output, or event data of a history event, or nil if the event has no payload.
+func getPayload(e *HistoryEvent) *wrapperspb.StringValue {
+	if e == nil {
+		return nil
+	}
+	switch t := e.EventType.(type) {
+	case *protos.HistoryEvent_ExecutionStarted:
+		return t.ExecutionStarted.GetInput()
+	case *protos.HistoryEvent_ExecutionCompleted:
+		return t.ExecutionCompleted.GetResult()
+	case *protos.HistoryEvent_ExecutionTerminated:
+		return t.ExecutionTerminated.GetInput()
+	case *protos.HistoryEvent_TaskScheduled:
+		return t.TaskScheduled.GetInput()
+	case *protos.HistoryEvent_TaskCompleted:
+		return t.TaskCompleted.GetResult()
+	case *protos.HistoryEvent_SubOrchestrationInstanceCreated:
+		return t.SubOrchestrationInstanceCreated.GetInput()
+	case *protos.HistoryEvent_SubOrchestrationInstanceCompleted:
+		return t.SubOrchestrationInstanceCompleted.GetResult()
+	case *protos.HistoryEvent_EventSent:
+		return t.EventSent.GetInput()
+	case *protos.HistoryEvent_EventRaised:
+		return t.EventRaised.GetInput()
+	case *protos.HistoryEvent_ContinueAsNew:
+		return t.ContinueAsNew.GetInput()
+	default:
+		return nil
+	}
+}
+
+// inMemoryPayloadStore is a PayloadStore that keeps the payloads in memory.
+type inMemoryPayloadStore struct {
+	lock     sync.RWMutex
+	payloads map[string][]byte
+}
+
+// NewInMemoryPayloadStore returns a [PayloadStore] that keeps the payloads in memory. It's intended for tests, since
+// the payloads are lost when the process exits.
+func NewInMemoryPayloadStore() PayloadStore {
+	return &inMemoryPayloadStore{payloads: make(map[string][]byte)}
+}
+
+// PutPayload implements PayloadStore
+func (s *inMemoryPayloadStore) PutPayload(_ context.Context, key string, payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.payloads[key] = payload
+	return nil
+}
+
+// GetPayload implements PayloadStore
+func (s *inMemoryPayloadStore) GetPayload(_ context.Context, key string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	payload, ok := s.payloads[key]
+	if !ok {
+		return nil, ErrPayloadNotFound
+	}
+	return payload, nil
+}
+
+// DeletePayloads implements PayloadStore
+func (s *inMemoryPayloadStore) DeletePayloads(_ context.Context, prefix string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key := range s.payloads {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.payloads, key)
+		}
+	}
+	return nil
+}
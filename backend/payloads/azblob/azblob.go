@@ -0,0 +1,119 @@
+package azblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+type AzureBlobOptions struct {
+	// ConnectionString is the connection string of the Azure Storage account, which contains its endpoint and key.
+	ConnectionString string
+
+	// ContainerName is the name of the blob container that stores the payloads, which is created on demand.
+	ContainerName string
+}
+
+type azureBlobPayloadStore struct {
+	options *AzureBlobOptions
+
+	lock   sync.Mutex
+	client *container.Client
+}
+
+// NewAzureBlobOptions creates a new options object for the Azure Blob Storage payload store.
+func NewAzureBlobOptions(connectionString string) *AzureBlobOptions {
+	// Default values are provided for required options
+	return &AzureBlobOptions{
+		ConnectionString: connectionString,
+		ContainerName:    "durabletask-payloads",
+	}
+}
+
+// NewAzureBlobPayloadStore creates a new [backend.PayloadStore] that stores each payload in a block blob of an Azure
+// Blob Storage container, named after its key.
+func NewAzureBlobPayloadStore(opts *AzureBlobOptions) backend.PayloadStore {
+	return &azureBlobPayloadStore{options: opts}
+}
+
+// PutPayload implements backend.PayloadStore
+func (s *azureBlobPayloadStore) PutPayload(ctx context.Context, key string, payload []byte) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := client.NewBlockBlobClient(key).UploadBuffer(ctx, payload, nil); err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetPayload implements backend.PayloadStore
+func (s *azureBlobPayloadStore) GetPayload(ctx context.Context, key string) ([]byte, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.NewBlobClient(key).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, backend.ErrPayloadNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to download blob %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob %s: %w", key, err)
+	}
+	return payload, nil
+}
+
+// DeletePayloads implements backend.PayloadStore
+func (s *azureBlobPayloadStore) DeletePayloads(ctx context.Context, prefix string) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	pager := client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			_, err := client.NewBlobClient(*item.Name).Delete(ctx, nil)
+			if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+				return fmt.Errorf("failed to delete blob %s: %w", *item.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// getClient creates the container client and the container the first time it's called.
+func (s *azureBlobPayloadStore) getClient(ctx context.Context) (*container.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	client, err := container.NewClientFromConnectionString(s.options.ConnectionString, s.options.ContainerName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Azure Blob Storage client: %w", err)
+	}
+	if _, err := client.Create(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil, fmt.Errorf("failed to create the %s container: %w", s.options.ContainerName, err)
+	}
+	s.client = client
+	return client, nil
+}
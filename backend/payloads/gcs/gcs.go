@@ -0,0 +1,193 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+type GCSOptions struct {
+	// Client is the HTTP client used to call the Cloud Storage JSON API. It must authenticate its requests, e.g. a
+	// client created by google.DefaultClient of the golang.org/x/oauth2/google package with the
+	// "https://www.googleapis.com/auth/devstorage.read_write" scope.
+	Client *http.Client
+
+	// Bucket is the name of the existing Cloud Storage bucket that stores the payloads.
+	Bucket string
+
+	// Endpoint is the base URL of the Cloud Storage JSON API, which can be changed to use an emulator.
+	Endpoint string
+}
+
+type gcsPayloadStore struct {
+	options *GCSOptions
+}
+
+// NewGCSOptions creates a new options object for the Google Cloud Storage payload store.
+func NewGCSOptions(client *http.Client, bucket string) *GCSOptions {
+	// Default values are provided for required options
+	return &GCSOptions{
+		Client:   client,
+		Bucket:   bucket,
+		Endpoint: "https://storage.googleapis.com",
+	}
+}
+
+// NewGCSPayloadStore creates a new [backend.PayloadStore] that stores each payload in an object of a Google Cloud
+// Storage bucket, named after its key. Lifecycle rules of the bucket can be used to delete the payloads of old
+// orchestrations.
+//
+// The store calls the Cloud Storage JSON API directly with the configured HTTP client, so that it doesn't depend on
+// the Cloud Storage client library.
+func NewGCSPayloadStore(opts *GCSOptions) backend.PayloadStore {
+	return &gcsPayloadStore{options: opts}
+}
+
+// PutPayload implements backend.PayloadStore
+func (s *gcsPayloadStore) PutPayload(ctx context.Context, key string, payload []byte) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", s.endpoint(), url.PathEscape(s.options.Bucket), url.QueryEscape(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.options.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload object %s: %w", key, newResponseError(resp))
+	}
+	return nil
+}
+
+// GetPayload implements backend.PayloadStore
+func (s *gcsPayloadStore) GetPayload(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.options.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, backend.ErrPayloadNotFound
+	default:
+		return nil, fmt.Errorf("failed to download object %s: %w", key, newResponseError(resp))
+	}
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object %s: %w", key, err)
+	}
+	return payload, nil
+}
+
+// DeletePayloads implements backend.PayloadStore
+func (s *gcsPayloadStore) DeletePayloads(ctx context.Context, prefix string) error {
+	pageToken := ""
+	for {
+		names, nextPageToken, err := s.list(ctx, prefix, pageToken)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := s.delete(ctx, name); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// list gets a page of the names of the objects whose names start with prefix.
+func (s *gcsPayloadStore) list(ctx context.Context, prefix string, pageToken string) ([]string, string, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("fields", "items(name),nextPageToken")
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.endpoint(), url.PathEscape(s.options.Bucket), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := s.options.Client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list objects: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to list objects: %w", newResponseError(resp))
+	}
+
+	var page struct {
+		Items []struct {
+			Name string `json:"name"`
+		} `json:"items"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", fmt.Errorf("failed to list objects: %w", err)
+	}
+	names := make([]string, 0, len(page.Items))
+	for _, item := range page.Items {
+		names = append(names, item.Name)
+	}
+	return names, page.NextPageToken, nil
+}
+
+func (s *gcsPayloadStore) delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.options.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	// Objects that were already deleted are ignored
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object %s: %w", name, newResponseError(resp))
+	}
+	return nil
+}
+
+func (s *gcsPayloadStore) endpoint() string {
+	return strings.TrimSuffix(s.options.Endpoint, "/")
+}
+
+func (s *gcsPayloadStore) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.endpoint(), url.PathEscape(s.options.Bucket), url.PathEscape(name))
+}
+
+// newResponseError returns an error with the status and the beginning of the body of an unexpected response.
+func newResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
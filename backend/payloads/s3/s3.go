@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+type S3Options struct {
+	// Config is the AWS configuration used to connect to S3, e.g. as loaded by config.LoadDefaultConfig.
+	Config aws.Config
+
+	// Bucket is the name of the existing S3 bucket that stores the payloads.
+	Bucket string
+}
+
+type s3PayloadStore struct {
+	client  *awss3.Client
+	options *S3Options
+}
+
+// NewS3Options creates a new options object for the S3 payload store.
+func NewS3Options(cfg aws.Config, bucket string) *S3Options {
+	return &S3Options{
+		Config: cfg,
+		Bucket: bucket,
+	}
+}
+
+// NewS3PayloadStore creates a new [backend.PayloadStore] that stores each payload in an object of an S3 bucket, named
+// after its key. Expiration rules of the bucket can be used to delete the payloads of old orchestrations.
+func NewS3PayloadStore(opts *S3Options) backend.PayloadStore {
+	return &s3PayloadStore{
+		client:  awss3.NewFromConfig(opts.Config),
+		options: opts,
+	}
+}
+
+// PutPayload implements backend.PayloadStore
+func (s *s3PayloadStore) PutPayload(ctx context.Context, key string, payload []byte) error {
+	_, err := s.client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(payload),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put object %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetPayload implements backend.PayloadStore
+func (s *s3PayloadStore) GetPayload(ctx context.Context, key string) ([]byte, error) {
+	output, err := s.client.GetObject(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, backend.ErrPayloadNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	payload, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	return payload, nil
+}
+
+// DeletePayloads implements backend.PayloadStore
+func (s *s3PayloadStore) DeletePayloads(ctx context.Context, prefix string) error {
+	paginator := awss3.NewListObjectsV2Paginator(s.client, &awss3.ListObjectsV2Input{
+		Bucket: aws.String(s.options.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		// Pages have at most 1000 objects, which is the most that can be deleted in a single request
+		objects := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, types.ObjectIdentifier{Key: object.Key})
+		}
+		output, err := s.client.DeleteObjects(ctx, &awss3.DeleteObjectsInput{
+			Bucket: aws.String(s.options.Bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return fmt.Errorf("failed to delete object %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
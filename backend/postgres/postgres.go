@@ -0,0 +1,1852 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:embed schema.sql
+var schema string
+
+var emptyString string = ""
+
+type PostgresOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// ConnectionString is the connection string or URL of the PostgreSQL database, in the format expected by the
+	// database/sql driver.
+	ConnectionString string
+
+	// DriverName is the name of the database/sql driver used to connect to the database. The app must import the
+	// package that registers this driver, e.g. github.com/jackc/pgx/v5/stdlib for "pgx" or github.com/lib/pq for
+	// "postgres".
+	DriverName string
+}
+
+type postgresBackend struct {
+	db         *sql.DB
+	workerName string
+	logger     backend.Logger
+	options    *PostgresOptions
+}
+
+// NewPostgresOptions creates a new options object for the PostgreSQL backend provider.
+//
+// The options use the "pgx" database/sql driver by default.
+func NewPostgresOptions(connectionString string) *PostgresOptions {
+	// Default values are provided for required options
+	return &PostgresOptions{
+		ConnectionString:         connectionString,
+		DriverName:               "pgx",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+	}
+}
+
+// NewPostgresBackend creates a new PostgreSQL-based Backend object.
+//
+// Multiple workers, in the same process or in different processes, can share the same database. Work items are
+// locked using row-level locks that skip the rows that other workers are locking, so that each work item is
+// processed by a single worker at a time, and workers don't block each other.
+func NewPostgresBackend(opts *PostgresOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewPostgresOptions("")
+	}
+
+	return &postgresBackend{
+		db:         nil,
+		workerName: fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:    opts,
+		logger:     logger,
+	}
+}
+
+// CreateTaskHub connects to the PostgreSQL database and applies the schema
+func (be *postgresBackend) CreateTaskHub(ctx context.Context) error {
+	if err := be.open(); err != nil {
+		return err
+	}
+
+	// Initialize database
+	if _, err := be.db.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("failed to initialize the database: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteTaskHub drops the tables of the task hub
+func (be *postgresBackend) DeleteTaskHub(ctx context.Context) error {
+	if err := be.open(); err != nil {
+		return err
+	}
+	defer func() {
+		be.db.Close()
+		be.db = nil
+	}()
+
+	var exists bool
+	if err := be.db.QueryRowContext(ctx, "SELECT to_regclass('instances') IS NOT NULL").Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check whether the task hub exists: %w", err)
+	} else if !exists {
+		return backend.ErrTaskHubNotFound
+	}
+
+	if _, err := be.db.ExecContext(ctx, "DROP TABLE IF EXISTS Instances, History, NewEvents, NewTasks, LastActions"); err != nil {
+		return fmt.Errorf("failed to drop the tables: %w", err)
+	}
+	return nil
+}
+
+// open opens the database if it isn't already open.
+func (be *postgresBackend) open() error {
+	if be.db != nil {
+		return nil
+	}
+
+	db, err := sql.Open(be.options.DriverName, be.options.ConnectionString)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+
+	be.db = db
+	return nil
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *postgresBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var visibleTime *time.Time = nil
+	if delay := wi.GetAbandonDelay(); delay > 0 {
+		t := time.Now().UTC().Add(delay)
+		visibleTime = &t
+	}
+
+	dbResult, err := tx.ExecContext(
+		ctx,
+		"UPDATE NewEvents SET LockedBy = NULL, VisibleTime = $1 WHERE InstanceID = $2 AND LockedBy = $3",
+		visibleTime,
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update NewEvents table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE NewEvents statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	dbResult, err = tx.ExecContext(
+		ctx,
+		"UPDATE Instances SET LockedBy = NULL, LockExpiration = NULL WHERE InstanceID = $1 AND LockedBy = $2",
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	rowsAffected, err = dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE Instances statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *postgresBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE Instances SET LockExpiration = $1 WHERE InstanceID = $2 AND LockedBy = $3",
+		time.Now().UTC().Add(be.options.OrchestrationLockTimeout),
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE Instances statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *postgresBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) (err error) {
+	defer func() { err = markTransient(err) }()
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	// Dynamically generate the UPDATE statement for the Instances table
+	var sqlSB strings.Builder
+	sqlSB.WriteString("UPDATE Instances SET ")
+
+	sqlUpdateArgs := make(queryArgs, 0, 10)
+	isCreated := false
+	isCompleted := false
+
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if isCreated {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			isCreated = true
+			sqlSB.WriteString("CreatedTime = " + sqlUpdateArgs.add(e.Timestamp.AsTime()) + ", ")
+			sqlSB.WriteString("Input = " + sqlUpdateArgs.add(es.Input.GetValue()) + ", ")
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			sqlSB.WriteString("CompletedTime = " + sqlUpdateArgs.add(now) + ", ")
+			sqlSB.WriteString("Output = " + sqlUpdateArgs.add(ec.Result.GetValue()) + ", ")
+			var failureDetailsPayload []byte
+			if ec.FailureDetails != nil {
+				bytes, err := proto.Marshal(ec.FailureDetails)
+				if err != nil {
+					return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+				}
+				failureDetailsPayload = bytes
+			}
+			sqlSB.WriteString("FailureDetails = " + sqlUpdateArgs.add(failureDetailsPayload) + ", ")
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		sqlSB.WriteString("CustomStatus = " + sqlUpdateArgs.add(wi.State.CustomStatus.Value) + ", ")
+	}
+
+	if count := wi.State.ContinuedAsNewCount(); count > 0 {
+		sqlSB.WriteString("GenerationCount = GenerationCount + " + sqlUpdateArgs.add(count) + ", ")
+	}
+
+	// TODO: Support for stickiness, which would extend the LockExpiration
+	sqlSB.WriteString("RuntimeStatus = " + sqlUpdateArgs.add(helpers.ToRuntimeStatusString(wi.State.RuntimeStatus())))
+	sqlSB.WriteString(", LastUpdatedTime = " + sqlUpdateArgs.add(now))
+	sqlSB.WriteString(", LockExpiration = NULL WHERE InstanceID = " + sqlUpdateArgs.add(string(wi.InstanceID)))
+	sqlSB.WriteString(" AND LockedBy = " + sqlUpdateArgs.add(wi.LockedBy))
+
+	result, err := tx.ExecContext(ctx, sqlSB.String(), sqlUpdateArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get the number of rows affected by the Instance table update: %w", err)
+	} else if count == 0 {
+		return fmt.Errorf("instance '%s' no longer exists or was locked by a different worker", string(wi.InstanceID))
+	}
+
+	// If continue-as-new, delete all existing history
+	if wi.State.ContinuedAsNew() {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM History WHERE InstanceID = $1", string(wi.InstanceID)); err != nil {
+			return fmt.Errorf("failed to delete from History table: %w", err)
+		}
+	}
+
+	// Save the actions from the most recent execution, if requested
+	if wi.State.LastActions != nil {
+		payload, err := proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: string(wi.InstanceID),
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO LastActions (InstanceID, Payload) VALUES ($1, $2) ON CONFLICT (InstanceID) DO UPDATE SET Payload = EXCLUDED.Payload",
+			string(wi.InstanceID),
+			payload,
+		); err != nil {
+			return fmt.Errorf("failed to update LastActions table: %w", err)
+		}
+	}
+
+	// Save new history events
+	newHistoryCount := len(wi.State.NewEvents())
+	if newHistoryCount > 0 {
+		values := make([]string, 0, newHistoryCount)
+		args := make(queryArgs, 0, newHistoryCount*3)
+		nextSequenceNumber := len(wi.State.OldEvents())
+		for _, e := range wi.State.NewEvents() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+
+			values = append(values, "("+args.addList(string(wi.InstanceID), nextSequenceNumber, eventPayload)+")")
+			nextSequenceNumber++
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO History (InstanceID, SequenceNumber, EventPayload) VALUES "+strings.Join(values, ", "), args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert into the History table: %w", err)
+		}
+	}
+
+	// Save outbound activity tasks
+	newActivityCount := len(wi.State.PendingTasks())
+	if newActivityCount > 0 {
+		values := make([]string, 0, newActivityCount)
+		sqlInsertArgs := make(queryArgs, 0, newActivityCount*2)
+		for _, e := range wi.State.PendingTasks() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+
+			values = append(values, "("+sqlInsertArgs.addList(string(wi.InstanceID), eventPayload)+")")
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO NewTasks (InstanceID, EventPayload) VALUES "+strings.Join(values, ", "), sqlInsertArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to insert into the NewTasks table: %w", err)
+		}
+	}
+
+	// Save outbound orchestrator events
+	newEventCount := len(wi.State.PendingTimers()) + len(wi.State.PendingMessages())
+	if newEventCount > 0 {
+		values := make([]string, 0, newEventCount)
+		sqlInsertArgs := make(queryArgs, 0, newEventCount*3)
+		for _, e := range wi.State.PendingTimers() {
+			eventPayload, err := backend.MarshalHistoryEvent(e)
+			if err != nil {
+				return err
+			}
+
+			visibileTime := e.GetTimerFired().GetFireAt().AsTime()
+			values = append(values, "("+sqlInsertArgs.addList(string(wi.InstanceID), eventPayload, visibileTime)+")")
+		}
+
+		for _, msg := range wi.State.PendingMessages() {
+			if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+				// Need to insert a new row into the DB
+				var instanceID string
+				if err := be.createOrchestrationInstanceInternal(ctx, msg.HistoryEvent, tx, &instanceID); err != nil {
+					if err == backend.ErrDuplicateEvent {
+						be.logger.Warnf(
+							"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+							wi.InstanceID,
+							es.OrchestrationInstance.InstanceId)
+					} else {
+						return err
+					}
+				}
+			}
+
+			eventPayload, err := backend.MarshalHistoryEvent(msg.HistoryEvent)
+			if err != nil {
+				return err
+			}
+
+			values = append(values, "("+sqlInsertArgs.addList(msg.TargetInstanceID, eventPayload, nil)+")")
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO NewEvents (InstanceID, EventPayload, VisibleTime) VALUES "+strings.Join(values, ", "), sqlInsertArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to insert into the NewEvents table: %w", err)
+		}
+	}
+
+	// Delete inbound events
+	dbResult, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM NewEvents WHERE InstanceID = $1 AND LockedBy = $2",
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewEvents table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *postgresBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := be.createOrchestrationInstance(ctx, e, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create orchestration: %w", err)
+	}
+
+	return nil
+}
+
+// createOrchestrationInstance creates the orchestration instance and its ExecutionStarted event in the specified
+// transaction.
+func (be *postgresBackend) createOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent, tx *sql.Tx) error {
+	var instanceID string
+	if err := be.createOrchestrationInstanceInternal(ctx, e, tx, &instanceID); err != nil {
+		return err
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime *time.Time = nil
+	if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+		t := ts.AsTime()
+		visibleTime = &t
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload, VisibleTime) VALUES ($1, $2, $3)`,
+		instanceID,
+		eventPayload,
+		visibleTime,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	return nil
+}
+
+func (be *postgresBackend) createOrchestrationInstanceInternal(ctx context.Context, e *backend.HistoryEvent, tx *sql.Tx, instanceID *string) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	var parentInstanceID *string
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		parentInstanceID = &parent.GetOrchestrationInstance().InstanceId
+	}
+
+	tags, err := helpers.MarshalTags(helpers.GetTags(startEvent))
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags: %w", err)
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO Instances (
+			Name,
+			Version,
+			InstanceID,
+			ExecutionID,
+			Input,
+			RuntimeStatus,
+			CreatedTime,
+			ParentInstanceID,
+			Tags
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (InstanceID) DO NOTHING`,
+		startEvent.Name,
+		startEvent.Version.GetValue(),
+		startEvent.OrchestrationInstance.InstanceId,
+		startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		startEvent.Input.GetValue(),
+		"PENDING",
+		e.Timestamp.AsTime(),
+		parentInstanceID,
+		tags,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into Instances table: %w", err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	}
+
+	if rows <= 0 {
+		return backend.ErrDuplicateEvent
+	}
+
+	*instanceID = startEvent.OrchestrationInstance.InstanceId
+	return nil
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *postgresBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = be.db.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload) VALUES ($1, $2)`,
+		string(iid),
+		eventPayload,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	return nil
+}
+
+// IngestOperations implements backend.BackendWithIngest
+func (be *postgresBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		// Each operation is applied in a savepoint so that a failed operation can be rolled back without aborting
+		// the transaction
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT ingest"); err != nil {
+			return nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+		if errs[i] = be.ingestOperation(ctx, op, tx); errs[i] != nil {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT ingest"); err != nil {
+				return nil, fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT ingest"); err != nil {
+			return nil, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return errs, nil
+}
+
+func (be *postgresBackend) ingestOperation(ctx context.Context, op *backend.IngestOperation, tx *sql.Tx) error {
+	if op.Event.GetExecutionStarted() != nil {
+		return be.createOrchestrationInstance(ctx, op.Event, tx)
+	}
+
+	if op.Event == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if op.Event.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(op.Event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload) VALUES ($1, $2)`,
+		string(op.InstanceID),
+		eventPayload,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	return nil
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *postgresBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	sqlArgs := make(queryArgs, 0, len(statuses)+2)
+	instanceIDParam := sqlArgs.add(string(iid))
+	eventPayloadParam := sqlArgs.add(eventPayload)
+	runtimeStatuses := make([]interface{}, 0, len(statuses))
+	for _, status := range statuses {
+		runtimeStatuses = append(runtimeStatuses, helpers.ToRuntimeStatusString(status))
+	}
+	statusesParams := sqlArgs.addList(runtimeStatuses...)
+
+	// The status check and the insert are done in a single statement so that the status can't change in between
+	res, err := be.db.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents (InstanceID, EventPayload)
+		SELECT `+instanceIDParam+`::TEXT, `+eventPayloadParam+`::BYTEA WHERE EXISTS (
+			SELECT 1 FROM Instances WHERE InstanceID = `+instanceIDParam+` AND RuntimeStatus IN (`+statusesParams+`)
+		)`,
+		sqlArgs...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert row into NewEvents table: %w", err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var exists int
+	err = be.db.QueryRowContext(ctx, "SELECT 1 FROM Instances WHERE InstanceID = $1", string(iid)).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return api.ErrInstanceNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	return api.ErrPreconditionFailed
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *postgresBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	row := be.db.QueryRowContext(
+		ctx,
+		"SELECT "+metadataColumns+" FROM Instances WHERE InstanceID = $1",
+		string(iid),
+	)
+
+	err := row.Err()
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", row.Err())
+	}
+
+	metadata, err := scanOrchestrationMetadata(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	}
+	return metadata, err
+}
+
+// metadataColumns are the columns of the Instances table that are read by scanOrchestrationMetadata.
+const metadataColumns = "InstanceID, Name, RuntimeStatus, CreatedTime, LastUpdatedTime, Input, Output, CustomStatus, FailureDetails, GenerationCount, Tags"
+
+// scanOrchestrationMetadata reads the orchestration metadata from a row that contains the metadataColumns.
+func scanOrchestrationMetadata(scan func(dest ...any) error) (*api.OrchestrationMetadata, error) {
+	var instanceID *string
+	var name *string
+	var runtimeStatus *string
+	var createdAt *time.Time
+	var lastUpdatedAt *time.Time
+	var input *string
+	var output *string
+	var customStatus *string
+	var failureDetails *protos.TaskFailureDetails
+	var generationCount int
+	var tags *string
+
+	var failureDetailsPayload []byte
+	err := scan(&instanceID, &name, &runtimeStatus, &createdAt, &lastUpdatedAt, &input, &output, &customStatus, &failureDetailsPayload, &generationCount, &tags)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+	}
+
+	if input == nil {
+		input = &emptyString
+	}
+
+	if output == nil {
+		output = &emptyString
+	}
+
+	if customStatus == nil {
+		customStatus = &emptyString
+	}
+
+	if len(failureDetailsPayload) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal(failureDetailsPayload, failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(*instanceID),
+		*name,
+		helpers.FromRuntimeStatusString(*runtimeStatus),
+		createdAt.UTC(),
+		lastUpdatedAt.UTC(),
+		*input,
+		*output,
+		*customStatus,
+		failureDetails,
+	)
+	metadata.GenerationCount = generationCount
+	if tags != nil {
+		if metadata.Tags, err = helpers.UnmarshalTags(*tags); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+	}
+	return metadata, nil
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *postgresBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	row := be.db.QueryRowContext(
+		ctx,
+		`SELECT A.Payload FROM Instances I
+		LEFT OUTER JOIN LastActions A ON A.InstanceID = I.InstanceID
+		WHERE I.InstanceID = $1`,
+		string(iid),
+	)
+
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to scan the LastActions table result: %w", err)
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(payload, res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *postgresBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT EventPayload FROM History WHERE InstanceID = $1 ORDER BY SequenceNumber ASC",
+		string(wi.InstanceID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existingEvents := make([]*protos.HistoryEvent, 0, 50)
+	for rows.Next() {
+		var eventPayload []byte
+		if err := rows.Scan(&eventPayload); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		existingEvents = append(existingEvents, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the History table results: %w", err)
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *postgresBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	return be.getOrchestrationWorkItem(ctx, backend.OrchestrationWorkItemFilter{})
+}
+
+// GetOrchestrationWorkItemWithFilter implements backend.BackendWithOrchestrationFilters
+func (be *postgresBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	if filter.Names != nil && len(filter.Names) == 0 {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getOrchestrationWorkItem(ctx, filter)
+}
+
+// getOrchestrationWorkItem locks an orchestration instance that matches the filter and has new events that are ready
+// to be executed.
+func (be *postgresBackend) getOrchestrationWorkItem(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	newLockExpiration := now.Add(be.options.OrchestrationLockTimeout)
+
+	args := []interface{}{
+		be.workerName,     // LockedBy for Instances table
+		newLockExpiration, // Updated LockExpiration for Instances table
+		now,               // LockExpiration for Instances table and VisibleTime for NewEvents table
+	}
+	nameFilter := ""
+	if filter.Names != nil {
+		placeholders := make([]string, 0, len(filter.Names))
+		for _, name := range filter.Names {
+			args = append(args, name)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		nameFilter = " AND I.Name IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	// Place a lock on an orchestration instance that has new events that are ready to be executed.
+	// Instances that haven't started yet and still have invisible events are waiting for their
+	// scheduled start time, so events raised to them in the meantime must wait as well.
+	// Rows that are being locked by other workers are skipped rather than waited on, so that
+	// concurrent workers lock different instances.
+	row := tx.QueryRowContext(
+		ctx,
+		`UPDATE Instances SET LockedBy = $1, LockExpiration = $2
+		WHERE InstanceID = (
+			SELECT I.InstanceID FROM Instances I
+			WHERE (I.LockExpiration IS NULL OR I.LockExpiration < $3) AND EXISTS (
+				SELECT 1 FROM NewEvents E
+				WHERE E.InstanceID = I.InstanceID AND (E.VisibleTime IS NULL OR E.VisibleTime < $3)
+			) AND NOT (
+				EXISTS (SELECT 1 FROM NewEvents E WHERE E.InstanceID = I.InstanceID AND E.VisibleTime >= $3)
+				AND NOT EXISTS (SELECT 1 FROM History H WHERE H.InstanceID = I.InstanceID)
+			)`+nameFilter+`
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		) RETURNING InstanceID`,
+		args...,
+	)
+
+	if err := row.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+	}
+
+	var instanceID string
+	if err := row.Scan(&instanceID); err != nil {
+		if err == sql.ErrNoRows {
+			// No new events to process
+			return nil, backend.ErrNoWorkItems
+		}
+
+		return nil, fmt.Errorf("failed to scan the orchestration work-item: %w", err)
+	}
+
+	// The number of saved history events is used by the worker to detect stale cached state, so it's only counted
+	// for workers that cache state
+	var nextSequenceNumber int
+	if filter.IncludeHistoryLength {
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM History WHERE InstanceID = $1", instanceID).Scan(&nextSequenceNumber); err != nil {
+			return nil, fmt.Errorf("failed to count the history events of the orchestration work-item: %w", err)
+		}
+	}
+
+	// TODO: Get all the unprocessed events associated with the locked instance
+	events, err := tx.QueryContext(
+		ctx,
+		`WITH Locked AS (
+			UPDATE NewEvents SET DequeueCount = DequeueCount + 1, LockedBy = $1 WHERE SequenceNumber IN (
+				SELECT SequenceNumber FROM NewEvents
+				WHERE InstanceID = $2 AND (VisibleTime IS NULL OR VisibleTime <= $3)
+				ORDER BY SequenceNumber
+				LIMIT 1000
+			)
+			RETURNING SequenceNumber, EventPayload, DequeueCount
+		)
+		SELECT EventPayload, DequeueCount FROM Locked ORDER BY SequenceNumber`,
+		be.workerName,
+		instanceID,
+		now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+	}
+	defer events.Close()
+
+	maxDequeueCount := int32(0)
+
+	newEvents := make([]*protos.HistoryEvent, 0, 10)
+	for events.Next() {
+		var eventPayload []byte
+		var dequeueCount int32
+		if err := events.Scan(&eventPayload, &dequeueCount); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		if dequeueCount > maxDequeueCount {
+			maxDequeueCount = dequeueCount
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		newEvents = append(newEvents, e)
+	}
+	if err := events.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the orchestration work-item events: %w", err)
+	}
+	events.Close()
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update orchestration work-item: %w", err)
+	}
+
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: api.InstanceID(instanceID),
+		NewEvents:  newEvents,
+		LockedBy:   be.workerName,
+		RetryCount: maxDequeueCount - 1,
+
+		NextSequenceNumber: nextSequenceNumber,
+	}
+
+	return wi, nil
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *postgresBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	wis, err := be.GetActivityWorkItems(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return wis[0], nil
+}
+
+// GetActivityWorkItems implements backend.BackendWithActivityBatches
+func (be *postgresBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+	if max < 1 {
+		return nil, backend.ErrNoWorkItems
+	}
+
+	now := time.Now().UTC()
+	newLockExpiration := now.Add(be.options.ActivityLockTimeout)
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		`UPDATE NewTasks SET LockedBy = $1, LockExpiration = $2, DequeueCount = DequeueCount + 1
+		WHERE SequenceNumber IN (
+			SELECT SequenceNumber FROM NewTasks T
+			WHERE T.LockExpiration IS NULL OR T.LockExpiration < $3
+			ORDER BY SequenceNumber
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		) RETURNING SequenceNumber, InstanceID, EventPayload, DequeueCount`,
+		be.workerName,
+		newLockExpiration,
+		now,
+		max,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
+	}
+	defer rows.Close()
+
+	var wis []*backend.ActivityWorkItem
+	for rows.Next() {
+		var sequenceNumber int64
+		var instanceID string
+		var eventPayload []byte
+		var dequeueCount int32
+		if err := rows.Scan(&sequenceNumber, &instanceID, &eventPayload, &dequeueCount); err != nil {
+			return nil, fmt.Errorf("failed to scan the activity work-item: %w", err)
+		}
+
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		wis = append(wis, &backend.ActivityWorkItem{
+			SequenceNumber: sequenceNumber,
+			InstanceID:     api.InstanceID(instanceID),
+			NewEvent:       e,
+			LockedBy:       be.workerName,
+			RetryCount:     dequeueCount - 1,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
+	}
+
+	if len(wis) == 0 {
+		// No new activity tasks to process
+		return nil, backend.ErrNoWorkItems
+	}
+
+	// The order of the rows returned by UPDATE statements is unspecified
+	sort.Slice(wis, func(i, j int) bool { return wis[i].SequenceNumber < wis[j].SequenceNumber })
+	return wis, nil
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *postgresBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) (err error) {
+	defer func() { err = markTransient(err) }()
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bytes, err := backend.MarshalHistoryEvent(wi.Result)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO NewEvents (InstanceID, EventPayload) VALUES ($1, $2)", string(wi.InstanceID), bytes)
+	if err != nil {
+		return fmt.Errorf("failed to insert into NewEvents table: %w", err)
+	}
+
+	dbResult, err := tx.ExecContext(ctx, "DELETE FROM NewTasks WHERE SequenceNumber = $1 AND LockedBy = $2", wi.SequenceNumber, wi.LockedBy)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewTasks table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteActivityWorkItem implements backend.BackendWithExternalActivityResults
+func (be *postgresBackend) DeleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(ctx, "DELETE FROM NewTasks WHERE SequenceNumber = $1 AND LockedBy = $2", wi.SequenceNumber, wi.LockedBy)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewTasks table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *postgresBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET LockedBy = NULL, LockExpiration = NULL WHERE SequenceNumber = $1 AND LockedBy = $2",
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the NewTasks table for abandon: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by update statement for abandon: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *postgresBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET LockExpiration = $1 WHERE SequenceNumber = $2 AND LockedBy = $3",
+		time.Now().UTC().Add(be.options.ActivityLockTimeout),
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the NewTasks table for lock renewal: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by update statement for lock renewal: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *postgresBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "SELECT 1 FROM Instances WHERE InstanceID = $1", string(id))
+	if err := row.Err(); err != nil {
+		return fmt.Errorf("failed to query for instance existence: %w", err)
+	}
+
+	var unused int
+	if err := row.Scan(&unused); err == sql.ErrNoRows {
+		return api.ErrInstanceNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to scan instance existence: %w", err)
+	}
+
+	dbResult, err := tx.ExecContext(ctx, "DELETE FROM Instances WHERE InstanceID = $1 AND RuntimeStatus IN ('COMPLETED', 'FAILED', 'TERMINATED')", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from the Instances table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected in Instances delete operation: %w", err)
+	}
+	if rowsAffected == 0 {
+		return api.ErrNotCompleted
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM History WHERE InstanceID = $1", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from History table: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM LastActions WHERE InstanceID = $1", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from LastActions table: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *postgresBackend) PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error) {
+	if err := be.ensureDB(); err != nil {
+		return 0, "", err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	// Only the state of completed orchestrations can be purged. The selected rows are locked so that they can't be
+	// restarted before they're deleted.
+	sqlArgs := make(queryArgs, 0, len(query.RuntimeStatuses)+10)
+	filter := instanceQueryFilter(query, &sqlArgs)
+	pageSize := query.PageSizeOrDefault()
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT InstanceID FROM Instances WHERE RuntimeStatus IN ('COMPLETED', 'FAILED', 'TERMINATED')"+filter+" ORDER BY InstanceID LIMIT "+sqlArgs.add(pageSize+1)+" FOR UPDATE",
+		sqlArgs...,
+	)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	instanceIDs := make([]interface{}, 0, pageSize+1)
+	for rows.Next() {
+		var instanceID string
+		if err := rows.Scan(&instanceID); err != nil {
+			rows.Close()
+			return 0, "", fmt.Errorf("failed to scan the instance ID: %w", err)
+		}
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, "", fmt.Errorf("failed to read the instance IDs: %w", err)
+	}
+	rows.Close()
+	if len(instanceIDs) == 0 {
+		return 0, "", nil
+	}
+
+	continuationToken := ""
+	if len(instanceIDs) > pageSize {
+		instanceIDs = instanceIDs[:pageSize]
+		continuationToken = instanceIDs[len(instanceIDs)-1].(string)
+	}
+	deleteArgs := make(queryArgs, 0, len(instanceIDs))
+	inClause := "(" + deleteArgs.addList(instanceIDs...) + ")"
+	for _, table := range []string{"Instances", "History", "LastActions"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE InstanceID IN "+inClause, deleteArgs...); err != nil {
+			return 0, "", fmt.Errorf("failed to delete from the %s table: %w", table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(instanceIDs), continuationToken, nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *postgresBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	if len(fromSequenceNumbers) == 0 {
+		return histories, nil
+	}
+
+	tx, err := be.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	idArgs := make(queryArgs, 0, len(fromSequenceNumbers))
+	idParams := make([]string, 0, len(fromSequenceNumbers))
+	historyArgs := make(queryArgs, 0, len(fromSequenceNumbers)*2)
+	historyConditions := make([]string, 0, len(fromSequenceNumbers))
+	for iid, from := range fromSequenceNumbers {
+		idParams = append(idParams, idArgs.add(string(iid)))
+		historyConditions = append(historyConditions, "(InstanceID = "+historyArgs.add(string(iid))+" AND SequenceNumber >= "+historyArgs.add(from)+")")
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT InstanceID FROM Instances WHERE InstanceID IN ("+strings.Join(idParams, ", ")+")",
+		idArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	for rows.Next() {
+		var instanceID string
+		if err := rows.Scan(&instanceID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+		}
+		histories[api.InstanceID(instanceID)] = make([]*backend.HistoryEvent, 0)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(
+		ctx,
+		"SELECT InstanceID, EventPayload FROM History WHERE "+strings.Join(historyConditions, " OR ")+
+			" ORDER BY InstanceID, SequenceNumber ASC",
+		historyArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the History table: %w", err)
+	}
+	defer rows.Close()
+
+	errs := make(map[api.InstanceID]error)
+	for rows.Next() {
+		var instanceID string
+		var eventPayload []byte
+		if err := rows.Scan(&instanceID, &eventPayload); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		iid := api.InstanceID(instanceID)
+		if _, failed := errs[iid]; failed {
+			continue
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			errs[iid] = err
+			delete(histories, iid)
+			continue
+		}
+		histories[iid] = append(histories[iid], e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the History table results: %w", err)
+	}
+
+	for iid := range fromSequenceNumbers {
+		if _, ok := histories[iid]; !ok {
+			if _, failed := errs[iid]; !failed {
+				errs[iid] = api.ErrInstanceNotFound
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *postgresBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT "+metadataColumns+` FROM Instances WHERE InstanceID IN (
+			SELECT c.InstanceID FROM Instances c
+			LEFT JOIN Instances p ON p.InstanceID = c.ParentInstanceID
+			WHERE c.ParentInstanceID IS NOT NULL
+				AND c.RuntimeStatus IN ('PENDING', 'RUNNING', 'SUSPENDED')
+				AND (p.InstanceID IS NULL OR p.RuntimeStatus IN ('COMPLETED', 'FAILED', 'TERMINATED'))
+		) ORDER BY CreatedTime`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for rows.Next() {
+		metadata, err := scanOrchestrationMetadata(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *postgresBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	sqlArgs := make(queryArgs, 0, len(query.RuntimeStatuses)+10)
+	filter := instanceQueryFilter(query, &sqlArgs)
+	pageSize := query.PageSizeOrDefault()
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT "+metadataColumns+" FROM Instances WHERE 1 = 1"+filter+" ORDER BY InstanceID LIMIT "+sqlArgs.add(pageSize+1),
+		sqlArgs...,
+	)
+	if err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	instances := make([]*api.OrchestrationMetadata, 0)
+	for rows.Next() {
+		metadata, err := scanOrchestrationMetadata(rows.Scan)
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		instances = append(instances, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// instanceQueryFilter returns the conditions of the Instances table that implement the continuation token, instance
+// ID prefix, name, name prefix, runtime status, creation time, and completion time filters of the query, each
+// starting with " AND ", and adds their arguments to sqlArgs.
+func instanceQueryFilter(query api.InstanceQuery, sqlArgs *queryArgs) string {
+	var sqlSB strings.Builder
+	if query.ContinuationToken != "" {
+		sqlSB.WriteString(" AND InstanceID > " + sqlArgs.add(query.ContinuationToken))
+	}
+	if query.InstanceIDPrefix != "" {
+		prefixParam := sqlArgs.add(query.InstanceIDPrefix)
+		sqlSB.WriteString(" AND left(InstanceID, char_length(" + prefixParam + ")) = " + prefixParam)
+	}
+	if query.Name != "" {
+		sqlSB.WriteString(" AND Name = " + sqlArgs.add(query.Name))
+	}
+	if query.NamePrefix != "" {
+		prefixParam := sqlArgs.add(query.NamePrefix)
+		sqlSB.WriteString(" AND left(Name, char_length(" + prefixParam + ")) = " + prefixParam)
+	}
+	if len(query.RuntimeStatuses) > 0 {
+		statusParams := make([]string, 0, len(query.RuntimeStatuses))
+		for _, status := range query.RuntimeStatuses {
+			statusParams = append(statusParams, sqlArgs.add(helpers.ToRuntimeStatusString(status)))
+		}
+		sqlSB.WriteString(" AND RuntimeStatus IN (" + strings.Join(statusParams, ", ") + ")")
+	}
+	if !query.CreatedFrom.IsZero() {
+		sqlSB.WriteString(" AND CreatedTime >= " + sqlArgs.add(query.CreatedFrom.UTC()))
+	}
+	if !query.CreatedTo.IsZero() {
+		sqlSB.WriteString(" AND CreatedTime < " + sqlArgs.add(query.CreatedTo.UTC()))
+	}
+	if !query.CompletedBefore.IsZero() {
+		sqlSB.WriteString(" AND CompletedTime < " + sqlArgs.add(query.CompletedBefore.UTC()))
+	}
+	return sqlSB.String()
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *postgresBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	// A repeatable read transaction so that the metadata, history, and pending events are a consistent snapshot
+	tx, err := be.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "SELECT "+metadataColumns+" FROM Instances WHERE InstanceID = $1", string(iid))
+	metadata, err := scanOrchestrationMetadata(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{Metadata: metadata}
+	if state.History, err = readEvents(ctx, tx, "SELECT EventPayload FROM History WHERE InstanceID = $1 ORDER BY SequenceNumber ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the History table: %w", err)
+	}
+	if state.PendingEvents, err = readEvents(ctx, tx, "SELECT EventPayload FROM NewEvents WHERE InstanceID = $1 ORDER BY SequenceNumber ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the NewEvents table: %w", err)
+	}
+	if state.PendingTasks, err = readEvents(ctx, tx, "SELECT EventPayload FROM NewTasks WHERE InstanceID = $1 ORDER BY SequenceNumber ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the NewTasks table: %w", err)
+	}
+	return state, nil
+}
+
+// readEvents reads the history events returned by a query that selects a single column with event payloads.
+func readEvents(ctx context.Context, tx *sql.Tx, query string, iid api.InstanceID) ([]*backend.HistoryEvent, error) {
+	rows, err := tx.QueryContext(ctx, query, string(iid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*backend.HistoryEvent, 0)
+	for rows.Next() {
+		var eventPayload []byte
+		if err := rows.Scan(&eventPayload); err != nil {
+			return nil, err
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *postgresBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+	var parentInstanceID *string
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		parentInstanceID = &parent.GetOrchestrationInstance().InstanceId
+	}
+	tags, err := helpers.MarshalTags(metadata.Tags)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags: %w", err)
+	}
+	var completedTime *time.Time
+	if metadata.IsComplete() {
+		completedTime = &metadata.LastUpdatedAt
+	}
+	var failureDetailsPayload []byte
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		failureDetailsPayload = bytes
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO Instances (
+			Name,
+			Version,
+			InstanceID,
+			ExecutionID,
+			RuntimeStatus,
+			CreatedTime,
+			LastUpdatedTime,
+			CompletedTime,
+			Input,
+			Output,
+			CustomStatus,
+			FailureDetails,
+			ParentInstanceID,
+			GenerationCount,
+			Tags
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (InstanceID) DO NOTHING`,
+		metadata.Name,
+		startEvent.GetVersion().GetValue(),
+		string(metadata.InstanceID),
+		startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		helpers.ToRuntimeStatusString(metadata.RuntimeStatus),
+		metadata.CreatedAt.UTC(),
+		metadata.LastUpdatedAt.UTC(),
+		completedTime,
+		metadata.SerializedInput,
+		metadata.SerializedOutput,
+		metadata.SerializedCustomStatus,
+		failureDetailsPayload,
+		parentInstanceID,
+		metadata.GenerationCount,
+		tags,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into Instances table: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	} else if rows <= 0 {
+		return backend.ErrDuplicateEvent
+	}
+
+	for i, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO History (InstanceID, SequenceNumber, EventPayload) VALUES ($1, $2, $3)", string(metadata.InstanceID), i, eventPayload); err != nil {
+			return fmt.Errorf("failed to insert into the History table: %w", err)
+		}
+	}
+
+	for _, e := range state.PendingEvents {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+
+		// Timers and scheduled starts must stay invisible to workers until they're due
+		var visibleTime *time.Time
+		if tf := e.GetTimerFired(); tf != nil {
+			t := tf.GetFireAt().AsTime()
+			visibleTime = &t
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			t := ts.AsTime()
+			visibleTime = &t
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO NewEvents (InstanceID, EventPayload, VisibleTime) VALUES ($1, $2, $3)", string(metadata.InstanceID), eventPayload, visibleTime); err != nil {
+			return fmt.Errorf("failed to insert into the NewEvents table: %w", err)
+		}
+	}
+
+	for _, e := range state.PendingTasks {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO NewTasks (InstanceID, EventPayload) VALUES ($1, $2)", string(metadata.InstanceID), eventPayload); err != nil {
+			return fmt.Errorf("failed to insert into the NewTasks table: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *postgresBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	row := be.db.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM Instances WHERE Name = $1 AND CreatedTime >= $2",
+		name,
+		since.UTC(),
+	)
+	if err := row.Scan(&stats.Started); err != nil {
+		return nil, fmt.Errorf("failed to count the started instances: %w", err)
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		`SELECT RuntimeStatus, CreatedTime, CompletedTime FROM Instances
+		WHERE Name = $1 AND CompletedTime >= $2 AND RuntimeStatus IN ('COMPLETED', 'FAILED')`,
+		name,
+		since.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	var durations []time.Duration
+	var total time.Duration
+	for rows.Next() {
+		var runtimeStatus string
+		var createdAt, completedAt time.Time
+		if err := rows.Scan(&runtimeStatus, &createdAt, &completedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+		}
+		if runtimeStatus == "FAILED" {
+			stats.Failed++
+		} else {
+			stats.Completed++
+		}
+		d := completedAt.Sub(createdAt)
+		durations = append(durations, d)
+		total += d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+func (*postgresBackend) Start(context.Context) error {
+	return nil
+}
+
+// Stop implements backend.Backend
+func (*postgresBackend) Stop(context.Context) error {
+	return nil
+}
+
+// markTransient marks the errors of transactions that were rolled back because of a serialization failure or a
+// deadlock as transient. The SQLSTATE is read through the SQLState method of the errors of the pgx and lib/pq drivers.
+func markTransient(err error) error {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		if code := pgErr.SQLState(); code == "40001" || code == "40P01" {
+			return backend.TransientError(err)
+		}
+	}
+	return err
+}
+
+func (be *postgresBackend) ensureDB() error {
+	if be.db == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *postgresBackend) String() string {
+	return fmt.Sprintf("postgres::%s", be.options.DriverName)
+}
+
+// queryArgs collects the arguments of a query with numbered parameters.
+type queryArgs []interface{}
+
+// add adds an argument and returns the parameter that references it, e.g. "$3".
+func (a *queryArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// addList adds the specified arguments and returns a comma-separated list of the parameters that reference them.
+func (a *queryArgs) addList(values ...interface{}) string {
+	params := make([]string, len(values))
+	for i, v := range values {
+		params[i] = a.add(v)
+	}
+	return strings.Join(params, ", ")
+}
@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS Instances (
+    InstanceID TEXT PRIMARY KEY NOT NULL,
+    ExecutionID TEXT NOT NULL,
+    Name TEXT NOT NULL, -- the type name of the orchestration or entity
+    Version TEXT NULL, -- the version of the orchestration (optional)
+    RuntimeStatus TEXT NOT NULL,
+    CreatedTime TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    LastUpdatedTime TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CompletedTime TIMESTAMPTZ NULL,
+    LockedBy TEXT NULL,
+    LockExpiration TIMESTAMPTZ NULL,
+    Input TEXT NULL,
+    Output TEXT NULL,
+    CustomStatus TEXT NULL,
+    FailureDetails BYTEA NULL,
+    ParentInstanceID TEXT NULL,
+    GenerationCount INTEGER NOT NULL DEFAULT 0, -- the number of times the orchestration continued-as-new
+    Tags TEXT NULL -- the tags of the orchestration, as a JSON object (optional)
+);
+
+-- This index is used by LockNext and Purge logic
+CREATE INDEX IF NOT EXISTS IX_Instances_RuntimeStatus ON Instances(RuntimeStatus);
+
+-- This index is intended to help the performance of multi-instance query
+CREATE INDEX IF NOT EXISTS IX_Instances_CreatedTime ON Instances(CreatedTime);
+
+CREATE TABLE IF NOT EXISTS History (
+    InstanceID TEXT NOT NULL,
+    SequenceNumber INTEGER NOT NULL,
+    EventPayload BYTEA NOT NULL,
+
+    CONSTRAINT PK_History PRIMARY KEY (InstanceID, SequenceNumber)
+);
+
+CREATE TABLE IF NOT EXISTS NewEvents (
+    SequenceNumber BIGSERIAL PRIMARY KEY, -- order is important for FIFO
+    InstanceID TEXT NOT NULL,
+    ExecutionID TEXT NULL,
+    Timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    VisibleTime TIMESTAMPTZ NULL, -- for scheduled or abandoned messages
+    DequeueCount INTEGER NOT NULL DEFAULT 0,
+    LockedBy TEXT NULL,
+    EventPayload BYTEA NOT NULL
+);
+
+-- This index is used to fetch the new events of a locked instance
+CREATE INDEX IF NOT EXISTS IX_NewEvents_InstanceID ON NewEvents(InstanceID, SequenceNumber);
+
+CREATE TABLE IF NOT EXISTS NewTasks (
+    SequenceNumber BIGSERIAL PRIMARY KEY, -- order is important for FIFO
+    InstanceID TEXT NOT NULL,
+    ExecutionID TEXT NULL,
+    Timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    DequeueCount INTEGER NOT NULL DEFAULT 0,
+    LockedBy TEXT NULL,
+    LockExpiration TIMESTAMPTZ NULL,
+    EventPayload BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS LastActions (
+    InstanceID TEXT PRIMARY KEY NOT NULL,
+    Payload BYTEA NOT NULL -- serialized OrchestratorResponse containing only the actions
+);
@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// ErrQueriesNotSupported is returned by the operations that query orchestration instances if the backend doesn't
+// implement [BackendWithQueries].
+var ErrQueriesNotSupported = errors.New("the backend doesn't support querying orchestration instances")
+
+// NewInstanceQueryResult creates the result of [BackendWithQueries.QueryOrchestrationMetadata] from the metadata of up to
+// pageSize+1 orchestration instances that match the query, sorted by instance ID and starting after the query's
+// continuation token. The extra instance, if present, only signals that there's another page and isn't returned.
+//
+// The continuation token is the ID of the last instance in the page, so backends resume the query by selecting the
+// instances whose IDs are greater than the token.
+func NewInstanceQueryResult(instances []*api.OrchestrationMetadata, pageSize int) api.InstanceQueryResult {
+	if len(instances) <= pageSize {
+		return api.InstanceQueryResult{Instances: instances}
+	}
+	instances = instances[:pageSize]
+	return api.InstanceQueryResult{
+		Instances:         instances,
+		ContinuationToken: string(instances[len(instances)-1].InstanceID),
+	}
+}
+
+// queryOrchestrationMetadata queries the orchestration metadata of a backend, and applies the filters of the query
+// that backends don't implement themselves, which are the name prefix, completion time, custom status, and tag
+// filters, and leaves out the instances of durable entities. Pages are fetched from the backend until the page of filtered results is full or there are no more
+// instances, and the continuation token of the last backend page is returned, so backends don't need to know about
+// these filters. The tag filter expression is still passed to the backend, so that backends that can evaluate it
+// only return matching instances, and it's applied again to the results of the other backends.
+//
+// [ErrQueriesNotSupported] is returned if the backend doesn't implement [BackendWithQueries].
+func queryOrchestrationMetadata(ctx context.Context, be Backend, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	querier, ok := As[BackendWithQueries](be)
+	if !ok {
+		return api.InstanceQueryResult{}, ErrQueriesNotSupported
+	}
+	if query.TagFilter != nil {
+		if err := query.TagFilter.Validate(); err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+	}
+	pageSize := query.PageSizeOrDefault()
+	result := api.InstanceQueryResult{Instances: make([]*api.OrchestrationMetadata, 0)}
+	page := query
+	page.NamePrefix = ""
+	page.CompletedBefore = time.Time{}
+	page.CustomStatusContains = ""
+	page.Tags = nil
+	for {
+		// Only fetch as many instances as are still needed, so that the continuation token of the backend page
+		// doesn't skip any instance
+		page.PageSize = pageSize - len(result.Instances)
+		pageResult, err := querier.QueryOrchestrationMetadata(ctx, page)
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		for _, metadata := range pageResult.Instances {
+			if matchesQueryFilters(metadata, query) {
+				result.Instances = append(result.Instances, metadata)
+			}
+		}
+		result.ContinuationToken = pageResult.ContinuationToken
+		if result.ContinuationToken == "" || len(result.Instances) >= pageSize {
+			return result, nil
+		}
+		page.ContinuationToken = result.ContinuationToken
+	}
+}
+
+// matchesQueryFilters returns true if the metadata isn't the metadata of an entity and matches the name prefix,
+// completion time, custom status, tag, and tag filter expression filters of the query. The completion time of an
+// orchestration is the time at which its metadata was last updated.
+func matchesQueryFilters(metadata *api.OrchestrationMetadata, query api.InstanceQuery) bool {
+	if helpers.IsEntityOrchestratorName(metadata.Name) {
+		return false
+	}
+	if !strings.HasPrefix(metadata.Name, query.NamePrefix) {
+		return false
+	}
+	if !query.CompletedBefore.IsZero() && (!metadata.IsComplete() || !metadata.LastUpdatedAt.Before(query.CompletedBefore)) {
+		return false
+	}
+	if !strings.Contains(metadata.SerializedCustomStatus, query.CustomStatusContains) {
+		return false
+	}
+	for k, v := range query.Tags {
+		if actual, ok := metadata.Tags[k]; !ok || actual != v {
+			return false
+		}
+	}
+	return query.TagFilter.Matches(metadata.Tags)
+}
+
+// countOrchestrationMetadata returns the number of orchestrations that match the query, but stops counting once it
+// reaches limit, so that callers that compare the count to a limit don't page through all the matches.
+func countOrchestrationMetadata(ctx context.Context, be Backend, query api.InstanceQuery, limit int) (int, error) {
+	count := 0
+	query.PageSize = limit
+	for count < limit {
+		page, err := queryOrchestrationMetadata(ctx, be, query)
+		if err != nil {
+			return 0, err
+		}
+		count += len(page.Instances)
+		if page.ContinuationToken == "" {
+			break
+		}
+		query.ContinuationToken = page.ContinuationToken
+	}
+	return count, nil
+}
+
+// computeOrchestrationStats computes the statistics of [BackendWithStats.GetOrchestrationStats] from the metadata of
+// all the orchestrations with the specified name. The completion time of an orchestration is the time at which its
+// metadata was last updated.
+func computeOrchestrationStats(ctx context.Context, be Backend, name string, since time.Time) (*api.OrchestrationStats, error) {
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	query := api.InstanceQuery{Name: name}
+	for {
+		page, err := queryOrchestrationMetadata(ctx, be, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range page.Instances {
+			if !metadata.CreatedAt.Before(since) {
+				stats.Started++
+			}
+			if !metadata.IsComplete() || metadata.LastUpdatedAt.Before(since) {
+				continue
+			}
+			switch metadata.RuntimeStatus {
+			case protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED:
+				stats.Completed++
+			case protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED:
+				stats.Failed++
+			default:
+				continue
+			}
+			d := metadata.LastUpdatedAt.Sub(metadata.CreatedAt)
+			durations = append(durations, d)
+			total += d
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		query.ContinuationToken = page.ContinuationToken
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
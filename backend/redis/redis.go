@@ -0,0 +1,1785 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	goredis "github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/proto"
+)
+
+// The payloads of the messages that are published when work items become available
+const (
+	orchestrationSignal = "orchestration"
+	activitySignal      = "activity"
+)
+
+// maxTransactionAttempts is the number of times that a transaction is attempted when concurrent transactions
+// modify the keys that it reads.
+const maxTransactionAttempts = 100
+
+// maxWorkItemCandidates is the number of work items that a worker attempts to lock before giving up, when other
+// workers lock them first.
+const maxWorkItemCandidates = 10
+
+var (
+	// errTooManyConflicts is transient because none of the conflicting transactions were committed, so workers can
+	// retry the completions that fail with it.
+	errTooManyConflicts = backend.TransientError(errors.New("the transaction conflicted with too many concurrent transactions"))
+	errNotAvailable     = errors.New("the work item is no longer available")
+)
+
+type RedisOptions struct {
+	OrchestrationLockTimeout time.Duration
+	ActivityLockTimeout      time.Duration
+
+	// Address is the host:port address of the Redis server.
+	Address string
+
+	// Username and Password are the credentials used to connect to the Redis server, if any.
+	Username string
+	Password string
+
+	// DB is the number of the Redis database.
+	DB int
+
+	// KeyPrefix is prepended to all the keys of the task hub, so that multiple task hubs can share a database.
+	KeyPrefix string
+
+	// PollTimeout is how long fetching a work item waits for a new work item when there are none, before
+	// [backend.ErrNoWorkItems] is returned. Waiting fetches return as soon as a new work item is added by any
+	// client or worker that's connected to the task hub, so that work items are dispatched without waiting for
+	// the next poll. Fetches only wait after the backend was started.
+	PollTimeout time.Duration
+}
+
+type redisBackend struct {
+	client     *goredis.Client
+	pubsub     *goredis.PubSub
+	listening  int32
+	workerName string
+	logger     backend.Logger
+	options    *RedisOptions
+
+	orchestrationSignals chan struct{}
+	activitySignals      chan struct{}
+}
+
+// NewRedisOptions creates a new options object for the Redis backend provider.
+func NewRedisOptions(address string) *RedisOptions {
+	// Default values are provided for required options
+	return &RedisOptions{
+		Address:                  address,
+		KeyPrefix:                "durabletask",
+		OrchestrationLockTimeout: 2 * time.Minute,
+		ActivityLockTimeout:      2 * time.Minute,
+		PollTimeout:              time.Second,
+	}
+}
+
+// NewRedisBackend creates a new Redis-based Backend object.
+//
+// The history of each orchestration instance is stored in a list and its metadata in a hash. Orchestration and
+// activity work items are indexed by sorted sets that are ordered by the time at which the work items become
+// visible, and updates are made with optimistic transactions, so that multiple workers can share the same
+// database. Once started, the backend subscribes to a channel on which new work items are announced, so that idle
+// workers pick up new work items immediately instead of polling for them.
+//
+// Redis Cluster isn't supported because transactions span the keys of multiple orchestration instances.
+func NewRedisBackend(opts *RedisOptions, logger backend.Logger) backend.Backend {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	pid := os.Getpid()
+	uuidStr := uuid.NewString()
+
+	if opts == nil {
+		opts = NewRedisOptions("localhost:6379")
+	}
+
+	return &redisBackend{
+		client:               nil,
+		workerName:           fmt.Sprintf("%s,%d,%s", hostname, pid, uuidStr),
+		options:              opts,
+		logger:               logger,
+		orchestrationSignals: make(chan struct{}, 1),
+		activitySignals:      make(chan struct{}, 1),
+	}
+}
+
+// CreateTaskHub connects to the Redis server and marks the task hub as created
+func (be *redisBackend) CreateTaskHub(ctx context.Context) error {
+	if be.client == nil {
+		be.client = goredis.NewClient(&goredis.Options{
+			Addr:     be.options.Address,
+			Username: be.options.Username,
+			Password: be.options.Password,
+			DB:       be.options.DB,
+		})
+	}
+
+	if err := be.client.Set(ctx, be.taskHubKey(), "1", 0).Err(); err != nil {
+		return fmt.Errorf("failed to initialize the database: %w", err)
+	}
+	return nil
+}
+
+// DeleteTaskHub deletes all the keys of the task hub
+func (be *redisBackend) DeleteTaskHub(ctx context.Context) error {
+	client := be.client
+	if client == nil {
+		client = goredis.NewClient(&goredis.Options{
+			Addr:     be.options.Address,
+			Username: be.options.Username,
+			Password: be.options.Password,
+			DB:       be.options.DB,
+		})
+	}
+	defer func() {
+		client.Close()
+		be.client = nil
+	}()
+
+	if exists, err := client.Exists(ctx, be.taskHubKey()).Result(); err != nil {
+		return fmt.Errorf("failed to check whether the task hub exists: %w", err)
+	} else if exists == 0 {
+		return backend.ErrTaskHubNotFound
+	}
+
+	iter := client.Scan(ctx, 0, escapePattern(be.options.KeyPrefix)+":*", 1000).Iterator()
+	keys := make([]string, 0, 1000)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == cap(keys) {
+			if err := client.Del(ctx, keys...).Err(); err != nil {
+				return fmt.Errorf("failed to delete the keys of the task hub: %w", err)
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to scan the keys of the task hub: %w", err)
+	}
+	if len(keys) > 0 {
+		if err := client.Del(ctx, keys...).Err(); err != nil {
+			return fmt.Errorf("failed to delete the keys of the task hub: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateOrchestrationInstance implements backend.Backend
+func (be *redisBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(ctx, func(q *queueTx) error {
+		return q.createInstance(ctx, e)
+	})
+}
+
+// AddNewOrchestrationEvent implements backend.Backend
+func (be *redisBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	return be.update(ctx, func(q *queueTx) error {
+		return q.addEvent(ctx, string(iid), e, time.Time{})
+	})
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *redisBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	// The status is read in the same transaction in which the event is added, so that it can't change in between
+	return be.update(ctx, func(q *queueTx) error {
+		s, err := q.load(ctx, string(iid))
+		if err != nil {
+			return err
+		}
+		if !s.exists() {
+			return api.ErrInstanceNotFound
+		}
+
+		matches := false
+		for _, status := range statuses {
+			if helpers.ToRuntimeStatusString(status) == s.runtimeStatus {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return api.ErrPreconditionFailed
+		}
+
+		return q.addEvent(ctx, string(iid), e, time.Time{})
+	})
+}
+
+// IngestOperations implements backend.BackendWithIngest
+//
+// Each operation is committed in its own transaction.
+func (be *redisBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Event.GetExecutionStarted() != nil {
+			errs[i] = be.CreateOrchestrationInstance(ctx, op.Event)
+		} else {
+			errs[i] = be.AddNewOrchestrationEvent(ctx, op.InstanceID, op.Event)
+		}
+	}
+	return errs, nil
+}
+
+// GetOrchestrationWorkItem implements backend.Backend
+func (be *redisBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	wi, err := be.lockNextOrchestrationWorkItem(ctx)
+	if err == backend.ErrNoWorkItems && be.waitForWorkItems(ctx, be.orchestrationSignals, be.readyKey()) {
+		wi, err = be.lockNextOrchestrationWorkItem(ctx)
+	}
+	return wi, err
+}
+
+func (be *redisBackend) lockNextOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	now := time.Now().UTC()
+	nowScore := toScore(now)
+
+	candidates, err := be.client.ZRangeByScore(ctx, be.readyKey(), &goredis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(nowScore, 'f', -1, 64),
+		Count: maxWorkItemCandidates,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for orchestration work-items: %w", err)
+	}
+
+	for _, id := range candidates {
+		var wi *backend.OrchestrationWorkItem
+		err := be.update(ctx, func(q *queueTx) error {
+			s, err := q.load(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			// Another worker may have locked the instance since it was selected
+			if readyTime, ok := s.readyTime(); !ok || readyTime > nowScore {
+				return errNotAvailable
+			}
+
+			// TODO: Get all the unprocessed events associated with the locked instance
+			seqs := make([]string, 0, len(s.eventTimes))
+			for seq, visibleTime := range s.eventTimes {
+				if visibleTime <= nowScore {
+					seqs = append(seqs, seq)
+				}
+			}
+			sort.Strings(seqs)
+			if len(seqs) > 1000 {
+				seqs = seqs[:1000]
+			}
+
+			payloads, err := q.tx.HMGet(ctx, be.eventsKey(id), seqs...).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read the orchestration work-item events: %w", err)
+			}
+			dequeueCounts, err := q.tx.HMGet(ctx, be.dequeueCountsKey(id), seqs...).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read the orchestration work-item dequeue counts: %w", err)
+			}
+
+			maxDequeueCount := int32(0)
+			newEvents := make([]*protos.HistoryEvent, 0, len(seqs))
+			for i := range seqs {
+				payload, _ := payloads[i].(string)
+				e, err := backend.UnmarshalHistoryEvent([]byte(payload))
+				if err != nil {
+					return err
+				}
+				newEvents = append(newEvents, e)
+
+				dequeueCount := int32(1)
+				if count, ok := dequeueCounts[i].(string); ok {
+					n, _ := strconv.Atoi(count)
+					dequeueCount += int32(n)
+				}
+				if dequeueCount > maxDequeueCount {
+					maxDequeueCount = dequeueCount
+				}
+			}
+
+			lockExpiration := toScore(now.Add(be.options.OrchestrationLockTimeout))
+			q.write(func(pipe goredis.Pipeliner) {
+				pipe.HSet(ctx, be.instanceKey(id),
+					"LockedBy", be.workerName,
+					"LockExpiration", strconv.FormatFloat(lockExpiration, 'f', -1, 64),
+					"LockedEvents", strings.Join(seqs, ","))
+				for _, seq := range seqs {
+					pipe.HIncrBy(ctx, be.dequeueCountsKey(id), seq, 1)
+				}
+			})
+			s.lockedBy = be.workerName
+			s.lockExpiration = lockExpiration
+			s.lockedEvents = seqs
+			s.dirty = true
+
+			wi = &backend.OrchestrationWorkItem{
+				InstanceID: api.InstanceID(id),
+				NewEvents:  newEvents,
+				LockedBy:   be.workerName,
+				RetryCount: maxDequeueCount - 1,
+
+				NextSequenceNumber: int(s.historyLength),
+			}
+			return nil
+		})
+		if err == errNotAvailable {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return wi, nil
+	}
+
+	// No new events to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// GetOrchestrationRuntimeState implements backend.Backend
+func (be *redisBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	payloads, err := be.client.LRange(ctx, be.historyKey(string(wi.InstanceID)), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the history: %w", err)
+	}
+
+	existingEvents, err := unmarshalEvents(payloads)
+	if err != nil {
+		return nil, err
+	}
+
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, existingEvents)
+	return state, nil
+}
+
+// GetOrchestrationMetadata implements backend.Backend
+func (be *redisBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	fields, err := be.client.HGetAll(ctx, be.instanceKey(string(iid))).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the instance: %w", err)
+	} else if len(fields) == 0 {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	return parseOrchestrationMetadata(string(iid), fields)
+}
+
+// parseOrchestrationMetadata reads the orchestration metadata from the fields of an instance hash.
+func parseOrchestrationMetadata(id string, fields map[string]string) (*api.OrchestrationMetadata, error) {
+	var failureDetails *protos.TaskFailureDetails
+	if payload := fields["FailureDetails"]; len(payload) > 0 {
+		failureDetails = new(protos.TaskFailureDetails)
+		if err := proto.Unmarshal([]byte(payload), failureDetails); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure details: %w", err)
+		}
+	}
+
+	metadata := api.NewOrchestrationMetadata(
+		api.InstanceID(id),
+		fields["Name"],
+		helpers.FromRuntimeStatusString(fields["RuntimeStatus"]),
+		parseTime(fields["CreatedTime"]),
+		parseTime(fields["LastUpdatedTime"]),
+		fields["Input"],
+		fields["Output"],
+		fields["CustomStatus"],
+		failureDetails,
+	)
+	metadata.GenerationCount, _ = strconv.Atoi(fields["GenerationCount"])
+	tags, err := helpers.UnmarshalTags(fields["Tags"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+	}
+	metadata.Tags = tags
+	return metadata, nil
+}
+
+// CompleteOrchestrationWorkItem implements backend.Backend
+func (be *redisBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	now := time.Now().UTC()
+
+	// Prepare the updates of the instance hash
+	fields := make(map[string]interface{})
+	createdTime := time.Time{}
+	isCompleted := false
+
+	for _, e := range wi.State.NewEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			if !createdTime.IsZero() {
+				// TODO: Log warning about duplicate start event
+				continue
+			}
+			createdTime = e.Timestamp.AsTime()
+			fields["CreatedTime"] = formatTime(createdTime)
+			fields["Input"] = es.Input.GetValue()
+		} else if ec := e.GetExecutionCompleted(); ec != nil {
+			if isCompleted {
+				// TODO: Log warning about duplicate completion event
+				continue
+			}
+			isCompleted = true
+			fields["CompletedTime"] = formatTime(now)
+			fields["Output"] = ec.Result.GetValue()
+			fields["FailureDetails"] = ""
+			if ec.FailureDetails != nil {
+				bytes, err := proto.Marshal(ec.FailureDetails)
+				if err != nil {
+					return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+				}
+				fields["FailureDetails"] = bytes
+			}
+		}
+		// TODO: Execution suspended & resumed
+	}
+
+	if wi.State.CustomStatus != nil {
+		fields["CustomStatus"] = wi.State.CustomStatus.Value
+	}
+	fields["RuntimeStatus"] = helpers.ToRuntimeStatusString(wi.State.RuntimeStatus())
+	fields["LastUpdatedTime"] = formatTime(now)
+
+	// Save the actions from the most recent execution, if requested
+	var lastActions []byte
+	if wi.State.LastActions != nil {
+		payload, err := proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: id,
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+		lastActions = payload
+	}
+
+	history := make([]interface{}, 0, len(wi.State.NewEvents()))
+	for _, e := range wi.State.NewEvents() {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		history = append(history, eventPayload)
+	}
+
+	return be.update(ctx, func(q *queueTx) error {
+		s, err := q.load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !s.exists() || s.lockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		lockedEvents := s.lockedEvents
+		q.write(func(pipe goredis.Pipeliner) {
+			// TODO: Support for stickiness, which would extend the LockExpiration
+			pipe.HSet(ctx, be.instanceKey(id), fields)
+			pipe.HDel(ctx, be.instanceKey(id), "LockedBy", "LockExpiration", "LockedEvents")
+			if count := wi.State.ContinuedAsNewCount(); count > 0 {
+				pipe.HIncrBy(ctx, be.instanceKey(id), "GenerationCount", int64(count))
+			}
+			if !createdTime.IsZero() {
+				pipe.ZAdd(ctx, be.instancesKey(), goredis.Z{Score: toScore(createdTime), Member: id})
+			}
+
+			// If continue-as-new, delete all existing history
+			if wi.State.ContinuedAsNew() {
+				pipe.Del(ctx, be.historyKey(id))
+			}
+			if lastActions != nil {
+				pipe.Set(ctx, be.lastActionsKey(id), lastActions, 0)
+			}
+			if len(history) > 0 {
+				pipe.RPush(ctx, be.historyKey(id), history...)
+			}
+
+			// Delete inbound events
+			if len(lockedEvents) > 0 {
+				pipe.HDel(ctx, be.eventsKey(id), lockedEvents...)
+				pipe.ZRem(ctx, be.eventTimesKey(id), toMembers(lockedEvents)...)
+				pipe.HDel(ctx, be.dequeueCountsKey(id), lockedEvents...)
+			}
+		})
+		if wi.State.ContinuedAsNew() {
+			s.historyLength = 0
+		}
+		s.historyLength += int64(len(history))
+		for _, seq := range lockedEvents {
+			delete(s.eventTimes, seq)
+		}
+		s.lockedBy = ""
+		s.lockExpiration = 0
+		s.lockedEvents = nil
+		s.dirty = true
+
+		// Save outbound activity tasks
+		for _, e := range wi.State.PendingTasks() {
+			if err := q.addTask(ctx, id, e); err != nil {
+				return err
+			}
+		}
+
+		// Save outbound orchestrator events
+		for _, e := range wi.State.PendingTimers() {
+			if err := q.addEvent(ctx, id, e, e.GetTimerFired().GetFireAt().AsTime()); err != nil {
+				return err
+			}
+		}
+
+		for _, msg := range wi.State.PendingMessages() {
+			if es := msg.HistoryEvent.GetExecutionStarted(); es != nil {
+				// Need to create a new instance
+				if err := q.createInstance(ctx, msg.HistoryEvent); err != nil {
+					if err != backend.ErrDuplicateEvent {
+						return err
+					}
+					be.logger.Warnf(
+						"%v: dropping sub-orchestration creation event because an instance with the target ID (%v) already exists.",
+						wi.InstanceID,
+						es.OrchestrationInstance.InstanceId)
+				}
+				continue
+			}
+
+			if err := q.addEvent(ctx, msg.TargetInstanceID, msg.HistoryEvent, time.Time{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// AbandonOrchestrationWorkItem implements backend.Backend
+func (be *redisBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	return be.update(ctx, func(q *queueTx) error {
+		s, err := q.load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !s.exists() || s.lockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		lockedEvents := s.lockedEvents
+		var visibleTime float64
+		if delay := wi.GetAbandonDelay(); delay > 0 {
+			visibleTime = toScore(time.Now().UTC().Add(delay))
+		}
+
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.HDel(ctx, be.instanceKey(id), "LockedBy", "LockExpiration", "LockedEvents")
+			if visibleTime > 0 && len(lockedEvents) > 0 {
+				members := make([]goredis.Z, 0, len(lockedEvents))
+				for _, seq := range lockedEvents {
+					members = append(members, goredis.Z{Score: visibleTime, Member: seq})
+				}
+				pipe.ZAddXX(ctx, be.eventTimesKey(id), members...)
+			}
+		})
+		if visibleTime > 0 {
+			for _, seq := range lockedEvents {
+				if _, ok := s.eventTimes[seq]; ok {
+					s.eventTimes[seq] = visibleTime
+				}
+			}
+		}
+		s.lockedBy = ""
+		s.lockExpiration = 0
+		s.lockedEvents = nil
+		s.dirty = true
+		return nil
+	})
+}
+
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *redisBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	id := string(wi.InstanceID)
+	return be.update(ctx, func(q *queueTx) error {
+		s, err := q.load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !s.exists() || s.lockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		lockExpiration := toScore(time.Now().UTC().Add(be.options.OrchestrationLockTimeout))
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.HSet(ctx, be.instanceKey(id), "LockExpiration", strconv.FormatFloat(lockExpiration, 'f', -1, 64))
+		})
+		s.lockExpiration = lockExpiration
+		s.dirty = true
+		return nil
+	})
+}
+
+// GetActivityWorkItem implements backend.Backend
+func (be *redisBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	wi, err := be.lockNextActivityWorkItem(ctx)
+	if err == backend.ErrNoWorkItems && be.waitForWorkItems(ctx, be.activitySignals, be.tasksKey()) {
+		wi, err = be.lockNextActivityWorkItem(ctx)
+	}
+	return wi, err
+}
+
+func (be *redisBackend) lockNextActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	now := time.Now().UTC()
+	nowScore := toScore(now)
+
+	candidates, err := be.client.ZRangeByScore(ctx, be.tasksKey(), &goredis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(nowScore, 'f', -1, 64),
+		Count: maxWorkItemCandidates,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
+	}
+
+	for _, seq := range candidates {
+		var wi *backend.ActivityWorkItem
+		err := be.update(ctx, func(q *queueTx) error {
+			key := be.taskKey(seq)
+			if err := q.tx.Watch(ctx, key).Err(); err != nil {
+				return err
+			}
+			fields, err := q.tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read the activity work-item: %w", err)
+			}
+
+			// Another worker may have locked or completed the task since it was selected
+			if len(fields) == 0 {
+				return errNotAvailable
+			}
+			if lockExpiration, err := strconv.ParseFloat(fields["LockExpiration"], 64); err == nil && lockExpiration > nowScore {
+				return errNotAvailable
+			}
+
+			e, err := backend.UnmarshalHistoryEvent([]byte(fields["EventPayload"]))
+			if err != nil {
+				return err
+			}
+			sequenceNumber, err := strconv.ParseInt(seq, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid activity work-item sequence number '%s': %w", seq, err)
+			}
+
+			lockExpiration := toScore(now.Add(be.options.ActivityLockTimeout))
+			q.write(func(pipe goredis.Pipeliner) {
+				pipe.HSet(ctx, key, "LockedBy", be.workerName, "LockExpiration", strconv.FormatFloat(lockExpiration, 'f', -1, 64))
+				pipe.HIncrBy(ctx, key, "DequeueCount", 1)
+				pipe.ZAdd(ctx, be.tasksKey(), goredis.Z{Score: lockExpiration, Member: seq})
+			})
+
+			wi = &backend.ActivityWorkItem{
+				SequenceNumber: sequenceNumber,
+				InstanceID:     api.InstanceID(fields["InstanceID"]),
+				NewEvent:       e,
+				LockedBy:       be.workerName,
+			}
+			return nil
+		})
+		if err == errNotAvailable {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return wi, nil
+	}
+
+	// No new activity tasks to process
+	return nil, backend.ErrNoWorkItems
+}
+
+// CompleteActivityWorkItem implements backend.Backend
+func (be *redisBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	seq := formatSequenceNumber(wi.SequenceNumber)
+	return be.update(ctx, func(q *queueTx) error {
+		lockedBy, err := q.lockedTaskOwner(ctx, seq)
+		if err != nil {
+			return err
+		} else if lockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		if err := q.addEvent(ctx, string(wi.InstanceID), wi.Result, time.Time{}); err != nil {
+			return err
+		}
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.Del(ctx, be.taskKey(seq))
+			pipe.ZRem(ctx, be.tasksKey(), seq)
+			pipe.SRem(ctx, be.instanceTasksKey(string(wi.InstanceID)), seq)
+		})
+		return nil
+	})
+}
+
+// AbandonActivityWorkItem implements backend.Backend
+func (be *redisBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	seq := formatSequenceNumber(wi.SequenceNumber)
+	return be.update(ctx, func(q *queueTx) error {
+		lockedBy, err := q.lockedTaskOwner(ctx, seq)
+		if err != nil {
+			return err
+		} else if lockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.HDel(ctx, be.taskKey(seq), "LockedBy", "LockExpiration")
+			pipe.ZAdd(ctx, be.tasksKey(), goredis.Z{Score: 0, Member: seq})
+		})
+		q.signalActivities = true
+		return nil
+	})
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *redisBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	seq := formatSequenceNumber(wi.SequenceNumber)
+	return be.update(ctx, func(q *queueTx) error {
+		lockedBy, err := q.lockedTaskOwner(ctx, seq)
+		if err != nil {
+			return err
+		} else if lockedBy != wi.LockedBy {
+			return backend.ErrWorkItemLockLost
+		}
+
+		lockExpiration := toScore(time.Now().UTC().Add(be.options.ActivityLockTimeout))
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.HSet(ctx, be.taskKey(seq), "LockExpiration", strconv.FormatFloat(lockExpiration, 'f', -1, 64))
+			pipe.ZAdd(ctx, be.tasksKey(), goredis.Z{Score: lockExpiration, Member: seq})
+		})
+		return nil
+	})
+}
+
+// GetOrchestrationLastActions implements backend.Backend
+func (be *redisBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	var exists *goredis.IntCmd
+	var payload *goredis.StringCmd
+	if _, err := be.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		exists = pipe.Exists(ctx, be.instanceKey(string(iid)))
+		payload = pipe.Get(ctx, be.lastActionsKey(string(iid)))
+		return nil
+	}); err != nil && err != goredis.Nil {
+		return nil, fmt.Errorf("failed to read the last actions: %w", err)
+	}
+	if exists.Val() == 0 {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal([]byte(payload.Val()), res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
+// PurgeOrchestrationState implements backend.Backend
+func (be *redisBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	return be.update(ctx, func(q *queueTx) error {
+		s, err := q.load(ctx, string(id))
+		if err != nil {
+			return err
+		}
+		if !s.exists() {
+			return api.ErrInstanceNotFound
+		}
+		if !isCompletedStatus(s.runtimeStatus) {
+			return api.ErrNotCompleted
+		}
+
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.Del(ctx, be.instanceKey(string(id)), be.historyKey(string(id)), be.lastActionsKey(string(id)))
+			pipe.ZRem(ctx, be.instancesKey(), string(id))
+		})
+		s.runtimeStatus = ""
+		s.historyLength = 0
+		s.dirty = true
+		return nil
+	})
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *redisBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	if len(fromSequenceNumbers) == 0 {
+		return histories, nil
+	}
+
+	exists := make(map[api.InstanceID]*goredis.IntCmd, len(fromSequenceNumbers))
+	payloads := make(map[api.InstanceID]*goredis.StringSliceCmd, len(fromSequenceNumbers))
+	if _, err := be.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for iid, from := range fromSequenceNumbers {
+			exists[iid] = pipe.Exists(ctx, be.instanceKey(string(iid)))
+			payloads[iid] = pipe.LRange(ctx, be.historyKey(string(iid)), int64(from), -1)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read the histories: %w", err)
+	}
+
+	errs := make(map[api.InstanceID]error)
+	for iid := range fromSequenceNumbers {
+		if exists[iid].Val() == 0 {
+			errs[iid] = api.ErrInstanceNotFound
+			continue
+		}
+		events, err := unmarshalEvents(payloads[iid].Val())
+		if err != nil {
+			errs[iid] = err
+			continue
+		}
+		histories[iid] = events
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *redisBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.readAllInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string, len(instances))
+	for _, instance := range instances {
+		statuses[instance.id] = instance.fields["RuntimeStatus"]
+	}
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for _, instance := range instances {
+		parentID, ok := instance.fields["ParentInstanceID"]
+		if !ok || isCompletedStatus(instance.fields["RuntimeStatus"]) {
+			continue
+		}
+		if parentStatus, ok := statuses[parentID]; ok && !isCompletedStatus(parentStatus) {
+			continue
+		}
+
+		metadata, err := parseOrchestrationMetadata(instance.id, instance.fields)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *redisBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	instances, err := be.readAllInstances(ctx)
+	if err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].id < instances[j].id
+	})
+
+	pageSize := query.PageSizeOrDefault()
+	page := make([]*api.OrchestrationMetadata, 0)
+	for _, instance := range instances {
+		if instance.id <= query.ContinuationToken || !strings.HasPrefix(instance.id, query.InstanceIDPrefix) {
+			continue
+		}
+		if query.Name != "" && instance.fields["Name"] != query.Name {
+			continue
+		}
+		if len(query.RuntimeStatuses) > 0 {
+			matches := false
+			for _, status := range query.RuntimeStatuses {
+				if helpers.ToRuntimeStatusString(status) == instance.fields["RuntimeStatus"] {
+					matches = true
+					break
+				}
+			}
+			if !matches {
+				continue
+			}
+		}
+		if !query.CreatedFrom.IsZero() && instance.createdTime.Before(query.CreatedFrom) {
+			continue
+		}
+		if !query.CreatedTo.IsZero() && !instance.createdTime.Before(query.CreatedTo) {
+			continue
+		}
+
+		metadata, err := parseOrchestrationMetadata(instance.id, instance.fields)
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		page = append(page, metadata)
+		if len(page) > pageSize {
+			break
+		}
+	}
+	return backend.NewInstanceQueryResult(page, pageSize), nil
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *redisBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	id := string(iid)
+	var state *backend.OrchestrationInstanceState
+	for i := 0; i < maxTransactionAttempts; i++ {
+		// The set of pending tasks is watched so that the tasks can be read in the same snapshot as the rest
+		err := be.client.Watch(ctx, func(tx *goredis.Tx) error {
+			seqs, err := tx.SMembers(ctx, be.instanceTasksKey(id)).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read the pending tasks: %w", err)
+			}
+			sort.Strings(seqs)
+
+			var fields *goredis.MapStringStringCmd
+			var history *goredis.StringSliceCmd
+			var events *goredis.MapStringStringCmd
+			tasks := make([]*goredis.SliceCmd, 0, len(seqs))
+			if _, err := tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+				fields = pipe.HGetAll(ctx, be.instanceKey(id))
+				history = pipe.LRange(ctx, be.historyKey(id), 0, -1)
+				events = pipe.HGetAll(ctx, be.eventsKey(id))
+				for _, seq := range seqs {
+					tasks = append(tasks, pipe.HMGet(ctx, be.taskKey(seq), "EventPayload"))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if len(fields.Val()) == 0 {
+				return api.ErrInstanceNotFound
+			}
+			metadata, err := parseOrchestrationMetadata(id, fields.Val())
+			if err != nil {
+				return err
+			}
+			state = &backend.OrchestrationInstanceState{Metadata: metadata}
+
+			if state.History, err = unmarshalEvents(history.Val()); err != nil {
+				return fmt.Errorf("failed to read the history: %w", err)
+			}
+
+			eventSeqs := make([]string, 0, len(events.Val()))
+			for seq := range events.Val() {
+				eventSeqs = append(eventSeqs, seq)
+			}
+			sort.Strings(eventSeqs)
+			eventPayloads := make([]string, 0, len(eventSeqs))
+			for _, seq := range eventSeqs {
+				eventPayloads = append(eventPayloads, events.Val()[seq])
+			}
+			if state.PendingEvents, err = unmarshalEvents(eventPayloads); err != nil {
+				return fmt.Errorf("failed to read the pending events: %w", err)
+			}
+
+			taskPayloads := make([]string, 0, len(tasks))
+			for _, task := range tasks {
+				if payload, ok := task.Val()[0].(string); ok {
+					taskPayloads = append(taskPayloads, payload)
+				}
+			}
+			if state.PendingTasks, err = unmarshalEvents(taskPayloads); err != nil {
+				return fmt.Errorf("failed to read the pending tasks: %w", err)
+			}
+			return nil
+		}, be.instanceTasksKey(id))
+		if err != goredis.TxFailedErr {
+			return state, err
+		}
+	}
+	return nil, errTooManyConflicts
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *redisBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+	id := string(metadata.InstanceID)
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+
+	fields := map[string]interface{}{
+		"Name":            metadata.Name,
+		"Version":         startEvent.GetVersion().GetValue(),
+		"ExecutionID":     startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		"RuntimeStatus":   helpers.ToRuntimeStatusString(metadata.RuntimeStatus),
+		"CreatedTime":     formatTime(metadata.CreatedAt),
+		"LastUpdatedTime": formatTime(metadata.LastUpdatedAt),
+		"Input":           metadata.SerializedInput,
+		"Output":          metadata.SerializedOutput,
+		"CustomStatus":    metadata.SerializedCustomStatus,
+		"GenerationCount": metadata.GenerationCount,
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		fields["ParentInstanceID"] = parent.GetOrchestrationInstance().GetInstanceId()
+	}
+	if len(metadata.Tags) > 0 {
+		tags, err := helpers.MarshalTags(metadata.Tags)
+		if err != nil {
+			return fmt.Errorf("failed to marshal tags: %w", err)
+		}
+		fields["Tags"] = tags
+	}
+	if metadata.IsComplete() {
+		fields["CompletedTime"] = formatTime(metadata.LastUpdatedAt)
+	}
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		fields["FailureDetails"] = bytes
+	}
+
+	history := make([]interface{}, 0, len(state.History))
+	for _, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		history = append(history, eventPayload)
+	}
+
+	return be.update(ctx, func(q *queueTx) error {
+		s, err := q.load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if s.exists() {
+			return backend.ErrDuplicateEvent
+		}
+
+		q.write(func(pipe goredis.Pipeliner) {
+			pipe.HSet(ctx, be.instanceKey(id), fields)
+			pipe.ZAdd(ctx, be.instancesKey(), goredis.Z{Score: toScore(metadata.CreatedAt), Member: id})
+			if len(history) > 0 {
+				pipe.RPush(ctx, be.historyKey(id), history...)
+			}
+		})
+		s.runtimeStatus = helpers.ToRuntimeStatusString(metadata.RuntimeStatus)
+		s.historyLength = int64(len(history))
+		s.dirty = true
+
+		for _, e := range state.PendingEvents {
+			// Timers and scheduled starts must stay invisible to workers until they're due
+			var visibleTime time.Time
+			if tf := e.GetTimerFired(); tf != nil {
+				visibleTime = tf.GetFireAt().AsTime()
+			} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+				visibleTime = ts.AsTime()
+			}
+			if err := q.addEvent(ctx, id, e, visibleTime); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range state.PendingTasks {
+			if err := q.addTask(ctx, id, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetOrchestrationStats implements backend.Backend
+func (be *redisBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	instances, err := be.readAllInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	var durations []time.Duration
+	var total time.Duration
+	for _, instance := range instances {
+		if instance.fields["Name"] != name {
+			continue
+		}
+		if !instance.createdTime.Before(since) {
+			stats.Started++
+		}
+
+		runtimeStatus := instance.fields["RuntimeStatus"]
+		completedTime := instance.fields["CompletedTime"]
+		if (runtimeStatus != "COMPLETED" && runtimeStatus != "FAILED") || completedTime == "" {
+			continue
+		}
+		completedAt := parseTime(completedTime)
+		if completedAt.Before(since) {
+			continue
+		}
+		if runtimeStatus == "FAILED" {
+			stats.Failed++
+		} else {
+			stats.Completed++
+		}
+		d := completedAt.Sub(instance.createdTime)
+		durations = append(durations, d)
+		total += d
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
+// Start implements backend.Backend
+//
+// Start subscribes to the channel on which new work items are announced.
+func (be *redisBackend) Start(ctx context.Context) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+	if be.pubsub != nil {
+		return backend.ErrBackendAlreadyStarted
+	}
+
+	pubsub := be.client.Subscribe(ctx, be.signalChannel())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to the work item channel: %w", err)
+	}
+	be.pubsub = pubsub
+	atomic.StoreInt32(&be.listening, 1)
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			switch msg.Payload {
+			case orchestrationSignal:
+				notify(be.orchestrationSignals)
+			case activitySignal:
+				notify(be.activitySignals)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop implements backend.Backend
+func (be *redisBackend) Stop(context.Context) error {
+	atomic.StoreInt32(&be.listening, 0)
+	if be.pubsub == nil {
+		return nil
+	}
+
+	err := be.pubsub.Close()
+	be.pubsub = nil
+	return err
+}
+
+// waitForWorkItems waits until a new work item is announced, the next work item of the specified queue becomes
+// visible, or the poll timeout expires. It returns false without waiting if the backend isn't started.
+func (be *redisBackend) waitForWorkItems(ctx context.Context, signals <-chan struct{}, queueKey string) bool {
+	if atomic.LoadInt32(&be.listening) == 0 || be.options.PollTimeout <= 0 {
+		return false
+	}
+
+	// Don't wait past the time at which the next work item becomes visible, e.g. when a timer fires
+	timeout := be.options.PollTimeout
+	if next, err := be.client.ZRangeWithScores(ctx, queueKey, 0, 0).Result(); err == nil && len(next) > 0 {
+		if untilNext := time.Until(time.UnixMilli(int64(next[0].Score))); untilNext < timeout {
+			timeout = untilNext
+		}
+	}
+	if timeout <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-signals:
+		return true
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notify wakes up a fetch that's waiting on the specified channel, if any.
+func notify(signals chan<- struct{}) {
+	select {
+	case signals <- struct{}{}:
+	default:
+	}
+}
+
+// update runs fn in an optimistic transaction, and commits the writes that fn records if none of the keys that it
+// watched changed in the meantime. Otherwise, the transaction is retried. Workers that wait for new work items are
+// notified after the transaction commits.
+func (be *redisBackend) update(ctx context.Context, fn func(q *queueTx) error) error {
+	for i := 0; i < maxTransactionAttempts; i++ {
+		q := &queueTx{be: be, states: make(map[string]*queueState)}
+		err := be.client.Watch(ctx, func(tx *goredis.Tx) error {
+			q.tx = tx
+			if err := fn(q); err != nil {
+				return err
+			}
+			return q.commit(ctx)
+		})
+		if err == goredis.TxFailedErr {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if q.signalOrchestrations {
+			be.publish(ctx, orchestrationSignal)
+		}
+		if q.signalActivities {
+			be.publish(ctx, activitySignal)
+		}
+		return nil
+	}
+	return errTooManyConflicts
+}
+
+func (be *redisBackend) publish(ctx context.Context, signal string) {
+	if err := be.client.Publish(ctx, be.signalChannel(), signal).Err(); err != nil {
+		// Waiting workers will find the work item when their poll times out
+		be.logger.Warnf("failed to announce new %s work item: %v", signal, err)
+	}
+}
+
+// queueTx is an optimistic transaction that reads and updates the queues of orchestration instances. Reads are
+// executed immediately, after watching the keys that are read, and writes are recorded and committed atomically
+// by [redisBackend.update].
+type queueTx struct {
+	be     *redisBackend
+	tx     *goredis.Tx
+	states map[string]*queueState
+	writes []func(pipe goredis.Pipeliner)
+
+	signalOrchestrations bool
+	signalActivities     bool
+}
+
+// queueState is the state of an orchestration instance that determines whether, and when, it can be locked by a
+// worker.
+type queueState struct {
+	// runtimeStatus is empty if the instance doesn't exist
+	runtimeStatus  string
+	historyLength  int64
+	lockedBy       string
+	lockExpiration float64
+	lockedEvents   []string
+
+	// eventTimes contains the time at which each pending event becomes visible, by sequence number
+	eventTimes map[string]float64
+
+	dirty bool
+}
+
+func (s *queueState) exists() bool {
+	return s.runtimeStatus != ""
+}
+
+// readyTime returns the time at which the instance can be locked by a worker, or false if it has no pending events.
+func (s *queueState) readyTime() (float64, bool) {
+	if !s.exists() || len(s.eventTimes) == 0 {
+		return 0, false
+	}
+
+	first, last := math.Inf(1), math.Inf(-1)
+	for _, t := range s.eventTimes {
+		first = math.Min(first, t)
+		last = math.Max(last, t)
+	}
+
+	// Instances that haven't started yet and still have invisible events are waiting for their scheduled start
+	// time, so events raised to them in the meantime must wait as well.
+	readyTime := first
+	if s.historyLength == 0 {
+		readyTime = last
+	}
+	if s.lockedBy != "" && s.lockExpiration > readyTime {
+		readyTime = s.lockExpiration
+	}
+	return readyTime, true
+}
+
+// load watches and reads the queue state of an orchestration instance.
+func (q *queueTx) load(ctx context.Context, id string) (*queueState, error) {
+	if s, ok := q.states[id]; ok {
+		return s, nil
+	}
+
+	be := q.be
+	if err := q.tx.Watch(ctx, be.instanceKey(id), be.historyKey(id), be.eventTimesKey(id)).Err(); err != nil {
+		return nil, fmt.Errorf("failed to watch the instance: %w", err)
+	}
+
+	var fields *goredis.SliceCmd
+	var historyLength *goredis.IntCmd
+	var eventTimes *goredis.ZSliceCmd
+	if _, err := q.tx.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		fields = pipe.HMGet(ctx, be.instanceKey(id), "RuntimeStatus", "LockedBy", "LockExpiration", "LockedEvents")
+		historyLength = pipe.LLen(ctx, be.historyKey(id))
+		eventTimes = pipe.ZRangeWithScores(ctx, be.eventTimesKey(id), 0, -1)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read the instance: %w", err)
+	}
+
+	s := &queueState{
+		historyLength: historyLength.Val(),
+		eventTimes:    make(map[string]float64, len(eventTimes.Val())),
+	}
+	s.runtimeStatus, _ = fields.Val()[0].(string)
+	s.lockedBy, _ = fields.Val()[1].(string)
+	if lockExpiration, ok := fields.Val()[2].(string); ok {
+		s.lockExpiration, _ = strconv.ParseFloat(lockExpiration, 64)
+	}
+	if lockedEvents, ok := fields.Val()[3].(string); ok && lockedEvents != "" {
+		s.lockedEvents = strings.Split(lockedEvents, ",")
+	}
+	for _, z := range eventTimes.Val() {
+		s.eventTimes[z.Member.(string)] = z.Score
+	}
+
+	q.states[id] = s
+	return s, nil
+}
+
+// write records a write that's committed with the transaction.
+func (q *queueTx) write(w func(pipe goredis.Pipeliner)) {
+	q.writes = append(q.writes, w)
+}
+
+// commit atomically executes the recorded writes and updates the times at which the updated instances are ready to
+// be locked.
+func (q *queueTx) commit(ctx context.Context) error {
+	now := toScore(time.Now().UTC())
+	_, err := q.tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for _, w := range q.writes {
+			w(pipe)
+		}
+		for id, s := range q.states {
+			if !s.dirty {
+				continue
+			}
+			if readyTime, ok := s.readyTime(); ok {
+				pipe.ZAdd(ctx, q.be.readyKey(), goredis.Z{Score: readyTime, Member: id})
+				if readyTime <= now {
+					q.signalOrchestrations = true
+				}
+			} else {
+				pipe.ZRem(ctx, q.be.readyKey(), id)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// nextSequenceNumber returns a new sequence number for an event or activity task. Sequence numbers are formatted
+// so that their lexicographic order is their numeric order.
+func (q *queueTx) nextSequenceNumber(ctx context.Context) (string, error) {
+	seq, err := q.tx.Incr(ctx, q.be.sequenceNumberKey()).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate a sequence number: %w", err)
+	}
+	return formatSequenceNumber(seq), nil
+}
+
+// createInstance creates an orchestration instance and adds its ExecutionStarted event.
+func (q *queueTx) createInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	startEvent := e.GetExecutionStarted()
+	if startEvent == nil {
+		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
+	}
+
+	id := startEvent.OrchestrationInstance.InstanceId
+	s, err := q.load(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// TODO: Support for re-using orchestration instance IDs
+	if s.exists() {
+		return backend.ErrDuplicateEvent
+	}
+
+	createdTime := e.Timestamp.AsTime()
+	fields := map[string]interface{}{
+		"Name":            startEvent.Name,
+		"Version":         startEvent.Version.GetValue(),
+		"ExecutionID":     startEvent.OrchestrationInstance.ExecutionId.GetValue(),
+		"Input":           startEvent.Input.GetValue(),
+		"RuntimeStatus":   "PENDING",
+		"CreatedTime":     formatTime(createdTime),
+		"LastUpdatedTime": formatTime(time.Now().UTC()),
+		"GenerationCount": 0,
+	}
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		fields["ParentInstanceID"] = parent.GetOrchestrationInstance().InstanceId
+	}
+	if tags := helpers.GetTags(startEvent); len(tags) > 0 {
+		serialized, err := helpers.MarshalTags(tags)
+		if err != nil {
+			return fmt.Errorf("failed to marshal tags: %w", err)
+		}
+		fields["Tags"] = serialized
+	}
+
+	q.write(func(pipe goredis.Pipeliner) {
+		pipe.HSet(ctx, q.be.instanceKey(id), fields)
+		pipe.ZAdd(ctx, q.be.instancesKey(), goredis.Z{Score: toScore(createdTime), Member: id})
+	})
+	s.runtimeStatus = "PENDING"
+	s.dirty = true
+
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime time.Time
+	if ts := startEvent.GetScheduledStartTimestamp(); ts != nil {
+		visibleTime = ts.AsTime()
+	}
+	return q.addEvent(ctx, id, e, visibleTime)
+}
+
+// addEvent adds a new event to the queue of an orchestration instance. The event stays invisible to workers until
+// visibleTime, unless it's zero.
+func (q *queueTx) addEvent(ctx context.Context, id string, e *backend.HistoryEvent, visibleTime time.Time) error {
+	s, err := q.load(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+	seq, err := q.nextSequenceNumber(ctx)
+	if err != nil {
+		return err
+	}
+
+	score := float64(0)
+	if !visibleTime.IsZero() {
+		score = toScore(visibleTime)
+	}
+	q.write(func(pipe goredis.Pipeliner) {
+		pipe.HSet(ctx, q.be.eventsKey(id), seq, eventPayload)
+		pipe.ZAdd(ctx, q.be.eventTimesKey(id), goredis.Z{Score: score, Member: seq})
+	})
+	s.eventTimes[seq] = score
+	s.dirty = true
+	return nil
+}
+
+// addTask adds a new activity task that's scheduled by an orchestration instance.
+func (q *queueTx) addTask(ctx context.Context, id string, e *backend.HistoryEvent) error {
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+	seq, err := q.nextSequenceNumber(ctx)
+	if err != nil {
+		return err
+	}
+
+	q.write(func(pipe goredis.Pipeliner) {
+		pipe.HSet(ctx, q.be.taskKey(seq), "InstanceID", id, "EventPayload", eventPayload, "DequeueCount", 0)
+		pipe.ZAdd(ctx, q.be.tasksKey(), goredis.Z{Score: 0, Member: seq})
+		pipe.SAdd(ctx, q.be.instanceTasksKey(id), seq)
+	})
+	q.signalActivities = true
+	return nil
+}
+
+// lockedTaskOwner watches an activity task and returns the name of the worker that locked it, or an empty string
+// if it isn't locked or doesn't exist.
+func (q *queueTx) lockedTaskOwner(ctx context.Context, seq string) (string, error) {
+	key := q.be.taskKey(seq)
+	if err := q.tx.Watch(ctx, key).Err(); err != nil {
+		return "", fmt.Errorf("failed to watch the activity task: %w", err)
+	}
+	lockedBy, err := q.tx.HGet(ctx, key, "LockedBy").Result()
+	if err == goredis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read the activity task: %w", err)
+	}
+	return lockedBy, nil
+}
+
+// instanceRecord is the saved state of an orchestration instance, as read by the queries that scan all instances.
+type instanceRecord struct {
+	id          string
+	createdTime time.Time
+	fields      map[string]string
+}
+
+// readAllInstances reads the state of all orchestration instances, in the order in which they were created.
+func (be *redisBackend) readAllInstances(ctx context.Context) ([]*instanceRecord, error) {
+	ids, err := be.client.ZRange(ctx, be.instancesKey(), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the instances: %w", err)
+	}
+
+	cmds := make([]*goredis.MapStringStringCmd, len(ids))
+	if _, err := be.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, be.instanceKey(id))
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read the instances: %w", err)
+	}
+
+	instances := make([]*instanceRecord, 0, len(ids))
+	for i, id := range ids {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			// Purged in the meantime
+			continue
+		}
+		instances = append(instances, &instanceRecord{id: id, createdTime: parseTime(fields["CreatedTime"]), fields: fields})
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		if !instances[i].createdTime.Equal(instances[j].createdTime) {
+			return instances[i].createdTime.Before(instances[j].createdTime)
+		}
+		return instances[i].id < instances[j].id
+	})
+	return instances, nil
+}
+
+func (be *redisBackend) ensureDB() error {
+	if be.client == nil {
+		return backend.ErrNotInitialized
+	}
+	return nil
+}
+
+func (be *redisBackend) String() string {
+	return fmt.Sprintf("redis::%s", be.options.Address)
+}
+
+func (be *redisBackend) key(parts ...string) string {
+	return be.options.KeyPrefix + ":" + strings.Join(parts, ":")
+}
+
+func (be *redisBackend) taskHubKey() string             { return be.key("taskhub") }
+func (be *redisBackend) sequenceNumberKey() string      { return be.key("seq") }
+func (be *redisBackend) signalChannel() string          { return be.key("signal") }
+func (be *redisBackend) instancesKey() string           { return be.key("instances") }
+func (be *redisBackend) readyKey() string               { return be.key("ready") }
+func (be *redisBackend) tasksKey() string               { return be.key("tasks") }
+func (be *redisBackend) taskKey(seq string) string      { return be.key("task", seq) }
+func (be *redisBackend) instanceKey(id string) string   { return be.key("instance", id) }
+func (be *redisBackend) historyKey(id string) string    { return be.key("history", id) }
+func (be *redisBackend) eventsKey(id string) string     { return be.key("events", id) }
+func (be *redisBackend) eventTimesKey(id string) string { return be.key("eventtimes", id) }
+func (be *redisBackend) lastActionsKey(id string) string {
+	return be.key("lastactions", id)
+}
+func (be *redisBackend) dequeueCountsKey(id string) string {
+	return be.key("dequeuecounts", id)
+}
+func (be *redisBackend) instanceTasksKey(id string) string {
+	return be.key("instancetasks", id)
+}
+
+func isCompletedStatus(runtimeStatus string) bool {
+	return runtimeStatus == "COMPLETED" || runtimeStatus == "FAILED" || runtimeStatus == "TERMINATED"
+}
+
+func unmarshalEvents(payloads []string) ([]*backend.HistoryEvent, error) {
+	events := make([]*backend.HistoryEvent, 0, len(payloads))
+	for _, payload := range payloads {
+		e, err := backend.UnmarshalHistoryEvent([]byte(payload))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func formatSequenceNumber(seq int64) string {
+	return fmt.Sprintf("%019d", seq)
+}
+
+// toScore converts a time to a sorted set score, in milliseconds.
+func toScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func parseTime(s string) time.Time {
+	nanos, _ := strconv.ParseInt(s, 10, 64)
+	return time.Unix(0, nanos).UTC()
+}
+
+func toMembers(values []string) []interface{} {
+	members := make([]interface{}, len(values))
+	for i, v := range values {
+		members[i] = v
+	}
+	return members
+}
+
+// escapePattern escapes the special characters of a key pattern.
+func escapePattern(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,30 @@
+package redis
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+// The "redis" scheme connects to a Redis server, e.g. "redis://:password@localhost:6379/0", where the optional
+// path is the number of the database.
+func init() {
+	backend.Register("redis", func(u *url.URL, logger backend.Logger) (backend.Backend, error) {
+		options := NewRedisOptions(u.Host)
+		if u.User != nil {
+			options.Username = u.User.Username()
+			options.Password, _ = u.User.Password()
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			n, err := strconv.Atoi(db)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Redis database number %q: %w", db, err)
+			}
+			options.DB = n
+		}
+		return NewRedisBackend(options, logger), nil
+	})
+}
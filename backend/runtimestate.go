@@ -3,8 +3,10 @@ package backend
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
@@ -13,7 +15,14 @@ import (
 	"github.com/microsoft/durabletask-go/internal/protos"
 )
 
-var ErrDuplicateEvent = errors.New("duplicate event")
+var (
+	ErrDuplicateEvent       = errors.New("duplicate event")
+	ErrSuspensionBufferFull = errors.New("the event buffer of the suspended orchestration is full")
+
+	// ErrInvalidOrchestrationState indicates that the saved state of an orchestration is corrupted, e.g. because
+	// its history doesn't start with an ExecutionStarted event.
+	ErrInvalidOrchestrationState = errors.New("orchestration state is invalid")
+)
 
 type OrchestrationRuntimeState struct {
 	instanceID      api.InstanceID
@@ -31,7 +40,31 @@ type OrchestrationRuntimeState struct {
 	continuedAsNew  bool
 	isSuspended     bool
 
+	// continuedAsNewCount is the number of times the orchestration continued-as-new in the current work item
+	continuedAsNewCount int
+
+	// suspendedEventCount and suspendedEventBytes track the external events that were raised while suspended
+	suspendedEventCount int
+	suspendedEventBytes int
+
+	// subOrchestrations maps the task IDs of sub-orchestrations to their instance IDs
+	subOrchestrations map[int32]api.InstanceID
+
+	// pendingFaults are the injected faults that haven't been applied yet, in the order they were injected
+	pendingFaults []injectedFault
+
+	// orderedEvents is the most recently recorded event sequencing state, or nil if none was recorded
+	orderedEvents *orderedEventsState
+
+	// now is the time of the current work item, as reported by the worker's timestamp source. It's used for the
+	// events that the orchestration creates itself, e.g. when applying actions. The local clock is used if it's zero.
+	now time.Time
+
 	CustomStatus *wrapperspb.StringValue
+
+	// LastActions are the actions returned by the most recent orchestrator execution. It's only populated
+	// when the orchestration worker is configured to persist them.
+	LastActions []*protos.OrchestratorAction
 }
 
 type OrchestratorMessage struct {
@@ -73,8 +106,31 @@ func (s *OrchestrationRuntimeState) addEvent(e *HistoryEvent, isNew bool) error
 		s.completedTime = e.Timestamp.AsTime()
 	} else if e.GetExecutionSuspended() != nil {
 		s.isSuspended = true
+		s.suspendedEventCount = 0
+		s.suspendedEventBytes = 0
 	} else if e.GetExecutionResumed() != nil {
 		s.isSuspended = false
+		s.suspendedEventCount = 0
+		s.suspendedEventBytes = 0
+	} else if s.isSuspended && e.GetEventRaised() != nil {
+		s.suspendedEventCount++
+		s.suspendedEventBytes += proto.Size(e)
+	} else if created := e.GetSubOrchestrationInstanceCreated(); created != nil {
+		if s.subOrchestrations == nil {
+			s.subOrchestrations = make(map[int32]api.InstanceID)
+		}
+		s.subOrchestrations[e.EventId] = api.InstanceID(created.InstanceId)
+	} else if fault, ok := getInjectedFault(e); ok {
+		s.pendingFaults = append(s.pendingFaults, fault)
+	} else if state, ok := getOrderedEventsState(e); ok {
+		s.orderedEvents = state
+	} else if id, ok := getAppliedFaultID(e); ok {
+		for i, fault := range s.pendingFaults {
+			if fault.ID == id {
+				s.pendingFaults = append(s.pendingFaults[:i:i], s.pendingFaults[i+1:]...)
+				break
+			}
+		}
 	} else {
 		// TODO: Check for other possible duplicates using task IDs
 	}
@@ -107,34 +163,51 @@ func (s *OrchestrationRuntimeState) ApplyActions(actions []*protos.OrchestratorA
 			if completedAction.OrchestrationStatus == protos.OrchestrationStatus_ORCHESTRATION_STATUS_CONTINUED_AS_NEW {
 				newState := NewOrchestrationRuntimeState(s.instanceID, []*protos.HistoryEvent{})
 				newState.continuedAsNew = true
-				newState.AddEvent(helpers.NewOrchestratorStartedEvent())
+				newState.continuedAsNewCount = s.continuedAsNewCount
+				newState.now = s.now
+				newState.AddEvent(s.stamp(helpers.NewOrchestratorStartedEvent()))
 
 				// Duplicate the start event info, updating just the input
-				newState.AddEvent(
-					helpers.NewExecutionStartedEvent(
-						s.startEvent.Name,
-						string(s.instanceID),
-						completedAction.Result,
-						s.startEvent.ParentInstance,
-						s.startEvent.ParentTraceContext,
-					),
-				)
+				startEvent := s.stamp(helpers.NewExecutionStartedEvent(
+					s.startEvent.Name,
+					string(s.instanceID),
+					completedAction.Result,
+					s.startEvent.ParentInstance,
+					s.startEvent.ParentTraceContext,
+					nil,
+				))
+				startEvent.GetExecutionStarted().Version = s.startEvent.Version
+				helpers.SetTags(startEvent.GetExecutionStarted(), helpers.GetTags(s.startEvent))
+				// The timeout timer was scheduled by the first generation, so the timeout isn't reset
+				helpers.SetOrchestrationTimeout(startEvent.GetExecutionStarted(), helpers.GetOrchestrationTimeout(s.startEvent))
+				newState.AddEvent(startEvent)
 
 				// Unprocessed "carryover" events
 				for _, e := range completedAction.CarryoverEvents {
 					newState.AddEvent(e)
 				}
 
+				// The event sequencing state, including any buffered events, carries over to the new generation
+				if s.orderedEvents != nil {
+					if e, err := newOrderedEventsStateEvent(s.orderedEvents); err == nil {
+						newState.AddEvent(s.stamp(e))
+					}
+				}
+
+				// Messages sent to other orchestrations before continuing as new, e.g. to start detached
+				// orchestrations, are still delivered
+				newState.pendingMessages = s.pendingMessages
+
 				// Overwrite the current state object with a new one
 				*s = *newState
 
 				// ignore all remaining actions
 				return true, nil
 			} else {
-				s.AddEvent(helpers.NewExecutionCompletedEvent(action.Id, completedAction.OrchestrationStatus, completedAction.Result, completedAction.FailureDetails))
+				s.AddEvent(s.stamp(helpers.NewExecutionCompletedEvent(action.Id, completedAction.OrchestrationStatus, completedAction.Result, completedAction.FailureDetails)))
 				if s.startEvent.GetParentInstance() != nil {
 					msg := OrchestratorMessage{
-						HistoryEvent:     &protos.HistoryEvent{EventId: -1, Timestamp: timestamppb.Now()},
+						HistoryEvent:     &protos.HistoryEvent{EventId: -1, Timestamp: s.timestamp()},
 						TargetInstanceID: s.startEvent.GetParentInstance().OrchestrationInstance.GetInstanceId(),
 					}
 					if completedAction.OrchestrationStatus == protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED {
@@ -157,16 +230,18 @@ func (s *OrchestrationRuntimeState) ApplyActions(actions []*protos.OrchestratorA
 				}
 			}
 		} else if createtimer := action.GetCreateTimer(); createtimer != nil {
-			s.AddEvent(helpers.NewTimerCreatedEvent(action.Id, createtimer.FireAt))
-			s.pendingTimers = append(s.pendingTimers, helpers.NewTimerFiredEvent(action.Id, createtimer.FireAt, currentTraceContext))
+			s.AddEvent(s.stamp(helpers.NewTimerCreatedEvent(action.Id, createtimer.FireAt)))
+			s.pendingTimers = append(s.pendingTimers, s.stamp(helpers.NewTimerFiredEvent(action.Id, createtimer.FireAt, currentTraceContext)))
 		} else if scheduleTask := action.GetScheduleTask(); scheduleTask != nil {
-			scheduledEvent := helpers.NewTaskScheduledEvent(
+			scheduledEvent := s.stamp(helpers.NewTaskScheduledEvent(
 				action.Id,
 				scheduleTask.Name,
 				scheduleTask.Version,
 				scheduleTask.Input,
 				currentTraceContext,
-			)
+			))
+			helpers.SetActivityTimeout(scheduledEvent.GetTaskScheduled(), helpers.GetActivityTimeout(scheduleTask))
+			helpers.SetActivityQueue(scheduledEvent.GetTaskScheduled(), helpers.GetActivityQueue(scheduleTask))
 			s.AddEvent(scheduledEvent)
 			s.pendingTasks = append(s.pendingTasks, scheduledEvent)
 		} else if createSO := action.GetCreateSubOrchestration(); createSO != nil {
@@ -175,30 +250,55 @@ func (s *OrchestrationRuntimeState) ApplyActions(actions []*protos.OrchestratorA
 			if createSO.InstanceId == "" {
 				createSO.InstanceId = fmt.Sprintf("%s:%04x", s.instanceID, action.Id)
 			}
-			s.AddEvent(helpers.NewSubOrchestrationCreatedEvent(
+			s.AddEvent(s.stamp(helpers.NewSubOrchestrationCreatedEvent(
 				action.Id,
 				createSO.Name,
 				createSO.Version,
 				createSO.Input,
 				createSO.InstanceId,
-				currentTraceContext))
-			startEvent := helpers.NewExecutionStartedEvent(
+				currentTraceContext)))
+			startEvent := s.stamp(helpers.NewExecutionStartedEvent(
 				createSO.Name,
 				createSO.InstanceId,
 				createSO.Input,
 				helpers.NewParentInfo(action.Id, s.startEvent.Name, string(s.instanceID)),
 				currentTraceContext,
-			)
+				nil,
+			))
+			startEvent.GetExecutionStarted().Version = createSO.Version
 			s.pendingMessages = append(s.pendingMessages, OrchestratorMessage{HistoryEvent: startEvent, TargetInstanceID: createSO.InstanceId})
 		} else if sendEvent := action.GetSendEvent(); sendEvent != nil {
-			e := helpers.NewSendEventEvent(action.Id, sendEvent.Instance.InstanceId, sendEvent.Name, sendEvent.Data)
+			if isSideEffect, _ := helpers.IsSideEffect(sendEvent); isSideEffect {
+				// Side effects are only recorded in the history
+				e := s.stamp(helpers.NewSendEventEvent(action.Id, "", sendEvent.Name, sendEvent.Data))
+				helpers.SetSentEventKind(e.GetEventSent(), helpers.GetSentEventKind(sendEvent))
+				s.AddEvent(e)
+				continue
+			}
+			detached := helpers.IsStartDetachedOrchestration(sendEvent)
+			if detached && sendEvent.Instance.InstanceId == "" {
+				// Same deterministic instance ID as sub-orchestrations
+				sendEvent.Instance.InstanceId = fmt.Sprintf("%s:%04x", s.instanceID, action.Id)
+			}
+			e := s.stamp(helpers.NewSendEventEvent(action.Id, sendEvent.Instance.InstanceId, sendEvent.Name, sendEvent.Data))
+			helpers.SetSentEventKind(e.GetEventSent(), helpers.GetSentEventKind(sendEvent))
+			helpers.SetDetachedOrchestrationVersion(e.GetEventSent(), helpers.GetDetachedOrchestrationVersion(sendEvent))
 			s.AddEvent(e)
-			s.pendingMessages = append(s.pendingMessages, OrchestratorMessage{HistoryEvent: e, TargetInstanceID: sendEvent.Instance.InstanceId})
+			if detached {
+				// Detached orchestrations are started without a parent, so they never report back to this orchestration
+				startEvent := s.stamp(helpers.NewExecutionStartedEvent(sendEvent.Name, sendEvent.Instance.InstanceId, sendEvent.Data, nil, currentTraceContext, nil))
+				if version := helpers.GetDetachedOrchestrationVersion(sendEvent); version != "" {
+					startEvent.GetExecutionStarted().Version = wrapperspb.String(version)
+				}
+				s.pendingMessages = append(s.pendingMessages, OrchestratorMessage{HistoryEvent: startEvent, TargetInstanceID: sendEvent.Instance.InstanceId})
+			} else {
+				s.pendingMessages = append(s.pendingMessages, OrchestratorMessage{HistoryEvent: e, TargetInstanceID: sendEvent.Instance.InstanceId})
+			}
 		} else if terminate := action.GetTerminateOrchestration(); terminate != nil {
 			// Send a message to terminate the target orchestration
 			msg := OrchestratorMessage{
 				TargetInstanceID: terminate.InstanceId,
-				HistoryEvent:     helpers.NewExecutionTerminatedEvent(terminate.Reason, terminate.Recurse),
+				HistoryEvent:     s.stamp(helpers.NewExecutionTerminatedEvent(terminate.Reason, terminate.Recurse)),
 			}
 			s.pendingMessages = append(s.pendingMessages, msg)
 		} else {
@@ -209,6 +309,20 @@ func (s *OrchestrationRuntimeState) ApplyActions(actions []*protos.OrchestratorA
 	return false, nil
 }
 
+// timestamp returns the timestamp for the events that the orchestration creates itself.
+func (s *OrchestrationRuntimeState) timestamp() *timestamppb.Timestamp {
+	if s.now.IsZero() {
+		return timestamppb.Now()
+	}
+	return timestamppb.New(s.now)
+}
+
+// stamp sets the timestamp of an event that the orchestration creates itself, and returns the event.
+func (s *OrchestrationRuntimeState) stamp(e *HistoryEvent) *HistoryEvent {
+	e.Timestamp = s.timestamp()
+	return e
+}
+
 func (s *OrchestrationRuntimeState) InstanceID() api.InstanceID {
 	return s.instanceID
 }
@@ -221,6 +335,15 @@ func (s *OrchestrationRuntimeState) Name() (string, error) {
 	return s.startEvent.Name, nil
 }
 
+// Tags returns the tags that the orchestration was created with, or nil if it doesn't have any tags.
+func (s *OrchestrationRuntimeState) Tags() (map[string]string, error) {
+	if s.startEvent == nil {
+		return nil, api.ErrNotStarted
+	}
+
+	return helpers.GetTags(s.startEvent), nil
+}
+
 func (s *OrchestrationRuntimeState) Input() (string, error) {
 	if s.startEvent == nil {
 		return "", api.ErrNotStarted
@@ -240,12 +363,14 @@ func (s *OrchestrationRuntimeState) Output() (string, error) {
 }
 
 func (s *OrchestrationRuntimeState) RuntimeStatus() protos.OrchestrationStatus {
-	if s.startEvent == nil {
+	if s.completedEvent != nil {
+		// Completion, e.g. termination, takes precedence over suspension. Orchestrations with an invalid state can
+		// also be completed without ever having started.
+		return s.completedEvent.GetOrchestrationStatus()
+	} else if s.startEvent == nil {
 		return protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING
 	} else if s.isSuspended {
 		return protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED
-	} else if s.completedEvent != nil {
-		return s.completedEvent.GetOrchestrationStatus()
 	}
 
 	return protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING
@@ -275,6 +400,103 @@ func (s *OrchestrationRuntimeState) CompletedTime() (time.Time, error) {
 	return s.completedTime, nil
 }
 
+// IsSuspended returns true if the orchestration is currently suspended.
+func (s *OrchestrationRuntimeState) IsSuspended() bool {
+	return s.isSuspended
+}
+
+// SuspendedEvents returns the number of external events, and their total size in bytes, that were raised to the
+// orchestration since it was suspended. These events are buffered until the orchestration is resumed.
+func (s *OrchestrationRuntimeState) SuspendedEvents() (count int, bytes int) {
+	return s.suspendedEventCount, s.suspendedEventBytes
+}
+
+// exceedsSuspensionBuffer returns true if adding the specified event to the orchestration would exceed the specified
+// limits of the events buffered while it's suspended. Limits of zero or less are disabled. Only external events are
+// subject to these limits, since dropping internal events, like task completions or timers, would leave the
+// orchestration stuck.
+func (s *OrchestrationRuntimeState) exceedsSuspensionBuffer(e *HistoryEvent, maxEvents int, maxBytes int) bool {
+	if !s.isSuspended || e.GetEventRaised() == nil {
+		return false
+	}
+
+	if maxEvents > 0 && s.suspendedEventCount+1 > maxEvents {
+		return true
+	}
+	if maxBytes > 0 && s.suspendedEventBytes+proto.Size(e) > maxBytes {
+		return true
+	}
+	return false
+}
+
+// pendingFault returns the oldest injected fault of the specified type that hasn't been applied yet. For
+// [api.FaultDropNextEvent], only faults that match the specified event name are considered.
+func (s *OrchestrationRuntimeState) pendingFault(faultType api.FaultType, eventName string) (injectedFault, bool) {
+	for _, fault := range s.pendingFaults {
+		if fault.Type != faultType {
+			continue
+		}
+		if faultType == api.FaultDropNextEvent && fault.EventName != "" && !strings.EqualFold(fault.EventName, eventName) {
+			continue
+		}
+		return fault, true
+	}
+	return injectedFault{}, false
+}
+
+// SubOrchestrationInstanceIDs returns the instance IDs of all the sub-orchestrations created by the orchestration.
+func (s *OrchestrationRuntimeState) SubOrchestrationInstanceIDs() []api.InstanceID {
+	ids := make([]api.InstanceID, 0, len(s.subOrchestrations))
+	for _, id := range s.subOrchestrations {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// SubOrchestrationInstanceID returns the instance ID of the sub-orchestration that was scheduled with the specified task ID.
+func (s *OrchestrationRuntimeState) SubOrchestrationInstanceID(taskID int32) (api.InstanceID, bool) {
+	id, ok := s.subOrchestrations[taskID]
+	return id, ok
+}
+
+// ExecutionHistory returns the old and new history events that should be replayed by the orchestrator.
+//
+// This is the same as [OrchestrationRuntimeState.OldEvents] and [OrchestrationRuntimeState.NewEvents], except that
+// sub-orchestration failures that were superseded by a retry of the sub-orchestration are left out, so the
+// orchestrator keeps waiting for the outcome of the retried sub-orchestration.
+func (s *OrchestrationRuntimeState) ExecutionHistory() (oldEvents []*HistoryEvent, newEvents []*HistoryEvent) {
+	// Find the most recent failure of each retried sub-orchestration that precedes its retry
+	var hidden map[*HistoryEvent]bool
+	lastFailure := make(map[int32]*HistoryEvent)
+	for _, events := range [][]*HistoryEvent{s.oldEvents, s.newEvents} {
+		for _, e := range events {
+			if failed := e.GetSubOrchestrationInstanceFailed(); failed != nil {
+				lastFailure[failed.TaskScheduledId] = e
+			} else if taskID, ok := helpers.GetSubOrchestrationRetriedTaskID(e); ok && lastFailure[taskID] != nil {
+				if hidden == nil {
+					hidden = make(map[*HistoryEvent]bool)
+				}
+				hidden[lastFailure[taskID]] = true
+				delete(lastFailure, taskID)
+			}
+		}
+	}
+	if hidden == nil {
+		return s.oldEvents, s.newEvents
+	}
+
+	filter := func(events []*HistoryEvent) []*HistoryEvent {
+		filtered := make([]*HistoryEvent, 0, len(events))
+		for _, e := range events {
+			if !hidden[e] {
+				filtered = append(filtered, e)
+			}
+		}
+		return filtered
+	}
+	return filter(s.oldEvents), filter(s.newEvents)
+}
+
 func (s *OrchestrationRuntimeState) IsCompleted() bool {
 	return s.completedEvent != nil
 }
@@ -313,6 +535,12 @@ func (s *OrchestrationRuntimeState) ContinuedAsNew() bool {
 	return s.continuedAsNew
 }
 
+// ContinuedAsNewCount returns the number of times the orchestration continued-as-new while processing the current
+// work item. Backends add it to the persisted generation count of the orchestration.
+func (s *OrchestrationRuntimeState) ContinuedAsNewCount() int {
+	return s.continuedAsNewCount
+}
+
 func (s *OrchestrationRuntimeState) String() string {
 	return fmt.Sprintf("%v:%v", s.instanceID, helpers.ToRuntimeStatusString(s.RuntimeStatus()))
 }
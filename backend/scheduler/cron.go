@@ -0,0 +1,201 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression, which computes the times at which a schedule ticks.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// every is the interval of "@every" expressions, or zero for regular cron expressions
+	every time.Duration
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{name: "day of week", min: 0, max: 6, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression with the five standard fields: minute, hour, day of month, month, and day of
+// week. Fields can be "*", numbers, ranges like "1-5", lists like "1,15", and steps like "*/10" or "0-30/5". Months
+// and days of the week can also be specified with their three-letter English names, e.g. "jan" or "mon", and 7 is
+// accepted for Sunday. Like in most cron implementations, when both the day of month and the day of week are
+// restricted, the schedule ticks on the days that match either of them.
+//
+// The "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", and "@hourly" descriptors are also
+// supported, as well as "@every <duration>", e.g. "@every 90s", for schedules that tick at a fixed interval.
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		if every < time.Second {
+			return nil, fmt.Errorf("invalid cron expression %q: the interval must be at least one second", expr)
+		}
+		return &CronSchedule{every: every}, nil
+	}
+	if descriptor, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, found %d", expr, len(fields))
+	}
+	s := &CronSchedule{}
+	var err error
+	for i, target := range []struct {
+		field *cronField
+		bits  *uint64
+	}{{&minuteField, &s.minute}, {&hourField, &s.hour}, {&domField, &s.dom}, {&monthField, &s.month}, {&dowField, &s.dow}} {
+		if *target.bits, err = target.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+	}
+	return s, nil
+}
+
+// parse returns the bit set of the values that match the field expression.
+func (f *cronField) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepExpr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q for the %s field", stepExpr, f.name)
+			}
+		}
+
+		var lo, hi int
+		if rangeExpr == "*" {
+			lo, hi = f.min, f.max
+		} else if loExpr, hiExpr, isRange := strings.Cut(rangeExpr, "-"); isRange {
+			var err error
+			if lo, err = f.value(loExpr); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(hiExpr); err != nil {
+				return 0, err
+			}
+		} else {
+			var err error
+			if lo, err = f.value(rangeExpr); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if hasStep {
+				// "5/15" is the same as "5-max/15"
+				hi = f.max
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %q for the %s field", rangeExpr, f.name)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	if f == &dowField && bits&(1<<7) != 0 {
+		// Sunday can be specified as 7, which is the same as 0
+		bits = bits&^(1<<7) | 1
+	}
+	return bits, nil
+}
+
+func (f *cronField) value(expr string) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+	max := f.max
+	if f == &dowField {
+		max = 7
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil || v < f.min || v > max {
+		return 0, fmt.Errorf("invalid value %q for the %s field, which must be between %d and %d", expr, f.name, f.min, max)
+	}
+	return v, nil
+}
+
+// Next returns the first time after t at which the schedule ticks, in the location of t, or the zero time if the
+// schedule never ticks, e.g. for "0 0 30 2 *".
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every).Truncate(time.Second)
+	}
+
+	// Cron schedules have a granularity of one minute
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.dom == domField.all() || s.dow == dowField.all() {
+		// When either field is unrestricted, both must match
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// all returns the bit set of all the values of the field.
+func (f *cronField) all() uint64 {
+	var bits uint64
+	for v := f.min; v <= f.max; v++ {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
@@ -0,0 +1,270 @@
+// Package scheduler runs orchestrations on recurring cron schedules.
+//
+// Each schedule is an eternal orchestration, which is saved by the backend like any other orchestration: it waits
+// for the next tick of its cron expression using a durable timer, starts a new instance of the scheduled
+// orchestration, and continues as new. Schedules therefore survive process restarts, and don't require any support
+// from the backends. Workers that run schedules must register the scheduler orchestrator using
+// [AddToRegistry].
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+// OrchestratorName is the name of the orchestrator that runs schedules.
+const OrchestratorName = "durabletask.Schedule"
+
+// instanceIDPrefix is the prefix of the instance IDs of the orchestrations that run schedules.
+const instanceIDPrefix = "schedule:"
+
+// maxCatchUpRuns is the maximum number of missed runs that are started at once with [MissedRunAll].
+const maxCatchUpRuns = 100
+
+// MissedRunPolicy determines which runs are started for the ticks that were missed while the schedule couldn't run,
+// e.g. because no worker was running or because the schedule was paused.
+type MissedRunPolicy string
+
+const (
+	// MissedRunLatest starts a single run for all the missed ticks. This is the default policy.
+	MissedRunLatest MissedRunPolicy = "latest"
+
+	// MissedRunAll starts one run for each missed tick, up to 100 runs.
+	MissedRunAll MissedRunPolicy = "all"
+
+	// MissedRunSkip doesn't start any run for the missed ticks, and waits for the next tick.
+	MissedRunSkip MissedRunPolicy = "skip"
+)
+
+// Schedule describes a recurring orchestration.
+type Schedule struct {
+	// Cron is the cron expression of the schedule. See [ParseCron] for the supported syntax.
+	Cron string `json:"cron"`
+
+	// TimeZone is the name of the IANA time zone in which the cron expression is evaluated, e.g.
+	// "America/New_York", or empty for UTC.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Orchestrator is the name of the orchestrator that's started on each tick.
+	Orchestrator string `json:"orchestrator"`
+
+	// Input is the serialized input of the orchestrations that are started on each tick, if any.
+	Input string `json:"input,omitempty"`
+
+	// MissedRunPolicy determines which runs are started for missed ticks. Defaults to [MissedRunLatest].
+	MissedRunPolicy MissedRunPolicy `json:"missedRunPolicy,omitempty"`
+}
+
+// ScheduleMetadata describes the state of a schedule.
+type ScheduleMetadata struct {
+	ID       string
+	Schedule Schedule
+
+	// Paused is true if the schedule was paused using [PauseSchedule].
+	Paused bool
+
+	// LastRun is the tick of the last run that was started, or the zero time if no run was started yet.
+	LastRun time.Time
+
+	// NextRun is the next tick of the schedule.
+	NextRun time.Time
+}
+
+// scheduleState is the input of the scheduler orchestrator, which is carried over each time it continues as new.
+type scheduleState struct {
+	Schedule
+	LastRun time.Time `json:"lastRun,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// scheduleStatus is the custom status of the scheduler orchestrator.
+type scheduleStatus struct {
+	NextRun time.Time `json:"nextRun"`
+}
+
+func (s *Schedule) parse() (*CronSchedule, *time.Location, error) {
+	if s.Orchestrator == "" {
+		return nil, nil, errors.New("the schedule doesn't have an orchestrator")
+	}
+	switch s.MissedRunPolicy {
+	case "", MissedRunLatest, MissedRunAll, MissedRunSkip:
+	default:
+		return nil, nil, fmt.Errorf("unknown missed run policy %q", s.MissedRunPolicy)
+	}
+	cron, err := ParseCron(s.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid time zone: %w", err)
+	}
+	return cron, loc, nil
+}
+
+// AddToRegistry registers the orchestrator that runs schedules.
+func AddToRegistry(r *task.TaskRegistry) error {
+	return r.AddOrchestratorN(OrchestratorName, runSchedule)
+}
+
+// InstanceID returns the instance ID of the orchestration that runs the schedule with the specified ID.
+func InstanceID(id string) api.InstanceID {
+	return api.InstanceID(instanceIDPrefix + id)
+}
+
+// RunInstanceID returns the instance ID of the orchestration that's started for the specified tick of the schedule
+// with the specified ID. Run instance IDs are derived from the ticks so that runs aren't started twice for the same
+// tick.
+func RunInstanceID(id string, tick time.Time) api.InstanceID {
+	return api.InstanceID(fmt.Sprintf("%s@%s", InstanceID(id), tick.UTC().Format(time.RFC3339)))
+}
+
+func runSchedule(ctx *task.OrchestrationContext) (any, error) {
+	var state scheduleState
+	if err := ctx.GetInput(&state); err != nil {
+		return nil, err
+	}
+	id := strings.TrimPrefix(string(ctx.ID), instanceIDPrefix)
+	cron, loc, err := state.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	last := state.LastRun
+	if last.IsZero() {
+		last = state.Created
+		if last.IsZero() {
+			last = ctx.CurrentTimeUtc
+		}
+	}
+	next := cron.Next(last.In(loc))
+	if next.IsZero() {
+		return nil, fmt.Errorf("the cron expression %q never ticks", state.Cron)
+	}
+	if err := ctx.SetCustomStatus(scheduleStatus{NextRun: next.UTC()}); err != nil {
+		return nil, err
+	}
+	if err := ctx.CreateTimer(next.Sub(ctx.CurrentTimeUtc)).Await(nil); err != nil {
+		return nil, err
+	}
+
+	// The timer fires late when the schedule couldn't run in time, in which case later ticks may have been missed
+	ticks := []time.Time{next}
+	for t := cron.Next(next); !t.IsZero() && !t.After(ctx.CurrentTimeUtc); t = cron.Next(t) {
+		ticks = append(ticks, t)
+		if len(ticks) > maxCatchUpRuns {
+			ticks = ticks[1:]
+		}
+	}
+	last = ticks[len(ticks)-1]
+
+	switch state.MissedRunPolicy {
+	case MissedRunAll:
+	case MissedRunSkip:
+		if len(ticks) > 1 {
+			ticks = nil
+		}
+	default:
+		ticks = ticks[len(ticks)-1:]
+	}
+	for _, tick := range ticks {
+		run := ctx.CallSubOrchestrator(
+			state.Orchestrator,
+			task.WithDetachedSubOrchestration(),
+			task.WithSubOrchestrationInstanceID(string(RunInstanceID(id, tick))),
+			task.WithRawSubOrchestratorInput(state.Input))
+		if err := run.Await(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	state.LastRun = last.UTC()
+	ctx.ContinueAsNew(state)
+	return nil, nil
+}
+
+// CreateSchedule creates a schedule with the specified ID, which starts the scheduled orchestration on each tick of
+// its cron expression, starting with the first tick after now. It returns [backend.ErrDuplicateEvent] if a schedule
+// with the same ID already exists.
+func CreateSchedule(ctx context.Context, c backend.TaskHubClient, id string, schedule Schedule) error {
+	if id == "" {
+		return errors.New("the schedule ID must not be empty")
+	}
+	if _, _, err := schedule.parse(); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	state := scheduleState{Schedule: schedule, Created: time.Now().UTC()}
+	_, err := c.ScheduleNewOrchestration(ctx, OrchestratorName, api.WithInstanceID(InstanceID(id)), api.WithInput(state))
+	return err
+}
+
+// GetSchedule returns the state of the schedule with the specified ID, or [api.ErrInstanceNotFound] if there's no
+// such schedule.
+func GetSchedule(ctx context.Context, c backend.TaskHubClient, id string) (*ScheduleMetadata, error) {
+	metadata, err := c.FetchOrchestrationMetadata(ctx, InstanceID(id))
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Name != OrchestratorName {
+		return nil, api.ErrInstanceNotFound
+	}
+
+	var state scheduleState
+	if err := unmarshal(metadata.SerializedInput, &state); err != nil {
+		return nil, fmt.Errorf("failed to read the schedule: %w", err)
+	}
+	var status scheduleStatus
+	if err := unmarshal(metadata.SerializedCustomStatus, &status); err != nil {
+		return nil, fmt.Errorf("failed to read the status of the schedule: %w", err)
+	}
+	return &ScheduleMetadata{
+		ID:       id,
+		Schedule: state.Schedule,
+		Paused:   metadata.RuntimeStatus == protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED,
+		LastRun:  state.LastRun,
+		NextRun:  status.NextRun,
+	}, nil
+}
+
+// PauseSchedule pauses the schedule with the specified ID. Ticks that are missed while the schedule is paused are
+// handled according to its missed run policy when it's resumed.
+func PauseSchedule(ctx context.Context, c backend.TaskHubClient, id string) error {
+	return c.SuspendOrchestration(ctx, InstanceID(id), "schedule paused")
+}
+
+// ResumeSchedule resumes the schedule with the specified ID after it was paused using [PauseSchedule].
+func ResumeSchedule(ctx context.Context, c backend.TaskHubClient, id string) error {
+	return c.ResumeOrchestration(ctx, InstanceID(id), "schedule resumed")
+}
+
+// DeleteSchedule stops the schedule with the specified ID and deletes its state. Runs that were already started keep
+// running.
+func DeleteSchedule(ctx context.Context, c backend.TaskHubClient, id string) error {
+	iid := InstanceID(id)
+	if err := c.TerminateOrchestration(ctx, iid); err != nil {
+		return fmt.Errorf("failed to stop the schedule: %w", err)
+	}
+	if _, err := c.WaitForOrchestrationCompletion(ctx, iid); err != nil {
+		return fmt.Errorf("failed to stop the schedule: %w", err)
+	}
+	if _, err := c.PurgeOrchestrationState(ctx, iid); err != nil {
+		return fmt.Errorf("failed to delete the schedule: %w", err)
+	}
+	return nil
+}
+
+func unmarshal(data string, v any) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), v)
+}
@@ -0,0 +1,20 @@
+package sqlite
+
+import (
+	"net/url"
+
+	"github.com/microsoft/durabletask-go/backend"
+)
+
+// The "sqlite" scheme opens a database file, e.g. "sqlite:///var/lib/durabletask.db" for an absolute path or
+// "sqlite:durabletask.db" for a path that's relative to the working directory. "sqlite://" opens an in-memory
+// database.
+func init() {
+	backend.Register("sqlite", func(u *url.URL, logger backend.Logger) (backend.Backend, error) {
+		filePath := u.Opaque
+		if filePath == "" {
+			filePath = u.Host + u.Path
+		}
+		return NewSqliteBackend(NewSqliteOptions(filePath), logger), nil
+	})
+}
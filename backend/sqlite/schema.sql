@@ -13,7 +13,9 @@ CREATE TABLE IF NOT EXISTS Instances (
     [Output] TEXT NULL,
     [CustomStatus] TEXT NULL,
     [FailureDetails] BLOB NULL,
-    [ParentInstanceID] TEXT NULL
+    [ParentInstanceID] TEXT NULL,
+    [GenerationCount] INTEGER NOT NULL DEFAULT 0, -- the number of times the orchestration continued-as-new
+    [Tags] TEXT NULL -- the tags of the orchestration, as a JSON object (optional)
 );
 
 -- This index is used by LockNext and Purge logic
@@ -51,5 +53,22 @@ CREATE TABLE IF NOT EXISTS NewTasks (
     [DequeueCount] INTEGER NOT NULL DEFAULT 0,
     [LockedBy] TEXT NULL,
     [LockExpiration] DATETIME NULL,
+    [Name] TEXT NOT NULL DEFAULT '', -- the name of the activity
+    [Queue] TEXT NOT NULL DEFAULT '', -- the queue that the activity is routed to, empty for the default queue
     [EventPayload] BLOB NOT NULL
-);
\ No newline at end of file
+);
+CREATE TABLE IF NOT EXISTS LastActions (
+    [InstanceID] TEXT PRIMARY KEY NOT NULL,
+    [Payload] BLOB NOT NULL -- serialized OrchestratorResponse containing only the actions
+);
+
+CREATE TABLE IF NOT EXISTS DeadLetters (
+    [ID] INTEGER PRIMARY KEY,
+    [Kind] INTEGER NOT NULL, -- 0 for orchestration work items, 1 for activity work items
+    [InstanceID] TEXT NOT NULL,
+    [Queue] TEXT NOT NULL DEFAULT '', -- the queue of activity work items, empty for the default queue
+    [DeliveryCount] INTEGER NOT NULL,
+    [Reason] TEXT NOT NULL,
+    [Timestamp] DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    [Payload] BLOB NOT NULL -- serialized OrchestratorRequest containing only the new events
+);
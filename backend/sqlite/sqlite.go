@@ -6,7 +6,9 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,7 +19,8 @@ import (
 	"github.com/microsoft/durabletask-go/internal/protos"
 	"google.golang.org/protobuf/proto"
 
-	_ "modernc.org/sqlite"
+	sqlitedriver "modernc.org/sqlite"
+	sqlitelib "modernc.org/sqlite/lib"
 )
 
 //go:embed schema.sql
@@ -126,6 +129,18 @@ func (be *sqliteBackend) DeleteTaskHub(ctx context.Context) error {
 
 // AbandonOrchestrationWorkItem implements backend.Backend
 func (be *sqliteBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	return be.releaseOrchestrationWorkItem(ctx, wi, false, 0)
+}
+
+// DeferOrchestrationWorkItem implements backend.BackendWithDeferrals
+func (be *sqliteBackend) DeferOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem, delay time.Duration) error {
+	return be.releaseOrchestrationWorkItem(ctx, wi, true, delay)
+}
+
+// releaseOrchestrationWorkItem unlocks an orchestration work item. The new events of abandoned work items become
+// visible again after the abandon delay of the work item, while those of deferred work items become visible again
+// after the specified delay, and their delivery isn't counted.
+func (be *sqliteBackend) releaseOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem, deferred bool, delay time.Duration) error {
 	if err := be.ensureDB(); err != nil {
 		return err
 	}
@@ -136,16 +151,23 @@ func (be *sqliteBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *b
 	}
 	defer tx.Rollback()
 
+	uncounted := 0
+	if deferred {
+		uncounted = 1
+	} else {
+		delay = wi.GetAbandonDelay()
+	}
 	var visibleTime *time.Time = nil
-	if delay := wi.GetAbandonDelay(); delay > 0 {
+	if delay > 0 {
 		t := time.Now().UTC().Add(delay)
 		visibleTime = &t
 	}
 
 	dbResult, err := tx.ExecContext(
 		ctx,
-		"UPDATE NewEvents SET [LockedBy] = NULL, [VisibleTime] = ? WHERE [InstanceID] = ? AND [LockedBy] = ?",
+		"UPDATE NewEvents SET [LockedBy] = NULL, [VisibleTime] = ?, [DequeueCount] = [DequeueCount] - ? WHERE [InstanceID] = ? AND [LockedBy] = ?",
 		visibleTime,
+		uncounted,
 		string(wi.InstanceID),
 		wi.LockedBy,
 	)
@@ -185,8 +207,36 @@ func (be *sqliteBackend) AbandonOrchestrationWorkItem(ctx context.Context, wi *b
 	return nil
 }
 
+// RenewOrchestrationWorkItemLock implements backend.BackendWithLockRenewal
+func (be *sqliteBackend) RenewOrchestrationWorkItemLock(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE Instances SET [LockExpiration] = ? WHERE [InstanceID] = ? AND [LockedBy] = ?",
+		time.Now().UTC().Add(be.options.OrchestrationLockTimeout),
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE Instances statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
 // CompleteOrchestrationWorkItem implements backend.Backend
-func (be *sqliteBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) error {
+func (be *sqliteBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem) (err error) {
+	defer func() { err = markTransient(err) }()
 	if err := be.ensureDB(); err != nil {
 		return err
 	}
@@ -244,6 +294,11 @@ func (be *sqliteBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *
 		sqlUpdateArgs = append(sqlUpdateArgs, wi.State.CustomStatus.Value)
 	}
 
+	if count := wi.State.ContinuedAsNewCount(); count > 0 {
+		sqlSB.WriteString("[GenerationCount] = [GenerationCount] + ?, ")
+		sqlUpdateArgs = append(sqlUpdateArgs, count)
+	}
+
 	// TODO: Support for stickiness, which would extend the LockExpiration
 	sqlSB.WriteString("[RuntimeStatus] = ?, [LastUpdatedTime] = ?, [LockExpiration] = NULL WHERE [InstanceID] = ? AND [LockedBy] = ?")
 	sqlUpdateArgs = append(sqlUpdateArgs, helpers.ToRuntimeStatusString(wi.State.RuntimeStatus()), now, string(wi.InstanceID), wi.LockedBy)
@@ -267,6 +322,20 @@ func (be *sqliteBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *
 		}
 	}
 
+	// Save the actions from the most recent execution, if requested
+	if wi.State.LastActions != nil {
+		payload, err := proto.Marshal(&protos.OrchestratorResponse{
+			InstanceId: string(wi.InstanceID),
+			Actions:    wi.State.LastActions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal last actions: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO LastActions ([InstanceID], [Payload]) VALUES (?, ?)", string(wi.InstanceID), payload); err != nil {
+			return fmt.Errorf("failed to update LastActions table: %w", err)
+		}
+	}
+
 	// Save new history events
 	newHistoryCount := len(wi.State.NewEvents())
 	if newHistoryCount > 0 {
@@ -294,17 +363,17 @@ func (be *sqliteBackend) CompleteOrchestrationWorkItem(ctx context.Context, wi *
 	// Save outbound activity tasks
 	newActivityCount := len(wi.State.PendingTasks())
 	if newActivityCount > 0 {
-		insertSql := "INSERT INTO NewTasks ([InstanceID], [EventPayload]) VALUES (?, ?)" +
-			strings.Repeat(", (?, ?)", newActivityCount-1)
+		insertSql := "INSERT INTO NewTasks ([InstanceID], [Name], [Queue], [EventPayload]) VALUES (?, ?, ?, ?)" +
+			strings.Repeat(", (?, ?, ?, ?)", newActivityCount-1)
 
-		sqlInsertArgs := make([]interface{}, 0, newActivityCount*2)
+		sqlInsertArgs := make([]interface{}, 0, newActivityCount*4)
 		for _, e := range wi.State.PendingTasks() {
 			eventPayload, err := backend.MarshalHistoryEvent(e)
 			if err != nil {
 				return err
 			}
 
-			sqlInsertArgs = append(sqlInsertArgs, string(wi.InstanceID), eventPayload)
+			sqlInsertArgs = append(sqlInsertArgs, string(wi.InstanceID), e.GetTaskScheduled().GetName(), helpers.GetActivityQueue(e.GetTaskScheduled()), eventPayload)
 		}
 
 		_, err = tx.ExecContext(ctx, insertSql, sqlInsertArgs...)
@@ -401,6 +470,20 @@ func (be *sqliteBackend) CreateOrchestrationInstance(ctx context.Context, e *bac
 	}
 	defer tx.Rollback()
 
+	if err := be.createOrchestrationInstance(ctx, e, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create orchestration: %w", err)
+	}
+
+	return nil
+}
+
+// createOrchestrationInstance creates the orchestration instance and its ExecutionStarted event in the specified
+// transaction.
+func (be *sqliteBackend) createOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent, tx *sql.Tx) error {
 	var instanceID string
 	if err := be.createOrchestrationInstanceInternal(ctx, e, tx, &instanceID); err != nil {
 		return err
@@ -411,21 +494,25 @@ func (be *sqliteBackend) CreateOrchestrationInstance(ctx context.Context, e *bac
 		return err
 	}
 
+	// Orchestrations with a scheduled start time stay invisible to workers until that time
+	var visibleTime *time.Time = nil
+	if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+		t := ts.AsTime()
+		visibleTime = &t
+	}
+
 	_, err = tx.ExecContext(
 		ctx,
-		`INSERT INTO NewEvents ([InstanceID], [EventPayload]) VALUES (?, ?)`,
+		`INSERT INTO NewEvents ([InstanceID], [EventPayload], [VisibleTime]) VALUES (?, ?, ?)`,
 		instanceID,
 		eventPayload,
+		visibleTime,
 	)
 
 	if err != nil {
 		return fmt.Errorf("failed to insert row into [NewEvents] table: %w", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to create orchestration: %w", err)
-	}
-
 	return nil
 }
 
@@ -441,6 +528,16 @@ func (be *sqliteBackend) createOrchestrationInstanceInternal(ctx context.Context
 		return errors.New("HistoryEvent must be an ExecutionStartedEvent")
 	}
 
+	var parentInstanceID *string
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		parentInstanceID = &parent.GetOrchestrationInstance().InstanceId
+	}
+
+	tags, err := helpers.MarshalTags(helpers.GetTags(startEvent))
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags: %w", err)
+	}
+
 	// TODO: Support for re-using orchestration instance IDs
 	res, err := tx.ExecContext(
 		ctx,
@@ -451,8 +548,10 @@ func (be *sqliteBackend) createOrchestrationInstanceInternal(ctx context.Context
 			[ExecutionID],
 			[Input],
 			[RuntimeStatus],
-			[CreatedTime]
-		) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			[CreatedTime],
+			[ParentInstanceID],
+			[Tags]
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		startEvent.Name,
 		startEvent.Version.GetValue(),
 		startEvent.OrchestrationInstance.InstanceId,
@@ -460,6 +559,8 @@ func (be *sqliteBackend) createOrchestrationInstanceInternal(ctx context.Context
 		startEvent.Input.GetValue(),
 		"PENDING",
 		e.Timestamp.AsTime(),
+		parentInstanceID,
+		tags,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to insert into [Instances] table: %w", err)
@@ -504,6 +605,124 @@ func (be *sqliteBackend) AddNewOrchestrationEvent(ctx context.Context, iid api.I
 	return nil
 }
 
+// IngestOperations implements backend.BackendWithIngest
+func (be *sqliteBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		// Each operation is applied in a savepoint so that a failed operation can be rolled back without rolling back
+		// the others
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT ingest"); err != nil {
+			return nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+		if errs[i] = be.ingestOperation(ctx, op, tx); errs[i] != nil {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO ingest"); err != nil {
+				return nil, fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE ingest"); err != nil {
+			return nil, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return errs, nil
+}
+
+func (be *sqliteBackend) ingestOperation(ctx context.Context, op *backend.IngestOperation, tx *sql.Tx) error {
+	if op.Event.GetExecutionStarted() != nil {
+		return be.createOrchestrationInstance(ctx, op.Event, tx)
+	}
+
+	if op.Event == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if op.Event.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(op.Event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents ([InstanceID], [EventPayload]) VALUES (?, ?)`,
+		string(op.InstanceID),
+		eventPayload,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert row into [NewEvents] table: %w", err)
+	}
+
+	return nil
+}
+
+// AddNewOrchestrationEventIf implements backend.Backend
+func (be *sqliteBackend) AddNewOrchestrationEventIf(ctx context.Context, iid api.InstanceID, e *backend.HistoryEvent, statuses []protos.OrchestrationStatus) error {
+	if e == nil {
+		return errors.New("HistoryEvent must be non-nil")
+	} else if e.Timestamp == nil {
+		return errors.New("HistoryEvent must have a non-nil timestamp")
+	} else if len(statuses) == 0 {
+		return errors.New("at least one runtime status must be specified")
+	}
+
+	eventPayload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		return err
+	}
+
+	sqlArgs := make([]interface{}, 0, len(statuses)+3)
+	sqlArgs = append(sqlArgs, string(iid), eventPayload, string(iid))
+	for _, status := range statuses {
+		sqlArgs = append(sqlArgs, helpers.ToRuntimeStatusString(status))
+	}
+
+	// The status check and the insert are done in a single statement so that the status can't change in between
+	res, err := be.db.ExecContext(
+		ctx,
+		`INSERT INTO NewEvents ([InstanceID], [EventPayload])
+		SELECT ?, ? WHERE EXISTS (
+			SELECT 1 FROM Instances WHERE [InstanceID] = ? AND [RuntimeStatus] IN (?`+strings.Repeat(", ?", len(statuses)-1)+`)
+		)`,
+		sqlArgs...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert row into [NewEvents] table: %w", err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var exists int
+	err = be.db.QueryRowContext(ctx, "SELECT 1 FROM Instances WHERE [InstanceID] = ?", string(iid)).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return api.ErrInstanceNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	return api.ErrPreconditionFailed
+}
+
 // GetOrchestrationMetadata implements backend.Backend
 func (be *sqliteBackend) GetOrchestrationMetadata(ctx context.Context, iid api.InstanceID) (*api.OrchestrationMetadata, error) {
 	if err := be.ensureDB(); err != nil {
@@ -512,8 +731,7 @@ func (be *sqliteBackend) GetOrchestrationMetadata(ctx context.Context, iid api.I
 
 	row := be.db.QueryRowContext(
 		ctx,
-		`SELECT [InstanceID], [Name], [RuntimeStatus], [CreatedTime], [LastUpdatedTime], [Input], [Output], [CustomStatus], [FailureDetails]
-		FROM Instances WHERE [InstanceID] = ?`,
+		"SELECT "+metadataColumns+" FROM Instances WHERE [InstanceID] = ?",
 		string(iid),
 	)
 
@@ -524,6 +742,18 @@ func (be *sqliteBackend) GetOrchestrationMetadata(ctx context.Context, iid api.I
 		return nil, fmt.Errorf("failed to query the Instances table: %w", row.Err())
 	}
 
+	metadata, err := scanOrchestrationMetadata(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	}
+	return metadata, err
+}
+
+// metadataColumns are the columns of the Instances table that are read by scanOrchestrationMetadata.
+const metadataColumns = "[InstanceID], [Name], [RuntimeStatus], [CreatedTime], [LastUpdatedTime], [Input], [Output], [CustomStatus], [FailureDetails], [GenerationCount], [Tags]"
+
+// scanOrchestrationMetadata reads the orchestration metadata from a row that contains the metadataColumns.
+func scanOrchestrationMetadata(scan func(dest ...any) error) (*api.OrchestrationMetadata, error) {
 	var instanceID *string
 	var name *string
 	var runtimeStatus *string
@@ -533,11 +763,13 @@ func (be *sqliteBackend) GetOrchestrationMetadata(ctx context.Context, iid api.I
 	var output *string
 	var customStatus *string
 	var failureDetails *protos.TaskFailureDetails
+	var generationCount int
+	var tags *string
 
 	var failureDetailsPayload []byte
-	err = row.Scan(&instanceID, &name, &runtimeStatus, &createdAt, &lastUpdatedAt, &input, &output, &customStatus, &failureDetailsPayload)
+	err := scan(&instanceID, &name, &runtimeStatus, &createdAt, &lastUpdatedAt, &input, &output, &customStatus, &failureDetailsPayload, &generationCount, &tags)
 	if err == sql.ErrNoRows {
-		return nil, api.ErrInstanceNotFound
+		return nil, err
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
 	}
@@ -562,7 +794,7 @@ func (be *sqliteBackend) GetOrchestrationMetadata(ctx context.Context, iid api.I
 	}
 
 	metadata := api.NewOrchestrationMetadata(
-		iid,
+		api.InstanceID(*instanceID),
 		*name,
 		helpers.FromRuntimeStatusString(*runtimeStatus),
 		*createdAt,
@@ -572,9 +804,46 @@ func (be *sqliteBackend) GetOrchestrationMetadata(ctx context.Context, iid api.I
 		*customStatus,
 		failureDetails,
 	)
+	metadata.GenerationCount = generationCount
+	if tags != nil {
+		if metadata.Tags, err = helpers.UnmarshalTags(*tags); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+	}
 	return metadata, nil
 }
 
+// GetOrchestrationLastActions implements backend.Backend
+func (be *sqliteBackend) GetOrchestrationLastActions(ctx context.Context, iid api.InstanceID) ([]*protos.OrchestratorAction, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	row := be.db.QueryRowContext(
+		ctx,
+		`SELECT A.[Payload] FROM Instances I
+		LEFT OUTER JOIN LastActions A ON A.[InstanceID] = I.[InstanceID]
+		WHERE I.[InstanceID] = ?`,
+		string(iid),
+	)
+
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to scan the LastActions table result: %w", err)
+	}
+
+	res := &protos.OrchestratorResponse{}
+	if err := proto.Unmarshal(payload, res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal last actions: %w", err)
+	}
+	if res.Actions == nil {
+		return []*protos.OrchestratorAction{}, nil
+	}
+	return res.Actions, nil
+}
+
 // GetOrchestrationRuntimeState implements backend.Backend
 func (be *sqliteBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
 	if err := be.ensureDB(); err != nil {
@@ -611,6 +880,20 @@ func (be *sqliteBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *b
 
 // GetOrchestrationWorkItem implements backend.Backend
 func (be *sqliteBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend.OrchestrationWorkItem, error) {
+	return be.getOrchestrationWorkItem(ctx, backend.OrchestrationWorkItemFilter{})
+}
+
+// GetOrchestrationWorkItemWithFilter implements backend.BackendWithOrchestrationFilters
+func (be *sqliteBackend) GetOrchestrationWorkItemWithFilter(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
+	if filter.Names != nil && len(filter.Names) == 0 {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getOrchestrationWorkItem(ctx, filter)
+}
+
+// getOrchestrationWorkItem locks an orchestration instance that matches the filter and has new events that are ready
+// to be executed.
+func (be *sqliteBackend) getOrchestrationWorkItem(ctx context.Context, filter backend.OrchestrationWorkItemFilter) (*backend.OrchestrationWorkItem, error) {
 	if err := be.ensureDB(); err != nil {
 		return nil, err
 	}
@@ -624,7 +907,24 @@ func (be *sqliteBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend
 	now := time.Now().UTC()
 	newLockExpiration := now.Add(be.options.OrchestrationLockTimeout)
 
+	args := []interface{}{
+		be.workerName,     // LockedBy for Instances table
+		newLockExpiration, // Updated LockExpiration for Instances table
+		now,               // LockExpiration for Instances table
+		now,               // VisibleTime for NewEvents table
+		now,               // VisibleTime for scheduled start events
+	}
+	nameFilter := ""
+	if filter.Names != nil {
+		nameFilter = " AND I.[Name] IN (?" + strings.Repeat(", ?", len(filter.Names)-1) + ")"
+		for _, name := range filter.Names {
+			args = append(args, name)
+		}
+	}
+
 	// Place a lock on an orchestration instance that has new events that are ready to be executed.
+	// Instances that haven't started yet and still have invisible events are waiting for their
+	// scheduled start time, so events raised to them in the meantime must wait as well.
 	row := tx.QueryRowContext(
 		ctx,
 		`UPDATE Instances SET [LockedBy] = ?, [LockExpiration] = ?
@@ -633,13 +933,13 @@ func (be *sqliteBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend
 			WHERE (I.[LockExpiration] IS NULL OR I.[LockExpiration] < ?) AND EXISTS (
 				SELECT 1 FROM NewEvents E
 				WHERE E.[InstanceID] = I.[InstanceID] AND (E.[VisibleTime] IS NULL OR E.[VisibleTime] < ?)
-			)
+			) AND NOT (
+				EXISTS (SELECT 1 FROM NewEvents E WHERE E.[InstanceID] = I.[InstanceID] AND E.[VisibleTime] >= ?)
+				AND NOT EXISTS (SELECT 1 FROM History H WHERE H.[InstanceID] = I.[InstanceID])
+			)`+nameFilter+`
 			LIMIT 1
 		) RETURNING [InstanceID]`,
-		be.workerName,     // LockedBy for Instances table
-		newLockExpiration, // Updated LockExpiration for Instances table
-		now,               // LockExpiration for Instances table
-		now,               // VisibleTime for NewEvents table
+		args...,
 	)
 
 	if err := row.Err(); err != nil {
@@ -656,6 +956,15 @@ func (be *sqliteBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend
 		return nil, fmt.Errorf("failed to scan the orchestration work-item: %w", err)
 	}
 
+	// The number of saved history events is used by the worker to detect stale cached state, so it's only counted
+	// for workers that cache state
+	var nextSequenceNumber int
+	if filter.IncludeHistoryLength {
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM History WHERE [InstanceID] = ?", instanceID).Scan(&nextSequenceNumber); err != nil {
+			return nil, fmt.Errorf("failed to count the history events of the orchestration work-item: %w", err)
+		}
+	}
+
 	// TODO: Get all the unprocessed events associated with the locked instance
 	events, err := tx.QueryContext(
 		ctx,
@@ -704,64 +1013,131 @@ func (be *sqliteBackend) GetOrchestrationWorkItem(ctx context.Context) (*backend
 		NewEvents:  newEvents,
 		LockedBy:   be.workerName,
 		RetryCount: maxDequeueCount - 1,
+
+		NextSequenceNumber: nextSequenceNumber,
 	}
 
 	return wi, nil
 }
 
 func (be *sqliteBackend) GetActivityWorkItem(ctx context.Context) (*backend.ActivityWorkItem, error) {
+	wis, err := be.getActivityWorkItems(ctx, backend.ActivityWorkItemFilter{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	return wis[0], nil
+}
+
+// GetActivityWorkItems implements backend.BackendWithActivityBatches
+func (be *sqliteBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*backend.ActivityWorkItem, error) {
+	return be.getActivityWorkItems(ctx, backend.ActivityWorkItemFilter{}, max)
+}
+
+// GetActivityWorkItemsFromQueues implements backend.BackendWithActivityQueues
+func (be *sqliteBackend) GetActivityWorkItemsFromQueues(ctx context.Context, queues []string, max int) ([]*backend.ActivityWorkItem, error) {
+	if len(queues) == 0 {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getActivityWorkItems(ctx, backend.ActivityWorkItemFilter{Queues: queues}, max)
+}
+
+// GetActivityWorkItemsWithFilter implements backend.BackendWithActivityFilters
+func (be *sqliteBackend) GetActivityWorkItemsWithFilter(ctx context.Context, filter backend.ActivityWorkItemFilter, max int) ([]*backend.ActivityWorkItem, error) {
+	if (filter.Queues != nil && len(filter.Queues) == 0) || (filter.Names != nil && len(filter.Names) == 0) {
+		return nil, backend.ErrNoWorkItems
+	}
+	return be.getActivityWorkItems(ctx, filter, max)
+}
+
+// getActivityWorkItems locks up to max activity work items that match the filter in a single statement.
+func (be *sqliteBackend) getActivityWorkItems(ctx context.Context, filter backend.ActivityWorkItemFilter, max int) ([]*backend.ActivityWorkItem, error) {
 	if err := be.ensureDB(); err != nil {
 		return nil, err
 	}
+	if max < 1 {
+		return nil, backend.ErrNoWorkItems
+	}
 
 	now := time.Now().UTC()
 	newLockExpiration := now.Add(be.options.OrchestrationLockTimeout)
 
-	row := be.db.QueryRowContext(
+	args := []interface{}{be.workerName, newLockExpiration, now}
+	itemFilter := ""
+	if filter.Queues != nil {
+		itemFilter += " AND T.[Queue] IN (?" + strings.Repeat(", ?", len(filter.Queues)-1) + ")"
+		for _, q := range filter.Queues {
+			args = append(args, q)
+		}
+	}
+	if filter.Names != nil {
+		itemFilter += " AND T.[Name] IN (?" + strings.Repeat(", ?", len(filter.Names)-1) + ")"
+		for _, name := range filter.Names {
+			args = append(args, name)
+		}
+	}
+	if len(filter.ExcludedNames) > 0 {
+		itemFilter += " AND T.[Name] NOT IN (?" + strings.Repeat(", ?", len(filter.ExcludedNames)-1) + ")"
+		for _, name := range filter.ExcludedNames {
+			args = append(args, name)
+		}
+	}
+	args = append(args, max)
+
+	rows, err := be.db.QueryContext(
 		ctx,
 		`UPDATE NewTasks SET [LockedBy] = ?, [LockExpiration] = ?, [DequeueCount] = [DequeueCount] + 1
-		WHERE [SequenceNumber] = (
+		WHERE [SequenceNumber] IN (
 			SELECT [SequenceNumber] FROM NewTasks T
-			WHERE T.[LockExpiration] IS NULL OR T.[LockExpiration] < ?
-			LIMIT 1
-		) RETURNING [SequenceNumber], [InstanceID], [EventPayload]`,
-		be.workerName,
-		newLockExpiration,
-		now,
+			WHERE (T.[LockExpiration] IS NULL OR T.[LockExpiration] < ?)`+itemFilter+`
+			ORDER BY T.[SequenceNumber]
+			LIMIT ?
+		) RETURNING [SequenceNumber], [InstanceID], [EventPayload], [DequeueCount]`,
+		args...,
 	)
-
-	if err := row.Err(); err != nil {
+	if err != nil {
 		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
 	}
+	defer rows.Close()
 
-	var sequenceNumber int64
-	var instanceID string
-	var eventPayload []byte
+	var wis []*backend.ActivityWorkItem
+	for rows.Next() {
+		var sequenceNumber int64
+		var instanceID string
+		var eventPayload []byte
+		var dequeueCount int32
+		if err := rows.Scan(&sequenceNumber, &instanceID, &eventPayload, &dequeueCount); err != nil {
+			return nil, fmt.Errorf("failed to scan the activity work-item: %w", err)
+		}
 
-	if err := row.Scan(&sequenceNumber, &instanceID, &eventPayload); err != nil {
-		if err == sql.ErrNoRows {
-			// No new activity tasks to process
-			return nil, backend.ErrNoWorkItems
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, fmt.Errorf("failed to scan the activity work-item: %w", err)
+		wis = append(wis, &backend.ActivityWorkItem{
+			SequenceNumber: sequenceNumber,
+			InstanceID:     api.InstanceID(instanceID),
+			NewEvent:       e,
+			LockedBy:       be.workerName,
+			RetryCount:     dequeueCount - 1,
+		})
 	}
-
-	e, err := backend.UnmarshalHistoryEvent(eventPayload)
-	if err != nil {
-		return nil, err
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query for activity work-items: %w", err)
 	}
 
-	wi := &backend.ActivityWorkItem{
-		SequenceNumber: sequenceNumber,
-		InstanceID:     api.InstanceID(instanceID),
-		NewEvent:       e,
-		LockedBy:       be.workerName,
+	if len(wis) == 0 {
+		// No new activity tasks to process
+		return nil, backend.ErrNoWorkItems
 	}
-	return wi, nil
+
+	// The order of the rows returned by UPDATE statements is unspecified
+	sort.Slice(wis, func(i, j int) bool { return wis[i].SequenceNumber < wis[j].SequenceNumber })
+	return wis, nil
 }
 
-func (be *sqliteBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+func (be *sqliteBackend) CompleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) (err error) {
+	defer func() { err = markTransient(err) }()
 	if err := be.ensureDB(); err != nil {
 		return err
 	}
@@ -801,6 +1177,27 @@ func (be *sqliteBackend) CompleteActivityWorkItem(ctx context.Context, wi *backe
 	return nil
 }
 
+// DeleteActivityWorkItem implements backend.BackendWithExternalActivityResults
+func (be *sqliteBackend) DeleteActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(ctx, "DELETE FROM NewTasks WHERE [SequenceNumber] = ? AND [LockedBy] = ?", wi.SequenceNumber, wi.LockedBy)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewTasks table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
 func (be *sqliteBackend) AbandonActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem) error {
 	if err := be.ensureDB(); err != nil {
 		return err
@@ -826,12 +1223,339 @@ func (be *sqliteBackend) AbandonActivityWorkItem(ctx context.Context, wi *backen
 	return nil
 }
 
-func (be *sqliteBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+// DeferActivityWorkItem implements backend.BackendWithDeferrals
+func (be *sqliteBackend) DeferActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem, delay time.Duration) error {
 	if err := be.ensureDB(); err != nil {
 		return err
 	}
 
-	tx, err := be.db.BeginTx(ctx, nil)
+	// The work item isn't fetched again until its lock expiration, which is set to the end of the delay
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET [LockedBy] = NULL, [LockExpiration] = ?, [DequeueCount] = [DequeueCount] - 1 WHERE [SequenceNumber] = ? AND [LockedBy] = ?",
+		time.Now().UTC().Add(delay),
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the NewTasks table for deferral: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by update statement for deferral: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// RenewActivityWorkItemLock implements backend.BackendWithLockRenewal
+func (be *sqliteBackend) RenewActivityWorkItemLock(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(
+		ctx,
+		"UPDATE NewTasks SET [LockExpiration] = ? WHERE [SequenceNumber] = ? AND [LockedBy] = ?",
+		time.Now().UTC().Add(be.options.ActivityLockTimeout),
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the NewTasks table for lock renewal: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by update statement for lock renewal: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	return nil
+}
+
+// RecordActivityHeartbeat implements backend.BackendWithActivityHeartbeats. The heartbeat details aren't saved, so
+// recording a heartbeat only extends the lock on the work item.
+func (be *sqliteBackend) RecordActivityHeartbeat(ctx context.Context, wi *backend.ActivityWorkItem) error {
+	return be.RenewActivityWorkItemLock(ctx, wi)
+}
+
+// DeadLetterOrchestrationWorkItem implements backend.BackendWithDeadLetters
+func (be *sqliteBackend) DeadLetterOrchestrationWorkItem(ctx context.Context, wi *backend.OrchestrationWorkItem, reason string) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"DELETE FROM NewEvents WHERE [InstanceID] = ? AND [LockedBy] = ? RETURNING [SequenceNumber], [EventPayload], [DequeueCount]",
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete from NewEvents table: %w", err)
+	}
+	defer rows.Close()
+
+	type lockedEvent struct {
+		sequenceNumber int64
+		event          *backend.HistoryEvent
+	}
+	var lockedEvents []lockedEvent
+	deliveryCount := int32(0)
+	for rows.Next() {
+		var sequenceNumber int64
+		var eventPayload []byte
+		var dequeueCount int32
+		if err := rows.Scan(&sequenceNumber, &eventPayload, &dequeueCount); err != nil {
+			return fmt.Errorf("failed to scan the NewEvents table result: %w", err)
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return err
+		}
+		lockedEvents = append(lockedEvents, lockedEvent{sequenceNumber, e})
+		if dequeueCount > deliveryCount {
+			deliveryCount = dequeueCount
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to delete from NewEvents table: %w", err)
+	}
+	rows.Close()
+
+	if len(lockedEvents) == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	// The order of the rows returned by DELETE statements is unspecified
+	sort.Slice(lockedEvents, func(i, j int) bool { return lockedEvents[i].sequenceNumber < lockedEvents[j].sequenceNumber })
+	events := make([]*backend.HistoryEvent, len(lockedEvents))
+	for i, e := range lockedEvents {
+		events[i] = e.event
+	}
+
+	if err := insertDeadLetter(ctx, tx, backend.DeadLetterOrchestration, wi.InstanceID, "", deliveryCount, reason, events); err != nil {
+		return err
+	}
+
+	dbResult, err := tx.ExecContext(
+		ctx,
+		"UPDATE Instances SET [LockedBy] = NULL, [LockExpiration] = NULL WHERE [InstanceID] = ? AND [LockedBy] = ?",
+		string(wi.InstanceID),
+		wi.LockedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update Instances table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by UPDATE Instances statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrWorkItemLockLost
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DeadLetterActivityWorkItem implements backend.BackendWithDeadLetters
+func (be *sqliteBackend) DeadLetterActivityWorkItem(ctx context.Context, wi *backend.ActivityWorkItem, reason string) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(
+		ctx,
+		"DELETE FROM NewTasks WHERE [SequenceNumber] = ? AND [LockedBy] = ? RETURNING [Queue], [EventPayload], [DequeueCount]",
+		wi.SequenceNumber,
+		wi.LockedBy,
+	)
+
+	var queue string
+	var eventPayload []byte
+	var deliveryCount int32
+	if err := row.Scan(&queue, &eventPayload, &deliveryCount); err == sql.ErrNoRows {
+		return backend.ErrWorkItemLockLost
+	} else if err != nil {
+		return fmt.Errorf("failed to delete from NewTasks table: %w", err)
+	}
+
+	e, err := backend.UnmarshalHistoryEvent(eventPayload)
+	if err != nil {
+		return err
+	}
+
+	if err := insertDeadLetter(ctx, tx, backend.DeadLetterActivity, wi.InstanceID, queue, deliveryCount, reason, []*backend.HistoryEvent{e}); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func insertDeadLetter(ctx context.Context, tx *sql.Tx, kind backend.DeadLetterKind, iid api.InstanceID, queue string, deliveryCount int32, reason string, events []*backend.HistoryEvent) error {
+	payload, err := proto.Marshal(&protos.OrchestratorRequest{
+		InstanceId: string(iid),
+		NewEvents:  events,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead-lettered events: %w", err)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO DeadLetters ([Kind], [InstanceID], [Queue], [DeliveryCount], [Reason], [Timestamp], [Payload]) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		int(kind),
+		string(iid),
+		queue,
+		deliveryCount,
+		reason,
+		time.Now().UTC(),
+		payload,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into DeadLetters table: %w", err)
+	}
+	return nil
+}
+
+// ListDeadLetters implements backend.BackendWithDeadLetters
+func (be *sqliteBackend) ListDeadLetters(ctx context.Context) ([]*backend.DeadLetter, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	rows, err := be.db.QueryContext(ctx, "SELECT [ID], [Kind], [InstanceID], [DeliveryCount], [Reason], [Timestamp], [Payload] FROM DeadLetters ORDER BY [ID]")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the DeadLetters table: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters := make([]*backend.DeadLetter, 0)
+	for rows.Next() {
+		dl := &backend.DeadLetter{}
+		var kind int
+		var instanceID string
+		var payload []byte
+		if err := rows.Scan(&dl.ID, &kind, &instanceID, &dl.DeliveryCount, &dl.Reason, &dl.DeadLetteredAt, &payload); err != nil {
+			return nil, fmt.Errorf("failed to scan the DeadLetters table result: %w", err)
+		}
+		req := &protos.OrchestratorRequest{}
+		if err := proto.Unmarshal(payload, req); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dead-lettered events: %w", err)
+		}
+		dl.Kind = backend.DeadLetterKind(kind)
+		dl.InstanceID = api.InstanceID(instanceID)
+		dl.Events = req.NewEvents
+		deadLetters = append(deadLetters, dl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query the DeadLetters table: %w", err)
+	}
+	return deadLetters, nil
+}
+
+// ResubmitDeadLetter implements backend.BackendWithDeadLetters
+func (be *sqliteBackend) ResubmitDeadLetter(ctx context.Context, id int64) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "DELETE FROM DeadLetters WHERE [ID] = ? RETURNING [Kind], [InstanceID], [Queue], [Payload]", id)
+
+	var kind int
+	var instanceID string
+	var queue string
+	var payload []byte
+	if err := row.Scan(&kind, &instanceID, &queue, &payload); err == sql.ErrNoRows {
+		return backend.ErrDeadLetterNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to delete from DeadLetters table: %w", err)
+	}
+
+	req := &protos.OrchestratorRequest{}
+	if err := proto.Unmarshal(payload, req); err != nil {
+		return fmt.Errorf("failed to unmarshal dead-lettered events: %w", err)
+	}
+
+	for _, e := range req.NewEvents {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if backend.DeadLetterKind(kind) == backend.DeadLetterActivity {
+			_, err = tx.ExecContext(ctx, "INSERT INTO NewTasks ([InstanceID], [Name], [Queue], [EventPayload]) VALUES (?, ?, ?, ?)", instanceID, e.GetTaskScheduled().GetName(), queue, eventPayload)
+			if err != nil {
+				return fmt.Errorf("failed to insert into NewTasks table: %w", err)
+			}
+		} else {
+			_, err = tx.ExecContext(ctx, "INSERT INTO NewEvents ([InstanceID], [EventPayload]) VALUES (?, ?)", instanceID, eventPayload)
+			if err != nil {
+				return fmt.Errorf("failed to insert into NewEvents table: %w", err)
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DeleteDeadLetter implements backend.BackendWithDeadLetters
+func (be *sqliteBackend) DeleteDeadLetter(ctx context.Context, id int64) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	dbResult, err := be.db.ExecContext(ctx, "DELETE FROM DeadLetters WHERE [ID] = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete from DeadLetters table: %w", err)
+	}
+
+	rowsAffected, err := dbResult.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get rows affected by delete statement: %w", err)
+	} else if rowsAffected == 0 {
+		return backend.ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func (be *sqliteBackend) PurgeOrchestrationState(ctx context.Context, id api.InstanceID) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -867,12 +1591,571 @@ func (be *sqliteBackend) PurgeOrchestrationState(ctx context.Context, id api.Ins
 		return fmt.Errorf("failed to delete from History table: %w", err)
 	}
 
+	_, err = tx.ExecContext(ctx, "DELETE FROM LastActions WHERE [InstanceID] = ?", string(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete from LastActions table: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// PurgeOrchestrationStateBatch implements backend.BackendWithBulkPurge
+func (be *sqliteBackend) PurgeOrchestrationStateBatch(ctx context.Context, query api.InstanceQuery) (int, string, error) {
+	if err := be.ensureDB(); err != nil {
+		return 0, "", err
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	// Only the state of completed orchestrations can be purged
+	filter, sqlArgs := instanceQueryFilter(query)
+	pageSize := query.PageSizeOrDefault()
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT [InstanceID] FROM Instances WHERE [RuntimeStatus] IN ('COMPLETED', 'FAILED', 'TERMINATED')"+filter+" ORDER BY [InstanceID] LIMIT ?",
+		append(sqlArgs, pageSize+1)...,
+	)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	instanceIDs := make([]interface{}, 0, pageSize+1)
+	for rows.Next() {
+		var instanceID string
+		if err := rows.Scan(&instanceID); err != nil {
+			rows.Close()
+			return 0, "", fmt.Errorf("failed to scan the instance ID: %w", err)
+		}
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, "", fmt.Errorf("failed to read the instance IDs: %w", err)
+	}
+	rows.Close()
+	if len(instanceIDs) == 0 {
+		return 0, "", nil
+	}
+
+	continuationToken := ""
+	if len(instanceIDs) > pageSize {
+		instanceIDs = instanceIDs[:pageSize]
+		continuationToken = instanceIDs[len(instanceIDs)-1].(string)
+	}
+	inClause := "(?" + strings.Repeat(", ?", len(instanceIDs)-1) + ")"
+	for _, table := range []string{"Instances", "History", "LastActions"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE [InstanceID] IN "+inClause, instanceIDs...); err != nil {
+			return 0, "", fmt.Errorf("failed to delete from the %s table: %w", table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(instanceIDs), continuationToken, nil
+}
+
+// GetOrchestrationHistoriesBatch implements backend.Backend
+func (be *sqliteBackend) GetOrchestrationHistoriesBatch(ctx context.Context, fromSequenceNumbers map[api.InstanceID]int) (map[api.InstanceID][]*backend.HistoryEvent, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[api.InstanceID][]*backend.HistoryEvent, len(fromSequenceNumbers))
+	if len(fromSequenceNumbers) == 0 {
+		return histories, nil
+	}
+
+	tx, err := be.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	idArgs := make([]interface{}, 0, len(fromSequenceNumbers))
+	historyArgs := make([]interface{}, 0, len(fromSequenceNumbers)*2)
+	for iid, from := range fromSequenceNumbers {
+		idArgs = append(idArgs, string(iid))
+		historyArgs = append(historyArgs, string(iid), from)
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT [InstanceID] FROM Instances WHERE [InstanceID] IN (?"+strings.Repeat(", ?", len(idArgs)-1)+")",
+		idArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	for rows.Next() {
+		var instanceID string
+		if err := rows.Scan(&instanceID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+		}
+		histories[api.InstanceID(instanceID)] = make([]*backend.HistoryEvent, 0)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(
+		ctx,
+		"SELECT [InstanceID], [EventPayload] FROM History WHERE ([InstanceID] = ? AND [SequenceNumber] >= ?)"+
+			strings.Repeat(" OR ([InstanceID] = ? AND [SequenceNumber] >= ?)", len(fromSequenceNumbers)-1)+
+			" ORDER BY [InstanceID], [SequenceNumber] ASC",
+		historyArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the History table: %w", err)
+	}
+	defer rows.Close()
+
+	errs := make(map[api.InstanceID]error)
+	for rows.Next() {
+		var instanceID string
+		var eventPayload []byte
+		if err := rows.Scan(&instanceID, &eventPayload); err != nil {
+			return nil, fmt.Errorf("failed to read history event: %w", err)
+		}
+
+		iid := api.InstanceID(instanceID)
+		if _, failed := errs[iid]; failed {
+			continue
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			errs[iid] = err
+			delete(histories, iid)
+			continue
+		}
+		histories[iid] = append(histories[iid], e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the History table results: %w", err)
+	}
+
+	for iid := range fromSequenceNumbers {
+		if _, ok := histories[iid]; !ok {
+			if _, failed := errs[iid]; !failed {
+				errs[iid] = api.ErrInstanceNotFound
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return histories, &backend.HistoryBatchError{Errors: errs}
+	}
+	return histories, nil
+}
+
+// GetOrphanedSubOrchestrations implements backend.Backend
+func (be *sqliteBackend) GetOrphanedSubOrchestrations(ctx context.Context) ([]*api.OrchestrationMetadata, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT "+metadataColumns+` FROM Instances WHERE [InstanceID] IN (
+			SELECT c.[InstanceID] FROM Instances c
+			LEFT JOIN Instances p ON p.[InstanceID] = c.[ParentInstanceID]
+			WHERE c.[ParentInstanceID] IS NOT NULL
+				AND c.[RuntimeStatus] IN ('PENDING', 'RUNNING', 'SUSPENDED')
+				AND (p.[InstanceID] IS NULL OR p.[RuntimeStatus] IN ('COMPLETED', 'FAILED', 'TERMINATED'))
+		) ORDER BY [CreatedTime]`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	orphans := make([]*api.OrchestrationMetadata, 0)
+	for rows.Next() {
+		metadata, err := scanOrchestrationMetadata(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	return orphans, nil
+}
+
+// QueryOrchestrationMetadata implements backend.BackendWithQueries
+func (be *sqliteBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if err := be.ensureDB(); err != nil {
+		return api.InstanceQueryResult{}, err
+	}
+
+	filter, sqlArgs := instanceQueryFilter(query)
+	pageSize := query.PageSizeOrDefault()
+	rows, err := be.db.QueryContext(
+		ctx,
+		"SELECT "+metadataColumns+" FROM Instances WHERE 1 = 1"+filter+" ORDER BY [InstanceID] LIMIT ?",
+		append(sqlArgs, pageSize+1)...,
+	)
+	if err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	instances := make([]*api.OrchestrationMetadata, 0)
+	for rows.Next() {
+		metadata, err := scanOrchestrationMetadata(rows.Scan)
+		if err != nil {
+			return api.InstanceQueryResult{}, err
+		}
+		instances = append(instances, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+	return backend.NewInstanceQueryResult(instances, pageSize), nil
+}
+
+// instanceQueryFilter returns the conditions of the Instances table that implement the continuation token, instance
+// ID prefix, name, name prefix, runtime status, creation time, completion time, and tag filter expression filters of
+// the query, each starting with " AND ", and their arguments.
+func instanceQueryFilter(query api.InstanceQuery) (string, []interface{}) {
+	var sqlSB strings.Builder
+	sqlArgs := make([]interface{}, 0, len(query.RuntimeStatuses)+10)
+	if query.ContinuationToken != "" {
+		sqlSB.WriteString(" AND [InstanceID] > ?")
+		sqlArgs = append(sqlArgs, query.ContinuationToken)
+	}
+	if query.InstanceIDPrefix != "" {
+		sqlSB.WriteString(" AND substr([InstanceID], 1, length(?)) = ?")
+		sqlArgs = append(sqlArgs, query.InstanceIDPrefix, query.InstanceIDPrefix)
+	}
+	if query.Name != "" {
+		sqlSB.WriteString(" AND [Name] = ?")
+		sqlArgs = append(sqlArgs, query.Name)
+	}
+	if query.NamePrefix != "" {
+		sqlSB.WriteString(" AND substr([Name], 1, length(?)) = ?")
+		sqlArgs = append(sqlArgs, query.NamePrefix, query.NamePrefix)
+	}
+	if len(query.RuntimeStatuses) > 0 {
+		sqlSB.WriteString(" AND [RuntimeStatus] IN (?" + strings.Repeat(", ?", len(query.RuntimeStatuses)-1) + ")")
+		for _, status := range query.RuntimeStatuses {
+			sqlArgs = append(sqlArgs, helpers.ToRuntimeStatusString(status))
+		}
+	}
+	if !query.CreatedFrom.IsZero() {
+		sqlSB.WriteString(" AND [CreatedTime] >= ?")
+		sqlArgs = append(sqlArgs, query.CreatedFrom.UTC())
+	}
+	if !query.CreatedTo.IsZero() {
+		sqlSB.WriteString(" AND [CreatedTime] < ?")
+		sqlArgs = append(sqlArgs, query.CreatedTo.UTC())
+	}
+	if !query.CompletedBefore.IsZero() {
+		sqlSB.WriteString(" AND [CompletedTime] < ?")
+		sqlArgs = append(sqlArgs, query.CompletedBefore.UTC())
+	}
+	if query.TagFilter != nil {
+		var condition string
+		condition, sqlArgs = tagFilterCondition(query.TagFilter, sqlArgs)
+		sqlSB.WriteString(" AND " + condition)
+	}
+	return sqlSB.String(), sqlArgs
+}
+
+// tagFilterCondition returns the condition of the Instances table that evaluates the tag filter expression on the
+// JSON object of the [Tags] column, and appends its arguments to sqlArgs.
+func tagFilterCondition(f *api.TagFilter, sqlArgs []interface{}) (string, []interface{}) {
+	const tagExists = "EXISTS (SELECT 1 FROM json_each(NULLIF([Tags], '')) WHERE [key] = ? AND [value] = ?)"
+	switch f.Op {
+	case api.TagFilterEquals:
+		return tagExists, append(sqlArgs, f.Key, f.Value)
+	case api.TagFilterNotEquals:
+		return "NOT " + tagExists, append(sqlArgs, f.Key, f.Value)
+	case api.TagFilterAnd, api.TagFilterOr:
+		if len(f.Operands) == 0 {
+			if f.Op == api.TagFilterAnd {
+				return "1 = 1", sqlArgs
+			}
+			return "1 = 0", sqlArgs
+		}
+		separator := " AND "
+		if f.Op == api.TagFilterOr {
+			separator = " OR "
+		}
+		conditions := make([]string, 0, len(f.Operands))
+		for _, operand := range f.Operands {
+			var condition string
+			condition, sqlArgs = tagFilterCondition(operand, sqlArgs)
+			conditions = append(conditions, condition)
+		}
+		return "(" + strings.Join(conditions, separator) + ")", sqlArgs
+	default:
+		return "1 = 0", sqlArgs
+	}
+}
+
+// ExportOrchestrationInstance implements backend.BackendWithMigration
+func (be *sqliteBackend) ExportOrchestrationInstance(ctx context.Context, iid api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	tx, err := be.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "SELECT "+metadataColumns+" FROM Instances WHERE [InstanceID] = ?", string(iid))
+	metadata, err := scanOrchestrationMetadata(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInstanceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &backend.OrchestrationInstanceState{Metadata: metadata}
+	if state.History, err = readEvents(ctx, tx, "SELECT [EventPayload] FROM History WHERE [InstanceID] = ? ORDER BY [SequenceNumber] ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the History table: %w", err)
+	}
+	if state.PendingEvents, err = readEvents(ctx, tx, "SELECT [EventPayload] FROM NewEvents WHERE [InstanceID] = ? ORDER BY [SequenceNumber] ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the NewEvents table: %w", err)
+	}
+	if state.PendingTasks, err = readEvents(ctx, tx, "SELECT [EventPayload] FROM NewTasks WHERE [InstanceID] = ? ORDER BY [SequenceNumber] ASC", iid); err != nil {
+		return nil, fmt.Errorf("failed to read from the NewTasks table: %w", err)
+	}
+	return state, nil
+}
+
+// readEvents reads the history events returned by a query that selects a single column with event payloads.
+func readEvents(ctx context.Context, tx *sql.Tx, query string, iid api.InstanceID) ([]*backend.HistoryEvent, error) {
+	rows, err := tx.QueryContext(ctx, query, string(iid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*backend.HistoryEvent, 0)
+	for rows.Next() {
+		var eventPayload []byte
+		if err := rows.Scan(&eventPayload); err != nil {
+			return nil, err
+		}
+		e, err := backend.UnmarshalHistoryEvent(eventPayload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ImportOrchestrationInstance implements backend.BackendWithMigration
+func (be *sqliteBackend) ImportOrchestrationInstance(ctx context.Context, state *backend.OrchestrationInstanceState) error {
+	if err := be.ensureDB(); err != nil {
+		return err
+	}
+
+	metadata := state.Metadata
+	if metadata == nil {
+		return errors.New("orchestration instance state must have metadata")
+	}
+
+	// The execution ID, version, and parent aren't part of the metadata, so they're taken from the start event
+	var startEvent *protos.ExecutionStartedEvent
+	for _, e := range append(append([]*backend.HistoryEvent{}, state.History...), state.PendingEvents...) {
+		if es := e.GetExecutionStarted(); es != nil {
+			startEvent = es
+			break
+		}
+	}
+	var parentInstanceID *string
+	if parent := startEvent.GetParentInstance(); parent != nil {
+		parentInstanceID = &parent.GetOrchestrationInstance().InstanceId
+	}
+	tags, err := helpers.MarshalTags(metadata.Tags)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags: %w", err)
+	}
+	var completedTime *time.Time
+	if metadata.IsComplete() {
+		completedTime = &metadata.LastUpdatedAt
+	}
+	var failureDetailsPayload []byte
+	if metadata.FailureDetails != nil {
+		bytes, err := proto.Marshal(metadata.FailureDetails)
+		if err != nil {
+			return fmt.Errorf("failed to marshal FailureDetails: %w", err)
+		}
+		failureDetailsPayload = bytes
+	}
+
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT OR IGNORE INTO [Instances] (
+			[Name],
+			[Version],
+			[InstanceID],
+			[ExecutionID],
+			[RuntimeStatus],
+			[CreatedTime],
+			[LastUpdatedTime],
+			[CompletedTime],
+			[Input],
+			[Output],
+			[CustomStatus],
+			[FailureDetails],
+			[ParentInstanceID],
+			[GenerationCount],
+			[Tags]
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		metadata.Name,
+		startEvent.GetVersion().GetValue(),
+		string(metadata.InstanceID),
+		startEvent.GetOrchestrationInstance().GetExecutionId().GetValue(),
+		helpers.ToRuntimeStatusString(metadata.RuntimeStatus),
+		metadata.CreatedAt.UTC(),
+		metadata.LastUpdatedAt.UTC(),
+		completedTime,
+		metadata.SerializedInput,
+		metadata.SerializedOutput,
+		metadata.SerializedCustomStatus,
+		failureDetailsPayload,
+		parentInstanceID,
+		metadata.GenerationCount,
+		tags,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into [Instances] table: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to count the rows affected: %w", err)
+	} else if rows <= 0 {
+		return backend.ErrDuplicateEvent
+	}
+
+	for i, e := range state.History {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO History ([InstanceID], [SequenceNumber], [EventPayload]) VALUES (?, ?, ?)", string(metadata.InstanceID), i, eventPayload); err != nil {
+			return fmt.Errorf("failed to insert into the History table: %w", err)
+		}
+	}
+
+	for _, e := range state.PendingEvents {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+
+		// Timers and scheduled starts must stay invisible to workers until they're due
+		var visibleTime *time.Time
+		if tf := e.GetTimerFired(); tf != nil {
+			t := tf.GetFireAt().AsTime()
+			visibleTime = &t
+		} else if ts := e.GetExecutionStarted().GetScheduledStartTimestamp(); ts != nil {
+			t := ts.AsTime()
+			visibleTime = &t
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO NewEvents ([InstanceID], [EventPayload], [VisibleTime]) VALUES (?, ?, ?)", string(metadata.InstanceID), eventPayload, visibleTime); err != nil {
+			return fmt.Errorf("failed to insert into the NewEvents table: %w", err)
+		}
+	}
+
+	for _, e := range state.PendingTasks {
+		eventPayload, err := backend.MarshalHistoryEvent(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO NewTasks ([InstanceID], [Name], [Queue], [EventPayload]) VALUES (?, ?, ?, ?)", string(metadata.InstanceID), e.GetTaskScheduled().GetName(), helpers.GetActivityQueue(e.GetTaskScheduled()), eventPayload); err != nil {
+			return fmt.Errorf("failed to insert into the NewTasks table: %w", err)
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 	return nil
 }
 
+// GetOrchestrationStats implements backend.Backend
+func (be *sqliteBackend) GetOrchestrationStats(ctx context.Context, name string, since time.Time) (*api.OrchestrationStats, error) {
+	if err := be.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	stats := &api.OrchestrationStats{Name: name}
+	row := be.db.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM Instances WHERE [Name] = ? AND [CreatedTime] >= ?",
+		name,
+		since.UTC(),
+	)
+	if err := row.Scan(&stats.Started); err != nil {
+		return nil, fmt.Errorf("failed to count the started instances: %w", err)
+	}
+
+	rows, err := be.db.QueryContext(
+		ctx,
+		`SELECT [RuntimeStatus], [CreatedTime], [CompletedTime] FROM Instances
+		WHERE [Name] = ? AND [CompletedTime] >= ? AND [RuntimeStatus] IN ('COMPLETED', 'FAILED')`,
+		name,
+		since.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the Instances table: %w", err)
+	}
+	defer rows.Close()
+
+	var durations []time.Duration
+	var total time.Duration
+	for rows.Next() {
+		var runtimeStatus string
+		var createdAt, completedAt time.Time
+		if err := rows.Scan(&runtimeStatus, &createdAt, &completedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan the Instances table result: %w", err)
+		}
+		if runtimeStatus == "FAILED" {
+			stats.Failed++
+		} else {
+			stats.Completed++
+		}
+		d := completedAt.Sub(createdAt)
+		durations = append(durations, d)
+		total += d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the Instances table results: %w", err)
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		stats.AverageDuration = total / time.Duration(len(durations))
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(0.95 * float64(len(durations))))
+		stats.P95Duration = durations[rank-1]
+	}
+	return stats, nil
+}
+
 // Start implements backend.Backend
 func (*sqliteBackend) Start(context.Context) error {
 	return nil
@@ -883,6 +2166,17 @@ func (*sqliteBackend) Stop(context.Context) error {
 	return nil
 }
 
+// markTransient marks the errors of transactions that were rolled back because the database was busy as transient.
+func markTransient(err error) error {
+	var sqliteErr *sqlitedriver.Error
+	if errors.As(err, &sqliteErr) {
+		if code := sqliteErr.Code() & 0xff; code == sqlitelib.SQLITE_BUSY || code == sqlitelib.SQLITE_LOCKED {
+			return backend.TransientError(err)
+		}
+	}
+	return err
+}
+
 func (be *sqliteBackend) ensureDB() error {
 	if be.db == nil {
 		return backend.ErrNotInitialized
@@ -8,7 +8,9 @@ type TaskHubWorker interface {
 	// Start starts the backend and the configured internal workers.
 	Start(context.Context) error
 
-	// Shutdown stops the backend and all internal workers.
+	// Shutdown stops the internal workers and the backend. The workers stop fetching new work items and wait for
+	// their in-flight work items to be processed until ctx is done, after which the remaining work items are
+	// abandoned, so that they can be processed again right away, e.g. by other instances of the application.
 	Shutdown(context.Context) error
 }
 
@@ -44,13 +46,29 @@ func (w *taskHubWorker) Start(ctx context.Context) error {
 }
 
 func (w *taskHubWorker) Shutdown(ctx context.Context) error {
+	// The workers are drained concurrently, since in-flight orchestrations may be waiting for in-flight activities
+	w.logger.Info("workers stopping and draining...")
+	errs := make(chan error, 2)
+	for _, worker := range []TaskWorker{w.orchestrationWorker, w.activityWorker} {
+		go func(worker TaskWorker) {
+			errs <- worker.Drain(ctx)
+		}(worker)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			w.logger.Warnf("workers weren't drained before the shutdown deadline: %v", err)
+		}
+	}
+
+	// The backend is stopped last, so that it's still available to complete or abandon the drained work items
 	w.logger.Info("backend stopping...")
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), drainAbandonTimeout)
+		defer cancel()
+	}
 	if err := w.backend.Stop(ctx); err != nil {
 		return err
 	}
-
-	w.logger.Info("workers stopping and draining...")
-	w.orchestrationWorker.StopAndDrain()
-	w.activityWorker.StopAndDrain()
 	return nil
 }
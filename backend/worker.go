@@ -3,11 +3,18 @@ package backend
 import (
 	"context"
 	"errors"
+	"fmt"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/marusama/semaphore/v2"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
 )
 
 type TaskWorker interface {
@@ -21,6 +28,97 @@ type TaskWorker interface {
 
 	// StopAndDrain stops the worker and waits for all outstanding work items to finish.
 	StopAndDrain()
+
+	// Drain stops fetching new work items and waits for the in-flight work items to be processed until ctx is done.
+	// The processing of the work items that are still in flight at that point is cancelled, and they're abandoned,
+	// so that other workers can process them right away instead of waiting for their locks to expire. In that case,
+	// Drain waits a few more seconds for the work items to be abandoned, and returns the error of ctx.
+	Drain(ctx context.Context) error
+
+	// DebugSnapshot returns a point-in-time snapshot of the worker's internal state, such as its in-flight
+	// work items and recent errors, which embedders can expose over a debugging endpoint.
+	DebugSnapshot() WorkerDebugInfo
+
+	// CacheStats returns the statistics of the orchestration state cache of the worker, which is enabled using
+	// [WithStateCacheSize]. Zero statistics are returned if the worker doesn't cache orchestration state.
+	CacheStats() CacheStats
+
+	// InvalidateCache evicts the cached state of the specified orchestration instance, so that the state is reloaded
+	// from the backend when the next work item of the orchestration is processed. It does nothing if the worker doesn't
+	// cache orchestration state.
+	//
+	// The worker detects most stale cached states by itself, by comparing the number of cached history events with
+	// the number of events saved by the backend. Manual invalidation is only necessary after changing the saved state
+	// of an orchestration out-of-band in a way that preserves the number of history events, e.g. after editing or
+	// restoring its history directly in the backend's storage.
+	InvalidateCache(id api.InstanceID)
+}
+
+// cachingTaskProcessor is implemented by task processors that cache orchestration state.
+type cachingTaskProcessor interface {
+	cacheStats() CacheStats
+	invalidateCache(id api.InstanceID)
+}
+
+// batchingTaskProcessor is implemented by task processors that can fetch several work items at once.
+type batchingTaskProcessor interface {
+	fetchWorkItems(ctx context.Context, max int) ([]WorkItem, error)
+}
+
+// maxRecentWorkerErrors is the number of recent errors that are kept for [TaskWorker.DebugSnapshot].
+const maxRecentWorkerErrors = 10
+
+// drainAbandonTimeout is how long a stopping worker waits for each of its in-flight work items to be abandoned.
+const drainAbandonTimeout = 5 * time.Second
+
+// workItemDeferral is how long the work items that a worker can't process right now are hidden when they're deferred,
+// so that they aren't fetched again right away.
+const workItemDeferral = time.Second
+
+// unsupportedWorkItemDeferral is how long the work items of the orchestrators and activities that the executor
+// doesn't support are hidden when they're deferred, which gives a compatible executor time to connect.
+const unsupportedWorkItemDeferral = 30 * time.Second
+
+// inFlightState is the state of a work item that's being processed by a worker.
+type inFlightState struct {
+	startedAt time.Time
+
+	// cancel cancels the processing of the work item.
+	cancel context.CancelFunc
+}
+
+// WorkerDebugInfo is a serializable, point-in-time snapshot of the internal state of a [TaskWorker].
+// Unlike metrics, which are aggregates, it describes the individual work items that are being processed.
+type WorkerDebugInfo struct {
+	// Name is the name of the worker's task processor.
+	Name string `json:"name"`
+
+	// InFlight are the work items that are currently being processed, oldest first.
+	InFlight []InFlightWorkItem `json:"inFlight"`
+
+	// MaxParallelWorkItems is the maximum number of work items that the worker currently processes concurrently.
+	MaxParallelWorkItems int `json:"maxParallelWorkItems"`
+
+	// FetchBackoff is the delay before the worker polls the backend for new work items again.
+	// It's zero when the worker is actively processing work items.
+	FetchBackoff time.Duration `json:"fetchBackoff"`
+
+	// RecentErrors are the most recent errors encountered by the worker, oldest first.
+	RecentErrors []WorkerError `json:"recentErrors"`
+}
+
+// InFlightWorkItem describes a work item that's being processed by a [TaskWorker].
+type InFlightWorkItem struct {
+	InstanceID  api.InstanceID `json:"instanceId"`
+	Description string         `json:"description"`
+	StartedAt   time.Time      `json:"startedAt"`
+	Age         time.Duration  `json:"age"`
+}
+
+// WorkerError is an error that was encountered by a [TaskWorker].
+type WorkerError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
 }
 
 type TaskProcessor interface {
@@ -32,6 +130,10 @@ type TaskProcessor interface {
 }
 
 type worker struct {
+	// fetchBackoff is the current polling delay in nanoseconds, accessed atomically.
+	// It's the first field to guarantee 64-bit alignment on 32-bit platforms.
+	fetchBackoff int64
+
 	backend Backend
 	options *WorkerOptions
 	logger  Logger
@@ -46,39 +148,555 @@ type worker struct {
 	cancel    context.CancelFunc
 	processor TaskProcessor
 	waiting   bool
+
+	// completionOrder is used to complete the work items of each instance in order if OrderedCompletions is enabled.
+	completionOrder *completionOrder
+
+	// debugLock protects the state that's reported by DebugSnapshot.
+	debugLock    sync.Mutex
+	inFlight     map[WorkItem]*inFlightState
+	recentErrors []WorkerError
+
+	// stopping is true once the processing of the in-flight work items was cancelled, so that the processing of work
+	// items that are dispatched afterwards is cancelled right away. It's protected by debugLock.
+	stopping bool
 }
 
 type NewTaskWorkerOptions func(*WorkerOptions)
 
+// SuspensionBufferOverflowPolicy determines what happens when a suspended orchestration receives
+// more external events than its configured suspension buffer limits allow.
+type SuspensionBufferOverflowPolicy int
+
+const (
+	// SuspensionBufferOverflowReject drops new events that don't fit in the buffer of a suspended
+	// orchestration. Dropped events are logged together with [ErrSuspensionBufferFull], and recorded in the
+	// orchestration history as generic events, which orchestrators ignore. Clients configured with
+	// [WithRaiseEventSuspensionBufferLimits] reject these events when they're raised instead, but events sent by
+	// other orchestrations can only be dropped.
+	SuspensionBufferOverflowReject SuspensionBufferOverflowPolicy = iota
+
+	// SuspensionBufferOverflowAutoResume automatically resumes the suspended orchestration, with a warning,
+	// so that the buffered events can be delivered.
+	SuspensionBufferOverflowAutoResume
+)
+
+// InvalidStatePolicy determines what the orchestration worker does with a work item for an orchestration whose saved
+// state is invalid, which usually indicates corruption in the backend.
+type InvalidStatePolicy int
+
+const (
+	// InvalidStateDrop logs a warning and drops the new events of the work item.
+	InvalidStateDrop InvalidStatePolicy = iota
+
+	// InvalidStateFail marks the orchestration as failed with [ErrInvalidOrchestrationState] as the failure reason.
+	InvalidStateFail
+
+	// InvalidStateQuarantine moves the new events to the dead-letter store of the backend, so that they're kept until
+	// the state of the orchestration is repaired and they're resubmitted with [TaskHubClient.ResubmitDeadLetter]. The
+	// quarantine is logged as an error, shows up in [TaskWorker.DebugSnapshot], is counted by the
+	// durabletask.workitem.quarantined metric, and is reported to the [InvalidStateAlert] configured with
+	// [WithInvalidStateAlert]. Backends that don't implement [BackendWithDeadLetters] can't quarantine work items, so
+	// the work item is abandoned and retried instead.
+	InvalidStateQuarantine
+)
+
+// InvalidStateAlert is called by the orchestration worker when it quarantines a work item because the saved state of
+// its orchestration is invalid, e.g. to page an operator. It's called synchronously, so it should return quickly.
+type InvalidStateAlert func(ctx context.Context, id api.InstanceID, err error)
+
+// EmptyWorkItemPolicy determines what the orchestration worker does with a work item that has no new events.
+//
+// Empty work items legitimately occur with backends that wake up orchestrations without delivering an event, e.g.
+// backends that implement durable timers by making the orchestration visible again when the timer fires instead of
+// enqueueing a TimerFired event, and when a work item is delivered again after its events were committed by a worker
+// whose lock had expired. With backends that always deliver at least one event, like the sqlite backend, they
+// indicate a bug, e.g. events that are lost between being enqueued and being fetched.
+type EmptyWorkItemPolicy int
+
+const (
+	// EmptyWorkItemWarn logs a warning and processes the work item, which records an orchestrator-started event in
+	// the history without executing the orchestrator.
+	EmptyWorkItemWarn EmptyWorkItemPolicy = iota
+
+	// EmptyWorkItemDrop completes the work item without changing the orchestration.
+	EmptyWorkItemDrop
+
+	// EmptyWorkItemError fails the work item with [ErrEmptyWorkItem], so that it's logged as an error and shows up in
+	// [TaskWorker.DebugSnapshot].
+	EmptyWorkItemError
+)
+
+// ContinueAsNewLimitPolicy determines what the orchestration worker does when an orchestration continues-as-new more
+// times than [WorkerOptions.MaxContinueAsNewCount] while processing a single work item.
+type ContinueAsNewLimitPolicy int
+
+const (
+	// ContinueAsNewLimitFail fails the work item, so that it's retried later. Orchestrations that always
+	// continue-as-new without awaiting anything are stuck until their code is fixed.
+	ContinueAsNewLimitFail ContinueAsNewLimitPolicy = iota
+
+	// ContinueAsNewLimitYield completes the work item with the state of the latest generation, and schedules a new
+	// work item that executes it, so that orchestrations that legitimately continue-as-new at a high frequency keep
+	// running without holding the lock of the orchestration for too long.
+	ContinueAsNewLimitYield
+)
+
+// ActivityHeartbeatTimeoutPolicy determines what the activity worker does with an activity that stopped recording
+// heartbeats for longer than the timeout configured by [WithActivityHeartbeatTimeout].
+type ActivityHeartbeatTimeoutPolicy int
+
+const (
+	// ActivityHeartbeatTimeoutFail fails the activity with an "ActivityHeartbeatTimeout" error, which the
+	// orchestration can handle, e.g. using a retry policy.
+	ActivityHeartbeatTimeoutFail ActivityHeartbeatTimeoutPolicy = iota
+
+	// ActivityHeartbeatTimeoutAbandon abandons the work item of the activity, so that the activity is executed again.
+	ActivityHeartbeatTimeoutAbandon
+)
+
+// OrchestrationTimeoutPolicy determines what the orchestration worker does with an orchestration that didn't complete
+// within the timeout configured by [api.WithOrchestrationTimeout].
+type OrchestrationTimeoutPolicy int
+
+const (
+	// OrchestrationTimeoutTerminate terminates the orchestration and its sub-orchestrations, like
+	// [TaskHubClient.TerminateOrchestration].
+	OrchestrationTimeoutTerminate OrchestrationTimeoutPolicy = iota
+
+	// OrchestrationTimeoutFail fails the orchestration with an "OrchestrationTimeout" error, which parent
+	// orchestrations receive as a sub-orchestration failure.
+	OrchestrationTimeoutFail
+)
+
 type WorkerOptions struct {
 	MaxParallelWorkItems int32
+
+	// AutoConcurrencyMultiplier, if greater than zero, scales the work item limit with runtime.GOMAXPROCS(0).
+	AutoConcurrencyMultiplier float64
+
+	// maxParallelismSet is true if MaxParallelWorkItems was explicitly configured.
+	maxParallelismSet bool
+
+	// MaxConcurrentOrchestrationWorkItems, if greater than zero, overrides MaxParallelWorkItems for orchestration workers.
+	MaxConcurrentOrchestrationWorkItems int32
+
+	// MaxConcurrentActivityWorkItems, if greater than zero, overrides MaxParallelWorkItems for activity workers.
+	MaxConcurrentActivityWorkItems int32
+
+	// FetchBatchSize is the maximum number of work items that the worker fetches from the backend at once.
+	FetchBatchSize int
+
+	// MaxCompletionRetries is the number of times a completion that fails with [ErrTransient] is retried.
+	MaxCompletionRetries int
+
+	// CompletionRetryInterval is the initial delay between completion retries, which grows exponentially.
+	CompletionRetryInterval time.Duration
+
+	// PersistLastActions configures whether the actions of the latest orchestrator execution are saved.
+	PersistLastActions bool
+
+	// MaxSuspendedEventCount, if greater than zero, limits the number of events buffered for a suspended orchestration.
+	MaxSuspendedEventCount int
+
+	// MaxSuspendedEventBytes, if greater than zero, limits the size of the events buffered for a suspended orchestration.
+	MaxSuspendedEventBytes int
+
+	// SuspensionBufferOverflowPolicy determines what happens when either of the suspension buffer limits is exceeded.
+	SuspensionBufferOverflowPolicy SuspensionBufferOverflowPolicy
+
+	// CustomStatusValidators are the custom status validators registered for each orchestration name.
+	CustomStatusValidators map[string]CustomStatusValidator
+
+	// MaxCustomStatusSize, if greater than zero, limits the size, in bytes, of the serialized custom status.
+	MaxCustomStatusSize int
+
+	// StateCacheSize is the number of orchestration runtime states that are cached between work items.
+	StateCacheSize int
+
+	// TimestampSource provides the timestamps of the history events that the worker creates.
+	TimestampSource TimestampSource
+
+	// ContinueAsNewInputTransform, if set, is applied to the input carried over by continue-as-new.
+	ContinueAsNewInputTransform ContinueAsNewInputTransform
+
+	// InvalidStatePolicy determines how work items for orchestrations with an invalid state are handled.
+	InvalidStatePolicy InvalidStatePolicy
+
+	// InvalidStateAlert, if set, is called when a work item is quarantined because of InvalidStateQuarantine.
+	InvalidStateAlert InvalidStateAlert
+
+	// MaxContinueAsNewCount, if greater than zero, limits the continue-as-new loops of a single work item.
+	MaxContinueAsNewCount int
+
+	// ContinueAsNewLimitPolicy determines what happens when MaxContinueAsNewCount is exceeded.
+	ContinueAsNewLimitPolicy ContinueAsNewLimitPolicy
+
+	// OrchestrationTimeoutPolicy determines what happens to orchestrations that exceed their execution timeout.
+	OrchestrationTimeoutPolicy OrchestrationTimeoutPolicy
+
+	// ActivityHeartbeatTimeout, if greater than zero, is how long to wait for the next heartbeat of an activity.
+	ActivityHeartbeatTimeout time.Duration
+
+	// ActivityHeartbeatTimeoutPolicy determines what happens to activities that exceed ActivityHeartbeatTimeout.
+	ActivityHeartbeatTimeoutPolicy ActivityHeartbeatTimeoutPolicy
+
+	// ActivityQueues are the queues that the activity worker fetches work items from.
+	ActivityQueues []string
+
+	// ActivityConcurrencyLimits are the maximum numbers of concurrent activities of specific names.
+	ActivityConcurrencyLimits map[string]int
+
+	// ActivityCancellationPollingInterval is how often the orchestrations of running activities are checked.
+	ActivityCancellationPollingInterval time.Duration
+
+	// EmptyWorkItemPolicy determines how orchestration work items without new events are handled.
+	EmptyWorkItemPolicy EmptyWorkItemPolicy
+
+	// CircuitBreaker, if set, pauses the processing of orchestrations whose names fail at a high rate.
+	CircuitBreaker *CircuitBreaker
+
+	// OrderedCompletions configures whether the work items of an instance are completed in the order they were fetched.
+	OrderedCompletions bool
+
+	// MaxDeliveryCount, if greater than zero, is the number of deliveries after which a work item is dead-lettered.
+	MaxDeliveryCount int
+
+	// LockRenewalInterval, if greater than zero, is how often the locks on the work items being processed are renewed.
+	LockRenewalInterval time.Duration
+
+	// PollingInitialInterval is the delay before the next poll after the first poll that found no work items.
+	PollingInitialInterval time.Duration
+
+	// PollingMaxInterval is the maximum delay between polls of the backend while it has no work items.
+	PollingMaxInterval time.Duration
+
+	// PollingMultiplier is the factor by which the delay between polls grows after each poll that finds no work items.
+	PollingMultiplier float64
+
+	// PollingJitter is the fraction of the delay between polls that is randomized.
+	PollingJitter float64
+}
+
+// TimestampSource provides the current time for the history events that workers create, such as the
+// orchestrator-started event, which determines the current time reported to orchestrators, and the events created for
+// the actions of orchestrators. Distributed
+// backends with a shared time authority can use it to reduce clock-skew-induced ordering issues across workers.
+//
+// Implementations must be safe for concurrent use. Now is called at least once for every orchestration work item,
+// so it should be cheap, for example by caching the offset between the local clock and the time authority. If Now
+// returns an error, the worker logs a warning and falls back to the local clock.
+type TimestampSource interface {
+	Now(ctx context.Context) (time.Time, error)
+}
+
+// localTimestampSource is the default TimestampSource, which uses the local clock.
+type localTimestampSource struct{}
+
+func (localTimestampSource) Now(context.Context) (time.Time, error) {
+	return time.Now(), nil
 }
 
 func NewWorkerOptions() *WorkerOptions {
 	return &WorkerOptions{
-		MaxParallelWorkItems: 1,
+		MaxParallelWorkItems:    1,
+		MaxCompletionRetries:    3,
+		CompletionRetryInterval: 100 * time.Millisecond,
+		TimestampSource:         localTimestampSource{},
+		MaxContinueAsNewCount:   20,
+		PollingInitialInterval:  50 * time.Millisecond,
+		PollingMaxInterval:      5 * time.Second,
+		PollingMultiplier:       1.05,
+		PollingJitter:           0.05,
 	}
 }
 
 func WithMaxParallelism(n int32) NewTaskWorkerOptions {
 	return func(o *WorkerOptions) {
 		o.MaxParallelWorkItems = n
+		o.maxParallelismSet = true
+	}
+}
+
+// WithMaxConcurrentOrchestrationWorkItems limits the number of concurrent work items of orchestration workers.
+func WithMaxConcurrentOrchestrationWorkItems(n int32) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxConcurrentOrchestrationWorkItems = n
+	}
+}
+
+// WithMaxConcurrentActivityWorkItems limits the number of concurrent work items of activity workers.
+func WithMaxConcurrentActivityWorkItems(n int32) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxConcurrentActivityWorkItems = n
+	}
+}
+
+// WithAutoConcurrency sets the work item limit to runtime.GOMAXPROCS(0) times the specified multiplier.
+func WithAutoConcurrency(multiplier float64) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.AutoConcurrencyMultiplier = multiplier
+	}
+}
+
+// autoConcurrencyLimit returns the maximum number of concurrent work items for the specified GOMAXPROCS value.
+func (o *WorkerOptions) autoConcurrencyLimit(procs int) int {
+	limit := int(float64(procs) * o.AutoConcurrencyMultiplier)
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// maxConcurrentWorkItems returns the concurrency limit that's specific to the kind of work items of the specified
+// task processor, or zero if there isn't any.
+func (o *WorkerOptions) maxConcurrentWorkItems(p TaskProcessor) int32 {
+	switch p.(type) {
+	case *orchestratorProcessor:
+		return o.MaxConcurrentOrchestrationWorkItems
+	case *activityProcessor:
+		return o.MaxConcurrentActivityWorkItems
+	default:
+		return 0
+	}
+}
+
+// usesAutoConcurrency returns true if the concurrency limit is derived from GOMAXPROCS.
+func (o *WorkerOptions) usesAutoConcurrency() bool {
+	return o.AutoConcurrencyMultiplier > 0 && !o.maxParallelismSet
+}
+
+// WithFetchBatchSize configures the worker to fetch up to n work items from the backend in a single round trip.
+func WithFetchBatchSize(n int) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.FetchBatchSize = n
+	}
+}
+
+// WithCompletionRetries configures the retries of the work item completions that fail with [ErrTransient].
+// The sqlite, postgres, and mysql backends report the transactions that the database rolled back because of lock
+// contention, serialization failures, or deadlocks as transient, and the redis backend reports the transactions that
+// conflicted too many times with concurrent transactions.
+func WithCompletionRetries(maxRetries int, initialInterval time.Duration) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxCompletionRetries = maxRetries
+		o.CompletionRetryInterval = initialInterval
+	}
+}
+
+// WithPersistLastActions configures the orchestration worker to save the actions of the latest orchestrator execution.
+func WithPersistLastActions(enabled bool) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.PersistLastActions = enabled
+	}
+}
+
+// WithSuspensionBufferLimits limits the events buffered for suspended orchestrations, where zero means no limit.
+func WithSuspensionBufferLimits(maxEvents int, maxBytes int, policy SuspensionBufferOverflowPolicy) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxSuspendedEventCount = maxEvents
+		o.MaxSuspendedEventBytes = maxBytes
+		o.SuspensionBufferOverflowPolicy = policy
+	}
+}
+
+// WithCustomStatusValidator registers a validator for the custom status values of the named orchestration.
+func WithCustomStatusValidator(orchestrationName string, validator CustomStatusValidator) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		if o.CustomStatusValidators == nil {
+			o.CustomStatusValidators = make(map[string]CustomStatusValidator)
+		}
+		o.CustomStatusValidators[orchestrationName] = validator
+	}
+}
+
+// WithMaxCustomStatusSize limits the size, in bytes, of the serialized custom status values of orchestrations.
+func WithMaxCustomStatusSize(maxBytes int) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxCustomStatusSize = maxBytes
+	}
+}
+
+// WithStateCacheSize configures the orchestration worker to cache up to size runtime states between work items.
+func WithStateCacheSize(size int) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.StateCacheSize = size
+	}
+}
+
+// WithTimestampSource configures the source of the timestamps of the history events created by the worker.
+func WithTimestampSource(ts TimestampSource) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.TimestampSource = ts
+	}
+}
+
+// WithContinueAsNewInputTransform configures a deterministic transform of the input carried over by continue-as-new.
+func WithContinueAsNewInputTransform(transform ContinueAsNewInputTransform) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ContinueAsNewInputTransform = transform
+	}
+}
+
+// WithInvalidStatePolicy configures how work items for orchestrations with an invalid state are handled.
+func WithInvalidStatePolicy(policy InvalidStatePolicy) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.InvalidStatePolicy = policy
+	}
+}
+
+// WithInvalidStateAlert configures a callback for the work items quarantined because of [InvalidStateQuarantine].
+func WithInvalidStateAlert(alert InvalidStateAlert) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.InvalidStateAlert = alert
+	}
+}
+
+// WithEmptyWorkItemPolicy configures how the orchestration worker handles work items without new events.
+func WithEmptyWorkItemPolicy(policy EmptyWorkItemPolicy) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.EmptyWorkItemPolicy = policy
+	}
+}
+
+// WithCircuitBreaker defers the work items of orchestrations whose circuit is open.
+func WithCircuitBreaker(cb *CircuitBreaker) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.CircuitBreaker = cb
+	}
+}
+
+// WithMaxContinueAsNewCount configures how many times an orchestration can continue-as-new within one work item.
+func WithMaxContinueAsNewCount(n int) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxContinueAsNewCount = n
+	}
+}
+
+// WithContinueAsNewLimitPolicy configures what happens when [WithMaxContinueAsNewCount] is exceeded.
+func WithContinueAsNewLimitPolicy(policy ContinueAsNewLimitPolicy) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ContinueAsNewLimitPolicy = policy
+	}
+}
+
+// WithOrchestrationTimeoutPolicy configures what happens to orchestrations that exceed their execution timeout.
+func WithOrchestrationTimeoutPolicy(policy OrchestrationTimeoutPolicy) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.OrchestrationTimeoutPolicy = policy
+	}
+}
+
+// WithActivityHeartbeatTimeout configures how long the activity worker waits for the next heartbeat of an activity.
+func WithActivityHeartbeatTimeout(timeout time.Duration) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ActivityHeartbeatTimeout = timeout
+	}
+}
+
+// WithActivityHeartbeatTimeoutPolicy configures what happens to activities that exceed their heartbeat timeout.
+func WithActivityHeartbeatTimeoutPolicy(policy ActivityHeartbeatTimeoutPolicy) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ActivityHeartbeatTimeoutPolicy = policy
+	}
+}
+
+// WithActivityQueues configures the queues that the activity worker fetches work items from.
+func WithActivityQueues(queues ...string) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ActivityQueues = append([]string(nil), queues...)
+	}
+}
+
+// WithActivityConcurrencyLimits configures the maximum numbers of concurrent activities of specific names.
+func WithActivityConcurrencyLimits(limits map[string]int) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ActivityConcurrencyLimits = make(map[string]int, len(limits))
+		for name, limit := range limits {
+			o.ActivityConcurrencyLimits[name] = limit
+		}
+	}
+}
+
+// WithActivityCancellation periodically cancels the running activities of completed orchestrations.
+func WithActivityCancellation(pollingInterval time.Duration) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.ActivityCancellationPollingInterval = pollingInterval
+	}
+}
+
+// WithOrderedCompletions completes the work items of an orchestration instance in the order they were fetched.
+func WithOrderedCompletions(enabled bool) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.OrderedCompletions = enabled
+	}
+}
+
+// WithMaxDeliveryCount moves the work items that were delivered n times without completing to the dead-letter store.
+func WithMaxDeliveryCount(n int) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.MaxDeliveryCount = n
+	}
+}
+
+// WithLockRenewalInterval configures how often the locks on the work items being processed are renewed.
+func WithLockRenewalInterval(interval time.Duration) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		o.LockRenewalInterval = interval
+	}
+}
+
+// WithPollingBackoff configures how the delay between polls grows while the backend has no work items.
+func WithPollingBackoff(initialInterval, maxInterval time.Duration, multiplier, jitter float64) NewTaskWorkerOptions {
+	return func(o *WorkerOptions) {
+		if initialInterval > 0 {
+			o.PollingInitialInterval = initialInterval
+		}
+		if maxInterval > 0 {
+			o.PollingMaxInterval = maxInterval
+		}
+		if multiplier >= 1 {
+			o.PollingMultiplier = multiplier
+		}
+		if jitter >= 0 && jitter <= 1 {
+			o.PollingJitter = jitter
+		}
 	}
 }
 
 func NewTaskWorker(be Backend, p TaskProcessor, logger Logger, opts ...NewTaskWorkerOptions) TaskWorker {
-	options := &WorkerOptions{MaxParallelWorkItems: 1}
+	options := NewWorkerOptions()
 	for _, configure := range opts {
 		configure(options)
 	}
+	if limit := options.maxConcurrentWorkItems(p); limit > 0 {
+		options.MaxParallelWorkItems = limit
+		options.maxParallelismSet = true
+	}
+	if _, ok := As[BackendWithDeadLetters](be); options.MaxDeliveryCount > 0 && !ok {
+		logger.Warnf("%v: the backend doesn't support dead letters, so the maximum delivery count is ignored", p.Name())
+	}
+	if _, ok := As[BackendWithDeadLetters](be); options.InvalidStatePolicy == InvalidStateQuarantine && !ok {
+		logger.Warnf("%v: the backend doesn't support dead letters, so work items for invalid orchestration states are retried instead of quarantined", p.Name())
+	}
+	if _, ok := As[BackendWithLockRenewal](be); options.LockRenewalInterval > 0 && !ok {
+		logger.Warnf("%v: the backend doesn't support lock renewal, so the locks on work items aren't renewed", p.Name())
+		options.LockRenewalInterval = 0
+	}
+	maxParallelWorkItems := int(options.MaxParallelWorkItems)
+	if options.usesAutoConcurrency() {
+		maxParallelWorkItems = options.autoConcurrencyLimit(runtime.GOMAXPROCS(0))
+	}
 	return &worker{
 		backend:           be,
 		processor:         p,
 		logger:            logger,
-		dispatchSemaphore: semaphore.New(int(options.MaxParallelWorkItems)),
+		dispatchSemaphore: semaphore.New(maxParallelWorkItems),
 		pending:           &sync.WaitGroup{},
 		cancel:            nil, // assigned later
 		options:           options,
+		inFlight:          make(map[WorkItem]*inFlightState),
+		completionOrder:   newCompletionOrder(),
 	}
 }
 
@@ -88,15 +706,17 @@ func (w *worker) Name() string {
 
 func (w *worker) Start(ctx context.Context) {
 	// TODO: Check for already started worker
+	// Only the polling is stopped by cancel, so that the work items that were already fetched can be drained
+	processCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	w.cancel = cancel
 
 	go func() {
 		var b backoff.BackOff = &backoff.ExponentialBackOff{
-			InitialInterval:     50 * time.Millisecond,
-			MaxInterval:         5 * time.Second,
-			Multiplier:          1.05,
-			RandomizationFactor: 0.05,
+			InitialInterval:     w.options.PollingInitialInterval,
+			MaxInterval:         w.options.PollingMaxInterval,
+			Multiplier:          w.options.PollingMultiplier,
+			RandomizationFactor: w.options.PollingJitter,
 			Stop:                backoff.Stop,
 			Clock:               backoff.SystemClock,
 		}
@@ -106,12 +726,13 @@ func (w *worker) Start(ctx context.Context) {
 	loop:
 		for {
 			// returns right away, with "ok" if a work item was found
-			ok, err := w.ProcessNext(ctx)
+			ok, err := w.processNext(ctx, processCtx)
 
 			switch {
 			case ok:
 				// found a work item - reset the backoff and check for the next item
 				b.Reset()
+				atomic.StoreInt64(&w.fetchBackoff, 0)
 			case err != nil && errors.Is(err, ctx.Err()):
 				// there's an error and it's due to the context being canceled
 				w.logger.Infof("%v: received cancellation signal", w.Name())
@@ -120,6 +741,7 @@ func (w *worker) Start(ctx context.Context) {
 				// another error was encountered
 				// log the error and inject some extra sleep to avoid tight failure loops
 				w.logger.Errorf("unexpected worker error: %v. Adding 5 extra seconds of backoff.", err)
+				atomic.StoreInt64(&w.fetchBackoff, int64(5*time.Second))
 				t := time.NewTimer(5 * time.Second)
 				select {
 				case <-t.C:
@@ -133,7 +755,9 @@ func (w *worker) Start(ctx context.Context) {
 				}
 			default:
 				// no work item found, so sleep until the next backoff
-				t := time.NewTimer(b.NextBackOff())
+				delay := b.NextBackOff()
+				atomic.StoreInt64(&w.fetchBackoff, int64(delay))
+				t := time.NewTimer(delay)
 				select {
 				case <-t.C:
 					// nop - all good
@@ -152,6 +776,15 @@ func (w *worker) Start(ctx context.Context) {
 }
 
 func (w *worker) ProcessNext(ctx context.Context) (bool, error) {
+	return w.processNext(ctx, ctx)
+}
+
+// processNext is like ProcessNext, but processes the fetched work items with processCtx, which isn't cancelled when
+// the worker stops polling for new work items.
+func (w *worker) processNext(ctx context.Context, processCtx context.Context) (bool, error) {
+	if w.options.usesAutoConcurrency() {
+		w.adjustConcurrency()
+	}
 	if !w.dispatchSemaphore.TryAcquire(1) {
 		w.logger.Debugf("%v: waiting for one of %v in-flight execution(s) to complete", w.Name(), w.dispatchSemaphore.GetCount())
 		if err := w.dispatchSemaphore.Acquire(ctx, 1); err != nil {
@@ -159,18 +792,36 @@ func (w *worker) ProcessNext(ctx context.Context) (bool, error) {
 			return false, err
 		}
 	}
-	w.pending.Add(1)
 
-	processing := false
+	// Batches are limited to the number of work items that can be processed right away
+	reserved := 1
+	batching, canBatch := w.processor.(batchingTaskProcessor)
+	if canBatch {
+		for reserved < w.options.FetchBatchSize && w.dispatchSemaphore.TryAcquire(1) {
+			reserved++
+		}
+	}
+	w.pending.Add(reserved)
+
+	processing := 0
 	defer func() {
-		if !processing {
-			w.pending.Done()
-			w.dispatchSemaphore.Release(1)
+		if unused := reserved - processing; unused > 0 {
+			w.pending.Add(-unused)
+			w.dispatchSemaphore.Release(unused)
 		}
 	}()
 
-	wi, err := w.processor.FetchWorkItem(ctx)
-	if err == ErrNoWorkItems || wi == nil {
+	var wis []WorkItem
+	var err error
+	if reserved > 1 {
+		wis, err = batching.fetchWorkItems(ctx, reserved)
+	} else {
+		var wi WorkItem
+		if wi, err = w.processor.FetchWorkItem(ctx); wi != nil {
+			wis = []WorkItem{wi}
+		}
+	}
+	if err == ErrNoWorkItems || (err == nil && len(wis) == 0) {
 		if !w.waiting {
 			w.logger.Debugf("%v: waiting for new work items...", w.Name())
 			w.waiting = true
@@ -179,51 +830,433 @@ func (w *worker) ProcessNext(ctx context.Context) (bool, error) {
 	} else if err != nil {
 		if !errors.Is(err, ctx.Err()) {
 			w.logger.Errorf("%v: failed to fetch work item: %v", w.Name(), err)
+			w.recordError("failed to fetch work item", err)
 		}
 		return false, err
 	} else {
-		// process the work-item in the background
+		// process the work-items in the background
 		w.waiting = false
-		processing = true
-		go w.processWorkItem(ctx, wi)
+		for _, wi := range wis {
+			processing++
+			var slot *completionSlot
+			if w.options.OrderedCompletions {
+				// The slot is reserved before processing starts, so that slots are reserved in the order of fetching
+				slot = w.completionOrder.reserve(getWorkItemInstanceID(wi))
+			}
+			go w.processWorkItem(processCtx, wi, slot)
+		}
 		return true, nil
 	}
 }
 
+// adjustConcurrency updates the concurrency limit of the worker if GOMAXPROCS changed since it was computed.
+func (w *worker) adjustConcurrency() {
+	limit := w.options.autoConcurrencyLimit(runtime.GOMAXPROCS(0))
+	if current := w.dispatchSemaphore.GetLimit(); limit != current {
+		w.logger.Infof("%v: GOMAXPROCS changed, adjusting max parallel work items from %d to %d", w.Name(), current, limit)
+		w.dispatchSemaphore.SetLimit(limit)
+	}
+}
+
+// abandonWorkItem releases the lock on a work item so that it can be picked up by this or another worker. If the
+// worker is shutting down, the abandon is done with a detached context so that the work item is released
+// immediately instead of remaining locked until its lock expires.
+func (w *worker) abandonWorkItem(ctx context.Context, wi WorkItem) {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), drainAbandonTimeout)
+		defer cancel()
+	}
+	if err := w.processor.AbandonWorkItem(ctx, wi); err != nil {
+		w.logger.Errorf("%v: failed to abandon work item: %v", w.Name(), err)
+		w.recordError("failed to abandon work item "+wi.Description(), err)
+	}
+}
+
+// deferWorkItem releases a work item that the worker can't process right now. The delivery of the work item isn't
+// counted if the backend implements [BackendWithDeferrals], so that deferred work items aren't dead-lettered, and
+// the work item is hidden for the delay. The work items of other backends are abandoned.
+func (w *worker) deferWorkItem(ctx context.Context, wi WorkItem, delay time.Duration) {
+	be, ok := As[BackendWithDeferrals](w.backend)
+	if !ok {
+		w.abandonWorkItem(ctx, wi)
+		return
+	}
+
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), drainAbandonTimeout)
+		defer cancel()
+	}
+	var err error
+	switch wi := wi.(type) {
+	case *OrchestrationWorkItem:
+		err = be.DeferOrchestrationWorkItem(ctx, wi, delay)
+	case *ActivityWorkItem:
+		err = be.DeferActivityWorkItem(ctx, wi, delay)
+	default:
+		err = fmt.Errorf("unexpected work item type: %T", wi)
+	}
+	if err != nil {
+		w.logger.Errorf("%v: failed to defer work item: %v", w.Name(), err)
+		w.recordError("failed to defer work item "+wi.Description(), err)
+	}
+}
+
+// startLockRenewal renews the lock on the work item in the background, until the returned function is called or the
+// lock is lost.
+func (w *worker) startLockRenewal(ctx context.Context, wi WorkItem) func() {
+	if w.options.LockRenewalInterval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(w.options.LockRenewalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := w.renewLock(ctx, wi)
+			if err == nil || ctx.Err() != nil {
+				continue
+			} else if errors.Is(err, ErrWorkItemLockLost) {
+				w.logger.Warnf("%v: lost the lock on work item %s while processing it", w.Name(), wi.Description())
+				w.recordError("lost the lock on work item "+wi.Description(), err)
+				return
+			}
+			// The lock is renewed again on the next tick, well before it expires
+			w.logger.Warnf("%v: failed to renew the lock on work item %s: %v", w.Name(), wi.Description(), err)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (w *worker) renewLock(ctx context.Context, wi WorkItem) error {
+	renewer, ok := As[BackendWithLockRenewal](w.backend)
+	if !ok {
+		return nil
+	}
+	switch wi := wi.(type) {
+	case *OrchestrationWorkItem:
+		return renewer.RenewOrchestrationWorkItemLock(ctx, wi)
+	case *ActivityWorkItem:
+		return renewer.RenewActivityWorkItemLock(ctx, wi)
+	default:
+		return nil
+	}
+}
+
+// isPoisonWorkItem returns true if the work item was already processed the maximum number of times and can be moved
+// to the dead-letter store of the backend.
+func (w *worker) isPoisonWorkItem(wi WorkItem) bool {
+	if w.options.MaxDeliveryCount <= 0 {
+		return false
+	}
+	if _, ok := As[BackendWithDeadLetters](w.backend); !ok {
+		return false
+	}
+	return int(getWorkItemRetryCount(wi)) >= w.options.MaxDeliveryCount
+}
+
+// quarantineWorkItem moves a work item for an orchestration whose state is invalid to the dead-letter store of the
+// backend and alerts about it. The work item is abandoned if the backend doesn't support dead letters.
+func (w *worker) quarantineWorkItem(ctx context.Context, wi WorkItem, err error) {
+	w.logger.Errorf("%v: quarantining work item: %v", w.Name(), err)
+	w.recordError("quarantined work item "+wi.Description(), err)
+	helpers.AddQuarantinedWorkItem(ctx, w.Name())
+	if alert := w.options.InvalidStateAlert; alert != nil {
+		alert(ctx, getWorkItemInstanceID(wi), err)
+	}
+
+	if _, ok := As[BackendWithDeadLetters](w.backend); !ok {
+		w.abandonWorkItem(ctx, wi)
+		return
+	}
+	w.deadLetterWorkItem(ctx, wi, err.Error())
+}
+
+// deadLetterWorkItem moves a work item to the dead-letter store of the backend with the specified reason, or abandons
+// it if that fails.
+func (w *worker) deadLetterWorkItem(ctx context.Context, wi WorkItem, reason string) {
+	be, _ := As[BackendWithDeadLetters](w.backend)
+	w.logger.Warnf("%v: moving work item %s to the dead-letter store: %s", w.Name(), wi.Description(), reason)
+
+	var err error
+	switch wi := wi.(type) {
+	case *OrchestrationWorkItem:
+		err = be.DeadLetterOrchestrationWorkItem(ctx, wi, reason)
+	case *ActivityWorkItem:
+		err = be.DeadLetterActivityWorkItem(ctx, wi, reason)
+	default:
+		err = fmt.Errorf("unexpected work item type: %T", wi)
+	}
+	if err != nil {
+		w.logger.Errorf("%v: failed to dead-letter work item: %v", w.Name(), err)
+		w.recordError("failed to dead-letter work item "+wi.Description(), err)
+		w.abandonWorkItem(ctx, wi)
+	}
+}
+
 func (w *worker) StopAndDrain() {
-	// Cancel the background poller and dispatcher(s)
+	// Cancel the background poller and dispatcher(s), and the processing of the outstanding work-items
 	if w.cancel != nil {
 		w.cancel()
+		w.cancelInFlight()
 	}
 
-	// Wait for outstanding work-items to finish processing.
+	// Wait for outstanding work-items to be abandoned.
 	// TODO: Need to find a way to cancel this if it takes too long for some reason.
 	w.pending.Wait()
 }
 
-func (w *worker) processWorkItem(ctx context.Context, wi WorkItem) {
+// Drain implements TaskWorker
+func (w *worker) Drain(ctx context.Context) error {
+	if w.cancel != nil {
+		w.cancel()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	w.debugLock.Lock()
+	remaining := len(w.inFlight)
+	w.debugLock.Unlock()
+	w.logger.Warnf("%v: abandoning %d work item(s) that weren't processed before the drain deadline", w.Name(), remaining)
+	w.cancelInFlight()
+
+	// Work items whose processing ignores the cancellation can't be abandoned, and are left locked until their
+	// locks expire
+	t := time.NewTimer(drainAbandonTimeout)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+		w.logger.Warnf("%v: timed out waiting for work items to be abandoned", w.Name())
+	}
+	return ctx.Err()
+}
+
+// cancelInFlight cancels the processing of the in-flight work items, and of the work items that are dispatched
+// afterwards.
+func (w *worker) cancelInFlight() {
+	w.debugLock.Lock()
+	defer w.debugLock.Unlock()
+	w.stopping = true
+	for _, state := range w.inFlight {
+		state.cancel()
+	}
+}
+
+func (w *worker) processWorkItem(ctx context.Context, wi WorkItem, slot *completionSlot) {
 	defer w.dispatchSemaphore.Release(1)
 	defer w.pending.Done()
+	defer slot.release()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.trackInFlight(wi, cancel)
+	defer w.untrackInFlight(wi)
 
 	w.logger.Debugf("%v: processing work item: %s", w.Name(), wi.Description())
 
-	if err := w.processor.ProcessWorkItem(ctx, wi); err != nil {
+	if w.isPoisonWorkItem(wi) {
+		slot.wait()
+		w.deadLetterWorkItem(ctx, wi, fmt.Sprintf("the work item was processed %d time(s) without being completed", getWorkItemRetryCount(wi)))
+		return
+	}
+
+	stopLockRenewal := w.startLockRenewal(ctx, wi)
+	err := w.processor.ProcessWorkItem(ctx, wi)
+
+	// Wait for the previously fetched work items of the same instance to be completed or abandoned
+	slot.wait()
+	stopLockRenewal()
+
+	if errors.Is(err, ErrUnsupportedByExecutor) {
+		w.logger.Warnf("%v: skipping work item: %v", w.Name(), err)
+		w.recordError("skipped work item "+wi.Description(), err)
+		// Backends that can't defer the work item abandon it, so that it isn't left locked until its lock expires
+		w.deferWorkItem(ctx, wi, unsupportedWorkItemDeferral)
+		return
+	} else if errors.Is(err, ErrCircuitOpen) {
+		w.logger.Warnf("%v: pausing work item: %v", w.Name(), err)
+		w.deferWorkItem(ctx, wi, workItemDeferral)
+		return
+	} else if errors.Is(err, ErrInvalidOrchestrationState) {
+		w.quarantineWorkItem(ctx, wi, err)
+		return
+	} else if errors.Is(err, ErrActivityConcurrencyLimit) || errors.Is(err, ErrActivityQueueNotServed) {
+		w.logger.Debugf("%v: deferring work item: %v", w.Name(), err)
+		w.deferWorkItem(ctx, wi, workItemDeferral)
+		return
+	} else if err != nil {
 		if errors.Is(err, ctx.Err()) {
 			w.logger.Warnf("%v: abandoning work item due to cancellation", w.Name())
 		} else {
 			w.logger.Errorf("%v: failed to process work item: %v", w.Name(), err)
+			w.recordError("failed to process work item "+wi.Description(), err)
 		}
-		if err := w.processor.AbandonWorkItem(ctx, wi); err != nil {
-			w.logger.Errorf("%v: failed to abandon work item: %v", w.Name(), err)
-		}
+		w.abandonWorkItem(ctx, wi)
+		return
+	} else if ctx.Err() != nil {
+		// The worker is shutting down and the result may have been affected by the cancellation, so release
+		// the work item to be processed again by another worker instead of committing it.
+		w.logger.Warnf("%v: abandoning work item due to cancellation", w.Name())
+		w.abandonWorkItem(ctx, wi)
+		return
 	}
 
-	if err := w.processor.CompleteWorkItem(ctx, wi); err != nil {
+	if err := w.completeWorkItem(ctx, wi); err != nil {
 		w.logger.Errorf("%v: failed to complete work item: %v", w.Name(), err)
-		if err := w.processor.AbandonWorkItem(ctx, wi); err != nil {
-			w.logger.Errorf("%v: failed to abandon work item: %v", w.Name(), err)
-		}
+		w.recordError("failed to complete work item "+wi.Description(), err)
+		w.abandonWorkItem(ctx, wi)
+		return
 	}
 
 	w.logger.Debugf("%v: work item processed successfully", w.Name())
 }
+
+// completeWorkItem completes a processed work item, retrying with backoff if the backend returns
+// an error that isn't expected to be permanent.
+func (w *worker) completeWorkItem(ctx context.Context, wi WorkItem) error {
+	if w.options.MaxCompletionRetries <= 0 {
+		return w.processor.CompleteWorkItem(ctx, wi)
+	}
+
+	var b backoff.BackOff = &backoff.ExponentialBackOff{
+		InitialInterval:     w.options.CompletionRetryInterval,
+		MaxInterval:         5 * time.Second,
+		Multiplier:          2,
+		RandomizationFactor: 0.1,
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+	b = backoff.WithContext(backoff.WithMaxRetries(b, uint64(w.options.MaxCompletionRetries)), ctx)
+
+	return backoff.RetryNotify(
+		func() error {
+			// Completions that may have been partially committed aren't retried, since they aren't idempotent
+			err := w.processor.CompleteWorkItem(ctx, wi)
+			if err != nil && (!errors.Is(err, ErrTransient) || errors.Is(err, ErrWorkItemLockLost) || ctx.Err() != nil) {
+				return backoff.Permanent(err)
+			}
+			return err
+		},
+		b,
+		func(err error, delay time.Duration) {
+			w.logger.Warnf("%v: failed to complete work item: %v. Retrying in %v.", w.Name(), err, delay)
+			helpers.AddCompletionRetry(ctx, w.Name())
+		},
+	)
+}
+
+// DebugSnapshot implements TaskWorker. It only copies a small amount of bookkeeping state under a short-lived
+// lock, so it's cheap enough to be polled frequently without affecting work item throughput.
+func (w *worker) DebugSnapshot() WorkerDebugInfo {
+	now := time.Now()
+	info := WorkerDebugInfo{
+		Name:                 w.Name(),
+		MaxParallelWorkItems: w.dispatchSemaphore.GetLimit(),
+		FetchBackoff:         time.Duration(atomic.LoadInt64(&w.fetchBackoff)),
+	}
+
+	w.debugLock.Lock()
+	info.InFlight = make([]InFlightWorkItem, 0, len(w.inFlight))
+	for wi, state := range w.inFlight {
+		info.InFlight = append(info.InFlight, InFlightWorkItem{
+			InstanceID:  getWorkItemInstanceID(wi),
+			Description: wi.Description(),
+			StartedAt:   state.startedAt,
+			Age:         now.Sub(state.startedAt),
+		})
+	}
+	info.RecentErrors = append([]WorkerError{}, w.recentErrors...)
+	w.debugLock.Unlock()
+
+	sort.Slice(info.InFlight, func(i, j int) bool {
+		return info.InFlight[i].StartedAt.Before(info.InFlight[j].StartedAt)
+	})
+	return info
+}
+
+// CacheStats implements TaskWorker
+func (w *worker) CacheStats() CacheStats {
+	if p, ok := w.processor.(cachingTaskProcessor); ok {
+		return p.cacheStats()
+	}
+	return CacheStats{}
+}
+
+// InvalidateCache implements TaskWorker
+func (w *worker) InvalidateCache(id api.InstanceID) {
+	if p, ok := w.processor.(cachingTaskProcessor); ok {
+		p.invalidateCache(id)
+	}
+}
+
+func (w *worker) trackInFlight(wi WorkItem, cancel context.CancelFunc) {
+	w.debugLock.Lock()
+	defer w.debugLock.Unlock()
+	w.inFlight[wi] = &inFlightState{startedAt: time.Now(), cancel: cancel}
+	if w.stopping {
+		cancel()
+	}
+}
+
+func (w *worker) untrackInFlight(wi WorkItem) {
+	w.debugLock.Lock()
+	defer w.debugLock.Unlock()
+	delete(w.inFlight, wi)
+}
+
+// recordError keeps track of the most recent errors encountered by the worker for debugging purposes.
+func (w *worker) recordError(msg string, err error) {
+	w.debugLock.Lock()
+	defer w.debugLock.Unlock()
+	if len(w.recentErrors) >= maxRecentWorkerErrors {
+		w.recentErrors = append(w.recentErrors[:0], w.recentErrors[1:]...)
+	}
+	w.recentErrors = append(w.recentErrors, WorkerError{Time: time.Now(), Message: msg + ": " + err.Error()})
+}
+
+func getWorkItemRetryCount(wi WorkItem) int32 {
+	switch wi := wi.(type) {
+	case *OrchestrationWorkItem:
+		return wi.RetryCount
+	case *ActivityWorkItem:
+		return wi.RetryCount
+	default:
+		return 0
+	}
+}
+
+func getWorkItemInstanceID(wi WorkItem) api.InstanceID {
+	switch wi := wi.(type) {
+	case *OrchestrationWorkItem:
+		return wi.InstanceID
+	case *ActivityWorkItem:
+		return wi.InstanceID
+	default:
+		return api.EmptyInstanceID
+	}
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -8,7 +9,13 @@ import (
 	"github.com/microsoft/durabletask-go/api"
 )
 
-var ErrNoWorkItems = errors.New("no work items were found")
+var (
+	ErrNoWorkItems = errors.New("no work items were found")
+
+	// ErrEmptyWorkItem is returned when processing an orchestration work item without new events, if the
+	// orchestration worker is configured with [EmptyWorkItemError].
+	ErrEmptyWorkItem = errors.New("the work item has no new events")
+)
 
 type WorkItem interface {
 	Description() string
@@ -21,6 +28,11 @@ type OrchestrationWorkItem struct {
 	RetryCount int32
 	State      *OrchestrationRuntimeState
 	Properties map[string]interface{}
+
+	// NextSequenceNumber is the sequence number of the next history event to be saved for the orchestration,
+	// which is the number of history events that the backend has saved so far. Backends that populate it allow
+	// the orchestration worker to detect whether a cached runtime state is stale. It's 0 if unknown.
+	NextSequenceNumber int
 }
 
 func (wi *OrchestrationWorkItem) Description() string {
@@ -46,6 +58,17 @@ type ActivityWorkItem struct {
 	Result         *HistoryEvent
 	LockedBy       string
 	Properties     map[string]interface{}
+
+	// LastHeartbeat is the time of the most recent heartbeat recorded by the activity, or zero if the activity
+	// hasn't recorded any heartbeats.
+	LastHeartbeat time.Time
+
+	// HeartbeatDetails are the details of the most recent heartbeat recorded by the activity, if any.
+	HeartbeatDetails []byte
+
+	// RetryCount is the number of times that the work item was delivered to workers before, for backends that keep
+	// track of deliveries.
+	RetryCount int32
 }
 
 // Description implements core.WorkItem
@@ -54,3 +77,24 @@ func (wi *ActivityWorkItem) Description() string {
 	taskID := wi.NewEvent.EventId
 	return fmt.Sprintf("%s/%s#%d", wi.InstanceID, name, taskID)
 }
+
+// FetchActivityWorkItems fetches up to max activity work items by calling fetch once for each work item, for backends
+// that can't fetch several work items in a single round trip. It stops at the first error, and returns the error only
+// if no work item was fetched, so that the work items that were already locked are processed.
+func FetchActivityWorkItems(ctx context.Context, max int, fetch func(context.Context) (*ActivityWorkItem, error)) ([]*ActivityWorkItem, error) {
+	var wis []*ActivityWorkItem
+	for len(wis) < max {
+		wi, err := fetch(ctx)
+		if err != nil {
+			if len(wis) == 0 {
+				return nil, err
+			}
+			break
+		}
+		wis = append(wis, wi)
+	}
+	if len(wis) == 0 {
+		return nil, ErrNoWorkItems
+	}
+	return wis, nil
+}
@@ -2,10 +2,12 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/microsoft/durabletask-go/api"
@@ -65,7 +67,7 @@ func (c *TaskHubGrpcClient) FetchOrchestrationMetadata(ctx context.Context, id a
 		return nil, api.ErrInstanceNotFound
 	}
 
-	metadata := makeOrchestrationMetadata(resp)
+	metadata := makeOrchestrationMetadata(resp.OrchestrationState)
 	return metadata, nil
 }
 
@@ -85,7 +87,7 @@ func (c *TaskHubGrpcClient) WaitForOrchestrationStart(ctx context.Context, id ap
 	if !resp.Exists {
 		return nil, api.ErrInstanceNotFound
 	}
-	metadata := makeOrchestrationMetadata(resp)
+	metadata := makeOrchestrationMetadata(resp.OrchestrationState)
 	return metadata, nil
 }
 
@@ -105,7 +107,7 @@ func (c *TaskHubGrpcClient) WaitForOrchestrationCompletion(ctx context.Context,
 	if !resp.Exists {
 		return nil, api.ErrInstanceNotFound
 	}
-	metadata := makeOrchestrationMetadata(resp)
+	metadata := makeOrchestrationMetadata(resp.OrchestrationState)
 	return metadata, nil
 }
 
@@ -179,6 +181,60 @@ func (c *TaskHubGrpcClient) ResumeOrchestration(ctx context.Context, id api.Inst
 	return nil
 }
 
+// QueryInstances fetches one page of the metadata of the orchestration instances that match the specified query,
+// in the order of their instance IDs. Set the continuation token of the result on the query to fetch the next page.
+//
+// The gRPC protocol doesn't support filtering by orchestration name, custom status, or tags, so an error is returned
+// if the query has any of these filters.
+func (c *TaskHubGrpcClient) QueryInstances(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	if query.Name != "" {
+		return api.InstanceQueryResult{}, errors.New("querying orchestration instances by name isn't supported over gRPC")
+	}
+	if query.CustomStatusContains != "" {
+		return api.InstanceQueryResult{}, errors.New("querying orchestration instances by custom status isn't supported over gRPC")
+	}
+	if len(query.Tags) > 0 || query.TagFilter != nil {
+		return api.InstanceQueryResult{}, errors.New("querying orchestration instances by tags isn't supported over gRPC")
+	}
+
+	req := &protos.QueryInstancesRequest{
+		Query: &protos.InstanceQuery{
+			RuntimeStatus:         query.RuntimeStatuses,
+			MaxInstanceCount:      int32(query.PageSize),
+			FetchInputsAndOutputs: true,
+		},
+	}
+	if !query.CreatedFrom.IsZero() {
+		req.Query.CreatedTimeFrom = timestamppb.New(query.CreatedFrom)
+	}
+	if !query.CreatedTo.IsZero() {
+		req.Query.CreatedTimeTo = timestamppb.New(query.CreatedTo)
+	}
+	if query.InstanceIDPrefix != "" {
+		req.Query.InstanceIdPrefix = wrapperspb.String(query.InstanceIDPrefix)
+	}
+	if query.ContinuationToken != "" {
+		req.Query.ContinuationToken = wrapperspb.String(query.ContinuationToken)
+	}
+
+	resp, err := c.client.QueryInstances(ctx, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return api.InstanceQueryResult{}, ctx.Err()
+		}
+		return api.InstanceQueryResult{}, fmt.Errorf("failed to query orchestration instances: %w", err)
+	}
+
+	result := api.InstanceQueryResult{
+		Instances:         make([]*api.OrchestrationMetadata, 0, len(resp.OrchestrationState)),
+		ContinuationToken: resp.ContinuationToken.GetValue(),
+	}
+	for _, state := range resp.OrchestrationState {
+		result.Instances = append(result.Instances, makeOrchestrationMetadata(state))
+	}
+	return result, nil
+}
+
 // PurgeOrchestrationState deletes the state of the specified orchestration instance.
 //
 // [api.api.ErrInstanceNotFound] is returned if the specified orchestration instance doesn't exist.
@@ -210,16 +266,16 @@ func makeGetInstanceRequest(id api.InstanceID, opts []api.FetchOrchestrationMeta
 	return req
 }
 
-func makeOrchestrationMetadata(resp *protos.GetInstanceResponse) *api.OrchestrationMetadata {
+func makeOrchestrationMetadata(state *protos.OrchestrationState) *api.OrchestrationMetadata {
 	metadata := &api.OrchestrationMetadata{
-		InstanceID:             api.InstanceID(resp.OrchestrationState.InstanceId),
-		Name:                   resp.OrchestrationState.Name,
-		RuntimeStatus:          resp.OrchestrationState.OrchestrationStatus,
-		CreatedAt:              resp.OrchestrationState.CreatedTimestamp.AsTime(),
-		LastUpdatedAt:          resp.OrchestrationState.LastUpdatedTimestamp.AsTime(),
-		SerializedInput:        resp.OrchestrationState.Input.GetValue(),
-		SerializedCustomStatus: resp.OrchestrationState.CustomStatus.GetValue(),
-		SerializedOutput:       resp.OrchestrationState.Output.GetValue(),
+		InstanceID:             api.InstanceID(state.InstanceId),
+		Name:                   state.Name,
+		RuntimeStatus:          state.OrchestrationStatus,
+		CreatedAt:              state.CreatedTimestamp.AsTime(),
+		LastUpdatedAt:          state.LastUpdatedTimestamp.AsTime(),
+		SerializedInput:        state.Input.GetValue(),
+		SerializedCustomStatus: state.CustomStatus.GetValue(),
+		SerializedOutput:       state.Output.GetValue(),
 	}
 	return metadata
 }
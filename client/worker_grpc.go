@@ -11,6 +11,8 @@ import (
 	"github.com/microsoft/durabletask-go/internal/helpers"
 	"github.com/microsoft/durabletask-go/internal/protos"
 	"github.com/microsoft/durabletask-go/task"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
@@ -18,9 +20,27 @@ import (
 func (c *TaskHubGrpcClient) StartWorkItemListener(ctx context.Context, r *task.TaskRegistry) error {
 	executor := task.NewTaskExecutor(r)
 
-	if _, err := c.client.Hello(ctx, &emptypb.Empty{}); err != nil {
+	// Advertise the supported protocol versions and registered functions, so that the task hub service only sends
+	// work items that this process can execute, and so that incompatible versions are detected before any work
+	// items are received.
+	handshake := backend.ExecutorHandshake{
+		Orchestrators: r.OrchestratorNames(),
+		Activities:    r.ActivityNames(),
+	}
+	for v := backend.MinExecutorProtocolVersion; v <= backend.MaxExecutorProtocolVersion; v++ {
+		handshake.ProtocolVersions = append(handshake.ProtocolVersions, v)
+	}
+	ctx = handshake.AppendToOutgoingContext(ctx)
+
+	var header metadata.MD
+	if _, err := c.client.Hello(ctx, &emptypb.Empty{}, grpc.Header(&header)); err != nil {
 		return fmt.Errorf("failed to connect to task hub service: %w", err)
 	}
+	if v, ok := backend.NegotiatedProtocolVersion(header); ok {
+		c.logger.Infof("negotiated protocol version %d with the task hub service", v)
+	} else {
+		c.logger.Infof("the task hub service doesn't support the handshake: assuming protocol version %d", backend.MinExecutorProtocolVersion)
+	}
 
 	req := protos.GetWorkItemsRequest{}
 	stream, err := c.client.GetWorkItems(ctx, &req)
@@ -0,0 +1,57 @@
+package helpers
+
+import "strings"
+
+// Durable entities are run as eternal orchestrations, whose instance IDs are the entity IDs and whose names are the
+// entity names prefixed with "@". Operations are delivered to entities as external events, and the results of calls
+// are sent back to the calling orchestrations as external events too. Backends don't know about entities, so the
+// clients leave them out of the orchestration queries and purges, and orchestration names that start with "@" are
+// reserved for them.
+
+// EntityOperationEventName is the name of the external events that deliver operations to entities.
+const EntityOperationEventName = "entity-operation"
+
+// entityResponseEventPrefix prefixes the name of the external events that deliver the results of entity calls to
+// the calling orchestrations, followed by the ID of the request.
+const entityResponseEventPrefix = "entity-response:"
+
+// EntityRequest is the payload of the external events that deliver operations to entities.
+type EntityRequest struct {
+	// ID identifies the request for the calling orchestration, or is empty for signals.
+	ID string `json:"id,omitempty"`
+
+	// Operation is the name of the operation.
+	Operation string `json:"op"`
+
+	// Input is the serialized input of the operation, if any.
+	Input *string `json:"input,omitempty"`
+
+	// ReplyTo is the instance ID of the calling orchestration, or is empty for signals.
+	ReplyTo string `json:"replyTo,omitempty"`
+}
+
+// EntityResponse is the payload of the external events that deliver the results of entity calls.
+type EntityResponse struct {
+	// Result is the serialized result of the operation, if any.
+	Result *string `json:"result,omitempty"`
+
+	// ErrorType and ErrorMessage describe the error of a failed operation.
+	ErrorType    string `json:"errorType,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// EntityOrchestratorName returns the name of the orchestrations that run the entities with the specified name.
+func EntityOrchestratorName(entityName string) string {
+	return "@" + strings.ToLower(entityName)
+}
+
+// IsEntityOrchestratorName returns true if the specified orchestration name is reserved for running entities.
+func IsEntityOrchestratorName(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+// EntityResponseEventName returns the name of the external event that delivers the result of the entity call with
+// the specified request ID.
+func EntityResponseEventName(requestID string) string {
+	return entityResponseEventPrefix + requestID
+}
@@ -0,0 +1,84 @@
+package helpers
+
+import "google.golang.org/protobuf/encoding/protowire"
+
+// The protocol, which is shared with the other Durable Task SDKs through the durabletask-protobuf submodule, doesn't
+// declare everything that this module records in orchestration histories. Extensions are therefore carried in two
+// ways, which are all declared in this file so that they stay unique and can be moved to the protocol together:
+//
+//   - Extra fields of existing messages are unknown fields, which are preserved when messages are serialized. Their
+//     numbers are far above the numbers of the fields that the protocol declares. See tags.go.
+//   - Extra history events are generic events, which orchestrators ignore. Their data starts with a prefix that
+//     identifies the kind of event, followed by its payload.
+//
+// Both are saved in orchestration histories, so numbers and prefixes must never be changed or reused.
+
+// The numbers of the unknown fields.
+const (
+	// tagsFieldNumber is the number of the field of the CreateInstanceRequest and ExecutionStartedEvent messages that
+	// contains the tags of an orchestration, encoded like a map<string, string> field.
+	tagsFieldNumber protowire.Number = 1000
+
+	// orchestrationTimeoutFieldNumber is the number of the field of the CreateInstanceRequest and
+	// ExecutionStartedEvent messages that contains the execution timeout of an orchestration, in nanoseconds.
+	orchestrationTimeoutFieldNumber protowire.Number = 1001
+
+	// activityTimeoutFieldNumber is the number of the field of the ScheduleTaskAction and TaskScheduledEvent messages
+	// that contains the timeout of each attempt of an activity, in nanoseconds.
+	activityTimeoutFieldNumber protowire.Number = 1002
+
+	// activityQueueFieldNumber is the number of the field of the ScheduleTaskAction and TaskScheduledEvent messages
+	// that contains the name of the queue that the activity is routed to.
+	activityQueueFieldNumber protowire.Number = 1003
+
+	// sentEventKindFieldNumber is the number of the field of the SendEventAction and EventSentEvent messages that
+	// contains the [SentEventKind] of the sent event.
+	sentEventKindFieldNumber protowire.Number = 1004
+
+	// instanceIDReuseActionFieldNumber is the number of the field of the CreateInstanceRequest message that contains
+	// the action to take if the instance ID is already in use, plus one, so that zero means that it isn't set.
+	instanceIDReuseActionFieldNumber protowire.Number = 1005
+
+	// detachedOrchestrationVersionFieldNumber is the number of the field of the SendEventAction and EventSentEvent
+	// messages that start detached orchestrations that contains the version of the detached orchestration.
+	detachedOrchestrationVersionFieldNumber protowire.Number = 1006
+)
+
+// The data of the generic events, and the prefixes of their data.
+const (
+	// ReevaluateEventData is the data of the generic event used to wake up an orchestration so that it re-runs over
+	// its existing history.
+	ReevaluateEventData = "reevaluate"
+
+	// subOrchestrationRetriedEventPrefix prefixes the data of the generic event that records the retry of a failed
+	// sub-orchestration, followed by its task ID.
+	subOrchestrationRetriedEventPrefix = "retry-sub-orchestration:"
+
+	// orchestrationRewoundEventPrefix prefixes the data of the generic event that records the rewind of a failed
+	// orchestration, followed by the reason.
+	orchestrationRewoundEventPrefix = "rewind:"
+
+	// customStatusUpdatedEventPrefix prefixes the data of the generic event that updates the custom status of an
+	// orchestration from outside of the orchestrator, followed by the serialized custom status.
+	customStatusUpdatedEventPrefix = "custom-status:"
+
+	// FaultInjectedEventPrefix prefixes the data of the generic event that records a fault injected into an
+	// orchestration, followed by the JSON-serialized fault.
+	FaultInjectedEventPrefix = "fault:"
+
+	// FaultAppliedEventPrefix prefixes the data of the generic event that records that an injected fault was
+	// applied, followed by the ID of the fault.
+	FaultAppliedEventPrefix = "fault-applied:"
+
+	// OrderedEventPrefix prefixes the data of the generic event that carries an event raised by an ordered client,
+	// followed by the JSON-serialized event.
+	OrderedEventPrefix = "ordered-event:"
+
+	// OrderedEventsStatePrefix prefixes the data of the generic event that records the event sequencing state of an
+	// orchestration, followed by the JSON-serialized state.
+	OrderedEventsStatePrefix = "ordered-events:"
+
+	// DroppedEventPrefix prefixes the data of the generic event that records an external event that a suspended
+	// orchestration dropped because its suspension buffer was full, followed by the JSON-serialized event.
+	DroppedEventPrefix = "dropped-event:"
+)
@@ -1,12 +1,14 @@
 package helpers
 
 import (
+	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
@@ -19,6 +21,7 @@ func NewExecutionStartedEvent(
 	input *wrapperspb.StringValue,
 	parent *protos.ParentInstanceInfo,
 	parentTraceContext *protos.TraceContext,
+	scheduledStartTime *timestamppb.Timestamp,
 ) *protos.HistoryEvent {
 	return &protos.HistoryEvent{
 		EventId:   -1,
@@ -32,7 +35,8 @@ func NewExecutionStartedEvent(
 					InstanceId:  instanceId,
 					ExecutionId: wrapperspb.String(uuid.New().String()),
 				},
-				ParentTraceContext: parentTraceContext,
+				ParentTraceContext:      parentTraceContext,
+				ScheduledStartTimestamp: scheduledStartTime,
 			},
 		},
 	}
@@ -229,6 +233,133 @@ func NewResumeOrchestrationEvent(reason string) *protos.HistoryEvent {
 	}
 }
 
+func NewGenericEvent(data string) *protos.HistoryEvent {
+	return &protos.HistoryEvent{
+		EventId:   -1,
+		Timestamp: timestamppb.New(time.Now()),
+		EventType: &protos.HistoryEvent_GenericEvent{
+			GenericEvent: &protos.GenericEvent{
+				Data: data,
+			},
+		},
+	}
+}
+
+// NewSubOrchestrationRetriedEvent returns a generic event that records that the failed sub-orchestration with
+// the specified task ID was reset and scheduled again.
+func NewSubOrchestrationRetriedEvent(taskID int32) *protos.HistoryEvent {
+	return NewGenericEvent(fmt.Sprintf("%s%d", subOrchestrationRetriedEventPrefix, taskID))
+}
+
+// GetSubOrchestrationRetriedTaskID returns the task ID of the retried sub-orchestration if the specified
+// event was created by [NewSubOrchestrationRetriedEvent].
+func GetSubOrchestrationRetriedTaskID(e *protos.HistoryEvent) (int32, bool) {
+	data := e.GetGenericEvent().GetData()
+	if !strings.HasPrefix(data, subOrchestrationRetriedEventPrefix) {
+		return 0, false
+	}
+	taskID, err := strconv.ParseInt(strings.TrimPrefix(data, subOrchestrationRetriedEventPrefix), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(taskID), true
+}
+
+// NewOrchestrationRewoundEvent returns a generic event that records that a failed orchestration was rewound to its
+// most recent failed task for the specified reason.
+func NewOrchestrationRewoundEvent(reason string) *protos.HistoryEvent {
+	return NewGenericEvent(orchestrationRewoundEventPrefix + reason)
+}
+
+// NewCustomStatusUpdatedEvent returns a generic event that sets the custom status of an orchestration to the
+// specified value when the orchestrator replays it. An empty value clears the custom status.
+func NewCustomStatusUpdatedEvent(customStatus string) *protos.HistoryEvent {
+	return NewGenericEvent(customStatusUpdatedEventPrefix + customStatus)
+}
+
+// GetUpdatedCustomStatus returns the custom status set by the specified event if it was created by
+// [NewCustomStatusUpdatedEvent].
+func GetUpdatedCustomStatus(e *protos.HistoryEvent) (string, bool) {
+	data := e.GetGenericEvent().GetData()
+	if !strings.HasPrefix(data, customStatusUpdatedEventPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(data, customStatusUpdatedEventPrefix), true
+}
+
+// NewStartDetachedOrchestrationAction returns an action that starts an orchestration that has no parent, so that it
+// doesn't report its completion to the orchestration that starts it, and isn't terminated with it. The action is a
+// send event action of the [SentEventKindStartDetachedOrchestration] kind, so that the orchestration that starts it
+// records an EventSent event instead of a SubOrchestrationInstanceCreated event.
+func NewStartDetachedOrchestrationAction(taskID int32, name string, iid string, input *wrapperspb.StringValue) *protos.OrchestratorAction {
+	sendEvent := &protos.SendEventAction{
+		Instance: &protos.OrchestrationInstance{InstanceId: iid},
+		Name:     name,
+		Data:     input,
+	}
+	SetSentEventKind(sendEvent, SentEventKindStartDetachedOrchestration)
+	return &protos.OrchestratorAction{
+		Id:                     taskID,
+		OrchestratorActionType: &protos.OrchestratorAction_SendEvent{SendEvent: sendEvent},
+	}
+}
+
+// IsStartDetachedOrchestration returns true if the specified SendEventAction or EventSentEvent message was created
+// for an action returned by [NewStartDetachedOrchestrationAction]. The name of the message is the name of the
+// detached orchestration.
+func IsStartDetachedOrchestration(m proto.Message) bool {
+	return GetSentEventKind(m) == SentEventKindStartDetachedOrchestration
+}
+
+// SetDetachedOrchestrationVersion replaces the version of the detached orchestration that the specified
+// SendEventAction or EventSentEvent message starts. An empty version removes the field.
+func SetDetachedOrchestrationVersion(m proto.Message, version string) {
+	setStringField(m, detachedOrchestrationVersionFieldNumber, version)
+}
+
+// GetDetachedOrchestrationVersion returns the version of the detached orchestration that the specified
+// SendEventAction or EventSentEvent message starts, or an empty string if it has no version.
+func GetDetachedOrchestrationVersion(m proto.Message) string {
+	return getStringField(m, detachedOrchestrationVersionFieldNumber)
+}
+
+// sideEffectEventName is the name of the events that record the results of the side effects of orchestrations. It's
+// only informational, since side effects are identified by their [SentEventKind].
+const sideEffectEventName = "SideEffect"
+
+// NewSideEffectAction returns an action that records the serialized result of a side effect of an orchestration, or
+// its error message if it failed. The action is a send event action without a target, so that the orchestration
+// records an EventSent event with the result, but nothing is sent.
+func NewSideEffectAction(taskID int32, data *wrapperspb.StringValue, failed bool) *protos.OrchestratorAction {
+	sendEvent := &protos.SendEventAction{
+		Instance: &protos.OrchestrationInstance{},
+		Name:     sideEffectEventName,
+		Data:     data,
+	}
+	if failed {
+		SetSentEventKind(sendEvent, SentEventKindFailedSideEffect)
+	} else {
+		SetSentEventKind(sendEvent, SentEventKindSideEffect)
+	}
+	return &protos.OrchestratorAction{
+		Id:                     taskID,
+		OrchestratorActionType: &protos.OrchestratorAction_SendEvent{SendEvent: sendEvent},
+	}
+}
+
+// IsSideEffect returns true if the specified SendEventAction or EventSentEvent message was created for an action
+// returned by [NewSideEffectAction], and whether the side effect failed.
+func IsSideEffect(m proto.Message) (isSideEffect bool, failed bool) {
+	switch GetSentEventKind(m) {
+	case SentEventKindSideEffect:
+		return true, false
+	case SentEventKindFailedSideEffect:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
 func NewParentInfo(taskID int32, name string, iid string) *protos.ParentInstanceInfo {
 	return &protos.ParentInstanceInfo{
 		TaskScheduledId:       taskID,
@@ -0,0 +1,67 @@
+package helpers
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+var meter = global.Meter("durabletask")
+
+var (
+	completionRetryCounter   syncint64.Counter
+	quarantinedCounter       syncint64.Counter
+	backendOperationDuration syncfloat64.Histogram
+)
+
+func init() {
+	// Instruments created from the global meter are delegated to whichever meter provider
+	// the app registers later, so it's safe to create them eagerly.
+	completionRetryCounter, _ = meter.SyncInt64().Counter(
+		"durabletask.workitem.completion_retries",
+		instrument.WithDescription("The number of times a work item completion was retried after a backend error"))
+	quarantinedCounter, _ = meter.SyncInt64().Counter(
+		"durabletask.workitem.quarantined",
+		instrument.WithDescription("The number of work items that were quarantined because the state of their orchestration is invalid"))
+	backendOperationDuration, _ = meter.SyncFloat64().Histogram(
+		"durabletask.backend.operation.duration",
+		instrument.WithDescription("The duration of the operations performed by the backend"),
+		instrument.WithUnit(unit.Milliseconds))
+}
+
+// AddCompletionRetry records a single retry of a work item completion for the named task processor.
+func AddCompletionRetry(ctx context.Context, processorName string) {
+	if completionRetryCounter == nil {
+		return
+	}
+	completionRetryCounter.Add(ctx, 1, attribute.String("durabletask.processor", processorName))
+}
+
+// AddQuarantinedWorkItem records a single work item that was quarantined by the named task processor.
+func AddQuarantinedWorkItem(ctx context.Context, processorName string) {
+	if quarantinedCounter == nil {
+		return
+	}
+	quarantinedCounter.Add(ctx, 1, attribute.String("durabletask.processor", processorName))
+}
+
+// RecordBackendOperation records the duration of the named backend operation, which started at the specified time
+// and failed if err isn't nil.
+func RecordBackendOperation(ctx context.Context, operation string, start time.Time, err error) {
+	if backendOperationDuration == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	backendOperationDuration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond),
+		attribute.String("durabletask.backend.operation", operation),
+		attribute.String("durabletask.backend.outcome", outcome))
+}
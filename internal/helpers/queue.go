@@ -0,0 +1,61 @@
+package helpers
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Like tags, the queue of an activity is carried in an unknown field of the messages that the generated code doesn't
+// have a field for. See tags.go.
+
+// SetActivityQueue replaces the queue of the specified ScheduleTaskAction or TaskScheduledEvent message. An empty
+// queue removes the field, so that the activity is routed to the default queue.
+func SetActivityQueue(m proto.Message, queue string) {
+	setStringField(m, activityQueueFieldNumber, queue)
+}
+
+// GetActivityQueue returns the queue of the specified ScheduleTaskAction or TaskScheduledEvent message, or an empty
+// string if the activity is routed to the default queue.
+func GetActivityQueue(m proto.Message) string {
+	return getStringField(m, activityQueueFieldNumber)
+}
+
+// setStringField replaces the value of the specified unknown field with a string, or removes the field if the string
+// is empty.
+func setStringField(m proto.Message, field protowire.Number, v string) {
+	r := m.ProtoReflect()
+	unknown := removeField(r.GetUnknown(), field)
+	if v != "" {
+		unknown = protowire.AppendTag(unknown, field, protowire.BytesType)
+		unknown = protowire.AppendString(unknown, v)
+	}
+	r.SetUnknown(unknown)
+}
+
+// getStringField returns the string in the specified unknown field, or an empty string if there's no such field.
+func getStringField(m proto.Message, field protowire.Number) string {
+	var v string
+	unknown := m.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return v
+		}
+		unknown = unknown[n:]
+		if num == field && typ == protowire.BytesType {
+			value, n := protowire.ConsumeString(unknown)
+			if n < 0 {
+				return v
+			}
+			v = value
+			unknown = unknown[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			return v
+		}
+		unknown = unknown[n:]
+	}
+	return v
+}
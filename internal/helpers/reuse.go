@@ -0,0 +1,22 @@
+package helpers
+
+import "google.golang.org/protobuf/proto"
+
+// Like tags, the instance ID reuse action of a request to create an orchestration is carried in an unknown field of
+// the CreateInstanceRequest message, so that it's passed through gRPC. See tags.go. It isn't copied into the history.
+
+// SetInstanceIDReuseAction sets the action to take if the instance ID of the specified CreateInstanceRequest message
+// is already in use.
+func SetInstanceIDReuseAction(m proto.Message, action int) {
+	setVarintField(m, instanceIDReuseActionFieldNumber, uint64(action)+1)
+}
+
+// GetInstanceIDReuseAction returns the action to take if the instance ID of the specified CreateInstanceRequest
+// message is already in use, and false if the request doesn't specify one.
+func GetInstanceIDReuseAction(m proto.Message) (int, bool) {
+	v := getVarintField(m, instanceIDReuseActionFieldNumber)
+	if v == 0 {
+		return 0, false
+	}
+	return int(v - 1), true
+}
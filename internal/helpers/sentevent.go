@@ -0,0 +1,37 @@
+package helpers
+
+import "google.golang.org/protobuf/proto"
+
+// Like tags, the kind of a sent event is carried in an unknown field of the messages that the generated code doesn't
+// have a field for. See tags.go. Unlike a reserved event name, the kind can't collide with the names of the events
+// that orchestrations send to each other.
+
+// SentEventKind is the kind of a send event action or an EventSent event. Kinds are saved in orchestration
+// histories, so new kinds must be added at the end.
+type SentEventKind uint64
+
+const (
+	// SentEventKindEvent is an event that an orchestration sends to another orchestration.
+	SentEventKindEvent SentEventKind = iota
+
+	// SentEventKindSideEffect records the result of a side effect of the orchestration. Nothing is sent.
+	SentEventKindSideEffect
+
+	// SentEventKindFailedSideEffect records the error message of a failed side effect of the orchestration. Nothing
+	// is sent.
+	SentEventKindFailedSideEffect
+
+	// SentEventKindStartDetachedOrchestration starts an orchestration without a parent. The name of the event is the
+	// name of the orchestration to start.
+	SentEventKindStartDetachedOrchestration
+)
+
+// SetSentEventKind replaces the kind of the specified SendEventAction or EventSentEvent message.
+func SetSentEventKind(m proto.Message, kind SentEventKind) {
+	setVarintField(m, sentEventKindFieldNumber, uint64(kind))
+}
+
+// GetSentEventKind returns the kind of the specified SendEventAction or EventSentEvent message.
+func GetSentEventKind(m proto.Message) SentEventKind {
+	return SentEventKind(getVarintField(m, sentEventKindFieldNumber))
+}
@@ -0,0 +1,147 @@
+package helpers
+
+import (
+	"encoding/json"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// The tags of an orchestration are carried in a field of the CreateInstanceRequest and ExecutionStartedEvent messages
+// that the generated code doesn't know about. Unknown fields are preserved when messages are serialized, so tags are
+// kept in the history of orchestrations and are passed through gRPC without any change to the protocol. The field
+// is encoded like a protobuf map<string, string> field, so it can be declared in the protocol later. The numbers of
+// all unknown fields are declared in extensions.go.
+
+// SetTags replaces the tags of the specified CreateInstanceRequest or ExecutionStartedEvent message. Tags are encoded
+// in the order of their keys, so that messages with the same tags are serialized identically.
+func SetTags(m proto.Message, tags map[string]string) {
+	r := m.ProtoReflect()
+	unknown := removeField(r.GetUnknown(), tagsFieldNumber)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, tags[k])
+
+		unknown = protowire.AppendTag(unknown, tagsFieldNumber, protowire.BytesType)
+		unknown = protowire.AppendBytes(unknown, entry)
+	}
+	r.SetUnknown(unknown)
+}
+
+// GetTags returns the tags of the specified CreateInstanceRequest or ExecutionStartedEvent message, or nil if it
+// doesn't have any tags.
+func GetTags(m proto.Message) map[string]string {
+	var tags map[string]string
+	unknown := m.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return tags
+		}
+		unknown = unknown[n:]
+		if num != tagsFieldNumber || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, unknown)
+			if n < 0 {
+				return tags
+			}
+			unknown = unknown[n:]
+			continue
+		}
+
+		entry, n := protowire.ConsumeBytes(unknown)
+		if n < 0 {
+			return tags
+		}
+		unknown = unknown[n:]
+		if k, v, ok := parseMapEntry(entry); ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// parseMapEntry parses the key and the value of an encoded map<string, string> entry.
+func parseMapEntry(entry []byte) (string, string, bool) {
+	var k, v string
+	for len(entry) > 0 {
+		num, typ, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return "", "", false
+		}
+		entry = entry[n:]
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			n = protowire.ConsumeFieldValue(num, typ, entry)
+			if n < 0 {
+				return "", "", false
+			}
+			entry = entry[n:]
+			continue
+		}
+		s, n := protowire.ConsumeString(entry)
+		if n < 0 {
+			return "", "", false
+		}
+		entry = entry[n:]
+		if num == 1 {
+			k = s
+		} else {
+			v = s
+		}
+	}
+	return k, v, true
+}
+
+// removeField returns the specified encoded fields without the fields with the specified number.
+func removeField(fields []byte, field protowire.Number) []byte {
+	var result []byte
+	for len(fields) > 0 {
+		num, _, n := protowire.ConsumeField(fields)
+		if n < 0 {
+			// Keep malformed data as is, so that it isn't silently lost
+			return append(result, fields...)
+		}
+		if num != field {
+			result = append(result, fields[:n]...)
+		}
+		fields = fields[n:]
+	}
+	return result
+}
+
+// MarshalTags serializes tags to JSON for backends that store them as text, or returns an empty string if there
+// aren't any tags.
+func MarshalTags(tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	bytes, err := json.Marshal(tags)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// UnmarshalTags deserializes tags that were serialized with [MarshalTags].
+func UnmarshalTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(s), &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
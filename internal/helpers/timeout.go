@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Like tags, timeouts are carried in unknown fields of the messages that the generated code doesn't have fields for.
+// See tags.go.
+
+// SetOrchestrationTimeout replaces the execution timeout of the specified CreateInstanceRequest or
+// ExecutionStartedEvent message. A timeout that isn't positive removes the timeout.
+func SetOrchestrationTimeout(m proto.Message, timeout time.Duration) {
+	setDurationField(m, orchestrationTimeoutFieldNumber, timeout)
+}
+
+// GetOrchestrationTimeout returns the execution timeout of the specified CreateInstanceRequest or
+// ExecutionStartedEvent message, or zero if it doesn't have a timeout.
+func GetOrchestrationTimeout(m proto.Message) time.Duration {
+	return getDurationField(m, orchestrationTimeoutFieldNumber)
+}
+
+// SetActivityTimeout replaces the timeout of the specified ScheduleTaskAction or TaskScheduledEvent message. A
+// timeout that isn't positive removes the timeout.
+func SetActivityTimeout(m proto.Message, timeout time.Duration) {
+	setDurationField(m, activityTimeoutFieldNumber, timeout)
+}
+
+// GetActivityTimeout returns the timeout of the specified ScheduleTaskAction or TaskScheduledEvent message, or zero
+// if it doesn't have a timeout.
+func GetActivityTimeout(m proto.Message) time.Duration {
+	return getDurationField(m, activityTimeoutFieldNumber)
+}
+
+// setDurationField replaces the value of the specified unknown field with a duration, or removes the field if the
+// duration isn't positive.
+func setDurationField(m proto.Message, field protowire.Number, d time.Duration) {
+	var v uint64
+	if d > 0 {
+		v = uint64(d)
+	}
+	setVarintField(m, field, v)
+}
+
+// getDurationField returns the duration in the specified unknown field, or zero if there's no such field.
+func getDurationField(m proto.Message, field protowire.Number) time.Duration {
+	return time.Duration(getVarintField(m, field))
+}
+
+// setVarintField replaces the value of the specified unknown field with an integer, or removes the field if the
+// integer is zero.
+func setVarintField(m proto.Message, field protowire.Number, v uint64) {
+	r := m.ProtoReflect()
+	unknown := removeField(r.GetUnknown(), field)
+	if v != 0 {
+		unknown = protowire.AppendTag(unknown, field, protowire.VarintType)
+		unknown = protowire.AppendVarint(unknown, v)
+	}
+	r.SetUnknown(unknown)
+}
+
+// getVarintField returns the integer in the specified unknown field, or zero if there's no such field.
+func getVarintField(m proto.Message, field protowire.Number) uint64 {
+	var v uint64
+	unknown := m.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return v
+		}
+		unknown = unknown[n:]
+		if num == field && typ == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(unknown)
+			if n < 0 {
+				return v
+			}
+			v = value
+			unknown = unknown[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			return v
+		}
+		unknown = unknown[n:]
+	}
+	return v
+}
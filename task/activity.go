@@ -2,7 +2,10 @@ package task
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/microsoft/durabletask-go/backend"
 	"github.com/microsoft/durabletask-go/internal/protos"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
@@ -10,7 +13,9 @@ import (
 type callActivityOption func(*callActivityOptions) error
 
 type callActivityOptions struct {
-	rawInput *wrapperspb.StringValue
+	rawInput    *wrapperspb.StringValue
+	retryPolicy *RetryPolicy
+	timeout     time.Duration
 }
 
 // WithActivityInput configures an input for an activity invocation.
@@ -34,10 +39,43 @@ func WithRawActivityInput(input string) callActivityOption {
 	}
 }
 
+// WithActivityRetryPolicy configures the automatic retries of the activity invocation when it fails. Failed
+// attempts are scheduled again after a durable timer, until an attempt succeeds or the policy is exhausted, in
+// which case awaiting the activity returns the error of the last attempt. Failures that are marked as non-retriable
+// aren't retried.
+func WithActivityRetryPolicy(policy RetryPolicy) callActivityOption {
+	return func(opt *callActivityOptions) error {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		opt.retryPolicy = &policy
+		return nil
+	}
+}
+
+// WithActivityTimeout configures the maximum duration of each attempt of the activity invocation. When an attempt
+// takes longer, the activity worker cancels the context of the activity function and fails the attempt with an
+// "ActivityTimeout" error, which is retried like other failures if a retry policy is configured.
+func WithActivityTimeout(timeout time.Duration) callActivityOption {
+	return func(opt *callActivityOptions) error {
+		if timeout <= 0 {
+			return fmt.Errorf("the activity timeout must be positive: %v", timeout)
+		}
+		opt.timeout = timeout
+		return nil
+	}
+}
+
 // ActivityContext is the context parameter type for activity implementations.
 type ActivityContext interface {
 	GetInput(resultPtr any) error
 	Context() context.Context
+
+	// RecordHeartbeat reports that a long-running activity is still making progress, with optional details about
+	// its progress, which must be serializable to JSON. Once an activity records a heartbeat, the worker expects it
+	// to keep recording them within the timeout configured with [backend.WithActivityHeartbeatTimeout], and gives up
+	// on it otherwise, in which case [backend.ErrActivityHeartbeatTimeout] is returned.
+	RecordHeartbeat(details any) error
 }
 
 type activityContext struct {
@@ -68,3 +106,12 @@ func (actx *activityContext) GetInput(v any) error {
 func (actx *activityContext) Context() context.Context {
 	return actx.ctx
 }
+
+// RecordHeartbeat implements ActivityContext
+func (actx *activityContext) RecordHeartbeat(details any) error {
+	data, err := marshalData(details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the heartbeat details to JSON: %w", err)
+	}
+	return backend.RecordActivityHeartbeat(actx.ctx, data)
+}
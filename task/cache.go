@@ -0,0 +1,177 @@
+package task
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// warmOrchestrator is an orchestrator function that keeps running on its own goroutine between work items. Instead
+// of unwinding the orchestrator when it awaits a task that isn't complete, the orchestration context parks the
+// goroutine until the next work item provides more events, so that the orchestrator resumes where it was blocked
+// instead of replaying the full history.
+type warmOrchestrator struct {
+	ctx *OrchestrationContext
+
+	// oldEvents and newEvents are the history that the orchestrator has processed so far.
+	oldEvents []*protos.HistoryEvent
+	newEvents []*protos.HistoryEvent
+
+	// resume wakes up the parked orchestrator, with true to process more events and false to unwind it.
+	resume chan bool
+
+	// yield receives the outcome of each execution, once the orchestrator is parked or has finished.
+	yield chan warmExecution
+
+	// stopped is set before the orchestrator is unwound, so that it doesn't report the outcome of the unwinding.
+	stopped bool
+}
+
+// warmExecution is the outcome of an execution of a warm orchestrator.
+type warmExecution struct {
+	actions []*protos.OrchestratorAction
+
+	// parked is true if the orchestrator is waiting for more events, and false if it finished running.
+	parked bool
+
+	// panicValue is the unexpected panic of the orchestrator, if any, which is re-raised on the goroutine of the caller.
+	panicValue any
+}
+
+// startWarmOrchestrator starts running the orchestrator of the specified context on a new goroutine, and returns once
+// the orchestrator is parked or has finished.
+func startWarmOrchestrator(ctx *OrchestrationContext) (*warmOrchestrator, warmExecution) {
+	w := &warmOrchestrator{
+		ctx:       ctx,
+		oldEvents: ctx.oldEvents,
+		newEvents: ctx.newEvents,
+		resume:    make(chan bool),
+		yield:     make(chan warmExecution),
+	}
+	ctx.warm = w
+	go func() {
+		var result warmExecution
+		defer func() {
+			if v := recover(); v != nil {
+				result = warmExecution{panicValue: v}
+			}
+			if !w.stopped {
+				w.yield <- result
+			}
+		}()
+		result.actions = ctx.start()
+	}()
+	return w, <-w.yield
+}
+
+// park is called on the goroutine of the orchestrator when it has processed all the events of the history. It
+// reports the pending actions of the orchestrator, and returns true once more events are available, or false if the
+// orchestrator must be unwound.
+func (w *warmOrchestrator) park() bool {
+	w.yield <- warmExecution{actions: w.ctx.actions(), parked: true}
+	return <-w.resume
+}
+
+// canResume returns true if the specified history starts with all the events that the orchestrator has processed.
+// Events are compared by identity, which is cheap and matches when the orchestration worker reuses the history of
+// the previous work item, e.g. from its state cache.
+func (w *warmOrchestrator) canResume(oldEvents []*protos.HistoryEvent) bool {
+	if len(oldEvents) < len(w.oldEvents)+len(w.newEvents) {
+		return false
+	}
+	for i, e := range w.oldEvents {
+		if oldEvents[i] != e {
+			return false
+		}
+	}
+	for i, e := range w.newEvents {
+		if oldEvents[len(w.oldEvents)+i] != e {
+			return false
+		}
+	}
+	return true
+}
+
+// execute resumes the parked orchestrator with the specified history, of which it only processes the events that it
+// hasn't processed yet, and returns once the orchestrator is parked again or has finished.
+func (w *warmOrchestrator) execute(oldEvents []*protos.HistoryEvent, newEvents []*protos.HistoryEvent) warmExecution {
+	w.ctx.oldEvents, w.ctx.newEvents = oldEvents, newEvents
+	w.oldEvents, w.newEvents = oldEvents, newEvents
+	w.resume <- true
+	return <-w.yield
+}
+
+// stop unwinds the parked orchestrator, which runs its deferred functions and ends its goroutine.
+func (w *warmOrchestrator) stop() {
+	w.stopped = true
+	w.resume <- false
+}
+
+// orchestratorCache is a size-bounded LRU cache of warm orchestrators.
+type orchestratorCache struct {
+	lock     sync.Mutex
+	capacity int
+	lru      *list.List // front is most recently used
+	entries  map[api.InstanceID]*list.Element
+}
+
+type orchestratorCacheEntry struct {
+	id           api.InstanceID
+	orchestrator *warmOrchestrator
+}
+
+func newOrchestratorCache(capacity int) *orchestratorCache {
+	return &orchestratorCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[api.InstanceID]*list.Element, capacity),
+	}
+}
+
+// take removes the warm orchestrator of the specified orchestration from the cache and returns it, so that it's
+// only resumed by one execution at a time.
+func (c *orchestratorCache) take(id api.InstanceID) (*warmOrchestrator, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, id)
+	return elem.Value.(*orchestratorCacheEntry).orchestrator, true
+}
+
+// put adds the warm orchestrator of the specified orchestration to the cache, stopping the orchestrator that it
+// replaces or the least recently used orchestrator if the cache is full.
+func (c *orchestratorCache) put(id api.InstanceID, w *warmOrchestrator) {
+	var stale *warmOrchestrator
+	defer func() {
+		if stale != nil {
+			stale.stop()
+		}
+	}()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		entry := elem.Value.(*orchestratorCacheEntry)
+		stale, entry.orchestrator = entry.orchestrator, w
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.capacity {
+		if oldest := c.lru.Back(); oldest != nil {
+			c.lru.Remove(oldest)
+			entry := oldest.Value.(*orchestratorCacheEntry)
+			delete(c.entries, entry.id)
+			stale = entry.orchestrator
+		}
+	}
+	c.entries[id] = c.lru.PushFront(&orchestratorCacheEntry{id: id, orchestrator: w})
+}
@@ -0,0 +1,261 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Entity is the functional interface for durable entity implementations. Entities process the operations that are
+// sent to them one at a time, so they can update their state without any concurrency control. The state changes of
+// an operation that returns an error are discarded.
+type Entity func(ctx *EntityContext) (any, error)
+
+// EntityContext is the context parameter type for entity implementations.
+type EntityContext struct {
+	// ID is the ID of the entity.
+	ID api.EntityID
+
+	// Operation is the name of the operation that the entity processes.
+	Operation string
+
+	rawInput []byte
+	rawState []byte
+}
+
+// GetInput unmarshals the serialized input of the operation and stores it in [v].
+func (ctx *EntityContext) GetInput(v any) error {
+	return unmarshalData(ctx.rawInput, v)
+}
+
+// HasState returns true if the entity has a state.
+func (ctx *EntityContext) HasState() bool {
+	return ctx.rawState != nil
+}
+
+// GetState unmarshals the state of the entity and stores it in [v]. [v] is left unchanged if the entity doesn't have
+// a state.
+func (ctx *EntityContext) GetState(v any) error {
+	return unmarshalData(ctx.rawState, v)
+}
+
+// SetState sets the state of the entity. The specified value must be serializable to JSON.
+func (ctx *EntityContext) SetState(v any) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entity state to JSON: %w", err)
+	}
+	ctx.rawState = bytes
+	return nil
+}
+
+// DeleteState deletes the state of the entity.
+func (ctx *EntityContext) DeleteState() {
+	ctx.rawState = nil
+}
+
+type entityOperationOption func(*entityOperationOptions) error
+
+type entityOperationOptions struct {
+	rawInput *string
+}
+
+// WithEntityInput configures an input for an entity operation. The specified input must be JSON serializable.
+func WithEntityInput(input any) entityOperationOption {
+	return func(opt *entityOperationOptions) error {
+		data, err := marshalData(input)
+		if err != nil {
+			return err
+		}
+		rawInput := string(data)
+		opt.rawInput = &rawInput
+		return nil
+	}
+}
+
+// WithRawEntityInput configures a raw input for an entity operation.
+func WithRawEntityInput(input string) entityOperationOption {
+	return func(opt *entityOperationOptions) error {
+		opt.rawInput = &input
+		return nil
+	}
+}
+
+// SignalEntity sends a one-way operation to an entity, without waiting for the entity to process it. The entity is
+// created if it doesn't exist yet.
+func (ctx *OrchestrationContext) SignalEntity(id api.EntityID, operation string, opts ...entityOperationOption) error {
+	options := new(entityOperationOptions)
+	for _, configure := range opts {
+		if err := configure(options); err != nil {
+			return err
+		}
+	}
+	return ctx.sendEntityRequest(id, &helpers.EntityRequest{Operation: operation, Input: options.rawInput})
+}
+
+// CallEntity sends an operation to an entity and returns a task that completes with the result of the operation
+// once the entity processed it. The entity is created if it doesn't exist yet. Awaiting the task returns an error if
+// the operation failed.
+func (ctx *OrchestrationContext) CallEntity(id api.EntityID, operation string, opts ...entityOperationOption) Task {
+	options := new(entityOperationOptions)
+	for _, configure := range opts {
+		if err := configure(options); err != nil {
+			failedTask := newTask(ctx)
+			failedTask.fail(helpers.NewTaskFailureDetails(err))
+			return failedTask
+		}
+	}
+
+	// The request ID must be unique across the generations of the calling orchestration
+	requestID := fmt.Sprintf("%s:%d", ctx.executionID, ctx.sequenceNumber)
+	req := &helpers.EntityRequest{ID: requestID, Operation: operation, Input: options.rawInput, ReplyTo: string(ctx.ID)}
+	if err := ctx.sendEntityRequest(id, req); err != nil {
+		failedTask := newTask(ctx)
+		failedTask.fail(helpers.NewTaskFailureDetails(err))
+		return failedTask
+	}
+	return &entityCallTask{response: ctx.WaitForSingleEvent(helpers.EntityResponseEventName(requestID), -1)}
+}
+
+func (ctx *OrchestrationContext) sendEntityRequest(id api.EntityID, req *helpers.EntityRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entity request to JSON: %w", err)
+	}
+
+	// Entities are started on demand. Starting an entity that already exists has no effect, so it's only done
+	// once per execution of the orchestration to avoid needless messages.
+	if _, ok := ctx.startedEntities[id.String()]; !ok {
+		startAction := helpers.NewStartDetachedOrchestrationAction(
+			ctx.getNextSequenceNumber(),
+			helpers.EntityOrchestratorName(id.Name),
+			id.String(),
+			nil,
+		)
+		ctx.pendingActions[startAction.Id] = startAction
+		ctx.startedEntities[id.String()] = struct{}{}
+	}
+	ctx.sendEvent(id.String(), helpers.EntityOperationEventName, wrapperspb.String(string(data)))
+	return nil
+}
+
+func (ctx *OrchestrationContext) sendEvent(iid string, name string, data *wrapperspb.StringValue) {
+	sendEventAction := helpers.NewSendEventAction(iid, name, data)
+	sendEventAction.Id = ctx.getNextSequenceNumber()
+	ctx.pendingActions[sendEventAction.Id] = sendEventAction
+}
+
+// entityCallTask is the task returned by CallEntity, which completes when the response of the entity is received.
+type entityCallTask struct {
+	response Task
+}
+
+// Await blocks the current orchestrator until the entity processed the operation, and then saves the unmarshalled
+// result of the operation (if any) into [v]. See [completableTask.Await].
+func (t *entityCallTask) Await(v any) error {
+	var resp helpers.EntityResponse
+	if err := t.response.Await(&resp); err != nil {
+		return err
+	}
+	if resp.ErrorType != "" {
+		return fmt.Errorf("task failed with an error: %v", resp.ErrorMessage)
+	}
+	if v != nil && resp.Result != nil {
+		if err := unmarshalData([]byte(*resp.Result), v); err != nil {
+			return fmt.Errorf("failed to decode task result: %w", err)
+		}
+	}
+	return nil
+}
+
+// entityOrchestrator returns the orchestrator that runs the instances of an entity. The state of the entity is the
+// input of the orchestration. Each generation of the orchestration waits for operations, processes all the
+// operations that were received when the first one is processed, and continues as new with the updated state, so
+// that the history of entities doesn't grow.
+func entityOrchestrator(entity Entity) Orchestrator {
+	return func(ctx *OrchestrationContext) (any, error) {
+		id, ok := api.EntityIDFromInstanceID(ctx.ID)
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not a valid entity ID", ctx.ID)
+		}
+		state := ctx.rawInput
+
+		var req helpers.EntityRequest
+		if err := ctx.WaitForSingleEvent(helpers.EntityOperationEventName, -1).Await(&req); err != nil {
+			return nil, err
+		}
+
+		// Process the rest of the history, which buffers the operations that were received with the first one. The
+		// history of a generation doesn't change once an operation is received, so this is deterministic.
+		for {
+			if ok, err := ctx.processNextEvent(); err != nil {
+				return nil, err
+			} else if !ok {
+				break
+			}
+		}
+
+		for {
+			var err error
+			if state, err = ctx.executeEntityOperation(id, entity, state, &req); err != nil {
+				return nil, err
+			}
+
+			req = helpers.EntityRequest{}
+			if err := ctx.WaitForSingleEvent(helpers.EntityOperationEventName, 0).Await(&req); errors.Is(err, ErrTaskCanceled) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if state == nil {
+			ctx.ContinueAsNew(nil, WithKeepUnprocessedEvents())
+		} else {
+			ctx.ContinueAsNew(json.RawMessage(state), WithKeepUnprocessedEvents())
+		}
+		return nil, nil
+	}
+}
+
+// executeEntityOperation executes an operation, replies to the caller if any, and returns the new state of the entity.
+func (ctx *OrchestrationContext) executeEntityOperation(id api.EntityID, entity Entity, state []byte, req *helpers.EntityRequest) ([]byte, error) {
+	ectx := &EntityContext{ID: id, Operation: req.Operation, rawState: state}
+	if req.Input != nil {
+		ectx.rawInput = []byte(*req.Input)
+	}
+
+	var resp helpers.EntityResponse
+	result, opErr := entity(ectx)
+	if opErr == nil {
+		if result != nil {
+			bytes, err := marshalData(result)
+			if err != nil {
+				opErr = fmt.Errorf("failed to marshal entity operation result to JSON: %w", err)
+			} else {
+				rawResult := string(bytes)
+				resp.Result = &rawResult
+			}
+		}
+	}
+	if opErr != nil {
+		// The state changes of failed operations are discarded
+		fd := helpers.NewTaskFailureDetails(opErr)
+		resp = helpers.EntityResponse{ErrorType: fd.ErrorType, ErrorMessage: fd.ErrorMessage}
+	} else {
+		state = ectx.rawState
+	}
+
+	if req.ReplyTo != "" {
+		data, err := json.Marshal(&resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal entity response to JSON: %w", err)
+		}
+		ctx.sendEvent(req.ReplyTo, helpers.EntityResponseEventName(req.ID), wrapperspb.String(string(data)))
+	}
+	return state, nil
+}
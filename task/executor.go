@@ -14,13 +14,40 @@ import (
 
 type taskExecutor struct {
 	Registry *TaskRegistry
+	cache    *orchestratorCache // nil if caching is disabled
+}
+
+// TaskExecutorOption configures the executor returned by [NewTaskExecutor].
+type TaskExecutorOption func(*taskExecutor)
+
+// WithOrchestratorCacheSize configures the executor to keep the orchestrators of up to the specified number of running
+// orchestrations in memory between work items. A cached orchestrator resumes where it was blocked and only processes
+// the new events of the next work item, instead of replaying the full history of the orchestration.
+//
+// A cached orchestrator is only resumed if the history of the next work item starts with the same history events
+// that it already processed, which is the case when the orchestration worker caches the runtime state of the
+// orchestration using backend.WithStateCacheSize. Otherwise, the cached orchestrator is discarded and the history is
+// replayed as usual. Each cached orchestrator keeps a goroutine parked, and the least recently used orchestrators are
+// discarded when the cache is full. Caching is disabled by default.
+func WithOrchestratorCacheSize(size int) TaskExecutorOption {
+	return func(te *taskExecutor) {
+		if size > 0 {
+			te.cache = newOrchestratorCache(size)
+		} else {
+			te.cache = nil
+		}
+	}
 }
 
 // NewTaskExecutor returns a [backend.Executor] implementation that executes orchestrator and activity functions in-memory.
-func NewTaskExecutor(registry *TaskRegistry) backend.Executor {
-	return &taskExecutor{
+func NewTaskExecutor(registry *TaskRegistry, opts ...TaskExecutorOption) backend.Executor {
+	te := &taskExecutor{
 		Registry: registry,
 	}
+	for _, configure := range opts {
+		configure(te)
+	}
+	return te
 }
 
 // ExecuteActivity implements backend.Executor and executes an activity function in the current goroutine.
@@ -78,17 +105,47 @@ func (te *taskExecutor) ExecuteActivity(ctx context.Context, id api.InstanceID,
 
 // ExecuteOrchestrator implements backend.Executor and executes an orchestrator function in the current goroutine.
 func (te *taskExecutor) ExecuteOrchestrator(ctx context.Context, id api.InstanceID, oldEvents []*protos.HistoryEvent, newEvents []*protos.HistoryEvent) (*backend.ExecutionResults, error) {
+	if te.cache != nil {
+		return te.executeWarmOrchestrator(id, oldEvents, newEvents), nil
+	}
+
 	orchestrationCtx := NewOrchestrationContext(te.Registry, id, oldEvents, newEvents)
 	actions := orchestrationCtx.start()
+	return newExecutionResults(orchestrationCtx, actions), nil
+}
+
+// executeWarmOrchestrator resumes the cached orchestrator of the orchestration if it can process the history, or
+// starts a new orchestrator otherwise, and caches the orchestrator if it's waiting for more events.
+func (te *taskExecutor) executeWarmOrchestrator(id api.InstanceID, oldEvents []*protos.HistoryEvent, newEvents []*protos.HistoryEvent) *backend.ExecutionResults {
+	var w *warmOrchestrator
+	var execution warmExecution
+	if cached, ok := te.cache.take(id); ok && cached.canResume(oldEvents) {
+		w = cached
+		execution = w.execute(oldEvents, newEvents)
+	} else {
+		if ok {
+			cached.stop()
+		}
+		w, execution = startWarmOrchestrator(NewOrchestrationContext(te.Registry, id, oldEvents, newEvents))
+	}
+
+	if execution.panicValue != nil {
+		panic(execution.panicValue)
+	}
+	if execution.parked {
+		te.cache.put(id, w)
+	}
+	return newExecutionResults(w.ctx, execution.actions)
+}
 
-	results := &backend.ExecutionResults{
+func newExecutionResults(orchestrationCtx *OrchestrationContext, actions []*protos.OrchestratorAction) *backend.ExecutionResults {
+	return &backend.ExecutionResults{
 		Response: &protos.OrchestratorResponse{
-			InstanceId:   string(id),
+			InstanceId:   string(orchestrationCtx.ID),
 			Actions:      actions,
-			CustomStatus: nil,
+			CustomStatus: orchestrationCtx.customStatus,
 		},
 	}
-	return results, nil
 }
 
 func unmarshalData(data []byte, v any) error {
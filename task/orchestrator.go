@@ -4,9 +4,14 @@ import (
 	"container/list"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/microsoft/durabletask-go/api"
@@ -22,10 +27,12 @@ type Orchestrator func(ctx *OrchestrationContext) (any, error)
 type OrchestrationContext struct {
 	ID             api.InstanceID
 	Name           string
+	Version        string
 	IsReplaying    bool
 	CurrentTimeUtc time.Time
 
 	registry            *TaskRegistry
+	executionID         string
 	rawInput            []byte
 	oldEvents           []*protos.HistoryEvent
 	newEvents           []*protos.HistoryEvent
@@ -37,16 +44,28 @@ type OrchestrationContext struct {
 	pendingTasks        map[int32]*completableTask
 	continuedAsNew      bool
 	continuedAsNewInput any
+	customStatus        *wrapperspb.StringValue
+	guidCounter         int
+	random              *rand.Rand
 
 	bufferedExternalEvents     map[string]*list.List
 	pendingExternalEventTasks  map[string]*list.List
 	saveBufferedExternalEvents bool
+
+	// startedEntities are the IDs of the entities that were started by the current execution
+	startedEntities map[string]struct{}
+
+	// warm is set if the orchestrator keeps running between work items, see [WithOrchestratorCacheSize]
+	warm *warmOrchestrator
 }
 
 // callSubOrchestratorOptions is a struct that holds the options for the CallSubOrchestrator orchestrator method.
 type callSubOrchestratorOptions struct {
-	instanceID string
-	rawInput   *wrapperspb.StringValue
+	instanceID  string
+	rawInput    *wrapperspb.StringValue
+	version     *wrapperspb.StringValue
+	detached    bool
+	retryPolicy *RetryPolicy
 }
 
 // subOrchestratorOption is a functional option type for the CallSubOrchestrator orchestrator method.
@@ -94,6 +113,42 @@ func WithSubOrchestrationInstanceID(instanceID string) subOrchestratorOption {
 	}
 }
 
+// WithSubOrchestrationVersion is a functional option type for the CallSubOrchestrator orchestrator method that
+// specifies the version of the sub-orchestration. See [TaskRegistry.AddVersionedOrchestratorN].
+func WithSubOrchestrationVersion(version string) subOrchestratorOption {
+	return func(opts *callSubOrchestratorOptions) error {
+		opts.version = wrapperspb.String(version)
+		return nil
+	}
+}
+
+// WithDetachedSubOrchestration is a functional option type for the CallSubOrchestrator orchestrator method that
+// starts the orchestration detached from the calling orchestration, for "spawn a background job" patterns. A
+// detached orchestration has no parent: the calling orchestration doesn't wait for it or track its completion, and
+// it keeps running when the calling orchestration completes or is terminated. The task returned by
+// CallSubOrchestrator completes as soon as the detached orchestration is scheduled, without a result.
+func WithDetachedSubOrchestration() subOrchestratorOption {
+	return func(opts *callSubOrchestratorOptions) error {
+		opts.detached = true
+		return nil
+	}
+}
+
+// WithSubOrchestrationRetryPolicy is a functional option type for the CallSubOrchestrator orchestrator method that
+// configures the automatic retries of the sub-orchestration when it fails. Each attempt runs as a new orchestration
+// instance: when an instance ID is specified, the retries use it with the attempt number as a suffix, e.g. "child-2"
+// for the second attempt of "child". When the policy is exhausted, awaiting the sub-orchestration returns the error
+// of the last attempt. The option is ignored for detached sub-orchestrations, whose completion isn't tracked.
+func WithSubOrchestrationRetryPolicy(policy RetryPolicy) subOrchestratorOption {
+	return func(opts *callSubOrchestratorOptions) error {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		opts.retryPolicy = &policy
+		return nil
+	}
+}
+
 // NewOrchestrationContext returns a new [OrchestrationContext] struct with the specified parameters.
 func NewOrchestrationContext(registry *TaskRegistry, id api.InstanceID, oldEvents []*protos.HistoryEvent, newEvents []*protos.HistoryEvent) *OrchestrationContext {
 	return &OrchestrationContext{
@@ -111,12 +166,17 @@ func (ctx *OrchestrationContext) start() (actions []*protos.OrchestratorAction)
 	ctx.sequenceNumber = 0
 	ctx.pendingActions = make(map[int32]*protos.OrchestratorAction)
 	ctx.pendingTasks = make(map[int32]*completableTask)
+	ctx.startedEntities = make(map[string]struct{})
 
 	defer func() {
 		result := recover()
 		if result == ErrTaskBlocked {
 			// Expected, normal part of execution
 			actions = ctx.actions()
+		} else if f, ok := result.(historyProcessingFailure); ok {
+			// Processing the history failed while the orchestrator was awaiting a task
+			ctx.setHistoryProcessingFailed(f.err)
+			actions = ctx.actions()
 		} else if result != nil {
 			// Unexpected panic!
 			panic(result)
@@ -125,7 +185,7 @@ func (ctx *OrchestrationContext) start() (actions []*protos.OrchestratorAction)
 
 	for {
 		if ok, err := ctx.processNextEvent(); err != nil {
-			ctx.setFailed(err)
+			ctx.setHistoryProcessingFailed(err)
 			break
 		} else if !ok {
 			// Orchestrator finished, break out of the loop and return any pending actions
@@ -149,6 +209,12 @@ func (ctx *OrchestrationContext) processNextEvent() (bool, error) {
 	return true, nil
 }
 
+// waitForEvents is called when the orchestrator awaits a task after all the events of the history were processed.
+// It returns true once more events are available to a warm orchestrator, and false if the orchestrator must unwind.
+func (ctx *OrchestrationContext) waitForEvents() bool {
+	return ctx.warm != nil && ctx.warm.park()
+}
+
 func (ctx *OrchestrationContext) getNextHistoryEvent() (*protos.HistoryEvent, bool) {
 	var historyList []*protos.HistoryEvent
 	index := ctx.historyIndex
@@ -189,6 +255,8 @@ func (ctx *OrchestrationContext) processEvent(e *backend.HistoryEvent) error {
 		err = ctx.onTaskFailed(tf)
 	} else if ts := e.GetSubOrchestrationInstanceCreated(); ts != nil {
 		err = ctx.onSubOrchestrationScheduled(e.EventId, ts)
+	} else if es := e.GetEventSent(); es != nil {
+		err = ctx.onEventSent(e.EventId, es)
 	} else if sc := e.GetSubOrchestrationInstanceCompleted(); sc != nil {
 		err = ctx.onSubOrchestrationCompleted(sc)
 	} else if sf := e.GetSubOrchestrationInstanceFailed(); sf != nil {
@@ -207,6 +275,12 @@ func (ctx *OrchestrationContext) processEvent(e *backend.HistoryEvent) error {
 		err = ctx.onExecutionTerminated(et)
 	} else if oc := e.GetOrchestratorCompleted(); oc != nil {
 		// Nothing to do
+	} else if customStatus, ok := helpers.GetUpdatedCustomStatus(e); ok {
+		// Custom status updates from clients take effect at their position in the history, so that later calls to
+		// SetCustomStatus override them
+		ctx.customStatus = wrapperspb.String(customStatus)
+	} else if ge := e.GetGenericEvent(); ge != nil {
+		// Other generic events, like reevaluation requests, only wake up the orchestrator
 	} else {
 		err = fmt.Errorf("don't know how to handle event: %v", e)
 	}
@@ -231,10 +305,22 @@ func (ctx *OrchestrationContext) CallActivity(activity interface{}, opts ...call
 		}
 	}
 
+	name := helpers.GetTaskFunctionName(activity)
+	if options.retryPolicy != nil {
+		return ctx.newRetryableTask(*options.retryPolicy, func(int) *completableTask {
+			return ctx.scheduleActivity(name, options)
+		})
+	}
+	return ctx.scheduleActivity(name, options)
+}
+
+func (ctx *OrchestrationContext) scheduleActivity(name string, options *callActivityOptions) *completableTask {
 	scheduleTaskAction := helpers.NewScheduleTaskAction(
 		ctx.getNextSequenceNumber(),
-		helpers.GetTaskFunctionName(activity),
+		name,
 		options.rawInput)
+	helpers.SetActivityTimeout(scheduleTaskAction.GetScheduleTask(), options.timeout)
+	helpers.SetActivityQueue(scheduleTaskAction.GetScheduleTask(), ctx.registry.getActivityQueue(name))
 
 	ctx.pendingActions[scheduleTaskAction.Id] = scheduleTaskAction
 
@@ -253,12 +339,43 @@ func (ctx *OrchestrationContext) CallSubOrchestrator(orchestrator interface{}, o
 		}
 	}
 
+	if options.detached {
+		startAction := helpers.NewStartDetachedOrchestrationAction(
+			ctx.getNextSequenceNumber(),
+			helpers.GetTaskFunctionName(orchestrator),
+			options.instanceID,
+			options.rawInput,
+		)
+		helpers.SetDetachedOrchestrationVersion(startAction.GetSendEvent(), options.version.GetValue())
+		ctx.pendingActions[startAction.Id] = startAction
+
+		task := newTask(ctx)
+		task.complete(nil)
+		return task
+	}
+
+	name := helpers.GetTaskFunctionName(orchestrator)
+	if options.retryPolicy != nil {
+		return ctx.newRetryableTask(*options.retryPolicy, func(attempt int) *completableTask {
+			instanceID := options.instanceID
+			if instanceID != "" && attempt > 1 {
+				// The instance of the previous attempt still exists, so each attempt needs its own instance ID
+				instanceID = fmt.Sprintf("%s-%d", instanceID, attempt)
+			}
+			return ctx.scheduleSubOrchestration(name, instanceID, options)
+		})
+	}
+	return ctx.scheduleSubOrchestration(name, options.instanceID, options)
+}
+
+func (ctx *OrchestrationContext) scheduleSubOrchestration(name string, instanceID string, options *callSubOrchestratorOptions) *completableTask {
 	createSubOrchestrationAction := helpers.NewCreateSubOrchestrationAction(
 		ctx.getNextSequenceNumber(),
-		helpers.GetTaskFunctionName(orchestrator),
-		options.instanceID,
+		name,
+		instanceID,
 		options.rawInput,
 	)
+	createSubOrchestrationAction.GetCreateSubOrchestration().Version = options.version
 	ctx.pendingActions[createSubOrchestrationAction.Id] = createSubOrchestrationAction
 
 	task := newTask(ctx)
@@ -285,8 +402,8 @@ func (ctx *OrchestrationContext) createTimerInternal(delay time.Duration) *compl
 // or when the specified timeout expires.
 //
 // The [timeout] parameter can be used to define a timeout for receiving the event. If the timeout expires before the
-// named event is received, the task will be completed and will return a timeout error value [ErrTaskCanceled] when
-// awaited. Otherwise, the awaited task will return the deserialized payload of the received event. A Duration value
+// named event is received, the task will be completed and will return an [EventTimeoutError], which matches
+// [ErrTaskCanceled] when compared using errors.Is, when awaited. Otherwise, the awaited task will return the deserialized payload of the received event. A Duration value
 // of zero returns a canceled task if the event isn't already available in the history. Use a negative Duration to
 // wait indefinitely for the event to be received.
 //
@@ -309,7 +426,7 @@ func (ctx *OrchestrationContext) WaitForSingleEvent(eventName string, timeout ti
 		task.complete(rawValue)
 	} else if timeout == 0 {
 		// Zero-timeout means fail immediately if the event isn't already buffered.
-		task.cancel()
+		task.cancelWithReason(&EventTimeoutError{EventName: eventName})
 	} else {
 		// Keep a reference to this task so we can complete it when the event of this name arrives
 		var taskList *list.List
@@ -322,14 +439,39 @@ func (ctx *OrchestrationContext) WaitForSingleEvent(eventName string, timeout ti
 
 		if timeout > 0 {
 			ctx.createTimerInternal(timeout).onCompleted(func() {
-				task.cancel()
+				// Durable timers can't be deleted, so the timer still fires if the event was received first, in
+				// which case it has no effect
+				if task.isCompleted {
+					return
+				}
+				task.cancelWithReason(&EventTimeoutError{EventName: eventName, Timeout: timeout})
 				taskList.Remove(taskElement)
+				if taskList.Len() == 0 && ctx.pendingExternalEventTasks[key] == taskList {
+					// Events that are received later are buffered
+					delete(ctx.pendingExternalEventTasks, key)
+				}
 			})
 		}
 	}
 	return task
 }
 
+// SetCustomStatus sets a custom status value for the current orchestration. The specified value must be
+// serializable to JSON. Custom status values are visible to clients through the orchestration metadata,
+// and can be read back in a typed way using [api.ReadCustomStatus]. Passing nil clears the custom status.
+func (ctx *OrchestrationContext) SetCustomStatus(customStatus any) error {
+	if customStatus == nil {
+		ctx.customStatus = wrapperspb.String("")
+		return nil
+	}
+	bytes, err := marshalData(customStatus)
+	if err != nil {
+		return fmt.Errorf("failed to marshal custom status to JSON: %w", err)
+	}
+	ctx.customStatus = wrapperspb.String(string(bytes))
+	return nil
+}
+
 func (ctx *OrchestrationContext) ContinueAsNew(newInput any, options ...ContinueAsNewOption) {
 	ctx.continuedAsNew = true
 	ctx.continuedAsNewInput = newInput
@@ -338,16 +480,92 @@ func (ctx *OrchestrationContext) ContinueAsNew(newInput any, options ...Continue
 	}
 }
 
+// guidNamespace is the namespace of the name-based UUIDs created by NewGUID. It's the same namespace as in the other
+// Durable Task SDKs.
+var guidNamespace = uuid.MustParse("9e952958-5e33-4daf-827f-2fa12937b875")
+
+// NewGUID returns a new UUID that's the same every time the orchestrator is replayed, which makes it safe to use in
+// orchestrator functions, unlike uuid.New. The UUID is derived from the instance ID of the orchestration, the current
+// orchestration time, and the number of UUIDs that were created before it.
+func (ctx *OrchestrationContext) NewGUID() uuid.UUID {
+	name := fmt.Sprintf("%s_%s_%d", ctx.ID, ctx.CurrentTimeUtc.Format(time.RFC3339Nano), ctx.guidCounter)
+	ctx.guidCounter++
+	return uuid.NewSHA1(guidNamespace, []byte(name))
+}
+
+// Random returns a pseudo-random number generator that returns the same sequence of numbers every time the
+// orchestrator is replayed, which makes it safe to use in orchestrator functions, unlike the top-level functions of
+// the math/rand package. The generator is seeded with the instance ID and the execution ID of the orchestration, so
+// each generation of an orchestration that continues as new gets a different sequence.
+func (ctx *OrchestrationContext) Random() *rand.Rand {
+	if ctx.random == nil {
+		h := fnv.New64a()
+		h.Write([]byte(ctx.ID))
+		h.Write([]byte(ctx.executionID))
+		ctx.random = rand.New(rand.NewSource(int64(h.Sum64())))
+	}
+	return ctx.random
+}
+
+// SideEffect executes a non-deterministic function, e.g. one that reads the local time or an environment variable,
+// and records its result in the history of the orchestration. The function is executed only once: when the
+// orchestrator is replayed, the returned task completes with the recorded result instead. The result must be
+// serializable to JSON. If the function returns an error, awaiting the task returns an error with the same message.
+//
+// The function must be quick and must not use the orchestration context. Use activities for I/O.
+func (ctx *OrchestrationContext) SideEffect(fn func() (any, error)) Task {
+	id := ctx.getNextSequenceNumber()
+	task := newTask(ctx)
+
+	var data *wrapperspb.StringValue
+	var failed bool
+	if recorded, ok := ctx.findEventSent(id); ok {
+		_, failed = helpers.IsSideEffect(recorded)
+		data = recorded.Input
+	} else if result, err := fn(); err != nil {
+		data, failed = wrapperspb.String(err.Error()), true
+	} else if bytes, err := marshalData(result); err != nil {
+		data, failed = wrapperspb.String(fmt.Sprintf("failed to marshal the side effect result to JSON: %v", err)), true
+	} else if bytes != nil {
+		data = wrapperspb.String(string(bytes))
+	}
+	ctx.pendingActions[id] = helpers.NewSideEffectAction(id, data, failed)
+
+	if failed {
+		task.fail(&protos.TaskFailureDetails{ErrorType: "SideEffectFailed", ErrorMessage: data.GetValue()})
+	} else if data != nil {
+		task.complete([]byte(data.GetValue()))
+	} else {
+		task.complete(nil)
+	}
+	return task
+}
+
+// findEventSent returns the EventSent event with the specified sequence number from the history of the current
+// execution, if it was recorded by a previous execution.
+func (ctx *OrchestrationContext) findEventSent(taskID int32) (*protos.EventSentEvent, bool) {
+	for _, history := range [][]*protos.HistoryEvent{ctx.oldEvents, ctx.newEvents} {
+		for _, e := range history {
+			if es := e.GetEventSent(); es != nil && e.EventId == taskID {
+				return es, true
+			}
+		}
+	}
+	return nil, false
+}
+
 func (ctx *OrchestrationContext) onExecutionStarted(es *protos.ExecutionStartedEvent) error {
-	orchestrator, ok := ctx.registry.orchestrators[es.Name]
+	version := es.Version.GetValue()
+	orchestrator, ok := ctx.registry.getOrchestrator(es.Name, version)
 	if !ok {
-		// try looking for a "default" orchestrator
-		orchestrator, ok = ctx.registry.orchestrators["*"]
-		if !ok {
-			return fmt.Errorf("orchestrator named '%s' is not registered", es.Name)
+		if version != "" {
+			return fmt.Errorf("version '%s' of orchestrator named '%s' is not registered", version, es.Name)
 		}
+		return fmt.Errorf("orchestrator named '%s' is not registered", es.Name)
 	}
 	ctx.Name = es.Name
+	ctx.Version = version
+	ctx.executionID = es.OrchestrationInstance.GetExecutionId().GetValue()
 	if es.Input != nil {
 		ctx.rawInput = []byte(es.Input.Value)
 	}
@@ -373,17 +591,61 @@ func (ctx *OrchestrationContext) onExecutionStarted(es *protos.ExecutionStartedE
 }
 
 func (ctx *OrchestrationContext) onTaskScheduled(taskID int32, ts *protos.TaskScheduledEvent) error {
-	if a, ok := ctx.pendingActions[taskID]; !ok || a.GetScheduleTask() == nil {
-		return fmt.Errorf(
-			"a previous execution called CallActivity for '%s' and sequence number %d at this point in the orchestration logic, but the current execution doesn't have this action with this sequence number",
-			ts.Name,
-			taskID,
-		)
+	return ctx.matchReplayedAction(taskID, "CallActivity", ts.Name)
+}
+
+// matchReplayedAction checks that the current execution scheduled the same action, with the same sequence number, as
+// the previous execution that recorded the history event being replayed. Otherwise, the code of the orchestrator
+// changed in a way that isn't compatible with the history, and a [NonDeterminismError] is returned.
+func (ctx *OrchestrationContext) matchReplayedAction(taskID int32, expectedAction string, expectedName string) error {
+	a, ok := ctx.pendingActions[taskID]
+	if !ok || a.GetCompleteOrchestration() != nil {
+		// The current execution completed the orchestration before scheduling this action
+		return &NonDeterminismError{SequenceNumber: taskID, ExpectedAction: expectedAction, ExpectedName: expectedName}
+	}
+	if action, name := describeAction(a); action != expectedAction || name != expectedName {
+		return &NonDeterminismError{
+			SequenceNumber: taskID,
+			ExpectedAction: expectedAction,
+			ExpectedName:   expectedName,
+			ActualAction:   action,
+			ActualName:     name,
+		}
 	}
 	delete(ctx.pendingActions, taskID)
 	return nil
 }
 
+// describeAction returns the name of the orchestration context method that scheduled an action, and the name of the
+// activity, orchestration, or event that the action refers to, if any.
+func describeAction(a *protos.OrchestratorAction) (string, string) {
+	if st := a.GetScheduleTask(); st != nil {
+		return "CallActivity", st.Name
+	} else if cso := a.GetCreateSubOrchestration(); cso != nil {
+		return "CallSubOrchestrator", cso.Name
+	} else if se := a.GetSendEvent(); se != nil {
+		return describeSentEvent(se, se.Name)
+	} else if a.GetCreateTimer() != nil {
+		return "CreateTimer", ""
+	} else if a.GetTerminateOrchestration() != nil {
+		return "TerminateOrchestration", ""
+	}
+	return "unknown", ""
+}
+
+// describeSentEvent returns the name of the orchestration context method that sent the specified SendEventAction or
+// EventSentEvent message with the specified event name, and the name that it was called with. Detached orchestrations are started, and side effects are recorded, by
+// sending an event.
+func describeSentEvent(m proto.Message, eventName string) (string, string) {
+	if isSideEffect, _ := helpers.IsSideEffect(m); isSideEffect {
+		return "SideEffect", ""
+	}
+	if helpers.IsStartDetachedOrchestration(m) {
+		return "CallSubOrchestrator", eventName
+	}
+	return "SendEvent", eventName
+}
+
 func (ctx *OrchestrationContext) onTaskCompleted(tc *protos.TaskCompletedEvent) error {
 	taskID := tc.TaskScheduledId
 	task, ok := ctx.pendingTasks[taskID]
@@ -420,15 +682,12 @@ func (ctx *OrchestrationContext) onTaskFailed(tf *protos.TaskFailedEvent) error
 }
 
 func (ctx *OrchestrationContext) onSubOrchestrationScheduled(taskID int32, ts *protos.SubOrchestrationInstanceCreatedEvent) error {
-	if a, ok := ctx.pendingActions[taskID]; !ok || a.GetCreateSubOrchestration() == nil {
-		return fmt.Errorf(
-			"a previous execution called CallSubOrchestrator for '%s' and sequence number %d at this point in the orchestration logic, but the current execution doesn't have this action with this sequence number",
-			ts.Name,
-			taskID,
-		)
-	}
-	delete(ctx.pendingActions, taskID)
-	return nil
+	return ctx.matchReplayedAction(taskID, "CallSubOrchestrator", ts.Name)
+}
+
+func (ctx *OrchestrationContext) onEventSent(taskID int32, es *protos.EventSentEvent) error {
+	action, name := describeSentEvent(es, es.Name)
+	return ctx.matchReplayedAction(taskID, action, name)
 }
 
 func (ctx *OrchestrationContext) onSubOrchestrationCompleted(soc *protos.SubOrchestrationInstanceCompletedEvent) error {
@@ -468,14 +727,7 @@ func (ctx *OrchestrationContext) onSubOrchestrationFailed(sof *protos.SubOrchest
 }
 
 func (ctx *OrchestrationContext) onTimerCreated(e *protos.HistoryEvent) error {
-	if a, ok := ctx.pendingActions[e.EventId]; !ok || a.GetCreateTimer() == nil {
-		return fmt.Errorf(
-			"a previous execution called CreateTimer with sequence number %d, but the current execution doesn't have this action with this sequence number",
-			e.EventId,
-		)
-	}
-	delete(ctx.pendingActions, e.EventId)
-	return nil
+	return ctx.matchReplayedAction(e.EventId, "CreateTimer", "")
 }
 
 func (ctx *OrchestrationContext) onTimerFired(tf *protos.TimerFiredEvent) error {
@@ -521,6 +773,30 @@ func (ctx *OrchestrationContext) onExternalEventRaised(e *protos.HistoryEvent) e
 	return nil
 }
 
+// unprocessedExternalEvents returns the buffered external events in the order in which they were received, so that
+// events with different names aren't reordered when they're carried over to a new generation.
+func (ctx *OrchestrationContext) unprocessedExternalEvents() []*protos.HistoryEvent {
+	buffered := make(map[*protos.HistoryEvent]struct{})
+	for _, eventList := range ctx.bufferedExternalEvents {
+		for item := eventList.Front(); item != nil; item = item.Next() {
+			buffered[item.Value.(*protos.HistoryEvent)] = struct{}{}
+		}
+	}
+	if len(buffered) == 0 {
+		return nil
+	}
+
+	events := make([]*protos.HistoryEvent, 0, len(buffered))
+	for _, history := range [][]*protos.HistoryEvent{ctx.oldEvents, ctx.newEvents} {
+		for _, e := range history {
+			if _, ok := buffered[e]; ok {
+				events = append(events, e)
+			}
+		}
+	}
+	return events
+}
+
 func (ctx *OrchestrationContext) onExecutionSuspended(er *protos.ExecutionSuspendedEvent) error {
 	ctx.isSuspended = true
 	return nil
@@ -538,6 +814,11 @@ func (ctx *OrchestrationContext) onExecutionResumed(er *protos.ExecutionResumedE
 }
 
 func (ctx *OrchestrationContext) onExecutionTerminated(et *protos.ExecutionTerminatedEvent) error {
+	// Termination takes effect even if the orchestration is suspended, and any events that were buffered
+	// during the suspension are discarded since the orchestration will never process them.
+	ctx.isSuspended = false
+	ctx.suspendedEvents = nil
+
 	if et.Recurse {
 		// Use a map to track which sub-orchestrations have been created but not completed
 		instancesToTerminate := make(map[int32]string)
@@ -601,6 +882,14 @@ func (ctx *OrchestrationContext) setFailed(appError error) error {
 	return nil
 }
 
+// setHistoryProcessingFailed fails the orchestration with an error that occurred while processing its history, e.g. a
+// [NonDeterminismError]. The actions that were scheduled by the current execution are discarded, since they may not
+// match the history.
+func (ctx *OrchestrationContext) setHistoryProcessingFailed(err error) {
+	ctx.pendingActions = make(map[int32]*protos.OrchestratorAction)
+	ctx.setFailed(err)
+}
+
 func (ctx *OrchestrationContext) setContinuedAsNew() error {
 	status := protos.OrchestrationStatus_ORCHESTRATION_STATUS_CONTINUED_AS_NEW
 	var newRawInput *wrapperspb.StringValue
@@ -645,17 +934,21 @@ func (ctx *OrchestrationContext) actions() []*protos.OrchestratorAction {
 		return nil
 	}
 
+	// Actions are returned in the order in which they were scheduled, so that the messages that the orchestration
+	// sends to another orchestration, e.g. entity operations, are delivered in order
+	ids := make([]int, 0, len(ctx.pendingActions))
+	for id := range ctx.pendingActions {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
 	var actions []*protos.OrchestratorAction
-	for _, a := range ctx.pendingActions {
+	for _, id := range ids {
+		a := ctx.pendingActions[int32(id)]
 		actions = append(actions, a)
 		if ctx.continuedAsNew && ctx.saveBufferedExternalEvents {
 			if co := a.GetCompleteOrchestration(); co != nil {
-				for _, eventList := range ctx.bufferedExternalEvents {
-					for item := eventList.Front(); item != nil; item = item.Next() {
-						e := item.Value.(*protos.HistoryEvent)
-						co.CarryoverEvents = append(co.CarryoverEvents, e)
-					}
-				}
+				co.CarryoverEvents = append(co.CarryoverEvents, ctx.unprocessedExternalEvents()...)
 			}
 		}
 	}
@@ -2,21 +2,26 @@ package task
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/microsoft/durabletask-go/internal/helpers"
 )
 
 // TaskRegistry contains maps of names to corresponding orchestrator and activity functions.
 type TaskRegistry struct {
-	orchestrators map[string]Orchestrator
-	activities    map[string]Activity
+	orchestrators          map[string]Orchestrator
+	versionedOrchestrators map[string]map[string]Orchestrator
+	activities             map[string]Activity
+	activityQueues         map[string]string
 }
 
 // NewTaskRegistry returns a new [TaskRegistry] struct.
 func NewTaskRegistry() *TaskRegistry {
 	r := &TaskRegistry{
-		orchestrators: make(map[string]Orchestrator),
-		activities:    make(map[string]Activity),
+		orchestrators:          make(map[string]Orchestrator),
+		versionedOrchestrators: make(map[string]map[string]Orchestrator),
+		activities:             make(map[string]Activity),
+		activityQueues:         make(map[string]string),
 	}
 	return r
 }
@@ -28,8 +33,12 @@ func (r *TaskRegistry) AddOrchestrator(o Orchestrator) error {
 	return r.AddOrchestratorN(name, o)
 }
 
-// AddOrchestratorN adds an orchestrator function to the registry with a specified name.
+// AddOrchestratorN adds an orchestrator function to the registry with a specified name. Names that start with "@" are
+// reserved for entities.
 func (r *TaskRegistry) AddOrchestratorN(name string, o Orchestrator) error {
+	if helpers.IsEntityOrchestratorName(name) {
+		return fmt.Errorf("orchestrator name '%s' is reserved for entities", name)
+	}
 	if _, ok := r.orchestrators[name]; ok {
 		return fmt.Errorf("orchestrator named '%s' is already registered", name)
 	}
@@ -37,6 +46,83 @@ func (r *TaskRegistry) AddOrchestratorN(name string, o Orchestrator) error {
 	return nil
 }
 
+// AddVersionedOrchestrator adds a version of an orchestrator function to the registry. The name of the orchestrator
+// function is determined using reflection.
+func (r *TaskRegistry) AddVersionedOrchestrator(version string, o Orchestrator) error {
+	name := helpers.GetTaskFunctionName(o)
+	return r.AddVersionedOrchestratorN(name, version, o)
+}
+
+// AddVersionedOrchestratorN adds a version of an orchestrator function to the registry with a specified name.
+// Several versions of an orchestrator can be registered with the same name, so that in-flight orchestrations keep
+// running the code they were started with during rolling upgrades: orchestrations are dispatched to the version
+// that they were scheduled with, e.g. using api.WithVersion. Orchestrations that were scheduled with a version that
+// isn't registered fail rather than falling back to a different version of the code. Registering an empty version is
+// the same as calling [TaskRegistry.AddOrchestratorN].
+func (r *TaskRegistry) AddVersionedOrchestratorN(name string, version string, o Orchestrator) error {
+	if version == "" {
+		return r.AddOrchestratorN(name, o)
+	}
+	if helpers.IsEntityOrchestratorName(name) {
+		return fmt.Errorf("orchestrator name '%s' is reserved for entities", name)
+	}
+	versions, ok := r.versionedOrchestrators[name]
+	if !ok {
+		versions = make(map[string]Orchestrator)
+		r.versionedOrchestrators[name] = versions
+	}
+	if _, ok := versions[version]; ok {
+		return fmt.Errorf("version '%s' of orchestrator named '%s' is already registered", version, name)
+	}
+	versions[version] = o
+	return nil
+}
+
+// getOrchestrator returns the orchestrator function for the specified name and version.
+func (r *TaskRegistry) getOrchestrator(name string, version string) (Orchestrator, bool) {
+	if version != "" {
+		// Never run an explicit version with the code of another version
+		o, ok := r.versionedOrchestrators[name][version]
+		return o, ok
+	}
+	if o, ok := r.orchestrators[name]; ok {
+		return o, true
+	}
+	// try looking for a "default" orchestrator
+	o, ok := r.orchestrators["*"]
+	return o, ok
+}
+
+// OrchestratorNames returns the names of the registered orchestrator functions, sorted. Orchestrators with several
+// registered versions are listed once.
+func (r *TaskRegistry) OrchestratorNames() []string {
+	if len(r.versionedOrchestrators) == 0 {
+		return sortedKeys(r.orchestrators)
+	}
+	names := make(map[string]struct{}, len(r.orchestrators)+len(r.versionedOrchestrators))
+	for name := range r.orchestrators {
+		names[name] = struct{}{}
+	}
+	for name := range r.versionedOrchestrators {
+		names[name] = struct{}{}
+	}
+	return sortedKeys(names)
+}
+
+// ActivityNames returns the names of the registered activity functions, sorted.
+func (r *TaskRegistry) ActivityNames() []string {
+	return sortedKeys(r.activities)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // AddActivity adds an activity function to the registry. The name of the activity
 // function is determined using reflection.
 func (r *TaskRegistry) AddActivity(a Activity) error {
@@ -52,3 +138,46 @@ func (r *TaskRegistry) AddActivityN(name string, a Activity) error {
 	r.activities[name] = a
 	return nil
 }
+
+// RouteActivityN routes the activity with the specified name to a dedicated queue of activity work items, so that
+// it's only executed by the activity workers that fetch work items from that queue, e.g. workers with GPUs that are
+// configured using backend.WithActivityQueues. Activities are routed when they're scheduled, so the route must be
+// added to the registries of the workers that run the orchestrations that call the activity, which don't need to
+// register the activity itself. Activities without a route are scheduled to the default queue.
+func (r *TaskRegistry) RouteActivityN(name string, queue string) error {
+	if queue == "" {
+		return fmt.Errorf("the queue of activity '%s' must not be empty", name)
+	}
+	if existing, ok := r.activityQueues[name]; ok && existing != queue {
+		return fmt.Errorf("activity named '%s' is already routed to queue '%s'", name, existing)
+	}
+	r.activityQueues[name] = queue
+	return nil
+}
+
+// getActivityQueue returns the queue that the activity with the specified name is routed to, or an empty string for
+// the default queue.
+func (r *TaskRegistry) getActivityQueue(name string) string {
+	if r == nil {
+		return ""
+	}
+	return r.activityQueues[name]
+}
+
+// AddEntity adds an entity function to the registry. The name of the entity function is determined using reflection.
+func (r *TaskRegistry) AddEntity(e Entity) error {
+	name := helpers.GetTaskFunctionName(e)
+	return r.AddEntityN(name, e)
+}
+
+// AddEntityN adds an entity function to the registry with a specified name. Entity names are case-insensitive.
+// Entities are run by orchestrations whose names are the entity names prefixed with "@", so these names are also
+// returned by [TaskRegistry.OrchestratorNames].
+func (r *TaskRegistry) AddEntityN(name string, e Entity) error {
+	orchestratorName := helpers.EntityOrchestratorName(name)
+	if _, ok := r.orchestrators[orchestratorName]; ok {
+		return fmt.Errorf("entity named '%s' is already registered", name)
+	}
+	r.orchestrators[orchestratorName] = entityOrchestrator(e)
+	return nil
+}
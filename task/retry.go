@@ -0,0 +1,103 @@
+package task
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// RetryPolicy configures the automatic retries of a failed activity or sub-orchestration. Retries are scheduled using durable timers, so
+// they survive process restarts, and are replayed like any other task of the orchestration.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one. Failed tasks aren't retried if it's
+	// less than 2.
+	MaxAttempts int
+
+	// InitialInterval is the delay before the first retry. It must be positive.
+	InitialInterval time.Duration
+
+	// BackoffCoefficient is the factor by which the delay grows after each retry. Values less than 1 are treated as 1,
+	// which retries at a fixed interval.
+	BackoffCoefficient float64
+
+	// MaxInterval is the maximum delay between retries, or zero for no maximum.
+	MaxInterval time.Duration
+
+	// RetryTimeout is the maximum amount of time, starting when the task is first scheduled, after which failed
+	// attempts aren't retried anymore, or zero for no timeout.
+	RetryTimeout time.Duration
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts > 1 && p.InitialInterval <= 0 {
+		return errors.New("the initial interval of a retry policy must be positive")
+	}
+	return nil
+}
+
+// nextDelay returns the delay before the attempt after the specified attempt, starting with 1 for the first attempt.
+func (p *RetryPolicy) nextDelay(attempt int) time.Duration {
+	coefficient := p.BackoffCoefficient
+	if coefficient < 1 {
+		coefficient = 1
+	}
+	delay := float64(p.InitialInterval) * math.Pow(coefficient, float64(attempt-1))
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		return p.MaxInterval
+	} else if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// retryableTask is a task that schedules new attempts of a failed task, after a durable timer, until an attempt
+// succeeds or the retry policy is exhausted. The first attempt is scheduled when the task is created, and the
+// subsequent attempts are scheduled while the task is awaited, so that replays schedule them at the same points.
+type retryableTask struct {
+	orchestrationCtx *OrchestrationContext
+	policy           RetryPolicy
+	schedule         func(attempt int) *completableTask
+	firstAttempt     time.Time
+
+	attempt   int
+	current   *completableTask
+	exhausted bool
+}
+
+func (ctx *OrchestrationContext) newRetryableTask(policy RetryPolicy, schedule func(attempt int) *completableTask) *retryableTask {
+	return &retryableTask{
+		orchestrationCtx: ctx,
+		policy:           policy,
+		schedule:         schedule,
+		firstAttempt:     ctx.CurrentTimeUtc,
+		attempt:          1,
+		current:          schedule(1),
+	}
+}
+
+// Await blocks the current orchestrator until an attempt of the task succeeds, or until the retry policy is exhausted,
+// in which case the error of the last attempt is returned. See [completableTask.Await].
+func (t *retryableTask) Await(v any) error {
+	for {
+		err := t.current.Await(v)
+		if err == nil || t.exhausted {
+			return err
+		}
+
+		delay := t.policy.nextDelay(t.attempt)
+		ctx := t.orchestrationCtx
+		if t.attempt >= t.policy.MaxAttempts ||
+			t.current.isCanceled ||
+			t.current.failureDetails.GetIsNonRetriable() ||
+			(t.policy.RetryTimeout > 0 && ctx.CurrentTimeUtc.Add(delay).After(t.firstAttempt.Add(t.policy.RetryTimeout))) {
+			t.exhausted = true
+			return err
+		}
+
+		if err := ctx.createTimerInternal(delay).Await(nil); err != nil {
+			return err
+		}
+		t.attempt++
+		t.current = t.schedule(t.attempt)
+	}
+}
@@ -3,6 +3,7 @@ package task
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/microsoft/durabletask-go/internal/protos"
 )
@@ -16,6 +17,71 @@ var ErrTaskBlocked = errors.New("the current task is blocked")
 // when configured timeouts expire.
 var ErrTaskCanceled = errors.New("the task was canceled") // CONSIDER: More specific info about the task
 
+// EventTimeoutError is returned when awaiting a task created by WaitForSingleEvent if the event wasn't received
+// before the timeout expired. For compatibility with code written before timeouts had their own error type, it has
+// the same message as [ErrTaskCanceled], and matches it when compared using errors.Is.
+type EventTimeoutError struct {
+	// EventName is the name of the event that wasn't received.
+	EventName string
+
+	// Timeout is the timeout that expired.
+	Timeout time.Duration
+}
+
+func (e *EventTimeoutError) Error() string {
+	return ErrTaskCanceled.Error()
+}
+
+// Is returns true if the target is [ErrTaskCanceled].
+func (e *EventTimeoutError) Is(target error) bool {
+	return target == ErrTaskCanceled
+}
+
+// historyProcessingFailure is the panic value that aborts an orchestrator function when processing the history of
+// the orchestration fails while the orchestrator function awaits a task. Like [ErrTaskBlocked], it's control flow
+// that orchestrator functions must never recover from.
+type historyProcessingFailure struct {
+	err error
+}
+
+// NonDeterminismError fails an orchestration when replaying its history shows that the orchestrator didn't schedule
+// the same actions as the previous executions, usually because its code was changed incompatibly while the
+// orchestration was running. The orchestration is failed instead of continuing with a history that doesn't match
+// its code.
+type NonDeterminismError struct {
+	// SequenceNumber is the sequence number of the mismatching action.
+	SequenceNumber int32
+
+	// ExpectedAction is the orchestration context method that scheduled the action in a previous execution, e.g.
+	// "CallActivity", and ExpectedName is the name of the activity, orchestration, or event that it was called with.
+	ExpectedAction string
+	ExpectedName   string
+
+	// ActualAction and ActualName describe the action that the current execution scheduled with the same sequence
+	// number. They're empty if the current execution didn't schedule an action with this sequence number.
+	ActualAction string
+	ActualName   string
+}
+
+func (e *NonDeterminismError) Error() string {
+	expected := describeCall(e.ExpectedAction, e.ExpectedName)
+	if e.ActualAction == "" {
+		return fmt.Sprintf(
+			"non-deterministic orchestration: a previous execution called %s with sequence number %d at this point in the orchestration logic, but the current execution doesn't have this action with this sequence number",
+			expected, e.SequenceNumber)
+	}
+	return fmt.Sprintf(
+		"non-deterministic orchestration: a previous execution called %s with sequence number %d at this point in the orchestration logic, but the current execution called %s instead",
+		expected, e.SequenceNumber, describeCall(e.ActualAction, e.ActualName))
+}
+
+func describeCall(action string, name string) string {
+	if name == "" {
+		return action
+	}
+	return fmt.Sprintf("%s for '%s'", action, name)
+}
+
 // Task is an interface for asynchronous durable tasks. A task is conceptually similar to a future.
 type Task interface {
 	Await(v any) error
@@ -25,6 +91,7 @@ type completableTask struct {
 	orchestrationCtx  *OrchestrationContext
 	isCompleted       bool
 	isCanceled        bool
+	cancelReason      error
 	rawResult         []byte
 	failureDetails    *protos.TaskFailureDetails
 	completedCallback func()
@@ -51,6 +118,9 @@ func (t *completableTask) Await(v any) error {
 			if t.failureDetails != nil {
 				return fmt.Errorf("task failed with an error: %v", t.failureDetails.ErrorMessage)
 			} else if t.isCanceled {
+				if t.cancelReason != nil {
+					return t.cancelReason
+				}
 				return ErrTaskCanceled
 			}
 			if v != nil && len(t.rawResult) > 0 {
@@ -63,10 +133,10 @@ func (t *completableTask) Await(v any) error {
 
 		ok, err := t.orchestrationCtx.processNextEvent()
 		if err != nil {
-			// TODO: If there is an error here, we need some kind of well-known panic to kill the orchestration
-			panic(err)
+			// The orchestrator function is aborted, and the orchestration fails with the error
+			panic(historyProcessingFailure{err: err})
 		}
-		if !ok {
+		if !ok && !t.orchestrationCtx.waitForEvents() {
 			break
 		}
 	}
@@ -93,6 +163,12 @@ func (t *completableTask) cancel() {
 	t.completeInternal()
 }
 
+// cancelWithReason cancels the task with a more specific error than [ErrTaskCanceled], which should match it.
+func (t *completableTask) cancelWithReason(reason error) {
+	t.cancelReason = reason
+	t.cancel()
+}
+
 func (t *completableTask) completeInternal() {
 	t.isCompleted = true
 	if t.completedCallback != nil {
@@ -3,17 +3,29 @@ package tests
 import (
 	"context"
 	"fmt"
+	"os"
 	"reflect"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/microsoft/durabletask-go/api"
 	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/bolt"
+	"github.com/microsoft/durabletask-go/backend/inmem"
+	"github.com/microsoft/durabletask-go/backend/jetstream"
+	"github.com/microsoft/durabletask-go/backend/kafka"
+	"github.com/microsoft/durabletask-go/backend/rabbitmq"
+	"github.com/microsoft/durabletask-go/backend/redis"
 	"github.com/microsoft/durabletask-go/backend/sqlite"
 	"github.com/microsoft/durabletask-go/internal/helpers"
 	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+	natsserver "github.com/nats-io/nats-server/v2/server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
@@ -23,11 +35,51 @@ var (
 	logger                = backend.DefaultLogger()
 	sqliteInMemoryOptions = sqlite.NewSqliteOptions("")
 	sqliteFileOptions     = sqlite.NewSqliteOptions("test.sqlite3")
+	redisOptions          = redis.NewRedisOptions(startMiniRedis())
+	boltOptions           = bolt.NewBoltOptions("test.bolt")
+	jetStreamOptions      = jetstream.NewJetStreamOptions(startNATSServer())
 )
 
 var backends = []backend.Backend{
 	sqlite.NewSqliteBackend(sqliteFileOptions, logger),
 	sqlite.NewSqliteBackend(sqliteInMemoryOptions, logger),
+	redis.NewRedisBackend(redisOptions, logger),
+	inmem.NewInMemoryBackend(inmem.NewInMemoryOptions(), logger),
+	bolt.NewBoltBackend(boltOptions, logger),
+	jetstream.NewJetStreamBackend(jetStreamOptions, logger),
+}
+
+// startMiniRedis starts an in-process Redis server for testing the Redis backend and returns its address.
+func startMiniRedis() string {
+	server, err := miniredis.Run()
+	if err != nil {
+		panic(fmt.Errorf("failed to start the test Redis server: %w", err))
+	}
+	return server.Addr()
+}
+
+// startNATSServer starts an in-process NATS server with JetStream enabled for testing the JetStream backend and
+// returns its URL.
+func startNATSServer() string {
+	storeDir, err := os.MkdirTemp("", "durabletask-jetstream")
+	if err != nil {
+		panic(fmt.Errorf("failed to create the test JetStream store directory: %w", err))
+	}
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      natsserver.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoSigs:    true,
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to create the test NATS server: %w", err))
+	}
+	go server.Start()
+	if !server.ReadyForConnections(10 * time.Second) {
+		panic(fmt.Errorf("the test NATS server didn't start"))
+	}
+	return server.ClientURL()
 }
 
 var completionStatusValues = []protos.OrchestrationStatus{
@@ -329,6 +381,405 @@ func Test_AbandonActivityWorkItem(t *testing.T) {
 	}
 }
 
+func Test_RenewOrchestrationWorkItemLock(t *testing.T) {
+	iid := "abc"
+
+	for i, be := range backends {
+		renewer, ok := backend.As[backend.BackendWithLockRenewal](be)
+		if !assert.True(t, ok) {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		if createOrchestrationInstance(t, be, iid) {
+			if wi, ok := getOrchestrationWorkItem(t, be, iid); ok {
+				// Renewing the lock keeps the work item locked
+				assert.NoError(t, renewer.RenewOrchestrationWorkItemLock(ctx, wi))
+				_, err := be.GetOrchestrationWorkItem(ctx)
+				assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+
+				// Renewal fails once the work item is no longer locked by the worker
+				if assert.NoError(t, be.AbandonOrchestrationWorkItem(ctx, wi)) {
+					assert.ErrorIs(t, renewer.RenewOrchestrationWorkItemLock(ctx, wi), backend.ErrWorkItemLockLost)
+				}
+			}
+		}
+	}
+}
+
+func Test_RenewActivityWorkItemLock(t *testing.T) {
+	for i, be := range backends {
+		renewer, ok := backend.As[backend.BackendWithLockRenewal](be)
+		if !assert.True(t, ok) {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		getOrchestratorActions := func() []*protos.OrchestratorAction {
+			return []*protos.OrchestratorAction{
+				helpers.NewScheduleTaskAction(123, "MyActivity", nil),
+			}
+		}
+		validateMetadata := func(metadata *api.OrchestrationMetadata) {
+			assert.True(t, metadata.IsRunning())
+		}
+		workItemProcessingTestLogic(t, be, getOrchestratorActions, validateMetadata)
+
+		wi, err := be.GetActivityWorkItem(ctx)
+		if assert.NoError(t, err) && assert.NotNil(t, wi) {
+			// Renewing the lock keeps the work item locked
+			assert.NoError(t, renewer.RenewActivityWorkItemLock(ctx, wi))
+			_, err = be.GetActivityWorkItem(ctx)
+			assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+
+			// Renewal fails once the work item is no longer locked by the worker
+			if assert.NoError(t, be.AbandonActivityWorkItem(ctx, wi)) {
+				assert.ErrorIs(t, renewer.RenewActivityWorkItemLock(ctx, wi), backend.ErrWorkItemLockLost)
+			}
+		}
+	}
+}
+
+func Test_DeleteActivityWorkItem(t *testing.T) {
+	for i, be := range backends {
+		external, ok := backend.As[backend.BackendWithExternalActivityResults](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		getOrchestratorActions := func() []*protos.OrchestratorAction {
+			return []*protos.OrchestratorAction{
+				helpers.NewScheduleTaskAction(123, "MyActivity", nil),
+			}
+		}
+		validateMetadata := func(metadata *api.OrchestrationMetadata) {
+			assert.True(t, metadata.IsRunning())
+		}
+		workItemProcessingTestLogic(t, be, getOrchestratorActions, validateMetadata)
+
+		wi, err := be.GetActivityWorkItem(ctx)
+		if assert.NoError(t, err) && assert.NotNil(t, wi) {
+			wi.Result = helpers.NewTaskCompletedEvent(123, nil)
+			if assert.NoError(t, external.DeleteActivityWorkItem(ctx, wi)) {
+				// The work item is gone, and its result wasn't added to the orchestration
+				_, err = be.GetActivityWorkItem(ctx)
+				assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+				_, err = be.GetOrchestrationWorkItem(ctx)
+				assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+				assert.ErrorIs(t, external.DeleteActivityWorkItem(ctx, wi), backend.ErrWorkItemLockLost)
+			}
+		}
+	}
+}
+
+func Test_RecordActivityHeartbeat(t *testing.T) {
+	for i, be := range backends {
+		heartbeats, ok := backend.As[backend.BackendWithActivityHeartbeats](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		getOrchestratorActions := func() []*protos.OrchestratorAction {
+			return []*protos.OrchestratorAction{
+				helpers.NewScheduleTaskAction(123, "MyActivity", nil),
+			}
+		}
+		validateMetadata := func(metadata *api.OrchestrationMetadata) {
+			assert.True(t, metadata.IsRunning())
+		}
+		workItemProcessingTestLogic(t, be, getOrchestratorActions, validateMetadata)
+
+		wi, err := be.GetActivityWorkItem(ctx)
+		if assert.NoError(t, err) && assert.NotNil(t, wi) {
+			// Heartbeats keep the work item locked
+			wi.LastHeartbeat = time.Now()
+			wi.HeartbeatDetails = []byte(`{"progress":50}`)
+			assert.NoError(t, heartbeats.RecordActivityHeartbeat(ctx, wi))
+			_, err = be.GetActivityWorkItem(ctx)
+			assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+
+			// Heartbeats fail once the work item is no longer locked by the worker
+			if assert.NoError(t, be.AbandonActivityWorkItem(ctx, wi)) {
+				assert.ErrorIs(t, heartbeats.RecordActivityHeartbeat(ctx, wi), backend.ErrWorkItemLockLost)
+			}
+		}
+	}
+}
+
+func Test_GetActivityWorkItems(t *testing.T) {
+	for i, be := range backends {
+		batched, ok := backend.As[backend.BackendWithActivityBatches](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		getOrchestratorActions := func() []*protos.OrchestratorAction {
+			return []*protos.OrchestratorAction{
+				helpers.NewScheduleTaskAction(1, "MyActivity", nil),
+				helpers.NewScheduleTaskAction(2, "MyActivity", nil),
+				helpers.NewScheduleTaskAction(3, "MyActivity", nil),
+			}
+		}
+		validateMetadata := func(metadata *api.OrchestrationMetadata) {
+			assert.True(t, metadata.IsRunning())
+		}
+		workItemProcessingTestLogic(t, be, getOrchestratorActions, validateMetadata)
+
+		// Work items are fetched in order, up to the maximum
+		wis, err := batched.GetActivityWorkItems(ctx, 2)
+		if assert.NoError(t, err) && assert.Len(t, wis, 2) {
+			assert.Equal(t, int32(1), wis[0].NewEvent.EventId)
+			assert.Equal(t, int32(2), wis[1].NewEvent.EventId)
+		}
+		wis, err = batched.GetActivityWorkItems(ctx, 2)
+		if assert.NoError(t, err) && assert.Len(t, wis, 1) {
+			assert.Equal(t, int32(3), wis[0].NewEvent.EventId)
+		}
+		_, err = batched.GetActivityWorkItems(ctx, 2)
+		assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+	}
+}
+
+// Test_ConcurrentOrchestrationWorkItems fetches orchestration work items from several goroutines at once, and checks
+// that each instance is leased by only one of them.
+func Test_ConcurrentOrchestrationWorkItems(t *testing.T) {
+	const instanceCount = 10
+	const fetcherCount = 4
+
+	for i, be := range backends {
+		initTest(t, be, i, true)
+
+		for j := 0; j < instanceCount; j++ {
+			createOrchestrationInstance(t, be, fmt.Sprintf("instance%d", j))
+		}
+
+		var mu sync.Mutex
+		leases := make(map[api.InstanceID]int)
+		var wg sync.WaitGroup
+		for j := 0; j < fetcherCount; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					wi, err := be.GetOrchestrationWorkItem(ctx)
+					if err == backend.ErrNoWorkItems {
+						return
+					} else if !assert.NoError(t, err) {
+						return
+					}
+					mu.Lock()
+					leases[wi.InstanceID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, leases, instanceCount)
+		for iid, count := range leases {
+			assert.Equal(t, 1, count, "instance %s was leased more than once", iid)
+		}
+	}
+}
+
+// Test_ConcurrentActivityWorkItems fetches activity work items from several goroutines at once, and checks that each
+// task is leased by only one of them.
+func Test_ConcurrentActivityWorkItems(t *testing.T) {
+	const taskCount = 10
+	const fetcherCount = 4
+
+	for i, be := range backends {
+		initTest(t, be, i, true)
+
+		getOrchestratorActions := func() []*protos.OrchestratorAction {
+			actions := make([]*protos.OrchestratorAction, 0, taskCount)
+			for j := 0; j < taskCount; j++ {
+				actions = append(actions, helpers.NewScheduleTaskAction(int32(j), "MyActivity", nil))
+			}
+			return actions
+		}
+		validateMetadata := func(metadata *api.OrchestrationMetadata) {
+			assert.True(t, metadata.IsRunning())
+		}
+		workItemProcessingTestLogic(t, be, getOrchestratorActions, validateMetadata)
+
+		var mu sync.Mutex
+		leases := make(map[int32]int)
+		var wg sync.WaitGroup
+		for j := 0; j < fetcherCount; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					wi, err := be.GetActivityWorkItem(ctx)
+					if err == backend.ErrNoWorkItems {
+						return
+					} else if !assert.NoError(t, err) {
+						return
+					}
+					mu.Lock()
+					leases[wi.NewEvent.EventId]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, leases, taskCount)
+		for taskID, count := range leases {
+			assert.Equal(t, 1, count, "task %d was leased more than once", taskID)
+		}
+	}
+}
+
+func Test_GetActivityWorkItemsFromQueues(t *testing.T) {
+	for i, be := range backends {
+		queues, ok := backend.As[backend.BackendWithActivityQueues](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		getOrchestratorActions := func() []*protos.OrchestratorAction {
+			action := helpers.NewScheduleTaskAction(123, "MyActivity", nil)
+			helpers.SetActivityQueue(action.GetScheduleTask(), "gpu")
+			return []*protos.OrchestratorAction{action}
+		}
+		validateMetadata := func(metadata *api.OrchestrationMetadata) {
+			assert.True(t, metadata.IsRunning())
+		}
+		workItemProcessingTestLogic(t, be, getOrchestratorActions, validateMetadata)
+
+		// The work item is only fetched from its queue
+		_, err := queues.GetActivityWorkItemsFromQueues(ctx, []string{backend.DefaultActivityQueue}, 10)
+		assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+		wis, err := queues.GetActivityWorkItemsFromQueues(ctx, []string{backend.DefaultActivityQueue, "gpu"}, 10)
+		if assert.NoError(t, err) && assert.Len(t, wis, 1) {
+			assert.Equal(t, "gpu", helpers.GetActivityQueue(wis[0].NewEvent.GetTaskScheduled()))
+		}
+	}
+}
+
+func Test_WrappedBackendCapabilities(t *testing.T) {
+	store := sqlite.NewSqliteBackend(sqliteInMemoryOptions, logger)
+	wrappers := map[string]backend.Backend{
+		"instrumented": backend.NewInstrumentedBackend(store),
+		"metadata":     backend.NewMetadataProjectionBackend(store, backend.NewInMemoryMetadataStore(), logger),
+		"payload":      backend.NewPayloadOffloadingBackend(store, backend.NewInMemoryPayloadStore(), 1024, logger),
+		"kafka":        kafka.NewKafkaBackend(store, nil, logger),
+		"nested": backend.NewInstrumentedBackend(
+			backend.NewMetadataProjectionBackend(
+				backend.NewPayloadOffloadingBackend(store, backend.NewInMemoryPayloadStore(), 1024, logger),
+				backend.NewInMemoryMetadataStore(),
+				logger)),
+	}
+	for name, be := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			// The optional interfaces of the wrapped backend are still visible
+			_, ok := backend.As[backend.BackendWithActivityHeartbeats](be)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithActivityQueues](be)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithDeadLetters](be)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithMigration](be)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithIngest](be)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithQueries](be)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithLockRenewal](be)
+			assert.True(t, ok)
+
+			// Kafka delivers the results of activities itself, so it doesn't forward external activity results
+			_, ok = backend.As[backend.BackendWithExternalActivityResults](be)
+			assert.Equal(t, name != "kafka", ok)
+
+			// Wrappers don't claim the optional interfaces that the wrapped backend doesn't support
+			_, ok = be.(backend.BackendWithWatch)
+			assert.True(t, ok)
+			_, ok = backend.As[backend.BackendWithWatch](be)
+			assert.False(t, ok)
+		})
+	}
+
+	// Wrappers that don't forward an optional interface hide it
+	rabbit := rabbitmq.NewRabbitMQBackend(store, nil, logger)
+	_, ok := backend.As[backend.BackendWithActivityHeartbeats](rabbit)
+	assert.True(t, ok)
+	_, ok = backend.As[backend.BackendWithActivityQueues](rabbit)
+	assert.False(t, ok)
+	projected := backend.NewMetadataProjectionBackend(store, backend.NewInMemoryMetadataStore(), logger)
+	_, ok = backend.As[backend.BackendWithBulkPurge](projected)
+	assert.False(t, ok)
+
+	watched := backend.NewInstrumentedBackend(inmem.NewInMemoryBackend(nil, logger))
+	_, ok = backend.As[backend.BackendWithWatch](watched)
+	assert.True(t, ok)
+}
+
+func Test_DeadLetterOrchestrationWorkItem(t *testing.T) {
+	iid := "abc"
+
+	for i, be := range backends {
+		deadLetters, ok := backend.As[backend.BackendWithDeadLetters](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		if !createOrchestrationInstance(t, be, iid) {
+			continue
+		}
+		wi, ok := getOrchestrationWorkItem(t, be, iid)
+		if !ok {
+			continue
+		}
+		require.NoError(t, deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, "poison"))
+
+		// The events are no longer delivered to workers
+		_, err := be.GetOrchestrationWorkItem(ctx)
+		assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+		assert.ErrorIs(t, deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, "poison"), backend.ErrWorkItemLockLost)
+
+		dls, err := deadLetters.ListDeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, dls, 1)
+		assert.Equal(t, backend.DeadLetterOrchestration, dls[0].Kind)
+		assert.Equal(t, api.InstanceID(iid), dls[0].InstanceID)
+		assert.Equal(t, int32(1), dls[0].DeliveryCount)
+		assert.Equal(t, "poison", dls[0].Reason)
+		assert.False(t, dls[0].DeadLetteredAt.IsZero())
+		if assert.Len(t, dls[0].Events, 1) {
+			assert.NotNil(t, dls[0].Events[0].GetExecutionStarted())
+		}
+
+		// Resubmitted events are delivered again, with a reset delivery count
+		require.NoError(t, deadLetters.ResubmitDeadLetter(ctx, dls[0].ID))
+		assert.ErrorIs(t, deadLetters.ResubmitDeadLetter(ctx, dls[0].ID), backend.ErrDeadLetterNotFound)
+		wi, ok = getOrchestrationWorkItem(t, be, iid)
+		if !ok {
+			continue
+		}
+		assert.Equal(t, int32(0), wi.RetryCount)
+		assert.Len(t, wi.NewEvents, 1)
+
+		// Deleted dead letters are discarded
+		require.NoError(t, deadLetters.DeadLetterOrchestrationWorkItem(ctx, wi, "poison"))
+		dls, err = deadLetters.ListDeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, dls, 1)
+		require.NoError(t, deadLetters.DeleteDeadLetter(ctx, dls[0].ID))
+		assert.ErrorIs(t, deadLetters.DeleteDeadLetter(ctx, dls[0].ID), backend.ErrDeadLetterNotFound)
+		dls, err = deadLetters.ListDeadLetters(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, dls)
+	}
+}
+
 func Test_UninitializedBackend(t *testing.T) {
 	for i, be := range backends {
 		initTest(t, be, i, false)
@@ -413,6 +864,256 @@ func Test_PurgeOrchestrationState(t *testing.T) {
 	}
 }
 
+func Test_PurgeOrchestrationStateBatch(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Import", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+	r.AddOrchestratorN("Wait", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("MyEvent", -1).Await(nil)
+	})
+
+	for i, be := range backends {
+		purger, ok := backend.As[backend.BackendWithBulkPurge](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		worker := startTaskHubWorker(ctx, be, r)
+		client := backend.NewTaskHubClient(be)
+		for _, id := range []api.InstanceID{"import-3", "import-1", "export-1", "import-2"} {
+			_, err := client.ScheduleNewOrchestration(ctx, "Import", api.WithInstanceID(id))
+			require.NoError(t, err)
+			_, err = client.WaitForOrchestrationCompletion(ctx, id)
+			require.NoError(t, err)
+		}
+		_, err := client.ScheduleNewOrchestration(ctx, "Wait", api.WithInstanceID("import-4"))
+		require.NoError(t, err)
+		_, err = client.WaitForOrchestrationStart(ctx, "import-4")
+		require.NoError(t, err)
+		require.NoError(t, worker.Shutdown(ctx))
+
+		// The completed instances are deleted in the order of their IDs, one batch at a time
+		query := api.InstanceQuery{InstanceIDPrefix: "import-", PageSize: 2}
+		count, continuationToken, err := purger.PurgeOrchestrationStateBatch(ctx, query)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+		assert.Equal(t, "import-2", continuationToken)
+		_, err = be.GetOrchestrationMetadata(ctx, "import-1")
+		assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+		_, err = be.GetOrchestrationMetadata(ctx, "import-3")
+		assert.NoError(t, err)
+
+		// Running instances are never deleted
+		query.ContinuationToken = continuationToken
+		count, continuationToken, err = purger.PurgeOrchestrationStateBatch(ctx, query)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Empty(t, continuationToken)
+		for _, id := range []api.InstanceID{"export-1", "import-4"} {
+			_, err = be.GetOrchestrationMetadata(ctx, id)
+			assert.NoError(t, err)
+		}
+
+		// The other filters are applied as well
+		count, _, err = purger.PurgeOrchestrationStateBatch(ctx, api.InstanceQuery{NamePrefix: "Exp"})
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+		count, _, err = purger.PurgeOrchestrationStateBatch(ctx, api.InstanceQuery{CompletedBefore: time.Now().Add(-time.Hour)})
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+		count, continuationToken, err = purger.PurgeOrchestrationStateBatch(ctx, api.InstanceQuery{NamePrefix: "Imp"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Empty(t, continuationToken)
+		_, err = be.GetOrchestrationMetadata(ctx, "export-1")
+		assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+	}
+}
+
+func Test_IngestOperations(t *testing.T) {
+	for i, be := range backends {
+		initTest(t, be, i, true)
+
+		expectedID := "myinstance"
+		startEvent := helpers.NewExecutionStartedEvent(defaultName, expectedID, nil, nil, nil, nil)
+		ops := []*backend.IngestOperation{
+			{InstanceID: api.InstanceID(expectedID), Event: startEvent},
+			{InstanceID: api.InstanceID(expectedID), Event: startEvent},
+			{InstanceID: api.InstanceID(expectedID), Event: helpers.NewEventRaisedEvent("MyEvent", nil)},
+		}
+		ingester, ok := backend.As[backend.BackendWithIngest](be)
+		if !assert.True(t, ok) {
+			return
+		}
+		errs, err := ingester.IngestOperations(ctx, ops)
+		if !assert.NoError(t, err) || !assert.Len(t, errs, len(ops)) {
+			return
+		}
+
+		// The duplicate create operation fails without affecting the other operations
+		assert.NoError(t, errs[0])
+		assert.ErrorIs(t, errs[1], backend.ErrDuplicateEvent)
+		assert.NoError(t, errs[2])
+
+		if wi, ok := getOrchestrationWorkItem(t, be, expectedID); ok {
+			if assert.Len(t, wi.NewEvents, 2) {
+				assert.NotNil(t, wi.NewEvents[0].GetExecutionStarted())
+				assert.Equal(t, "MyEvent", wi.NewEvents[1].GetEventRaised().GetName())
+			}
+		}
+	}
+}
+
+func Test_QueryOrchestrationMetadata(t *testing.T) {
+	for i, be := range backends {
+		initTest(t, be, i, true)
+		querier, ok := backend.As[backend.BackendWithQueries](be)
+		if !assert.True(t, ok) {
+			return
+		}
+
+		ops := make([]*backend.IngestOperation, 0, 4)
+		for _, id := range []string{"import-3", "import-1", "export-1", "import-2"} {
+			name := "Import"
+			if id == "export-1" {
+				name = "Export"
+			}
+			e := helpers.NewExecutionStartedEvent(name, id, nil, nil, nil, nil)
+			ops = append(ops, &backend.IngestOperation{InstanceID: api.InstanceID(id), Event: e})
+		}
+		errs, err := backend.IngestOperations(ctx, be, ops)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+
+		// The instances are returned in the order of their IDs, one page at a time
+		query := api.InstanceQuery{InstanceIDPrefix: "import-", PageSize: 2}
+		result, err := querier.QueryOrchestrationMetadata(ctx, query)
+		if assert.NoError(t, err) && assert.Len(t, result.Instances, 2) {
+			assert.Equal(t, api.InstanceID("import-1"), result.Instances[0].InstanceID)
+			assert.Equal(t, api.InstanceID("import-2"), result.Instances[1].InstanceID)
+			assert.Equal(t, "Import", result.Instances[0].Name)
+			assert.NotEmpty(t, result.ContinuationToken)
+		}
+		query.ContinuationToken = result.ContinuationToken
+		result, err = querier.QueryOrchestrationMetadata(ctx, query)
+		if assert.NoError(t, err) && assert.Len(t, result.Instances, 1) {
+			assert.Equal(t, api.InstanceID("import-3"), result.Instances[0].InstanceID)
+			assert.Empty(t, result.ContinuationToken)
+		}
+
+		// The last page isn't followed by an empty page when it's full
+		result, err = querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{InstanceIDPrefix: "import-", PageSize: 3})
+		if assert.NoError(t, err) {
+			assert.Len(t, result.Instances, 3)
+			assert.Empty(t, result.ContinuationToken)
+		}
+
+		// Filters
+		result, err = querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{Name: "Export"})
+		if assert.NoError(t, err) && assert.Len(t, result.Instances, 1) {
+			assert.Equal(t, api.InstanceID("export-1"), result.Instances[0].InstanceID)
+		}
+		result, err = querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{
+			RuntimeStatuses: []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING},
+		})
+		if assert.NoError(t, err) {
+			assert.Len(t, result.Instances, 4)
+		}
+		result, err = querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{
+			RuntimeStatuses: []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED},
+		})
+		if assert.NoError(t, err) {
+			assert.Empty(t, result.Instances)
+		}
+		result, err = querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{CreatedTo: time.Now().Add(-time.Hour)})
+		if assert.NoError(t, err) {
+			assert.Empty(t, result.Instances)
+		}
+		result, err = querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{CreatedFrom: time.Now().Add(-time.Hour)})
+		if assert.NoError(t, err) {
+			assert.Len(t, result.Instances, 4)
+		}
+	}
+}
+
+func Test_OrchestrationTagsMetadata(t *testing.T) {
+	for i, be := range backends {
+		initTest(t, be, i, true)
+		querier, ok := backend.As[backend.BackendWithQueries](be)
+		if !assert.True(t, ok) {
+			return
+		}
+
+		tags := map[string]string{"tenant": "contoso", "job": "42"}
+		tagged := helpers.NewExecutionStartedEvent(defaultName, "tagged", nil, nil, nil, nil)
+		helpers.SetTags(tagged.GetExecutionStarted(), tags)
+		if !assert.NoError(t, be.CreateOrchestrationInstance(ctx, tagged)) {
+			return
+		}
+		untagged := helpers.NewExecutionStartedEvent(defaultName, "untagged", nil, nil, nil, nil)
+		if !assert.NoError(t, be.CreateOrchestrationInstance(ctx, untagged)) {
+			return
+		}
+
+		metadata, err := be.GetOrchestrationMetadata(ctx, "tagged")
+		if assert.NoError(t, err) {
+			assert.Equal(t, tags, metadata.Tags)
+		}
+		metadata, err = be.GetOrchestrationMetadata(ctx, "untagged")
+		if assert.NoError(t, err) {
+			assert.Empty(t, metadata.Tags)
+		}
+		result, err := querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{InstanceIDPrefix: "tagged"})
+		if assert.NoError(t, err) && assert.Len(t, result.Instances, 1) {
+			assert.Equal(t, tags, result.Instances[0].Tags)
+		}
+	}
+}
+
+func Test_QueryOrchestrationMetadata_TagFilter(t *testing.T) {
+	filter := api.AllTags(
+		api.AnyTag(api.TagEquals("tenant", "contoso"), api.TagEquals("tenant", "fabrikam")),
+		api.TagNotEquals("job", "legacy"))
+	assert.Equal(t, "((tenant=contoso OR tenant=fabrikam) AND job!=legacy)", filter.String())
+
+	for i, be := range backends {
+		// Only some backends evaluate tag filters in their queries, the client filters the results of the others
+		if reflect.TypeOf(be).String() == "*redis.redisBackend" {
+			continue
+		}
+		initTest(t, be, i, true)
+		querier, ok := backend.As[backend.BackendWithQueries](be)
+		if !assert.True(t, ok) {
+			return
+		}
+
+		for id, tags := range map[string]map[string]string{
+			"a": {"tenant": "contoso", "job": "nightly"},
+			"b": {"tenant": "fabrikam", "job": "legacy"},
+			"c": {"tenant": "fabrikam"},
+			"d": nil,
+		} {
+			e := helpers.NewExecutionStartedEvent(defaultName, id, nil, nil, nil, nil)
+			helpers.SetTags(e.GetExecutionStarted(), tags)
+			require.NoError(t, be.CreateOrchestrationInstance(ctx, e))
+		}
+
+		result, err := querier.QueryOrchestrationMetadata(ctx, api.InstanceQuery{TagFilter: filter})
+		require.NoError(t, err)
+		ids := make([]api.InstanceID, 0, len(result.Instances))
+		for _, metadata := range result.Instances {
+			ids = append(ids, metadata.InstanceID)
+		}
+		assert.Equal(t, []api.InstanceID{"a", "c"}, ids)
+	}
+}
+
 func initTest(t *testing.T, be backend.Backend, testIteration int, createTaskHub bool) {
 	t.Logf("(%d) Testing %s...", testIteration, reflect.TypeOf(be).String())
 	err := be.DeleteTaskHub(ctx)
@@ -425,6 +1126,42 @@ func initTest(t *testing.T, be backend.Backend, testIteration int, createTaskHub
 	}
 }
 
+func Test_OrchestrationWorkItemHistoryLength(t *testing.T) {
+	iid := "abc"
+	filter := backend.OrchestrationWorkItemFilter{IncludeHistoryLength: true}
+
+	for i, be := range backends {
+		filtered, ok := backend.As[backend.BackendWithOrchestrationFilters](be)
+		if !ok {
+			continue
+		}
+		initTest(t, be, i, true)
+
+		if !createOrchestrationInstance(t, be, iid) {
+			continue
+		}
+		wi, err := filtered.GetOrchestrationWorkItemWithFilter(ctx, filter)
+		require.NoError(t, err)
+		assert.Equal(t, 0, wi.NextSequenceNumber)
+		state, ok := getOrchestrationRuntimeState(t, be, wi)
+		if !ok {
+			continue
+		}
+		for _, e := range wi.NewEvents {
+			require.NoError(t, state.AddEvent(e))
+		}
+		saved := len(state.NewEvents())
+		wi.State = state
+		require.NoError(t, be.CompleteOrchestrationWorkItem(ctx, wi))
+
+		// The saved history events are counted when requested
+		require.NoError(t, be.AddNewOrchestrationEvent(ctx, api.InstanceID(iid), helpers.NewEventRaisedEvent("MyEvent", nil)))
+		wi, err = filtered.GetOrchestrationWorkItemWithFilter(ctx, filter)
+		require.NoError(t, err)
+		assert.Equal(t, saved, wi.NextSequenceNumber)
+	}
+}
+
 func workItemProcessingTestLogic(
 	t *testing.T,
 	be backend.Backend,
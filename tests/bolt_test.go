@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/bolt"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+func Test_BoltBackend_ContinueAsNew(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Counter", func(ctx *task.OrchestrationContext) (any, error) {
+		var n int
+		if err := ctx.GetInput(&n); err != nil {
+			return nil, err
+		}
+		if err := ctx.CallActivity("Increment", task.WithActivityInput(n)).Await(&n); err != nil {
+			return nil, err
+		}
+		if n < 5 {
+			ctx.ContinueAsNew(n)
+		}
+		return n, nil
+	})
+	r.AddActivityN("Increment", func(ctx task.ActivityContext) (any, error) {
+		var n int
+		if err := ctx.GetInput(&n); err != nil {
+			return nil, err
+		}
+		return n + 1, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := bolt.NewBoltBackend(bolt.NewBoltOptions(filepath.Join(t.TempDir(), "taskhub.db")), logger)
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "Counter", api.WithInput(0))
+	require.NoError(t, err)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `5`, metadata.SerializedOutput)
+	assert.Equal(t, 4, metadata.GenerationCount)
+
+	// Only the history of the last generation is kept
+	migrator, ok := backend.As[backend.BackendWithMigration](be)
+	require.True(t, ok)
+	state, err := migrator.ExportOrchestrationInstance(ctx, id)
+	require.NoError(t, err)
+	if assert.NotEmpty(t, state.History) {
+		assert.Equal(t, `4`, state.History[1].GetExecutionStarted().GetInput().GetValue())
+	}
+}
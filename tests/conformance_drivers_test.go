@@ -0,0 +1,10 @@
+//go:build conformance
+
+package tests
+
+import (
+	// The database/sql drivers of the PostgreSQL and MySQL backends, which this module doesn't depend on outside of
+	// the conformance tests.
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
@@ -0,0 +1,257 @@
+//go:build conformance
+
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/cosmosdb"
+	"github.com/microsoft/durabletask-go/backend/dynamodb"
+	"github.com/microsoft/durabletask-go/backend/jetstream"
+	"github.com/microsoft/durabletask-go/backend/kafka"
+	"github.com/microsoft/durabletask-go/backend/mongodb"
+	"github.com/microsoft/durabletask-go/backend/mysql"
+	"github.com/microsoft/durabletask-go/backend/payloads/azblob"
+	"github.com/microsoft/durabletask-go/backend/payloads/gcs"
+	"github.com/microsoft/durabletask-go/backend/payloads/s3"
+	"github.com/microsoft/durabletask-go/backend/postgres"
+	"github.com/microsoft/durabletask-go/backend/rabbitmq"
+	"github.com/microsoft/durabletask-go/backend/sqlite"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+	"github.com/microsoft/durabletask-go/internal/protos"
+)
+
+// The backends and payload stores that depend on external services are tested against real instances of these
+// services when the tests are built with the conformance tag, e.g. from the tests directory:
+//
+//	DURABLETASK_MONGODB_URI=mongodb://localhost:27017 go test -tags conformance .
+//
+// Each backend or payload store is only tested if the environment variables that configure it are set. Configured
+// backends are added to the backends that all the backend tests run against, and they also run an orchestration on a
+// task hub worker. The Kafka and RabbitMQ backends use an in-memory SQLite backend as their store. The Kafka backend
+// ingests events asynchronously, so it isn't added to the backend tests, which expect events to be visible as soon
+// as they're added.
+//
+// The PostgreSQL and MySQL backends use the pgx and go-sql-driver/mysql database/sql drivers, which are linked into
+// the conformance tests by conformance_drivers_test.go. Other drivers can be used by linking them in the same way and setting the driver
+// environment variable.
+const (
+	postgresConnectionStringEnv = "DURABLETASK_POSTGRES_CONNECTION_STRING"
+	postgresDriverEnv           = "DURABLETASK_POSTGRES_DRIVER"
+	mysqlDataSourceNameEnv      = "DURABLETASK_MYSQL_DSN"
+	mysqlDriverEnv              = "DURABLETASK_MYSQL_DRIVER"
+	dynamoDBEndpointEnv         = "DURABLETASK_DYNAMODB_ENDPOINT"
+	cosmosDBConnectionStringEnv = "DURABLETASK_COSMOSDB_CONNECTION_STRING"
+	mongoDBURIEnv               = "DURABLETASK_MONGODB_URI"
+	natsURLEnv                  = "DURABLETASK_NATS_URL"
+	kafkaBrokersEnv             = "DURABLETASK_KAFKA_BROKERS"
+	rabbitMQURLEnv              = "DURABLETASK_RABBITMQ_URL"
+	s3EndpointEnv               = "DURABLETASK_S3_ENDPOINT"
+	s3BucketEnv                 = "DURABLETASK_S3_BUCKET"
+	azureBlobConnectionEnv      = "DURABLETASK_AZBLOB_CONNECTION_STRING"
+	gcsEndpointEnv              = "DURABLETASK_GCS_ENDPOINT"
+	gcsBucketEnv                = "DURABLETASK_GCS_BUCKET"
+)
+
+// conformanceBackends are the configured backends that depend on external services, by name.
+var conformanceBackends = map[string]backend.Backend{}
+
+func init() {
+	if cs := os.Getenv(postgresConnectionStringEnv); cs != "" {
+		opts := postgres.NewPostgresOptions(cs)
+		if driver := os.Getenv(postgresDriverEnv); driver != "" {
+			opts.DriverName = driver
+		}
+		requireSQLDriver(opts.DriverName, postgresConnectionStringEnv)
+		conformanceBackends["postgres"] = postgres.NewPostgresBackend(opts, logger)
+	}
+	if dsn := os.Getenv(mysqlDataSourceNameEnv); dsn != "" {
+		opts := mysql.NewMySQLOptions(dsn)
+		if driver := os.Getenv(mysqlDriverEnv); driver != "" {
+			opts.DriverName = driver
+		}
+		requireSQLDriver(opts.DriverName, mysqlDataSourceNameEnv)
+		conformanceBackends["mysql"] = mysql.NewMySQLBackend(opts, logger)
+	}
+	if endpoint := os.Getenv(dynamoDBEndpointEnv); endpoint != "" {
+		conformanceBackends["dynamodb"] = dynamodb.NewDynamoDBBackend(dynamodb.NewDynamoDBOptions(awsConfig(endpoint)), logger)
+	}
+	if cs := os.Getenv(cosmosDBConnectionStringEnv); cs != "" {
+		conformanceBackends["cosmosdb"] = cosmosdb.NewCosmosDBBackend(cosmosdb.NewCosmosDBOptions(cs), logger)
+	}
+	if uri := os.Getenv(mongoDBURIEnv); uri != "" {
+		conformanceBackends["mongodb"] = mongodb.NewMongoDBBackend(mongodb.NewMongoDBOptions(uri), logger)
+	}
+	if url := os.Getenv(natsURLEnv); url != "" {
+		conformanceBackends["jetstream"] = jetstream.NewJetStreamBackend(jetstream.NewJetStreamOptions(url), logger)
+	}
+	if brokers := os.Getenv(kafkaBrokersEnv); brokers != "" {
+		store := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+		conformanceBackends["kafka"] = kafka.NewKafkaBackend(store, kafkaOptions(brokers), logger)
+	}
+	if url := os.Getenv(rabbitMQURLEnv); url != "" {
+		store := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+		conformanceBackends["rabbitmq"] = rabbitmq.NewRabbitMQBackend(store, rabbitmq.NewRabbitMQOptions(url), logger)
+	}
+
+	for name, be := range conformanceBackends {
+		if name != "kafka" {
+			backends = append(backends, be)
+		}
+	}
+}
+
+// kafkaOptions returns the options of a Kafka backend that connects to the specified comma-separated brokers.
+func kafkaOptions(brokers string) *kafka.KafkaOptions {
+	return kafka.NewKafkaOptions(strings.Split(brokers, ",")...)
+}
+
+// requireSQLDriver panics if the specified database/sql driver isn't linked into the tests, since the backend that's
+// configured by the specified environment variable can't connect without it.
+func requireSQLDriver(driverName string, env string) {
+	for _, name := range sql.Drivers() {
+		if name == driverName {
+			return
+		}
+	}
+	panic(fmt.Errorf("%s is set, but the %q database/sql driver isn't linked into the tests", env, driverName))
+}
+
+// awsConfig returns the configuration of an AWS service emulator, such as DynamoDB Local or MinIO, at the specified
+// endpoint. The credentials are read from the standard environment variables, if set.
+func awsConfig(endpoint string) aws.Config {
+	return aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			creds := aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}
+			if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+				creds.AccessKeyID = id
+				creds.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			}
+			return creds, nil
+		}),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			// Emulators don't support virtual-hosted bucket addresses
+			return aws.Endpoint{URL: endpoint, HostnameImmutable: true}, nil
+		}),
+	}
+}
+
+func Test_Conformance_Orchestrations(t *testing.T) {
+	if len(conformanceBackends) == 0 {
+		t.Skip("no conformance backends are configured")
+	}
+	for name, be := range conformanceBackends {
+		t.Run(name, func(t *testing.T) {
+			initTest(t, be, 0, true)
+			testOrchestrationScenario(t, be)
+		})
+	}
+}
+
+func Test_Conformance_S3PayloadStore(t *testing.T) {
+	endpoint, bucket := os.Getenv(s3EndpointEnv), os.Getenv(s3BucketEnv)
+	if endpoint == "" || bucket == "" {
+		t.Skipf("%s and %s aren't set", s3EndpointEnv, s3BucketEnv)
+	}
+	testPayloadStore(t, s3.NewS3PayloadStore(s3.NewS3Options(awsConfig(endpoint), bucket)))
+}
+
+func Test_Conformance_AzureBlobPayloadStore(t *testing.T) {
+	cs := os.Getenv(azureBlobConnectionEnv)
+	if cs == "" {
+		t.Skipf("%s isn't set", azureBlobConnectionEnv)
+	}
+	testPayloadStore(t, azblob.NewAzureBlobPayloadStore(azblob.NewAzureBlobOptions(cs)))
+}
+
+func Test_Conformance_GCSPayloadStore(t *testing.T) {
+	endpoint, bucket := os.Getenv(gcsEndpointEnv), os.Getenv(gcsBucketEnv)
+	if endpoint == "" || bucket == "" {
+		t.Skipf("%s and %s aren't set", gcsEndpointEnv, gcsBucketEnv)
+	}
+	opts := gcs.NewGCSOptions(http.DefaultClient, bucket)
+	opts.Endpoint = endpoint
+	testPayloadStore(t, gcs.NewGCSPayloadStore(opts))
+}
+
+// activityRetryCountBackends are the conformance backends that count the deliveries of activity work items, which
+// the worker uses to dead-letter poison activities.
+var activityRetryCountBackends = []string{"postgres", "mysql"}
+
+func Test_Conformance_ActivityRetryCount(t *testing.T) {
+	for _, name := range activityRetryCountBackends {
+		be, ok := conformanceBackends[name]
+		if !ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			initTest(t, be, 0, true)
+			workItemProcessingTestLogic(t, be, func() []*protos.OrchestratorAction {
+				return []*protos.OrchestratorAction{helpers.NewScheduleTaskAction(123, "MyActivity", nil)}
+			}, func(*api.OrchestrationMetadata) {})
+
+			wi, err := be.GetActivityWorkItem(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, int32(0), wi.RetryCount)
+
+			// Each redelivery of the abandoned work item increments its retry count
+			for i := int32(1); i <= 2; i++ {
+				require.NoError(t, be.AbandonActivityWorkItem(ctx, wi))
+				wi, err = be.GetActivityWorkItem(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, i, wi.RetryCount)
+			}
+		})
+	}
+}
+
+func Test_Conformance_KafkaActivityResults(t *testing.T) {
+	brokers := os.Getenv(kafkaBrokersEnv)
+	if brokers == "" {
+		t.Skipf("%s isn't set", kafkaBrokersEnv)
+	}
+
+	// A separate backend is used, since stopping a Kafka backend closes its producer
+	opts := kafkaOptions(brokers)
+	opts.GroupID = "durabletask-activity-results"
+	be := kafka.NewKafkaBackend(sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger), opts, logger)
+	initTest(t, be, 0, true)
+	require.NoError(t, be.Start(ctx))
+	defer be.Stop(ctx)
+
+	workItemProcessingTestLogic(t, be, func() []*protos.OrchestratorAction {
+		return []*protos.OrchestratorAction{helpers.NewScheduleTaskAction(123, "MyActivity", nil)}
+	}, func(*api.OrchestrationMetadata) {})
+
+	wi, err := be.GetActivityWorkItem(ctx)
+	require.NoError(t, err)
+	wi.Result = helpers.NewTaskCompletedEvent(123, wrapperspb.String("42"))
+	require.NoError(t, be.CompleteActivityWorkItem(ctx, wi))
+
+	// The work item is deleted right away, but the result only reaches the orchestration through the results topic
+	_, err = be.GetActivityWorkItem(ctx)
+	assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+	var owi *backend.OrchestrationWorkItem
+	require.Eventually(t, func() bool {
+		owi, err = be.GetOrchestrationWorkItem(ctx)
+		return err == nil
+	}, 30*time.Second, 100*time.Millisecond)
+	if assert.Len(t, owi.NewEvents, 1) {
+		assert.Equal(t, "42", owi.NewEvents[0].GetTaskCompleted().GetResult().GetValue())
+	}
+}
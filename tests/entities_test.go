@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+func counterEntity(ctx *task.EntityContext) (any, error) {
+	var value int
+	if err := ctx.GetState(&value); err != nil {
+		return nil, err
+	}
+	switch ctx.Operation {
+	case "add":
+		var amount int
+		if err := ctx.GetInput(&amount); err != nil {
+			return nil, err
+		}
+		value += amount
+	case "get":
+		return value, nil
+	case "fail":
+		// The state changes of failed operations are discarded
+		if err := ctx.SetState(-1); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("operation failed")
+	case "delete":
+		ctx.DeleteState()
+		return nil, nil
+	default:
+		return nil, errors.New("unknown operation")
+	}
+	return value, ctx.SetState(value)
+}
+
+func Test_EntityID(t *testing.T) {
+	id := api.NewEntityID("Counter", "Key@1")
+	assert.Equal(t, "@counter@Key@1", id.String())
+
+	parsed, ok := api.EntityIDFromInstanceID(id.InstanceID())
+	require.True(t, ok)
+	assert.Equal(t, id, parsed)
+
+	for _, iid := range []api.InstanceID{"counter", "@counter", "@@key"} {
+		_, ok := api.EntityIDFromInstanceID(iid)
+		assert.False(t, ok, iid)
+	}
+}
+
+func Test_Entities(t *testing.T) {
+	r := task.NewTaskRegistry()
+	require.NoError(t, r.AddEntityN("Counter", counterEntity))
+	assert.Error(t, r.AddEntityN("counter", counterEntity))
+	r.AddOrchestratorN("UseCounter", func(ctx *task.OrchestrationContext) (any, error) {
+		id := api.NewEntityID("Counter", string(ctx.ID))
+		for i := 0; i < 3; i++ {
+			if err := ctx.SignalEntity(id, "add", task.WithEntityInput(1)); err != nil {
+				return nil, err
+			}
+		}
+		var value int
+		if err := ctx.CallEntity(id, "add", task.WithEntityInput(10)).Await(&value); err != nil {
+			return nil, err
+		}
+		if err := ctx.CallEntity(id, "fail").Await(nil); err == nil {
+			return nil, errors.New("expected the operation to fail")
+		}
+		var final int
+		if err := ctx.CallEntity(id, "get").Await(&final); err != nil {
+			return nil, err
+		}
+		return []int{value, final}, nil
+	})
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Signals and calls from orchestrations are processed in order
+	id, err := client.ScheduleNewOrchestration(ctx, "UseCounter")
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, "[13,13]", metadata.SerializedOutput)
+
+	entity, err := client.FetchEntityMetadata(ctx, api.NewEntityID("Counter", string(id)))
+	require.NoError(t, err)
+	assert.Equal(t, "13", entity.SerializedState)
+
+	// Signals from clients
+	counter := api.NewEntityID("Counter", "client")
+	_, err = client.FetchEntityMetadata(ctx, counter)
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, client.SignalEntity(ctx, counter, "add", api.WithSignalInput(2)))
+	}
+	require.Eventually(t, func() bool {
+		entity, err = client.FetchEntityMetadata(ctx, counter)
+		return err == nil && entity.SerializedState == "10"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, client.SignalEntity(ctx, counter, "delete"))
+	require.Eventually(t, func() bool {
+		entity, err = client.FetchEntityMetadata(ctx, counter)
+		return err == nil && entity.SerializedState == ""
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func Test_EntitiesHiddenFromQueriesAndPurges(t *testing.T) {
+	r := task.NewTaskRegistry()
+	require.NoError(t, r.AddEntityN("Counter", counterEntity))
+	assert.Error(t, r.AddOrchestratorN("@counter", func(ctx *task.OrchestrationContext) (any, error) { return nil, nil }))
+	r.AddOrchestratorN("Hello", func(ctx *task.OrchestrationContext) (any, error) { return nil, nil })
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Orchestrations can't pretend to be entities
+	_, err := client.ScheduleNewOrchestration(ctx, "@counter", api.WithInstanceID("@counter@fake"))
+	assert.ErrorIs(t, err, backend.ErrReservedOrchestrationName)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Hello")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+
+	// Completed entities are hidden as well, and keep their state
+	counter := api.NewEntityID("Counter", "hidden")
+	require.NoError(t, client.SignalEntity(ctx, counter, "add", api.WithSignalInput(1)))
+	require.Eventually(t, func() bool {
+		entity, err := client.FetchEntityMetadata(ctx, counter)
+		return err == nil && entity.SerializedState == "1"
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, client.TerminateOrchestration(ctx, counter.InstanceID()))
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, counter.InstanceID())
+	require.NoError(t, err)
+
+	result, err := client.QueryInstances(ctx, api.InstanceQuery{})
+	require.NoError(t, err)
+	if assert.Len(t, result.Instances, 1) {
+		assert.Equal(t, id, result.Instances[0].InstanceID)
+	}
+
+	_, err = client.PurgeOrchestrationState(ctx, counter.InstanceID())
+	assert.ErrorIs(t, err, backend.ErrEntityInstance)
+	purged, err := client.PurgeInstancesByFilter(ctx, api.InstanceQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged.DeletedInstanceCount)
+	purged, err = client.PurgeCompletedOrchestrationStates(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged.DeletedInstanceCount)
+
+	entity, err := client.FetchEntityMetadata(ctx, counter)
+	require.NoError(t, err)
+	assert.Equal(t, "1", entity.SerializedState)
+}
@@ -0,0 +1,128 @@
+module github.com/microsoft/durabletask-go/tests
+
+go 1.18
+
+require (
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/aws/aws-sdk-go-v2 v1.17.3
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/jackc/pgx/v5 v5.2.0
+	github.com/microsoft/durabletask-go v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/bolt v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/cosmosdb v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/dynamodb v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/jetstream v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/kafka v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/mongodb v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/mysql v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/payloads/azblob v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/payloads/gcs v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/payloads/s3 v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/postgres v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/rabbitmq v0.0.0-00010101000000-000000000000
+	github.com/microsoft/durabletask-go/backend/redis v0.0.0-00010101000000-000000000000
+	github.com/nats-io/nats-server/v2 v2.8.4
+	github.com/stretchr/testify v1.8.0
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/metric v0.33.0
+	go.opentelemetry.io/otel/sdk v1.11.1
+	google.golang.org/grpc v1.53.0
+	google.golang.org/protobuf v1.28.1
+)
+
+require (
+	github.com/Azure/azure-sdk-for-go v68.0.0+incompatible // indirect
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.4.0 // indirect
+	github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos v0.3.6 // indirect
+	github.com/Azure/azure-sdk-for-go/sdk/internal v1.2.0 // indirect
+	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.0.0 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream v1.4.10 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.1.27 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.4.21 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/v4a v1.0.18 // indirect
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.18.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.9.11 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/checksum v1.1.22 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/endpoint-discovery v1.7.21 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.9.21 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/s3shared v1.13.21 // indirect
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.30.0 // indirect
+	github.com/aws/smithy-go v1.13.5 // indirect
+	github.com/cenkalti/backoff/v4 v4.1.3 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
+	github.com/klauspost/compress v1.15.11 // indirect
+	github.com/marusama/semaphore/v2 v2.5.0 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/minio/highwayhash v1.0.2 // indirect
+	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/nats-io/jwt/v2 v2.2.1-0.20220330180145-442af02fd36a // indirect
+	github.com/nats-io/nats.go v1.23.0 // indirect
+	github.com/nats-io/nkeys v0.3.0 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.17 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rabbitmq/amqp091-go v1.8.1 // indirect
+	github.com/redis/go-redis/v9 v9.0.5 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/segmentio/kafka-go v0.4.42 // indirect
+	github.com/stretchr/objx v0.4.0 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	go.etcd.io/bbolt v1.3.6 // indirect
+	go.mongodb.org/mongo-driver v1.11.9 // indirect
+	go.opentelemetry.io/otel/trace v1.11.1 // indirect
+	golang.org/x/crypto v0.5.0 // indirect
+	golang.org/x/mod v0.8.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
+	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11 // indirect
+	golang.org/x/tools v0.6.0 // indirect
+	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	lukechampine.com/uint128 v1.2.0 // indirect
+	modernc.org/cc/v3 v3.40.0 // indirect
+	modernc.org/ccgo/v3 v3.16.13 // indirect
+	modernc.org/libc v1.22.5 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.5.0 // indirect
+	modernc.org/opt v0.1.3 // indirect
+	modernc.org/sqlite v1.22.1 // indirect
+	modernc.org/strutil v1.1.3 // indirect
+	modernc.org/token v1.0.1 // indirect
+)
+
+replace (
+	github.com/microsoft/durabletask-go => ..
+	github.com/microsoft/durabletask-go/backend/bolt => ../backend/bolt
+	github.com/microsoft/durabletask-go/backend/cosmosdb => ../backend/cosmosdb
+	github.com/microsoft/durabletask-go/backend/dynamodb => ../backend/dynamodb
+	github.com/microsoft/durabletask-go/backend/jetstream => ../backend/jetstream
+	github.com/microsoft/durabletask-go/backend/kafka => ../backend/kafka
+	github.com/microsoft/durabletask-go/backend/mongodb => ../backend/mongodb
+	github.com/microsoft/durabletask-go/backend/mysql => ../backend/mysql
+	github.com/microsoft/durabletask-go/backend/payloads/azblob => ../backend/payloads/azblob
+	github.com/microsoft/durabletask-go/backend/payloads/gcs => ../backend/payloads/gcs
+	github.com/microsoft/durabletask-go/backend/payloads/s3 => ../backend/payloads/s3
+	github.com/microsoft/durabletask-go/backend/postgres => ../backend/postgres
+	github.com/microsoft/durabletask-go/backend/rabbitmq => ../backend/rabbitmq
+	github.com/microsoft/durabletask-go/backend/redis => ../backend/redis
+)
@@ -19,12 +19,18 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 var (
-	grpcClient *client.TaskHubGrpcClient
-	ctx        = context.Background()
+	grpcClient   *client.TaskHubGrpcClient
+	grpcConn     *grpc.ClientConn
+	grpcExecutor backend.Executor
+	ctx          = context.Background()
 )
 
 // TestMain is the entry point for the test suite. We use this to set up a gRPC server and client instance
@@ -34,7 +40,8 @@ func TestMain(m *testing.M) {
 	logger := backend.DefaultLogger()
 	be := sqlite.NewSqliteBackend(sqliteOptions, logger)
 	grpcServer := grpc.NewServer()
-	grpcExecutor, registerFn := backend.NewGrpcExecutor(be, logger)
+	var registerFn func(grpcServer grpc.ServiceRegistrar)
+	grpcExecutor, registerFn = backend.NewGrpcExecutor(be, logger)
 	registerFn(grpcServer)
 	orchestrationWorker := backend.NewOrchestrationWorker(be, grpcExecutor, logger)
 	activityWorker := backend.NewActivityTaskWorker(be, grpcExecutor, logger)
@@ -57,12 +64,12 @@ func TestMain(m *testing.M) {
 
 	time.Sleep(1 * time.Second)
 
-	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	grpcConn, err = grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("failed to connect to gRPC server: %v", err)
 	}
-	defer conn.Close()
-	grpcClient = client.NewTaskHubGrpcClient(conn, logger)
+	defer grpcConn.Close()
+	grpcClient = client.NewTaskHubGrpcClient(grpcConn, logger)
 
 	// Run the test exitCode
 	exitCode := m.Run()
@@ -227,3 +234,139 @@ func Test_Grpc_Terminate_Recursive(t *testing.T) {
 		})
 	}
 }
+
+func Test_Grpc_QueryInstances(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Echo", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	cancelListener := startGrpcListener(t, r)
+	defer cancelListener()
+
+	for _, id := range []api.InstanceID{"query-b", "query-a", "query-c"} {
+		_, err := grpcClient.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID(id), api.WithInput(string(id)))
+		require.NoError(t, err)
+		_, err = grpcClient.WaitForOrchestrationCompletion(ctx, id)
+		require.NoError(t, err)
+	}
+
+	query := api.InstanceQuery{
+		InstanceIDPrefix: "query-",
+		RuntimeStatuses:  []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED},
+		PageSize:         2,
+	}
+	result, err := grpcClient.QueryInstances(ctx, query)
+	require.NoError(t, err)
+	require.Len(t, result.Instances, 2)
+	assert.Equal(t, api.InstanceID("query-a"), result.Instances[0].InstanceID)
+	assert.Equal(t, `"query-a"`, result.Instances[0].SerializedOutput)
+	assert.Equal(t, api.InstanceID("query-b"), result.Instances[1].InstanceID)
+	require.NotEmpty(t, result.ContinuationToken)
+
+	query.ContinuationToken = result.ContinuationToken
+	result, err = grpcClient.QueryInstances(ctx, query)
+	require.NoError(t, err)
+	require.Len(t, result.Instances, 1)
+	assert.Equal(t, api.InstanceID("query-c"), result.Instances[0].InstanceID)
+	assert.Empty(t, result.ContinuationToken)
+
+	_, err = grpcClient.QueryInstances(ctx, api.InstanceQuery{Name: "Echo"})
+	assert.Error(t, err)
+}
+
+func Test_Grpc_ExecutorHandshake(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Registered", func(ctx *task.OrchestrationContext) (any, error) {
+		return "done", nil
+	})
+	r.AddActivityN("SayHello", func(ctx task.ActivityContext) (any, error) {
+		return nil, nil
+	})
+
+	cancelListener := startGrpcListener(t, r)
+	defer cancelListener()
+
+	// The capabilities advertised by the listener are available for diagnostics
+	provider, ok := grpcExecutor.(backend.ExecutorCapabilitiesProvider)
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		c := provider.Capabilities()
+		return c != nil && c.SupportsOrchestrator("Registered")
+	}, 5*time.Second, 10*time.Millisecond)
+	capabilities := provider.Capabilities()
+	assert.True(t, capabilities.Negotiated)
+	assert.Equal(t, backend.MaxExecutorProtocolVersion, capabilities.ProtocolVersion)
+	assert.Equal(t, []string{"Registered"}, capabilities.Orchestrators)
+	assert.Equal(t, []string{"SayHello"}, capabilities.Activities)
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+	id, err := grpcClient.ScheduleNewOrchestration(ctx, "Registered")
+	require.NoError(t, err)
+	metadata, err := grpcClient.WaitForOrchestrationCompletion(timeoutCtx, id, api.WithFetchPayloads(true))
+	require.NoError(t, err)
+	assert.Equal(t, `"done"`, metadata.SerializedOutput)
+
+	// Orchestrations that the listener didn't advertise are never sent to it
+	id, err = grpcClient.ScheduleNewOrchestration(ctx, "NotRegistered")
+	require.NoError(t, err)
+	time.Sleep(1 * time.Second)
+	metadata, err = grpcClient.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING, metadata.RuntimeStatus)
+}
+
+func Test_Grpc_ExecutorHandshake_IncompatibleVersion(t *testing.T) {
+	client := protos.NewTaskHubSidecarServiceClient(grpcConn)
+	handshake := backend.ExecutorHandshake{ProtocolVersions: []int{backend.MaxExecutorProtocolVersion + 1}}
+
+	_, err := client.Hello(handshake.AppendToOutgoingContext(ctx), &emptypb.Empty{})
+	require.Error(t, err)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "incompatible executor")
+
+	stream, err := client.GetWorkItems(handshake.AppendToOutgoingContext(ctx), &protos.GetWorkItemsRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func Test_Grpc_ExecutorHandshake_Legacy(t *testing.T) {
+	// Executors that don't send the handshake are accepted and get the oldest protocol version
+	var header grpcmetadata.MD
+	_, err := protos.NewTaskHubSidecarServiceClient(grpcConn).Hello(ctx, &emptypb.Empty{}, grpc.Header(&header))
+	require.NoError(t, err)
+	version, ok := backend.NegotiatedProtocolVersion(header)
+	require.True(t, ok)
+	assert.Equal(t, backend.MinExecutorProtocolVersion, version)
+}
+
+func Test_Grpc_IdempotencyKey(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Echo", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	cancelListener := startGrpcListener(t, r)
+	defer cancelListener()
+
+	id, err := grpcClient.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey("grpc-order-42"), api.WithInput("first"))
+	require.NoError(t, err)
+	assert.Equal(t, api.IdempotentInstanceID("grpc-order-42"), id)
+
+	// Retries return the existing instance instead of creating a duplicate
+	retryID, err := grpcClient.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey("grpc-order-42"), api.WithInput("retry"))
+	require.NoError(t, err)
+	assert.Equal(t, id, retryID)
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+	metadata, err := grpcClient.WaitForOrchestrationCompletion(timeoutCtx, id, api.WithFetchPayloads(true))
+	require.NoError(t, err)
+	assert.Equal(t, `"first"`, metadata.SerializedOutput)
+}
@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/inmem"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+func Test_InMemoryBackend_ConcurrentWorkers(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("FanOut", func(ctx *task.OrchestrationContext) (any, error) {
+		tasks := make([]task.Task, 0, 10)
+		for i := 0; i < 10; i++ {
+			tasks = append(tasks, ctx.CallActivity("Double", task.WithActivityInput(i)))
+		}
+		sum := 0
+		for _, t := range tasks {
+			var n int
+			if err := t.Await(&n); err != nil {
+				return nil, err
+			}
+			sum += n
+		}
+		var approval string
+		if err := ctx.WaitForSingleEvent("Approval", 10*time.Second).Await(&approval); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%s: %d", approval, sum), nil
+	})
+	r.AddOrchestratorN("WaitForever", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Never", -1).Await(nil)
+	})
+	r.AddActivityN("Double", func(ctx task.ActivityContext) (any, error) {
+		var n int
+		if err := ctx.GetInput(&n); err != nil {
+			return nil, err
+		}
+		return n * 2, nil
+	})
+
+	// Initialization: two task hub workers share the same backend
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := inmem.NewInMemoryBackend(inmem.NewInMemoryOptions(), logger)
+	executor := task.NewTaskExecutor(r)
+	for i := 0; i < 2; i++ {
+		worker := backend.NewTaskHubWorker(be, backend.NewOrchestrationWorker(be, executor, logger), backend.NewActivityTaskWorker(be, executor, logger), logger)
+		require.NoError(t, worker.Start(ctx))
+		defer worker.Shutdown(ctx)
+	}
+	client := backend.NewTaskHubClient(be)
+
+	// Run the orchestrations
+	ids := make([]api.InstanceID, 0, 5)
+	for i := 0; i < 5; i++ {
+		id, err := client.ScheduleNewOrchestration(ctx, "FanOut", api.WithInstanceID(api.InstanceID(fmt.Sprintf("fanout-%d", i))))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	waitingID, err := client.ScheduleNewOrchestration(ctx, "WaitForever", api.WithInstanceID("waiting"))
+	require.NoError(t, err)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for _, id := range ids {
+		_, err := client.WaitForOrchestrationStart(timeoutCtx, id)
+		require.NoError(t, err)
+		require.NoError(t, client.RaiseEvent(ctx, id, "Approval", api.WithEventPayload("approved")))
+	}
+	for _, id := range ids {
+		metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+		require.NoError(t, err)
+		assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+		assert.Equal(t, `"approved: 90"`, metadata.SerializedOutput)
+	}
+
+	// Terminate the orchestration that never completes on its own
+	_, err = client.WaitForOrchestrationStart(timeoutCtx, waitingID)
+	require.NoError(t, err)
+	require.NoError(t, client.TerminateOrchestration(ctx, waitingID))
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, waitingID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
+
+	// Query results are ordered by instance ID
+	completed, err := client.QueryInstances(ctx, api.InstanceQuery{
+		RuntimeStatuses: []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED},
+	})
+	require.NoError(t, err)
+	completedIDs := make([]api.InstanceID, 0, len(completed.Instances))
+	for _, metadata := range completed.Instances {
+		completedIDs = append(completedIDs, metadata.InstanceID)
+	}
+	assert.Equal(t, ids, completedIDs)
+}
+
+func Test_InMemoryBackend_FIFO(t *testing.T) {
+	be := inmem.NewInMemoryBackend(nil, backend.DefaultLogger())
+	require.NoError(t, be.CreateTaskHub(ctx))
+	assert.ErrorIs(t, be.CreateTaskHub(ctx), backend.ErrTaskHubExists)
+
+	// Work items are returned in the order in which their instances were created
+	expected := []api.InstanceID{"c", "a", "b"}
+	for _, id := range expected {
+		require.True(t, createOrchestrationInstance(t, be, string(id)))
+	}
+	for _, id := range expected {
+		wi, err := be.GetOrchestrationWorkItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, id, wi.InstanceID)
+	}
+	_, err := be.GetOrchestrationWorkItem(ctx)
+	assert.ErrorIs(t, err, backend.ErrNoWorkItems)
+}
+
+func Test_InMemoryBackend_WatchOrchestrationRuntimeStatus(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		ctx.SetCustomStatus("waiting")
+		var name string
+		if err := ctx.WaitForSingleEvent("Name", -1).Await(&name); err != nil {
+			return nil, err
+		}
+		return "Hello, " + name + "!", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := inmem.NewInMemoryBackend(nil, logger)
+	executor := task.NewTaskExecutor(r)
+	worker := backend.NewTaskHubWorker(be, backend.NewOrchestrationWorker(be, executor, logger), backend.NewActivityTaskWorker(be, executor, logger), logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	watcher, ok := backend.As[backend.BackendWithWatch](be)
+	require.True(t, ok)
+	_, err := watcher.WatchOrchestrationRuntimeStatus(ctx, "does-not-exist")
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	updates, err := watcher.WatchOrchestrationRuntimeStatus(timeoutCtx, id)
+	require.NoError(t, err)
+
+	// Waits are notified by the backend, so they don't depend on the polling interval
+	_, err = client.WaitForOrchestrationStart(timeoutCtx, id, api.WithPollingBackoff(time.Hour, time.Hour, 1))
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Name", api.WithEventPayload("世界")))
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id, api.WithPollingBackoff(time.Hour, time.Hour, 1))
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"Hello, 世界!"`, metadata.SerializedOutput)
+
+	// The watch channel ends with the metadata of the completed orchestration
+	var last *api.OrchestrationMetadata
+	for metadata := range updates {
+		last = metadata
+	}
+	require.NoError(t, timeoutCtx.Err())
+	require.NotNil(t, last)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, last.RuntimeStatus)
+}
+
+func Test_InMemoryBackend_StreamOrchestrationMetadata(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Steps", func(ctx *task.OrchestrationContext) (any, error) {
+		for _, step := range []string{"step 1", "step 2"} {
+			ctx.SetCustomStatus(step)
+			if err := ctx.WaitForSingleEvent("Next", -1).Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return "done", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := inmem.NewInMemoryBackend(nil, logger)
+	executor := task.NewTaskExecutor(r)
+	worker := backend.NewTaskHubWorker(be, backend.NewOrchestrationWorker(be, executor, logger), backend.NewActivityTaskWorker(be, executor, logger), logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Steps")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Every custom status change is pushed by the backend, so the polling interval doesn't matter
+	updates, err := client.StreamOrchestrationMetadata(timeoutCtx, id, api.WithPollingBackoff(time.Hour, time.Hour, 1))
+	require.NoError(t, err)
+	for _, step := range []string{`"step 1"`, `"step 2"`} {
+		for metadata := range updates {
+			if metadata.SerializedCustomStatus == step {
+				break
+			}
+		}
+		require.NoError(t, timeoutCtx.Err())
+		require.NoError(t, client.RaiseEvent(ctx, id, "Next"))
+	}
+
+	var last *api.OrchestrationMetadata
+	for metadata := range updates {
+		last = metadata
+	}
+	require.NoError(t, timeoutCtx.Err())
+	require.NotNil(t, last)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, last.RuntimeStatus)
+	assert.Equal(t, `"done"`, last.SerializedOutput)
+}
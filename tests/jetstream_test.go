@@ -0,0 +1,14 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/jetstream"
+)
+
+func Test_JetStreamBackend_Orchestrations(t *testing.T) {
+	opts := jetstream.NewJetStreamOptions(jetStreamOptions.URL)
+	opts.TaskHubName = "orchestrations"
+	testOrchestrationScenario(t, jetstream.NewJetStreamBackend(opts, backend.DefaultLogger()))
+}
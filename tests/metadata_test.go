@@ -30,6 +30,8 @@ func Test_OrchestrationMetadata_Serialization(t *testing.T) {
 				ErrorMessage: "Fuse lit",
 			},
 		})
+	metadata.GenerationCount = 3
+	metadata.Tags = map[string]string{"tenant": "contoso"}
 
 	if bytes, err := json.Marshal(metadata); assert.NoError(t, err) {
 		metadata2 := new(api.OrchestrationMetadata)
@@ -42,6 +44,8 @@ func Test_OrchestrationMetadata_Serialization(t *testing.T) {
 			assert.Equal(t, metadata.SerializedInput, metadata2.SerializedInput)
 			assert.Equal(t, metadata.SerializedOutput, metadata2.SerializedOutput)
 			assert.Equal(t, metadata.SerializedCustomStatus, metadata2.SerializedCustomStatus)
+			assert.Equal(t, metadata.GenerationCount, metadata2.GenerationCount)
+			assert.Equal(t, metadata.Tags, metadata2.Tags)
 			if assert.NotNil(t, metadata2.FailureDetails) {
 				assert.Equal(t, metadata.FailureDetails.ErrorType, metadata2.FailureDetails.ErrorType)
 				assert.Equal(t, metadata.FailureDetails.ErrorMessage, metadata2.FailureDetails.ErrorMessage)
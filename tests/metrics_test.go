@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/sqlite"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+var (
+	initMetricsOnce       sync.Once
+	sharedLatencyRecorder = &latencyRecorder{counts: make(map[string]int)}
+)
+
+func Test_InstrumentedBackend(t *testing.T) {
+	initMetricsOnce.Do(func() {
+		global.SetMeterProvider(sharedLatencyRecorder)
+	})
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("SingleActivity", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallActivity("SayHello").Await(nil)
+	})
+	r.AddActivityN("SayHello", func(ctx task.ActivityContext) (any, error) {
+		return "Hello!", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := backend.NewInstrumentedBackend(sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger))
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "SingleActivity")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	// The operations on the hot path of the workers and clients are all recorded, including the optional
+	// operations of the wrapped backend, which the instrumented backend forwards
+	for _, operation := range []string{
+		"create_orchestration_instance",
+		"get_orchestration_work_item_with_filter",
+		"get_orchestration_runtime_state",
+		"complete_orchestration_work_item",
+		"get_activity_work_items_with_filter",
+		"complete_activity_work_item",
+		"get_orchestration_metadata",
+	} {
+		assert.Greater(t, sharedLatencyRecorder.count(operation, "success"), 0, operation)
+	}
+}
+
+// latencyRecorder is a meter provider that counts the recordings of the backend operation duration histogram by
+// operation and outcome, and ignores all other instruments.
+type latencyRecorder struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (r *latencyRecorder) Meter(string, ...metric.MeterOption) metric.Meter {
+	return &latencyRecorderMeter{Meter: metric.NewNoopMeter(), recorder: r}
+}
+
+func (r *latencyRecorder) count(operation string, outcome string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.counts[operation+"/"+outcome]
+}
+
+type latencyRecorderMeter struct {
+	metric.Meter
+	recorder *latencyRecorder
+}
+
+func (m *latencyRecorderMeter) SyncFloat64() syncfloat64.InstrumentProvider {
+	return &latencyRecorderInstruments{InstrumentProvider: m.Meter.SyncFloat64(), recorder: m.recorder}
+}
+
+type latencyRecorderInstruments struct {
+	syncfloat64.InstrumentProvider
+	recorder *latencyRecorder
+}
+
+func (p *latencyRecorderInstruments) Histogram(name string, opts ...instrument.Option) (syncfloat64.Histogram, error) {
+	h, err := p.InstrumentProvider.Histogram(name, opts...)
+	if err != nil || name != "durabletask.backend.operation.duration" {
+		return h, err
+	}
+	return &latencyRecorderHistogram{Histogram: h, recorder: p.recorder}, nil
+}
+
+type latencyRecorderHistogram struct {
+	syncfloat64.Histogram
+	recorder *latencyRecorder
+}
+
+func (h *latencyRecorderHistogram) Record(_ context.Context, _ float64, attrs ...attribute.KeyValue) {
+	var operation, outcome string
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "durabletask.backend.operation":
+			operation = attr.Value.AsString()
+		case "durabletask.backend.outcome":
+			outcome = attr.Value.AsString()
+		}
+	}
+
+	h.recorder.lock.Lock()
+	defer h.recorder.lock.Unlock()
+	h.recorder.counts[operation+"/"+outcome]++
+}
@@ -329,6 +329,53 @@ func (_c *Backend_DeleteTaskHub_Call) Return(_a0 error) *Backend_DeleteTaskHub_C
 	return _c
 }
 
+// ExportOrchestrationInstance provides a mock function with given fields: _a0, _a1
+func (_m *Backend) ExportOrchestrationInstance(_a0 context.Context, _a1 api.InstanceID) (*backend.OrchestrationInstanceState, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 *backend.OrchestrationInstanceState
+	if rf, ok := ret.Get(0).(func(context.Context, api.InstanceID) *backend.OrchestrationInstanceState); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*backend.OrchestrationInstanceState)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, api.InstanceID) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Backend_ExportOrchestrationInstance_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ExportOrchestrationInstance'
+type Backend_ExportOrchestrationInstance_Call struct {
+	*mock.Call
+}
+
+// ExportOrchestrationInstance is a helper method to define mock.On call
+//  - _a0 context.Context
+//  - _a1 api.InstanceID
+func (_e *Backend_Expecter) ExportOrchestrationInstance(_a0 interface{}, _a1 interface{}) *Backend_ExportOrchestrationInstance_Call {
+	return &Backend_ExportOrchestrationInstance_Call{Call: _e.mock.On("ExportOrchestrationInstance", _a0, _a1)}
+}
+
+func (_c *Backend_ExportOrchestrationInstance_Call) Run(run func(_a0 context.Context, _a1 api.InstanceID)) *Backend_ExportOrchestrationInstance_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(api.InstanceID))
+	})
+	return _c
+}
+
+func (_c *Backend_ExportOrchestrationInstance_Call) Return(_a0 *backend.OrchestrationInstanceState, _a1 error) *Backend_ExportOrchestrationInstance_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
 // GetActivityWorkItem provides a mock function with given fields: _a0
 func (_m *Backend) GetActivityWorkItem(_a0 context.Context) (*backend.ActivityWorkItem, error) {
 	ret := _m.Called(_a0)
@@ -515,6 +562,44 @@ func (_c *Backend_GetOrchestrationWorkItem_Call) Return(_a0 *backend.Orchestrati
 	return _c
 }
 
+// ImportOrchestrationInstance provides a mock function with given fields: _a0, _a1
+func (_m *Backend) ImportOrchestrationInstance(_a0 context.Context, _a1 *backend.OrchestrationInstanceState) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *backend.OrchestrationInstanceState) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Backend_ImportOrchestrationInstance_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ImportOrchestrationInstance'
+type Backend_ImportOrchestrationInstance_Call struct {
+	*mock.Call
+}
+
+// ImportOrchestrationInstance is a helper method to define mock.On call
+//  - _a0 context.Context
+//  - _a1 *backend.OrchestrationInstanceState
+func (_e *Backend_Expecter) ImportOrchestrationInstance(_a0 interface{}, _a1 interface{}) *Backend_ImportOrchestrationInstance_Call {
+	return &Backend_ImportOrchestrationInstance_Call{Call: _e.mock.On("ImportOrchestrationInstance", _a0, _a1)}
+}
+
+func (_c *Backend_ImportOrchestrationInstance_Call) Run(run func(_a0 context.Context, _a1 *backend.OrchestrationInstanceState)) *Backend_ImportOrchestrationInstance_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(*backend.OrchestrationInstanceState))
+	})
+	return _c
+}
+
+func (_c *Backend_ImportOrchestrationInstance_Call) Return(_a0 error) *Backend_ImportOrchestrationInstance_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
 // PurgeOrchestrationState provides a mock function with given fields: _a0, _a1
 func (_m *Backend) PurgeOrchestrationState(_a0 context.Context, _a1 api.InstanceID) error {
 	ret := _m.Called(_a0, _a1)
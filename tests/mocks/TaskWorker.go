@@ -3,6 +3,9 @@
 package mocks
 
 import (
+	api "github.com/microsoft/durabletask-go/api"
+	backend "github.com/microsoft/durabletask-go/backend"
+
 	context "context"
 
 	mock "github.com/stretchr/testify/mock"
@@ -21,6 +24,143 @@ func (_m *TaskWorker) EXPECT() *TaskWorker_Expecter {
 	return &TaskWorker_Expecter{mock: &_m.Mock}
 }
 
+// CacheStats provides a mock function with given fields: 
+func (_m *TaskWorker) CacheStats() backend.CacheStats {
+	ret := _m.Called()
+
+	var r0 backend.CacheStats
+	if rf, ok := ret.Get(0).(func() backend.CacheStats); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(backend.CacheStats)
+	}
+
+	return r0
+}
+
+// TaskWorker_CacheStats_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'CacheStats'
+type TaskWorker_CacheStats_Call struct {
+	*mock.Call
+}
+
+// CacheStats is a helper method to define mock.On call
+func (_e *TaskWorker_Expecter) CacheStats() *TaskWorker_CacheStats_Call {
+	return &TaskWorker_CacheStats_Call{Call: _e.mock.On("CacheStats")}
+}
+
+func (_c *TaskWorker_CacheStats_Call) Run(run func()) *TaskWorker_CacheStats_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *TaskWorker_CacheStats_Call) Return(_a0 backend.CacheStats) *TaskWorker_CacheStats_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+// DebugSnapshot provides a mock function with given fields: 
+func (_m *TaskWorker) DebugSnapshot() backend.WorkerDebugInfo {
+	ret := _m.Called()
+
+	var r0 backend.WorkerDebugInfo
+	if rf, ok := ret.Get(0).(func() backend.WorkerDebugInfo); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(backend.WorkerDebugInfo)
+	}
+
+	return r0
+}
+
+// TaskWorker_DebugSnapshot_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'DebugSnapshot'
+type TaskWorker_DebugSnapshot_Call struct {
+	*mock.Call
+}
+
+// DebugSnapshot is a helper method to define mock.On call
+func (_e *TaskWorker_Expecter) DebugSnapshot() *TaskWorker_DebugSnapshot_Call {
+	return &TaskWorker_DebugSnapshot_Call{Call: _e.mock.On("DebugSnapshot")}
+}
+
+func (_c *TaskWorker_DebugSnapshot_Call) Run(run func()) *TaskWorker_DebugSnapshot_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *TaskWorker_DebugSnapshot_Call) Return(_a0 backend.WorkerDebugInfo) *TaskWorker_DebugSnapshot_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+// Drain provides a mock function with given fields: _a0
+func (_m *TaskWorker) Drain(_a0 context.Context) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TaskWorker_Drain_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Drain'
+type TaskWorker_Drain_Call struct {
+	*mock.Call
+}
+
+// Drain is a helper method to define mock.On call
+//  - _a0 context.Context
+func (_e *TaskWorker_Expecter) Drain(_a0 interface{}) *TaskWorker_Drain_Call {
+	return &TaskWorker_Drain_Call{Call: _e.mock.On("Drain", _a0)}
+}
+
+func (_c *TaskWorker_Drain_Call) Run(run func(_a0 context.Context)) *TaskWorker_Drain_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context))
+	})
+	return _c
+}
+
+func (_c *TaskWorker_Drain_Call) Return(_a0 error) *TaskWorker_Drain_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+// InvalidateCache provides a mock function with given fields: _a0
+func (_m *TaskWorker) InvalidateCache(_a0 api.InstanceID) {
+	_m.Called(_a0)
+}
+
+// TaskWorker_InvalidateCache_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'InvalidateCache'
+type TaskWorker_InvalidateCache_Call struct {
+	*mock.Call
+}
+
+// InvalidateCache is a helper method to define mock.On call
+//  - _a0 api.InstanceID
+func (_e *TaskWorker_Expecter) InvalidateCache(_a0 interface{}) *TaskWorker_InvalidateCache_Call {
+	return &TaskWorker_InvalidateCache_Call{Call: _e.mock.On("InvalidateCache", _a0)}
+}
+
+func (_c *TaskWorker_InvalidateCache_Call) Run(run func(_a0 api.InstanceID)) *TaskWorker_InvalidateCache_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(api.InstanceID))
+	})
+	return _c
+}
+
+func (_c *TaskWorker_InvalidateCache_Call) Return() *TaskWorker_InvalidateCache_Call {
+	_c.Call.Return()
+	return _c
+}
+
 // ProcessNext provides a mock function with given fields: _a0
 func (_m *TaskWorker) ProcessNext(_a0 context.Context) (bool, error) {
 	ret := _m.Called(_a0)
@@ -1,10 +1,15 @@
 package tests
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,8 +19,10 @@ import (
 	"github.com/microsoft/durabletask-go/api"
 	"github.com/microsoft/durabletask-go/backend"
 	"github.com/microsoft/durabletask-go/backend/sqlite"
+	"github.com/microsoft/durabletask-go/internal/helpers"
 	"github.com/microsoft/durabletask-go/internal/protos"
 	"github.com/microsoft/durabletask-go/task"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func Test_EmptyOrchestration(t *testing.T) {
@@ -255,6 +262,86 @@ func Test_ActivityChain(t *testing.T) {
 	)
 }
 
+func Test_ActivityChain_StateCache(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ActivityChain", func(ctx *task.OrchestrationContext) (any, error) {
+		val := 0
+		for i := 0; i < 10; i++ {
+			if err := ctx.CallActivity("PlusOne", task.WithActivityInput(val)).Await(&val); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	})
+	r.AddActivityN("PlusOne", func(ctx task.ActivityContext) (any, error) {
+		var input int
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		return input + 1, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithStateCacheSize(10))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration, which reuses the cached state between activity completions
+	id, err := client.ScheduleNewOrchestration(ctx, "ActivityChain")
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `10`, metadata.SerializedOutput)
+}
+
+func Test_ActivityChain_OrchestratorCache(t *testing.T) {
+	// Registration
+	var invocations int32
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ActivityChain", func(ctx *task.OrchestrationContext) (any, error) {
+		atomic.AddInt32(&invocations, 1)
+		val := 0
+		for i := 0; i < 10; i++ {
+			if err := ctx.CallActivity("PlusOne", task.WithActivityInput(val)).Await(&val); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	})
+	r.AddActivityN("PlusOne", func(ctx task.ActivityContext) (any, error) {
+		var input int
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		return input + 1, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	executor := task.NewTaskExecutor(r, task.WithOrchestratorCacheSize(10))
+	worker := backend.NewTaskHubWorker(
+		be,
+		backend.NewOrchestrationWorker(be, executor, logger, backend.WithStateCacheSize(10)),
+		backend.NewActivityTaskWorker(be, executor, logger),
+		logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// Run the orchestration, whose orchestrator is resumed for each activity completion instead of being replayed
+	id, err := client.ScheduleNewOrchestration(ctx, "ActivityChain")
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `10`, metadata.SerializedOutput)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&invocations))
+}
+
 func Test_ActivityFanOut(t *testing.T) {
 	// Registration
 	r := task.NewTaskRegistry()
@@ -310,6 +397,62 @@ func Test_ActivityFanOut(t *testing.T) {
 	)
 }
 
+func Test_ActivityRetryPolicy(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("RetryActivity", func(ctx *task.OrchestrationContext) (any, error) {
+		var failures int
+		if err := ctx.GetInput(&failures); err != nil {
+			return nil, err
+		}
+		var output int32
+		err := ctx.CallActivity("Flaky", task.WithActivityInput(failures), task.WithActivityRetryPolicy(task.RetryPolicy{
+			MaxAttempts:        3,
+			InitialInterval:    10 * time.Millisecond,
+			BackoffCoefficient: 2,
+		})).Await(&output)
+		return output, err
+	})
+	// The orchestrations run one after the other, so one counter is enough
+	var attempts int32
+	r.AddActivityN("Flaky", func(ctx task.ActivityContext) (any, error) {
+		var failures int
+		if err := ctx.GetInput(&failures); err != nil {
+			return nil, err
+		}
+		attempt := atomic.AddInt32(&attempts, 1)
+		if int(attempt) <= failures {
+			return nil, fmt.Errorf("attempt %d failed", attempt)
+		}
+		return attempt, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// The activity succeeds on its third and last attempt
+	id, err := client.ScheduleNewOrchestration(ctx, "RetryActivity", api.WithInput(2))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, "3", metadata.SerializedOutput)
+
+	// The activity fails on all its attempts, and the error of the last attempt is returned
+	atomic.StoreInt32(&attempts, 0)
+	id, err = client.ScheduleNewOrchestration(ctx, "RetryActivity", api.WithInput(3))
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+	if assert.NotNil(t, metadata.FailureDetails) {
+		assert.Contains(t, metadata.FailureDetails.ErrorMessage, "attempt 3 failed")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
 func Test_SingleSubOrchestrator_Completed(t *testing.T) {
 	r := task.NewTaskRegistry()
 	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
@@ -386,6 +529,212 @@ func Test_SingleSubOrchestrator_Failed(t *testing.T) {
 	)
 }
 
+func Test_DetachedSubOrchestration(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.CallSubOrchestrator(
+			"Child",
+			task.WithDetachedSubOrchestration(),
+			task.WithSubOrchestrationInstanceID(string(ctx.ID)+"_child"),
+			task.WithSubOrchestratorInput("background job")).Await(nil); err != nil {
+			return nil, err
+		}
+		// Detached orchestrations with generated instance IDs
+		ctx.CallSubOrchestrator("Child", task.WithDetachedSubOrchestration(), task.WithSubOrchestratorInput("another job"))
+		return nil, ctx.WaitForSingleEvent("Never", -1).Await(nil)
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		if err := ctx.WaitForSingleEvent("Go", -1).Await(nil); err != nil {
+			return nil, err
+		}
+		return input, nil
+	})
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Parent")
+	require.NoError(t, err)
+	childID := id + "_child"
+	_, err = client.WaitForOrchestrationStart(timeoutCtx, childID)
+	require.NoError(t, err)
+
+	// The detached orchestrations survive the recursive termination of the parent
+	require.NoError(t, client.TerminateOrchestration(ctx, id))
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
+
+	// Detached orchestrations have no parent, so they aren't orphaned sub-orchestrations either
+	orphans, err := client.FindOrphanedSubOrchestrations(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	for childID, output := range map[api.InstanceID]string{childID: `"background job"`, id + ":0001": `"another job"`} {
+		require.NoError(t, client.RaiseEvent(ctx, childID, "Go"))
+		metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, childID)
+		require.NoError(t, err)
+		assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+		assert.Equal(t, output, metadata.SerializedOutput)
+	}
+}
+
+func Test_SubOrchestrationRetryPolicy(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		var failures int
+		if err := ctx.GetInput(&failures); err != nil {
+			return nil, err
+		}
+		var output string
+		err := ctx.CallSubOrchestrator(
+			"Child",
+			task.WithSubOrchestratorInput(failures),
+			task.WithSubOrchestrationInstanceID(string(ctx.ID)+"_child"),
+			task.WithSubOrchestrationRetryPolicy(task.RetryPolicy{
+				MaxAttempts:     3,
+				InitialInterval: 10 * time.Millisecond,
+			})).Await(&output)
+		return output, err
+	})
+	// The orchestrations run one after the other, so one counter is enough
+	var attempts int32
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		var failures int
+		if err := ctx.GetInput(&failures); err != nil {
+			return nil, err
+		}
+		var attempt int32
+		if err := ctx.CallActivity("CountAttempt").Await(&attempt); err != nil {
+			return nil, err
+		}
+		if int(attempt) <= failures {
+			return nil, fmt.Errorf("attempt %d failed", attempt)
+		}
+		return string(ctx.ID), nil
+	})
+	r.AddActivityN("CountAttempt", func(ctx task.ActivityContext) (any, error) {
+		return atomic.AddInt32(&attempts, 1), nil
+	})
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Each attempt runs as a new instance, and the third one succeeds
+	id, err := client.ScheduleNewOrchestration(ctx, "Parent", api.WithInput(2))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, fmt.Sprintf(`"%s_child-3"`, id), metadata.SerializedOutput)
+	for _, childID := range []api.InstanceID{id + "_child", id + "_child-2"} {
+		metadata, err = client.FetchOrchestrationMetadata(ctx, childID)
+		require.NoError(t, err)
+		assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+	}
+
+	// All the attempts fail, and the failure of the last one is returned to the parent
+	atomic.StoreInt32(&attempts, 0)
+	id, err = client.ScheduleNewOrchestration(ctx, "Parent", api.WithInput(3))
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+	if assert.NotNil(t, metadata.FailureDetails) {
+		assert.Contains(t, metadata.FailureDetails.ErrorMessage, "attempt 3 failed")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func Test_OrchestratorVersions(t *testing.T) {
+	r := task.NewTaskRegistry()
+	versioned := func(output string) task.Orchestrator {
+		return func(ctx *task.OrchestrationContext) (any, error) {
+			var generation int
+			if err := ctx.GetInput(&generation); err != nil {
+				return nil, err
+			}
+			if generation == 0 {
+				// The version is kept when the orchestration continues as new
+				ctx.ContinueAsNew(1)
+				return nil, nil
+			}
+			return output + ":" + ctx.Version, nil
+		}
+	}
+	require.NoError(t, r.AddOrchestratorN("Versioned", versioned("default")))
+	require.NoError(t, r.AddVersionedOrchestratorN("Versioned", "v1", versioned("one")))
+	require.NoError(t, r.AddVersionedOrchestratorN("Versioned", "v2", versioned("two")))
+	assert.Error(t, r.AddVersionedOrchestratorN("Versioned", "v2", versioned("two")))
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallSubOrchestrator("Versioned", task.WithSubOrchestrationVersion("v2")).Await(&output)
+		return output, err
+	})
+	r.AddOrchestratorN("DetachedParent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallSubOrchestrator(
+			"Versioned",
+			task.WithDetachedSubOrchestration(),
+			task.WithSubOrchestrationInstanceID(string(ctx.ID)+"_child"),
+			task.WithSubOrchestrationVersion("v1"),
+			task.WithSubOrchestratorInput(0)).Await(nil)
+	})
+	assert.Equal(t, []string{"DetachedParent", "Parent", "Versioned"}, r.OrchestratorNames())
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		opts   []api.NewOrchestrationOptions
+		output string
+	}{
+		{[]api.NewOrchestrationOptions{api.WithInput(0)}, `"default:"`},
+		{[]api.NewOrchestrationOptions{api.WithInput(0), api.WithVersion("v1")}, `"one:v1"`},
+		{[]api.NewOrchestrationOptions{api.WithInput(0), api.WithVersion("v2")}, `"two:v2"`},
+	} {
+		id, err := client.ScheduleNewOrchestration(ctx, "Versioned", tc.opts...)
+		require.NoError(t, err)
+		metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+		assert.Equal(t, tc.output, metadata.SerializedOutput)
+	}
+
+	// Unknown versions don't fall back to the orchestrator that was registered without a version
+	id, err := client.ScheduleNewOrchestration(ctx, "Versioned", api.WithInput(0), api.WithVersion("v3"))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+	if assert.NotNil(t, metadata.FailureDetails) {
+		assert.Contains(t, metadata.FailureDetails.ErrorMessage, "version 'v3' of orchestrator named 'Versioned' is not registered")
+	}
+
+	id, err = client.ScheduleNewOrchestration(ctx, "Parent")
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"two:v2"`, metadata.SerializedOutput)
+
+	// Detached sub-orchestrations are started with the requested version too
+	id, err = client.ScheduleNewOrchestration(ctx, "DetachedParent")
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id+"_child")
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"one:v1"`, metadata.SerializedOutput)
+}
+
 func Test_ContinueAsNew(t *testing.T) {
 	// Registration
 	r := task.NewTaskRegistry()
@@ -417,6 +766,7 @@ func Test_ContinueAsNew(t *testing.T) {
 		if assert.NoError(t, err) {
 			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
 			assert.Equal(t, `10`, metadata.SerializedOutput)
+			assert.Equal(t, 10, metadata.GenerationCount)
 		}
 	}
 
@@ -438,57 +788,214 @@ func Test_ContinueAsNew(t *testing.T) {
 	)
 }
 
-func Test_ContinueAsNew_Events(t *testing.T) {
+func Test_ContinueAsNew_YieldAtLimit(t *testing.T) {
 	// Registration
 	r := task.NewTaskRegistry()
-	r.AddOrchestratorN("ContinueAsNewTest", func(ctx *task.OrchestrationContext) (any, error) {
+	r.AddOrchestratorN("ContinueAsNewTightLoop", func(ctx *task.OrchestrationContext) (any, error) {
 		var input int32
 		if err := ctx.GetInput(&input); err != nil {
 			return nil, err
 		}
-		var complete bool
-		if err := ctx.WaitForSingleEvent("MyEvent", -1).Await(&complete); err != nil {
-			return nil, err
-		}
-		if complete {
-			return input, nil
+
+		// Continuing as new without awaiting anything keeps the orchestration in a single work item
+		if input < 10 {
+			ctx.ContinueAsNew(input + 1)
 		}
-		ctx.ContinueAsNew(input+1, task.WithKeepUnprocessedEvents())
-		return nil, nil
+		return input, nil
 	})
 
 	// Initialization
 	ctx := context.Background()
-	client, worker := initTaskHubWorker(ctx, r)
+	client, worker := initTaskHubWorker(ctx, r,
+		backend.WithMaxContinueAsNewCount(3),
+		backend.WithContinueAsNewLimitPolicy(backend.ContinueAsNewLimitYield))
 	defer worker.Shutdown(ctx)
 
 	// Run the orchestration
-	id, err := client.ScheduleNewOrchestration(ctx, "ContinueAsNewTest", api.WithInput(0))
-	require.NoError(t, err)
-	for i := 0; i < 10; i++ {
-		require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent", api.WithEventPayload(false)))
+	id, err := client.ScheduleNewOrchestration(ctx, "ContinueAsNewTightLoop", api.WithInput(0))
+	if assert.NoError(t, err) {
+		timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+		if assert.NoError(t, err) {
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+			assert.Equal(t, `10`, metadata.SerializedOutput)
+			assert.Equal(t, 10, metadata.GenerationCount)
+		}
 	}
-	require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent", api.WithEventPayload(true)))
-	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
-	require.NoError(t, err)
-	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
-	assert.Equal(t, `10`, metadata.SerializedOutput)
 }
 
-func Test_ExternalEventOrchestration(t *testing.T) {
-	const eventCount = 10
+func Test_ContinueAsNew_InputTransform(t *testing.T) {
+	type state struct {
+		Generation int
+		Items      []int
+	}
 
 	// Registration
 	r := task.NewTaskRegistry()
-	r.AddOrchestratorN("ExternalEventOrchestration", func(ctx *task.OrchestrationContext) (any, error) {
-		for i := 0; i < eventCount; i++ {
-			var value int
-			ctx.WaitForSingleEvent("MyEvent", 5*time.Second).Await(&value)
-			if value != i {
-				return false, errors.New("Unexpected value")
-			}
+	r.AddOrchestratorN("AccumulateItems", func(ctx *task.OrchestrationContext) (any, error) {
+		var input state
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
 		}
-		return true, nil
+
+		if input.Generation < 10 {
+			input.Items = append(input.Items, input.Generation)
+			input.Generation++
+			ctx.ContinueAsNew(input)
+		}
+		return input, nil
+	})
+
+	// The transform only keeps the three most recent items
+	transform := func(iid api.InstanceID, oldInput, newInput []byte) ([]byte, error) {
+		var oldState, newState state
+		if err := json.Unmarshal(oldInput, &oldState); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(newInput, &newState); err != nil {
+			return nil, err
+		}
+		if newState.Generation != oldState.Generation+1 {
+			return nil, fmt.Errorf("unexpected generation %d after %d", newState.Generation, oldState.Generation)
+		}
+		if len(newState.Items) > 3 {
+			newState.Items = newState.Items[len(newState.Items)-3:]
+		}
+		return json.Marshal(newState)
+	}
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithContinueAsNewInputTransform(transform))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "AccumulateItems", api.WithInput(state{}))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `{"Generation":10,"Items":[7,8,9]}`, metadata.SerializedOutput)
+	assert.Equal(t, 10, metadata.GenerationCount)
+}
+
+func Test_ContinueAsNew_Events(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ContinueAsNewTest", func(ctx *task.OrchestrationContext) (any, error) {
+		var input int32
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		var complete bool
+		if err := ctx.WaitForSingleEvent("MyEvent", -1).Await(&complete); err != nil {
+			return nil, err
+		}
+		if complete {
+			return input, nil
+		}
+		ctx.ContinueAsNew(input+1, task.WithKeepUnprocessedEvents())
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "ContinueAsNewTest", api.WithInput(0))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent", api.WithEventPayload(false)))
+	}
+	require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent", api.WithEventPayload(true)))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `10`, metadata.SerializedOutput)
+}
+
+func Test_DeterministicHelpers(t *testing.T) {
+	type observation struct {
+		GUID       string
+		Random     int64
+		SideEffect int32
+		Error      string
+	}
+
+	var sideEffectCalls, failedSideEffectCalls int32
+	var observations []observation
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("DeterministicHelpers", func(ctx *task.OrchestrationContext) (any, error) {
+		var o observation
+		o.GUID = ctx.NewGUID().String()
+		o.Random = ctx.Random().Int63()
+		if err := ctx.SideEffect(func() (any, error) {
+			return atomic.AddInt32(&sideEffectCalls, 1), nil
+		}).Await(&o.SideEffect); err != nil {
+			return nil, err
+		}
+		if err := ctx.SideEffect(func() (any, error) {
+			atomic.AddInt32(&failedSideEffectCalls, 1)
+			return nil, errors.New("boom")
+		}).Await(nil); err != nil {
+			o.Error = err.Error()
+		}
+
+		// The activity makes the orchestrator replay, which must produce the same values
+		observations = append(observations, o)
+		if err := ctx.CallActivity("Noop").Await(nil); err != nil {
+			return nil, err
+		}
+		return o, nil
+	})
+	r.AddActivityN("Noop", func(ctx task.ActivityContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "DeterministicHelpers")
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+
+	var output observation
+	require.NoError(t, json.Unmarshal([]byte(metadata.SerializedOutput), &output))
+	assert.NotEmpty(t, output.GUID)
+	assert.Equal(t, int32(1), output.SideEffect)
+	assert.Contains(t, output.Error, "boom")
+	if assert.Len(t, observations, 2) {
+		assert.Equal(t, observations[0], observations[1])
+		assert.Equal(t, output, observations[1])
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sideEffectCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failedSideEffectCalls))
+}
+
+func Test_ExternalEventOrchestration(t *testing.T) {
+	const eventCount = 10
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ExternalEventOrchestration", func(ctx *task.OrchestrationContext) (any, error) {
+		for i := 0; i < eventCount; i++ {
+			var value int
+			ctx.WaitForSingleEvent("MyEvent", 5*time.Second).Await(&value)
+			if value != i {
+				return false, errors.New("Unexpected value")
+			}
+		}
+		return true, nil
 	})
 
 	// Initialization
@@ -534,6 +1041,199 @@ func Test_ExternalEventOrchestration(t *testing.T) {
 	)
 }
 
+func Test_ExternalEventTimeoutError(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitWithTimeout", func(ctx *task.OrchestrationContext) (any, error) {
+		approval := ctx.WaitForSingleEvent("Approval", time.Second)
+		var value string
+		if err := approval.Await(&value); err != nil {
+			var timeoutErr *task.EventTimeoutError
+			if !errors.As(err, &timeoutErr) || !errors.Is(err, task.ErrTaskCanceled) {
+				return nil, err
+			}
+			// Events that are received after the timeout are buffered
+			if err := ctx.CreateTimer(2 * time.Second).Await(nil); err != nil {
+				return nil, err
+			}
+			return "timed out waiting for " + timeoutErr.EventName, nil
+		}
+
+		// The timer of the timeout has no effect once the event was received
+		if err := ctx.CreateTimer(2 * time.Second).Await(nil); err != nil {
+			return nil, err
+		}
+		if err := approval.Await(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "WaitWithTimeout")
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Approval", api.WithEventPayload("approved")))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"approved"`, metadata.SerializedOutput)
+
+	id, err = client.ScheduleNewOrchestration(ctx, "WaitWithTimeout")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	time.Sleep(1500 * time.Millisecond)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Approval", api.WithEventPayload("too late")))
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"timed out waiting for Approval"`, metadata.SerializedOutput)
+}
+
+func Test_RaiseEventIf(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("EchoEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		var value string
+		err := ctx.WaitForSingleEvent("MyEvent", -1).Await(&value)
+		return value, err
+	})
+
+	// Backends that can't check the runtime status atomically check it before adding the event
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			running := []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING}
+			err := client.RaiseEventIf(ctx, "does-not-exist", "MyEvent", running)
+			require.ErrorIs(t, err, api.ErrInstanceNotFound)
+
+			id, err := client.ScheduleNewOrchestration(ctx, "EchoEvent")
+			require.NoError(t, err)
+			_, err = client.WaitForOrchestrationStart(ctx, id)
+			require.NoError(t, err)
+
+			// The event is rejected when the orchestration isn't in one of the expected statuses
+			err = client.RaiseEventIf(ctx, id, "MyEvent", []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED})
+			require.ErrorIs(t, err, api.ErrPreconditionFailed)
+
+			require.NoError(t, client.RaiseEventIf(ctx, id, "MyEvent", running, api.WithEventPayload("hello")))
+			metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+			assert.Equal(t, `"hello"`, metadata.SerializedOutput)
+
+			// Completed orchestrations no longer accept events that require them to be running
+			err = client.RaiseEventIf(ctx, id, "MyEvent", running)
+			require.ErrorIs(t, err, api.ErrPreconditionFailed)
+		})
+	}
+}
+
+// heldEventsBackend holds the events that are added to orchestrations until they're released, which simulates a
+// backend that reorders or loses events.
+type heldEventsBackend struct {
+	backend.Backend
+	held []*backend.HistoryEvent
+}
+
+func (be *heldEventsBackend) AddNewOrchestrationEvent(_ context.Context, _ api.InstanceID, e *backend.HistoryEvent) error {
+	be.held = append(be.held, e)
+	return nil
+}
+
+func (be *heldEventsBackend) release(ctx context.Context, id api.InstanceID, indexes ...int) error {
+	for _, i := range indexes {
+		if err := be.Backend.AddNewOrchestrationEvent(ctx, id, be.held[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test_OrderedEvents(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CollectEvents", func(ctx *task.OrchestrationContext) (any, error) {
+		var count int
+		if err := ctx.GetInput(&count); err != nil {
+			return nil, err
+		}
+		values := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			var value string
+			if err := ctx.WaitForSingleEvent("Item", -1).Await(&value); err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	raiseHeldEvents := func(t *testing.T, count int) (api.InstanceID, *heldEventsBackend) {
+		id, err := backend.NewTaskHubClient(be).ScheduleNewOrchestration(ctx, "CollectEvents", api.WithInput(count))
+		require.NoError(t, err)
+
+		held := &heldEventsBackend{Backend: be}
+		client := backend.NewTaskHubClient(held, backend.WithOrderedEvents())
+		for _, value := range []string{"a", "b", "c"} {
+			require.NoError(t, client.RaiseEvent(ctx, id, "Item", api.WithEventPayload(value)))
+		}
+		return id, held
+	}
+
+	t.Run("Reordered", func(t *testing.T) {
+		id, held := raiseHeldEvents(t, 3)
+		for _, i := range []int{2, 1, 0} {
+			require.NoError(t, held.release(ctx, id, i))
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+		metadata, err := backend.NewTaskHubClient(be).WaitForOrchestrationCompletion(timeoutCtx, id)
+		require.NoError(t, err)
+		assert.Equal(t, `["a","b","c"]`, metadata.SerializedOutput)
+	})
+
+	t.Run("GapNeverFills", func(t *testing.T) {
+		// The buffered events are delivered once the buffering window expires, and the missing event is delivered
+		// out of order when it finally arrives
+		id, held := raiseHeldEvents(t, 3)
+		require.NoError(t, held.release(ctx, id, 2, 1))
+
+		client := backend.NewTaskHubClient(be)
+		require.Eventually(t, func() bool {
+			history, err := client.FetchOrchestrationHistories(ctx, map[api.InstanceID]int{id: 0})
+			if err != nil {
+				return false
+			}
+			raised := 0
+			for _, e := range history[id] {
+				if e.GetEventRaised() != nil {
+					raised++
+				}
+			}
+			return raised == 2
+		}, 15*time.Second, 100*time.Millisecond)
+
+		require.NoError(t, held.release(ctx, id, 0))
+		metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, `["b","c","a"]`, metadata.SerializedOutput)
+	})
+}
+
 func Test_ExternalEventTimeout(t *testing.T) {
 	// Registration
 	r := task.NewTaskRegistry()
@@ -681,99 +1381,3829 @@ func Test_SuspendResumeOrchestration(t *testing.T) {
 	)
 }
 
-func Test_TerminateOrchestration(t *testing.T) {
+func Test_SuspensionBufferFull_Reject(t *testing.T) {
+	const eventCount = 5
+	const maxBufferedEvents = 3
+
 	// Registration
 	r := task.NewTaskRegistry()
-	r.AddOrchestratorN("MyOrchestrator", func(ctx *task.OrchestrationContext) (any, error) {
-		ctx.CreateTimer(3 * time.Second).Await(nil)
-		return nil, nil
+	r.AddOrchestratorN("CountEvents", func(ctx *task.OrchestrationContext) (any, error) {
+		received := 0
+		for i := 0; i < eventCount; i++ {
+			if err := ctx.WaitForSingleEvent("MyEvent", 3*time.Second).Await(nil); err != nil {
+				break
+			}
+			received++
+		}
+		return received, nil
 	})
 
 	// Initialization
 	ctx := context.Background()
-	exporter := initTracing()
-	client, worker := initTaskHubWorker(ctx, r)
+	client, worker := initTaskHubWorker(ctx, r, backend.WithSuspensionBufferLimits(
+		maxBufferedEvents, 0, backend.SuspensionBufferOverflowReject))
 	defer worker.Shutdown(ctx)
 
-	// Run the orchestration, which will block waiting for external events
-	id, err := client.ScheduleNewOrchestration(ctx, "MyOrchestrator")
+	// Run the orchestration and suspend it once it starts
+	id, err := client.ScheduleNewOrchestration(ctx, "CountEvents")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
 	require.NoError(t, err)
+	require.NoError(t, client.SuspendOrchestration(ctx, id, ""))
 
-	// Terminate the orchestration before the timer expires
-	require.NoError(t, client.TerminateOrchestration(ctx, id, api.WithOutput("You got terminated!")))
+	// Raise more events than the suspension buffer can hold
+	for i := 0; i < eventCount; i++ {
+		require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent"))
+	}
 
-	// Wait for the orchestration to complete
-	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
-	require.NoError(t, err)
-	require.True(t, metadata.IsComplete())
-	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
-	require.Equal(t, `"You got terminated!"`, metadata.SerializedOutput)
+	// Make sure the orchestration stays suspended
+	timeoutCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.ErrorIs(t, err, timeoutCtx.Err())
 
-	// Validate the exported OTel traces
-	spans := exporter.GetSpans().Snapshots()
-	assertSpanSequence(t, spans,
-		assertOrchestratorCreated("MyOrchestrator", id),
-		assertOrchestratorExecuted("MyOrchestrator", id, "TERMINATED"),
-	)
+	// Resume the orchestration and wait for it to complete. Only the buffered events should be delivered.
+	require.NoError(t, client.ResumeOrchestration(ctx, id, ""))
+	timeoutCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, fmt.Sprintf("%d", maxBufferedEvents), metadata.SerializedOutput)
 }
 
-func Test_PurgeCompletedOrchestration(t *testing.T) {
+func Test_SuspensionBufferFull_RejectRaiseEvent(t *testing.T) {
+	const maxBufferedEvents = 3
+
 	// Registration
 	r := task.NewTaskRegistry()
-	r.AddOrchestratorN("ExternalEventOrchestration", func(ctx *task.OrchestrationContext) (any, error) {
-		if err := ctx.WaitForSingleEvent("MyEvent", 30*time.Second).Await(nil); err != nil {
-			return nil, err
+	r.AddOrchestratorN("CountEvents", func(ctx *task.OrchestrationContext) (any, error) {
+		received := 0
+		for i := 0; i < maxBufferedEvents+1; i++ {
+			if err := ctx.WaitForSingleEvent("MyEvent", 3*time.Second).Await(nil); err != nil {
+				break
+			}
+			received++
 		}
-		return nil, nil
+		return received, nil
 	})
 
-	// Initialization
+	// Initialization, with a client that enforces the same limits as the worker
 	ctx := context.Background()
-	client, worker := initTaskHubWorker(ctx, r)
+	be, worker := initBackendAndTaskHubWorker(ctx, r, backend.WithSuspensionBufferLimits(
+		maxBufferedEvents, 0, backend.SuspensionBufferOverflowReject))
 	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be, backend.WithRaiseEventSuspensionBufferLimits(maxBufferedEvents, 0))
 
-	// Run the orchestration
-	id, err := client.ScheduleNewOrchestration(ctx, "ExternalEventOrchestration")
-	if !assert.NoError(t, err) {
-		return
-	}
-	if _, err = client.WaitForOrchestrationStart(ctx, id); !assert.NoError(t, err) {
-		return
-	}
-
-	// Try to purge the orchestration state before it completes and verify that it fails with ErrNotCompleted
-	if err = client.PurgeOrchestrationState(ctx, id); !assert.ErrorIs(t, err, api.ErrNotCompleted) {
-		return
-	}
+	// Run the orchestration and suspend it once it starts
+	id, err := client.ScheduleNewOrchestration(ctx, "CountEvents")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, client.SuspendOrchestration(ctx, id, ""))
+	require.Eventually(t, func() bool {
+		metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+		return err == nil && metadata.RuntimeStatus == protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED
+	}, 5*time.Second, 10*time.Millisecond)
 
-	// Raise an event to the orchestration so that it can complete
-	if err = client.RaiseEvent(ctx, id, "MyEvent"); !assert.NoError(t, err) {
-		return
-	}
-	if _, err = client.WaitForOrchestrationCompletion(ctx, id); !assert.NoError(t, err) {
-		return
+	// Fill the suspension buffer, and wait for the worker to buffer the events
+	for i := 0; i < maxBufferedEvents; i++ {
+		require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent"))
 	}
+	require.Eventually(t, func() bool {
+		state, err := be.GetOrchestrationRuntimeState(ctx, &backend.OrchestrationWorkItem{InstanceID: id})
+		if err != nil {
+			return false
+		}
+		count, _ := state.SuspendedEvents()
+		return count == maxBufferedEvents
+	}, 5*time.Second, 10*time.Millisecond)
 
-	// Try to purge the orchestration state again and verify that it succeeds
-	if err = client.PurgeOrchestrationState(ctx, id); !assert.NoError(t, err) {
-		return
-	}
+	// Events that don't fit in the buffer are rejected instead of being dropped by the worker
+	err = client.RaiseEvent(ctx, id, "MyEvent")
+	require.ErrorIs(t, err, backend.ErrSuspensionBufferFull)
+	err = client.RaiseEventIf(ctx, id, "MyEvent", []protos.OrchestrationStatus{protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED})
+	require.ErrorIs(t, err, backend.ErrSuspensionBufferFull)
 
-	// Try to fetch the orchestration metadata and verify that it fails with ErrInstanceNotFound
-	if _, err = client.FetchOrchestrationMetadata(ctx, id); !assert.ErrorIs(t, err, api.ErrInstanceNotFound) {
+	// Resume the orchestration, which receives the buffered events only
+	require.NoError(t, client.ResumeOrchestration(ctx, id, ""))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, fmt.Sprintf("%d", maxBufferedEvents), metadata.SerializedOutput)
+}
+
+func Test_SuspensionBufferFull_RejectSentEvent(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CountEvents", func(ctx *task.OrchestrationContext) (any, error) {
+		received := 0
+		for i := 0; i < 2; i++ {
+			if err := ctx.WaitForSingleEvent("MyEvent", 3*time.Second).Await(nil); err != nil {
+				break
+			}
+			received++
+		}
+		return received, nil
+	})
+
+	// Initialization, with a client that enforces the same limits as the worker
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r, backend.WithSuspensionBufferLimits(
+		1, 0, backend.SuspensionBufferOverflowReject))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be, backend.WithRaiseEventSuspensionBufferLimits(1, 0))
+
+	// Run the orchestration, suspend it once it starts, and fill its suspension buffer
+	id, err := client.ScheduleNewOrchestration(ctx, "CountEvents")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, client.SuspendOrchestration(ctx, id, ""))
+	require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent"))
+	require.Eventually(t, func() bool {
+		state, err := be.GetOrchestrationRuntimeState(ctx, &backend.OrchestrationWorkItem{InstanceID: id})
+		if err != nil {
+			return false
+		}
+		count, _ := state.SuspendedEvents()
+		return count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Events sent by other orchestrations bypass the client, so the worker can't reject them, but it doesn't drop
+	// them silently either: they're recorded in the orchestration history
+	require.NoError(t, be.AddNewOrchestrationEvent(ctx, id, helpers.NewSendEventEvent(0, string(id), "MyEvent", wrapperspb.String(`"sent"`))))
+	isDropped := func(e *api.HistoryEvent) bool {
+		return e.Type == api.HistoryEventGeneric && strings.HasPrefix(e.Input, helpers.DroppedEventPrefix)
+	}
+	var dropped *api.HistoryEvent
+	require.Eventually(t, func() bool {
+		history, err := client.GetOrchestrationHistory(ctx, id)
+		if err != nil {
+			return false
+		}
+		for _, e := range history {
+			if isDropped(e) {
+				dropped = e
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, dropped.Input, `"name":"MyEvent"`)
+	assert.Contains(t, dropped.Input, `"input":"\"sent\""`)
+
+	// Resume the orchestration, which receives the buffered event only
+	require.NoError(t, client.ResumeOrchestration(ctx, id, ""))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, "1", metadata.SerializedOutput)
+}
+
+func Test_SuspensionBufferFull_AutoResume(t *testing.T) {
+	const eventCount = 5
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CountEvents", func(ctx *task.OrchestrationContext) (any, error) {
+		for i := 0; i < eventCount; i++ {
+			if err := ctx.WaitForSingleEvent("MyEvent", 5*time.Second).Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return eventCount, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithSuspensionBufferLimits(
+		3, 0, backend.SuspensionBufferOverflowAutoResume))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration and suspend it once it starts
+	id, err := client.ScheduleNewOrchestration(ctx, "CountEvents")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, client.SuspendOrchestration(ctx, id, ""))
+
+	// Raise more events than the suspension buffer can hold
+	for i := 0; i < eventCount; i++ {
+		require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent"))
+	}
+
+	// The orchestration should get resumed automatically and complete without an explicit resume
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, fmt.Sprintf("%d", eventCount), metadata.SerializedOutput)
+}
+
+func Test_TypedCustomStatus(t *testing.T) {
+	type progress struct {
+		Step    int    `json:"step"`
+		Message string `json:"message"`
+	}
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ReportProgress", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.SetCustomStatus(progress{Step: 1, Message: "waiting"}); err != nil {
+			return nil, err
+		}
+		if err := ctx.WaitForSingleEvent("Continue", 5*time.Second).Await(nil); err != nil {
+			return nil, err
+		}
+		// This status doesn't match the registered schema and must not be persisted
+		if err := ctx.SetCustomStatus(map[string]any{"bogus": true}); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithCustomStatusValidator(
+		"ReportProgress", backend.CustomStatusSchema[progress]()))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration and wait for it to report its first status
+	id, err := client.ScheduleNewOrchestration(ctx, "ReportProgress")
+	require.NoError(t, err)
+	var metadata *api.OrchestrationMetadata
+	require.Eventually(t, func() bool {
+		metadata, err = client.FetchOrchestrationMetadata(ctx, id)
+		return err == nil && metadata.SerializedCustomStatus != ""
+	}, 5*time.Second, 100*time.Millisecond)
+
+	status, err := api.ReadCustomStatus[progress](metadata)
+	require.NoError(t, err)
+	assert.Equal(t, progress{Step: 1, Message: "waiting"}, status)
+
+	// Let the orchestration complete with an invalid status, which should be discarded
+	require.NoError(t, client.RaiseEvent(ctx, id, "Continue"))
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	status, err = api.ReadCustomStatus[progress](metadata)
+	require.NoError(t, err)
+	assert.Equal(t, progress{Step: 1, Message: "waiting"}, status)
+}
+
+func Test_ReadCustomStatus_NotSet(t *testing.T) {
+	metadata := &api.OrchestrationMetadata{InstanceID: "abc"}
+	_, err := api.ReadCustomStatus[string](metadata)
+	assert.ErrorIs(t, err, api.ErrNoCustomStatus)
+}
+
+func Test_CustomStatus_UpdateAndQuery(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Shipment", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Delivered", -1).Await(nil)
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithMaxCustomStatusSize(32))
+	defer worker.Shutdown(ctx)
+
+	ids := []api.InstanceID{"shipment-1", "shipment-2", "shipment-3"}
+	for _, id := range ids {
+		_, err := client.ScheduleNewOrchestration(ctx, "Shipment", api.WithInstanceID(id))
+		require.NoError(t, err)
+		_, err = client.WaitForOrchestrationStart(ctx, id)
+		require.NoError(t, err)
+	}
+
+	// Update the custom statuses while the orchestrations are waiting. The last status is too large to be saved.
+	require.NoError(t, client.SetCustomStatus(ctx, ids[0], "shipped"))
+	require.NoError(t, client.SetCustomStatus(ctx, ids[1], "packed"))
+	require.NoError(t, client.SetCustomStatus(ctx, ids[2], strings.Repeat("p", 64)))
+	require.Eventually(t, func() bool {
+		metadata, err := client.FetchOrchestrationMetadata(ctx, ids[1])
+		return err == nil && metadata.SerializedCustomStatus == `"packed"`
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Eventually(t, func() bool {
+		metadata, err := client.FetchOrchestrationMetadata(ctx, ids[0])
+		return err == nil && metadata.SerializedCustomStatus == `"shipped"`
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Query the orchestrations by custom status, one per page
+	query := api.InstanceQuery{InstanceIDPrefix: "shipment-", CustomStatusContains: "p", PageSize: 1}
+	var matched []api.InstanceID
+	for {
+		result, err := client.QueryInstances(ctx, query)
+		require.NoError(t, err)
+		for _, metadata := range result.Instances {
+			matched = append(matched, metadata.InstanceID)
+		}
+		if result.ContinuationToken == "" {
+			break
+		}
+		query.ContinuationToken = result.ContinuationToken
+	}
+	assert.Equal(t, ids[:2], matched)
+
+	// Clearing the custom status removes the orchestration from the results
+	require.NoError(t, client.SetCustomStatus(ctx, ids[0], nil))
+	require.Eventually(t, func() bool {
+		result, err := client.QueryInstances(ctx, api.InstanceQuery{InstanceIDPrefix: "shipment-", CustomStatusContains: "shipped"})
+		return err == nil && len(result.Instances) == 0
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// The orchestrator keeps the updated custom status when it completes
+	require.NoError(t, client.RaiseEvent(ctx, ids[1], "Delivered"))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, `"packed"`, metadata.SerializedCustomStatus)
+}
+
+func Test_OrchestrationTags(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Countdown", func(ctx *task.OrchestrationContext) (any, error) {
+		var remaining int
+		if err := ctx.GetInput(&remaining); err != nil {
+			return nil, err
+		}
+		if remaining > 0 {
+			ctx.ContinueAsNew(remaining - 1)
+		}
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Tags from multiple options are merged, and are kept when the orchestration continues as new
+	id, err := client.ScheduleNewOrchestration(ctx, "Countdown",
+		api.WithInstanceID("countdown-contoso"),
+		api.WithInput(2),
+		api.WithTags(map[string]string{"tenant": "contoso"}),
+		api.WithTags(map[string]string{"job": "nightly"}))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 2, metadata.GenerationCount)
+	assert.Equal(t, map[string]string{"tenant": "contoso", "job": "nightly"}, metadata.Tags)
+
+	_, err = client.ScheduleNewOrchestration(ctx, "Countdown",
+		api.WithInstanceID("countdown-fabrikam"),
+		api.WithTags(map[string]string{"tenant": "fabrikam", "job": "nightly"}))
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "Countdown", api.WithInstanceID("countdown-untagged"))
+	require.NoError(t, err)
+
+	// Query the orchestrations by tags
+	query := func(tags map[string]string) []api.InstanceID {
+		result, err := client.QueryInstances(ctx, api.InstanceQuery{InstanceIDPrefix: "countdown-", Tags: tags})
+		require.NoError(t, err)
+		ids := make([]api.InstanceID, 0, len(result.Instances))
+		for _, metadata := range result.Instances {
+			ids = append(ids, metadata.InstanceID)
+		}
+		return ids
+	}
+	assert.Equal(t, []api.InstanceID{"countdown-contoso", "countdown-fabrikam"}, query(map[string]string{"job": "nightly"}))
+	assert.Equal(t, []api.InstanceID{"countdown-fabrikam"}, query(map[string]string{"job": "nightly", "tenant": "fabrikam"}))
+	assert.Empty(t, query(map[string]string{"job": "weekly"}))
+	assert.Len(t, query(nil), 3)
+
+	// Query the orchestrations by tag filter expressions
+	queryFilter := func(filter *api.TagFilter) []api.InstanceID {
+		result, err := client.QueryInstances(ctx, api.InstanceQuery{InstanceIDPrefix: "countdown-", TagFilter: filter})
+		require.NoError(t, err)
+		ids := make([]api.InstanceID, 0, len(result.Instances))
+		for _, metadata := range result.Instances {
+			ids = append(ids, metadata.InstanceID)
+		}
+		return ids
+	}
+	assert.Equal(t, []api.InstanceID{"countdown-fabrikam", "countdown-untagged"}, queryFilter(api.TagNotEquals("tenant", "contoso")))
+	assert.Equal(t, []api.InstanceID{"countdown-fabrikam"}, queryFilter(api.AllTags(api.TagEquals("job", "nightly"), api.TagNotEquals("tenant", "contoso"))))
+	assert.Equal(t, []api.InstanceID{"countdown-contoso", "countdown-untagged"}, queryFilter(api.AnyTag(api.TagEquals("tenant", "contoso"), api.TagNotEquals("job", "nightly"))))
+	assert.Empty(t, queryFilter(api.AnyTag()))
+	assert.Len(t, queryFilter(api.AllTags()), 3)
+	_, err = client.QueryInstances(ctx, api.InstanceQuery{TagFilter: &api.TagFilter{Op: api.TagFilterOp(42)}})
+	assert.Error(t, err)
+
+	// Restarted orchestrations keep their tags
+	restartID, err := client.RestartOrchestration(ctx, id, api.WithRestartNewInstanceID(true))
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, restartID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tenant": "contoso", "job": "nightly"}, metadata.Tags)
+}
+
+func Test_OrchestrationMetadata_LazyPayloads(t *testing.T) {
+	type order struct {
+		ID    string `json:"id"`
+		Items int    `json:"items"`
+	}
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CountItems", func(ctx *task.OrchestrationContext) (any, error) {
+		var input order
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		return input.Items, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "CountItems", api.WithInput(order{ID: "abc", Items: 3}))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	var input order
+	require.NoError(t, metadata.Input().Into(&input))
+	assert.Equal(t, order{ID: "abc", Items: 3}, input)
+
+	var output int
+	require.NoError(t, metadata.Output().Into(&output))
+	assert.Equal(t, 3, output)
+
+	// Invalid payloads only fail when they're read
+	var wrongType string
+	assert.Error(t, metadata.Output().Into(&wrongType))
+
+	// Empty values leave the target unchanged
+	empty := &api.OrchestrationMetadata{InstanceID: "abc"}
+	assert.True(t, empty.Output().IsEmpty())
+	output = 42
+	require.NoError(t, empty.Output().Into(&output))
+	assert.Equal(t, 42, output)
+}
+
+func Test_TerminateSuspendedOrchestration(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForEvents", func(ctx *task.OrchestrationContext) (any, error) {
+		for {
+			if err := ctx.WaitForSingleEvent("MyEvent", -1).Await(nil); err != nil {
+				return nil, err
+			}
+		}
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration and suspend it once it starts
+	id, err := client.ScheduleNewOrchestration(ctx, "WaitForEvents")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, client.SuspendOrchestration(ctx, id, ""))
+
+	// Events raised while suspended are buffered, but a terminate takes effect right away
+	require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent"))
+	require.NoError(t, client.TerminateOrchestration(ctx, id, api.WithOutput("terminated while suspended")))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
+	assert.Equal(t, `"terminated while suspended"`, metadata.SerializedOutput)
+}
+
+func Test_ShutdownReleasesInFlightWorkItems(t *testing.T) {
+	// Worker A blocks in its activity until it's shut down, whereas worker B completes it right away
+	activityStarted := make(chan struct{}, 1)
+	rA := task.NewTaskRegistry()
+	rB := task.NewTaskRegistry()
+	orchestrator := func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallActivity("Work").Await(&output)
+		return output, err
+	}
+	rA.AddOrchestratorN("SingleActivity", orchestrator)
+	rB.AddOrchestratorN("SingleActivity", orchestrator)
+	rA.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+		activityStarted <- struct{}{}
+		<-ctx.Context().Done()
+		return nil, ctx.Context().Err()
+	})
+	rB.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+		return "done by worker B", nil
+	})
+
+	// Both workers share the same database file
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	options := sqlite.NewSqliteOptions(filepath.Join(t.TempDir(), "taskhub.sqlite3"))
+	startWorker := func(r *task.TaskRegistry) (backend.Backend, backend.TaskHubWorker) {
+		be := sqlite.NewSqliteBackend(options, logger)
+		executor := task.NewTaskExecutor(r)
+		orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+		activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+		worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+		require.NoError(t, worker.Start(ctx))
+		return be, worker
+	}
+
+	beA, workerA := startWorker(rA)
+	client := backend.NewTaskHubClient(beA)
+	id, err := client.ScheduleNewOrchestration(ctx, "SingleActivity")
+	require.NoError(t, err)
+
+	select {
+	case <-activityStarted:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for worker A to start the activity")
+	}
+
+	// Shutting down worker A releases the activity it was running once the drain deadline is reached, well before
+	// its lock expires
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShutdown()
+	require.NoError(t, workerA.Shutdown(shutdownCtx))
+	_, workerB := startWorker(rB)
+	defer workerB.Shutdown(ctx)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"done by worker B"`, metadata.SerializedOutput)
+}
+
+func Test_ShutdownDrainsInFlightWorkItems(t *testing.T) {
+	// The activity is still running when worker A is shut down
+	var executions int32
+	activityStarted := make(chan struct{}, 1)
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("SingleActivity", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallActivity("Work").Await(&output)
+		return output, err
+	})
+	r.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+		atomic.AddInt32(&executions, 1)
+		activityStarted <- struct{}{}
+		time.Sleep(500 * time.Millisecond)
+		return "done", nil
+	})
+
+	// Both workers share the same database file
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	options := sqlite.NewSqliteOptions(filepath.Join(t.TempDir(), "taskhub.sqlite3"))
+	startWorker := func() (backend.Backend, backend.TaskHubWorker) {
+		be := sqlite.NewSqliteBackend(options, logger)
+		executor := task.NewTaskExecutor(r)
+		orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+		activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+		worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+		require.NoError(t, worker.Start(ctx))
+		return be, worker
+	}
+
+	beA, workerA := startWorker()
+	client := backend.NewTaskHubClient(beA)
+	id, err := client.ScheduleNewOrchestration(ctx, "SingleActivity")
+	require.NoError(t, err)
+
+	select {
+	case <-activityStarted:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for worker A to start the activity")
+	}
+
+	// Shutting down worker A waits for the activity to complete, and saves its result
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelShutdown()
+	require.NoError(t, workerA.Shutdown(shutdownCtx))
+	assert.NoError(t, shutdownCtx.Err())
+
+	// Worker B completes the orchestration without executing the activity again
+	_, workerB := startWorker()
+	defer workerB.Shutdown(ctx)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"done"`, metadata.SerializedOutput)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&executions))
+}
+
+func Test_ScheduledStartTime(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		var value string
+		err := ctx.WaitForSingleEvent("MyEvent", 5*time.Second).Await(&value)
+		return value, err
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// The orchestration stays pending until its scheduled start time, even when it receives events
+	startTime := time.Now().Add(2 * time.Second)
+	id, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent", api.WithScheduledStartTime(startTime))
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, id, "MyEvent", api.WithEventPayload("hello")))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	_, err = client.WaitForOrchestrationStart(timeoutCtx, id)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING, metadata.RuntimeStatus)
+
+	timeoutCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"hello"`, metadata.SerializedOutput)
+	assert.False(t, time.Now().Before(startTime))
+
+	// A scheduled start time in the past starts the orchestration right away
+	id, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent", api.WithScheduledStartTime(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	timeoutCtx, cancel = context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationStart(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING, metadata.RuntimeStatus)
+}
+
+func Test_TerminateOrchestration(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("MyOrchestrator", func(ctx *task.OrchestrationContext) (any, error) {
+		ctx.CreateTimer(3 * time.Second).Await(nil)
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	exporter := initTracing()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration, which will block waiting for external events
+	id, err := client.ScheduleNewOrchestration(ctx, "MyOrchestrator")
+	require.NoError(t, err)
+
+	// Terminate the orchestration before the timer expires
+	require.NoError(t, client.TerminateOrchestration(ctx, id, api.WithOutput("You got terminated!")))
+
+	// Wait for the orchestration to complete
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	require.True(t, metadata.IsComplete())
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
+	require.Equal(t, `"You got terminated!"`, metadata.SerializedOutput)
+
+	// Validate the exported OTel traces
+	spans := exporter.GetSpans().Snapshots()
+	assertSpanSequence(t, spans,
+		assertOrchestratorCreated("MyOrchestrator", id),
+		assertOrchestratorExecuted("MyOrchestrator", id, "TERMINATED"),
+	)
+}
+
+func Test_OrchestrationTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         backend.OrchestrationTimeoutPolicy
+		expectedStatus protos.OrchestrationStatus
+	}{
+		{"Terminate", backend.OrchestrationTimeoutTerminate, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED},
+		{"Fail", backend.OrchestrationTimeoutFail, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Registration
+			r := task.NewTaskRegistry()
+			r.AddOrchestratorN("WaitForever", func(ctx *task.OrchestrationContext) (any, error) {
+				var input int
+				if err := ctx.GetInput(&input); err != nil {
+					return nil, err
+				}
+				if input < 3 {
+					// The timeout isn't reset when the orchestration continues as new
+					ctx.ContinueAsNew(input + 1)
+					return nil, nil
+				}
+				return nil, ctx.WaitForSingleEvent("Never", -1).Await(nil)
+			})
+
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r, backend.WithOrchestrationTimeoutPolicy(tt.policy))
+			defer worker.Shutdown(ctx)
+
+			// Run the orchestration, which never completes by itself
+			id, err := client.ScheduleNewOrchestration(ctx, "WaitForever", api.WithInput(0), api.WithOrchestrationTimeout(500*time.Millisecond))
+			require.NoError(t, err)
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, metadata.RuntimeStatus)
+			assert.Equal(t, 3, metadata.GenerationCount)
+			if tt.policy == backend.OrchestrationTimeoutFail && assert.NotNil(t, metadata.FailureDetails) {
+				assert.Equal(t, "OrchestrationTimeout", metadata.FailureDetails.ErrorType)
+			}
+		})
+	}
+}
+
+func Test_OrchestrationTimeout_ContinueAsNewLater(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ContinueOnEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		var generation int
+		if err := ctx.GetInput(&generation); err != nil {
+			return nil, err
+		}
+		if err := ctx.WaitForSingleEvent("Continue", -1).Await(nil); err != nil {
+			return nil, err
+		}
+		ctx.ContinueAsNew(generation + 1)
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r, backend.WithOrchestrationTimeoutPolicy(backend.OrchestrationTimeoutFail))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// Continue as new in a later work item than the one that started the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "ContinueOnEvent", api.WithInput(0), api.WithOrchestrationTimeout(time.Second))
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Continue"))
+	require.Eventually(t, func() bool {
+		metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+		return err == nil && metadata.GenerationCount == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The new generation keeps the timeout of the orchestration
+	state, err := be.GetOrchestrationRuntimeState(ctx, &backend.OrchestrationWorkItem{InstanceID: id})
+	require.NoError(t, err)
+	for _, e := range state.OldEvents() {
+		if es := e.GetExecutionStarted(); es != nil {
+			assert.Equal(t, time.Second, helpers.GetOrchestrationTimeout(es))
+		}
+	}
+
+	// The orchestration times out, and reports its timeout
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+	if assert.NotNil(t, metadata.FailureDetails) {
+		assert.Equal(t, "OrchestrationTimeout", metadata.FailureDetails.ErrorType)
+		assert.Equal(t, "the orchestration didn't complete within 1s", metadata.FailureDetails.ErrorMessage)
+	}
+}
+
+func Test_OrchestrationTimeout_CompletedInTime(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Quick", func(ctx *task.OrchestrationContext) (any, error) {
+		return "done", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration and wait for its timeout to expire
+	id, err := client.ScheduleNewOrchestration(ctx, "Quick", api.WithOrchestrationTimeout(200*time.Millisecond))
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	time.Sleep(1 * time.Second)
+
+	// The expired timeout doesn't change the orchestration
+	metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"done"`, metadata.SerializedOutput)
+}
+
+func Test_ActivityHeartbeatTimeout(t *testing.T) {
+	tests := []struct {
+		name             string
+		policy           backend.ActivityHeartbeatTimeoutPolicy
+		keepAlive        bool
+		expectedOutput   string
+		expectedAttempts int32
+	}{
+		{"Fail", backend.ActivityHeartbeatTimeoutFail, false, "stopped recording heartbeats", 1},
+		{"Abandon", backend.ActivityHeartbeatTimeoutAbandon, false, "2", 2},
+		{"KeepAlive", backend.ActivityHeartbeatTimeoutFail, true, "1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+
+			// Registration
+			r := task.NewTaskRegistry()
+			r.AddOrchestratorN("LongRunning", func(ctx *task.OrchestrationContext) (any, error) {
+				var attempt int32
+				if err := ctx.CallActivity("Work").Await(&attempt); err != nil {
+					return err.Error(), nil
+				}
+				return attempt, nil
+			})
+			r.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+				attempt := atomic.AddInt32(&attempts, 1)
+				if err := ctx.RecordHeartbeat(attempt); err != nil {
+					return nil, err
+				}
+				if tt.keepAlive {
+					// Keeps running for longer than the heartbeat timeout, but keeps recording heartbeats
+					for i := 0; i < 10; i++ {
+						time.Sleep(50 * time.Millisecond)
+						if err := ctx.RecordHeartbeat(i); err != nil {
+							return nil, err
+						}
+					}
+				} else if attempt == 1 {
+					// Hangs without recording any more heartbeats until the worker gives up on it
+					<-ctx.Context().Done()
+					return nil, ctx.Context().Err()
+				}
+				return attempt, nil
+			})
+
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r,
+				backend.WithActivityHeartbeatTimeout(200*time.Millisecond),
+				backend.WithActivityHeartbeatTimeoutPolicy(tt.policy))
+			defer worker.Shutdown(ctx)
+
+			// Run the orchestration
+			id, err := client.ScheduleNewOrchestration(ctx, "LongRunning")
+			require.NoError(t, err)
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+			require.NoError(t, err)
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+			assert.Contains(t, metadata.SerializedOutput, tt.expectedOutput)
+			assert.Equal(t, tt.expectedAttempts, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func Test_ActivityTimeout(t *testing.T) {
+	tests := []struct {
+		name             string
+		retries          bool
+		expectedOutput   string
+		expectedAttempts int32
+	}{
+		{"NoRetries", false, "the activity didn't complete within 200ms", 1},
+		{"Retried", true, "2", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+
+			// Registration
+			r := task.NewTaskRegistry()
+			r.AddOrchestratorN("CallWithTimeout", func(ctx *task.OrchestrationContext) (any, error) {
+				var work task.Task
+				if tt.retries {
+					work = ctx.CallActivity("Work",
+						task.WithActivityTimeout(200*time.Millisecond),
+						task.WithActivityRetryPolicy(task.RetryPolicy{MaxAttempts: 3, InitialInterval: 10 * time.Millisecond}))
+				} else {
+					work = ctx.CallActivity("Work", task.WithActivityTimeout(200*time.Millisecond))
+				}
+				var attempt int32
+				if err := work.Await(&attempt); err != nil {
+					return err.Error(), nil
+				}
+				return attempt, nil
+			})
+			r.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+				attempt := atomic.AddInt32(&attempts, 1)
+				if attempt == 1 {
+					// The first attempt hangs until it times out
+					<-ctx.Context().Done()
+					return nil, ctx.Context().Err()
+				}
+				return attempt, nil
+			})
+
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			// Run the orchestration
+			id, err := client.ScheduleNewOrchestration(ctx, "CallWithTimeout")
+			require.NoError(t, err)
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+			require.NoError(t, err)
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+			assert.Contains(t, metadata.SerializedOutput, tt.expectedOutput)
+			assert.Equal(t, tt.expectedAttempts, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func Test_ActivityConcurrencyLimits(t *testing.T) {
+	var running, maxRunning int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("FanOut", func(ctx *task.OrchestrationContext) (any, error) {
+		tasks := []task.Task{
+			ctx.CallActivity("Slow"),
+			ctx.CallActivity("Slow"),
+			ctx.CallActivity("Slow"),
+			ctx.CallActivity("Fast"),
+		}
+		for _, t := range tasks {
+			if err := t.Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	r.AddActivityN("Slow", func(ctx task.ActivityContext) (any, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	})
+	r.AddActivityN("Fast", func(ctx task.ActivityContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r,
+		backend.WithMaxParallelism(4),
+		backend.WithActivityConcurrencyLimits(map[string]int{"Slow": 1}))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "FanOut")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+}
+
+func Test_ActivityConcurrencyLimits_OtherNamesProgress(t *testing.T) {
+	fastDone := make(chan struct{})
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("FanOut", func(ctx *task.OrchestrationContext) (any, error) {
+		tasks := []task.Task{
+			ctx.CallActivity("Slow"),
+			ctx.CallActivity("Slow"),
+			ctx.CallActivity("Slow"),
+			ctx.CallActivity("Fast"),
+		}
+		for _, t := range tasks {
+			if err := t.Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	r.AddActivityN("Slow", func(ctx task.ActivityContext) (any, error) {
+		// The saturated activity only completes once the activity of the other name ran
+		select {
+		case <-fastDone:
+			return nil, nil
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("the Fast activity didn't run while the Slow activity was saturated")
+		}
+	})
+	r.AddActivityN("Fast", func(ctx task.ActivityContext) (any, error) {
+		close(fastDone)
+		return nil, nil
+	})
+
+	// Initialization, with a single slot for the activities other than the running "Slow" activity, which the other
+	// "Slow" work items would keep taking if they were fetched
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r,
+		backend.WithMaxParallelism(2),
+		backend.WithActivityConcurrencyLimits(map[string]int{"Slow": 1}))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "FanOut")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+}
+
+func Test_ActivityQueues(t *testing.T) {
+	// Registration of the default workers, which route the "Render" activity to the "gpu" queue. They also
+	// register the activity to verify that they don't execute it.
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Pipeline", func(ctx *task.OrchestrationContext) (any, error) {
+		var rendered, logged string
+		if err := ctx.CallActivity("Render").Await(&rendered); err != nil {
+			return nil, err
+		}
+		if err := ctx.CallActivity("Log").Await(&logged); err != nil {
+			return nil, err
+		}
+		return rendered + "," + logged, nil
+	})
+	r.AddActivityN("Render", func(ctx task.ActivityContext) (any, error) {
+		return "cpu", nil
+	})
+	r.AddActivityN("Log", func(ctx task.ActivityContext) (any, error) {
+		return "logged", nil
+	})
+	require.NoError(t, r.RouteActivityN("Render", "gpu"))
+
+	// Registration of the GPU worker
+	gpuRegistry := task.NewTaskRegistry()
+	gpuRegistry.AddActivityN("Render", func(ctx task.ActivityContext) (any, error) {
+		return "gpu", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	gpuWorker := backend.NewActivityTaskWorker(be, task.NewTaskExecutor(gpuRegistry), backend.DefaultLogger(), backend.WithActivityQueues("gpu"))
+	gpuWorker.Start(ctx)
+	defer gpuWorker.StopAndDrain()
+	client := backend.NewTaskHubClient(be)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "Pipeline")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"gpu,logged"`, metadata.SerializedOutput)
+}
+
+func Test_TerminateOrchestration_CancelsActivities(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("LongRunning", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallActivity("Work").Await(nil)
+	})
+	r.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+		close(started)
+		select {
+		case <-ctx.Context().Done():
+			close(canceled)
+			return nil, ctx.Context().Err()
+		case <-time.After(10 * time.Second):
+			return "finished", nil
+		}
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithActivityCancellation(50*time.Millisecond))
+	defer worker.Shutdown(ctx)
+
+	// Terminate the orchestration while its activity is running
+	id, err := client.ScheduleNewOrchestration(ctx, "LongRunning")
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the activity didn't start")
+	}
+	require.NoError(t, client.TerminateOrchestration(ctx, id))
+
+	// The activity is canceled, and its result doesn't change the terminated orchestration
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the activity wasn't canceled")
+	}
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
+	time.Sleep(200 * time.Millisecond)
+	metadata, err = client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_TERMINATED, metadata.RuntimeStatus)
+}
+
+func Test_PurgeCompletedOrchestration(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("ExternalEventOrchestration", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.WaitForSingleEvent("MyEvent", 30*time.Second).Await(nil); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "ExternalEventOrchestration")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if _, err = client.WaitForOrchestrationStart(ctx, id); !assert.NoError(t, err) {
+		return
+	}
+
+	// Try to purge the orchestration state before it completes and verify that it fails with ErrNotCompleted
+	if _, err = client.PurgeOrchestrationState(ctx, id); !assert.ErrorIs(t, err, api.ErrNotCompleted) {
+		return
+	}
+
+	// Raise an event to the orchestration so that it can complete
+	if err = client.RaiseEvent(ctx, id, "MyEvent"); !assert.NoError(t, err) {
+		return
+	}
+	if _, err = client.WaitForOrchestrationCompletion(ctx, id); !assert.NoError(t, err) {
+		return
+	}
+
+	// Try to purge the orchestration state again and verify that it succeeds
+	if result, err := client.PurgeOrchestrationState(ctx, id); !assert.NoError(t, err) {
+		return
+	} else {
+		assert.Equal(t, 1, result.DeletedInstanceCount)
+	}
+
+	// Try to fetch the orchestration metadata and verify that it fails with ErrInstanceNotFound
+	if _, err = client.FetchOrchestrationMetadata(ctx, id); !assert.ErrorIs(t, err, api.ErrInstanceNotFound) {
 		return
 	}
 
-	// Try to purge again and verify that it also fails with ErrInstanceNotFound
-	if err = client.PurgeOrchestrationState(ctx, id); !assert.ErrorIs(t, err, api.ErrInstanceNotFound) {
-		return
+	// Try to purge again and verify that it also fails with ErrInstanceNotFound
+	if _, err = client.PurgeOrchestrationState(ctx, id); !assert.ErrorIs(t, err, api.ErrInstanceNotFound) {
+		return
+	}
+}
+
+func Test_PurgeOrchestrationState_Recursive(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		for i := 0; i < 2; i++ {
+			if err := ctx.CallSubOrchestrator("Child", task.WithSubOrchestrationInstanceID(fmt.Sprintf("%s_child_%d", ctx.ID, i))).Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallSubOrchestrator("Grandchild", task.WithSubOrchestrationInstanceID(string(ctx.ID)+"_grandchild")).Await(nil)
+	})
+	r.AddOrchestratorN("Grandchild", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Parent", api.WithInstanceID("purge_parent"))
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	// The parent, both children, and both grandchildren are purged
+	result, err := client.PurgeOrchestrationState(ctx, id, api.WithRecursivePurge(true))
+	require.NoError(t, err)
+	assert.Equal(t, 5, result.DeletedInstanceCount)
+	for _, descendant := range []api.InstanceID{"purge_parent_child_0", "purge_parent_child_1", "purge_parent_child_0_grandchild", "purge_parent_child_1_grandchild"} {
+		_, err = client.FetchOrchestrationMetadata(ctx, descendant)
+		assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+	}
+}
+
+func Test_PurgeCompletedOrchestrationStates(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Succeed", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+	r.AddOrchestratorN("Fail", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, errors.New("boom")
+	})
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("MyEvent", -1).Await(nil)
+	})
+
+	// Backends that can't purge in bulk fall back to purging the orchestrations one at a time
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			completedIDs := make([]api.InstanceID, 0, 2)
+			for _, name := range []string{"Succeed", "Fail"} {
+				id, err := client.ScheduleNewOrchestration(ctx, name)
+				require.NoError(t, err)
+				_, err = client.WaitForOrchestrationCompletion(ctx, id)
+				require.NoError(t, err)
+				completedIDs = append(completedIDs, id)
+			}
+			runningID, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+			require.NoError(t, err)
+			_, err = client.WaitForOrchestrationStart(ctx, runningID)
+			require.NoError(t, err)
+
+			// Nothing completed before the orchestrations were created
+			result, err := client.PurgeCompletedOrchestrationStates(ctx, time.Now().Add(-time.Hour))
+			require.NoError(t, err)
+			assert.Equal(t, 0, result.DeletedInstanceCount)
+
+			// Only the failed orchestration is purged when filtering by status
+			cutoff := time.Now().Add(time.Second)
+			result, err = client.PurgeCompletedOrchestrationStates(ctx, cutoff, api.WithPurgeRuntimeStatus(protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED))
+			require.NoError(t, err)
+			assert.Equal(t, 1, result.DeletedInstanceCount)
+			_, err = client.FetchOrchestrationMetadata(ctx, completedIDs[1])
+			assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+
+			// The remaining completed orchestration is purged, but the running one is left alone
+			result, err = client.PurgeCompletedOrchestrationStates(ctx, cutoff)
+			require.NoError(t, err)
+			assert.Equal(t, 1, result.DeletedInstanceCount)
+			_, err = client.FetchOrchestrationMetadata(ctx, completedIDs[0])
+			assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+			metadata, err := client.FetchOrchestrationMetadata(ctx, runningID)
+			require.NoError(t, err)
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING, metadata.RuntimeStatus)
+		})
+	}
+}
+
+func Test_PurgeInstancesByFilter(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("import-succeed", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+	r.AddOrchestratorN("import-fail", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, errors.New("boom")
+	})
+	r.AddOrchestratorN("import-wait", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("MyEvent", -1).Await(nil)
+	})
+	r.AddOrchestratorN("export", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Backends that can't purge in batches fall back to purging the orchestrations one at a time
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			ids := make(map[string][]api.InstanceID)
+			for _, name := range []string{"import-succeed", "import-fail", "export", "export", "export"} {
+				id, err := client.ScheduleNewOrchestration(ctx, name)
+				require.NoError(t, err)
+				_, err = client.WaitForOrchestrationCompletion(ctx, id)
+				require.NoError(t, err)
+				ids[name] = append(ids[name], id)
+			}
+			runningID, err := client.ScheduleNewOrchestration(ctx, "import-wait")
+			require.NoError(t, err)
+			_, err = client.WaitForOrchestrationStart(ctx, runningID)
+			require.NoError(t, err)
+
+			// Nothing was created before the orchestrations were scheduled
+			result, err := client.PurgeInstancesByFilter(ctx, api.InstanceQuery{CreatedTo: time.Now().Add(-time.Hour), NamePrefix: "import-"})
+			require.NoError(t, err)
+			assert.Equal(t, 0, result.DeletedInstanceCount)
+
+			// Only the failed orchestration is purged when filtering by status, and running orchestrations are never
+			// purged, even if their status is requested
+			result, err = client.PurgeInstancesByFilter(ctx, api.InstanceQuery{
+				NamePrefix: "import-",
+				RuntimeStatuses: []protos.OrchestrationStatus{
+					protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED,
+					protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING,
+				},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 1, result.DeletedInstanceCount)
+			_, err = client.FetchOrchestrationMetadata(ctx, ids["import-fail"][0])
+			assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+
+			// The remaining completed orchestration with the prefix is purged, but the running one and the ones with
+			// another name are left alone
+			result, err = client.PurgeInstancesByFilter(ctx, api.InstanceQuery{NamePrefix: "import-"})
+			require.NoError(t, err)
+			assert.Equal(t, 1, result.DeletedInstanceCount)
+			_, err = client.FetchOrchestrationMetadata(ctx, ids["import-succeed"][0])
+			assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+			metadata, err := client.FetchOrchestrationMetadata(ctx, runningID)
+			require.NoError(t, err)
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING, metadata.RuntimeStatus)
+
+			// All the matching orchestrations are purged when they span several batches
+			result, err = client.PurgeInstancesByFilter(ctx, api.InstanceQuery{Name: "export", PageSize: 2})
+			require.NoError(t, err)
+			assert.Equal(t, 3, result.DeletedInstanceCount)
+			for _, id := range ids["export"] {
+				_, err = client.FetchOrchestrationMetadata(ctx, id)
+				assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+			}
+		})
+	}
+}
+
+func Test_PurgeInstancesByFilter_Canceled(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("export", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "export")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	// A canceled context stops the purge before the next batch
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	result, err := client.PurgeInstancesByFilter(canceledCtx, api.InstanceQuery{Name: "export"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, result.DeletedInstanceCount)
+	_, err = client.FetchOrchestrationMetadata(ctx, id)
+	assert.NoError(t, err)
+}
+
+func Test_GetOrchestrationStats(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("MaybeFail", func(ctx *task.OrchestrationContext) (any, error) {
+		var fail bool
+		if err := ctx.GetInput(&fail); err != nil {
+			return nil, err
+		}
+		if err := ctx.CreateTimer(10 * time.Millisecond).Await(nil); err != nil {
+			return nil, err
+		}
+		if fail {
+			return nil, errors.New("boom")
+		}
+		return nil, nil
+	})
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("MyEvent", -1).Await(nil)
+	})
+
+	// Backends that can't compute statistics return the metadata that the client computes them from
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			_, err := client.GetOrchestrationStats(ctx, "MaybeFail", 0)
+			require.Error(t, err)
+
+			for _, fail := range []bool{false, false, false, true} {
+				id, err := client.ScheduleNewOrchestration(ctx, "MaybeFail", api.WithInput(fail))
+				require.NoError(t, err)
+				_, err = client.WaitForOrchestrationCompletion(ctx, id)
+				require.NoError(t, err)
+			}
+			id, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+			require.NoError(t, err)
+			_, err = client.WaitForOrchestrationStart(ctx, id)
+			require.NoError(t, err)
+
+			stats, err := client.GetOrchestrationStats(ctx, "MaybeFail", time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, "MaybeFail", stats.Name)
+			assert.Equal(t, 4, stats.Started)
+			assert.Equal(t, 3, stats.Completed)
+			assert.Equal(t, 1, stats.Failed)
+			assert.GreaterOrEqual(t, stats.AverageDuration, 10*time.Millisecond)
+			assert.GreaterOrEqual(t, stats.P95Duration, stats.AverageDuration)
+
+			// Running orchestrations are counted as started, but have no duration yet
+			stats, err = client.GetOrchestrationStats(ctx, "WaitForEvent", time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, 1, stats.Started)
+			assert.Equal(t, 0, stats.Completed)
+			assert.Equal(t, 0, stats.Failed)
+			assert.Zero(t, stats.AverageDuration)
+			assert.Zero(t, stats.P95Duration)
+
+			// Nothing happened within a window that ends before the orchestrations were created
+			time.Sleep(100 * time.Millisecond)
+			stats, err = client.GetOrchestrationStats(ctx, "MaybeFail", 50*time.Millisecond)
+			require.NoError(t, err)
+			assert.Equal(t, 0, stats.Started)
+			assert.Equal(t, 0, stats.Completed+stats.Failed)
+		})
+	}
+}
+
+func Test_FetchOrchestrationHistories(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("SingleActivity", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallActivity("SayHello", task.WithActivityInput("世界")).Await(&output)
+		return output, err
+	})
+	r.AddActivityN("SayHello", func(ctx task.ActivityContext) (any, error) {
+		var name string
+		if err := ctx.GetInput(&name); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("Hello, %s!", name), nil
+	})
+
+	// Backends that can't fetch histories in batches load the runtime state of each orchestration
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			ids := make([]api.InstanceID, 0, 2)
+			for i := 0; i < 2; i++ {
+				id, err := client.ScheduleNewOrchestration(ctx, "SingleActivity")
+				require.NoError(t, err)
+				_, err = client.WaitForOrchestrationCompletion(ctx, id)
+				require.NoError(t, err)
+				ids = append(ids, id)
+			}
+
+			histories, err := client.FetchOrchestrationHistories(ctx, map[api.InstanceID]int{ids[0]: 0, ids[1]: 0})
+			require.NoError(t, err)
+			require.Len(t, histories, 2)
+			fullHistory := histories[ids[0]]
+			require.NotEmpty(t, fullHistory)
+			assert.NotNil(t, fullHistory[0].GetOrchestratorStarted())
+			assert.NotNil(t, fullHistory[len(fullHistory)-1].GetExecutionCompleted())
+			assert.Len(t, histories[ids[1]], len(fullHistory))
+
+			// Incremental fetching only returns the events at or after the requested sequence number, and missing
+			// instances are reported individually without failing the whole batch
+			histories, err = client.FetchOrchestrationHistories(ctx, map[api.InstanceID]int{ids[0]: len(fullHistory) - 1, "does-not-exist": 0})
+			var batchErr *backend.HistoryBatchError
+			require.ErrorAs(t, err, &batchErr)
+			assert.Len(t, batchErr.Errors, 1)
+			assert.ErrorIs(t, batchErr.Errors["does-not-exist"], api.ErrInstanceNotFound)
+			require.Len(t, histories[ids[0]], 1)
+			assert.NotNil(t, histories[ids[0]][0].GetExecutionCompleted())
+			assert.NotContains(t, histories, api.InstanceID("does-not-exist"))
+		})
+	}
+}
+
+func Test_GetOrchestrationHistory(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("SingleActivity", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallActivity("SayHello", task.WithActivityInput("世界")).Await(&output)
+		return output, err
+	})
+	r.AddActivityN("SayHello", func(ctx task.ActivityContext) (any, error) {
+		var name string
+		if err := ctx.GetInput(&name); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("Hello, %s!", name), nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "SingleActivity")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	history, err := client.GetOrchestrationHistory(ctx, id)
+	require.NoError(t, err)
+
+	types := make([]api.HistoryEventType, 0, len(history))
+	for _, e := range history {
+		if e.Type != api.HistoryEventOrchestratorStarted && e.Type != api.HistoryEventOrchestratorCompleted {
+			types = append(types, e.Type)
+		}
+		assert.False(t, e.Timestamp.IsZero())
+	}
+	assert.Equal(t, []api.HistoryEventType{
+		api.HistoryEventExecutionStarted,
+		api.HistoryEventTaskScheduled,
+		api.HistoryEventTaskCompleted,
+		api.HistoryEventExecutionCompleted,
+	}, types)
+
+	for _, e := range history {
+		switch e.Type {
+		case api.HistoryEventExecutionStarted:
+			assert.Equal(t, "SingleActivity", e.Name)
+		case api.HistoryEventTaskScheduled:
+			assert.Equal(t, "SayHello", e.Name)
+			assert.Equal(t, `"世界"`, e.Input)
+			assert.Equal(t, int32(0), e.TaskID)
+		case api.HistoryEventTaskCompleted:
+			assert.Equal(t, `"Hello, 世界!"`, e.Output)
+			assert.Equal(t, int32(0), e.TaskID)
+		case api.HistoryEventExecutionCompleted:
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, e.RuntimeStatus)
+			assert.Equal(t, `"Hello, 世界!"`, e.Output)
+			assert.Nil(t, e.Failure)
+		}
+	}
+
+	_, err = client.GetOrchestrationHistory(ctx, "does-not-exist")
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+}
+
+func Test_MetadataProjection(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Counter", func(ctx *task.OrchestrationContext) (any, error) {
+		var count int
+		if err := ctx.GetInput(&count); err != nil {
+			return nil, err
+		}
+		if count < 2 {
+			ctx.ContinueAsNew(count + 1)
+			return nil, nil
+		}
+		if err := ctx.SetCustomStatus("waiting"); err != nil {
+			return nil, err
+		}
+		if err := ctx.WaitForSingleEvent("Done", -1).Await(nil); err != nil {
+			return nil, err
+		}
+		return count, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	sqliteBackend := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	store := backend.NewInMemoryMetadataStore()
+	be := backend.NewMetadataProjectionBackend(sqliteBackend, store, logger)
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Counter", api.WithInput(0))
+	require.NoError(t, err)
+	projected, err := store.GetOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Counter", projected.Name)
+
+	// Metadata queries are served from the projection, which must match the metadata saved with the history
+	require.Eventually(t, func() bool {
+		m, err := client.FetchOrchestrationMetadata(ctx, id)
+		return err == nil && m.SerializedCustomStatus != ""
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Done"))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	projected, err = store.GetOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, projected, metadata)
+
+	saved, err := sqliteBackend.GetOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, saved.RuntimeStatus, projected.RuntimeStatus)
+	assert.Equal(t, saved.SerializedInput, projected.SerializedInput)
+	assert.Equal(t, saved.SerializedOutput, projected.SerializedOutput)
+	assert.Equal(t, saved.SerializedCustomStatus, projected.SerializedCustomStatus)
+	assert.Equal(t, saved.GenerationCount, projected.GenerationCount)
+	assert.Equal(t, 2, projected.GenerationCount)
+	assert.Equal(t, `"waiting"`, projected.SerializedCustomStatus)
+
+	// Purging removes the projection too
+	_, err = client.PurgeOrchestrationState(ctx, id)
+	require.NoError(t, err)
+	_, err = store.GetOrchestrationMetadata(ctx, id)
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+	_, err = client.FetchOrchestrationMetadata(ctx, id)
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+}
+
+func Test_PayloadOffloading(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Concat", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		var upper string
+		if err := ctx.CallActivity("ToUpper", task.WithActivityInput(input)).Await(&upper); err != nil {
+			return nil, err
+		}
+		var data string
+		if err := ctx.WaitForSingleEvent("Data", -1).Await(&data); err != nil {
+			return nil, err
+		}
+		return upper + data, nil
+	})
+	r.AddActivityN("ToUpper", func(ctx task.ActivityContext) (any, error) {
+		var input string
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		return strings.ToUpper(input), nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	sqliteBackend := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	store := backend.NewInMemoryPayloadStore()
+	be := backend.NewPayloadOffloadingBackend(sqliteBackend, store, 1024, logger)
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// Run the orchestration with payloads on both sides of the threshold
+	input := strings.Repeat("a", 2048)
+	data := strings.Repeat("b", 10)
+	id, err := client.ScheduleNewOrchestration(ctx, "Concat", api.WithInput(input))
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Data", api.WithEventPayload(data)))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"`+strings.Repeat("A", 2048)+data+`"`, metadata.SerializedOutput)
+	assert.Equal(t, `"`+input+`"`, metadata.SerializedInput)
+
+	// Only references to the large payloads are saved in the history
+	saved, err := sqliteBackend.GetOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(saved.SerializedInput, "durabletask+payload://"))
+	assert.Less(t, len(saved.SerializedOutput), 1024)
+	batch, ok := backend.As[backend.BackendWithHistoriesBatch](sqliteBackend)
+	require.True(t, ok)
+	histories, err := batch.GetOrchestrationHistoriesBatch(ctx, map[api.InstanceID]int{id: 0})
+	require.NoError(t, err)
+	for _, e := range histories[id] {
+		if raised := e.GetEventRaised(); raised != nil {
+			assert.Equal(t, `"`+data+`"`, raised.GetInput().GetValue())
+		}
+	}
+	histories, err = client.FetchOrchestrationHistories(ctx, map[api.InstanceID]int{id: 0})
+	require.NoError(t, err)
+	assert.Equal(t, `"`+input+`"`, histories[id][1].GetExecutionStarted().GetInput().GetValue())
+
+	// Purging deletes the payloads
+	key := strings.TrimPrefix(saved.SerializedInput, "durabletask+payload://")
+	_, err = store.GetPayload(ctx, key)
+	require.NoError(t, err)
+	_, err = client.PurgeOrchestrationState(ctx, id)
+	require.NoError(t, err)
+	_, err = store.GetPayload(ctx, key)
+	assert.ErrorIs(t, err, backend.ErrPayloadNotFound)
+}
+
+func Test_ExportImportTaskHub(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Succeed", func(ctx *task.OrchestrationContext) (any, error) {
+		return "ok", nil
+	})
+	r.AddOrchestratorN("WaitThenEcho", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.SetCustomStatus("waiting"); err != nil {
+			return nil, err
+		}
+		var value string
+		err := ctx.WaitForSingleEvent("Go", -1).Await(&value)
+		return value, err
+	})
+
+	// Initialization of the source task hub
+	ctx := context.Background()
+	source, sourceWorker := initBackendAndTaskHubWorker(ctx, r)
+	sourceClient := backend.NewTaskHubClient(source)
+
+	completedID, err := sourceClient.ScheduleNewOrchestration(ctx, "Succeed")
+	require.NoError(t, err)
+	_, err = sourceClient.WaitForOrchestrationCompletion(ctx, completedID)
+	require.NoError(t, err)
+	runningID, err := sourceClient.ScheduleNewOrchestration(ctx, "WaitThenEcho")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		m, err := sourceClient.FetchOrchestrationMetadata(ctx, runningID)
+		return err == nil && m.SerializedCustomStatus != ""
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// The export is done offline, and the event raised after the workers stopped is exported as pending work
+	require.NoError(t, sourceWorker.Shutdown(ctx))
+	require.NoError(t, sourceClient.RaiseEvent(ctx, runningID, "Go", api.WithEventPayload("migrated")))
+
+	var terminal bytes.Buffer
+	require.NoError(t, backend.ExportTaskHub(ctx, source, &terminal, backend.WithExportRuntimeStatus(protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED)))
+	assert.Equal(t, 2, strings.Count(terminal.String(), "\n"), "expected a header and a single instance")
+
+	var export bytes.Buffer
+	require.NoError(t, backend.ExportTaskHub(ctx, source, &export))
+
+	// Backends that can't export their instances are rejected
+	err = backend.ExportTaskHub(ctx, minimalBackend{source}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, backend.ErrMigrationNotSupported)
+
+	// Import into a fresh task hub
+	logger := backend.DefaultLogger()
+	target := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(filepath.Join(t.TempDir(), "taskhub.sqlite3")), logger)
+	require.NoError(t, target.CreateTaskHub(ctx))
+	require.NoError(t, backend.ImportTaskHub(ctx, target, bytes.NewReader(export.Bytes())))
+
+	// Importing the same instances again fails
+	err = backend.ImportTaskHub(ctx, target, bytes.NewReader(export.Bytes()))
+	require.ErrorIs(t, err, backend.ErrDuplicateEvent)
+
+	executor := task.NewTaskExecutor(r)
+	targetWorker := backend.NewTaskHubWorker(target, backend.NewOrchestrationWorker(target, executor, logger), backend.NewActivityTaskWorker(target, executor, logger), logger)
+	require.NoError(t, targetWorker.Start(ctx))
+	defer targetWorker.Shutdown(ctx)
+	targetClient := backend.NewTaskHubClient(target)
+
+	expected, err := sourceClient.FetchOrchestrationMetadata(ctx, completedID)
+	require.NoError(t, err)
+	actual, err := targetClient.FetchOrchestrationMetadata(ctx, completedID)
+	require.NoError(t, err)
+	assert.Equal(t, expected.RuntimeStatus, actual.RuntimeStatus)
+	assert.Equal(t, expected.SerializedOutput, actual.SerializedOutput)
+	assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt))
+
+	// The running orchestration resumes in the target task hub with its pending event
+	metadata, err := targetClient.WaitForOrchestrationCompletion(ctx, runningID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"migrated"`, metadata.SerializedOutput)
+	assert.Equal(t, `"waiting"`, metadata.SerializedCustomStatus)
+}
+
+func Test_ImportTaskHub_UnsupportedVersion(t *testing.T) {
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, task.NewTaskRegistry())
+	defer worker.Shutdown(ctx)
+
+	err := backend.ImportTaskHub(ctx, be, strings.NewReader(`{"format":"durabletask-taskhub-export","version":1000}`))
+	assert.ErrorContains(t, err, "unsupported export version")
+	err = backend.ImportTaskHub(ctx, be, strings.NewReader(`{"format":"something-else","version":1}`))
+	assert.ErrorContains(t, err, "unrecognized export format")
+}
+
+func Test_GetLastActions(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("SingleActivity", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallActivity("SayHello", task.WithActivityInput("世界")).Await(&output)
+		return output, err
+	})
+	r.AddActivityN("SayHello", func(ctx task.ActivityContext) (any, error) {
+		var name string
+		if err := ctx.GetInput(&name); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("Hello, %s!", name), nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r, backend.WithPersistLastActions(true))
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "SingleActivity")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	// The last execution should have produced only the completion action
+	actions, err := client.GetLastActions(ctx, id)
+	require.NoError(t, err)
+	if assert.Len(t, actions, 1) {
+		if complete := actions[0].GetCompleteOrchestration(); assert.NotNil(t, complete) {
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, complete.OrchestrationStatus)
+			assert.Equal(t, `"Hello, 世界!"`, complete.Result.GetValue())
+		}
+	}
+
+	// Non-existent instances should return an error
+	_, err = client.GetLastActions(ctx, api.InstanceID("bogus"))
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+}
+
+func Test_GetLastActions_NotPersistedByDefault(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("EmptyOrchestrator", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "EmptyOrchestrator")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	actions, err := client.GetLastActions(ctx, id)
+	require.NoError(t, err)
+	assert.Empty(t, actions)
+}
+
+func Test_GetLastActions_NotSupported(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("EmptyOrchestrator", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initMinimalTaskHubWorker(ctx, r, backend.WithPersistLastActions(true))
+	defer worker.Shutdown(ctx)
+
+	// Orchestrations still run when the backend can't save their actions
+	id, err := client.ScheduleNewOrchestration(ctx, "EmptyOrchestrator")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	_, err = client.GetLastActions(ctx, id)
+	assert.ErrorIs(t, err, backend.ErrLastActionsNotSupported)
+}
+
+func Test_QueryInstances_NotSupported(t *testing.T) {
+	// The backend only implements the methods of backend.Backend, so the client can't query its instances
+	be := struct{ backend.Backend }{sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), backend.DefaultLogger())}
+	require.NoError(t, be.CreateTaskHub(ctx))
+	client := backend.NewTaskHubClient(be)
+
+	_, err := client.QueryInstances(ctx, api.InstanceQuery{})
+	assert.ErrorIs(t, err, backend.ErrQueriesNotSupported)
+	_, err = client.PurgeCompletedOrchestrationStates(ctx, time.Now())
+	assert.ErrorIs(t, err, backend.ErrQueriesNotSupported)
+	_, err = client.GetOrchestrationStats(ctx, "Orchestrator", time.Hour)
+	assert.ErrorIs(t, err, backend.ErrQueriesNotSupported)
+}
+
+func Test_Reevaluate(t *testing.T) {
+	// The orchestrator is "fixed" at runtime to simulate deploying new orchestrator code
+	var fixed int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Reevaluate", func(ctx *task.OrchestrationContext) (any, error) {
+		if atomic.LoadInt32(&fixed) == 1 {
+			return "fixed", nil
+		}
+		// The buggy version waits for an event that never arrives
+		return nil, ctx.WaitForSingleEvent("NeverRaised", -1).Await(nil)
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Reevaluation must be explicitly enabled on the client
+	client := backend.NewTaskHubClient(be)
+	id, err := client.ScheduleNewOrchestration(ctx, "Reevaluate")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	assert.ErrorIs(t, client.Reevaluate(ctx, id), backend.ErrReevaluationDisabled)
+
+	// Deploy the fix and force the orchestration to re-run over its existing history
+	atomic.StoreInt32(&fixed, 1)
+	client = backend.NewTaskHubClient(be, backend.WithReevaluation(true))
+	require.NoError(t, client.Reevaluate(ctx, id))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"fixed"`, metadata.SerializedOutput)
+}
+
+func Test_InjectFault(t *testing.T) {
+	type result struct {
+		Event         string
+		ActivityError string
+		TimerDelay    time.Duration
+	}
+	var activityExecuted int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Chaos", func(ctx *task.OrchestrationContext) (any, error) {
+		var output result
+		if err := ctx.WaitForSingleEvent("Go", -1).Await(&output.Event); err != nil {
+			return nil, err
+		}
+		if err := ctx.CallActivity("Work").Await(nil); err != nil {
+			output.ActivityError = err.Error()
+		}
+		start := ctx.CurrentTimeUtc
+		if err := ctx.CreateTimer(0).Await(nil); err != nil {
+			return nil, err
+		}
+		output.TimerDelay = ctx.CurrentTimeUtc.Sub(start)
+		return output, nil
+	})
+	r.AddActivityN("Work", func(ctx task.ActivityContext) (any, error) {
+		atomic.StoreInt32(&activityExecuted, 1)
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Fault injection must be explicitly enabled on the client
+	client := backend.NewTaskHubClient(be)
+	id, err := client.ScheduleNewOrchestration(ctx, "Chaos")
+	require.NoError(t, err)
+	assert.ErrorIs(t, client.InjectFault(ctx, id, api.FaultSpec{Type: api.FaultDropNextEvent}), backend.ErrFaultInjectionDisabled)
+
+	client = backend.NewTaskHubClient(be, backend.WithFaultInjection(true))
+	require.Error(t, client.InjectFault(ctx, id, api.FaultSpec{Type: api.FaultDelayNextTimer}))
+	require.NoError(t, client.InjectFault(ctx, id, api.FaultSpec{Type: api.FaultDropNextEvent, EventName: "go"}))
+	require.NoError(t, client.InjectFault(ctx, id, api.FaultSpec{Type: api.FaultFailNextActivity, Message: "chaos!"}))
+	require.NoError(t, client.InjectFault(ctx, id, api.FaultSpec{Type: api.FaultDelayNextTimer, Delay: time.Second}))
+
+	// The first event is dropped, so only the second one is received
+	require.NoError(t, client.RaiseEvent(ctx, id, "Go", api.WithEventPayload("first")))
+	require.NoError(t, client.RaiseEvent(ctx, id, "Go", api.WithEventPayload("second")))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+
+	var output result
+	require.NoError(t, json.Unmarshal([]byte(metadata.SerializedOutput), &output))
+	assert.Equal(t, "second", output.Event)
+	assert.Contains(t, output.ActivityError, "chaos!")
+	assert.GreaterOrEqual(t, output.TimerDelay, time.Second)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&activityExecuted))
+}
+
+func Test_CollisionHandler(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Echo", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	var action backend.CollisionAction
+	var collisions []*api.OrchestrationMetadata
+	client := backend.NewTaskHubClient(be, backend.WithCollisionHandler(func(existing *api.OrchestrationMetadata) (backend.CollisionAction, error) {
+		collisions = append(collisions, existing)
+		return action, nil
+	}))
+
+	// No collision: the handler isn't consulted
+	id, err := client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("first"))
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Empty(t, collisions)
+
+	// Error: the duplicate is reported to the caller
+	action = backend.CollisionActionError
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("second"))
+	assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
+
+	// Use existing: the existing instance is left untouched
+	action = backend.CollisionActionUseExisting
+	id, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("second"))
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceID("abc"), id)
+	metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"first"`, metadata.SerializedOutput)
+
+	// Overwrite: the existing instance is replaced with a new one
+	action = backend.CollisionActionOverwrite
+	id, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("third"))
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"third"`, metadata.SerializedOutput)
+
+	if assert.Len(t, collisions, 3) {
+		assert.Equal(t, api.InstanceID("abc"), collisions[0].InstanceID)
+		assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, collisions[0].RuntimeStatus)
+	}
+}
+
+func Test_InstanceIDReusePolicy(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForever", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Never", -1).Await(nil)
+	})
+	r.AddOrchestratorN("Echo", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	id, err := backend.NewTaskHubClient(be).ScheduleNewOrchestration(ctx, "WaitForever", api.WithInstanceID("abc"))
+	require.NoError(t, err)
+	_, err = backend.NewTaskHubClient(be).WaitForOrchestrationStart(timeoutCtx, id)
+	require.NoError(t, err)
+
+	// Ignore: the running instance is left untouched
+	client := backend.NewTaskHubClient(be, backend.WithInstanceIDReusePolicy(backend.CollisionActionUseExisting))
+	id, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("ignored"))
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceID("abc"), id)
+	metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "WaitForever", metadata.Name)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING, metadata.RuntimeStatus)
+
+	// Overwrite: running instances can't be overwritten
+	client = backend.NewTaskHubClient(be, backend.WithInstanceIDReusePolicy(backend.CollisionActionOverwrite))
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("overwritten"))
+	assert.ErrorIs(t, err, api.ErrNotCompleted)
+
+	// Terminate and replace: the running instance is terminated and replaced with a new one
+	client = backend.NewTaskHubClient(be, backend.WithInstanceIDReusePolicy(backend.CollisionActionTerminateAndReplace))
+	id, err = client.ScheduleNewOrchestration(timeoutCtx, "Echo", api.WithInstanceID("abc"), api.WithInput("replaced"))
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Echo", metadata.Name)
+	assert.Equal(t, `"replaced"`, metadata.SerializedOutput)
+
+	// Completed instances are replaced without being terminated
+	id, err = client.ScheduleNewOrchestration(timeoutCtx, "Echo", api.WithInstanceID("abc"), api.WithInput("replaced again"))
+	require.NoError(t, err)
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"replaced again"`, metadata.SerializedOutput)
+
+	// Error: the duplicate is reported to the caller
+	client = backend.NewTaskHubClient(be, backend.WithInstanceIDReusePolicy(backend.CollisionActionError))
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"))
+	assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
+}
+
+func Test_InstanceIDReusePolicy_PerRequest(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Echo", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	client := backend.NewTaskHubClient(be, backend.WithInstanceIDReusePolicy(backend.CollisionActionUseExisting))
+	id, err := client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("first"))
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+
+	// The policy of the request takes precedence over the policy of the client
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInstanceIDReusePolicy(api.InstanceIDReuseError))
+	assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("second"), api.WithInstanceIDReusePolicy(api.InstanceIDReuseOverwrite))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"second"`, metadata.SerializedOutput)
+
+	// The policy of the client still applies to other requests
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInput("ignored"))
+	require.NoError(t, err)
+	metadata, err = client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"second"`, metadata.SerializedOutput)
+
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceIDReusePolicy(api.InstanceIDReuseAction(42)))
+	assert.Error(t, err)
+}
+
+func Test_InstanceIDReusePolicy_ReplaceTimeout(t *testing.T) {
+	// Initialization, without a worker that could process the termination
+	ctx := context.Background()
+	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), backend.DefaultLogger())
+	require.NoError(t, be.CreateTaskHub(ctx))
+	client := backend.NewTaskHubClient(be, backend.WithReplaceTimeout(100*time.Millisecond))
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"))
+	require.NoError(t, err)
+
+	// The wait for the termination is bounded, and the existing instance is left in place
+	start := time.Now()
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID("abc"), api.WithInstanceIDReusePolicy(api.InstanceIDReuseTerminateAndReplace))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	_, err = client.FetchOrchestrationMetadata(ctx, id)
+	assert.NoError(t, err)
+}
+
+func Test_IdempotencyKey(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Echo", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey("order-42"), api.WithInput("first"))
+	require.NoError(t, err)
+	assert.Equal(t, api.IdempotentInstanceID("order-42"), id)
+
+	// Retries return the existing instance instead of creating a duplicate
+	retryID, err := client.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey("order-42"), api.WithInput("retry"))
+	require.NoError(t, err)
+	assert.Equal(t, id, retryID)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"first"`, metadata.SerializedOutput)
+	assert.Equal(t, "order-42", metadata.IdempotencyKey())
+
+	// Reusing the key for another orchestration is a collision
+	_, err = client.ScheduleNewOrchestration(ctx, "Other", api.WithIdempotencyKey("order-42"))
+	assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
+
+	// Explicit instance IDs take precedence over idempotency keys
+	id, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey("order-43"), api.WithInstanceID("explicit"))
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceID("explicit"), id)
+
+	// Instance IDs that look like they were derived from an idempotency key aren't treated as retries, and neither
+	// are requests with a key that collide with an orchestration that was scheduled without it
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID(api.IdempotentInstanceID("order-42")))
+	assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
+	plainID, err := client.ScheduleNewOrchestration(ctx, "Echo")
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithInstanceID(plainID), api.WithIdempotencyKey("order-44"))
+	assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
+
+	// The key can be reused once the orchestration is purged
+	_, err = client.PurgeOrchestrationState(ctx, retryID)
+	require.NoError(t, err)
+	newID, err := client.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey("order-42"), api.WithInput("second"))
+	require.NoError(t, err)
+	assert.Equal(t, retryID, newID)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, newID)
+	require.NoError(t, err)
+	assert.Equal(t, `"second"`, metadata.SerializedOutput)
+
+	_, err = client.ScheduleNewOrchestration(ctx, "Echo", api.WithIdempotencyKey(""))
+	assert.Error(t, err)
+}
+
+func Test_CollisionHandler_HandlerError(t *testing.T) {
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, task.NewTaskRegistry())
+	defer worker.Shutdown(ctx)
+
+	handlerErr := errors.New("instance IDs must be unique")
+	client := backend.NewTaskHubClient(be, backend.WithCollisionHandler(func(*api.OrchestrationMetadata) (backend.CollisionAction, error) {
+		return backend.CollisionActionUseExisting, handlerErr
+	}))
+
+	_, err := client.ScheduleNewOrchestration(ctx, "Unregistered", api.WithInstanceID("abc"))
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "Unregistered", api.WithInstanceID("abc"))
+	assert.ErrorIs(t, err, handlerErr)
+}
+
+func Test_OnScheduleError(t *testing.T) {
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, task.NewTaskRegistry())
+	defer worker.Shutdown(ctx)
+
+	var failedRequests []*protos.CreateInstanceRequest
+	var reportedErrs []error
+	client := backend.NewTaskHubClient(be, backend.WithOnScheduleError(func(req *protos.CreateInstanceRequest, err error) {
+		failedRequests = append(failedRequests, req)
+		reportedErrs = append(reportedErrs, err)
+	}))
+
+	// Successfully scheduled orchestrations aren't reported
+	_, err := client.ScheduleNewOrchestration(ctx, "Unregistered", api.WithInstanceID("abc"))
+	require.NoError(t, err)
+	assert.Empty(t, failedRequests)
+
+	// The callback fires in addition to the error being returned
+	_, err = client.ScheduleNewOrchestration(ctx, "Unregistered", api.WithInstanceID("abc"))
+	require.ErrorIs(t, err, backend.ErrDuplicateEvent)
+	if assert.Len(t, failedRequests, 1) {
+		assert.Equal(t, "abc", failedRequests[0].InstanceId)
+		assert.Equal(t, "Unregistered", failedRequests[0].Name)
+		assert.Equal(t, err, reportedErrs[0])
+	}
+
+	// Invalid options are reported too
+	_, err = client.ScheduleNewOrchestration(ctx, "Unregistered", api.WithInput(make(chan int)))
+	require.Error(t, err)
+	if assert.Len(t, reportedErrs, 2) {
+		assert.Equal(t, err, reportedErrs[1])
+	}
+}
+
+func Test_NamespaceQuota(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Done", -1).Await(nil)
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be, backend.WithNamespaceQuota("tenant", map[string]int{"contoso": 2, "fabrikam": 0}))
+	inNamespace := func(namespace string) api.NewOrchestrationOptions {
+		return api.WithTags(map[string]string{"tenant": namespace})
+	}
+
+	// The namespace is full once it has as many running orchestrations as its quota
+	first, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent", inNamespace("contoso"))
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent", inNamespace("contoso"))
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent", inNamespace("contoso"))
+	assert.ErrorIs(t, err, backend.ErrQuotaExceeded)
+	_, err = client.ScheduleNewOrchestrations(ctx, []backend.NewOrchestrationRequest{
+		{Orchestrator: "WaitForEvent", Options: []api.NewOrchestrationOptions{inNamespace("contoso")}},
+		{Orchestrator: "WaitForEvent", Options: []api.NewOrchestrationOptions{inNamespace("other")}},
+	})
+	var batchErr *backend.ScheduleBatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Errors, 1)
+	assert.ErrorIs(t, batchErr.Errors[0], backend.ErrQuotaExceeded)
+
+	// Other namespaces and untagged orchestrations aren't limited, unless their quota is zero
+	_, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent", inNamespace("fabrikam"))
+	assert.ErrorIs(t, err, backend.ErrQuotaExceeded)
+	_, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent", inNamespace("other"))
+	assert.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+	assert.NoError(t, err)
+
+	// Completed orchestrations no longer count against the quota
+	require.NoError(t, client.RaiseEvent(ctx, first, "Done"))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, first)
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "WaitForEvent", inNamespace("contoso"))
+	assert.NoError(t, err)
+}
+
+func Test_KnownOrchestrations(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Known", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	var reportedErr error
+	client := backend.NewTaskHubClient(be,
+		backend.WithKnownOrchestrationNames(r.OrchestratorNames()...),
+		backend.WithOnScheduleError(func(_ *protos.CreateInstanceRequest, err error) {
+			reportedErr = err
+		}))
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Known")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+
+	// Unknown orchestrations are rejected without creating an instance
+	_, err = client.ScheduleNewOrchestration(ctx, "Unknown", api.WithInstanceID("unknown"))
+	require.ErrorIs(t, err, api.ErrUnknownOrchestration)
+	assert.Equal(t, err, reportedErr)
+	_, err = client.FetchOrchestrationMetadata(ctx, "unknown")
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+
+	// A wildcard matches all orchestrations
+	client = backend.NewTaskHubClient(be, backend.WithKnownOrchestrationNames("*"))
+	_, err = client.ScheduleNewOrchestration(ctx, "Unknown")
+	assert.NoError(t, err)
+}
+
+func Test_ExecutorRegisteredOrchestrations(t *testing.T) {
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, task.NewTaskRegistry())
+	defer worker.Shutdown(ctx)
+
+	executor := &capabilitiesExecutor{}
+	client := backend.NewTaskHubClient(be, backend.WithKnownOrchestrations(backend.ExecutorRegisteredOrchestrations(executor)))
+
+	// Names aren't validated while no executor is connected
+	_, err := client.ScheduleNewOrchestration(ctx, "Unknown")
+	require.NoError(t, err)
+
+	// Once an executor advertises its orchestrations, other orchestrations are rejected
+	executor.capabilities = &backend.ExecutorCapabilities{ProtocolVersion: 1, Negotiated: true, Orchestrators: []string{"Known"}}
+	_, err = client.ScheduleNewOrchestration(ctx, "Unknown")
+	require.ErrorIs(t, err, api.ErrUnknownOrchestration)
+	_, err = client.ScheduleNewOrchestration(ctx, "Known")
+	require.NoError(t, err)
+}
+
+func Test_ExecutorCapabilities_FetchSupportedWorkItems(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Supported", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallActivity("SupportedActivity").Await(nil)
+	})
+	r.AddOrchestratorN("Unsupported", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallActivity("UnsupportedActivity").Await(nil)
+	})
+	r.AddActivityN("SupportedActivity", func(ctx task.ActivityContext) (any, error) {
+		return nil, nil
+	})
+	r.AddActivityN("UnsupportedActivity", func(ctx task.ActivityContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization of a worker whose executor only advertises some of the orchestrations and activities
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	executor := &capabilitiesExecutor{
+		Executor: task.NewTaskExecutor(r),
+		capabilities: &backend.ExecutorCapabilities{
+			ProtocolVersion: 1,
+			Negotiated:      true,
+			Orchestrators:   []string{"Supported"},
+			Activities:      []string{"SupportedActivity"},
+		},
+	}
+	worker := backend.NewTaskHubWorker(be,
+		backend.NewOrchestrationWorker(be, executor, logger),
+		backend.NewActivityTaskWorker(be, executor, logger),
+		logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// The supported orchestration completes, while the unsupported one isn't fetched
+	unsupportedID, err := client.ScheduleNewOrchestration(ctx, "Unsupported")
+	require.NoError(t, err)
+	supportedID, err := client.ScheduleNewOrchestration(ctx, "Supported")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, supportedID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	metadata, err = client.FetchOrchestrationMetadata(ctx, unsupportedID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING, metadata.RuntimeStatus)
+
+	// A worker that supports everything completes the unsupported orchestration and activity right away, since the
+	// first worker didn't lock their work items
+	otherExecutor := task.NewTaskExecutor(r)
+	otherOrchestrationWorker := backend.NewOrchestrationWorker(be, otherExecutor, logger)
+	otherOrchestrationWorker.Start(ctx)
+	defer otherOrchestrationWorker.StopAndDrain()
+	otherActivityWorker := backend.NewActivityTaskWorker(be, otherExecutor, logger)
+	otherActivityWorker.Start(ctx)
+	defer otherActivityWorker.StopAndDrain()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, unsupportedID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+}
+
+// capabilitiesExecutor is an executor that reports fixed capabilities for its connected executor.
+type capabilitiesExecutor struct {
+	backend.Executor
+	capabilities *backend.ExecutorCapabilities
+}
+
+func (e *capabilitiesExecutor) Capabilities() *backend.ExecutorCapabilities {
+	return e.capabilities
+}
+
+func Test_FindOrphanedSubOrchestrations(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("FireAndForget", func(ctx *task.OrchestrationContext) (any, error) {
+		ctx.CallSubOrchestrator("Child", task.WithSubOrchestrationInstanceID(string(ctx.ID)+"_child"))
+		return nil, nil
+	})
+	r.AddOrchestratorN("AwaitChild", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallSubOrchestrator("Child", task.WithSubOrchestrationInstanceID(string(ctx.ID)+"_child")).Await(nil)
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Done", -1).Await(nil)
+	})
+
+	// Backends that can't query the parent links load the history of each orchestration to find its parent
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			orphans, err := client.FindOrphanedSubOrchestrations(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, orphans)
+
+			fireAndForgetID, err := client.ScheduleNewOrchestration(ctx, "FireAndForget")
+			require.NoError(t, err)
+			awaitChildID, err := client.ScheduleNewOrchestration(ctx, "AwaitChild")
+			require.NoError(t, err)
+			for _, id := range []api.InstanceID{fireAndForgetID, awaitChildID} {
+				_, err = client.WaitForOrchestrationStart(ctx, id+"_child")
+				require.NoError(t, err)
+			}
+
+			// Only the child of the completed parent is orphaned
+			orphans, err = client.FindOrphanedSubOrchestrations(ctx)
+			require.NoError(t, err)
+			if assert.Len(t, orphans, 1) {
+				assert.Equal(t, fireAndForgetID+"_child", orphans[0].InstanceID)
+				assert.Equal(t, "Child", orphans[0].Name)
+			}
+
+			// Terminating a parent without its children orphans them too
+			require.NoError(t, client.TerminateOrchestration(ctx, awaitChildID, api.WithRecursive(false)))
+			_, err = client.WaitForOrchestrationCompletion(ctx, awaitChildID)
+			require.NoError(t, err)
+			orphans, err = client.FindOrphanedSubOrchestrations(ctx)
+			require.NoError(t, err)
+			assert.Len(t, orphans, 2)
+
+			// Orphans are no longer reported once they're terminated
+			for _, orphan := range orphans {
+				require.NoError(t, client.TerminateOrchestration(ctx, orphan.InstanceID))
+				_, err = client.WaitForOrchestrationCompletion(ctx, orphan.InstanceID)
+				require.NoError(t, err)
+			}
+			orphans, err = client.FindOrphanedSubOrchestrations(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, orphans)
+		})
+	}
+}
+
+func Test_RetrySubOrchestration(t *testing.T) {
+	var attempt int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallSubOrchestrator("Child").Await(&output)
+		return output, err
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.WaitForSingleEvent("Go", 5*time.Second).Await(nil); err != nil {
+			return nil, err
+		}
+		if atomic.AddInt32(&attempt, 1) == 1 {
+			return nil, errors.New("transient failure")
+		}
+		return "ok", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the parent and wait for the child to start
+	parentID, err := client.ScheduleNewOrchestration(ctx, "Parent", api.WithInstanceID("parent"))
+	require.NoError(t, err)
+	childID := api.InstanceID("parent:0000")
+	require.Eventually(t, func() bool {
+		_, err := client.FetchOrchestrationMetadata(ctx, childID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	_, err = client.WaitForOrchestrationStart(ctx, childID)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, client.RetrySubOrchestration(ctx, parentID, 42), backend.ErrSubOrchestrationNotFound)
+	assert.ErrorIs(t, client.RetrySubOrchestration(ctx, parentID, 0), backend.ErrSubOrchestrationNotFailed)
+
+	// Suspend the parent so that it keeps waiting on the child when the child fails
+	require.NoError(t, client.SuspendOrchestration(ctx, parentID, ""))
+	require.Eventually(t, func() bool {
+		metadata, err := client.FetchOrchestrationMetadata(ctx, parentID)
+		return err == nil && metadata.RuntimeStatus == protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED
+	}, 5*time.Second, 100*time.Millisecond)
+	require.NoError(t, client.RaiseEvent(ctx, childID, "Go"))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, childID)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+
+	// Retry just the child, then let both the child and the parent complete
+	require.NoError(t, client.RetrySubOrchestration(ctx, parentID, 0))
+	_, err = client.WaitForOrchestrationStart(ctx, childID)
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, childID, "Go"))
+	require.NoError(t, client.ResumeOrchestration(ctx, parentID, ""))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, parentID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"ok"`, metadata.SerializedOutput)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempt))
+}
+
+func Test_RetrySubOrchestration_FailureObserved(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.CallSubOrchestrator("Child").Await(nil); err == nil {
+			return nil, nil
+		}
+		// The failure is handled by waiting for a compensation signal
+		return nil, ctx.WaitForSingleEvent("Compensated", -1).Await(nil)
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, errors.New("failure")
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	parentID, err := client.ScheduleNewOrchestration(ctx, "Parent", api.WithInstanceID("parent"))
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, "parent:0000")
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+
+	// Wait until the parent processed the failure, after which the child can no longer be retried
+	require.Eventually(t, func() bool {
+		history, err := client.GetOrchestrationHistory(ctx, parentID)
+		if err != nil {
+			return false
+		}
+		for _, e := range history {
+			if e.Type == api.HistoryEventSubOrchestrationInstanceFailed {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.ErrorIs(t, client.RetrySubOrchestration(ctx, parentID, 0), backend.ErrSubOrchestrationFailureObserved)
+	metadata, err = client.FetchOrchestrationMetadata(ctx, "parent:0000")
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+}
+
+// failingCreateBackend fails to create orchestration instances while fail is set, which simulates a backend that fails
+// between the steps of a multi-step operation.
+type failingCreateBackend struct {
+	backend.BackendWithMigration
+	fail bool
+}
+
+func (be *failingCreateBackend) CreateOrchestrationInstance(ctx context.Context, e *backend.HistoryEvent) error {
+	if be.fail {
+		return errors.New("create failed")
+	}
+	return be.BackendWithMigration.CreateOrchestrationInstance(ctx, e)
+}
+
+func Test_RetrySubOrchestration_RestoresOnFailure(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallSubOrchestrator("Child").Await(nil)
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.WaitForSingleEvent("Go", 5*time.Second).Await(nil); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("failure")
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	failing := &failingCreateBackend{BackendWithMigration: be.(backend.BackendWithMigration)}
+	client := backend.NewTaskHubClient(failing)
+
+	// Fail the child while the parent is suspended, so that it can be retried
+	parentID, err := client.ScheduleNewOrchestration(ctx, "Parent", api.WithInstanceID("parent"))
+	require.NoError(t, err)
+	childID := api.InstanceID("parent:0000")
+	require.Eventually(t, func() bool {
+		_, err := client.FetchOrchestrationMetadata(ctx, childID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	_, err = client.WaitForOrchestrationStart(ctx, childID)
+	require.NoError(t, err)
+	require.NoError(t, client.SuspendOrchestration(ctx, parentID, ""))
+	require.Eventually(t, func() bool {
+		metadata, err := client.FetchOrchestrationMetadata(ctx, parentID)
+		return err == nil && metadata.RuntimeStatus == protos.OrchestrationStatus_ORCHESTRATION_STATUS_SUSPENDED
+	}, 5*time.Second, 100*time.Millisecond)
+	require.NoError(t, client.RaiseEvent(ctx, childID, "Go"))
+	_, err = client.WaitForOrchestrationCompletion(ctx, childID)
+	require.NoError(t, err)
+
+	// The child is restored when it can't be scheduled again after the purge
+	failing.fail = true
+	assert.Error(t, client.RetrySubOrchestration(ctx, parentID, 0))
+	metadata, err := client.FetchOrchestrationMetadata(ctx, childID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+
+	// The parent still observes the original failure
+	require.NoError(t, client.ResumeOrchestration(ctx, parentID, ""))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, parentID)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+}
+
+func Test_RewindOrchestration_Activity(t *testing.T) {
+	var attempts int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Sequence", func(ctx *task.OrchestrationContext) (any, error) {
+		var sum int
+		for i := 1; i <= 3; i++ {
+			var result int
+			if err := ctx.CallActivity("Double", task.WithActivityInput(i)).Await(&result); err != nil {
+				return nil, err
+			}
+			sum += result
+		}
+		return sum, nil
+	})
+	r.AddActivityN("Double", func(ctx task.ActivityContext) (any, error) {
+		var input int
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		if input == 2 && atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("transient failure")
+		}
+		return input * 2, nil
+	})
+	r.AddOrchestratorN("Fail", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, errors.New("boom")
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Sequence")
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+
+	// The orchestration resumes from the failed activity instead of starting over
+	require.NoError(t, client.RewindOrchestration(ctx, id, "fixed the outage"))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, "12", metadata.SerializedOutput)
+	assert.Nil(t, metadata.FailureDetails)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+
+	// Only failed orchestrations with a failed task can be rewound
+	assert.ErrorIs(t, client.RewindOrchestration(ctx, id, ""), backend.ErrOrchestrationNotFailed)
+	failID, err := client.ScheduleNewOrchestration(ctx, "Fail")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationCompletion(ctx, failID)
+	require.NoError(t, err)
+	assert.ErrorIs(t, client.RewindOrchestration(ctx, failID, ""), backend.ErrNothingToRewind)
+	assert.ErrorIs(t, client.RewindOrchestration(ctx, "bogus", ""), api.ErrInstanceNotFound)
+}
+
+func Test_RewindOrchestration_SubOrchestration(t *testing.T) {
+	var attempts int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallSubOrchestrator("Child", task.WithSubOrchestrationInstanceID("rewind-child")).Await(&output)
+		return output, err
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("transient failure")
+		}
+		return "ok", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Parent")
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+
+	// The sub-orchestration is scheduled again with the same instance ID, and the parent waits for it
+	require.NoError(t, client.RewindOrchestration(ctx, id, ""))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"ok"`, metadata.SerializedOutput)
+	child, err := client.FetchOrchestrationMetadata(ctx, "rewind-child")
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, child.RuntimeStatus)
+}
+
+func Test_RestartOrchestration(t *testing.T) {
+	var runs int32
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Greet", func(ctx *task.OrchestrationContext) (any, error) {
+		var name string
+		if err := ctx.GetInput(&name); err != nil {
+			return nil, err
+		}
+		if !ctx.IsReplaying && atomic.AddInt32(&runs, 1) == 1 {
+			return nil, errors.New("transient failure")
+		}
+		return "Hello, " + name + "!", nil
+	})
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Done", -1).Await(nil)
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Greet", api.WithInput("世界"))
+	require.NoError(t, err)
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+
+	// Restarting with the same instance ID replaces the failed orchestration
+	restartedID, err := client.RestartOrchestration(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, id, restartedID)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"Hello, 世界!"`, metadata.SerializedOutput)
+
+	// Restarting with a new instance ID keeps the original orchestration
+	restartedID, err = client.RestartOrchestration(ctx, id, api.WithRestartNewInstanceID(true))
+	require.NoError(t, err)
+	assert.NotEqual(t, id, restartedID)
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, restartedID)
+	require.NoError(t, err)
+	assert.Equal(t, `"Hello, 世界!"`, metadata.SerializedOutput)
+	_, err = client.FetchOrchestrationMetadata(ctx, id)
+	assert.NoError(t, err)
+
+	// Running orchestrations can only be restarted with a new instance ID
+	runningID, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, runningID)
+	require.NoError(t, err)
+	_, err = client.RestartOrchestration(ctx, runningID)
+	assert.ErrorIs(t, err, api.ErrNotCompleted)
+	_, err = client.RestartOrchestration(ctx, "bogus")
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+}
+
+func Test_WaitForOrchestration_PollingBackoff(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.WaitForSingleEvent("Done", -1).Await(nil)
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id, api.WithPollingBackoff(10*time.Millisecond, 50*time.Millisecond, 2))
+	require.NoError(t, err)
+
+	// Context cancellation must win even when the next poll is far away
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, id, api.WithPollingBackoff(time.Hour, time.Hour, 1))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	require.NoError(t, client.RaiseEvent(ctx, id, "Done"))
+	metadata, err := client.WaitForOrchestrationCompletion(ctx, id, api.WithPollingBackoff(10*time.Millisecond, 50*time.Millisecond, 2), api.WithPollingJitter(0.5))
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+}
+
+func Test_WaitForOrchestration_PollingJitter(t *testing.T) {
+	// Initialization, without a worker, so that the orchestration never completes
+	ctx := context.Background()
+	be := &pollRecordingBackend{Backend: sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), backend.DefaultLogger())}
+	require.NoError(t, be.CreateTaskHub(ctx))
+	client := backend.NewTaskHubClient(be)
+	id, err := client.ScheduleNewOrchestration(ctx, "Pending")
+	require.NoError(t, err)
+
+	const interval = 50 * time.Millisecond
+	const polls = 15
+	intervals := func(jitter float64) []time.Duration {
+		be.polls = nil
+		timeoutCtx, cancel := context.WithTimeout(ctx, polls*interval*3/2)
+		defer cancel()
+		start := time.Now()
+		_, err := client.WaitForOrchestrationCompletion(timeoutCtx, id, api.WithPollingBackoff(interval, interval, 1), api.WithPollingJitter(jitter))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.GreaterOrEqual(t, len(be.polls), 5)
+
+		result := make([]time.Duration, 0, len(be.polls))
+		for _, poll := range be.polls {
+			result = append(result, poll.Sub(start))
+			start = poll
+		}
+		return result
+	}
+
+	// Without jitter, the polls are never early
+	for _, d := range intervals(0) {
+		assert.GreaterOrEqual(t, d, interval)
+	}
+
+	// With a jitter of 0.5, the intervals are between 50% and 150% of the configured interval, and not all the same.
+	// The upper bound allows for scheduling delays.
+	jittered := intervals(0.5)
+	early := 0
+	for _, d := range jittered {
+		assert.GreaterOrEqual(t, d, interval/2)
+		assert.Less(t, d, interval*3/2+50*time.Millisecond)
+		if d < interval*9/10 {
+			early++
+		}
+	}
+	assert.Greater(t, early, 0, "no poll was early: %v", jittered)
+}
+
+// pollRecordingBackend records the times at which the metadata of orchestrations is fetched.
+type pollRecordingBackend struct {
+	backend.Backend
+	polls []time.Time
+}
+
+func (be *pollRecordingBackend) GetOrchestrationMetadata(ctx context.Context, id api.InstanceID) (*api.OrchestrationMetadata, error) {
+	be.polls = append(be.polls, time.Now())
+	return be.Backend.GetOrchestrationMetadata(ctx, id)
+}
+
+func Test_StreamOrchestrationMetadata(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Stages", func(ctx *task.OrchestrationContext) (any, error) {
+		for _, stage := range []string{"one", "two"} {
+			if err := ctx.SetCustomStatus(stage); err != nil {
+				return nil, err
+			}
+			if err := ctx.WaitForSingleEvent("Next", -1).Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return "done", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	_, err := client.StreamOrchestrationMetadata(ctx, api.InstanceID("does-not-exist"))
+	require.ErrorIs(t, err, api.ErrInstanceNotFound)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "Stages")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	updates, err := client.StreamOrchestrationMetadata(timeoutCtx, id, api.WithPollingBackoff(10*time.Millisecond, 50*time.Millisecond, 1))
+	require.NoError(t, err)
+
+	var snapshots []*api.OrchestrationMetadata
+	for metadata := range updates {
+		snapshots = append(snapshots, metadata)
+		if !metadata.IsComplete() {
+			// Advance the orchestration only after each change was observed
+			require.NoError(t, client.RaiseEvent(ctx, id, "Next"))
+		}
+	}
+	require.NoError(t, timeoutCtx.Err())
+	require.NotEmpty(t, snapshots)
+	for i := 1; i < len(snapshots); i++ {
+		prev, curr := snapshots[i-1], snapshots[i]
+		assert.False(t, prev.RuntimeStatus == curr.RuntimeStatus && prev.SerializedCustomStatus == curr.SerializedCustomStatus, "duplicate snapshot at index %d", i)
+	}
+	last := snapshots[len(snapshots)-1]
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, last.RuntimeStatus)
+	assert.Equal(t, `"done"`, last.SerializedOutput)
+}
+
+func Test_StreamOrchestrationMetadata_SlowConsumer(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForEvent", func(ctx *task.OrchestrationContext) (any, error) {
+		if err := ctx.SetCustomStatus("waiting"); err != nil {
+			return nil, err
+		}
+		return nil, ctx.WaitForSingleEvent("Done", -1).Await(nil)
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	id, err := client.ScheduleNewOrchestration(ctx, "WaitForEvent")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	updates, err := client.StreamOrchestrationMetadata(timeoutCtx, id, api.WithPollingBackoff(10*time.Millisecond, 50*time.Millisecond, 1))
+	require.NoError(t, err)
+
+	// Don't read anything until the orchestration has completed; stale snapshots must be replaced, not queued
+	require.NoError(t, client.RaiseEvent(ctx, id, "Done"))
+	_, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+
+	var snapshots []*api.OrchestrationMetadata
+	for metadata := range updates {
+		snapshots = append(snapshots, metadata)
+	}
+	require.NoError(t, timeoutCtx.Err())
+	if assert.Len(t, snapshots, 1) {
+		assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, snapshots[0].RuntimeStatus)
+	}
+}
+
+func Test_IngestStream(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("WaitForGo", func(ctx *task.OrchestrationContext) (any, error) {
+		var value int
+		if err := ctx.WaitForSingleEvent("Go", -1).Await(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	stream, err := client.NewIngestStream(ctx, backend.WithIngestWindowSize(4))
+	require.NoError(t, err)
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		id := api.InstanceID(fmt.Sprintf("ingest-%d", i))
+		require.NoError(t, stream.Send(backend.IngestCreateOrchestration("WaitForGo", api.WithInstanceID(id))))
+		require.NoError(t, stream.Send(backend.IngestRaiseEvent(id, "Go", api.WithEventPayload(i))))
+	}
+	require.NoError(t, stream.Send(backend.IngestCreateOrchestration("WaitForGo", api.WithInstanceID("ingest-0"))))
+
+	results, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Len(t, results, 2*count+1)
+	for i, result := range results[:2*count] {
+		assert.NoError(t, result.Err)
+		assert.Equal(t, api.InstanceID(fmt.Sprintf("ingest-%d", i/2)), result.InstanceID)
+	}
+	assert.ErrorIs(t, results[2*count].Err, backend.ErrDuplicateEvent)
+
+	// Sending after closing fails
+	assert.ErrorIs(t, stream.Send(backend.IngestRaiseEvent("ingest-0", "Go")), backend.ErrIngestStreamClosed)
+
+	for i := 0; i < count; i++ {
+		metadata, err := client.WaitForOrchestrationCompletion(ctx, api.InstanceID(fmt.Sprintf("ingest-%d", i)))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), metadata.SerializedOutput)
+	}
+}
+
+func Test_ScheduleNewOrchestrations(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Double", func(ctx *task.OrchestrationContext) (any, error) {
+		var value int
+		if err := ctx.GetInput(&value); err != nil {
+			return nil, err
+		}
+		return 2 * value, nil
+	})
+
+	// Orchestrations are scheduled one at a time for backends that can't ingest batches
+	for name, initTaskHubWorker := range taskHubInitializers {
+		t.Run(name, func(t *testing.T) {
+			// Initialization
+			ctx := context.Background()
+			client, worker := initTaskHubWorker(ctx, r)
+			defer worker.Shutdown(ctx)
+
+			const count = 20
+			reqs := make([]backend.NewOrchestrationRequest, 0, count)
+			for i := 0; i < count; i++ {
+				reqs = append(reqs, backend.NewOrchestrationRequest{Orchestrator: "Double", Options: []api.NewOrchestrationOptions{api.WithInput(i)}})
+			}
+			ids, err := client.ScheduleNewOrchestrations(ctx, reqs)
+			require.NoError(t, err)
+			require.Len(t, ids, count)
+			for i, id := range ids {
+				metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, fmt.Sprint(2*i), metadata.SerializedOutput)
+			}
+
+			// Orchestrations that can't be scheduled don't prevent the others from being scheduled
+			ids, err = client.ScheduleNewOrchestrations(ctx, []backend.NewOrchestrationRequest{
+				{Orchestrator: "Double", Options: []api.NewOrchestrationOptions{api.WithInstanceID(ids[0])}},
+				{Orchestrator: "Double", Options: []api.NewOrchestrationOptions{api.WithInstanceID("batch-new"), api.WithInput(21)}},
+				{Orchestrator: "Double", Options: []api.NewOrchestrationOptions{api.WithInput(make(chan int))}},
+			})
+			var batchErr *backend.ScheduleBatchError
+			require.ErrorAs(t, err, &batchErr)
+			assert.Len(t, batchErr.Errors, 2)
+			assert.ErrorIs(t, batchErr.Errors[0], backend.ErrDuplicateEvent)
+			assert.Error(t, batchErr.Errors[2])
+			assert.Equal(t, []api.InstanceID{api.EmptyInstanceID, "batch-new", api.EmptyInstanceID}, ids)
+			metadata, err := client.WaitForOrchestrationCompletion(ctx, "batch-new")
+			require.NoError(t, err)
+			assert.Equal(t, "42", metadata.SerializedOutput)
+		})
+	}
+}
+
+func Test_IngestStream_Backpressure(t *testing.T) {
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, task.NewTaskRegistry())
+	defer worker.Shutdown(ctx)
+
+	gated := &gatedIngestBackend{Backend: be, gate: make(chan struct{})}
+	client := backend.NewTaskHubClient(gated)
+	stream, err := client.NewIngestStream(ctx, backend.WithIngestWindowSize(2))
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Send(backend.IngestCreateOrchestration("A")))
+	require.NoError(t, stream.Send(backend.IngestCreateOrchestration("B")))
+
+	// The window is full, so the next operation waits until the backend commits a batch
+	sent := make(chan error, 1)
+	go func() {
+		sent <- stream.Send(backend.IngestCreateOrchestration("C"))
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expected Send to block while the window is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(gated.gate)
+	require.NoError(t, <-sent)
+
+	results, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+		_, err := client.FetchOrchestrationMetadata(ctx, result.InstanceID)
+		assert.NoError(t, err)
+	}
+}
+
+// gatedIngestBackend is a backend that doesn't ingest operations until its gate is closed.
+type gatedIngestBackend struct {
+	backend.Backend
+	gate chan struct{}
+}
+
+func (be *gatedIngestBackend) IngestOperations(ctx context.Context, ops []*backend.IngestOperation) ([]error, error) {
+	<-be.gate
+	return backend.IngestOperations(ctx, be.Backend, ops)
+}
+
+func Test_CircuitBreaker(t *testing.T) {
+	// Registration
+	var healthy int32
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CallDependency", func(ctx *task.OrchestrationContext) (any, error) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return nil, errors.New("dependency is down")
+		}
+		return nil, nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	cb := backend.NewCircuitBreaker(backend.CircuitBreakerOptions{MinimumOutcomes: 2, Cooldown: time.Second})
+	be, worker := initBackendAndTaskHubWorker(ctx, r, backend.WithCircuitBreaker(cb))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be, backend.WithScheduleCircuitBreaker(cb))
+
+	// Two failures in a row open the circuit
+	for i := 0; i < 2; i++ {
+		id, err := client.ScheduleNewOrchestration(ctx, "CallDependency")
+		require.NoError(t, err)
+		metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+	}
+	assert.Equal(t, backend.CircuitOpen, cb.State("CallDependency"))
+	_, err := client.ScheduleNewOrchestration(ctx, "CallDependency")
+	require.ErrorIs(t, err, backend.ErrCircuitOpen)
+
+	// Orchestrations scheduled by other clients aren't processed while the circuit is open
+	atomic.StoreInt32(&healthy, 1)
+	id, err := backend.NewTaskHubClient(be).ScheduleNewOrchestration(ctx, "CallDependency")
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING, metadata.RuntimeStatus)
+
+	// After the cooldown, the circuit half-opens and closes again once an orchestration succeeds
+	metadata, err = client.WaitForOrchestrationCompletion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, backend.CircuitClosed, cb.State("CallDependency"))
+	_, err = client.ScheduleNewOrchestration(ctx, "CallDependency")
+	assert.NoError(t, err)
+}
+
+func Test_RetryFailedOrchestrations(t *testing.T) {
+	type division struct {
+		A int `json:"a"`
+		B int `json:"b"`
+	}
+
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Divide", func(ctx *task.OrchestrationContext) (any, error) {
+		var input division
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		if input.B == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return input.A / input.B, nil
+	})
+	r.AddOrchestratorN("AlwaysFails", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, errors.New("failed")
+	})
+
+	// Initialization
+	ctx := context.Background()
+	be, worker := initBackendAndTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	schedule := func(name string, id api.InstanceID, input any) {
+		_, err := client.ScheduleNewOrchestration(ctx, name, api.WithInstanceID(id), api.WithInput(input))
+		require.NoError(t, err)
+		_, err = client.WaitForOrchestrationCompletion(ctx, id)
+		require.NoError(t, err)
+	}
+	schedule("Divide", "div1", division{A: 6, B: 0})
+	schedule("Divide", "div2", division{A: 8, B: 0})
+	schedule("Divide", "div3", division{A: 9, B: 3})
+	schedule("AlwaysFails", "fails", nil)
+
+	// Only the failed orchestrations that match the query are retried, with their inputs patched
+	count, err := client.RetryFailedOrchestrations(ctx, api.InstanceQuery{Name: "Divide"}, func(input []byte) ([]byte, error) {
+		var d division
+		if err := json.Unmarshal(input, &d); err != nil {
+			return nil, err
+		}
+		d.B = 2
+		return json.Marshal(d)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	ids := queryInstanceIDs(t, client, api.InstanceQuery{Name: "Divide"})
+	require.Len(t, ids, 5)
+	outputs := make(map[string]string)
+	for _, id := range ids {
+		metadata, err := client.WaitForOrchestrationCompletion(ctx, id)
+		require.NoError(t, err)
+		if original, _, isRetry := strings.Cut(string(id), "-retry-"); isRetry {
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+			outputs[original] = metadata.SerializedOutput
+		} else if id != "div3" {
+			// The original instances are left untouched
+			assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, metadata.RuntimeStatus)
+		}
+	}
+	assert.Equal(t, map[string]string{"div1": "3", "div2": "4"}, outputs)
+
+	// Errors are aggregated per instance
+	_, err = client.RetryFailedOrchestrations(ctx, api.InstanceQuery{Name: "AlwaysFails"}, func([]byte) ([]byte, error) {
+		return nil, errors.New("bad patch")
+	})
+	var retryErr *backend.RetryFailedError
+	require.ErrorAs(t, err, &retryErr)
+	assert.Contains(t, retryErr.Errors, api.InstanceID("fails"))
+
+	// With purging, the failed instance is replaced by its retry
+	original, err := client.FetchOrchestrationMetadata(ctx, "fails")
+	require.NoError(t, err)
+	count, err = client.RetryFailedOrchestrations(ctx, api.InstanceQuery{Name: "AlwaysFails"}, nil, backend.WithRetryPurge(true))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	retried, err := client.WaitForOrchestrationCompletion(ctx, "fails")
+	require.NoError(t, err)
+	assert.True(t, retried.CreatedAt.After(original.CreatedAt))
+	ids = queryInstanceIDs(t, client, api.InstanceQuery{Name: "AlwaysFails"})
+	assert.Equal(t, []api.InstanceID{"fails"}, ids)
+}
+
+// queryInstanceIDs returns the IDs of all the orchestration instances that match the query.
+func queryInstanceIDs(t *testing.T, client backend.TaskHubClient, query api.InstanceQuery) []api.InstanceID {
+	var ids []api.InstanceID
+	for {
+		result, err := client.QueryInstances(ctx, query)
+		require.NoError(t, err)
+		for _, metadata := range result.Instances {
+			ids = append(ids, metadata.InstanceID)
+		}
+		if result.ContinuationToken == "" {
+			return ids
+		}
+		query.ContinuationToken = result.ContinuationToken
+	}
+}
+
+func Test_DeadLetters(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CallFlaky", func(ctx *task.OrchestrationContext) (any, error) {
+		var output string
+		err := ctx.CallActivity("Flaky").Await(&output)
+		return output, err
+	})
+	r.AddActivityN("Flaky", func(ctx task.ActivityContext) (any, error) {
+		return "recovered", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	executor := &crashingExecutor{Executor: task.NewTaskExecutor(r), crash: 1}
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger, backend.WithMaxDeliveryCount(3))
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// The activity work item is moved to the dead-letter store after 3 failed deliveries
+	id, err := client.ScheduleNewOrchestration(ctx, "CallFlaky")
+	require.NoError(t, err)
+	var deadLetters []*backend.DeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters, err = client.ListDeadLetters(ctx)
+		return err == nil && len(deadLetters) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	dl := deadLetters[0]
+	assert.Equal(t, backend.DeadLetterActivity, dl.Kind)
+	assert.Equal(t, id, dl.InstanceID)
+	assert.Equal(t, int32(4), dl.DeliveryCount)
+	assert.NotEmpty(t, dl.Reason)
+	require.Len(t, dl.Events, 1)
+	assert.Equal(t, "Flaky", dl.Events[0].GetTaskScheduled().GetName())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&executor.activityCalls))
+
+	metadata, err := client.FetchOrchestrationMetadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_RUNNING, metadata.RuntimeStatus)
+
+	// Resubmitting the dead letter once the activity is fixed completes the orchestration
+	atomic.StoreInt32(&executor.crash, 0)
+	require.NoError(t, client.ResubmitDeadLetter(ctx, dl.ID))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `"recovered"`, metadata.SerializedOutput)
+
+	deadLetters, err = client.ListDeadLetters(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
+	assert.ErrorIs(t, client.ResubmitDeadLetter(ctx, dl.ID), backend.ErrDeadLetterNotFound)
+	assert.ErrorIs(t, client.DeleteDeadLetter(ctx, dl.ID), backend.ErrDeadLetterNotFound)
+}
+
+func Test_DeadLetters_DeferredWorkItems(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("FanOut", func(ctx *task.OrchestrationContext) (any, error) {
+		tasks := []task.Task{
+			ctx.CallActivity("Throttled"),
+			ctx.CallActivity("Throttled"),
+			ctx.CallActivity("Throttled"),
+		}
+		for _, t := range tasks {
+			if err := t.Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	r.AddActivityN("Throttled", func(ctx task.ActivityContext) (any, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	})
+
+	// Initialization, with batches of work items that exceed the concurrency limit, so that the work items of the
+	// batches are deferred more often than the maximum delivery count
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger,
+		backend.WithMaxParallelism(3),
+		backend.WithFetchBatchSize(3),
+		backend.WithActivityConcurrencyLimits(map[string]int{"Throttled": 1}),
+		backend.WithMaxDeliveryCount(1))
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// The deferred work items aren't dead-lettered
+	id, err := client.ScheduleNewOrchestration(ctx, "FanOut")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+
+	deadLetters, err := client.ListDeadLetters(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func Test_LockRenewal(t *testing.T) {
+	// Registration
+	var executions int32
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("CallSlow", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, ctx.CallActivity("Slow").Await(nil)
+	})
+	r.AddActivityN("Slow", func(ctx task.ActivityContext) (any, error) {
+		atomic.AddInt32(&executions, 1)
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+
+	// Initialization, with locks that expire long before the activity completes
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	options := sqlite.NewSqliteOptions("")
+	options.OrchestrationLockTimeout = 200 * time.Millisecond
+	options.ActivityLockTimeout = 200 * time.Millisecond
+	be := sqlite.NewSqliteBackend(options, logger)
+	executor := task.NewTaskExecutor(r)
+	opts := []backend.NewTaskWorkerOptions{backend.WithMaxParallelism(2), backend.WithLockRenewalInterval(50 * time.Millisecond)}
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger, opts...)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger, opts...)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// The renewed lock keeps the activity from being executed again while it's running
+	id, err := client.ScheduleNewOrchestration(ctx, "CallSlow")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&executions))
+}
+
+func Test_InvalidStateQuarantine(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Hello", func(ctx *task.OrchestrationContext) (any, error) {
+		return "hello", nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := &corruptStateBackend{
+		BackendWithDeadLetters: sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger).(backend.BackendWithDeadLetters),
+		corrupt:                1,
+	}
+	alerts := make(chan error, 10)
+	alert := func(_ context.Context, id api.InstanceID, err error) {
+		assert.Equal(t, api.InstanceID("corrupted"), id)
+		alerts <- err
+	}
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger,
+		backend.WithInvalidStatePolicy(backend.InvalidStateQuarantine), backend.WithInvalidStateAlert(alert))
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// The work item is quarantined in the dead-letter store on its first delivery, and an alert is raised
+	id, err := client.ScheduleNewOrchestration(ctx, "Hello", api.WithInstanceID("corrupted"))
+	require.NoError(t, err)
+	select {
+	case err := <-alerts:
+		assert.ErrorIs(t, err, backend.ErrInvalidOrchestrationState)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "the quarantine wasn't alerted")
+	}
+	var deadLetters []*backend.DeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters, err = client.ListDeadLetters(ctx)
+		return err == nil && len(deadLetters) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	dl := deadLetters[0]
+	assert.Equal(t, backend.DeadLetterOrchestration, dl.Kind)
+	assert.Equal(t, id, dl.InstanceID)
+	assert.Equal(t, int32(1), dl.DeliveryCount)
+	assert.Contains(t, dl.Reason, backend.ErrInvalidOrchestrationState.Error())
+
+	// Resubmitting the dead letter once the state is repaired completes the orchestration
+	atomic.StoreInt32(&be.corrupt, 0)
+	require.NoError(t, client.ResubmitDeadLetter(ctx, dl.ID))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, `"hello"`, metadata.SerializedOutput)
+	assert.Len(t, alerts, 0)
+}
+
+// corruptStateBackend returns an invalid orchestration state, whose history is missing its ExecutionStarted event,
+// while corrupt is non-zero.
+type corruptStateBackend struct {
+	backend.BackendWithDeadLetters
+	corrupt int32
+}
+
+func (be *corruptStateBackend) GetOrchestrationRuntimeState(ctx context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	if atomic.LoadInt32(&be.corrupt) != 0 {
+		return backend.NewOrchestrationRuntimeState(wi.InstanceID, []*protos.HistoryEvent{helpers.NewOrchestratorStartedEvent()}), nil
+	}
+	return be.BackendWithDeadLetters.GetOrchestrationRuntimeState(ctx, wi)
+}
+
+// crashingExecutor is an executor whose activity executions fail, as if the worker crashed, while crash is non-zero.
+type crashingExecutor struct {
+	backend.Executor
+	crash         int32
+	activityCalls int32
+}
+
+func (e *crashingExecutor) ExecuteActivity(ctx context.Context, iid api.InstanceID, event *protos.HistoryEvent) (*protos.HistoryEvent, error) {
+	if atomic.LoadInt32(&e.crash) != 0 {
+		atomic.AddInt32(&e.activityCalls, 1)
+		return nil, errors.New("activity crashed")
+	}
+	return e.Executor.ExecuteActivity(ctx, iid, event)
+}
+
+func Test_ActionsReturnedInSchedulingOrder(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	names := []string{"A", "B", "C", "D", "E"}
+	r.AddOrchestratorN("FanOut", func(ctx *task.OrchestrationContext) (any, error) {
+		tasks := make([]task.Task, 0, len(names))
+		for _, name := range names {
+			tasks = append(tasks, ctx.CallActivity(name))
+		}
+		for _, t := range tasks {
+			if err := t.Await(nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	for _, name := range names {
+		r.AddActivityN(name, func(ctx task.ActivityContext) (any, error) {
+			return nil, nil
+		})
+	}
+
+	// Initialization
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "FanOut")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err = client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+
+	// The activities are scheduled in the order in which the orchestrator called them
+	history, err := client.GetOrchestrationHistory(ctx, id)
+	require.NoError(t, err)
+	var scheduled []string
+	for _, e := range history {
+		if e.Type == api.HistoryEventTaskScheduled {
+			scheduled = append(scheduled, e.Name)
+		}
+	}
+	assert.Equal(t, names, scheduled)
+}
+
+func Test_SentEventsDeliveredAsRaisedEvents(t *testing.T) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Receiver", func(ctx *task.OrchestrationContext) (any, error) {
+		var received []string
+		for i := 0; i < 3; i++ {
+			var value string
+			if err := ctx.WaitForSingleEvent("Ping", 5*time.Second).Await(&value); err != nil {
+				return nil, err
+			}
+			received = append(received, value)
+		}
+		return received, nil
+	})
+	r.AddOrchestratorN("Sender", func(ctx *task.OrchestrationContext) (any, error) {
+		return nil, nil
+	})
+
+	// Initialization of a worker whose executor sends events on behalf of the sender, like out-of-process SDKs do
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	executor := &sendEventExecutor{Executor: task.NewTaskExecutor(r), senderID: "sender", receiverID: "receiver"}
+	worker := backend.NewTaskHubWorker(be,
+		backend.NewOrchestrationWorker(be, executor, logger),
+		backend.NewActivityTaskWorker(be, executor, logger),
+		logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// The receiver gets the sent events as raised events, in the order in which they were sent
+	_, err := client.ScheduleNewOrchestration(ctx, "Receiver", api.WithInstanceID("receiver"))
+	require.NoError(t, err)
+	_, err = client.ScheduleNewOrchestration(ctx, "Sender", api.WithInstanceID("sender"))
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, "receiver")
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `["1","2","3"]`, metadata.SerializedOutput)
+}
+
+// sendEventExecutor is an executor that adds actions that send three "Ping" events to the receiver to the first
+// execution of the sender.
+type sendEventExecutor struct {
+	backend.Executor
+	senderID   api.InstanceID
+	receiverID api.InstanceID
+}
+
+func (e *sendEventExecutor) ExecuteOrchestrator(ctx context.Context, iid api.InstanceID, oldEvents []*protos.HistoryEvent, newEvents []*protos.HistoryEvent) (*backend.ExecutionResults, error) {
+	results, err := e.Executor.ExecuteOrchestrator(ctx, iid, oldEvents, newEvents)
+	if err != nil || iid != e.senderID || len(oldEvents) > 0 {
+		return results, err
+	}
+	var actions []*protos.OrchestratorAction
+	for i := 1; i <= 3; i++ {
+		action := helpers.NewSendEventAction(string(e.receiverID), "Ping", wrapperspb.String(fmt.Sprintf(`"%d"`, i)))
+		action.Id = int32(100 + i)
+		actions = append(actions, action)
 	}
+	results.Response.Actions = append(actions, results.Response.Actions...)
+	return results, nil
 }
 
 func initTaskHubWorker(ctx context.Context, r *task.TaskRegistry, opts ...backend.NewTaskWorkerOptions) (backend.TaskHubClient, backend.TaskHubWorker) {
+	be, taskHubWorker := initBackendAndTaskHubWorker(ctx, r, opts...)
+	taskHubClient := backend.NewTaskHubClient(be)
+	return taskHubClient, taskHubWorker
+}
+
+// initBackendAndTaskHubWorker is like initTaskHubWorker, but returns the backend so that tests can create clients with custom options.
+func initBackendAndTaskHubWorker(ctx context.Context, r *task.TaskRegistry, opts ...backend.NewTaskWorkerOptions) (backend.Backend, backend.TaskHubWorker) {
 	// TODO: Switch to options pattern
 	logger := backend.DefaultLogger()
 	be := sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), logger)
+	return be, startTaskHubWorker(ctx, be, r, opts...)
+}
+
+// initMinimalTaskHubWorker is like initTaskHubWorker, but hides the optional interfaces of the backend other than
+// queries, so that tests can exercise the fallbacks of the workers and clients, most of which depend on queries.
+func initMinimalTaskHubWorker(ctx context.Context, r *task.TaskRegistry, opts ...backend.NewTaskWorkerOptions) (backend.TaskHubClient, backend.TaskHubWorker) {
+	be := &minimalBackend{Backend: sqlite.NewSqliteBackend(sqlite.NewSqliteOptions(""), backend.DefaultLogger())}
+	return backend.NewTaskHubClient(be), startTaskHubWorker(ctx, be, r, opts...)
+}
+
+// taskHubInitializers initialize task hubs whose backends do and don't implement the optional backend interfaces, so
+// that tests can cover the fallbacks of the workers and clients.
+var taskHubInitializers = map[string]func(context.Context, *task.TaskRegistry, ...backend.NewTaskWorkerOptions) (backend.TaskHubClient, backend.TaskHubWorker){
+	"full":    initTaskHubWorker,
+	"minimal": initMinimalTaskHubWorker,
+}
+
+// minimalBackend only exposes the methods of [backend.Backend] and [backend.BackendWithQueries] of the wrapped
+// backend, so it hides its other optional interfaces.
+type minimalBackend struct {
+	backend.Backend
+}
+
+func (be minimalBackend) QueryOrchestrationMetadata(ctx context.Context, query api.InstanceQuery) (api.InstanceQueryResult, error) {
+	querier, ok := backend.As[backend.BackendWithQueries](be.Backend)
+	if !ok {
+		return api.InstanceQueryResult{}, backend.ErrNotSupported
+	}
+	return querier.QueryOrchestrationMetadata(ctx, query)
+}
+
+func startTaskHubWorker(ctx context.Context, be backend.Backend, r *task.TaskRegistry, opts ...backend.NewTaskWorkerOptions) backend.TaskHubWorker {
+	logger := backend.DefaultLogger()
 	executor := task.NewTaskExecutor(r)
 	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger, opts...)
 	activityWorker := backend.NewActivityTaskWorker(be, executor, logger, opts...)
@@ -781,6 +5211,5 @@ func initTaskHubWorker(ctx context.Context, r *task.TaskRegistry, opts ...backen
 	if err := taskHubWorker.Start(ctx); err != nil {
 		panic(err)
 	}
-	taskHubClient := backend.NewTaskHubClient(be)
-	return taskHubClient, taskHubWorker
+	return taskHubWorker
 }
@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/payloads/gcs"
+)
+
+func Test_InMemoryPayloadStore(t *testing.T) {
+	testPayloadStore(t, backend.NewInMemoryPayloadStore())
+}
+
+func Test_GCSPayloadStore(t *testing.T) {
+	server := httptest.NewServer(newFakeGCSHandler("payloads"))
+	defer server.Close()
+
+	opts := gcs.NewGCSOptions(server.Client(), "payloads")
+	opts.Endpoint = server.URL
+	testPayloadStore(t, gcs.NewGCSPayloadStore(opts))
+}
+
+// newFakeGCSHandler returns a handler that implements the subset of the Cloud Storage JSON API that the GCS payload
+// store uses, for a single bucket. Lists return one object per page, to exercise paging.
+func newFakeGCSHandler(bucket string) http.Handler {
+	var lock sync.Mutex
+	objects := map[string][]byte{}
+	objectsPath := "/storage/v1/b/" + bucket + "/o"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		path := r.URL.EscapedPath()
+		switch {
+		case r.Method == http.MethodPost && path == "/upload"+objectsPath:
+			payload, _ := io.ReadAll(r.Body)
+			objects[r.URL.Query().Get("name")] = payload
+		case r.Method == http.MethodGet && path == objectsPath:
+			var names []string
+			for name := range objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("pageToken") {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			page := map[string]any{"items": []map[string]string{}}
+			if len(names) > 0 {
+				page["items"] = []map[string]string{{"name": names[0]}}
+				page["nextPageToken"] = names[0]
+			}
+			json.NewEncoder(w).Encode(page)
+		case strings.HasPrefix(path, objectsPath+"/"):
+			name, _ := url.PathUnescape(strings.TrimPrefix(path, objectsPath+"/"))
+			payload, ok := objects[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+			} else if r.Method == http.MethodDelete {
+				delete(objects, name)
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.Write(payload)
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
+
+// testPayloadStore tests the contract of a payload store, using keys that are unique to the test run so that stores
+// backed by external services don't need to be emptied first.
+func testPayloadStore(t *testing.T, store backend.PayloadStore) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("test-%d/", time.Now().UnixNano())
+	other := fmt.Sprintf("test-%d-other/", time.Now().UnixNano())
+
+	// Payloads can be read back, and are overwritten by later puts with the same key
+	require.NoError(t, store.PutPayload(ctx, prefix+"a", []byte("first")))
+	require.NoError(t, store.PutPayload(ctx, prefix+"a", []byte("second")))
+	require.NoError(t, store.PutPayload(ctx, prefix+"b", []byte{}))
+	require.NoError(t, store.PutPayload(ctx, other+"c", []byte("other")))
+	payload, err := store.GetPayload(ctx, prefix+"a")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "second", string(payload))
+	}
+	payload, err = store.GetPayload(ctx, prefix+"b")
+	if assert.NoError(t, err) {
+		assert.Empty(t, payload)
+	}
+
+	_, err = store.GetPayload(ctx, prefix+"missing")
+	assert.ErrorIs(t, err, backend.ErrPayloadNotFound)
+
+	// Only the payloads with the prefix are deleted
+	require.NoError(t, store.DeletePayloads(ctx, prefix))
+	_, err = store.GetPayload(ctx, prefix+"a")
+	assert.ErrorIs(t, err, backend.ErrPayloadNotFound)
+	_, err = store.GetPayload(ctx, prefix+"b")
+	assert.ErrorIs(t, err, backend.ErrPayloadNotFound)
+	payload, err = store.GetPayload(ctx, other+"c")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "other", string(payload))
+	}
+
+	// Deleting payloads that don't exist isn't an error
+	require.NoError(t, store.DeletePayloads(ctx, other))
+	assert.NoError(t, store.DeletePayloads(ctx, other))
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/redis"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+func Test_RedisBackend_Orchestrations(t *testing.T) {
+	server := miniredis.RunT(t)
+	testOrchestrationScenario(t, redis.NewRedisBackend(redis.NewRedisOptions(server.Addr()), backend.DefaultLogger()))
+}
+
+// testOrchestrationScenario runs an orchestration that uses activities, timers, external events, and
+// sub-orchestrations on a task hub worker for the specified backend, and purges it once it completes.
+func testOrchestrationScenario(t *testing.T, be backend.Backend) {
+	// Registration
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Parent", func(ctx *task.OrchestrationContext) (any, error) {
+		var greetings []string
+		for i := 0; i < 3; i++ {
+			var greeting string
+			if err := ctx.CallActivity("SayHello", task.WithActivityInput(i)).Await(&greeting); err != nil {
+				return nil, err
+			}
+			greetings = append(greetings, greeting)
+		}
+		if err := ctx.CreateTimer(100 * time.Millisecond).Await(nil); err != nil {
+			return nil, err
+		}
+		var approval string
+		if err := ctx.WaitForSingleEvent("Approval", 10*time.Second).Await(&approval); err != nil {
+			return nil, err
+		}
+		var child string
+		if err := ctx.CallSubOrchestrator("Child", task.WithSubOrchestratorInput(approval)).Await(&child); err != nil {
+			return nil, err
+		}
+		return append(greetings, child), nil
+	})
+	r.AddOrchestratorN("Child", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		if err := ctx.GetInput(&input); err != nil {
+			return nil, err
+		}
+		return "child: " + input, nil
+	})
+	r.AddActivityN("SayHello", func(ctx task.ActivityContext) (any, error) {
+		var i int
+		if err := ctx.GetInput(&i); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("Hello, %d!", i), nil
+	})
+
+	// Initialization
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+	executor := task.NewTaskExecutor(r)
+	orchestrationWorker := backend.NewOrchestrationWorker(be, executor, logger)
+	activityWorker := backend.NewActivityTaskWorker(be, executor, logger)
+	worker := backend.NewTaskHubWorker(be, orchestrationWorker, activityWorker, logger)
+	require.NoError(t, worker.Start(ctx))
+	defer worker.Shutdown(ctx)
+	client := backend.NewTaskHubClient(be)
+
+	// Run the orchestration
+	id, err := client.ScheduleNewOrchestration(ctx, "Parent")
+	require.NoError(t, err)
+	_, err = client.WaitForOrchestrationStart(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, client.RaiseEvent(ctx, id, "Approval", api.WithEventPayload("approved")))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metadata, err := client.WaitForOrchestrationCompletion(timeoutCtx, id)
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, metadata.RuntimeStatus)
+	assert.Equal(t, `["Hello, 0!","Hello, 1!","Hello, 2!","child: approved"]`, metadata.SerializedOutput)
+
+	// The completed orchestration can be purged
+	_, err = client.PurgeOrchestrationState(ctx, id)
+	require.NoError(t, err)
+	_, err = client.FetchOrchestrationMetadata(ctx, id)
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+}
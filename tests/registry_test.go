@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	_ "github.com/microsoft/durabletask-go/backend/inmem"
+	_ "github.com/microsoft/durabletask-go/backend/sqlite"
+)
+
+func Test_OpenBackend(t *testing.T) {
+	ctx := context.Background()
+	logger := backend.DefaultLogger()
+
+	filePath := filepath.ToSlash(filepath.Join(t.TempDir(), "taskhub.db"))
+	for _, connectionURL := range []string{"inmem://", "sqlite://", "sqlite://" + filePath, "SQLITE:" + filePath} {
+		t.Run(connectionURL, func(t *testing.T) {
+			be, err := backend.Open(connectionURL, logger)
+			require.NoError(t, err)
+			require.NoError(t, be.CreateTaskHub(ctx))
+			defer be.DeleteTaskHub(ctx)
+
+			_, err = be.GetOrchestrationMetadata(ctx, api.InstanceID("missing"))
+			assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+		})
+	}
+
+	assert.Subset(t, backend.Schemes(), []string{"inmem", "sqlite"})
+
+	_, err := backend.Open("unknown://", logger)
+	assert.ErrorContains(t, err, "unknown backend scheme")
+	_, err = backend.Open("/no/scheme", logger)
+	assert.Error(t, err)
+}
+
+func Test_RegisterBackend(t *testing.T) {
+	var opened *url.URL
+	backend.Register("test-registry", func(u *url.URL, logger backend.Logger) (backend.Backend, error) {
+		opened = u
+		return nil, nil
+	})
+
+	_, err := backend.Open("test-registry://host/path?option=value", nil)
+	require.NoError(t, err)
+	require.NotNil(t, opened)
+	assert.Equal(t, "host", opened.Host)
+	assert.Equal(t, "value", opened.Query().Get("option"))
+
+	assert.Panics(t, func() {
+		backend.Register("TEST-REGISTRY", func(*url.URL, backend.Logger) (backend.Backend, error) { return nil, nil })
+	})
+}
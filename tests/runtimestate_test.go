@@ -116,7 +116,7 @@ func Test_CompletedSubOrchestration(t *testing.T) {
 
 	parentInfo := helpers.NewParentInfo(expectedTaskID, "Parent", "parent_id")
 	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent("Child", "child_id", nil, parentInfo, nil),
+		helpers.NewExecutionStartedEvent("Child", "child_id", nil, parentInfo, nil, nil),
 	})
 
 	actions := []*protos.OrchestratorAction{
@@ -160,7 +160,7 @@ func Test_RuntimeState_ContinueAsNew(t *testing.T) {
 	eventPayload := "MyEventPayload"
 
 	state := backend.NewOrchestrationRuntimeState(api.InstanceID(iid), []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent(expectedName, iid, nil, nil, nil),
+		helpers.NewExecutionStartedEvent(expectedName, iid, nil, nil, nil, nil),
 	})
 
 	carryoverEvents := []*protos.HistoryEvent{helpers.NewEventRaisedEvent(eventName, wrapperspb.String(eventPayload))}
@@ -207,7 +207,7 @@ func Test_CreateTimer(t *testing.T) {
 	expectedFireAt := time.Now().UTC().Add(72 * time.Hour)
 
 	s := backend.NewOrchestrationRuntimeState(iid, []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent("MyOrchestration", iid, nil, nil, nil),
+		helpers.NewExecutionStartedEvent("MyOrchestration", iid, nil, nil, nil, nil),
 	})
 
 	var actions []*protos.OrchestratorAction
@@ -246,7 +246,7 @@ func Test_ScheduleTask(t *testing.T) {
 	expectedInput := "{\"Foo\":5}"
 
 	state := backend.NewOrchestrationRuntimeState(iid, []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent("MyOrchestration", iid, wrapperspb.String(expectedInput), nil, nil),
+		helpers.NewExecutionStartedEvent("MyOrchestration", iid, wrapperspb.String(expectedInput), nil, nil, nil),
 	})
 
 	actions := []*protos.OrchestratorAction{
@@ -296,7 +296,7 @@ func Test_CreateSubOrchestration(t *testing.T) {
 	expectedTraceState := "trace_state"
 
 	state := backend.NewOrchestrationRuntimeState(api.InstanceID(iid), []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent("Parent", iid, nil, nil, nil),
+		helpers.NewExecutionStartedEvent("Parent", iid, nil, nil, nil, nil),
 	})
 
 	actions := []*protos.OrchestratorAction{
@@ -355,7 +355,7 @@ func Test_SendEvent(t *testing.T) {
 	expectedInput := "foo"
 
 	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", wrapperspb.String(expectedInput), nil, nil),
+		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", wrapperspb.String(expectedInput), nil, nil, nil),
 	})
 
 	actions := []*protos.OrchestratorAction{
@@ -383,11 +383,73 @@ func Test_SendEvent(t *testing.T) {
 	}
 }
 
+func Test_SendEvent_SideEffectName(t *testing.T) {
+	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
+		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil, nil),
+	})
+
+	// Events are sent regardless of their names, even if they're named like side effects
+	for _, name := range []string{"SideEffect", "side-effect", "side-effect-failed"} {
+		actions := []*protos.OrchestratorAction{helpers.NewSendEventAction("xyz", name, nil)}
+		_, err := s.ApplyActions(actions, nil)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, s.PendingMessages(), 3)
+}
+
+func Test_SideEffect(t *testing.T) {
+	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
+		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil, nil),
+	})
+
+	actions := []*protos.OrchestratorAction{
+		helpers.NewSideEffectAction(0, wrapperspb.String("42"), false),
+		helpers.NewSideEffectAction(1, wrapperspb.String("oops"), true),
+	}
+	continuedAsNew, err := s.ApplyActions(actions, nil)
+	if assert.NoError(t, err) && assert.False(t, continuedAsNew) {
+		// Side effects are only recorded in the history, and are identified by their kind
+		assert.Empty(t, s.PendingMessages())
+		if assert.Len(t, s.NewEvents(), 2) {
+			isSideEffect, failed := helpers.IsSideEffect(s.NewEvents()[0].GetEventSent())
+			assert.True(t, isSideEffect)
+			assert.False(t, failed)
+			isSideEffect, failed = helpers.IsSideEffect(s.NewEvents()[1].GetEventSent())
+			assert.True(t, isSideEffect)
+			assert.True(t, failed)
+		}
+	}
+}
+
+func Test_StartDetachedOrchestration(t *testing.T) {
+	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
+		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil, nil),
+	})
+
+	actions := []*protos.OrchestratorAction{
+		helpers.NewStartDetachedOrchestrationAction(0, "Child", "xyz", wrapperspb.String("foo")),
+		// Events are sent regardless of their names, even if they're named like detached orchestrations
+		helpers.NewSendEventAction("xyz", "start-detached-orchestration:Child", nil),
+	}
+	continuedAsNew, err := s.ApplyActions(actions, nil)
+	if assert.NoError(t, err) && assert.False(t, continuedAsNew) && assert.Len(t, s.PendingMessages(), 2) {
+		if executionStarted := s.PendingMessages()[0].HistoryEvent.GetExecutionStarted(); assert.NotNil(t, executionStarted) {
+			assert.Equal(t, "Child", executionStarted.Name)
+			assert.Equal(t, "foo", executionStarted.Input.GetValue())
+			assert.Nil(t, executionStarted.ParentInstance)
+		}
+		if sendEvent := s.PendingMessages()[1].HistoryEvent.GetEventSent(); assert.NotNil(t, sendEvent) {
+			assert.Equal(t, "start-detached-orchestration:Child", sendEvent.Name)
+		}
+		assert.True(t, helpers.IsStartDetachedOrchestration(s.NewEvents()[0].GetEventSent()))
+	}
+}
+
 func Test_StateIsValid(t *testing.T) {
 	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{})
 	assert.True(t, s.IsValid())
 	s = backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
-		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil),
+		helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil, nil),
 	})
 	assert.True(t, s.IsValid())
 	s = backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{
@@ -398,8 +460,8 @@ func Test_StateIsValid(t *testing.T) {
 
 func Test_DuplicateEvents(t *testing.T) {
 	s := backend.NewOrchestrationRuntimeState("abc", []*protos.HistoryEvent{})
-	if err := s.AddEvent(helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil)); assert.NoError(t, err) {
-		err = s.AddEvent(helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil))
+	if err := s.AddEvent(helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil, nil)); assert.NoError(t, err) {
+		err = s.AddEvent(helpers.NewExecutionStartedEvent("MyOrchestration", "abc", nil, nil, nil, nil))
 		assert.ErrorIs(t, err, backend.ErrDuplicateEvent)
 	} else {
 		return
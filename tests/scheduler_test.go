@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/scheduler"
+	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
+)
+
+func Test_ParseCron(t *testing.T) {
+	start := time.Date(2023, time.March, 15, 10, 30, 45, 0, time.UTC) // a Wednesday
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2023, time.March, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, time.March, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2023, time.March, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * * mon-fri", time.Date(2023, time.March, 16, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2023, time.March, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", time.Date(2023, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2023, time.March, 15, 10, 32, 15, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			cron, err := scheduler.ParseCron(tc.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.next, cron.Next(start))
+		})
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every 1ms", "@every soon"} {
+		_, err := scheduler.ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func Test_Scheduler(t *testing.T) {
+	r := task.NewTaskRegistry()
+	require.NoError(t, scheduler.AddToRegistry(r))
+	r.AddOrchestratorN("Job", func(ctx *task.OrchestrationContext) (any, error) {
+		var input string
+		err := ctx.GetInput(&input)
+		return input, err
+	})
+
+	ctx := context.Background()
+	client, worker := initTaskHubWorker(ctx, r)
+	defer worker.Shutdown(ctx)
+
+	schedule := scheduler.Schedule{Cron: "@every 1s", Orchestrator: "Job", Input: `"tick"`}
+	require.NoError(t, scheduler.CreateSchedule(ctx, client, "job", schedule))
+	assert.ErrorIs(t, scheduler.CreateSchedule(ctx, client, "job", schedule), backend.ErrDuplicateEvent)
+	assert.Error(t, scheduler.CreateSchedule(ctx, client, "invalid", scheduler.Schedule{Cron: "* * *", Orchestrator: "Job"}))
+
+	// Wait for a run to be started, and for it to complete
+	var metadata *scheduler.ScheduleMetadata
+	require.Eventually(t, func() bool {
+		var err error
+		metadata, err = scheduler.GetSchedule(ctx, client, "job")
+		return err == nil && !metadata.LastRun.IsZero()
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, schedule, metadata.Schedule)
+	assert.False(t, metadata.Paused)
+	assert.True(t, metadata.NextRun.After(metadata.LastRun))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	run, err := client.WaitForOrchestrationCompletion(timeoutCtx, scheduler.RunInstanceID("job", metadata.LastRun))
+	require.NoError(t, err)
+	assert.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, run.RuntimeStatus)
+	assert.Equal(t, `"tick"`, run.SerializedOutput)
+
+	require.NoError(t, scheduler.PauseSchedule(ctx, client, "job"))
+	require.Eventually(t, func() bool {
+		metadata, err = scheduler.GetSchedule(ctx, client, "job")
+		return err == nil && metadata.Paused
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, scheduler.ResumeSchedule(ctx, client, "job"))
+
+	require.NoError(t, scheduler.DeleteSchedule(timeoutCtx, client, "job"))
+	_, err = scheduler.GetSchedule(ctx, client, "job")
+	assert.ErrorIs(t, err, api.ErrInstanceNotFound)
+}
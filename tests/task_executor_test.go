@@ -2,6 +2,7 @@
 package tests
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -10,6 +11,8 @@ import (
 	"github.com/microsoft/durabletask-go/internal/protos"
 	"github.com/microsoft/durabletask-go/task"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // Verifies that the WaitForSingleEvent API implicitly creates a timer when the timeout is non-zero.
@@ -27,7 +30,7 @@ func Test_Executor_WaitForEventSchedulesTimer(t *testing.T) {
 	oldEvents := []*protos.HistoryEvent{}
 	newEvents := []*protos.HistoryEvent{
 		startEvent,
-		helpers.NewExecutionStartedEvent("Orchestration", string(iid), nil, nil, nil),
+		helpers.NewExecutionStartedEvent("Orchestration", string(iid), nil, nil, nil, nil),
 	}
 
 	// Execute the orchestrator function and expect to get back a single timer action
@@ -57,7 +60,7 @@ func Test_Executor_SuspendStopsAllActions(t *testing.T) {
 	oldEvents := []*protos.HistoryEvent{}
 	newEvents := []*protos.HistoryEvent{
 		helpers.NewOrchestratorStartedEvent(),
-		helpers.NewExecutionStartedEvent("SuspendResumeOrchestration", string(iid), nil, nil, nil),
+		helpers.NewExecutionStartedEvent("SuspendResumeOrchestration", string(iid), nil, nil, nil, nil),
 		helpers.NewSuspendOrchestrationEvent(""),
 	}
 
@@ -66,3 +69,152 @@ func Test_Executor_SuspendStopsAllActions(t *testing.T) {
 	require.NoError(t, err)
 	require.Empty(t, results.Response.Actions, "Suspended orchestrations should not have any actions")
 }
+
+// Verifies that unprocessed external events are carried over to the new generation in the order in which they were
+// received, even when they have different names.
+func Test_Executor_ContinueAsNewCarriesOverEventsInOrder(t *testing.T) {
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Orchestration", func(ctx *task.OrchestrationContext) (any, error) {
+		ctx.ContinueAsNew(nil, task.WithKeepUnprocessedEvents())
+		return nil, nil
+	})
+
+	executor := task.NewTaskExecutor(r)
+	iid := api.InstanceID("abc123")
+	newEvents := []*protos.HistoryEvent{
+		helpers.NewOrchestratorStartedEvent(),
+		helpers.NewExecutionStartedEvent("Orchestration", string(iid), nil, nil, nil, nil),
+	}
+	names := []string{"A", "B", "A", "C", "B", "C"}
+	for i, name := range names {
+		newEvents = append(newEvents, helpers.NewEventRaisedEvent(name, wrapperspb.String(strconv.Itoa(i))))
+	}
+
+	results, err := executor.ExecuteOrchestrator(ctx, iid, nil, newEvents)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(results.Response.Actions))
+	completeAction := results.Response.Actions[0].GetCompleteOrchestration()
+	require.NotNil(t, completeAction)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_CONTINUED_AS_NEW, completeAction.OrchestrationStatus)
+	require.Len(t, completeAction.CarryoverEvents, len(names))
+	for i, e := range completeAction.CarryoverEvents {
+		require.Equal(t, names[i], e.GetEventRaised().GetName())
+		require.Equal(t, strconv.Itoa(i), e.GetEventRaised().GetInput().GetValue())
+	}
+}
+
+// Verifies that replaying a history that doesn't match the actions scheduled by the orchestrator fails the
+// orchestration with a NonDeterminismError that describes the mismatch.
+func Test_Executor_NonDeterminismDetected(t *testing.T) {
+	tests := []struct {
+		name            string
+		orchestrator    task.Orchestrator
+		expectedMessage string
+	}{
+		{
+			name: "DifferentActivityName",
+			orchestrator: func(ctx *task.OrchestrationContext) (any, error) {
+				return nil, ctx.CallActivity("SayGoodbye").Await(nil)
+			},
+			expectedMessage: "a previous execution called CallActivity for 'SayHello' with sequence number 0 at this point in the orchestration logic, but the current execution called CallActivity for 'SayGoodbye' instead",
+		},
+		{
+			name: "DifferentActionType",
+			orchestrator: func(ctx *task.OrchestrationContext) (any, error) {
+				return nil, ctx.CreateTimer(time.Second).Await(nil)
+			},
+			expectedMessage: "a previous execution called CallActivity for 'SayHello' with sequence number 0 at this point in the orchestration logic, but the current execution called CreateTimer instead",
+		},
+		{
+			name: "MissingAction",
+			orchestrator: func(ctx *task.OrchestrationContext) (any, error) {
+				return nil, nil
+			},
+			expectedMessage: "a previous execution called CallActivity for 'SayHello' with sequence number 0 at this point in the orchestration logic, but the current execution doesn't have this action with this sequence number",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := task.NewTaskRegistry()
+			require.NoError(t, r.AddOrchestratorN("Orchestration", tt.orchestrator))
+
+			executor := task.NewTaskExecutor(r)
+			iid := api.InstanceID("abc123")
+			oldEvents := []*protos.HistoryEvent{
+				helpers.NewOrchestratorStartedEvent(),
+				helpers.NewExecutionStartedEvent("Orchestration", string(iid), nil, nil, nil, nil),
+				helpers.NewTaskScheduledEvent(0, "SayHello", nil, nil, nil),
+			}
+			newEvents := []*protos.HistoryEvent{
+				helpers.NewOrchestratorStartedEvent(),
+			}
+
+			results, err := executor.ExecuteOrchestrator(ctx, iid, oldEvents, newEvents)
+			require.NoError(t, err)
+			var completeAction *protos.CompleteOrchestrationAction
+			for _, a := range results.Response.Actions {
+				if co := a.GetCompleteOrchestration(); co != nil {
+					completeAction = co
+				}
+			}
+			require.NotNil(t, completeAction)
+			require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED, completeAction.OrchestrationStatus)
+			require.Equal(t, "*task.NonDeterminismError", completeAction.FailureDetails.GetErrorType())
+			require.Equal(t, "non-deterministic orchestration: "+tt.expectedMessage, completeAction.FailureDetails.GetErrorMessage())
+		})
+	}
+}
+
+// Verifies that a cached orchestrator only processes the new events of the next execution when the history starts
+// with the events that it already processed, and that the history is replayed otherwise.
+func Test_Executor_OrchestratorCache(t *testing.T) {
+	invocations := 0
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("Orchestration", func(ctx *task.OrchestrationContext) (any, error) {
+		invocations++
+		var sum int
+		for i := 0; i < 3; i++ {
+			var value int
+			if err := ctx.WaitForSingleEvent("MyEvent", -1).Await(&value); err != nil {
+				return nil, err
+			}
+			sum += value
+		}
+		return sum, nil
+	})
+
+	executor := task.NewTaskExecutor(r, task.WithOrchestratorCacheSize(10))
+	iid := api.InstanceID("abc123")
+	var history []*protos.HistoryEvent
+	execute := func(newEvents ...*protos.HistoryEvent) *protos.OrchestratorResponse {
+		newEvents = append([]*protos.HistoryEvent{helpers.NewOrchestratorStartedEvent()}, newEvents...)
+		results, err := executor.ExecuteOrchestrator(ctx, iid, history, newEvents)
+		require.NoError(t, err)
+		history = append(history[:len(history):len(history)], newEvents...)
+		return results.Response
+	}
+
+	response := execute(helpers.NewExecutionStartedEvent("Orchestration", string(iid), nil, nil, nil, nil))
+	require.Empty(t, response.Actions)
+	response = execute(helpers.NewEventRaisedEvent("MyEvent", wrapperspb.String("1")))
+	require.Empty(t, response.Actions)
+	require.Equal(t, 1, invocations, "the cached orchestrator should be resumed")
+
+	// A history with different events, e.g. one that was reloaded from the backend, is replayed
+	reloaded := make([]*protos.HistoryEvent, 0, len(history))
+	for _, e := range history {
+		reloaded = append(reloaded, proto.Clone(e).(*protos.HistoryEvent))
+	}
+	history = reloaded
+	response = execute(helpers.NewEventRaisedEvent("MyEvent", wrapperspb.String("2")))
+	require.Empty(t, response.Actions)
+	require.Equal(t, 2, invocations, "the history should be replayed")
+
+	response = execute(helpers.NewEventRaisedEvent("MyEvent", wrapperspb.String("3")))
+	require.Equal(t, 2, invocations, "the cached orchestrator should be resumed")
+	require.Len(t, response.Actions, 1)
+	completeAction := response.Actions[0].GetCompleteOrchestration()
+	require.NotNil(t, completeAction)
+	require.Equal(t, protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED, completeAction.OrchestrationStatus)
+	require.Equal(t, "6", completeAction.Result.GetValue())
+}
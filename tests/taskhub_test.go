@@ -34,8 +34,8 @@ func Test_TaskHubWorkerStopsDependencies(t *testing.T) {
 	actWorker := mocks.NewTaskWorker(t)
 
 	be.EXPECT().Stop(ctx).Return(nil).Once()
-	orchWorker.EXPECT().StopAndDrain().Return().Once()
-	actWorker.EXPECT().StopAndDrain().Return().Once()
+	orchWorker.EXPECT().Drain(ctx).Return(nil).Once()
+	actWorker.EXPECT().Drain(ctx).Return(nil).Once()
 
 	w := backend.NewTaskHubWorker(be, orchWorker, actWorker, logger)
 	err := w.Shutdown(ctx)
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/microsoft/durabletask-go/backend"
+	"github.com/microsoft/durabletask-go/backend/mysql"
+	"github.com/microsoft/durabletask-go/backend/postgres"
+	"github.com/microsoft/durabletask-go/internal/helpers"
+)
+
+// failingDriver is a database/sql driver whose statements succeed outside of transactions, so that task hubs can be
+// created, and fail with err inside of transactions, like transactions that the database rolls back.
+type failingDriver struct {
+	err error
+}
+
+func (d *failingDriver) Open(string) (driver.Conn, error) {
+	return &failingConn{err: d.err}, nil
+}
+
+type failingConn struct {
+	err  error
+	inTx bool
+}
+
+func (c *failingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements aren't supported")
+}
+
+func (c *failingConn) Close() error {
+	return nil
+}
+
+func (c *failingConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *failingConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.inTx = true
+	return c, nil
+}
+
+func (c *failingConn) Commit() error {
+	c.inTx = false
+	return c.err
+}
+
+func (c *failingConn) Rollback() error {
+	c.inTx = false
+	return nil
+}
+
+func (c *failingConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	if c.inTx {
+		return nil, c.err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *failingConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return nil, c.err
+}
+
+// testCompletionErrors checks which database errors the Complete methods of the backends created by newBackend
+// report as transient, so that workers retry the completions.
+func testCompletionErrors(t *testing.T, newBackend func(driverName string) backend.Backend, errs map[error]bool) {
+	ctx := context.Background()
+	i := 0
+	for dbErr, transient := range errs {
+		i++
+		driverName := fmt.Sprintf("failing-%s-%d", t.Name(), i)
+		sql.Register(driverName, &failingDriver{err: dbErr})
+		be := newBackend(driverName)
+		require.NoError(t, be.CreateTaskHub(ctx))
+
+		owi := &backend.OrchestrationWorkItem{
+			InstanceID: "abc",
+			State:      backend.NewOrchestrationRuntimeState("abc", nil),
+		}
+		awi := &backend.ActivityWorkItem{
+			InstanceID: "abc",
+			Result:     helpers.NewTaskCompletedEvent(1, nil),
+		}
+		for _, err := range []error{be.CompleteOrchestrationWorkItem(ctx, owi), be.CompleteActivityWorkItem(ctx, awi)} {
+			if assert.ErrorIs(t, err, dbErr) {
+				assert.Equal(t, transient, errors.Is(err, backend.ErrTransient), "%v", dbErr)
+			}
+		}
+	}
+}
+
+func Test_Postgres_TransientCompletionErrors(t *testing.T) {
+	testCompletionErrors(t, func(driverName string) backend.Backend {
+		opts := postgres.NewPostgresOptions("")
+		opts.DriverName = driverName
+		return postgres.NewPostgresBackend(opts, backend.DefaultLogger())
+	}, map[error]bool{
+		&pgconn.PgError{Code: "40001", Message: "could not serialize access due to concurrent update"}: true,
+		&pgconn.PgError{Code: "40P01", Message: "deadlock detected"}:                                   true,
+		&pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint"}:      false,
+	})
+}
+
+func Test_MySQL_TransientCompletionErrors(t *testing.T) {
+	testCompletionErrors(t, func(driverName string) backend.Backend {
+		opts := mysql.NewMySQLOptions("")
+		opts.DriverName = driverName
+		return mysql.NewMySQLBackend(opts, backend.DefaultLogger())
+	}, map[error]bool{
+		&mysqldriver.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}: true,
+		&mysqldriver.MySQLError{Number: 1062, Message: "Duplicate entry"}:                       false,
+	})
+}
@@ -2,12 +2,17 @@ package tests
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/microsoft/durabletask-go/api"
 	"github.com/microsoft/durabletask-go/backend"
 	"github.com/microsoft/durabletask-go/internal/helpers"
 	"github.com/microsoft/durabletask-go/internal/protos"
+	"github.com/microsoft/durabletask-go/task"
 	"github.com/microsoft/durabletask-go/tests/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -23,7 +28,7 @@ func Test_TryProcessSingleOrchestrationWorkItem_BasicFlow(t *testing.T) {
 	ctx := context.Background()
 	wi := &backend.OrchestrationWorkItem{
 		InstanceID: "test123",
-		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil)},
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
 	}
 	state := &backend.OrchestrationRuntimeState{}
 	result := &backend.ExecutionResults{Response: &protos.OrchestratorResponse{}}
@@ -61,7 +66,7 @@ func Test_TryProcessSingleOrchestrationWorkItem_ExecutionStartedAndCompleted(t *
 	iid := api.InstanceID("test123")
 
 	// Simulate getting an ExecutionStarted message from the orchestration queue
-	startEvent := helpers.NewExecutionStartedEvent("MyOrchestration", string(iid), nil, nil, nil)
+	startEvent := helpers.NewExecutionStartedEvent("MyOrchestration", string(iid), nil, nil, nil, nil)
 	wi := &backend.OrchestrationWorkItem{
 		InstanceID: iid,
 		NewEvents:  []*protos.HistoryEvent{startEvent},
@@ -107,3 +112,915 @@ func Test_TryProcessSingleOrchestrationWorkItem_ExecutionStartedAndCompleted(t *
 	assert.Nil(t, err)
 	assert.True(t, ok)
 }
+
+func Test_TryProcessSingleOrchestrationWorkItem_CompletionRetried(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	state := &backend.OrchestrationRuntimeState{}
+	result := &backend.ExecutionResults{Response: &protos.OrchestratorResponse{}}
+
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+
+	// The first completion attempt fails with a transient error, the second succeeds
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(backend.TransientError(errors.New("database is busy"))).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	// The orchestrator should only be executed once, and the work item should never be abandoned
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteOrchestrator(anyContext, wi.InstanceID, state.OldEvents(), mock.Anything).Return(result, nil).Once()
+
+	worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithCompletionRetries(3, time.Millisecond))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_NonTransientErrorNotRetried(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	state := &backend.OrchestrationRuntimeState{}
+	result := &backend.ExecutionResults{Response: &protos.OrchestratorResponse{}}
+
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+
+	// The completion may have been partially committed, so the work item is abandoned without retrying
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(errors.New("connection reset")).Once()
+	be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteOrchestrator(anyContext, wi.InstanceID, state.OldEvents(), mock.Anything).Return(result, nil).Once()
+
+	worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithCompletionRetries(3, time.Millisecond))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_LockLostNotRetried(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	state := &backend.OrchestrationRuntimeState{}
+	result := &backend.ExecutionResults{Response: &protos.OrchestratorResponse{}}
+
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+
+	// Losing the lock is a permanent error, so the work item is abandoned without retrying
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(backend.ErrWorkItemLockLost).Once()
+	be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteOrchestrator(anyContext, wi.InstanceID, state.OldEvents(), mock.Anything).Return(result, nil).Once()
+
+	worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithCompletionRetries(3, time.Millisecond))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_WorkerDebugSnapshot(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+
+	// Block loading the state so that the work item stays in-flight, and then fail it
+	started := make(chan struct{})
+	release := make(chan struct{})
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Run(func(context.Context, *backend.OrchestrationWorkItem) {
+		close(started)
+		<-release
+	}).Return(nil, errors.New("storage unavailable")).Once()
+	be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	worker := backend.NewOrchestrationWorker(be, nil, logger)
+	ok, err := worker.ProcessNext(ctx)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	<-started
+	snapshot := worker.DebugSnapshot()
+	assert.Equal(t, "orchestration-processor", snapshot.Name)
+	if assert.Len(t, snapshot.InFlight, 1) {
+		assert.Equal(t, wi.InstanceID, snapshot.InFlight[0].InstanceID)
+		assert.False(t, snapshot.InFlight[0].StartedAt.IsZero())
+	}
+	assert.Empty(t, snapshot.RecentErrors)
+
+	close(release)
+	worker.StopAndDrain()
+
+	snapshot = worker.DebugSnapshot()
+	assert.Empty(t, snapshot.InFlight)
+	if assert.Len(t, snapshot.RecentErrors, 1) {
+		assert.Contains(t, snapshot.RecentErrors[0].Message, "storage unavailable")
+	}
+}
+
+func Test_WorkerPollingBackoff(t *testing.T) {
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(nil, backend.ErrNoWorkItems)
+
+	// Without jitter, the delay between polls doubles until it reaches the maximum interval
+	worker := backend.NewOrchestrationWorker(be, nil, logger, backend.WithPollingBackoff(time.Millisecond, 8*time.Millisecond, 2, 0))
+	worker.Start(context.Background())
+	defer worker.StopAndDrain()
+
+	assert.Eventually(t, func() bool {
+		return worker.DebugSnapshot().FetchBackoff == 8*time.Millisecond
+	}, 5*time.Second, time.Millisecond)
+}
+
+func Test_WorkerAutoConcurrency(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+
+	ctx := context.Background()
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(nil, backend.ErrNoWorkItems)
+
+	worker := backend.NewOrchestrationWorker(be, nil, logger, backend.WithAutoConcurrency(1.5))
+	assert.Equal(t, 3, worker.DebugSnapshot().MaxParallelWorkItems)
+
+	// The limit follows GOMAXPROCS
+	runtime.GOMAXPROCS(4)
+	_, err := worker.ProcessNext(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, worker.DebugSnapshot().MaxParallelWorkItems)
+
+	// The limit is never less than one
+	worker = backend.NewOrchestrationWorker(be, nil, logger, backend.WithAutoConcurrency(0.1))
+	assert.Equal(t, 1, worker.DebugSnapshot().MaxParallelWorkItems)
+
+	// An explicit limit takes precedence, regardless of the order of the options
+	worker = backend.NewOrchestrationWorker(be, nil, logger, backend.WithMaxParallelism(5), backend.WithAutoConcurrency(1.5))
+	_, err = worker.ProcessNext(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, worker.DebugSnapshot().MaxParallelWorkItems)
+}
+
+func Test_WorkerConcurrencyLimitsByKind(t *testing.T) {
+	be := mocks.NewBackend(t)
+	opts := []backend.NewTaskWorkerOptions{
+		backend.WithMaxParallelism(10),
+		backend.WithMaxConcurrentOrchestrationWorkItems(3),
+		backend.WithMaxConcurrentActivityWorkItems(5),
+	}
+
+	// Each kind of worker uses its own limit, which takes precedence over the general one
+	orchestrationWorker := backend.NewOrchestrationWorker(be, nil, logger, opts...)
+	assert.Equal(t, 3, orchestrationWorker.DebugSnapshot().MaxParallelWorkItems)
+	activityWorker := backend.NewActivityTaskWorker(be, nil, logger, opts...)
+	assert.Equal(t, 5, activityWorker.DebugSnapshot().MaxParallelWorkItems)
+
+	// The general limit applies to the kinds of workers without a specific limit
+	activityWorker = backend.NewActivityTaskWorker(be, nil, logger, opts[:2]...)
+	assert.Equal(t, 10, activityWorker.DebugSnapshot().MaxParallelWorkItems)
+}
+
+func Test_TryProcessOrchestrationWorkItems_StateCached(t *testing.T) {
+	ctx := context.Background()
+	iid := api.InstanceID("test123")
+	newWorkItem := func(nextSequenceNumber int, e *protos.HistoryEvent) *backend.OrchestrationWorkItem {
+		return &backend.OrchestrationWorkItem{
+			InstanceID:         iid,
+			NewEvents:          []*protos.HistoryEvent{e},
+			NextSequenceNumber: nextSequenceNumber,
+		}
+	}
+	wi1 := newWorkItem(0, helpers.NewExecutionStartedEvent("MyOrch", string(iid), nil, nil, nil, nil))
+	wi2 := newWorkItem(2, helpers.NewEventRaisedEvent("MyEvent", nil))
+	wi3 := newWorkItem(99, helpers.NewEventRaisedEvent("MyEvent", nil)) // stale
+	result := &backend.ExecutionResults{Response: &protos.OrchestratorResponse{}}
+
+	be := mocks.NewBackend(t)
+	ex := mocks.NewExecutor(t)
+	worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithStateCacheSize(10))
+
+	// The first work item loads the state from the backend
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi1, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi1).Return(backend.NewOrchestrationRuntimeState(iid, nil), nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi1).Return(nil).Once()
+	ex.EXPECT().ExecuteOrchestrator(anyContext, iid, mock.Anything, mock.Anything).Return(result, nil).Once()
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// The second work item uses the cached state, which contains the two events saved by the first work item
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi2, nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi2).Return(nil).Once()
+	ex.EXPECT().ExecuteOrchestrator(anyContext, iid, mock.Anything, mock.Anything).Run(
+		func(_ context.Context, _ api.InstanceID, oldEvents []*protos.HistoryEvent, _ []*protos.HistoryEvent) {
+			assert.Len(t, oldEvents, 2)
+		}).Return(result, nil).Once()
+	ok, err = worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// The third work item doesn't match the cached state, so the state is reloaded
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi3, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi3).Return(backend.NewOrchestrationRuntimeState(iid, nil), nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi3).Return(nil).Once()
+	ex.EXPECT().ExecuteOrchestrator(anyContext, iid, mock.Anything, mock.Anything).Return(result, nil).Once()
+	ok, err = worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessOrchestrationWorkItems_CacheStats(t *testing.T) {
+	ctx := context.Background()
+	iid := api.InstanceID("test123")
+	be := &historyBackend{Backend: mocks.NewBackend(t), iid: iid}
+	be.save(helpers.NewExecutionStartedEvent("MyOrch", string(iid), nil, nil, nil, nil))
+	worker := backend.NewOrchestrationWorker(be, noopExecutor{}, discardLogger{}, backend.WithStateCacheSize(1))
+
+	processNext := func() {
+		ok, err := worker.ProcessNext(ctx)
+		worker.StopAndDrain()
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// The first work item loads the state, and the following ones use the cached state
+	for i := 0; i < 3; i++ {
+		processNext()
+	}
+	assert.Equal(t, 1, be.loads)
+	assert.Equal(t, backend.CacheStats{Capacity: 1, Size: 1, Hits: 2, Misses: 1}, worker.CacheStats())
+
+	// An invalidated state is reloaded by the next work item
+	worker.InvalidateCache(iid)
+	assert.Equal(t, 0, worker.CacheStats().Size)
+	processNext()
+	assert.Equal(t, 2, be.loads)
+
+	stats := worker.CacheStats()
+	assert.Equal(t, backend.CacheStats{Capacity: 1, Size: 1, Hits: 2, Misses: 2, Invalidations: 1}, stats)
+	assert.Equal(t, 0.5, stats.HitRate())
+
+	// Workers that don't cache state have no statistics
+	activityWorker := backend.NewActivityTaskWorker(be, nil, discardLogger{})
+	activityWorker.InvalidateCache(iid)
+	assert.Equal(t, backend.CacheStats{}, activityWorker.CacheStats())
+	assert.Equal(t, 0.0, activityWorker.CacheStats().HitRate())
+}
+
+// Benchmark_OrchestrationStateCache measures the cost of processing a work item for an orchestration with a
+// 5000-event history, with and without the runtime state cache of the worker and the orchestrator cache of the
+// executor. Without the caches, the full history is loaded, deserialized, and replayed for every work item.
+func Benchmark_OrchestrationStateCache(b *testing.B) {
+	const historySize = 5000
+	iid := api.InstanceID("test123")
+
+	// The orchestrator waits for one event after the other, so that it replays all the events of the history unless
+	// it's cached
+	r := task.NewTaskRegistry()
+	r.AddOrchestratorN("MyOrch", func(ctx *task.OrchestrationContext) (any, error) {
+		for {
+			if err := ctx.WaitForSingleEvent("MyEvent", -1).Await(nil); err != nil {
+				return nil, err
+			}
+		}
+	})
+
+	for _, cacheSize := range []int{0, 10} {
+		name := "Disabled"
+		if cacheSize > 0 {
+			name = "Enabled"
+		}
+		b.Run(name, func(b *testing.B) {
+			// Each work item saves an OrchestratorStarted and an EventRaised event
+			be := &historyBackend{Backend: mocks.NewBackend(b), iid: iid, completed: make(chan struct{}, 1)}
+			be.save(helpers.NewOrchestratorStartedEvent())
+			be.save(helpers.NewExecutionStartedEvent("MyOrch", string(iid), nil, nil, nil, nil))
+			for len(be.history) < historySize-2 {
+				be.save(helpers.NewOrchestratorStartedEvent())
+				be.save(helpers.NewEventRaisedEvent("MyEvent", nil))
+			}
+			base := be.history[:len(be.history):len(be.history)]
+
+			ctx := context.Background()
+			executor := task.NewTaskExecutor(r, task.WithOrchestratorCacheSize(cacheSize))
+			worker := backend.NewOrchestrationWorker(be, executor, discardLogger{}, backend.WithStateCacheSize(cacheSize))
+			defer worker.StopAndDrain()
+			processNext := func() {
+				if _, err := worker.ProcessNext(ctx); err != nil {
+					b.Fatal(err)
+				}
+				<-be.completed
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// The history is reset before each measured work item, and the work item that brings it back to its
+				// full size leaves its state in the cache, if enabled, like the previous work item of an instance would
+				b.StopTimer()
+				be.history = base
+				processNext()
+				if len(be.history) != historySize {
+					b.Fatalf("expected a history of %d events, got %d", historySize, len(be.history))
+				}
+				b.StartTimer()
+
+				processNext()
+			}
+		})
+	}
+}
+
+// Benchmark_AutoConcurrency measures the throughput of an orchestration worker configured with WithAutoConcurrency
+// for different GOMAXPROCS values, using a backend that takes 1ms to load the state of each work item, which is
+// representative of I/O-bound workloads.
+func Benchmark_AutoConcurrency(b *testing.B) {
+	for _, procs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("GOMAXPROCS=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			be := &latencyBackend{Backend: mocks.NewBackend(b), latency: time.Millisecond}
+
+			ctx := context.Background()
+			worker := backend.NewOrchestrationWorker(be, noopExecutor{}, discardLogger{}, backend.WithAutoConcurrency(4))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := worker.ProcessNext(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			worker.StopAndDrain()
+		})
+	}
+}
+
+// latencyBackend is a fake backend that always has a work item ready, and that takes the specified amount of time
+// to load the runtime state of each work item.
+type latencyBackend struct {
+	*mocks.Backend
+	latency time.Duration
+}
+
+func (be *latencyBackend) GetOrchestrationWorkItem(context.Context) (*backend.OrchestrationWorkItem, error) {
+	return &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewEventRaisedEvent("MyEvent", nil)},
+	}, nil
+}
+
+func (be *latencyBackend) GetOrchestrationRuntimeState(_ context.Context, wi *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	time.Sleep(be.latency)
+	return backend.NewOrchestrationRuntimeState(wi.InstanceID, []*protos.HistoryEvent{
+		helpers.NewExecutionStartedEvent("MyOrch", string(wi.InstanceID), nil, nil, nil, nil),
+	}), nil
+}
+
+func (be *latencyBackend) CompleteOrchestrationWorkItem(context.Context, *backend.OrchestrationWorkItem) error {
+	return nil
+}
+
+// historyBackend is a fake backend for a single orchestration that keeps its history in serialized form, like a
+// real backend would, and always has a work item with one new event ready.
+type historyBackend struct {
+	*mocks.Backend
+	iid     api.InstanceID
+	history [][]byte
+	loads   int // the number of times the runtime state was loaded
+
+	// completed, if not nil, is signaled after each completed work item
+	completed chan struct{}
+}
+
+func (be *historyBackend) save(e *protos.HistoryEvent) {
+	payload, err := backend.MarshalHistoryEvent(e)
+	if err != nil {
+		panic(err)
+	}
+	be.history = append(be.history, payload)
+}
+
+func (be *historyBackend) GetOrchestrationWorkItem(context.Context) (*backend.OrchestrationWorkItem, error) {
+	return &backend.OrchestrationWorkItem{
+		InstanceID:         be.iid,
+		NewEvents:          []*protos.HistoryEvent{helpers.NewEventRaisedEvent("MyEvent", nil)},
+		NextSequenceNumber: len(be.history),
+	}, nil
+}
+
+func (be *historyBackend) GetOrchestrationRuntimeState(context.Context, *backend.OrchestrationWorkItem) (*backend.OrchestrationRuntimeState, error) {
+	be.loads++
+	events := make([]*protos.HistoryEvent, 0, len(be.history))
+	for _, payload := range be.history {
+		e, err := backend.UnmarshalHistoryEvent(payload)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return backend.NewOrchestrationRuntimeState(be.iid, events), nil
+}
+
+func (be *historyBackend) CompleteOrchestrationWorkItem(_ context.Context, wi *backend.OrchestrationWorkItem) error {
+	for _, e := range wi.State.NewEvents() {
+		be.save(e)
+	}
+	if be.completed != nil {
+		be.completed <- struct{}{}
+	}
+	return nil
+}
+
+// noopExecutor is an orchestrator executor that doesn't schedule any actions.
+type noopExecutor struct{}
+
+func (noopExecutor) ExecuteOrchestrator(_ context.Context, iid api.InstanceID, _ []*protos.HistoryEvent, _ []*protos.HistoryEvent) (*backend.ExecutionResults, error) {
+	return &backend.ExecutionResults{Response: &protos.OrchestratorResponse{InstanceId: string(iid)}}, nil
+}
+
+// continueAsNewExecutor is an orchestrator executor that continues-as-new the specified number of times before
+// completing the orchestration.
+type continueAsNewExecutor struct {
+	calls         int
+	completeAfter int
+}
+
+func (ex *continueAsNewExecutor) ExecuteOrchestrator(_ context.Context, iid api.InstanceID, _ []*protos.HistoryEvent, _ []*protos.HistoryEvent) (*backend.ExecutionResults, error) {
+	ex.calls++
+	status := protos.OrchestrationStatus_ORCHESTRATION_STATUS_CONTINUED_AS_NEW
+	if ex.calls > ex.completeAfter {
+		status = protos.OrchestrationStatus_ORCHESTRATION_STATUS_COMPLETED
+	}
+	action := helpers.NewCompleteOrchestrationAction(-1, status, nil, nil, nil)
+	return &backend.ExecutionResults{Response: &protos.OrchestratorResponse{
+		InstanceId: string(iid),
+		Actions:    []*protos.OrchestratorAction{action},
+	}}, nil
+}
+
+// discardLogger is a backend.Logger that discards all messages, which keeps logging out of benchmark results.
+type discardLogger struct{}
+
+func (discardLogger) Debug(v ...any)                 {}
+func (discardLogger) Debugf(format string, v ...any) {}
+func (discardLogger) Info(v ...any)                  {}
+func (discardLogger) Infof(format string, v ...any)  {}
+func (discardLogger) Warn(v ...any)                  {}
+func (discardLogger) Warnf(format string, v ...any)  {}
+func (discardLogger) Error(v ...any)                 {}
+func (discardLogger) Errorf(format string, v ...any) {}
+
+func Test_TryProcessSingleOrchestrationWorkItem_TimestampSource(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, nil)
+	result := &backend.ExecutionResults{Response: &protos.OrchestratorResponse{}}
+	authorityTime := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	// The orchestrator-started event should be stamped with the time from the timestamp source
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteOrchestrator(anyContext, wi.InstanceID, mock.Anything, mock.Anything).Run(
+		func(_ context.Context, _ api.InstanceID, _ []*protos.HistoryEvent, newEvents []*protos.HistoryEvent) {
+			if assert.NotEmpty(t, newEvents) && assert.NotNil(t, newEvents[0].GetOrchestratorStarted()) {
+				assert.Equal(t, authorityTime, newEvents[0].Timestamp.AsTime())
+			}
+		}).Return(result, nil).Once()
+
+	worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithTimestampSource(fixedTimestampSource(authorityTime)))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_TimestampSourceAppliedActions(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, nil)
+	authorityTime := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	// The orchestration continues as new once, and then completes
+	worker := backend.NewOrchestrationWorker(be, &continueAsNewExecutor{completeAfter: 1}, logger, backend.WithTimestampSource(fixedTimestampSource(authorityTime)))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, state.IsCompleted())
+
+	// The events of the new generation are created by the worker, so they're stamped with the time from the
+	// timestamp source
+	for _, e := range state.NewEvents() {
+		assert.Equal(t, authorityTime, e.Timestamp.AsTime(), "unexpected timestamp of %v", e)
+	}
+	completedTime, err := state.CompletedTime()
+	assert.Nil(t, err)
+	assert.Equal(t, authorityTime, completedTime)
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_TimestampSourceInvalidState(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewEventRaisedEvent("MyEvent", nil)},
+	}
+	state := backend.NewOrchestrationRuntimeState(wi.InstanceID, []*protos.HistoryEvent{helpers.NewOrchestratorStartedEvent()})
+	authorityTime := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	worker := backend.NewOrchestrationWorker(be, mocks.NewExecutor(t), logger,
+		backend.WithInvalidStatePolicy(backend.InvalidStateFail),
+		backend.WithTimestampSource(fixedTimestampSource(authorityTime)))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	completedTime, err := state.CompletedTime()
+	assert.Nil(t, err)
+	assert.Equal(t, authorityTime, completedTime)
+}
+
+func Test_TryProcessOrchestrationWorkItems_OrderedCompletions(t *testing.T) {
+	ctx := context.Background()
+	wi1 := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	wi2 := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+
+	// The first work item takes longer to process than the second one
+	release := make(chan struct{})
+	completed := make(chan *backend.OrchestrationWorkItem, 2)
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi1, nil).Once()
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi2, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi1).Run(func(context.Context, *backend.OrchestrationWorkItem) {
+		<-release
+	}).Return(backend.NewOrchestrationRuntimeState(wi1.InstanceID, nil), nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi2).Return(backend.NewOrchestrationRuntimeState(wi2.InstanceID, nil), nil).Once()
+	be.EXPECT().CompleteOrchestrationWorkItem(anyContext, mock.Anything).Run(func(_ context.Context, wi *backend.OrchestrationWorkItem) {
+		completed <- wi
+	}).Return(nil).Twice()
+
+	worker := backend.NewOrchestrationWorker(be, noopExecutor{}, logger, backend.WithMaxParallelism(2), backend.WithOrderedCompletions(true))
+	for i := 0; i < 2; i++ {
+		ok, err := worker.ProcessNext(ctx)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// The second work item can't be completed before the first one
+	select {
+	case <-completed:
+		assert.Fail(t, "work item was completed out of order")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	worker.StopAndDrain()
+	close(completed)
+	order := make([]*backend.OrchestrationWorkItem, 0, 2)
+	for wi := range completed {
+		order = append(order, wi)
+	}
+	if assert.Len(t, order, 2) {
+		assert.Same(t, wi1, order[0])
+		assert.Same(t, wi2, order[1])
+	}
+}
+
+func Test_TryProcessActivityWorkItems_FetchBatch(t *testing.T) {
+	ctx := context.Background()
+	wis := make([]*backend.ActivityWorkItem, 3)
+	for i := range wis {
+		wis[i] = &backend.ActivityWorkItem{
+			SequenceNumber: int64(i),
+			InstanceID:     "test123",
+			NewEvent:       helpers.NewTaskScheduledEvent(int32(i), "MyActivity", nil, nil, nil),
+		}
+	}
+	result := helpers.NewTaskCompletedEvent(0, nil)
+
+	// The batch is limited to the batch size, although more work items could be processed in parallel
+	be := activityBatchBackend{mocks.NewBackend(t)}
+	be.On("GetActivityWorkItems", anyContext, 3).Return(wis, nil).Once()
+	be.EXPECT().CompleteActivityWorkItem(anyContext, mock.Anything).Return(nil).Times(3)
+
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteActivity(anyContext, api.InstanceID("test123"), mock.Anything).Return(result, nil).Times(3)
+
+	worker := backend.NewActivityTaskWorker(be, ex, logger, backend.WithMaxParallelism(4), backend.WithFetchBatchSize(3))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessActivityWorkItems_FetchBatch_OneAtATime(t *testing.T) {
+	ctx := context.Background()
+	result := helpers.NewTaskCompletedEvent(0, nil)
+
+	// The work items of backends that can't fetch batches are fetched one at a time, until there are no more
+	be := mocks.NewBackend(t)
+	for i := 0; i < 2; i++ {
+		wi := &backend.ActivityWorkItem{
+			SequenceNumber: int64(i),
+			InstanceID:     "test123",
+			NewEvent:       helpers.NewTaskScheduledEvent(int32(i), "MyActivity", nil, nil, nil),
+		}
+		be.EXPECT().GetActivityWorkItem(anyContext).Return(wi, nil).Once()
+	}
+	be.EXPECT().GetActivityWorkItem(anyContext).Return(nil, backend.ErrNoWorkItems).Once()
+	be.EXPECT().CompleteActivityWorkItem(anyContext, mock.Anything).Return(nil).Times(2)
+
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteActivity(anyContext, api.InstanceID("test123"), mock.Anything).Return(result, nil).Times(2)
+
+	worker := backend.NewActivityTaskWorker(be, ex, logger, backend.WithMaxParallelism(4), backend.WithFetchBatchSize(3))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessActivityWorkItem_NoLockRenewal(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.ActivityWorkItem{
+		SequenceNumber: 1,
+		InstanceID:     "test123",
+		NewEvent:       helpers.NewTaskScheduledEvent(1, "MyActivity", nil, nil, nil),
+	}
+	result := helpers.NewTaskCompletedEvent(1, nil)
+
+	// The mock backend can't renew locks, so the slow activity completes without any renewal
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetActivityWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().CompleteActivityWorkItem(anyContext, wi).Return(nil).Once()
+
+	ex := mocks.NewExecutor(t)
+	ex.EXPECT().ExecuteActivity(anyContext, api.InstanceID("test123"), mock.Anything).Run(func(context.Context, api.InstanceID, *protos.HistoryEvent) {
+		time.Sleep(50 * time.Millisecond)
+	}).Return(result, nil).Once()
+
+	worker := backend.NewActivityTaskWorker(be, ex, logger, backend.WithLockRenewalInterval(10*time.Millisecond))
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_UnsupportedAbandoned(t *testing.T) {
+	ctx := context.Background()
+	wi := &backend.OrchestrationWorkItem{
+		InstanceID: "test123",
+		NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+	}
+	state := &backend.OrchestrationRuntimeState{}
+
+	// The mock backend can't defer work items, so the unsupported work item is abandoned instead of left locked
+	be := mocks.NewBackend(t)
+	be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+	be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+	be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+
+	// The orchestrator is never executed, since the executor doesn't advertise it
+	ex := &capabilitiesExecutor{
+		Executor: mocks.NewExecutor(t),
+		capabilities: &backend.ExecutorCapabilities{
+			ProtocolVersion: 1,
+			Negotiated:      true,
+			Orchestrators:   []string{"OtherOrch"},
+		},
+	}
+
+	worker := backend.NewOrchestrationWorker(be, ex, logger)
+	ok, err := worker.ProcessNext(ctx)
+	worker.StopAndDrain()
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+// activityBatchBackend is a mock backend that implements [backend.BackendWithActivityBatches].
+type activityBatchBackend struct {
+	*mocks.Backend
+}
+
+func (be activityBatchBackend) GetActivityWorkItems(ctx context.Context, max int) ([]*backend.ActivityWorkItem, error) {
+	ret := be.Called(ctx, max)
+	return ret.Get(0).([]*backend.ActivityWorkItem), ret.Error(1)
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_InvalidStatePolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         backend.InvalidStatePolicy
+		expectAbandon  bool
+		expectedStatus protos.OrchestrationStatus
+	}{
+		{"Drop", backend.InvalidStateDrop, false, protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING},
+		{"Fail", backend.InvalidStateFail, false, protos.OrchestrationStatus_ORCHESTRATION_STATUS_FAILED},
+		// The mock backend doesn't support dead letters, so the work item is abandoned instead of quarantined
+		{"Quarantine", backend.InvalidStateQuarantine, true, protos.OrchestrationStatus_ORCHESTRATION_STATUS_PENDING},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			wi := &backend.OrchestrationWorkItem{
+				InstanceID: "test123",
+				NewEvents:  []*protos.HistoryEvent{helpers.NewEventRaisedEvent("MyEvent", nil)},
+			}
+
+			// The saved history is missing its ExecutionStarted event, which makes the state invalid
+			state := backend.NewOrchestrationRuntimeState(wi.InstanceID, []*protos.HistoryEvent{helpers.NewOrchestratorStartedEvent()})
+
+			be := mocks.NewBackend(t)
+			be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+			be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+			if tt.expectAbandon {
+				be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+			} else {
+				be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+			}
+
+			// The orchestrator is never executed for an invalid state
+			ex := mocks.NewExecutor(t)
+
+			worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithInvalidStatePolicy(tt.policy))
+			ok, err := worker.ProcessNext(ctx)
+			worker.StopAndDrain()
+
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.expectedStatus, state.RuntimeStatus())
+		})
+	}
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_EmptyWorkItemPolicy(t *testing.T) {
+	tests := []struct {
+		name              string
+		policy            backend.EmptyWorkItemPolicy
+		expectAbandon     bool
+		expectedNewEvents int
+	}{
+		{"Warn", backend.EmptyWorkItemWarn, false, 1},
+		{"Drop", backend.EmptyWorkItemDrop, false, 0},
+		{"Error", backend.EmptyWorkItemError, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			wi := &backend.OrchestrationWorkItem{InstanceID: "test123"}
+			state := backend.NewOrchestrationRuntimeState(wi.InstanceID, []*protos.HistoryEvent{
+				helpers.NewOrchestratorStartedEvent(),
+				helpers.NewExecutionStartedEvent("MyOrch", string(wi.InstanceID), nil, nil, nil, nil),
+			})
+
+			be := mocks.NewBackend(t)
+			be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+			be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+			if tt.expectAbandon {
+				be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+			} else {
+				be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+			}
+
+			// The orchestrator is never executed for an empty work item
+			ex := mocks.NewExecutor(t)
+
+			worker := backend.NewOrchestrationWorker(be, ex, logger, backend.WithEmptyWorkItemPolicy(tt.policy))
+			ok, err := worker.ProcessNext(ctx)
+			worker.StopAndDrain()
+
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Len(t, state.NewEvents(), tt.expectedNewEvents)
+			if tt.expectAbandon {
+				if errs := worker.DebugSnapshot().RecentErrors; assert.Len(t, errs, 1) {
+					assert.Contains(t, errs[0].Message, backend.ErrEmptyWorkItem.Error())
+				}
+			}
+		})
+	}
+}
+
+func Test_TryProcessSingleOrchestrationWorkItem_MaxContinueAsNewCount(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int
+		policy        backend.ContinueAsNewLimitPolicy
+		expectedCalls int
+		expectFailure bool
+		expectYield   bool
+	}{
+		{"LimitExceeded", 3, backend.ContinueAsNewLimitFail, 4, true, false},
+		{"Yield", 3, backend.ContinueAsNewLimitYield, 4, false, true},
+		{"Unlimited", 0, backend.ContinueAsNewLimitFail, 31, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			wi := &backend.OrchestrationWorkItem{
+				InstanceID: "test123",
+				NewEvents:  []*protos.HistoryEvent{helpers.NewExecutionStartedEvent("MyOrch", "test123", nil, nil, nil, nil)},
+			}
+			state := backend.NewOrchestrationRuntimeState(wi.InstanceID, nil)
+
+			be := mocks.NewBackend(t)
+			be.EXPECT().GetOrchestrationWorkItem(anyContext).Return(wi, nil).Once()
+			be.EXPECT().GetOrchestrationRuntimeState(anyContext, wi).Return(state, nil).Once()
+			if tt.expectFailure {
+				be.EXPECT().AbandonOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+			} else {
+				be.EXPECT().CompleteOrchestrationWorkItem(anyContext, wi).Return(nil).Once()
+			}
+
+			// The orchestrator continues-as-new in a tight loop 30 times before completing
+			ex := &continueAsNewExecutor{completeAfter: 30}
+
+			worker := backend.NewOrchestrationWorker(be, ex, logger,
+				backend.WithMaxContinueAsNewCount(tt.limit),
+				backend.WithContinueAsNewLimitPolicy(tt.policy))
+			ok, err := worker.ProcessNext(ctx)
+			worker.StopAndDrain()
+
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.expectedCalls, ex.calls)
+
+			// A yielding orchestration saves its latest generation and wakes it up with a timer
+			if tt.expectYield {
+				assert.True(t, state.ContinuedAsNew())
+				assert.False(t, state.IsCompleted())
+				if timers := state.PendingTimers(); assert.Len(t, timers, 1) {
+					assert.NotNil(t, timers[0].GetTimerFired())
+				}
+			}
+
+			// The error should identify the orchestration and the configured limit
+			errs := worker.DebugSnapshot().RecentErrors
+			if tt.expectFailure && assert.Len(t, errs, 1) {
+				assert.Contains(t, errs[0].Message, "test123")
+				assert.Contains(t, errs[0].Message, "limit of 3")
+			} else if !tt.expectFailure {
+				assert.Empty(t, errs)
+			}
+		})
+	}
+}
+
+// fixedTimestampSource is a backend.TimestampSource that always returns the same time.
+type fixedTimestampSource time.Time
+
+func (ts fixedTimestampSource) Now(context.Context) (time.Time, error) {
+	return time.Time(ts), nil
+}